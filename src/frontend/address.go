@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// checkoutAddress is the shipping address and e-mail of the checkout form.
+// That of the last order is kept encrypted in the shop_address cookie to
+// estimate shipping and pre-fill the next checkout. Payment details are never
+// saved.
+type checkoutAddress struct {
+	Email         string `json:"email"`
+	StreetAddress string `json:"street_address"`
+	City          string `json:"city"`
+	State         string `json:"state"`
+	Country       string `json:"country"` // code, or name in older cookies
+	ZipCode       string `json:"zip_code"`
+}
+
+// shippingAddress returns a as the checkout and shipping services take it.
+// Their zip_code is a number, so postal codes that do not survive being one,
+// with letters or a leading zero, go after the city instead.
+func (a *checkoutAddress) shippingAddress() *pb.Address {
+	addr := &pb.Address{
+		StreetAddress: a.StreetAddress,
+		City:          a.City,
+		State:         a.State,
+		Country:       a.Country,
+	}
+	if c, ok := lookupCountry(a.Country); ok {
+		addr.Country = c.Name
+	}
+	zip := strings.TrimSpace(a.ZipCode)
+	digits := strings.NewReplacer("-", "", " ", "").Replace(zip)
+	if n, err := strconv.ParseInt(digits, 10, 32); err == nil && n > 0 && digits[0] != '0' {
+		addr.ZipCode = int32(n)
+	} else if zip != "" {
+		addr.City += " " + zip
+	}
+	return addr
+}
+
+// saveAddress remembers a for the user's next visit to the cart.
+func (fe *frontendServer) saveAddress(w http.ResponseWriter, a checkoutAddress) {
+	if fe.cookieSealer == nil {
+		return
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		panic(err) // only strings
+	}
+	http.SetCookie(w, newCookie(cookieAddress, fe.cookieSealer.seal(cookieAddress, b)))
+}
+
+// savedCheckout returns the address stored by saveAddress, or nil if there is
+// none or the cookie cannot be decrypted, such as after SESSION_SECRET was
+// rotated.
+func (fe *frontendServer) savedCheckout(r *http.Request) *checkoutAddress {
+	c, err := r.Cookie(cookieAddress)
+	if err != nil || fe.cookieSealer == nil {
+		return nil
+	}
+	b, ok := fe.cookieSealer.open(cookieAddress, c.Value)
+	if !ok {
+		return nil
+	}
+	var a checkoutAddress
+	if err := json.Unmarshal(b, &a); err != nil || a.StreetAddress == "" {
+		return nil
+	}
+	return &a
+}
+
+// savedAddress returns the shipping address of savedCheckout.
+func (fe *frontendServer) savedAddress(r *http.Request) *pb.Address {
+	a := fe.savedCheckout(r)
+	if a == nil {
+		return nil
+	}
+	return a.shippingAddress()
+}
+
+// clearAddressHandler forgets the saved address, and goes back to the cart
+// with the demo details in the checkout form.
+func (fe *frontendServer) clearAddressHandler(w http.ResponseWriter, r *http.Request) {
+	loggerFromContext(r.Context()).Debug("clearing saved address")
+	http.SetCookie(w, expiredCookie(cookieAddress))
+	w.Header().Set("location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+// setAddressValues fills in the address fields of the checkout form.
+func setAddressValues(form url.Values, a *checkoutAddress) {
+	if a.Email != "" {
+		form.Set("email", a.Email)
+	}
+	form.Set("street_address", a.StreetAddress)
+	form.Set("city", a.City)
+	form.Set("state", a.State)
+	if c, ok := lookupCountry(a.Country); ok {
+		form.Set("country", c.Code)
+	}
+	form.Set("zip_code", a.ZipCode)
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+var testAddress = &pb.Address{
+	StreetAddress: "1 Main Street",
+	City:          "Springfield",
+	State:         "OR",
+	Country:       "United States",
+	ZipCode:       97477,
+}
+
+// testCheckoutAddress is testAddress as entered in the checkout form.
+var testCheckoutAddress = checkoutAddress{
+	Email:         "ada@example.com",
+	StreetAddress: "1 Main Street",
+	City:          "Springfield",
+	State:         "OR",
+	Country:       "US",
+	ZipCode:       "97477",
+}
+
+// withSavedAddress adds the cookie set by saveAddress(testCheckoutAddress) to r.
+func withSavedAddress(fe *frontendServer, r *http.Request) *http.Request {
+	w := httptest.NewRecorder()
+	fe.saveAddress(w, testCheckoutAddress)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestSavedAddress(t *testing.T) {
+	fe := &frontendServer{cookieSealer: newCookieSealer("secret")}
+	r := withSavedAddress(fe, newTestRequest(http.MethodGet, "/cart", nil))
+	if got := fe.savedCheckout(r); got == nil || *got != testCheckoutAddress {
+		t.Errorf("savedCheckout = %+v, want %+v", got, testCheckoutAddress)
+	}
+	if got := fe.savedAddress(r); !proto.Equal(got, testAddress) {
+		t.Errorf("savedAddress = %v, want %v", got, testAddress)
+	}
+	c, _ := r.Cookie(cookieAddress)
+	if strings.Contains(c.Value, "eyJ") || strings.Contains(c.Value, "Springfield") {
+		t.Errorf("address cookie is readable: %q", c.Value)
+	}
+
+	// A rotated secret still opens cookies sealed with the old one; once the
+	// old one is gone, they are ignored.
+	if got := (&frontendServer{cookieSealer: newCookieSealer("new,secret")}).savedAddress(r); !proto.Equal(got, testAddress) {
+		t.Errorf("after rotation: savedAddress = %v", got)
+	}
+	if got := (&frontendServer{cookieSealer: newCookieSealer("new")}).savedAddress(r); got != nil {
+		t.Errorf("old secret dropped: savedAddress = %v, want nil", got)
+	}
+
+	tampered := []byte(c.Value)
+	tampered[len(tampered)/2] ^= 'A' ^ 'B'
+	for _, value := range []string{"", "garbage", "eyJzdHJlZXRfYWRkcmVzcyI6IngifQ.forged", string(tampered)} {
+		r := newTestRequest(http.MethodGet, "/cart", nil)
+		r.AddCookie(&http.Cookie{Name: cookieAddress, Value: value})
+		if got := fe.savedAddress(r); got != nil {
+			t.Errorf("cookie %q: savedAddress = %v, want nil", value, got)
+		}
+	}
+}
+
+func TestViewCartShippingEstimate(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, withSavedAddress(fe, newTestRequest(http.MethodGet, "/cart", nil)))
+	body := w.Body.String()
+	if !strings.Contains(body, "Estimated shipping") || !strings.Contains(body, "$28.98") {
+		t.Error("cart page does not show the shipping estimate and grand total")
+	}
+	if !strings.Contains(body, `value="1 Main Street"`) {
+		t.Error("checkout form is not pre-filled with the saved address")
+	}
+	if !proto.Equal(fb.quoteAddress, testAddress) {
+		t.Errorf("quote requested for %v, want %v", fb.quoteAddress, testAddress)
+	}
+
+	fb.setError("GetQuote", status.Error(codes.Unavailable, "down"))
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, withSavedAddress(fe, newTestRequest(http.MethodGet, "/cart", nil)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("shipping down: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if strings.Contains(w.Body.String(), "Estimated shipping") {
+		t.Error("shipping down: cart page shows an estimate")
+	}
+}
+
+func TestPlaceOrderSavesAddress(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	w := placeTestOrder(t, fe)
+
+	r := newTestRequest(http.MethodGet, "/cart", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if got := fe.savedCheckout(r); got == nil || got.StreetAddress != "1600 Amphitheatre Parkway" || got.ZipCode != "94043" ||
+		got.Country != "US" || got.Email != "someone@example.com" {
+		t.Errorf("saved address = %+v, want the one the order shipped to", got)
+	}
+	c, _ := r.Cookie(cookieAddress)
+	b, _ := fe.cookieSealer.open(cookieAddress, c.Value)
+	if strings.Contains(string(b), "credit") || strings.Contains(string(b), "4432") {
+		t.Errorf("payment details saved: %s", b)
+	}
+}
+
+func TestCheckoutPrefilledFromSavedAddress(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, withSavedAddress(fe, newTestRequest(http.MethodGet, "/cart", nil)))
+	body := w.Body.String()
+	if !strings.Contains(body, `value="ada@example.com"`) || !strings.Contains(body, `value="Springfield"`) {
+		t.Error("checkout form is not pre-filled with the saved e-mail and address")
+	}
+	if !strings.Contains(body, "/cart/address/clear") {
+		t.Error("no way to clear the saved address")
+	}
+
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if strings.Contains(w.Body.String(), "/cart/address/clear") {
+		t.Error("offers to clear an address that was not saved")
+	}
+}
+
+func TestClearAddressHandler(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	fe.clearAddressHandler(w, withSavedAddress(fe, newTestRequest(http.MethodPost, "/cart/address/clear", nil)))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/cart" {
+		t.Errorf("got status %d to %q, want a redirect to the cart", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != cookieAddress || cookies[0].MaxAge >= 0 {
+		t.Errorf("cookies = %v, want the address cookie expired", cookies)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// logLevelHandler reports the level of log on GET and changes it on PUT, with
+// a JSON body such as {"level": "debug"}. The change lasts until the next
+// restart.
+func logLevelHandler(log *logrus.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var body logLevelBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSON(log, w, http.StatusBadRequest, apiError{Error: "invalid request body", Code: http.StatusBadRequest})
+				return
+			}
+			level, err := logrus.ParseLevel(body.Level)
+			if err != nil {
+				writeJSON(log, w, http.StatusBadRequest, apiError{Error: err.Error(), Code: http.StatusBadRequest})
+				return
+			}
+			// Logged at warn so that the change shows up whichever level it
+			// moves from or to, short of error-only logging.
+			log.WithFields(logrus.Fields{
+				"log.level.from": log.GetLevel().String(),
+				"log.level.to":   level.String(),
+				"client_ip":      clientIP(r),
+			}).Warn("log level changed")
+			log.SetLevel(level)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeJSON(log, w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed", Code: http.StatusMethodNotAllowed})
+			return
+		}
+		writeJSON(log, w, http.StatusOK, logLevelBody{Level: log.GetLevel().String()})
+	}
+}
+
+// requireAdminToken rejects requests that do not carry token as a bearer
+// token. An empty token lets every request through, for the admin port.
+func requireAdminToken(token string, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(log, w, http.StatusUnauthorized, apiError{Error: "unauthorized", Code: http.StatusUnauthorized})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// adminHandler serves the admin listener on ADMIN_PORT: log level control,
+// pprof, /debug/status, /debug/config, /debug/flags, /debug/chaos and
+// /admin/cache/flush. It shares nothing with the public router, which only
+// gets /debug/loglevel, and only when ADMIN_TOKEN is set.
+// When it is, the token guards every admin endpoint.
+func (fe *frontendServer) adminHandler(log *logrus.Logger, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/loglevel", logLevelHandler(log))
+	mux.HandleFunc("/debug/status", fe.debugStatusHandler)
+	mux.HandleFunc("/debug/config", debugConfigHandler)
+	mux.HandleFunc("/admin/cache/flush", fe.cacheFlushHandler)
+	mux.HandleFunc("/debug/flags", fe.debugFlagsHandler)
+	mux.HandleFunc("/debug/reload", fe.reloadHandler(log))
+	if chaos != nil {
+		mux.HandleFunc("/debug/chaos", chaos.handler(log))
+	}
+
+	// These are the handlers net/http/pprof registers on
+	// http.DefaultServeMux, which nothing serves.
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return requireAdminToken(token, mux)
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/featureflags"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	defaultAdSlots = 1
+
+	// maxServedAds bounds the number of distinct ads remembered for click
+	// validation. The ad service only has a handful.
+	maxServedAds = 1000
+)
+
+var adClicksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ad_clicks_total",
+	Help: "Number of ad clicks, by the host the ad redirects to (\"self\" for links within the shop).",
+}, []string{"host"})
+
+// servedAds remembers the ads shown to users by redirect URL, so that
+// /ad/click only redirects to a real ad's target. It is per replica: a click
+// routed to a replica that never served the ad is rejected.
+type servedAds struct {
+	mu   sync.Mutex
+	text map[string]string
+}
+
+func newServedAds() *servedAds {
+	return &servedAds{text: make(map[string]string)}
+}
+
+func (s *servedAds) add(ads []*pb.Ad) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ad := range ads {
+		if _, ok := s.text[ad.GetRedirectUrl()]; !ok && len(s.text) >= maxServedAds {
+			continue
+		}
+		s.text[ad.GetRedirectUrl()] = ad.GetText()
+	}
+}
+
+func (s *servedAds) lookup(target string) (text string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	text, ok = s.text[target]
+	return text, ok
+}
+
+// chooseAds queries for ads matching ctxKeys and picks up to fe.adSlots of
+// them at random. It ignores the error retrieving ads since they are not
+// critical, and returns none when ads are disabled or to crawlers.
+func (fe *frontendServer) chooseAds(ctx context.Context, ctxKeys []string, log logrus.FieldLogger) []*pb.Ad {
+	if !fe.adsEnabled() || isBot(ctx) || !featureflags.Enabled(ctx, featureAds) {
+		return nil
+	}
+	ads, err := fe.getAd(ctx, ctxKeys)
+	if err != nil {
+		log.WithField("error", err).Warn("failed to retrieve ads")
+		return nil
+	}
+	out := make([]*pb.Ad, 0, fe.adSlots)
+	for _, i := range rand.Perm(len(ads)) {
+		if len(out) == fe.adSlots {
+			break
+		}
+		out = append(out, ads[i])
+	}
+	fe.servedAds.add(out)
+	return out
+}
+
+// productCategories returns the distinct categories of products, sorted, for
+// use as ad context keys and in the navigation.
+func productCategories(products ...*pb.Product) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, p := range products {
+		for _, c := range p.GetCategories() {
+			if !seen[c] {
+				seen[c] = true
+				out = append(out, c)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// adClickHandler records a click on an ad and redirects to its target, which
+// must be the redirect URL of an ad this replica served.
+func (fe *frontendServer) adClickHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	target := r.URL.Query().Get("target")
+	text, ok := fe.servedAds.lookup(target)
+	if !ok {
+		renderHTTPError(log, r, w, errors.Errorf("unknown ad target %q", target), http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "invalid ad target"), http.StatusBadRequest)
+		return
+	}
+
+	host := "self"
+	if u.Host != "" {
+		host = u.Hostname()
+	} else {
+		// Ad links within the shop are relative to its base path.
+		target = baseUrl + "/" + strings.TrimLeft(target, "/")
+	}
+	adClicksTotal.WithLabelValues(host).Inc()
+	log.WithFields(logrus.Fields{
+		"event":     "ad_click",
+		"session":   sessionID(r),
+		"ad.text":   text,
+		"ad.target": target,
+	}).Info("ad clicked")
+	http.Redirect(w, r, target, http.StatusFound)
+}
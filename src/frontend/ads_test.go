@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestChooseAds(t *testing.T) {
+	fb := newFakeBackend()
+	fb.ads = []*pb.Ad{
+		{RedirectUrl: "/product/1", Text: "one"},
+		{RedirectUrl: "/product/2", Text: "two"},
+		{RedirectUrl: "/product/3", Text: "three"},
+	}
+	fe := newTestFrontend(t, fb)
+	fe.adSlots = 2
+	ctx := newTestRequest(http.MethodGet, "/", nil).Context()
+
+	ads := fe.chooseAds(ctx, nil, discardLog)
+	if len(ads) != 2 || ads[0] == ads[1] {
+		t.Errorf("got %v, want two different ads", ads)
+	}
+
+	fb.ads = nil
+	if ads := fe.chooseAds(ctx, nil, discardLog); len(ads) != 0 {
+		t.Errorf("got %v with no ads available, want none", ads)
+	}
+}
+
+func TestCartAdsUseCartCategories(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{
+		{ProductId: "66VCHSJNUP", Quantity: 1},
+		{ProductId: "OLJCESPC7Z", Quantity: 1},
+	}
+	fe := newTestFrontend(t, fb)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if want := []string{"accessories", "clothing", "tops"}; !reflect.DeepEqual(fb.adContextKeys, want) {
+		t.Errorf("ad context keys = %v, want %v", fb.adContextKeys, want)
+	}
+	if !strings.Contains(w.Body.String(), `/ad/click?target=%2fproduct%2f1YMWWN1N4O`) {
+		t.Error("cart page does not link the ad through /ad/click")
+	}
+}
+
+func TestAdClickHandler(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.servedAds.add([]*pb.Ad{
+		{RedirectUrl: "/product/1YMWWN1N4O", Text: "Watch for sale"},
+		{RedirectUrl: "https://ads.example.com/offer", Text: "Elsewhere"},
+	})
+
+	click := func(target string) (*httptest.ResponseRecorder, *logtest.Hook) {
+		logger, hook := logtest.NewNullLogger()
+		r := newTestRequest(http.MethodGet, "/ad/click?target="+url.QueryEscape(target), nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(logger)))
+		w := httptest.NewRecorder()
+		fe.adClickHandler(w, r)
+		return w, hook
+	}
+
+	before := testutil.ToFloat64(adClicksTotal.WithLabelValues("self"))
+	w, hook := click("/product/1YMWWN1N4O")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/product/1YMWWN1N4O" {
+		t.Fatalf("got status %d to %q, want a redirect to the product", w.Code, w.Header().Get("Location"))
+	}
+	if got := testutil.ToFloat64(adClicksTotal.WithLabelValues("self")) - before; got != 1 {
+		t.Errorf("ad_clicks_total{host=self} increased by %v, want 1", got)
+	}
+	e := hook.LastEntry()
+	if e == nil || e.Data["event"] != "ad_click" || e.Data["session"] != "test-session" || e.Data["ad.text"] != "Watch for sale" {
+		t.Errorf("click log entry = %+v", e)
+	}
+
+	before = testutil.ToFloat64(adClicksTotal.WithLabelValues("ads.example.com"))
+	if w, _ := click("https://ads.example.com/offer"); w.Header().Get("Location") != "https://ads.example.com/offer" {
+		t.Errorf("external ad redirected to %q", w.Header().Get("Location"))
+	}
+	if got := testutil.ToFloat64(adClicksTotal.WithLabelValues("ads.example.com")) - before; got != 1 {
+		t.Errorf("ad_clicks_total{host=ads.example.com} increased by %v, want 1", got)
+	}
+
+	for _, target := range []string{"https://evil.example.com/", "//evil.example.com/", "/product/other", ""} {
+		if w, _ := click(target); w.Code != http.StatusBadRequest {
+			t.Errorf("target %q: got status %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
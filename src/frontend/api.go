@@ -0,0 +1,424 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+// Handlers under /api return JSON, including for errors, so that scripts and
+// the SPA never have to parse an HTML error page.
+
+const (
+	// maxAPIProductIDs caps the IDs of one product lookup.
+	maxAPIProductIDs = 20
+	// productLookupWorkers bounds the concurrent catalog calls of a lookup.
+	productLookupWorkers = 5
+)
+
+type apiError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+	// Reason identifies the error for scripts, such as "invalid_quantity",
+	// where the status code alone is ambiguous.
+	Reason string `json:"reason,omitempty"`
+}
+
+type apiMoney struct {
+	CurrencyCode string `json:"currency_code"`
+	Units        int64  `json:"units"`
+	Nanos        int32  `json:"nanos"`
+	Formatted    string `json:"formatted"`
+}
+
+func newAPIMoney(m *pb.Money, l money.Locale) apiMoney {
+	return apiMoney{
+		CurrencyCode: m.GetCurrencyCode(),
+		Units:        m.GetUnits(),
+		Nanos:        m.GetNanos(),
+		Formatted:    l.Format(*m),
+	}
+}
+
+type apiCartItem struct {
+	ProductID string   `json:"product_id"`
+	Name      string   `json:"name"`
+	Picture   string   `json:"picture"`
+	Variant   string   `json:"variant,omitempty"`
+	Quantity  int32    `json:"quantity"`
+	UnitPrice apiMoney `json:"unit_price"`
+	LineTotal apiMoney `json:"line_total"`
+}
+
+type apiCart struct {
+	Items     []apiCartItem `json:"items"`
+	ItemCount int           `json:"item_count"`
+	Subtotal  apiMoney      `json:"subtotal"`
+	// PromoCode and Discount are omitted without a promo code.
+	PromoCode string    `json:"promo_code,omitempty"`
+	Discount  *apiMoney `json:"discount,omitempty"`
+	// EstimatedShipping is null when shipping could not be estimated.
+	EstimatedShipping *apiMoney `json:"estimated_shipping"`
+	Total             apiMoney  `json:"total"`
+	// UnavailableProductIDs are products in the cart that the catalog no
+	// longer has, left out of Items.
+	UnavailableProductIDs []string `json:"unavailable_product_ids,omitempty"`
+}
+
+func (fe *frontendServer) apiCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	log.Debug("api: view user cart")
+
+	cart, view, err := fe.sessionCartView(r)
+	if err != nil {
+		renderAPIGRPCError(log, r, w, err)
+		return
+	}
+
+	loc := userLocale(r)
+	out := apiCart{
+		Items:     make([]apiCartItem, len(view.Items)),
+		ItemCount: cartSize(cart),
+		Subtotal:  newAPIMoney(&view.Subtotal, loc),
+		Total:     newAPIMoney(&view.Total, loc),
+
+		UnavailableProductIDs: view.Unavailable,
+	}
+	if view.Discount != nil {
+		m := newAPIMoney(view.Discount, loc)
+		out.PromoCode, out.Discount = view.Promo, &m
+	}
+	if view.EstimatedShipping != nil {
+		m := newAPIMoney(view.EstimatedShipping, loc)
+		out.EstimatedShipping = &m
+	}
+	for i, it := range view.Items {
+		out.Items[i] = apiCartItem{
+			ProductID: it.Item.GetId(),
+			Name:      it.Item.GetName(),
+			Picture:   it.Item.GetPicture(),
+			Variant:   it.Variant,
+			Quantity:  it.Quantity,
+			UnitPrice: newAPIMoney(it.UnitPrice, loc),
+			LineTotal: newAPIMoney(it.Price, loc),
+		}
+	}
+	writeJSON(log, w, http.StatusOK, out)
+}
+
+// apiAddedToCart answers an add-to-cart request made by a script.
+type apiAddedToCart struct {
+	// Count is the number of items in the cart, for the header badge.
+	Count int `json:"count"`
+	// Item is the cart line of the product added, with its quantity and
+	// price after the addition.
+	Item apiCartItem `json:"item"`
+	// Degraded is set when the product was added but the cart could not be
+	// read back: Count is then 0 and Item only shows what was added.
+	Degraded bool `json:"degraded,omitempty"`
+}
+
+// addedToCart describes the cart after quantity of variant of p was added to
+// it. It runs after the addition succeeded, so failures only mark the answer
+// degraded.
+func (fe *frontendServer) addedToCart(r *http.Request, p *pb.Product, variant string, quantity int32) apiAddedToCart {
+	log := loggerFromContext(r.Context())
+	out := apiAddedToCart{Item: apiCartItem{
+		ProductID: p.GetId(),
+		Name:      p.GetName(),
+		Picture:   p.GetPicture(),
+		Variant:   variant,
+		Quantity:  quantity,
+	}}
+	cart, err := fe.getCart(r.Context(), sessionID(r))
+	if err != nil {
+		log.WithField("error", err).Warn("failed to retrieve cart after adding to it")
+		out.Degraded = true
+	} else {
+		out.Count = cartSize(cart)
+		for _, it := range cart {
+			if it.GetProductId() == p.GetId() {
+				out.Item.Quantity, _ = sessionCartVariants(r).line(it, variant)
+			}
+		}
+	}
+	price, _, err := fe.productPrice(r.Context(), p, currentCurrency(r))
+	if err != nil {
+		log.WithField("error", err).Warn("failed to convert the price of the product added to the cart")
+		out.Degraded = true
+		return out
+	}
+	loc := userLocale(r)
+	lineTotal := money.MultiplySlow(*price, uint32(out.Item.Quantity))
+	out.Item.UnitPrice = newAPIMoney(price, loc)
+	out.Item.LineTotal = newAPIMoney(&lineTotal, loc)
+	return out
+}
+
+type apiProduct struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Picture     string   `json:"picture"`
+	Categories  []string `json:"categories"`
+	Price       apiMoney `json:"price"`
+	// CompareAtPrice is the price before the sale the product is on; it is
+	// omitted if the product is not on sale.
+	CompareAtPrice *apiMoney `json:"compare_at_price,omitempty"`
+}
+
+func newAPIProduct(p productView, l money.Locale) apiProduct {
+	out := apiProduct{
+		ID:          p.Item.GetId(),
+		Name:        p.Item.GetName(),
+		Description: p.Item.GetDescription(),
+		Picture:     p.Item.GetPicture(),
+		Categories:  p.Item.GetCategories(),
+		Price:       newAPIMoney(p.Price, l),
+	}
+	if p.CompareAt != nil {
+		m := newAPIMoney(p.CompareAt, l)
+		out.CompareAtPrice = &m
+	}
+	return out
+}
+
+type apiProducts struct {
+	Products []apiProduct `json:"products"`
+	// Missing lists requested IDs that the catalog does not have.
+	Missing []string `json:"missing,omitempty"`
+}
+
+type apiSearchResults struct {
+	Query   string       `json:"query"`
+	Results []apiProduct `json:"results"`
+}
+
+func (fe *frontendServer) apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	query := strings.TrimSpace(r.FormValue("q"))
+	payload := validator.SearchPayload{Query: query}
+	if err := payload.Validate(); err != nil {
+		renderAPIError(log, r, w, validator.ValidationErrorResponse(err), http.StatusBadRequest)
+		return
+	}
+	log.WithField("query", query).Debug("api: searching products")
+
+	results, err := fe.searchProducts(r.Context(), query)
+	if err != nil {
+		renderAPIGRPCError(log, r, w, errors.Wrap(err, "could not search products"))
+		return
+	}
+	ps, err := fe.priceProducts(r.Context(), results, currentCurrency(r))
+	if err != nil {
+		renderAPIGRPCError(log, r, w, err)
+		return
+	}
+
+	out := apiSearchResults{Query: query, Results: make([]apiProduct, len(ps))}
+	for i, p := range ps {
+		out.Results[i] = newAPIProduct(p, userLocale(r))
+	}
+	writeJSON(log, w, http.StatusOK, out)
+}
+
+// apiProductsHandler lists the catalog, or with ?ids=a,b only the products
+// asked for. /product-meta/{ids} is an alias for the latter.
+func (fe *frontendServer) apiProductsHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	ids, ok := mux.Vars(r)["ids"]
+	if q := r.URL.Query(); !ok && q.Has("ids") {
+		ids, ok = q.Get("ids"), true
+	}
+	if ok {
+		fe.apiProductsByID(w, r, ids)
+		return
+	}
+
+	products, err := fe.getProducts(r.Context())
+	if err != nil {
+		renderAPIGRPCError(log, r, w, errors.Wrap(err, "could not retrieve products"))
+		return
+	}
+	ps, err := fe.priceProducts(r.Context(), products, currentCurrency(r))
+	if err != nil {
+		renderAPIGRPCError(log, r, w, err)
+		return
+	}
+	out := apiProducts{Products: make([]apiProduct, len(ps))}
+	for i, p := range ps {
+		out.Products[i] = newAPIProduct(p, userLocale(r))
+	}
+	writeJSON(log, w, http.StatusOK, out)
+}
+
+func (fe *frontendServer) apiProductsByID(w http.ResponseWriter, r *http.Request, list string) {
+	log := loggerFromContext(r.Context())
+	ids := parseProductIDs(list)
+	switch {
+	case len(ids) == 0:
+		renderAPIError(log, r, w, errors.New("no product IDs given"), http.StatusBadRequest)
+		return
+	case len(ids) > maxAPIProductIDs:
+		renderAPIError(log, r, w, errors.Errorf("at most %d product IDs can be requested at once", maxAPIProductIDs), http.StatusBadRequest)
+		return
+	}
+
+	found, missing, err := fe.lookupProducts(r.Context(), ids, currentCurrency(r))
+	if err != nil {
+		renderAPIGRPCError(log, r, w, err)
+		return
+	}
+	out := apiProducts{Products: make([]apiProduct, 0, len(found)), Missing: missing}
+	for _, p := range found {
+		out.Products = append(out.Products, newAPIProduct(p, userLocale(r)))
+	}
+	writeJSON(log, w, http.StatusOK, out)
+}
+
+func (fe *frontendServer) apiProductHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	id := mux.Vars(r)["id"]
+	p, err := fe.getProduct(r.Context(), id)
+	if err != nil {
+		renderAPIGRPCError(log, r, w, errors.Wrapf(err, "could not retrieve product %q", id))
+		return
+	}
+	ps, err := fe.priceProducts(r.Context(), []*pb.Product{p}, currentCurrency(r))
+	if err != nil {
+		renderAPIGRPCError(log, r, w, err)
+		return
+	}
+	writeJSON(log, w, http.StatusOK, newAPIProduct(ps[0], userLocale(r)))
+}
+
+// parseProductIDs splits a comma-separated list of product IDs, dropping
+// blanks and duplicates but keeping the order.
+func parseProductIDs(list string) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// lookupProducts fetches and prices the products with the given IDs, at most
+// productLookupWorkers at a time. IDs the catalog does not know are returned
+// in missing; any other error fails the whole lookup. found keeps the order
+// of ids.
+func (fe *frontendServer) lookupProducts(ctx context.Context, ids []string, currency string) (found []productView, missing []string, err error) {
+	views := make([]*productView, len(ids))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(productLookupWorkers)
+	for i, id := range ids {
+		g.Go(func() error {
+			p, err := fe.getProduct(gctx, id)
+			if status.Code(errors.Cause(err)) == codes.NotFound {
+				return nil
+			} else if err != nil {
+				return errors.Wrapf(err, "could not retrieve product %q", id)
+			}
+			price, compareAt, err := fe.productPrice(gctx, p, currency)
+			if err != nil {
+				return errors.Wrapf(err, "failed to do currency conversion for product %s", id)
+			}
+			views[i] = &productView{p, price, compareAt}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	for i, v := range views {
+		if v == nil {
+			missing = append(missing, ids[i])
+		} else {
+			found = append(found, *v)
+		}
+	}
+	return found, missing, nil
+}
+
+func (fe *frontendServer) orderReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	id := mux.Vars(r)["id"]
+	rc, ok := fe.receipts.get(sessionID(r), id)
+	if !ok {
+		renderAPIError(log, r, w, errors.Errorf("no receipt for order %q", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(log, w, http.StatusOK, rc)
+}
+
+// isXHR reports whether r was sent by a script rather than by a form, which
+// wants a JSON answer instead of a redirect.
+func isXHR(r *http.Request) bool {
+	return accepts(r, "application/json") || r.Header.Get("X-Requested-With") != ""
+}
+
+// wantsJSON reports whether errors for r should be JSON rather than a page:
+// for requests under /api and clients asking for JSON.
+func wantsJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, baseUrl+"/api/") || accepts(r, "application/json")
+}
+
+func writeJSON(log logrus.FieldLogger, w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithField("error", err).Warn("failed to write JSON response")
+	}
+}
+
+// renderAPIError is the JSON counterpart of renderHTTPError.
+func renderAPIError(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error, code int) {
+	renderAPIErrorReason(log, r, w, err, code, "")
+}
+
+// renderAPIErrorReason is renderAPIError for errors scripts need to tell
+// apart, identified by reason.
+func renderAPIErrorReason(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error, code int, reason string) {
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		log.WithField("route", routeName(r)).Warn("request deadline exceeded")
+		code = http.StatusGatewayTimeout
+		reason = ""
+	}
+	log.WithField("error", err).Error("request error")
+	writeJSON(log, w, code, apiError{Error: strings.TrimSpace(err.Error()), Code: code, Reason: reason})
+}
+
+// renderAPIGRPCError is the JSON counterpart of renderGRPCError.
+func renderAPIGRPCError(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error) {
+	code := grpcErrorStatus(log, r, w, err)
+	writeJSON(log, w, code, apiError{Error: userErrorMessage(err, code), Code: code})
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestAPICartHandler(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{
+		{ProductId: "OLJCESPC7Z", Quantity: 2},
+		{ProductId: "66VCHSJNUP", Quantity: 1},
+	}
+	fe := newTestFrontend(t, fb)
+
+	w := httptest.NewRecorder()
+	fe.apiCartHandler(w, withSavedAddress(fe, newTestRequest(http.MethodGet, "/api/cart", nil)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var got apiCart
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Items) != 2 || got.ItemCount != 3 {
+		t.Fatalf("got %d lines with %d items, want 2 lines with 3 items", len(got.Items), got.ItemCount)
+	}
+	first := got.Items[0]
+	if first.ProductID != "OLJCESPC7Z" || first.Name != "Sunglasses" || first.Quantity != 2 {
+		t.Errorf("first line = %+v", first)
+	}
+	if first.UnitPrice.Formatted != "$19.99" || first.LineTotal.Formatted != "$39.98" {
+		t.Errorf("first line prices = %s / %s, want $19.99 / $39.98", first.UnitPrice.Formatted, first.LineTotal.Formatted)
+	}
+	// 39.98 + 18.99 + 8.99 shipping
+	if got.EstimatedShipping == nil {
+		t.Fatal("no shipping estimate")
+	}
+	if got.Subtotal.Formatted != "$58.97" || got.EstimatedShipping.Formatted != "$8.99" || got.Total.Formatted != "$67.96" {
+		t.Errorf("totals = %s + %s = %s, want $58.97 + $8.99 = $67.96",
+			got.Subtotal.Formatted, got.EstimatedShipping.Formatted, got.Total.Formatted)
+	}
+}
+
+func TestAPICartHandlerWithoutShippingEstimate(t *testing.T) {
+	tests := []struct {
+		name    string
+		address bool
+		err     error
+	}{
+		{"no address", false, nil},
+		{"shipping down", true, status.Error(codes.Unavailable, "down")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackend()
+			fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+			if tt.err != nil {
+				fb.setError("GetQuote", tt.err)
+			}
+			fe := newTestFrontend(t, fb)
+			r := newTestRequest(http.MethodGet, "/api/cart", nil)
+			if tt.address {
+				r = withSavedAddress(fe, r)
+			}
+			w := httptest.NewRecorder()
+			fe.apiCartHandler(w, r)
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("got status %d and body %s", w.Code, w.Body)
+			}
+			if v, ok := got["estimated_shipping"]; !ok || v != nil {
+				t.Errorf("estimated_shipping = %v, want null", v)
+			}
+			if total := got["total"].(map[string]interface{})["formatted"]; total != "$19.99" {
+				t.Errorf("total = %v, want the subtotal $19.99", total)
+			}
+		})
+	}
+}
+
+func TestAPICartHandlerEmpty(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	fe.apiCartHandler(w, newTestRequest(http.MethodGet, "/api/cart", nil))
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if items, ok := got["items"].([]interface{}); !ok || len(items) != 0 {
+		t.Errorf("items = %#v, want an empty array", got["items"])
+	}
+}
+
+func TestAPICartHandlerError(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("GetCart", status.Error(codes.Unavailable, "dial tcp 10.0.0.1:7070: connection refused"))
+	fe := newTestFrontend(t, fb)
+
+	w := httptest.NewRecorder()
+	fe.apiCartHandler(w, newTestRequest(http.MethodGet, "/api/cart", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var got apiError
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("error response is not JSON: %v: %s", err, w.Body)
+	}
+	if got.Code != http.StatusServiceUnavailable || got.Error != "could not retrieve cart" {
+		t.Errorf("got %+v, want code 503 and the user-facing message", got)
+	}
+}
+
+func TestAPIProductsHandler(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	r := newTestRequest(http.MethodGet, "/api/products", nil)
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EUR"})
+	w := httptest.NewRecorder()
+	fe.apiProductsHandler(w, r)
+
+	var got apiProducts
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, %v: %s", w.Code, err, w.Body)
+	}
+	if len(got.Products) != 3 || got.Missing != nil {
+		t.Fatalf("got %+v, want the 3 products of the catalog", got)
+	}
+	if p := got.Products[0]; p.ID != "OLJCESPC7Z" || p.Price.CurrencyCode != "EUR" || p.Price.Units != 19 || p.Price.Formatted == "" {
+		t.Errorf("first product = %+v, want Sunglasses priced in EUR", p)
+	}
+}
+
+func TestAPIProductHandler(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	get := func(id string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(newTestRequest(http.MethodGet, "/api/products/"+id, nil), map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		fe.apiProductHandler(w, r)
+		return w
+	}
+
+	w := get("66VCHSJNUP")
+	var p apiProduct
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, %v: %s", w.Code, err, w.Body)
+	}
+	if p.Name != "Tank Top" || len(p.Categories) != 2 || p.Price.Formatted != "$18.99" {
+		t.Errorf("product = %+v", p)
+	}
+
+	if w := get("NOPE"); w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unknown product: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestAPIProductsByID(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	lookup := func(ids string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product-meta/"+url.PathEscape(ids), nil), map[string]string{"ids": ids})
+		w := httptest.NewRecorder()
+		fe.apiProductsHandler(w, r)
+		return w
+	}
+
+	w := lookup("1YMWWN1N4O, OLJCESPC7Z,NOPE,,1YMWWN1N4O")
+	var got apiProducts
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, %v: %s", w.Code, err, w.Body)
+	}
+	if len(got.Products) != 2 || got.Products[0].ID != "1YMWWN1N4O" || got.Products[1].ID != "OLJCESPC7Z" {
+		t.Errorf("products = %+v, want the watch and the sunglasses in that order", got.Products)
+	}
+	if len(got.Missing) != 1 || got.Missing[0] != "NOPE" {
+		t.Errorf("missing = %q, want [NOPE]", got.Missing)
+	}
+	if n := fb.callCount("GetProduct"); n != 3 {
+		t.Errorf("GetProduct called %d times for 3 distinct IDs", n)
+	}
+
+	ids := make([]string, maxAPIProductIDs+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("P%d", i)
+	}
+	for _, list := range []string{" , ", strings.Join(ids, ",")} {
+		if w := lookup(list); w.Code != http.StatusBadRequest {
+			t.Errorf("ids %.20q: status %d, want 400", list, w.Code)
+		}
+	}
+
+	fb.setError("GetProduct", status.Error(codes.Unavailable, "down"))
+	if w := lookup("OLJCESPC7Z"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("catalog down: status %d, want 503", w.Code)
+	}
+}
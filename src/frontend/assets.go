@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// staticAssetPrefix is where pages load the static assets from, such as a
+// CDN (STATIC_ASSET_PREFIX); empty for baseUrl + "/static".
+var staticAssetPrefix string
+
+// assetHashes maps the path of each embedded static file to a hash of its
+// content, which assetURL adds to the file's URL so that caches fetch it
+// again after it changes. It is computed once, on first use.
+var assetHashes = sync.OnceValue(func() map[string]string {
+	hashes := make(map[string]string)
+	fsys := staticFS("")
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hashes[name] = hex.EncodeToString(sum[:4])
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return hashes
+})
+
+// assetURL is the assetURL template function: it returns the URL of a static
+// asset, given by its path under static/ or, as in the pictures of the
+// catalog, under /static/. Absolute URLs are returned as they are.
+//
+//	<img src="{{ assetURL "icons/Hipster_CartIcon.svg" }}">
+//	<img src="{{ assetURL .Item.Picture }}">
+func assetURL(p string) string {
+	if u, err := url.Parse(p); err != nil || u.IsAbs() || u.Host != "" {
+		return p
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(p, "/static/"), "/")
+	prefix := staticAssetPrefix
+	if prefix == "" {
+		prefix = baseUrl + "/static"
+	}
+	if h, ok := assetHashes()[name]; ok {
+		return prefix + "/" + name + "?v=" + h
+	}
+	return prefix + "/" + name
+}
+
+// normalizeAssetPrefix cleans up STATIC_ASSET_PREFIX like normalizeBaseURL.
+// It reports false unless the result is empty, a path, or an http or https
+// URL with a host and an optional path.
+func normalizeAssetPrefix(v string) (string, bool) {
+	v = strings.TrimSuffix(v, "/")
+	if v == "" || strings.HasPrefix(v, "/") && !strings.HasPrefix(v, "//") {
+		return normalizeBaseURL(v)
+	}
+	u, err := url.Parse(v)
+	if err != nil || strings.ContainsAny(v, "?# \t\n") {
+		return v, false
+	}
+	return v, (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil
+}
+
+// assetOrigin returns the origin of an absolute STATIC_ASSET_PREFIX, which
+// the Content-Security-Policy must allow, and "" for a path.
+func assetOrigin(prefix string) string {
+	u, err := url.Parse(prefix)
+	if err != nil || !u.IsAbs() {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
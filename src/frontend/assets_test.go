@@ -0,0 +1,139 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// setAssetPrefix sets baseUrl and staticAssetPrefix for the test.
+func setAssetPrefix(t *testing.T, base, prefix string) {
+	oldBase, oldPrefix := baseUrl, staticAssetPrefix
+	baseUrl, staticAssetPrefix = base, prefix
+	t.Cleanup(func() { baseUrl, staticAssetPrefix = oldBase, oldPrefix })
+}
+
+func TestAssetURL(t *testing.T) {
+	hash := assetHashes()["styles/styles.css"]
+	if !regexp.MustCompile(`^[0-9a-f]{8}$`).MatchString(hash) {
+		t.Fatalf("styles.css hash = %q", hash)
+	}
+	picHash := assetHashes()["img/products/sunglasses.jpg"]
+
+	for _, tc := range []struct {
+		base, prefix, path, want string
+	}{
+		{"", "", "styles/styles.css", "/static/styles/styles.css?v=" + hash},
+		{"/shop", "", "styles/styles.css", "/shop/static/styles/styles.css?v=" + hash},
+		{"/shop", "https://cdn.example.com/shop", "styles/styles.css", "https://cdn.example.com/shop/styles/styles.css?v=" + hash},
+		{"", "/assets", "styles/styles.css", "/assets/styles/styles.css?v=" + hash},
+		// Pictures of the catalog.
+		{"/shop", "", "/static/img/products/sunglasses.jpg", "/shop/static/img/products/sunglasses.jpg?v=" + picHash},
+		{"", "https://cdn.example.com", "/static/img/products/sunglasses.jpg", "https://cdn.example.com/img/products/sunglasses.jpg?v=" + picHash},
+		{"", "https://cdn.example.com", "https://images.example.com/a.jpg", "https://images.example.com/a.jpg"},
+		{"", "https://cdn.example.com", "//images.example.com/a.jpg", "//images.example.com/a.jpg"},
+		// Not embedded, so without a hash.
+		{"", "", "icons/missing.svg", "/static/icons/missing.svg"},
+	} {
+		setAssetPrefix(t, tc.base, tc.prefix)
+		if got := assetURL(tc.path); got != tc.want {
+			t.Errorf("base %q, prefix %q: assetURL(%q) = %q, want %q", tc.base, tc.prefix, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestAssetURLIsCachedForever(t *testing.T) {
+	setAssetPrefix(t, "", "")
+	h := newStaticHandler("")
+	for _, tc := range []struct {
+		target, want string
+	}{
+		{strings.TrimPrefix(assetURL("styles/styles.css"), "/static"), immutableCacheControl},
+		{"/styles/styles.css?v=00000000", staticCacheControl},
+		{"/styles/styles.css", staticCacheControl},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if cc := w.Header().Get("Cache-Control"); cc != tc.want {
+			t.Errorf("%s: Cache-Control = %q, want %q", tc.target, cc, tc.want)
+		}
+	}
+}
+
+func TestPagesLoadAssetsFromPrefix(t *testing.T) {
+	setAssetPrefix(t, "", "https://cdn.example.com")
+	fe := newTestFrontend(t, newFakeBackend())
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	w := httptest.NewRecorder()
+	fe.productHandler(w, r)
+	body := w.Body.String()
+	for _, want := range []string{
+		`href="https://cdn.example.com/styles/styles.css?v=` + assetHashes()["styles/styles.css"] + `"`,
+		`src="https://cdn.example.com/img/products/sunglasses.jpg?v=`,
+		`src="https://cdn.example.com/icons/Hipster_CartIcon.svg?v=`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("product page does not contain %s", want)
+		}
+	}
+	if strings.Contains(body, `src="/static/`) {
+		t.Error("product page loads assets from /static")
+	}
+}
+
+func TestNormalizeAssetPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"/assets/", "/assets", true},
+		{"https://cdn.example.com/", "https://cdn.example.com", true},
+		{"https://cdn.example.com/shop/static", "https://cdn.example.com/shop/static", true},
+		{"cdn.example.com", "cdn.example.com", false},
+		{"//cdn.example.com", "//cdn.example.com", false},
+		{"ftp://cdn.example.com", "ftp://cdn.example.com", false},
+		{"https://cdn.example.com?x=1", "https://cdn.example.com?x=1", false},
+	} {
+		if got, ok := normalizeAssetPrefix(tc.in); got != tc.want || ok != tc.ok {
+			t.Errorf("normalizeAssetPrefix(%q) = %q, %v; want %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestContentSecurityPolicyAllowsAssetOrigin(t *testing.T) {
+	setAssetPrefix(t, "", "https://cdn.example.com/shop")
+	csp := serveSecurityHeaders(securityHeadersFromEnv(nil), httptest.NewRequest(http.MethodGet, "/", nil)).Get("Content-Security-Policy")
+	for _, want := range []string{
+		"img-src https://cdn.example.com 'self' data:;",
+		"style-src https://cdn.example.com 'self'",
+		"font-src https://cdn.example.com 'self'",
+		"default-src 'self';",
+		"connect-src 'self';",
+	} {
+		if !strings.Contains(csp, want) {
+			t.Errorf("Content-Security-Policy %q does not contain %q", csp, want)
+		}
+	}
+	if got := allowAssetOrigin(defaultContentSecurityPolicy, ""); got != defaultContentSecurityPolicy {
+		t.Errorf("without a CDN: %q", got)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sseHeartbeatInterval is how often an assistant stream sends a comment line
+// while waiting for the model, so that proxies do not drop the idle
+// connection.
+var sseHeartbeatInterval = 15 * time.Second
+
+// assistantMessage is the chat answer sent to the browser, whole or as one
+// chunk of a stream.
+type assistantMessage struct {
+	Message string `json:"message"`
+}
+
+// assistantReply is the shopping assistant's response body, or the data of
+// one of its stream events.
+type assistantReply struct {
+	Content string `json:"content"`
+}
+
+// chatBotHandler relays a chat message to the shopping assistant. Clients
+// that accept text/event-stream get the answer as Server-Sent Events while
+// it is generated; others get it in one JSON response.
+func (fe *frontendServer) chatBotHandler(w http.ResponseWriter, r *http.Request) {
+	if accepts(r, "text/event-stream") {
+		fe.streamChatBot(w, r)
+		return
+	}
+	log := loggerFromContext(r.Context())
+	res, err := fe.askAssistant(r.Context(), r.Body, "application/json")
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusInternalServerError)
+		return
+	}
+	defer res.Body.Close()
+
+	var reply assistantReply
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to unmarshal body"), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(log, w, http.StatusOK, assistantMessage{Message: reply.Content})
+}
+
+// streamChatBot sends the assistant's answer as a "message" event per chunk,
+// then a "done" event, or an "error" event if the assistant fails part way.
+// The upstream request is canceled as soon as the client goes away.
+func (fe *frontendServer) streamChatBot(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	// The server stops reading the request once the response is flushed.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to read request body"), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	chunks := make(chan string)
+	done := make(chan error, 1)
+	go func() { done <- fe.readAssistant(ctx, bytes.NewReader(body), chunks) }()
+
+	stream := newEventStream(w)
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case chunk := <-chunks:
+			err = stream.send("message", assistantMessage{Message: chunk})
+		case <-heartbeat.C:
+			err = stream.comment("ping")
+		case readErr := <-done:
+			switch {
+			case errors.Is(ctx.Err(), context.Canceled):
+				log.Debug("client closed the assistant stream")
+			case readErr != nil:
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					log.WithField("route", routeName(r)).Warn("request deadline exceeded")
+				}
+				log.WithField("error", readErr).Error("assistant stream failed")
+				stream.send("error", apiError{Error: "The shopping assistant is unavailable.", Code: http.StatusBadGateway})
+			default:
+				stream.send("done", struct{}{})
+			}
+			return
+		}
+		if err != nil {
+			// The client is gone; stop the upstream call and wait for
+			// the reader to return.
+			log.WithField("error", err).Debug("failed to write to the assistant stream")
+			cancel()
+		}
+	}
+}
+
+// askAssistant forwards a chat request body to the shopping assistant. The
+// caller closes the response body.
+func (fe *frontendServer) askAssistant(ctx context.Context, body io.Reader, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+fe.shoppingAssistantSvcAddr, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", accept)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send request")
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.Errorf("shopping assistant returned %s", res.Status)
+	}
+	return res, nil
+}
+
+// readAssistant asks the assistant for a streamed answer and sends each
+// chunk of it to chunks. An assistant that does not stream answers with a
+// single JSON body, which becomes a single chunk.
+func (fe *frontendServer) readAssistant(ctx context.Context, body io.Reader, chunks chan<- string) error {
+	res, err := fe.askAssistant(ctx, body, "text/event-stream, application/json;q=0.9")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mt != "text/event-stream" {
+		var reply assistantReply
+		if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+			return errors.Wrap(err, "failed to unmarshal body")
+		}
+		chunks <- reply.Content
+		return nil
+	}
+
+	var event string
+	var data []string
+	sc := bufio.NewScanner(res.Body)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			// A blank line dispatches the event.
+			if event == "error" {
+				return errors.Errorf("shopping assistant failed: %s", strings.Join(data, "\n"))
+			}
+			if len(data) > 0 {
+				var reply assistantReply
+				if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &reply); err != nil {
+					return errors.Wrap(err, "failed to unmarshal event")
+				}
+				if reply.Content != "" {
+					chunks <- reply.Content
+				}
+			}
+			event, data = "", data[:0]
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return errors.Wrap(sc.Err(), "failed to read the assistant stream")
+}
+
+// accepts reports whether the request's Accept header lists mediaType.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			if mt, _, err := mime.ParseMediaType(part); err == nil && mt == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// eventStream writes Server-Sent Events, flushing each one to the client.
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	s := &eventStream{w: w, rc: http.NewResponseController(w)}
+	s.flush()
+	return s
+}
+
+// send writes an event whose data is v encoded as JSON.
+func (s *eventStream) send(event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+	var b bytes.Buffer
+	b.WriteString("event: " + event + "\n")
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	return s.write(b.Bytes())
+}
+
+// comment writes a comment line, which clients ignore.
+func (s *eventStream) comment(text string) error {
+	return s.write([]byte(": " + text + "\n\n"))
+}
+
+func (s *eventStream) write(p []byte) error {
+	if _, err := s.w.Write(p); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+// flush sends buffered events and pushes the connection's write deadline
+// back, so that HTTP_WRITE_TIMEOUT does not cut off a long answer. Where a
+// wrapping ResponseWriter hides the connection the deadline stays as is.
+func (s *eventStream) flush() error {
+	err := s.rc.SetWriteDeadline(time.Now().Add(2 * sseHeartbeatInterval))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return s.rc.Flush()
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newAssistantFrontend returns a server running the chat handler behind the
+// logging middleware, talking to an assistant served by upstream.
+func newAssistantFrontend(t *testing.T, upstream http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	assistant := httptest.NewServer(upstream)
+	t.Cleanup(assistant.Close)
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.shoppingAssistantSvcAddr = strings.TrimPrefix(assistant.URL, "http://")
+	srv := httptest.NewServer(&logHandler{log: discardLog, next: http.HandlerFunc(fe.chatBotHandler)})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func askBot(t *testing.T, srv *httptest.Server, accept string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(`{"message":"hi"}`))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+type sseEvent struct {
+	name, data string
+}
+
+// readEvent returns the next event from an SSE stream, skipping comments.
+func readEvent(t *testing.T, br *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev != (sseEvent{}):
+			return ev
+		case strings.HasPrefix(line, "event: "):
+			ev.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestChatBotStreamsChunks(t *testing.T) {
+	next := make(chan struct{})
+	srv := newAssistantFrontend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "application/json" {
+			t.Error("frontend did not ask the assistant to stream")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{"Hello", ", world"} {
+			fmt.Fprintf(w, "data: {\"content\": %q}\n\n", chunk)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	})
+
+	res := askBot(t, srv, "text/event-stream")
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+	br := bufio.NewReader(res.Body)
+	// The first chunk arrives while the assistant is still generating.
+	if ev := readEvent(t, br); ev != (sseEvent{"message", `{"message":"Hello"}`}) {
+		t.Errorf("first event = %+v", ev)
+	}
+	next <- struct{}{}
+	if ev := readEvent(t, br); ev != (sseEvent{"message", `{"message":", world"}`}) {
+		t.Errorf("second event = %+v", ev)
+	}
+	next <- struct{}{}
+	if ev := readEvent(t, br); ev.name != "done" {
+		t.Errorf("last event = %+v, want done", ev)
+	}
+}
+
+func TestChatBotStreamHeartbeat(t *testing.T) {
+	defer func(d time.Duration) { sseHeartbeatInterval = d }(sseHeartbeatInterval)
+	sseHeartbeatInterval = 10 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	srv := newAssistantFrontend(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	br := bufio.NewReader(askBot(t, srv, "text/event-stream").Body)
+	line, err := br.ReadString('\n')
+	if err != nil || line != ": ping\n" {
+		t.Errorf("got %q, %v while the assistant is busy, want a heartbeat comment", line, err)
+	}
+}
+
+func TestChatBotStreamCancelsUpstream(t *testing.T) {
+	canceled := make(chan struct{})
+	srv := newAssistantFrontend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"content\": \"thinking\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(canceled)
+	})
+
+	res := askBot(t, srv, "text/event-stream")
+	readEvent(t, bufio.NewReader(res.Body))
+	res.Body.Close()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request not canceled after the client went away")
+	}
+}
+
+func TestChatBotStreamFromJSONAssistant(t *testing.T) {
+	srv := newAssistantFrontend(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(assistantReply{Content: "all at once"})
+	})
+
+	br := bufio.NewReader(askBot(t, srv, "text/event-stream").Body)
+	if ev := readEvent(t, br); ev != (sseEvent{"message", `{"message":"all at once"}`}) {
+		t.Errorf("first event = %+v", ev)
+	}
+	if ev := readEvent(t, br); ev.name != "done" {
+		t.Errorf("last event = %+v, want done", ev)
+	}
+}
+
+func TestChatBotStreamError(t *testing.T) {
+	srv := newAssistantFrontend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"content\": \"partial\"}\n\nevent: error\ndata: quota exceeded\n\n")
+	})
+
+	br := bufio.NewReader(askBot(t, srv, "text/event-stream").Body)
+	readEvent(t, br)
+	if ev := readEvent(t, br); ev.name != "error" {
+		t.Errorf("got %+v after the assistant failed, want an error event", ev)
+	}
+}
+
+func TestChatBotJSONFallback(t *testing.T) {
+	srv := newAssistantFrontend(t, func(w http.ResponseWriter, r *http.Request) {
+		if accept := r.Header.Get("Accept"); accept != "application/json" {
+			t.Errorf("assistant asked for %q, want application/json", accept)
+		}
+		json.NewEncoder(w).Encode(assistantReply{Content: "buffered"})
+	})
+
+	for _, accept := range []string{"", "application/json"} {
+		res := askBot(t, srv, accept)
+		var got assistantMessage
+		if err := json.NewDecoder(res.Body).Decode(&got); err != nil || res.StatusCode != http.StatusOK || got.Message != "buffered" {
+			t.Errorf("Accept %q: got status %d, %+v, %v", accept, res.StatusCode, got, err)
+		}
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                  false,
+		"application/json":  false,
+		"text/event-stream": true,
+		"application/json, text/event-stream;q=0.5": true,
+		"text/event-streams":                        false,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/bot", nil)
+		r.Header.Set("Accept", accept)
+		if got := accepts(r, "text/event-stream"); got != want {
+			t.Errorf("accepts(%q, text/event-stream) = %v, want %v", accept, got, want)
+		}
+	}
+}
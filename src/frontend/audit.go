@@ -0,0 +1,300 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+const (
+	// auditBufferSize is the number of records that may wait for the audit
+	// log; further ones are dropped rather than hold up requests.
+	auditBufferSize = 1024
+
+	defaultAuditLogMaxBytes = 100 << 20
+	defaultAuditLogBackups  = 5
+)
+
+// The actions recorded in the audit log.
+const (
+	auditAddToCart  = "cart.add"
+	auditEmptyCart  = "cart.empty"
+	auditPlaceOrder = "order.place"
+)
+
+var auditRecordsDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "audit_records_dropped_total",
+	Help: "Number of audit records dropped because the audit log fell behind.",
+})
+
+// auditConfig holds the AUDIT_LOG_* settings.
+type auditConfig struct {
+	// path is the file audit records are appended to, or stdout or
+	// stderr; empty disables the audit log.
+	path string
+	// maxBytes is the size past which the file is rotated; backups is the
+	// number of older files kept, path.1 being the newest.
+	maxBytes int
+	backups  int
+}
+
+func auditFromEnv(l *envLoader) auditConfig {
+	c := auditConfig{
+		path:     l.str("AUDIT_LOG_PATH", ""),
+		maxBytes: l.int("AUDIT_LOG_MAX_BYTES", defaultAuditLogMaxBytes),
+		backups:  l.int("AUDIT_LOG_BACKUPS", defaultAuditLogBackups),
+	}
+	if c.maxBytes <= 0 {
+		l.problem("AUDIT_LOG_MAX_BYTES: must be positive, got %d", c.maxBytes)
+	}
+	if c.backups < 0 {
+		l.problem("AUDIT_LOG_BACKUPS: must not be negative, got %d", c.backups)
+	}
+	return c
+}
+
+// auditItem is a product and quantity of an audit record.
+type auditItem struct {
+	ProductID string `json:"product_id"`
+	Variant   string `json:"variant,omitempty"`
+	Quantity  int32  `json:"quantity"`
+}
+
+// auditRecord is an entry of the audit log. auditLogger.record fills in the
+// session, client IP and time.
+type auditRecord struct {
+	action   string
+	session  string
+	clientIP string
+	at       time.Time
+	items    []auditItem
+	orderID  string
+	total    *pb.Money
+}
+
+// auditLogger writes the audit trail of cart changes and orders, apart from
+// the debug logs. Records are queued and written by a worker, so that a slow
+// disk never holds up requests; those that do not fit in the queue are
+// dropped and counted.
+type auditLogger struct {
+	log     *logrus.Logger
+	out     io.Writer
+	records chan auditRecord
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newAuditLogger opens the audit log of cfg, nil if it is disabled.
+func newAuditLogger(cfg auditConfig) (*auditLogger, error) {
+	switch cfg.path {
+	case "":
+		return nil, nil
+	case "stdout":
+		return startAuditLogger(os.Stdout, auditBufferSize), nil
+	case "stderr":
+		return startAuditLogger(os.Stderr, auditBufferSize), nil
+	}
+	f, err := openRotatingFile(cfg.path, int64(cfg.maxBytes), cfg.backups)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open the audit log")
+	}
+	return startAuditLogger(f, auditBufferSize), nil
+}
+
+// startAuditLogger starts the worker writing to out, which queues up to
+// buffer records.
+func startAuditLogger(out io.Writer, buffer int) *auditLogger {
+	l := logrus.New()
+	l.Out = out
+	l.Level = logrus.InfoLevel
+	l.Formatter = &logrus.JSONFormatter{
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime: "timestamp",
+			logrus.FieldKeyMsg:  "action",
+		},
+		TimestampFormat: time.RFC3339Nano,
+	}
+	a := &auditLogger{log: l, out: out, records: make(chan auditRecord, buffer), done: make(chan struct{})}
+	go a.run()
+	return a
+}
+
+func (a *auditLogger) run() {
+	defer close(a.done)
+	for rec := range a.records {
+		fields := logrus.Fields{
+			"session":   rec.session,
+			"client_ip": rec.clientIP,
+		}
+		if len(rec.items) > 0 {
+			fields["items"] = rec.items
+		}
+		if rec.orderID != "" {
+			fields["order"] = rec.orderID
+		}
+		if rec.total != nil {
+			fields["order.total"] = money.Amount(*rec.total)
+			fields["order.currency"] = rec.total.GetCurrencyCode()
+		}
+		a.log.WithTime(rec.at).WithFields(fields).Info(rec.action)
+	}
+}
+
+// record queues rec, made by the request r, for the audit log. It never
+// blocks: when the queue is full the record is dropped.
+func (a *auditLogger) record(r *http.Request, rec auditRecord) {
+	if a == nil {
+		return
+	}
+	rec.session = sessionID(r)
+	rec.clientIP = clientIP(r)
+	rec.at = time.Now()
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		auditRecordsDropped.Inc()
+		return
+	}
+	select {
+	case a.records <- rec:
+	default:
+		auditRecordsDropped.Inc()
+	}
+}
+
+// auditOrder records the order of rc, placed by the request r.
+func (fe *frontendServer) auditOrder(r *http.Request, rc *receipt) {
+	items := make([]auditItem, len(rc.Items))
+	for i, it := range rc.Items {
+		items[i] = auditItem{ProductID: it.ProductID, Variant: it.Variant, Quantity: it.Quantity}
+	}
+	fe.audit.record(r, auditRecord{
+		action:  auditPlaceOrder,
+		items:   items,
+		orderID: rc.OrderID,
+		total:   &pb.Money{CurrencyCode: rc.Total.CurrencyCode, Units: rc.Total.Units, Nanos: rc.Total.Nanos},
+	})
+}
+
+// close writes the queued records and closes the log. Records made later
+// are dropped.
+func (a *auditLogger) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.records)
+	}
+	a.mu.Unlock()
+	<-a.done
+	if c, ok := a.out.(io.Closer); ok && a.out != os.Stdout && a.out != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+// rotatingFile appends to a file that it rotates once it would grow past
+// maxBytes: path becomes path.1, path.1 becomes path.2 and so on, the oldest
+// of the backups being removed. It is not safe for concurrent use.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	var rerr error
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		rerr = rf.rotate()
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	if err == nil && rerr != nil {
+		err = errors.Wrap(rerr, "could not rotate the audit log")
+	}
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	err := rf.shift()
+	// Whatever happened, writes go on: to the same file if it could not
+	// be moved.
+	if oerr := rf.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// shift moves the file and its backups up by one.
+func (rf *rotatingFile) shift() error {
+	if rf.backups == 0 {
+		return os.Remove(rf.path)
+	}
+	for i := rf.backups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(rf.path, rf.path+".1")
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAuditLogRecordsCartAndOrders(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	var buf bytes.Buffer
+	fe.audit = startAuditLogger(&buf, 16)
+
+	w := httptest.NewRecorder()
+	fe.addToCartHandler(w, newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=2")))
+	if w.Code != http.StatusFound {
+		t.Fatalf("add to cart: status %d", w.Code)
+	}
+	if w := placeTestOrder(t, fe); w.Code != http.StatusOK {
+		t.Fatalf("checkout: status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	fe.emptyCartHandler(w, newTestRequest(http.MethodPost, "/cart/empty", nil))
+	if err := fe.audit.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []map[string]interface{}
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("%v: %s", err, sc.Bytes())
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3:\n%s", len(records), buf.String())
+	}
+	for i, action := range []string{auditAddToCart, auditPlaceOrder, auditEmptyCart} {
+		rec := records[i]
+		if rec["action"] != action || rec["session"] != "test-session" || rec["client_ip"] != "192.0.2.1" {
+			t.Errorf("record %d = %v, want %s by test-session from 192.0.2.1", i, rec, action)
+		}
+		if ts, _ := rec["timestamp"].(string); ts == "" {
+			t.Errorf("record %d has no timestamp", i)
+		}
+	}
+	items, _ := json.Marshal(records[0]["items"])
+	if string(items) != `[{"product_id":"OLJCESPC7Z","quantity":2}]` {
+		t.Errorf("cart.add items %s", items)
+	}
+	order := records[1]
+	if order["order"] != "order-test-session" || order["order.currency"] != "USD" || order["order.total"] == "" || order["items"] == nil {
+		t.Errorf("order.place record %v", order)
+	}
+}
+
+// blockingWriter holds up every write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestAuditLogDropsRecordsWhenBehind(t *testing.T) {
+	out := blockingWriter{release: make(chan struct{})}
+	a := startAuditLogger(out, 1)
+	before := testutil.ToFloat64(auditRecordsDropped)
+
+	r := newTestRequest(http.MethodPost, "/cart/empty", nil)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			a.record(r, auditRecord{action: auditEmptyCart})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording blocked on the audit log")
+	}
+	if dropped := testutil.ToFloat64(auditRecordsDropped) - before; dropped < 3 {
+		t.Errorf("dropped %v records, want at least 3", dropped)
+	}
+
+	close(out.release)
+	a.close()
+	a.record(r, auditRecord{action: auditEmptyCart}) // after close: dropped, no panic
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.Repeat("x", 59) + "\n"
+	for c := 'a'; c <= 'd'; c++ {
+		if _, err := rf.Write([]byte(string(c) + line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Each line fills more than half a file, so each got its own; the
+	// first was rotated out.
+	for name, want := range map[string]string{"audit.log": "d", "audit.log.1": "c", "audit.log.2": "b"} {
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(data) != want+line {
+			t.Errorf("%s holds %q, want the line %s", name, data, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("audit.log.3 kept: %v", err)
+	}
+
+	// Reopened, the file keeps growing from its size.
+	rf, err = openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	if rf.size != int64(len(line)+1) {
+		t.Errorf("reopened at size %d", rf.size)
+	}
+}
+
+func TestNewAuditLoggerDisabled(t *testing.T) {
+	a, err := newAuditLogger(auditConfig{})
+	if a != nil || err != nil {
+		t.Fatalf("newAuditLogger without a path = %v, %v", a, err)
+	}
+	// A disabled audit log takes records and does nothing.
+	a.record(newTestRequest(http.MethodPost, "/cart", nil), auditRecord{action: auditAddToCart, items: []auditItem{{ProductID: "OLJCESPC7Z", Quantity: 1}}})
+	if err := a.close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type ctxKeyBot struct{}
+
+// crawlerUserAgents are lower-case substrings of the user agents of well
+// known crawlers. Most name themselves "...bot"; this is not meant to catch
+// clients that try to pass for browsers.
+var crawlerUserAgents = []string{
+	"bot", "crawler", "spider", "slurp", "facebookexternalhit", "mediapartners-google",
+	"ia_archiver", "yandex", "baiduspider", "bingpreview", "lighthouse",
+}
+
+// isCrawler reports whether userAgent belongs to a crawler.
+func isCrawler(userAgent string) bool {
+	ua := strings.ToLower(userAgent)
+	for _, s := range crawlerUserAgents {
+		if strings.Contains(ua, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectBots marks requests from crawlers, so that they are served without
+// a session cookie, ads or recommendations. It is only installed when
+// ROBOTS_ALLOW lets crawlers in.
+func detectBots(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isCrawler(r.UserAgent()) {
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyBot{}, true))
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// isBot reports whether ctx is that of a request detectBots marked as coming
+// from a crawler.
+func isBot(ctx context.Context) bool {
+	v, _ := ctx.Value(ctxKeyBot{}).(bool)
+	return v
+}
+
+// robotsHandler serves robots.txt: crawling is disallowed unless
+// ROBOTS_ALLOW is set, then ROBOTS_EXTRA_RULES follow, and the sitemap is
+// advertised when there is one.
+func (fe *frontendServer) robotsHandler(w http.ResponseWriter, _ *http.Request) {
+	if fe.robotsAllow {
+		fmt.Fprint(w, "User-agent: *\nAllow: /")
+	} else {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /")
+	}
+	if fe.robotsExtraRules != "" {
+		fmt.Fprintf(w, "\n%s", fe.robotsExtraRules)
+	}
+	if fe.sitemap != nil {
+		fmt.Fprintf(w, "\nSitemap: %s%s/sitemap.xml", fe.sitemap.origin, baseUrl)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestIsCrawler(t *testing.T) {
+	for ua, want := range map[string]bool{
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                          true,
+		"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)":                           true,
+		"Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)":               true,
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)":                         true,
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36": false,
+		"": false,
+	} {
+		if got := isCrawler(ua); got != want {
+			t.Errorf("isCrawler(%q) = %v, want %v", ua, got, want)
+		}
+	}
+}
+
+func TestBotsGetNoSessionCookie(t *testing.T) {
+	var bot bool
+	var session string
+	h := detectBots(ensureSessionID(nil, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		bot, session = isBot(r.Context()), sessionID(r)
+	})))
+	for ua, wantBot := range map[string]bool{"Googlebot/2.1": true, "Mozilla/5.0 Firefox/128.0": false} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if bot != wantBot || session == "" {
+			t.Errorf("%s: bot %v, session %q; want bot %v and a session", ua, bot, session, wantBot)
+		}
+		if set := len(w.Result().Cookies()) > 0; set == wantBot {
+			t.Errorf("%s: session cookie set %v, want %v", ua, set, !wantBot)
+		}
+	}
+}
+
+func TestBotsSkipAdsAndRecommendations(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	fe.adSlots = 2
+	fe.cookieSigner = newCookieSigner("secret")
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyBot{}, true))
+	w := httptest.NewRecorder()
+	fe.productHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if n, m := fb.callCount("ListRecommendations"), fb.callCount("GetAds"); n != 0 || m != 0 {
+		t.Errorf("crawler cost %d recommendation and %d ad calls, want none", n, m)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("crawler got cookies %v", w.Result().Cookies())
+	}
+}
+
+func TestRobots(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow bool
+		extra string
+		want  string
+	}{
+		{"default", false, "", "User-agent: *\nDisallow: /"},
+		{"allowed", true, "", "User-agent: *\nAllow: /"},
+		{"extra rules", true, "Disallow: /cart\nCrawl-delay: 10", "User-agent: *\nAllow: /\nDisallow: /cart\nCrawl-delay: 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := &frontendServer{robotsAllow: tt.allow, robotsExtraRules: tt.extra}
+			w := httptest.NewRecorder()
+			fe.robotsHandler(w, newTestRequest(http.MethodGet, "/robots.txt", nil))
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("robots.txt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
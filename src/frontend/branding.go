@@ -0,0 +1,165 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const maxBrandNameLength = 64
+
+// brandSettings customizes the look of the shop on top of CYMBAL_BRANDING.
+// Unset fields keep the stock look.
+type brandSettings struct {
+	name         string
+	logoURL      string
+	primaryColor string // #rrggbb
+	// bannerMessage is shown in an announcement bar that users can dismiss.
+	bannerMessage string
+}
+
+var hexColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// brandFromEnv reads BRAND_NAME, BRAND_LOGO_URL, BRAND_PRIMARY_COLOR and
+// BANNER_MESSAGE with getenv, which may look in SETTINGS_FILE first. The logo
+// must be an http(s) URL or a path on this host, so that the variable cannot
+// smuggle markup or scripts into pages.
+func brandFromEnv(l *envLoader, getenv func(string) string) brandSettings {
+	b := brandSettings{
+		name:          strings.TrimSpace(getenv("BRAND_NAME")),
+		logoURL:       strings.TrimSpace(getenv("BRAND_LOGO_URL")),
+		bannerMessage: strings.TrimSpace(getenv("BANNER_MESSAGE")),
+	}
+	if len(b.name) > maxBrandNameLength || strings.IndexFunc(b.name, unicode.IsControl) >= 0 {
+		l.problem("BRAND_NAME: %q is not a name of at most %d characters", b.name, maxBrandNameLength)
+	}
+	if strings.IndexFunc(b.bannerMessage, unicode.IsControl) >= 0 {
+		l.problem("BANNER_MESSAGE: control characters are not allowed")
+	}
+	if b.logoURL != "" && !validLogoURL(b.logoURL) {
+		l.problem("BRAND_LOGO_URL: %q is not an http(s) URL or an absolute path", b.logoURL)
+	}
+	if c := getenv("BRAND_PRIMARY_COLOR"); c != "" {
+		if !hexColorPattern.MatchString(c) {
+			l.problem("BRAND_PRIMARY_COLOR: %q is not a hex color such as #ce0631", c)
+		} else {
+			c = strings.ToLower(c)
+			if len(c) == 4 {
+				c = string([]byte{'#', c[1], c[1], c[2], c[2], c[3], c[3]})
+			}
+			b.primaryColor = c
+		}
+	}
+	return b
+}
+
+// validLogoURL reports whether v is an http(s) URL, or a path starting with a
+// single slash, free of characters that could end an HTML attribute.
+func validLogoURL(v string) bool {
+	if strings.ContainsAny(v, "\"'<>\\` ") || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+		return false
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.User != nil {
+		return false
+	}
+	if u.Scheme == "" {
+		return u.Host == "" && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(v, "//")
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// stylesheet returns the CSS overriding the colors of the stock styles, or ""
+// if there is nothing to override. Hover and focus states use a darker
+// shade, as the stock #ce0631 does with #7b031d.
+func (b brandSettings) stylesheet() string {
+	if b.primaryColor == "" {
+		return ""
+	}
+	dark := shadeColor(b.primaryColor, 0.6)
+	return fmt.Sprintf(`.cymbal-button-primary, .cymbal-button-secondary { border-color: %[1]s; }
+.cymbal-button-primary { background-color: %[1]s; }
+.cymbal-button-secondary { color: %[1]s; }
+.cymbal-button-primary:active, .cymbal-button-primary:focus, .cymbal-button-primary:hover { border-color: %[2]s; background-color: %[2]s; }
+.cymbal-button-secondary:active, .cymbal-button-secondary:focus, .cymbal-button-secondary:hover { border-color: %[2]s; color: %[2]s; }
+`, b.primaryColor, dark)
+}
+
+// shadeColor scales the channels of the #rrggbb color c by f.
+func shadeColor(c string, f float64) string {
+	n, _ := strconv.ParseUint(c[1:], 16, 32)
+	ch := func(shift uint) uint64 { return uint64(float64((n>>shift)&0xff) * f) }
+	return fmt.Sprintf("#%02x%02x%02x", ch(16), ch(8), ch(0))
+}
+
+// contentID returns a short digest of s, to tell its versions apart.
+func contentID(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+// brandCSSHandler serves /static/brand.css. Pages link it with the digest of
+// its content in the query, so it can be cached like fingerprinted assets.
+func brandCSSHandler(w http.ResponseWriter, r *http.Request) {
+	brand := currentBrand()
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	if r.URL.Query().Get("v") == contentID(brand.stylesheet()) {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", staticCacheControl)
+	}
+	if r.Method != http.MethodHead {
+		fmt.Fprint(w, brand.stylesheet())
+	}
+}
+
+// brandTemplateData returns the branding fields of the template data for r.
+// The banner is left out once the user dismissed its current message.
+func brandTemplateData(r *http.Request) map[string]interface{} {
+	brand := currentBrand()
+	data := map[string]interface{}{
+		"brand_name":     brand.name,
+		"brand_logo_url": brand.logoURL,
+	}
+	if css := brand.stylesheet(); css != "" {
+		data["brand_css_version"] = contentID(css)
+	}
+	if brand.bannerMessage != "" && cookieValue(r, cookieBannerDismissed) != contentID(brand.bannerMessage) {
+		data["banner_message"] = brand.bannerMessage
+	}
+	return data
+}
+
+// dismissBannerHandler hides the announcement bar until its message changes,
+// and goes back to the page it was dismissed from.
+func dismissBannerHandler(w http.ResponseWriter, r *http.Request) {
+	if brand := currentBrand(); brand.bannerMessage != "" {
+		http.SetCookie(w, newCookie(cookieBannerDismissed, contentID(brand.bannerMessage)))
+	}
+	target, ok := localRedirect(r, r.FormValue("redirect_to"))
+	if !ok {
+		target, _ = localRedirect(r, r.Referer())
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusFound)
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStates = []breakerState{breakerClosed, breakerOpen, breakerHalfOpen}
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+var circuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "grpc_client_circuit_breaker_state",
+	Help: "Circuit breaker state by backend: 1 for the current state, 0 for the others.",
+}, []string{"service", "state"})
+
+var circuitBreakerRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "grpc_client_circuit_breaker_rejected_total",
+	Help: "Number of gRPC calls short-circuited by an open circuit breaker.",
+}, []string{"service"})
+
+// circuitBreaker stops calling a non-critical backend that keeps failing, so
+// that pages render without its content straight away instead of waiting for
+// every call to time out. After threshold consecutive failures the breaker
+// opens and rejects calls for cooldown; then a single probe call is let
+// through (half-open), whose outcome closes or reopens the breaker.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// newCircuitBreaker returns a closed breaker, or nil if threshold is not
+// positive, which disables it.
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	b := &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown, now: time.Now}
+	b.publish()
+	return b
+}
+
+// current returns the breaker's state; a nil breaker is always closed.
+func (b *circuitBreaker) current() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a call may proceed. In the half-open state only one
+// probe call is allowed at a time.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		b.setState(breakerHalfOpen)
+	}
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of an allowed call.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+	if status.Code(err) == codes.Canceled {
+		return // says nothing about the backend
+	}
+	if !isBackendFailure(err) {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState moves the breaker to s. b.mu must be held.
+func (b *circuitBreaker) setState(s breakerState) {
+	if b.state == s {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"breaker":      b.name,
+		"breaker.from": b.state.String(),
+		"breaker.to":   s.String(),
+	}).Warn("circuit breaker state changed")
+	b.state = s
+	b.publish()
+}
+
+func (b *circuitBreaker) publish() {
+	for _, s := range breakerStates {
+		v := 0.0
+		if s == b.state {
+			v = 1
+		}
+		circuitBreakerState.WithLabelValues(b.name, s.String()).Set(v)
+	}
+}
+
+// isBackendFailure reports whether err suggests the backend is unhealthy, as
+// opposed to the call being canceled or rejected on its merits.
+func isBackendFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+// unaryInterceptor short-circuits calls while the breaker is open, failing
+// them with codes.Unavailable. A nil breaker lets every call through.
+func (b *circuitBreaker) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if b == nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	if !b.allow() {
+		circuitBreakerRejectedTotal.WithLabelValues(b.name).Inc()
+		return status.Errorf(codes.Unavailable, "circuit breaker for %s is open", b.name)
+	}
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	b.record(err)
+	return err
+}
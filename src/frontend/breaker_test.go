@@ -0,0 +1,165 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newBreakerFrontend returns a frontend whose ad service calls go through b,
+// with b's clock under the test's control.
+func newBreakerFrontend(t *testing.T, fb *fakeBackend, b *circuitBreaker) (*frontendServer, func(time.Duration)) {
+	t.Helper()
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	// All fake services share one connection, so pick out the ad calls.
+	adOnly := func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if grpcServiceName(method) == "hipstershop.AdService" {
+			return b.unaryInterceptor(ctx, method, req, reply, cc, invoker, opts...)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	fe := newTestFrontend(t, fb, grpc.WithChainUnaryInterceptor(adOnly))
+	fe.breakers = map[string]*circuitBreaker{"ad": b}
+	return fe, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestCircuitBreakerStateMachine(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("GetAds", status.Error(codes.Unavailable, "down"))
+	b := newCircuitBreaker("ad", 3, time.Minute)
+	fe, advance := newBreakerFrontend(t, fb, b)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if b.current() != breakerClosed {
+			t.Fatalf("breaker %s after %d failures, want closed", b.current(), i)
+		}
+		fe.getAd(ctx, nil)
+	}
+	if b.current() != breakerOpen {
+		t.Fatalf("breaker %s after 3 failures, want open", b.current())
+	}
+	if got := testutil.ToFloat64(circuitBreakerState.WithLabelValues("ad", "open")); got != 1 {
+		t.Errorf("open state gauge = %v, want 1", got)
+	}
+
+	// Open: calls fail fast without reaching the backend.
+	if _, err := fe.getAd(ctx, nil); status.Code(err) != codes.Unavailable {
+		t.Errorf("short-circuited call: got %v, want Unavailable", err)
+	}
+	if n := fb.callCount("GetAds"); n != 3 {
+		t.Errorf("backend called %d times, want 3", n)
+	}
+
+	// Half-open: a failed probe reopens the breaker.
+	advance(time.Minute)
+	if b.current() != breakerHalfOpen {
+		t.Fatalf("breaker %s after the cool-down, want half-open", b.current())
+	}
+	fe.getAd(ctx, nil)
+	if b.current() != breakerOpen || fb.callCount("GetAds") != 4 {
+		t.Fatalf("breaker %s after a failed probe, want open", b.current())
+	}
+
+	// Half-open: a successful probe closes it.
+	advance(time.Minute)
+	fb.setError("GetAds", nil)
+	if _, err := fe.getAd(ctx, nil); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if b.current() != breakerClosed {
+		t.Errorf("breaker %s after a successful probe, want closed", b.current())
+	}
+	if got := testutil.ToFloat64(circuitBreakerState.WithLabelValues("ad", "closed")); got != 1 {
+		t.Errorf("closed state gauge = %v, want 1", got)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := newCircuitBreaker("test", 1, time.Minute)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	b.allow()
+	b.record(status.Error(codes.Unavailable, "down"))
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("probe call rejected")
+	}
+	if b.allow() {
+		t.Error("second call allowed while the probe is in flight")
+	}
+	b.record(nil)
+	if !b.allow() {
+		t.Error("call rejected after a successful probe")
+	}
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	b := newCircuitBreaker("test", 2, time.Minute)
+	for _, err := range []error{
+		status.Error(codes.NotFound, "x"),
+		status.Error(codes.InvalidArgument, "x"),
+		status.Error(codes.Canceled, "x"),
+		status.Error(codes.NotFound, "x"),
+	} {
+		b.allow()
+		b.record(err)
+	}
+	if b.current() != breakerClosed {
+		t.Errorf("breaker %s, want closed", b.current())
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	if b := newCircuitBreaker("test", 0, time.Minute); b != nil {
+		t.Errorf("newCircuitBreaker with threshold 0 = %v, want nil", b)
+	}
+}
+
+func TestHandlersDegradeWithOpenBreaker(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("GetAds", status.Error(codes.Unavailable, "down"))
+	b := newCircuitBreaker("ad", 1, time.Minute)
+	fe, _ := newBreakerFrontend(t, fb, b)
+	fe.getAd(context.Background(), nil)
+
+	fb.setLatency("GetAds", time.Second)
+	w, elapsed := serveHome(t, fe)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if elapsed >= time.Second {
+		t.Errorf("home page took %v with the ad breaker open", elapsed)
+	}
+
+	report := fe.checkReadiness(context.Background())
+	if got := report.Dependencies["ad"].Breaker; got != "open" {
+		t.Errorf("readiness reports ad breaker %q, want open", got)
+	}
+	if got := report.Dependencies["cart"].Breaker; got != "" {
+		t.Errorf("readiness reports cart breaker %q, want none", got)
+	}
+}
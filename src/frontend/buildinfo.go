@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/version"
+)
+
+var buildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "build_info",
+	Help: "Always 1, labeled with the version, commit and build date of the running binary.",
+}, []string{"version", "commit", "build_date", "goversion"})
+
+func init() {
+	v := version.Get()
+	buildInfo.WithLabelValues(v.Version, v.Commit, v.BuildDate, v.GoVersion).Set(1)
+}
+
+// buildLogFields are the build fields of the startup log line.
+func buildLogFields() logrus.Fields {
+	v := version.Get()
+	return logrus.Fields{
+		"build.version":    v.Version,
+		"build.commit":     v.Commit,
+		"build.date":       v.BuildDate,
+		"build.go_version": v.GoVersion,
+	}
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(loggerFromContext(r.Context()), w, http.StatusOK, version.Get())
+}
+
+// labelBuild labels every traced request with the version and commit, so
+// that traces can be told apart across a rollout.
+func labelBuild(next http.Handler) http.HandlerFunc {
+	v := version.Get()
+	return func(w http.ResponseWriter, r *http.Request) {
+		labelSpan(r.Context(), "build_version", v.Version)
+		labelSpan(r.Context(), "build_commit", v.Commit)
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.elastic.co/apm/apmtest"
+	"go.elastic.co/apm/module/apmhttp"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/version"
+)
+
+func TestVersionHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	versionHandler(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var got version.Info
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != version.Get() || got.GoVersion == "" {
+		t.Errorf("got %+v, want %+v", got, version.Get())
+	}
+
+	v := version.Get()
+	if n := testutil.ToFloat64(buildInfo.WithLabelValues(v.Version, v.Commit, v.BuildDate, v.GoVersion)); n != 1 {
+		t.Errorf("build_info = %v, want 1", n)
+	}
+}
+
+func TestLabelBuild(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	h := apmhttp.Wrap(labelBuild(http.NotFoundHandler()), apmhttp.WithTracer(tracer.Tracer))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	tracer.Flush(nil)
+
+	txs := tracer.Payloads().Transactions
+	if len(txs) != 1 {
+		t.Fatalf("recorded %d transactions", len(txs))
+	}
+	labels := make(map[string]interface{})
+	for _, l := range txs[0].Context.Tags {
+		labels[l.Key] = l.Value
+	}
+	if labels["build_version"] != version.Version {
+		t.Errorf("labels = %v, want build_version %q", labels, version.Version)
+	}
+}
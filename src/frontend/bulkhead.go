@@ -0,0 +1,108 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultBulkheadWait is how long a call waits for a permit of a full
+// bulkhead before failing.
+const defaultBulkheadWait = 50 * time.Millisecond
+
+var (
+	bulkheadInUse = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpc_client_bulkhead_in_use",
+		Help: "Number of calls in flight to a backend whose concurrency is limited by <SERVICE>_MAX_CONCURRENT, by service.",
+	}, []string{"service"})
+	bulkheadRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_client_bulkhead_rejected_total",
+		Help: "Number of calls failed without being sent because the backend's bulkhead stayed full, by service.",
+	}, []string{"service"})
+)
+
+// bulkhead caps the calls in flight to one backend, so that a slow backend
+// cannot tie up every request of the frontend and starve calls to the
+// healthy ones. A nil bulkhead lets every call through.
+type bulkhead struct {
+	service string
+	permits chan struct{}
+	wait    time.Duration
+}
+
+// newBulkhead returns a bulkhead admitting max concurrent calls to service,
+// or nil if max is 0.
+func newBulkhead(service string, max int, wait time.Duration) *bulkhead {
+	if max <= 0 {
+		return nil
+	}
+	bulkheadInUse.WithLabelValues(service).Set(0)
+	return &bulkhead{service: service, permits: make(chan struct{}, max), wait: wait}
+}
+
+// bulkheadFullError is returned for calls rejected by a full bulkhead. It
+// carries the ResourceExhausted code, but is shown to users as the backend
+// being unavailable rather than as too many requests of theirs; see
+// httpStatusFromGRPC.
+type bulkheadFullError struct {
+	service string
+	max     int
+}
+
+func (e *bulkheadFullError) Error() string {
+	return fmt.Sprintf("%s: all %d concurrent calls in use", e.service, e.max)
+}
+
+func (e *bulkheadFullError) GRPCStatus() *status.Status {
+	return status.New(codes.ResourceExhausted, e.Error())
+}
+
+// unaryInterceptor holds a permit for the duration of each call, retries
+// included. A call finding the bulkhead full waits up to b.wait for a permit,
+// then fails without being sent.
+func (b *bulkhead) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if b == nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	select {
+	case b.permits <- struct{}{}:
+	default:
+		timer := time.NewTimer(b.wait)
+		defer timer.Stop()
+		select {
+		case b.permits <- struct{}{}:
+		case <-timer.C:
+			bulkheadRejectedTotal.WithLabelValues(b.service).Inc()
+			return &bulkheadFullError{service: b.service, max: cap(b.permits)}
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	bulkheadInUse.WithLabelValues(b.service).Inc()
+	defer func() {
+		<-b.permits
+		bulkheadInUse.WithLabelValues(b.service).Dec()
+	}()
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
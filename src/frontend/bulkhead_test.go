@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestBulkhead(t *testing.T) {
+	b := newBulkhead("testservice", 2, 20*time.Millisecond)
+	release := make(chan struct{})
+	blocked := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		<-release
+		return nil
+	}
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- b.unaryInterceptor(context.Background(), "/x/Y", nil, nil, nil, blocked) }()
+	}
+	for testutil.ToFloat64(bulkheadInUse.WithLabelValues("testservice")) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rejected := testutil.ToFloat64(bulkheadRejectedTotal.WithLabelValues("testservice"))
+	start := time.Now()
+	err := b.unaryInterceptor(context.Background(), "/x/Y", nil, nil, nil, blocked)
+	if status.Code(err) != codes.ResourceExhausted || time.Since(start) < 20*time.Millisecond {
+		t.Errorf("third call: %v after %v, want ResourceExhausted after the wait", err, time.Since(start))
+	}
+	if got := testutil.ToFloat64(bulkheadRejectedTotal.WithLabelValues("testservice")) - rejected; got != 1 {
+		t.Errorf("%v rejections counted, want 1", got)
+	}
+
+	// A permit freed during the wait is taken.
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	passed := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return nil
+	}
+	if err := b.unaryInterceptor(context.Background(), "/x/Y", nil, nil, nil, passed); err != nil {
+		t.Errorf("call after a permit was freed: %v", err)
+	}
+	close(release)
+	<-done
+	<-done
+	if got := testutil.ToFloat64(bulkheadInUse.WithLabelValues("testservice")); got != 0 {
+		t.Errorf("%v permits in use after the calls, want 0", got)
+	}
+
+	if err := (*bulkhead)(nil).unaryInterceptor(context.Background(), "/x/Y", nil, nil, nil, passed); err != nil {
+		t.Errorf("nil bulkhead: %v", err)
+	}
+}
+
+// TestBulkheadDegradesOptionalBackends checks that a full bulkhead fails
+// checkout with a 503 but only leaves the recommendations out of a page.
+func TestBulkheadDegradesOptionalBackends(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	full := &bulkhead{service: "testservice", permits: make(chan struct{}, 1), wait: time.Millisecond}
+	full.permits <- struct{}{}
+	fe := newTestFrontend(t, fb)
+	limited := newTestFrontend(t, fb, grpcDialOptions(0, full, nil)...)
+	fe.checkoutSvcConn, fe.recommendationSvcConn = limited.checkoutSvcConn, limited.recommendationSvcConn
+
+	w := placeTestOrder(t, fe)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("checkout: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Sunglasses") {
+		t.Errorf("cart: status %d", w.Code)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	cartCountTTL = 2 * time.Second
+
+	// maxCartCounts bounds the memory of the cache; past it, expired
+	// entries are dropped, and if none are, everything is.
+	maxCartCounts = 10000
+)
+
+type cachedCartCount struct {
+	count   int
+	expires time.Time
+}
+
+// cartCounts caches the number of items in carts for a short while, so that
+// pages polling /api/cart/count do not each cost a GetCart. Entries are keyed
+// by session and cart version, so a change made through this frontend is
+// seen at once.
+type cartCounts struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]cachedCartCount
+}
+
+func newCartCounts(ttl time.Duration) *cartCounts {
+	return &cartCounts{ttl: ttl, max: maxCartCounts, entries: make(map[string]cachedCartCount)}
+}
+
+func (c *cartCounts) get(key string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return 0, false
+	}
+	return e.count, true
+}
+
+func (c *cartCounts) put(key string, count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.max {
+			c.entries = make(map[string]cachedCartCount)
+		}
+	}
+	c.entries[key] = cachedCartCount{count: count, expires: now.Add(c.ttl)}
+}
+
+type apiCartCount struct {
+	Count int `json:"count"`
+	// Degraded is set when the cart could not be read and Count is only a
+	// placeholder.
+	Degraded bool `json:"degraded,omitempty"`
+}
+
+// apiCartCountHandler returns the number of items in the cart, for the badge
+// of the header. The badge is cosmetic, so a cart service failure is not an
+// error: the count is 0 and marked degraded.
+func (fe *frontendServer) apiCartCountHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	w.Header().Set("Cache-Control", "no-store")
+
+	n, err := fe.cartCount(r.Context(), r)
+	if err != nil {
+		log.WithField("error", err).Warn("failed to retrieve cart for its item count")
+		writeJSON(log, w, http.StatusOK, apiCartCount{Degraded: true})
+		return
+	}
+	writeJSON(log, w, http.StatusOK, apiCartCount{Count: n})
+}
+
+// cartCount returns the number of items in the cart of r, from fe.cartCounts
+// while it is fresh.
+func (fe *frontendServer) cartCount(ctx context.Context, r *http.Request) (int, error) {
+	key := sessionID(r) + "/" + cartVersion(r)
+	if fe.cartCounts != nil {
+		if n, ok := fe.cartCounts.get(key); ok {
+			return n, nil
+		}
+	}
+	cart, err := fe.getCart(ctx, sessionID(r))
+	if err != nil {
+		return 0, err
+	}
+	n := cartSize(cart)
+	if fe.cartCounts != nil {
+		fe.cartCounts.put(key, n)
+	}
+	return n, nil
+}
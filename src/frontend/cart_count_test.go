@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func getCartCount(t *testing.T, fe *frontendServer, r *http.Request) apiCartCount {
+	t.Helper()
+	w := httptest.NewRecorder()
+	fe.apiCartCountHandler(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("status %d, Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	var got apiCartCount
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestAPICartCount(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}, {ProductId: "66VCHSJNUP", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+	fe.cartCounts = newCartCounts(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if got := getCartCount(t, fe, newTestRequest(http.MethodGet, "/api/cart/count", nil)); got != (apiCartCount{Count: 3}) {
+			t.Errorf("count = %+v, want 3", got)
+		}
+	}
+	if n := fb.callCount("GetCart"); n != 1 {
+		t.Errorf("GetCart called %d times, want the count cached", n)
+	}
+
+	// Changing the cart bumps its version, which skips the cache.
+	fb.carts["test-session"] = nil
+	r := newTestRequest(http.MethodGet, "/api/cart/count", nil)
+	r.AddCookie(&http.Cookie{Name: cookieCartVersion, Value: "2"})
+	if got := getCartCount(t, fe, r); got.Count != 0 {
+		t.Errorf("count after a cart change = %d, want 0", got.Count)
+	}
+}
+
+func TestAPICartCountDegraded(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("GetCart", status.Error(codes.Unavailable, "down"))
+	fe := newTestFrontend(t, fb)
+	if got := getCartCount(t, fe, newTestRequest(http.MethodGet, "/api/cart/count", nil)); got != (apiCartCount{Degraded: true}) {
+		t.Errorf("count = %+v, want a degraded 0", got)
+	}
+}
+
+func TestCartCountsBounded(t *testing.T) {
+	c := newCartCounts(time.Minute)
+	c.max = 2
+	c.put("a", 1)
+	c.put("b", 2)
+	c.put("c", 3)
+	if n, ok := c.get("c"); !ok || n != 3 || len(c.entries) > c.max {
+		t.Errorf("get(c) = %d, %v with %d entries", n, ok, len(c.entries))
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// cartItemView is a cart line priced in the user's currency.
+type cartItemView struct {
+	Item      *pb.Product
+	Variant   string // "" for the product without a variant
+	Quantity  int32
+	UnitPrice *pb.Money
+	Price     *pb.Money // line total
+}
+
+// cartView is a cart with product details and prices resolved, as shown on
+// the cart page and returned by /api/cart.
+type cartView struct {
+	Items    []cartItemView
+	Subtotal pb.Money
+	// Promo is the promo code applied, and Discount what it takes off the
+	// subtotal; both are empty without a promo code.
+	Promo    string
+	Discount *pb.Money
+	// EstimatedShipping is nil when shipping could not be estimated.
+	EstimatedShipping *pb.Money
+	Total             pb.Money // subtotal less discount plus estimated shipping
+	// Unavailable are the IDs of the products in the cart that the catalog
+	// no longer has. Their lines are left out of the view; the order cannot
+	// be placed until they are removed from the cart.
+	Unavailable []string
+}
+
+// buildCartView looks up the products in cart concurrently and prices them
+// in currency, with a line for each of their variants, and the discount of
+// promo, if not nil. Lines of products the catalog no longer has are dropped
+// into Unavailable. Shipping to addr is estimated on a
+// best-effort basis: it is left out if addr is nil or the shipping service
+// fails. Errors are wrapped with a message fit for users.
+func (fe *frontendServer) buildCartView(ctx context.Context, cart []*pb.CartItem, variants cartVariants, addr *pb.Address, promo *promoCode, currency string) (*cartView, error) {
+	view := &cartView{
+		Items:    make([]cartItemView, 0, len(cart)),
+		Subtotal: pb.Money{CurrencyCode: currency},
+	}
+	found, missing, err := fe.lookupProducts(ctx, cartIDs(cart), currency)
+	if err != nil {
+		return nil, err
+	}
+	products := make(map[string]productView, len(found))
+	for _, p := range found {
+		products[p.Item.GetId()] = p
+	}
+	available := make([]*pb.CartItem, 0, len(cart))
+	for _, item := range cart {
+		pv, ok := products[item.GetProductId()]
+		if !ok {
+			continue
+		}
+		available = append(available, item)
+		p, price := pv.Item, pv.Price
+
+		for _, l := range variants.lines(item) {
+			multPrice := money.MultiplySlow(*price, uint32(l.Quantity))
+			view.Items = append(view.Items, cartItemView{
+				Item:      p,
+				Variant:   l.Variant,
+				Quantity:  l.Quantity,
+				UnitPrice: price,
+				Price:     &multPrice})
+			view.Subtotal = money.Must(money.Sum(view.Subtotal, multPrice))
+		}
+	}
+	for _, id := range missing {
+		loggerFromContext(ctx).WithField("product_id", id).Warn("cart has a product the catalog no longer has")
+	}
+	view.Unavailable = missing
+
+	view.Total = view.Subtotal
+	if promo != nil && len(available) > 0 {
+		d, err := fe.promoDiscount(ctx, *promo, &view.Subtotal)
+		if err != nil {
+			return nil, err
+		}
+		view.Promo, view.Discount = promo.code, d
+		view.Total = money.Must(money.Sum(view.Subtotal, money.Negate(*d)))
+	}
+
+	if addr == nil || len(available) == 0 {
+		return view, nil
+	}
+	shippingCost, err := fe.getShippingQuote(ctx, available, addr, currency)
+	if err != nil {
+		loggerFromContext(ctx).WithField("error", err).Warn("failed to estimate shipping")
+		return view, nil
+	}
+	view.EstimatedShipping = shippingCost
+	view.Total = money.Must(money.Sum(view.Total, *shippingCost))
+	return view, nil
+}
+
+// sessionCartView returns the session's cart and its view, with the promo
+// code applied and shipping estimated to the saved address.
+func (fe *frontendServer) sessionCartView(r *http.Request) ([]*pb.CartItem, *cartView, error) {
+	cart, err := fe.getCart(r.Context(), sessionID(r))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not retrieve cart")
+	}
+	var promo *promoCode
+	if p, ok := fe.activePromo(r); ok {
+		promo = &p
+	}
+	view, err := fe.buildCartView(r.Context(), cart, sessionCartVariants(r), fe.savedAddress(r), promo, currentCurrency(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	return cart, view, nil
+}
+
+// cartCategories returns the categories of the products in the cart.
+func cartCategories(view *cartView) []string {
+	products := make([]*pb.Product, len(view.Items))
+	for i, it := range view.Items {
+		products[i] = it.Item
+	}
+	return productCategories(products...)
+}
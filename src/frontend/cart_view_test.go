@@ -0,0 +1,66 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestCartWithUnavailableProduct(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}, {ProductId: "GONE000000", Quantity: 2}}
+	fe := newTestFrontend(t, fb)
+	store := newMemorySessionStore(time.Hour, 10)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, withSessionState(newTestRequest(http.MethodGet, "/cart", nil), store))
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("cart: status %d: %.500s", w.Code, body)
+	}
+	if !strings.Contains(body, "Sunglasses") || !strings.Contains(body, "no longer available") || !strings.Contains(body, `action="/cart/clean-up"`) {
+		t.Errorf("cart page lacks the available line or the notice: %.2000s", body)
+	}
+
+	w = httptest.NewRecorder()
+	fe.placeOrderHandler(w, withSessionState(newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm())), store))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "Remove them to place your order") {
+		t.Errorf("checkout: status %d, want %d with the reason", w.Code, http.StatusConflict)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Errorf("%d orders placed, want none", n)
+	}
+
+	w = httptest.NewRecorder()
+	fe.cleanUpCartHandler(w, withSessionState(newTestRequest(http.MethodPost, "/cart/clean-up", nil), store))
+	if w.Code != http.StatusFound {
+		t.Fatalf("clean up: status %d", w.Code)
+	}
+	if cart := fb.carts["test-session"]; len(cart) != 1 || cart[0].GetProductId() != "OLJCESPC7Z" || cart[0].GetQuantity() != 1 {
+		t.Errorf("cart after clean up = %v, want the sunglasses only", cart)
+	}
+
+	w = httptest.NewRecorder()
+	fe.placeOrderHandler(w, withSessionState(newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm())), store))
+	if w.Code != http.StatusOK {
+		t.Errorf("checkout after clean up: status %d", w.Code)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	defaultCatalogCacheTTL = 2 * time.Minute
+
+	catalogFetchTimeout = 2 * time.Second
+
+	catalogListKey = "list"
+)
+
+var catalogCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "catalog_cache_requests_total",
+	Help: "Number of product catalog lookups, by result: hit, miss, or stale when a failed refresh fell back to an expired entry.",
+}, []string{"result"})
+
+type cachedCatalog struct {
+	products []*pb.Product
+	fetched  time.Time
+	expires  time.Time
+}
+
+// catalogCache is a read-through cache of the product catalog: the full list
+// and individual products are each kept for ttl. When refreshing an expired
+// entry fails, the stale entry is served instead of the error.
+type catalogCache struct {
+	ttl   time.Duration
+	conn  *grpc.ClientConn
+	group singleflight.Group
+
+	mu      sync.RWMutex
+	entries map[string]cachedCatalog // by catalogListKey or product ID
+	// generation is bumped by flush, so that a fetch started before a flush
+	// does not store what it got.
+	generation uint64
+
+	hits, misses atomic.Int64
+}
+
+func newCatalogCache(conn *grpc.ClientConn, ttl time.Duration) *catalogCache {
+	return &catalogCache{ttl: ttl, conn: conn, entries: make(map[string]cachedCatalog)}
+}
+
+// listProducts returns every product of the catalog.
+func (c *catalogCache) listProducts(ctx context.Context) ([]*pb.Product, error) {
+	return c.get(ctx, catalogListKey, func(ctx context.Context) ([]*pb.Product, error) {
+		resp, err := pb.NewProductCatalogServiceClient(c.conn).ListProducts(ctx, &pb.Empty{})
+		return resp.GetProducts(), err
+	})
+}
+
+// listFetched returns when the cached list of products was fetched, or the
+// zero time if it is not cached.
+func (c *catalogCache) listFetched() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries[catalogListKey].fetched
+}
+
+// product returns the product with the given ID. Unknown IDs are not cached.
+func (c *catalogCache) product(ctx context.Context, id string) (*pb.Product, error) {
+	ps, err := c.get(ctx, id, func(ctx context.Context) ([]*pb.Product, error) {
+		p, err := pb.NewProductCatalogServiceClient(c.conn).GetProduct(ctx, &pb.GetProductRequest{Id: id})
+		if err != nil {
+			return nil, err
+		}
+		return []*pb.Product{p}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ps[0], nil
+}
+
+// get returns the entry for key, fetching it if it is missing or expired.
+// Concurrent fetches of the same key share a single RPC.
+func (c *catalogCache) get(ctx context.Context, key string, fetch func(context.Context) ([]*pb.Product, error)) ([]*pb.Product, error) {
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	gen := c.generation
+	c.mu.RUnlock()
+	if ok && time.Now().Before(e.expires) {
+		c.hits.Add(1)
+		catalogCacheRequests.WithLabelValues("hit").Inc()
+		return e.products, nil
+	}
+	c.misses.Add(1)
+
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		// Detach from the caller's cancellation: the result is shared with
+		// every request waiting on this key.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), catalogFetchTimeout)
+		defer cancel()
+		products, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		if c.generation == gen {
+			now := time.Now()
+			c.entries[key] = cachedCatalog{products: products, fetched: now, expires: now.Add(c.ttl)}
+		}
+		c.mu.Unlock()
+		return products, nil
+	})
+	if err != nil {
+		if ok {
+			catalogCacheRequests.WithLabelValues("stale").Inc()
+			log.WithField("error", err).WithField("catalog.key", key).Warn("failed to refresh catalog cache, serving stale entry")
+			return e.products, nil
+		}
+		catalogCacheRequests.WithLabelValues("miss").Inc()
+		return nil, err
+	}
+	catalogCacheRequests.WithLabelValues("miss").Inc()
+	return v.([]*pb.Product), nil
+}
+
+// flush drops every entry, e.g. after the catalog has been edited.
+func (c *catalogCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cachedCatalog)
+	c.generation++
+}
+
+// cacheFlushHandler empties the catalog cache on POST.
+func (fe *frontendServer) cacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(log, w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed", Code: http.StatusMethodNotAllowed})
+		return
+	}
+	flushed := []string{}
+	if fe.catalog != nil {
+		fe.catalog.flush()
+		flushed = append(flushed, "catalog")
+	}
+	log.WithFields(logrus.Fields{"caches": flushed, "client_ip": clientIP(r)}).Warn("caches flushed")
+	writeJSON(log, w, http.StatusOK, map[string][]string{"flushed": flushed})
+}
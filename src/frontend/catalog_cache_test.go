@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// expire makes every entry of c stale.
+func (c *catalogCache) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		e.expires = time.Time{}
+		c.entries[k] = e
+	}
+}
+
+func TestCatalogCache(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	fe.catalog = newCatalogCache(fe.productCatalogSvcConn, time.Minute)
+	ctx := context.Background()
+
+	for range 3 {
+		if ps, err := fe.getProducts(ctx); err != nil || len(ps) != 3 {
+			t.Fatalf("getProducts = %d products, %v", len(ps), err)
+		}
+		if p, err := fe.getProduct(ctx, "OLJCESPC7Z"); err != nil || p.GetName() != "Sunglasses" {
+			t.Fatalf("getProduct = %v, %v", p, err)
+		}
+	}
+	if n, m := fb.callCount("ListProducts"), fb.callCount("GetProduct"); n != 1 || m != 1 {
+		t.Errorf("%d ListProducts and %d GetProduct calls, want 1 each", n, m)
+	}
+	if h, m := fe.catalog.hits.Load(), fe.catalog.misses.Load(); h != 4 || m != 2 {
+		t.Errorf("%d hits and %d misses, want 4 and 2", h, m)
+	}
+
+	fe.catalog.expire()
+	fe.getProducts(ctx)
+	if n := fb.callCount("ListProducts"); n != 2 {
+		t.Errorf("%d ListProducts calls after expiry, want 2", n)
+	}
+
+	for range 2 {
+		if _, err := fe.getProduct(ctx, "NOPE"); status.Code(err) != codes.NotFound {
+			t.Fatalf("unknown product: %v", err)
+		}
+	}
+	if n := fb.callCount("GetProduct"); n != 3 {
+		t.Errorf("%d GetProduct calls, want unknown IDs not to be cached", n)
+	}
+}
+
+func TestCatalogCacheServesStaleOnError(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	fe.catalog = newCatalogCache(fe.productCatalogSvcConn, time.Minute)
+	ctx := context.Background()
+
+	fe.getProducts(ctx)
+	fe.catalog.expire()
+	fb.setError("ListProducts", status.Error(codes.Unavailable, "down"))
+	fb.setError("GetProduct", status.Error(codes.Unavailable, "down"))
+	if ps, err := fe.getProducts(ctx); err != nil || len(ps) != 3 {
+		t.Errorf("with a stale entry: %d products, %v", len(ps), err)
+	}
+	if n := fb.callCount("ListProducts"); n != 2 {
+		t.Errorf("%d ListProducts calls, want a refresh attempt", n)
+	}
+	if _, err := fe.getProduct(ctx, "OLJCESPC7Z"); status.Code(err) != codes.Unavailable {
+		t.Errorf("without a stale entry: %v, want Unavailable", err)
+	}
+}
+
+func TestCatalogCacheSharesFetches(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setLatency("ListProducts", 50*time.Millisecond)
+	fe := newTestFrontend(t, fb)
+	fe.catalog = newCatalogCache(fe.productCatalogSvcConn, time.Minute)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fe.getProducts(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fb.callCount("ListProducts"); n != 1 {
+		t.Errorf("%d ListProducts calls for concurrent misses, want 1", n)
+	}
+}
+
+func TestCacheFlushHandler(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	fe.catalog = newCatalogCache(fe.productCatalogSvcConn, time.Minute)
+	fe.getProducts(context.Background())
+	h := fe.adminHandler(discardLog, "")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/cache/flush", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/cache/flush", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: status %d: %s", w.Code, w.Body)
+	}
+	fe.getProducts(context.Background())
+	if n := fb.callCount("ListProducts"); n != 2 {
+		t.Errorf("%d ListProducts calls, want a fetch after the flush", n)
+	}
+}
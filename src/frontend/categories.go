@@ -0,0 +1,191 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	defaultCategoryPageSize = 12
+	maxCategoryPageSize     = 48
+)
+
+// navCategories holds the categories of the catalog as of the last successful
+// listing, for the navigation of every page. It is empty until the catalog
+// has been listed once.
+var navCategories atomic.Pointer[[]string]
+
+func setNavCategories(products []*pb.Product) {
+	c := productCategories(products...)
+	navCategories.Store(&c)
+}
+
+func getNavCategories() []string {
+	if c := navCategories.Load(); c != nil {
+		return *c
+	}
+	return nil
+}
+
+// productSorts are the orders a category page can be sorted by with ?sort=.
+// Without one, products are listed in catalog order.
+var productSorts = map[string]func(a, b *pb.Product) int{
+	"price_asc":  func(a, b *pb.Product) int { return comparePrices(a, b) },
+	"price_desc": func(a, b *pb.Product) int { return comparePrices(b, a) },
+	"name":       func(a, b *pb.Product) int { return strings.Compare(a.GetName(), b.GetName()) },
+}
+
+// comparePrices orders products by their price in USD, which every product
+// of the catalog has.
+func comparePrices(a, b *pb.Product) int {
+	x, y := a.GetPriceUsd(), b.GetPriceUsd()
+	if x.GetUnits() != y.GetUnits() {
+		if x.GetUnits() < y.GetUnits() {
+			return -1
+		}
+		return 1
+	}
+	return int(x.GetNanos()) - int(y.GetNanos())
+}
+
+// inCategory reports whether p is in the category name, ignoring case.
+func inCategory(p *pb.Product, name string) bool {
+	for _, c := range p.GetCategories() {
+		if strings.EqualFold(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// pageParam parses the positive integer query parameter key, or returns def
+// when it is absent.
+func pageParam(q url.Values, key string, def int) (int, error) {
+	v := q.Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, errors.Errorf("%s must be a positive integer, got %q", key, v)
+	}
+	return n, nil
+}
+
+// categoryPageURL returns the URL of page of the category listing r asked
+// for, keeping its sort order and page size.
+func categoryPageURL(r *http.Request, page int) string {
+	q := r.URL.Query()
+	q.Set("page", strconv.Itoa(page))
+	return baseUrl + "/category/" + url.PathEscape(mux.Vars(r)["name"]) + "?" + q.Encode()
+}
+
+// categoryHandler lists the products of a category, sorted by ?sort= and
+// split into pages by ?page= and ?size=. A category without products is not
+// an error: it renders an empty listing.
+func (fe *frontendServer) categoryHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	name := mux.Vars(r)["name"]
+	q := r.URL.Query()
+
+	sortBy := q.Get("sort")
+	if _, ok := productSorts[sortBy]; sortBy != "" && !ok {
+		renderHTTPError(log, r, w, errors.Errorf("unknown sort order %q: use price_asc, price_desc or name", sortBy), http.StatusBadRequest)
+		return
+	}
+	page, err := pageParam(q, "page", 1)
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
+	size, err := pageParam(q, "size", defaultCategoryPageSize)
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
+	size = min(size, maxCategoryPageSize)
+	log.WithField("category", name).Debug("listing category")
+	if r.Method == http.MethodHead {
+		answerHead(w, r, "", 0)
+		return
+	}
+
+	var (
+		common   templateData
+		products []*pb.Product
+	)
+	g, gctx := errgroup.WithContext(r.Context())
+	g.Go(func() error {
+		common = fe.commonTemplateData(gctx, r)
+		return nil
+	})
+	g.Go(func() (err error) {
+		products, err = fe.getProducts(gctx)
+		return errors.Wrap(err, "could not retrieve products")
+	})
+	if err := g.Wait(); err != nil {
+		renderGRPCError(log, r, w, err)
+		return
+	}
+
+	var matches []*pb.Product
+	for _, p := range products {
+		if inCategory(p, name) {
+			matches = append(matches, p)
+		}
+	}
+	if order := productSorts[sortBy]; order != nil {
+		slices.SortStableFunc(matches, order)
+	}
+	pages := max(1, (len(matches)+size-1)/size)
+	page = min(page, pages)
+	start := (page - 1) * size
+	ps, err := fe.priceProducts(r.Context(), matches[start:min(start+size, len(matches))], currentCurrency(r))
+	if err != nil {
+		renderGRPCError(log, r, w, err)
+		return
+	}
+
+	data := common.with(map[string]interface{}{
+		"category": name,
+		"products": ps,
+		"total":    len(matches),
+		"sort":     sortBy,
+		"size":     size,
+		"page":     page,
+		"pages":    pages,
+	})
+	if page > 1 {
+		data["prev_url"] = categoryPageURL(r, page-1)
+	}
+	if page < pages {
+		data["next_url"] = categoryPageURL(r, page+1)
+	}
+	if err := templates.ExecuteTemplate(w, "category", data); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func categoryRequest(name, query string) *http.Request {
+	target := "/category/" + name
+	if query != "" {
+		target += "?" + query
+	}
+	return mux.SetURLVars(newTestRequest(http.MethodGet, target, nil), map[string]string{"name": name})
+}
+
+var productNames = regexp.MustCompile(`hot-product-card-name">([^<]+)<`)
+
+// listedProducts returns the names of the products a listing page shows.
+func listedProducts(body string) []string {
+	var names []string
+	for _, m := range productNames.FindAllStringSubmatch(body, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+func TestCategoryHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		category string
+		query    string
+		want     []string
+	}{
+		{"catalog order", "accessories", "", []string{"Sunglasses", "Watch"}},
+		{"any case", "Accessories", "", []string{"Sunglasses", "Watch"}},
+		{"price descending", "accessories", "sort=price_desc", []string{"Watch", "Sunglasses"}},
+		{"price ascending", "accessories", "sort=price_asc", []string{"Sunglasses", "Watch"}},
+		{"name", "accessories", "sort=name", []string{"Sunglasses", "Watch"}},
+		{"second page", "accessories", "sort=price_desc&size=1&page=2", []string{"Sunglasses"}},
+		{"past the last page", "accessories", "size=1&page=9", []string{"Watch"}},
+		{"oversized page", "accessories", "size=1000", []string{"Sunglasses", "Watch"}},
+		{"several categories", "tops", "", []string{"Tank Top"}},
+		{"unknown category", "garden", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := newTestFrontend(t, newFakeBackend())
+			w := httptest.NewRecorder()
+			fe.categoryHandler(w, categoryRequest(tt.category, tt.query))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if got := listedProducts(w.Body.String()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("products = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCategoryHandlerPages(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	fe.categoryHandler(w, categoryRequest("accessories", "sort=name&size=1"))
+	body := w.Body.String()
+	if !strings.Contains(body, "Page 1 of 2") || !strings.Contains(body, `href="/category/accessories?page=2&amp;size=1&amp;sort=name"`) {
+		t.Errorf("first page does not link to the second: %.2000s", body)
+	}
+	if strings.Contains(body, `rel="prev"`) {
+		t.Error("first page links to a previous page")
+	}
+}
+
+func TestCategoryHandlerRejectsBadQuery(t *testing.T) {
+	for _, query := range []string{"sort=popular", "page=0", "page=two", "size=-1"} {
+		fe := newTestFrontend(t, newFakeBackend())
+		w := httptest.NewRecorder()
+		fe.categoryHandler(w, categoryRequest("accessories", query))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestNavigationListsCategories(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	if got, want := getNavCategories(), []string{"accessories", "clothing", "tops"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("navigation categories = %v, want %v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if !strings.Contains(w.Body.String(), `href="/category/clothing"`) {
+		t.Error("cart page does not link to the categories")
+	}
+}
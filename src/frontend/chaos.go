@@ -0,0 +1,299 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var chaosInjectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chaos_injections_total",
+	Help: "Number of faults injected by chaos rules, by target (a route or RPC) and kind: latency or error.",
+}, []string{"target", "kind"})
+
+// chaosRule injects faults into the requests to one route or the calls to one
+// backend RPC, for reproducible failure demos.
+type chaosRule struct {
+	// route is a route's path template below BASE_URL, e.g.
+	// /product/{id}, or its name, e.g. checkout.
+	route string
+	// rpc is a gRPC service, e.g. CartService, or one of its methods, e.g.
+	// CartService/GetCart.
+	rpc string
+	// latency is added to every request or call, plus a random delay of up
+	// to jitter.
+	latency time.Duration
+	jitter  time.Duration
+	// errorRate is the fraction of requests or calls, from 0 to 1, that fail
+	// as if the backend were Unavailable.
+	errorRate float64
+}
+
+// parseChaosRules parses rules written as in CHAOS_RULES: rules are separated
+// by commas, and each is a list of key=value fields separated by semicolons,
+// e.g. "route=/cart/checkout;latency=2s;error_rate=0.1,rpc=AdService;jitter=500ms".
+// Each rule needs a route or an rpc, and a fault.
+func parseChaosRules(s string) ([]chaosRule, error) {
+	var rules []chaosRule
+	for _, text := range strings.Split(s, ",") {
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		var rule chaosRule
+		for _, field := range strings.Split(text, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok {
+				return nil, errors.Errorf("chaos rule %q: field %q is not of the form key=value", text, field)
+			}
+			var err error
+			switch k {
+			case "route":
+				rule.route = v
+			case "rpc":
+				rule.rpc = strings.TrimPrefix(v, "/")
+			case "latency":
+				rule.latency, err = time.ParseDuration(v)
+			case "jitter":
+				rule.jitter, err = time.ParseDuration(v)
+			case "error_rate":
+				rule.errorRate, err = strconv.ParseFloat(v, 64)
+				if err == nil && (rule.errorRate < 0 || rule.errorRate > 1) {
+					err = errors.New("not between 0 and 1")
+				}
+			default:
+				return nil, errors.Errorf("chaos rule %q: unknown field %q", text, k)
+			}
+			if err != nil || rule.latency < 0 || rule.jitter < 0 {
+				return nil, errors.Errorf("chaos rule %q: invalid %s %q", text, k, v)
+			}
+		}
+		if (rule.route == "") == (rule.rpc == "") {
+			return nil, errors.Errorf("chaos rule %q: needs either a route or an rpc", text)
+		}
+		if rule.latency == 0 && rule.jitter == 0 && rule.errorRate == 0 {
+			return nil, errors.Errorf("chaos rule %q: injects nothing", text)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule chaosRule) String() string {
+	var fields []string
+	if rule.route != "" {
+		fields = append(fields, "route="+rule.route)
+	} else {
+		fields = append(fields, "rpc="+rule.rpc)
+	}
+	if rule.latency > 0 {
+		fields = append(fields, "latency="+rule.latency.String())
+	}
+	if rule.jitter > 0 {
+		fields = append(fields, "jitter="+rule.jitter.String())
+	}
+	if rule.errorRate > 0 {
+		fields = append(fields, "error_rate="+strconv.FormatFloat(rule.errorRate, 'g', -1, 64))
+	}
+	return strings.Join(fields, ";")
+}
+
+// matchesRPC reports whether the rule applies to calls to method, such as
+// /hipstershop.CartService/GetCart.
+func (rule chaosRule) matchesRPC(method string) bool {
+	if rule.rpc == "" {
+		return false
+	}
+	_, name, _ := strings.Cut(strings.TrimPrefix(method, "/"), ".") // drop the package
+	return name == rule.rpc || strings.HasPrefix(name, rule.rpc+"/")
+}
+
+// inject waits for the rule's latency, then reports whether the request or
+// call must fail. It gives up waiting when ctx is done.
+func (rule chaosRule) inject(ctx context.Context, target string) bool {
+	d := rule.latency
+	if rule.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(rule.jitter)))
+	}
+	if d > 0 {
+		chaosInjectionsTotal.WithLabelValues(target, "latency").Inc()
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+		}
+		t.Stop()
+	}
+	if rule.errorRate > 0 && rand.Float64() < rule.errorRate {
+		chaosInjectionsTotal.WithLabelValues(target, "error").Inc()
+		return true
+	}
+	return false
+}
+
+// errChaos is what a call failed by a chaos rule returns: what a backend that
+// is down would.
+var errChaos = status.Error(codes.Unavailable, "chaos: injected failure")
+
+// chaosInjector applies the current chaos rules, which can be changed at
+// runtime through /debug/chaos on the admin port.
+type chaosInjector struct {
+	rules atomic.Pointer[[]chaosRule]
+}
+
+// chaos is nil unless CHAOS_RULES or the admin port is set, in which case
+// main installs its hooks on every route and backend connection. Without
+// rules, they cost an atomic load.
+var chaos *chaosInjector
+
+func newChaosInjector(rules []chaosRule) *chaosInjector {
+	c := new(chaosInjector)
+	c.set(rules)
+	return c
+}
+
+func (c *chaosInjector) set(rules []chaosRule) {
+	if len(rules) == 0 {
+		c.rules.Store(nil)
+		return
+	}
+	c.rules.Store(&rules)
+}
+
+func (c *chaosInjector) get() []chaosRule {
+	if p := c.rules.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// middleware applies the first rule for route, the name of next, to its
+// requests. Failed requests get the error page or JSON error of an
+// Unavailable backend. A nil injector returns next.
+func (c *chaosInjector) middleware(route string, next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules := c.rules.Load()
+		if rules == nil {
+			next(w, r)
+			return
+		}
+		var tpl string
+		if cur := mux.CurrentRoute(r); cur != nil {
+			tpl, _ = cur.GetPathTemplate()
+			tpl = strings.TrimPrefix(tpl, baseUrl)
+		}
+		for _, rule := range *rules {
+			if rule.route != route && rule.route != tpl {
+				continue
+			}
+			if rule.inject(r.Context(), route) {
+				log := loggerFromContext(r.Context())
+				if wantsJSON(r) {
+					renderAPIGRPCError(log, r, w, errChaos)
+				} else {
+					renderGRPCError(log, r, w, errChaos)
+				}
+				return
+			}
+			break
+		}
+		next(w, r)
+	}
+}
+
+// unaryInterceptor applies the first rule for the called method. It must be
+// the innermost interceptor, so that retries, breakers, metrics and traces
+// handle injected failures as real ones.
+func (c *chaosInjector) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if rules := c.rules.Load(); rules != nil {
+		for _, rule := range *rules {
+			if !rule.matchesRPC(method) {
+				continue
+			}
+			if rule.inject(ctx, grpcServiceName(method)) {
+				return errChaos
+			}
+			break
+		}
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+type chaosRulesBody struct {
+	Rules string `json:"rules"`
+}
+
+// chaosHandler reports the chaos rules on GET and replaces them on PUT, with
+// a JSON body such as {"rules": "rpc=CartService;error_rate=0.5"} in the
+// syntax of CHAOS_RULES; DELETE removes them all. Changes last until the next
+// restart.
+func (c *chaosInjector) handler(log *logrus.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodDelete:
+			var rules []chaosRule
+			if r.Method == http.MethodPut {
+				var body chaosRulesBody
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					writeJSON(log, w, http.StatusBadRequest, apiError{Error: "invalid request body", Code: http.StatusBadRequest})
+					return
+				}
+				var err error
+				if rules, err = parseChaosRules(body.Rules); err != nil {
+					writeJSON(log, w, http.StatusBadRequest, apiError{Error: err.Error(), Code: http.StatusBadRequest})
+					return
+				}
+			}
+			c.set(rules)
+			log.WithFields(logrus.Fields{
+				"chaos.rules": formatChaosRules(rules),
+				"client_ip":   clientIP(r),
+			}).Warn("chaos rules changed")
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			writeJSON(log, w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed", Code: http.StatusMethodNotAllowed})
+			return
+		}
+		writeJSON(log, w, http.StatusOK, chaosRulesBody{Rules: formatChaosRules(c.get())})
+	}
+}
+
+func formatChaosRules(rules []chaosRule) string {
+	out := make([]string, len(rules))
+	for i, rule := range rules {
+		out[i] = rule.String()
+	}
+	return strings.Join(out, ",")
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mustParseChaosRules(t *testing.T, s string) []chaosRule {
+	t.Helper()
+	rules, err := parseChaosRules(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestParseChaosRules(t *testing.T) {
+	const s = "route=/cart/checkout;latency=2s;error_rate=0.1, rpc=AdService;jitter=500ms"
+	rules := mustParseChaosRules(t, s)
+	want := []chaosRule{
+		{route: "/cart/checkout", latency: 2 * time.Second, errorRate: 0.1},
+		{rpc: "AdService", jitter: 500 * time.Millisecond},
+	}
+	if len(rules) != len(want) || rules[0] != want[0] || rules[1] != want[1] {
+		t.Errorf("rules = %+v, want %+v", rules, want)
+	}
+	if got := formatChaosRules(rules); got != strings.ReplaceAll(s, " ", "") {
+		t.Errorf("formatted = %q, want %q", got, s)
+	}
+	if rules := mustParseChaosRules(t, ""); rules != nil {
+		t.Errorf("empty rules = %+v", rules)
+	}
+
+	for _, s := range []string{
+		"route=/cart",
+		"latency=1s",
+		"route=/cart;rpc=CartService;latency=1s",
+		"route=/cart;latency=fast",
+		"route=/cart;latency=-1s",
+		"route=/cart;error_rate=2",
+		"route=/cart;crash=1",
+		"route=/cart;latency",
+	} {
+		if _, err := parseChaosRules(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestChaosRuleMatchesRPC(t *testing.T) {
+	for _, tt := range []struct {
+		rpc, method string
+		want        bool
+	}{
+		{"CartService", "/hipstershop.CartService/GetCart", true},
+		{"CartService/GetCart", "/hipstershop.CartService/GetCart", true},
+		{"CartService/AddItem", "/hipstershop.CartService/GetCart", false},
+		{"Cart", "/hipstershop.CartService/GetCart", false},
+		{"", "/hipstershop.CartService/GetCart", false},
+	} {
+		if got := (chaosRule{rpc: tt.rpc}).matchesRPC(tt.method); got != tt.want {
+			t.Errorf("rpc=%s matches %s = %v, want %v", tt.rpc, tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestChaosInterceptor(t *testing.T) {
+	c := newChaosInjector(nil)
+	fe := newTestFrontend(t, newFakeBackend(), grpc.WithChainUnaryInterceptor(c.unaryInterceptor))
+	ctx := context.Background()
+	if _, err := fe.getCart(ctx, "test-session"); err != nil {
+		t.Fatalf("no rules: %v", err)
+	}
+
+	c.set(mustParseChaosRules(t, "rpc=CartService;error_rate=1,rpc=ProductCatalogService/GetProduct;latency=30ms"))
+	if _, err := fe.getCart(ctx, "test-session"); status.Code(err) != codes.Unavailable {
+		t.Errorf("GetCart: err = %v, want Unavailable", err)
+	}
+	start := time.Now()
+	if _, err := fe.getProduct(ctx, "OLJCESPC7Z"); err != nil || time.Since(start) < 30*time.Millisecond {
+		t.Errorf("GetProduct: err %v after %v, want success after 30ms", err, time.Since(start))
+	}
+	if _, err := fe.getCurrencies(ctx); err != nil {
+		t.Errorf("GetSupportedCurrencies, which no rule targets: %v", err)
+	}
+}
+
+func TestChaosMiddleware(t *testing.T) {
+	c := newChaosInjector(mustParseChaosRules(t, "route=/product/{id};error_rate=1,route=api_cart_count;error_rate=1"))
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router := mux.NewRouter()
+	router.HandleFunc("/product/{id}", c.middleware("product", ok))
+	router.HandleFunc("/api/cart/count", c.middleware("api_cart_count", ok))
+	router.HandleFunc("/cart", c.middleware("cart", ok))
+
+	for _, tt := range []struct {
+		target string
+		code   int
+		json   bool
+	}{
+		{"/product/OLJCESPC7Z", http.StatusServiceUnavailable, false},
+		{"/api/cart/count", http.StatusServiceUnavailable, true},
+		{"/cart", http.StatusOK, false},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newTestRequest(http.MethodGet, tt.target, nil))
+		isJSON := strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+		if w.Code != tt.code || (w.Code != http.StatusOK && isJSON != tt.json) {
+			t.Errorf("%s: status %d, JSON %v; want %d", tt.target, w.Code, isJSON, tt.code)
+		}
+	}
+}
+
+func TestChaosHandler(t *testing.T) {
+	c := newChaosInjector(nil)
+	h := c.handler(logrus.New())
+	do := func(method, body string) (int, string) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(method, "/debug/chaos", strings.NewReader(body)))
+		var got chaosRulesBody
+		json.NewDecoder(w.Body).Decode(&got)
+		return w.Code, got.Rules
+	}
+
+	if code, rules := do(http.MethodPut, `{"rules": "rpc=CartService;error_rate=0.5"}`); code != http.StatusOK || rules != "rpc=CartService;error_rate=0.5" {
+		t.Errorf("PUT: status %d, rules %q", code, rules)
+	}
+	if len(c.get()) != 1 {
+		t.Errorf("rules in effect = %+v", c.get())
+	}
+	if code, _ := do(http.MethodPut, `{"rules": "rpc=CartService"}`); code != http.StatusBadRequest || len(c.get()) != 1 {
+		t.Errorf("invalid PUT: status %d, rules %+v; want 400 and no change", code, c.get())
+	}
+	if code, rules := do(http.MethodGet, ""); code != http.StatusOK || rules != "rpc=CartService;error_rate=0.5" {
+		t.Errorf("GET: status %d, rules %q", code, rules)
+	}
+	if code, rules := do(http.MethodDelete, ""); code != http.StatusOK || rules != "" || c.rules.Load() != nil {
+		t.Errorf("DELETE: status %d, rules %q", code, rules)
+	}
+	if code, _ := do(http.MethodPost, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d", code)
+	}
+}
@@ -0,0 +1,499 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+const defaultLogLevel = logrus.InfoLevel
+
+// config is the startup configuration of the frontend. loadConfig reads it
+// from the environment in one pass and reports every problem it finds, rather
+// than stopping at the first. Settings that belong to a single component,
+// such as security headers, are still read by that component.
+type config struct {
+	listenAddrs []listenAddr
+	socketMode  os.FileMode
+	port        string
+	baseURL     string
+	logLevel    logrus.Level
+	// logLevelInFile is set when LOG_LEVEL comes from SETTINGS_FILE, which
+	// reloads may change.
+	logLevelInFile bool
+	// externalURL is the scheme and host the shop is reached at from the
+	// outside, for the absolute URLs of the sitemap.
+	externalURL string
+
+	productCatalogSvcAddr    string
+	currencySvcAddr          string
+	cartSvcAddr              string
+	recommendationSvcAddr    string
+	checkoutSvcAddr          string
+	shippingSvcAddr          string
+	adSvcAddr                string // optional, see featuresFromEnv
+	shoppingAssistantSvcAddr string // optional, see featuresFromEnv
+	collectorAddr            string // only required when exporting OpenTelemetry spans
+	features                 featureSet
+
+	telemetry         telemetryBackend
+	enableTracing     bool
+	enableProfiler    bool
+	sessionSecret     string
+	csrfDisabled      bool
+	staticDir         string
+	staticAssetPrefix string
+	imageCacheDir     string
+	imageCacheBytes   int
+	templateDevMode   bool
+	currencyAllowlist string
+	defaultCurrency   string
+	trustedProxyCIDRs string
+
+	robotsAllow      bool
+	robotsExtraRules string
+
+	graphiqlEnabled bool
+
+	featureFlagsFile         string
+	stockFile                string
+	variantsFile             string
+	saleConfig               string
+	featureFlagsPollInterval time.Duration
+	experiments              []experiment
+	experimentOverrides      bool
+	promoCodes               promoCodes
+
+	adminPort       string
+	adminToken      string
+	redirectPort    string
+	httpsPublicPort string
+
+	http            httpServerConfig
+	shutdownTimeout time.Duration
+	shutdownDelay   time.Duration
+	handlerTimeout  time.Duration
+	// handlerTimeouts and rateLimits hold the routes' own deadlines and
+	// limits, by route.
+	handlerTimeouts map[string]time.Duration
+	rateLimits      map[string]rateLimit
+	maxBodyBytes    int
+	maxBotBodyBytes int
+
+	// The load shedder serves maxInflight requests at once, 0 for no
+	// limit, and queues up to inflightQueue more for inflightQueueTimeout.
+	maxInflight          int
+	inflightQueue        int
+	inflightQueueTimeout time.Duration
+
+	cartMaxQuantity         int
+	grpcRetryMax            int
+	grpcRetryBackoff        time.Duration
+	grpcHedgeDelay          time.Duration
+	breakerThreshold        int
+	breakerCooldown         time.Duration
+	requireBackends         bool
+	startupBackendTimeout   time.Duration
+	catalogCacheTTL         time.Duration
+	currencyCacheTTL        time.Duration
+	currencyRefreshInterval time.Duration
+	orderHistorySize        int
+	giftWrapFee             *pb.Money // in USD
+	sessionStoreTTL         time.Duration
+	sessionStoreMaxEntries  int
+	sessionStoreKind        string // "memory" or "redis"
+	sessionStoreStrict      bool
+	redis                   redisConfig
+	adSlots                 int
+	productPageMaxAge       time.Duration
+
+	tls             *tlsSetup
+	grpcTransport   grpcTransport
+	grpcConns       map[string]grpcConnConfig // by service
+	backendMetadata backendMetadataKeys
+	traceFormats    traceFormats
+	brand           brandSettings
+	cors            corsPolicy
+	delivery        *deliveryEstimator
+	redactFields    redactFields
+	audit           auditConfig
+	logSampling     *logSampling
+	chaosRules      []chaosRule
+}
+
+// httpServerConfig holds the limits applied to every HTTP listener.
+type httpServerConfig struct {
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+
+	// h2c serves HTTP/2 without TLS, for proxies such as Envoy that
+	// multiplex requests to the shop over a few connections. h2IdleTimeout
+	// defaults to idleTimeout.
+	h2c                    bool
+	h2MaxConcurrentStreams int
+	h2IdleTimeout          time.Duration
+}
+
+// configError lists every problem found in the configuration.
+type configError []string
+
+func (e configError) Error() string {
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(e, "; "))
+}
+
+// envLoader reads environment variables, collecting a problem for each one
+// that is missing or malformed instead of failing on the first.
+type envLoader struct {
+	problems configError
+}
+
+func (l *envLoader) problem(format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf(format, args...))
+}
+
+func (l *envLoader) err() error {
+	if len(l.problems) == 0 {
+		return nil
+	}
+	return l.problems
+}
+
+func (l *envLoader) str(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envKeysWithPrefix returns the names of the set environment variables that
+// start with prefix, sorted.
+func envKeysWithPrefix(prefix string) []string {
+	var keys []string
+	for _, kv := range os.Environ() {
+		if k, v, _ := strings.Cut(kv, "="); strings.HasPrefix(k, prefix) && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (l *envLoader) required(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		l.problem("environment variable %q not set", key)
+	}
+	return v
+}
+
+// duration parses key as a non-negative time.Duration.
+func (l *envLoader) duration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		l.problem("%s: invalid duration %q", key, v)
+		return def
+	}
+	return d
+}
+
+// int parses key as a non-negative integer.
+func (l *envLoader) int(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		l.problem("%s: invalid integer %q", key, v)
+		return def
+	}
+	return n
+}
+
+// bool parses key as a boolean such as "true" or "0".
+func (l *envLoader) bool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.problem("%s: invalid boolean %q", key, v)
+		return def
+	}
+	return b
+}
+
+// port reads key as a TCP port number.
+func (l *envLoader) port(key, def string) string {
+	v := l.str(key, def)
+	if v == "" {
+		return ""
+	}
+	if n, err := strconv.Atoi(v); err != nil || n < 1 || n > 65535 {
+		l.problem("%s: invalid port %q", key, v)
+	}
+	return v
+}
+
+// money reads an amount in USD written as a plain decimal number, such as
+// "4.99". Negative amounts are problems.
+func (l *envLoader) money(key, def string) *pb.Money {
+	v := l.str(key, def)
+	m, err := money.Parse(v, "USD")
+	if err != nil || money.IsNegative(m) {
+		l.problem("%s: invalid amount %q", key, v)
+		return &pb.Money{CurrencyCode: "USD"}
+	}
+	return &m
+}
+
+// check records err, if any, as a problem.
+func (l *envLoader) check(err error) {
+	if err != nil {
+		l.problem("%v", err)
+	}
+}
+
+// normalizeBaseURL cleans up BASE_URL so that routes can be appended to it:
+// trailing slashes are stripped, so "/shop/" becomes "/shop" and "/" becomes
+// "". It reports false unless the result is empty or a path with a leading
+// slash and no query, fragment or whitespace.
+func normalizeBaseURL(v string) (string, bool) {
+	v = strings.TrimRight(v, "/")
+	if v == "" {
+		return "", true
+	}
+	return v, strings.HasPrefix(v, "/") && !strings.Contains(v, "//") && !strings.ContainsAny(v, "?# \t\n")
+}
+
+// normalizeExternalURL cleans up EXTERNAL_URL so that paths can be appended
+// to it: a trailing slash is stripped. It reports false unless the result is
+// empty or an http or https URL with a host and nothing after it.
+func normalizeExternalURL(v string) (string, bool) {
+	v = strings.TrimSuffix(v, "/")
+	if v == "" {
+		return "", true
+	}
+	u, err := url.Parse(v)
+	if err != nil || strings.ContainsAny(v, "?# \t\n") {
+		return v, false
+	}
+	return v, (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil && u.Path == ""
+}
+
+// loadConfig reads the startup configuration from the environment. The
+// returned error is a configError listing every problem.
+func loadConfig() (*config, error) {
+	var l envLoader
+	c := &config{
+		port:       l.port("PORT", port),
+		socketMode: socketModeFromEnv(&l),
+		baseURL:    os.Getenv("BASE_URL"),
+
+		externalURL: os.Getenv("EXTERNAL_URL"),
+
+		productCatalogSvcAddr:    l.required("PRODUCT_CATALOG_SERVICE_ADDR"),
+		currencySvcAddr:          l.required("CURRENCY_SERVICE_ADDR"),
+		cartSvcAddr:              l.required("CART_SERVICE_ADDR"),
+		recommendationSvcAddr:    l.required("RECOMMENDATION_SERVICE_ADDR"),
+		checkoutSvcAddr:          l.required("CHECKOUT_SERVICE_ADDR"),
+		shippingSvcAddr:          l.required("SHIPPING_SERVICE_ADDR"),
+		adSvcAddr:                os.Getenv("AD_SERVICE_ADDR"),
+		shoppingAssistantSvcAddr: os.Getenv("SHOPPING_ASSISTANT_SERVICE_ADDR"),
+
+		enableTracing:     os.Getenv("ENABLE_TRACING") == "1",
+		enableProfiler:    os.Getenv("ENABLE_PROFILER") == "1",
+		sessionSecret:     os.Getenv("SESSION_SECRET"),
+		csrfDisabled:      os.Getenv("CSRF_DISABLED") == "true",
+		staticDir:         os.Getenv("STATIC_DIR"),
+		staticAssetPrefix: os.Getenv("STATIC_ASSET_PREFIX"),
+		imageCacheDir:     os.Getenv("IMAGE_CACHE_DIR"),
+		imageCacheBytes:   l.int("IMAGE_CACHE_BYTES", defaultImageCacheBytes),
+		templateDevMode:   os.Getenv("TEMPLATE_DEV_MODE") == "1",
+		currencyAllowlist: os.Getenv("CURRENCY_ALLOWLIST"),
+		defaultCurrency:   strings.ToUpper(l.str("DEFAULT_CURRENCY", defaultCurrency)),
+		trustedProxyCIDRs: os.Getenv("TRUSTED_PROXY_CIDRS"),
+
+		robotsAllow: l.bool("ROBOTS_ALLOW", false),
+		// A literal \n separates rules, for environments where the value
+		// cannot span several lines.
+		robotsExtraRules: strings.TrimSpace(strings.ReplaceAll(os.Getenv("ROBOTS_EXTRA_RULES"), `\n`, "\n")),
+
+		graphiqlEnabled: l.bool("GRAPHIQL_ENABLED", false),
+
+		featureFlagsFile:         os.Getenv("FEATURE_FLAGS_FILE"),
+		stockFile:                os.Getenv("STOCK_FILE"),
+		variantsFile:             os.Getenv("VARIANTS_FILE"),
+		saleConfig:               os.Getenv("SALE_CONFIG"),
+		featureFlagsPollInterval: l.duration("FEATURE_FLAGS_POLL_INTERVAL", defaultFeatureFlagsPollInterval),
+		experimentOverrides:      os.Getenv("EXPERIMENT_OVERRIDES_ALLOWED") == "1",
+
+		adminPort:       l.port("ADMIN_PORT", ""),
+		adminToken:      os.Getenv("ADMIN_TOKEN"),
+		redirectPort:    l.port("HTTP_REDIRECT_PORT", ""),
+		httpsPublicPort: l.port("HTTPS_PUBLIC_PORT", ""),
+
+		http: httpServerConfig{
+			readHeaderTimeout: l.duration("HTTP_READ_HEADER_TIMEOUT", defaultReadHeaderTimeout),
+			readTimeout:       l.duration("HTTP_READ_TIMEOUT", defaultReadTimeout),
+			writeTimeout:      l.duration("HTTP_WRITE_TIMEOUT", defaultWriteTimeout),
+			idleTimeout:       l.duration("HTTP_IDLE_TIMEOUT", defaultIdleTimeout),
+			maxHeaderBytes:    l.int("HTTP_MAX_HEADER_BYTES", defaultMaxHeaderBytes),
+
+			h2c:                    l.bool("HTTP2_H2C", false),
+			h2MaxConcurrentStreams: l.int("HTTP2_MAX_CONCURRENT_STREAMS", defaultH2MaxConcurrentStreams),
+			h2IdleTimeout:          l.duration("HTTP2_IDLE_TIMEOUT", 0),
+		},
+		shutdownTimeout: l.duration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+		shutdownDelay:   l.duration("SHUTDOWN_DELAY", defaultShutdownDelay),
+		handlerTimeout:  l.duration("HANDLER_TIMEOUT_DEFAULT", defaultHandlerTimeout),
+		maxBodyBytes:    l.int("HTTP_MAX_BODY_BYTES", defaultMaxBodyBytes),
+		maxBotBodyBytes: l.int("HTTP_MAX_BODY_BYTES_BOT", defaultMaxBotBodyBytes),
+
+		cartMaxQuantity:         l.int("CART_MAX_QTY", cartMaxQuantity),
+		grpcRetryMax:            l.int("GRPC_RETRY_MAX", grpcRetry.maxRetries),
+		grpcRetryBackoff:        l.duration("GRPC_RETRY_BACKOFF", grpcRetry.baseBackoff),
+		grpcHedgeDelay:          l.duration("HEDGE_DELAY", 0),
+		breakerThreshold:        l.int("CIRCUIT_BREAKER_THRESHOLD", defaultBreakerThreshold),
+		breakerCooldown:         l.duration("CIRCUIT_BREAKER_COOLDOWN", defaultBreakerCooldown),
+		requireBackends:         os.Getenv("STARTUP_REQUIRE_BACKENDS") == "true",
+		startupBackendTimeout:   l.duration("STARTUP_BACKEND_TIMEOUT", defaultStartupBackendTimeout),
+		catalogCacheTTL:         l.duration("CATALOG_CACHE_TTL", defaultCatalogCacheTTL),
+		currencyCacheTTL:        l.duration("CURRENCY_CACHE_TTL", defaultCurrencyCacheTTL),
+		currencyRefreshInterval: l.duration("CURRENCY_REFRESH_INTERVAL", defaultCurrencyRefreshInterval),
+		orderHistorySize:        l.int("ORDER_HISTORY_SIZE", defaultOrderHistorySize),
+		giftWrapFee:             l.money("GIFT_WRAP_FEE", defaultGiftWrapFee),
+		sessionStoreTTL:         l.duration("SESSION_STORE_TTL", defaultSessionStoreTTL),
+		sessionStoreMaxEntries:  l.int("SESSION_STORE_MAX_ENTRIES", defaultSessionStoreMaxEntries),
+		sessionStoreKind:        l.str("SESSION_STORE", "memory"),
+		sessionStoreStrict:      l.bool("SESSION_STORE_STRICT", false),
+		adSlots:                 l.int("AD_SLOTS", defaultAdSlots),
+		productPageMaxAge:       l.duration("PRODUCT_PAGE_MAX_AGE", defaultProductPageMaxAge),
+	}
+
+	c.maxInflight = l.int("MAX_INFLIGHT", defaultMaxInflight())
+	c.inflightQueue = l.int("MAX_INFLIGHT_QUEUE", c.maxInflight/4)
+	c.inflightQueueTimeout = l.duration("MAX_INFLIGHT_QUEUE_TIMEOUT", defaultInflightQueueTimeout)
+	c.handlerTimeouts = handlerTimeoutsFromEnv(&l)
+	c.rateLimits = rateLimitsFromEnv(&l)
+
+	c.listenAddrs = listenAddrsFromEnv(&l, c.port)
+	settingsFile, err := readSettingsFile(os.Getenv("SETTINGS_FILE"))
+	l.check(err)
+	c.logLevel = logLevelFromEnv(&l, settingsFile.getenv)
+	_, c.logLevelInFile = settingsFile["LOG_LEVEL"]
+	c.brand = brandFromEnv(&l, settingsFile.getenv)
+	if base, ok := normalizeBaseURL(c.baseURL); ok {
+		c.baseURL = base
+	} else {
+		l.problem("BASE_URL: %q must be empty or a path like /shop", c.baseURL)
+	}
+	if origin, ok := normalizeExternalURL(c.externalURL); ok {
+		c.externalURL = origin
+	} else {
+		l.problem("EXTERNAL_URL: %q must be empty or a URL like https://shop.example.com", c.externalURL)
+	}
+	if prefix, ok := normalizeAssetPrefix(c.staticAssetPrefix); ok {
+		c.staticAssetPrefix = prefix
+	} else {
+		l.problem("STATIC_ASSET_PREFIX: %q must be empty, a path or a URL like https://cdn.example.com", c.staticAssetPrefix)
+	}
+	if err := (&validator.SetCurrencyPayload{Currency: c.defaultCurrency}).Validate(); err != nil {
+		l.problem("DEFAULT_CURRENCY: %q is not a currency code", c.defaultCurrency)
+	}
+	c.features = featuresFromEnv(&l, c)
+	c.telemetry = telemetryElastic
+	if b, ok := parseTelemetryBackend(l.str("TELEMETRY_BACKEND", string(telemetryElastic))); ok {
+		c.telemetry = b
+	} else {
+		l.problem("TELEMETRY_BACKEND: %q must be elastic, otel or none", os.Getenv("TELEMETRY_BACKEND"))
+	}
+	if c.telemetry.exportsOTel(c.enableTracing) {
+		c.collectorAddr = l.required("COLLECTOR_SERVICE_ADDR")
+	}
+	switch c.sessionStoreKind {
+	case "memory":
+	case "redis":
+		c.redis = redisConfig{
+			addr:     l.required("REDIS_ADDR"),
+			password: os.Getenv("REDIS_PASSWORD"),
+			tls:      l.bool("REDIS_TLS", false),
+			poolSize: l.int("REDIS_POOL_SIZE", 0),
+		}
+	default:
+		l.problem("SESSION_STORE: %q must be memory or redis", c.sessionStoreKind)
+	}
+	if c.adminPort != "" && c.adminPort == c.port {
+		l.problem("ADMIN_PORT: must differ from PORT %s", c.port)
+	}
+
+	c.tls, err = tlsSetupFromEnv()
+	l.check(err)
+	if c.redirectPort != "" && c.tls == nil && err == nil {
+		l.problem("HTTP_REDIRECT_PORT: set without TLS_CERT_FILE or ACME_DOMAINS")
+	}
+	if c.http.h2c && c.tls != nil {
+		l.problem("HTTP2_H2C: set along with TLS, which negotiates HTTP/2 by itself")
+	}
+	if c.http.h2MaxConcurrentStreams == 0 {
+		l.problem("HTTP2_MAX_CONCURRENT_STREAMS: must be positive")
+	}
+	c.grpcTransport, err = grpcTransportFromEnv()
+	l.check(err)
+	c.grpcConns = grpcConnConfigsFromEnv(&l)
+	c.backendMetadata = backendMetadataFromEnv(&l)
+	c.traceFormats = tracePropagationFromEnv(&l)
+	c.cors = corsFromEnv(&l)
+	c.delivery = deliveryFromEnv(&l)
+	c.redactFields = redactFieldsFromEnv(&l)
+	c.audit = auditFromEnv(&l)
+	c.logSampling = logSamplingFromEnv(&l)
+	c.chaosRules, err = parseChaosRules(os.Getenv("CHAOS_RULES"))
+	l.check(err)
+	c.experiments, err = parseExperiments(os.Getenv("EXPERIMENTS"))
+	l.check(err)
+	switch promoFile := os.Getenv("PROMO_CODES_FILE"); {
+	case promoFile != "" && os.Getenv("PROMO_CODES") != "":
+		l.problem("PROMO_CODES_FILE: set together with PROMO_CODES")
+	case promoFile != "":
+		c.promoCodes, err = loadPromoCodes(promoFile)
+		l.check(err)
+	default:
+		c.promoCodes, err = parsePromoCodes(os.Getenv("PROMO_CODES"))
+		l.check(err)
+	}
+
+	return c, l.err()
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+var backendAddrEnv = []string{
+	"PRODUCT_CATALOG_SERVICE_ADDR",
+	"CURRENCY_SERVICE_ADDR",
+	"CART_SERVICE_ADDR",
+	"RECOMMENDATION_SERVICE_ADDR",
+	"CHECKOUT_SERVICE_ADDR",
+	"SHIPPING_SERVICE_ADDR",
+	"AD_SERVICE_ADDR",
+	"SHOPPING_ASSISTANT_SERVICE_ADDR",
+}
+
+// loadTestConfig sets every required variable and loads the configuration,
+// failing the test on any problem.
+func loadTestConfig(t *testing.T) *config {
+	t.Helper()
+	for _, k := range backendAddrEnv {
+		t.Setenv(k, "localhost:1")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg := loadTestConfig(t)
+	if cfg.port != port || cfg.baseURL != "" || cfg.logLevel != defaultLogLevel || cfg.tls != nil {
+		t.Errorf("config = %+v", cfg)
+	}
+	if cfg.http.readHeaderTimeout != defaultReadHeaderTimeout || cfg.http.maxHeaderBytes != defaultMaxHeaderBytes ||
+		cfg.shutdownTimeout != defaultShutdownTimeout || cfg.adSlots != defaultAdSlots ||
+		money.Amount(*cfg.giftWrapFee) != defaultGiftWrapFee {
+		t.Errorf("config = %+v, want defaults", cfg)
+	}
+	if cfg.maxInflight != defaultMaxInflight() || cfg.inflightQueue != cfg.maxInflight/4 {
+		t.Errorf("max in flight %d, queue %d; want %d and a quarter of it", cfg.maxInflight, cfg.inflightQueue, defaultMaxInflight())
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	t.Setenv("PORT", "9090")
+	t.Setenv("BASE_URL", "/shop/")
+	t.Setenv("LOG_LEVEL", "WARN")
+	t.Setenv("SHUTDOWN_DELAY", "0s")
+	t.Setenv("CART_MAX_QTY", "3")
+	t.Setenv("DEFAULT_CURRENCY", "eur")
+	t.Setenv("ROBOTS_ALLOW", "true")
+	t.Setenv("ROBOTS_EXTRA_RULES", `Disallow: /cart\nCrawl-delay: 10`)
+	cfg := loadTestConfig(t)
+	if cfg.port != "9090" || cfg.baseURL != "/shop" || cfg.logLevel != logrus.WarnLevel ||
+		cfg.shutdownDelay != 0 || cfg.cartMaxQuantity != 3 || cfg.defaultCurrency != "EUR" ||
+		!cfg.robotsAllow || cfg.robotsExtraRules != "Disallow: /cart\nCrawl-delay: 10" {
+		t.Errorf("config = %+v", cfg)
+	}
+}
+
+func TestLoadConfigOTelNeedsCollector(t *testing.T) {
+	for _, k := range backendAddrEnv {
+		t.Setenv(k, "localhost:1")
+	}
+	t.Setenv("TELEMETRY_BACKEND", "otel")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "COLLECTOR_SERVICE_ADDR") {
+		t.Errorf("err = %v, want COLLECTOR_SERVICE_ADDR required", err)
+	}
+	t.Setenv("COLLECTOR_SERVICE_ADDR", "collector:4317")
+	if cfg := loadTestConfig(t); cfg.telemetry != telemetryOTel || cfg.collectorAddr != "collector:4317" {
+		t.Errorf("config = %+v", cfg)
+	}
+}
+
+func TestLoadConfigCollectsAllProblems(t *testing.T) {
+	for _, k := range backendAddrEnv {
+		t.Setenv(k, "localhost:1")
+	}
+	t.Setenv("CART_SERVICE_ADDR", "")
+	t.Setenv("HTTP_IDLE_TIMEOUT", "bogus")
+	t.Setenv("SHUTDOWN_TIMEOUT", "-1s")
+	t.Setenv("PORT", "http")
+	t.Setenv("ADMIN_PORT", "70000")
+	t.Setenv("BASE_URL", "shop/")
+	t.Setenv("LOG_LEVEL", "chatty")
+	t.Setenv("AD_SLOTS", "two")
+	t.Setenv("ENABLE_TRACING", "1")
+	t.Setenv("TLS_CERT_FILE", "cert.pem")
+	t.Setenv("DEFAULT_CURRENCY", "dollars")
+	t.Setenv("EXTERNAL_URL", "shop.example.com")
+	t.Setenv("ROBOTS_ALLOW", "sometimes")
+	t.Setenv("SESSION_STORE", "redis")
+	t.Setenv("TELEMETRY_BACKEND", "jaeger")
+	t.Setenv("CHAOS_RULES", "route=/cart")
+	t.Setenv("GIFT_WRAP_FEE", "-1")
+	t.Setenv("CHECKOUT_SERVICE_TIMEOUT", "10")
+	t.Setenv("GRPC_KEEPALIVE_TIME", "soon")
+	t.Setenv("GRPC_LB_POLICY", "random")
+	t.Setenv("HANDLER_TIMEOUT_CHECKOUT", "20")
+	t.Setenv("RATE_LIMIT_BOT", "lots")
+
+	_, err := loadConfig()
+	problems, ok := err.(configError)
+	if !ok {
+		t.Fatalf("err = %v, want a configError", err)
+	}
+	for _, want := range []string{
+		`"CART_SERVICE_ADDR"`,
+		`"COLLECTOR_SERVICE_ADDR"`,
+		"HTTP_IDLE_TIMEOUT",
+		"SHUTDOWN_TIMEOUT",
+		"PORT",
+		"ADMIN_PORT",
+		"BASE_URL",
+		"LOG_LEVEL",
+		"AD_SLOTS",
+		"TLS_CERT_FILE",
+		"DEFAULT_CURRENCY",
+		"EXTERNAL_URL",
+		"ROBOTS_ALLOW",
+		`"REDIS_ADDR"`,
+		"TELEMETRY_BACKEND",
+		"chaos rule",
+		"GIFT_WRAP_FEE",
+		"CHECKOUT_SERVICE_TIMEOUT",
+		"GRPC_KEEPALIVE_TIME",
+		"GRPC_LB_POLICY",
+		"HANDLER_TIMEOUT_CHECKOUT",
+		"RATE_LIMIT_BOT",
+	} {
+		found := false
+		for _, p := range problems {
+			if strings.Contains(p, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("no problem reported for %s in %q", want, problems)
+		}
+	}
+	if len(problems) != 22 {
+		t.Errorf("got %d problems, want 22: %q", len(problems), problems)
+	}
+	if !strings.Contains(err.Error(), "HTTP_IDLE_TIMEOUT") || !strings.Contains(err.Error(), "AD_SLOTS") {
+		t.Errorf("Error() = %q, want every problem", err)
+	}
+}
+
+func TestLoadConfigConflicts(t *testing.T) {
+	t.Setenv("ADMIN_PORT", port)
+	t.Setenv("HTTP_REDIRECT_PORT", "8081")
+	for _, k := range backendAddrEnv {
+		t.Setenv(k, "localhost:1")
+	}
+	_, err := loadConfig()
+	problems, _ := err.(configError)
+	if len(problems) != 2 {
+		t.Errorf("problems = %q, want ADMIN_PORT and HTTP_REDIRECT_PORT", problems)
+	}
+}
+
+func TestNormalizeBaseURL(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"/shop", "/shop", true},
+		{"/shop/", "/shop", true},
+		{"/a/b//", "/a/b", true},
+		{"shop", "shop", false},
+		{"/a//b", "/a//b", false},
+		{"/shop?x=1", "/shop?x=1", false},
+		{"/my shop", "/my shop", false},
+	} {
+		if got, ok := normalizeBaseURL(tc.in); got != tc.want || ok != tc.ok {
+			t.Errorf("normalizeBaseURL(%q) = %q, %v; want %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestNormalizeExternalURL(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"https://shop.example.com", "https://shop.example.com", true},
+		{"http://localhost:8080/", "http://localhost:8080", true},
+		{"shop.example.com", "shop.example.com", false},
+		{"ftp://shop.example.com", "ftp://shop.example.com", false},
+		{"https://shop.example.com/shop", "https://shop.example.com/shop", false},
+		{"https://shop.example.com?x=1", "https://shop.example.com?x=1", false},
+		{"https://user@shop.example.com", "https://user@shop.example.com", false},
+	} {
+		if got, ok := normalizeExternalURL(tc.in); got != tc.want || ok != tc.ok {
+			t.Errorf("normalizeExternalURL(%q) = %q, %v; want %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestMustMapEnv(t *testing.T) {
+	t.Setenv("CART_SERVICE_ADDR", "cartservice:7070")
+	var addr string
+	mustMapEnv(&addr, "CART_SERVICE_ADDR")
+	if addr != "cartservice:7070" {
+		t.Errorf("addr = %q", addr)
+	}
+
+	t.Setenv("CART_SERVICE_ADDR", "")
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("no panic for an unset variable")
+		}
+	}()
+	mustMapEnv(&addr, "CART_SERVICE_ADDR")
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cookieAttributes are applied to every cookie the frontend sets.
+type cookieAttributes struct {
+	secure   bool
+	sameSite http.SameSite
+	domain   string
+}
+
+var cookieAttrs = cookieAttributes{sameSite: http.SameSiteLaxMode}
+
+// cookieAttributesFromEnv reads COOKIE_SECURE, COOKIE_SAMESITE and
+// COOKIE_DOMAIN. Unrecognized values are logged and fall back to the defaults.
+func cookieAttributesFromEnv(log logrus.FieldLogger) cookieAttributes {
+	a := cookieAttributes{
+		secure:   os.Getenv("COOKIE_SECURE") == "true",
+		sameSite: http.SameSiteLaxMode,
+		domain:   os.Getenv("COOKIE_DOMAIN"),
+	}
+	switch v := os.Getenv("COOKIE_SAMESITE"); strings.ToLower(v) {
+	case "", "lax":
+	case "strict":
+		a.sameSite = http.SameSiteStrictMode
+	case "none":
+		a.sameSite = http.SameSiteNoneMode
+		if !a.secure {
+			// Browsers drop SameSite=None cookies that are not Secure.
+			log.Warn("COOKIE_SAMESITE=None requires Secure cookies, enabling COOKIE_SECURE")
+			a.secure = true
+		}
+	default:
+		log.Warnf("invalid COOKIE_SAMESITE %q, using Lax", v)
+	}
+	return a
+}
+
+// newCookie returns a cookie carrying the configured attributes.
+func newCookie(name, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   cookieAttrs.domain,
+		MaxAge:   cookieMaxAge,
+		Secure:   cookieAttrs.secure,
+		HttpOnly: true,
+		SameSite: cookieAttrs.sameSite,
+	}
+}
+
+// expiredCookie returns a cookie that makes the browser delete name. Its Path
+// and Domain match newCookie, otherwise the browser keeps the original.
+func expiredCookie(name string) *http.Cookie {
+	c := newCookie(name, "")
+	c.MaxAge = -1
+	c.Expires = time.Unix(0, 0)
+	return c
+}
+
+// maxProductIDLen bounds the product IDs accepted from cookies.
+const maxProductIDLen = 64
+
+// productIDsKey is the name a list of product IDs is signed under. It
+// includes the session so that the list does not outlive it.
+func productIDsKey(r *http.Request, name string) string {
+	return name + "/" + sessionID(r)
+}
+
+// productIDsCookie returns the product IDs stored in cookie name by
+// setProductIDsCookie, at most max of them, or nil if the cookie is missing
+// or not one we issued for this session.
+func (fe *frontendServer) productIDsCookie(r *http.Request, name string, max int) []string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return nil
+	}
+	value, ok := fe.cookieSigner.verify(productIDsKey(r, name), c.Value)
+	if !ok || value == "" {
+		return nil
+	}
+	var ids []string
+	for _, id := range strings.Split(value, "|") {
+		if len(ids) == max {
+			break
+		}
+		if validProductID(id) && !stringinSlice(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// setProductIDsCookie stores ids in cookie name, signed for the session of r.
+func (fe *frontendServer) setProductIDsCookie(w http.ResponseWriter, r *http.Request, name string, ids []string) {
+	value := strings.Join(ids, "|")
+	http.SetCookie(w, newCookie(name, fe.cookieSigner.sign(productIDsKey(r, name), value)))
+}
+
+// validProductID reports whether id may be a catalog product ID.
+func validProductID(id string) bool {
+	if id == "" || len(id) > maxProductIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// withCookieEnv configures cookieAttrs from env for the duration of the test.
+func withCookieEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, k := range []string{"COOKIE_SECURE", "COOKIE_SAMESITE", "COOKIE_DOMAIN"} {
+		t.Setenv(k, env[k])
+	}
+	prev := cookieAttrs
+	cookieAttrs = cookieAttributesFromEnv(discardLog)
+	t.Cleanup(func() { cookieAttrs = prev })
+}
+
+func setCookieHeader(t *testing.T, w *httptest.ResponseRecorder, name string) string {
+	t.Helper()
+	for _, h := range w.Result().Header.Values("Set-Cookie") {
+		if strings.HasPrefix(h, name+"=") {
+			return h
+		}
+	}
+	t.Fatalf("no Set-Cookie for %s in %q", name, w.Result().Header.Values("Set-Cookie"))
+	return ""
+}
+
+func TestSetCurrencyCookieAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "defaults",
+			env:     map[string]string{},
+			want:    []string{"Path=/", "HttpOnly", "SameSite=Lax"},
+			notWant: []string{"Secure", "Domain="},
+		},
+		{
+			name: "secure strict with domain",
+			env:  map[string]string{"COOKIE_SECURE": "true", "COOKIE_SAMESITE": "Strict", "COOKIE_DOMAIN": "shop.example.com"},
+			want: []string{"Path=/", "Domain=shop.example.com", "HttpOnly", "Secure", "SameSite=Strict"},
+		},
+		{
+			name: "none forces secure",
+			env:  map[string]string{"COOKIE_SAMESITE": "none"},
+			want: []string{"Secure", "SameSite=None"},
+		},
+		{
+			name: "invalid samesite falls back to lax",
+			env:  map[string]string{"COOKIE_SAMESITE": "sometimes"},
+			want: []string{"SameSite=Lax"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCookieEnv(t, tt.env)
+			fe := newTestFrontend(t, newFakeBackend())
+			w := httptest.NewRecorder()
+			fe.setCurrencyHandler(w, newTestRequest(http.MethodPost, "/setCurrency",
+				strings.NewReader(url.Values{"currency_code": {"EUR"}}.Encode())))
+
+			h := setCookieHeader(t, w, cookieCurrency)
+			for _, s := range tt.want {
+				if !strings.Contains(h, s) {
+					t.Errorf("Set-Cookie %q missing %q", h, s)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(h, s) {
+					t.Errorf("Set-Cookie %q unexpectedly contains %q", h, s)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	withCookieEnv(t, map[string]string{"COOKIE_SECURE": "true", "COOKIE_DOMAIN": "shop.example.com"})
+	h := ensureSessionID(nil, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	w := httptest.NewRecorder()
+	h(w, newTestRequest(http.MethodGet, "/", nil))
+
+	c := setCookieHeader(t, w, cookieSessionID)
+	for _, s := range []string{"Path=/", "Domain=shop.example.com", "HttpOnly", "Secure", "SameSite=Lax"} {
+		if !strings.Contains(c, s) {
+			t.Errorf("Set-Cookie %q missing %q", c, s)
+		}
+	}
+}
+
+func TestLogoutClearsCookies(t *testing.T) {
+	withCookieEnv(t, map[string]string{"COOKIE_DOMAIN": "shop.example.com"})
+	fe := &frontendServer{}
+	r := newTestRequest(http.MethodGet, "/logout", nil)
+	r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: testSessionID})
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EUR"})
+	w := httptest.NewRecorder()
+	fe.logoutHandler(w, r)
+
+	for _, name := range []string{cookieSessionID, cookieCurrency} {
+		h := setCookieHeader(t, w, name)
+		for _, s := range []string{name + "=;", "Path=/", "Domain=shop.example.com", "Max-Age=0"} {
+			if !strings.Contains(h, s) {
+				t.Errorf("Set-Cookie %q missing %q", h, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	corsAllowedMethods = "GET, HEAD, POST"
+	corsAllowedHeaders = "Content-Type, X-CSRF-Token, X-Requested-With"
+	corsMaxAge         = 10 * time.Minute
+)
+
+// corsPolicy lets pages of other origins, such as a separate single-page
+// app, call the JSON API and the assistant. Origins are listed in
+// CORS_ALLOWED_ORIGINS, separated by commas, as exact origins, wildcards
+// such as https://*.example.com matching any subdomain, or "*" for any
+// origin. Only exactly listed origins may send credentials: the session
+// cookie must not be usable from origins nobody named.
+type corsPolicy struct {
+	exact    map[string]bool
+	suffixes []corsWildcard
+	any      bool
+}
+
+// corsWildcard matches the origins of scheme whose host ends in suffix,
+// which starts with a dot.
+type corsWildcard struct {
+	scheme, suffix string
+}
+
+func corsFromEnv(l *envLoader) corsPolicy {
+	p := corsPolicy{exact: make(map[string]bool)}
+	for _, v := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if v == "*" {
+			p.any = true
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			l.problem("CORS_ALLOWED_ORIGINS: %q is not an origin such as https://shop.example.com or https://*.example.com", v)
+			continue
+		}
+		if host, ok := strings.CutPrefix(u.Host, "*."); ok {
+			p.suffixes = append(p.suffixes, corsWildcard{u.Scheme, "." + strings.ToLower(host)})
+		} else {
+			p.exact[u.Scheme+"://"+strings.ToLower(u.Host)] = true
+		}
+	}
+	return p
+}
+
+// allows reports whether origin may call the API, and whether with
+// credentials.
+func (p corsPolicy) allows(origin string) (allowed, credentials bool) {
+	o := strings.ToLower(origin)
+	if p.exact[o] {
+		return true, true
+	}
+	for _, w := range p.suffixes {
+		if host, ok := strings.CutPrefix(o, w.scheme+"://"); ok && strings.HasSuffix(host, w.suffix) {
+			return true, false
+		}
+	}
+	return p.any, false
+}
+
+// enabled reports whether any origin is allowed.
+func (p corsPolicy) enabled() bool {
+	return p.any || len(p.exact) > 0 || len(p.suffixes) > 0
+}
+
+// middleware adds the CORS headers to the responses of /api/ and /bot, and
+// answers their preflight requests itself, before the router, which has no
+// OPTIONS routes. Requests of origins not allowed go on without the headers
+// rather than failing, and so are left to the browser to block.
+func (p corsPolicy) middleware(next http.Handler) http.Handler {
+	if !p.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !(strings.HasPrefix(r.URL.Path, baseUrl+"/api/") || r.URL.Path == baseUrl+"/bot") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		allowed, credentials := p.allows(origin)
+		if allowed {
+			h.Set("Access-Control-Allow-Origin", origin)
+			if credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if !preflight {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+		if allowed {
+			h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge/time.Second)))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func corsTestHandler(t *testing.T, origins string) http.Handler {
+	t.Helper()
+	t.Setenv("CORS_ALLOWED_ORIGINS", origins)
+	var l envLoader
+	p := corsFromEnv(&l)
+	if err := l.err(); err != nil {
+		t.Fatal(err)
+	}
+	return p.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"items":[]}`)
+	}))
+}
+
+func corsRequest(method, path, origin string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	if method == http.MethodOptions {
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		r.Header.Set("Access-Control-Request-Headers", "content-type")
+	}
+	return r
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := corsTestHandler(t, "https://spa.example.com, https://*.example.org")
+	for _, tc := range []struct {
+		path, origin string
+		allowed      bool
+		credentials  bool
+	}{
+		{"/api/cart", "https://spa.example.com", true, true},
+		{"/bot", "https://spa.example.com", true, true},
+		{"/api/cart", "https://app.example.org", true, false},
+		{"/api/cart", "http://app.example.org", false, false},
+		{"/api/cart", "https://example.org", false, false},
+		{"/api/cart", "https://evil.example", false, false},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, corsRequest(http.MethodOptions, tc.path, tc.origin))
+		if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+			t.Errorf("%s from %s: status %d, %d bytes", tc.path, tc.origin, w.Code, w.Body.Len())
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin") == tc.origin; got != tc.allowed {
+			t.Errorf("%s from %s: Access-Control-Allow-Origin %q", tc.path, tc.origin, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tc.credentials {
+			t.Errorf("%s from %s: Access-Control-Allow-Credentials %q", tc.path, tc.origin, w.Header().Get("Access-Control-Allow-Credentials"))
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods") != ""; got != tc.allowed {
+			t.Errorf("%s from %s: Access-Control-Allow-Methods %q", tc.path, tc.origin, w.Header().Get("Access-Control-Allow-Methods"))
+		}
+		if tc.allowed && w.Header().Get("Access-Control-Max-Age") != "600" {
+			t.Errorf("%s from %s: Access-Control-Max-Age %q", tc.path, tc.origin, w.Header().Get("Access-Control-Max-Age"))
+		}
+	}
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	h := corsTestHandler(t, "https://spa.example.com")
+	for _, tc := range []struct {
+		path, origin string
+		headers      bool
+	}{
+		{"/api/cart", "https://spa.example.com", true},
+		{"/api/cart", "https://evil.example", false},
+		{"/cart", "https://spa.example.com", false}, // pages are not part of the API
+		{"/api/cart", "", false},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, corsRequest(http.MethodGet, tc.path, tc.origin))
+		if w.Code != http.StatusOK || w.Body.String() != `{"items":[]}` {
+			t.Errorf("%s from %q: status %d, body %q", tc.path, tc.origin, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin") != ""; got != tc.headers {
+			t.Errorf("%s from %q: Access-Control-Allow-Origin %q", tc.path, tc.origin, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+}
+
+func TestCORSAnyOriginWithoutCredentials(t *testing.T) {
+	h := corsTestHandler(t, "*")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, corsRequest(http.MethodGet, "/api/products", "https://anywhere.example"))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://anywhere.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("credentials allowed for any origin: %q", got)
+	}
+}
+
+func TestCORSFromEnv(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "")
+	var l envLoader
+	if corsFromEnv(&l).enabled() || l.err() != nil {
+		t.Errorf("unset: enabled, or %v", l.err())
+	}
+	for _, v := range []string{"spa.example.com", "ftp://spa.example.com", "https://spa.example.com/app", "https://"} {
+		t.Setenv("CORS_ALLOWED_ORIGINS", v)
+		var l envLoader
+		corsFromEnv(&l)
+		if l.err() == nil {
+			t.Errorf("%q accepted", v)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// countriesCSV lists the ISO 3166-1 countries the checkout form offers, as
+// code, English name and currency, which is empty for Antarctica.
+//
+//go:embed countries.csv
+var countriesCSV string
+
+// country is a country of the checkout form.
+type country struct {
+	Code     string // ISO 3166-1 alpha-2
+	Name     string // in English, as the checkout service is sent it
+	Currency string // ISO 4217
+}
+
+var (
+	countries       = mustParseCountries(countriesCSV)
+	countriesByCode = make(map[string]country, len(countries))
+)
+
+func init() {
+	for _, c := range countries {
+		countriesByCode[c.Code] = c
+	}
+}
+
+func mustParseCountries(data string) []country {
+	rows, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		panic(errors.Wrap(err, "countries.csv"))
+	}
+	out := make([]country, 0, len(rows))
+	for _, row := range rows[1:] { // the header
+		out = append(out, country{Code: row[0], Name: row[1], Currency: row[2]})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// lookupCountry finds a country by code or, as saved by earlier versions of
+// the form, by English name.
+func lookupCountry(v string) (country, bool) {
+	v = strings.TrimSpace(v)
+	if c, ok := countriesByCode[strings.ToUpper(v)]; ok {
+		return c, true
+	}
+	for _, c := range countries {
+		if strings.EqualFold(c.Name, v) {
+			return c, true
+		}
+	}
+	return country{}, false
+}
+
+// postalCodeFormat is the format of a country's postal codes, with an
+// example for error messages.
+type postalCodeFormat struct {
+	pattern string
+	example string
+	re      *regexp.Regexp
+}
+
+// postalCodeFormats are the countries whose postal codes are checked, and
+// must be given. Other countries take an optional code of up to ten letters,
+// digits, spaces and dashes.
+var postalCodeFormats = map[string]*postalCodeFormat{
+	"AT": {pattern: `\d{4}`, example: "1010"},
+	"AU": {pattern: `\d{4}`, example: "2000"},
+	"BE": {pattern: `\d{4}`, example: "1000"},
+	"BR": {pattern: `\d{5}-?\d{3}`, example: "01310-100"},
+	"CA": {pattern: `[A-Za-z]\d[A-Za-z] ?\d[A-Za-z]\d`, example: "K1A 0B1"},
+	"CH": {pattern: `\d{4}`, example: "8001"},
+	"CN": {pattern: `\d{6}`, example: "100000"},
+	"DE": {pattern: `\d{5}`, example: "10115"},
+	"DK": {pattern: `\d{4}`, example: "1050"},
+	"ES": {pattern: `\d{5}`, example: "28001"},
+	"FI": {pattern: `\d{5}`, example: "00100"},
+	"FR": {pattern: `\d{5}`, example: "75001"},
+	"GB": {pattern: `[A-Za-z]{1,2}\d[A-Za-z\d]? ?\d[A-Za-z]{2}`, example: "SW1A 1AA"},
+	"IN": {pattern: `\d{6}`, example: "110001"},
+	"IT": {pattern: `\d{5}`, example: "00118"},
+	"JP": {pattern: `\d{3}-?\d{4}`, example: "100-0001"},
+	"KR": {pattern: `\d{5}`, example: "03187"},
+	"MX": {pattern: `\d{5}`, example: "06000"},
+	"NL": {pattern: `\d{4} ?[A-Za-z]{2}`, example: "1012 AB"},
+	"NO": {pattern: `\d{4}`, example: "0150"},
+	"NZ": {pattern: `\d{4}`, example: "6011"},
+	"PL": {pattern: `\d{2}-\d{3}`, example: "00-001"},
+	"PT": {pattern: `\d{4}-\d{3}`, example: "1100-148"},
+	"SE": {pattern: `\d{3} ?\d{2}`, example: "111 22"},
+	"SG": {pattern: `\d{6}`, example: "018956"},
+	"US": {pattern: `\d{5}(-\d{4})?`, example: "94043"},
+	"ZA": {pattern: `\d{4}`, example: "0001"},
+}
+
+// otherPostalCodes is the format of the postal codes of countries missing
+// from postalCodeFormats.
+var otherPostalCodes = regexp.MustCompile(`^[A-Za-z\d][A-Za-z\d -]{0,9}$`)
+
+func init() {
+	for _, f := range postalCodeFormats {
+		f.re = regexp.MustCompile(`^(?:` + f.pattern + `)$`)
+	}
+}
+
+// stateRequired reports whether addresses in c need a state or province.
+func (c country) stateRequired() bool {
+	return c.Code == "US" || c.Code == "CA"
+}
+
+// checkAddress checks the state and postal code of an address in the country
+// of code, and returns a message for each field at fault, keyed by form
+// field name like validator.FieldErrors.
+func checkAddress(code, state, zip string) map[string]string {
+	c, ok := countriesByCode[code]
+	if !ok {
+		return map[string]string{"country": "Choose a country from the list."}
+	}
+	errs := make(map[string]string)
+	if c.stateRequired() && strings.TrimSpace(state) == "" {
+		errs["state"] = "This field is required."
+	}
+	zip = strings.TrimSpace(zip)
+	if f := postalCodeFormats[c.Code]; f != nil {
+		if zip == "" {
+			errs["zip_code"] = "This field is required."
+		} else if !f.re.MatchString(zip) {
+			errs["zip_code"] = "Enter a postal code such as " + f.example + "."
+		}
+	} else if zip != "" && !otherPostalCodes.MatchString(zip) {
+		errs["zip_code"] = "Enter letters, digits, spaces and dashes only."
+	}
+	return errs
+}
+
+// countryOption is a country of the checkout form's list, with what the form
+// needs to adjust its other fields once the country is chosen.
+type countryOption struct {
+	country
+	StateRequired bool
+	ZipPattern    string // empty for any
+	ZipRequired   bool
+	// SuggestCurrency is the currency of the country, if the shop supports
+	// it, to offer switching to.
+	SuggestCurrency string
+}
+
+// countryOptions returns the countries of the checkout form, given the
+// shop's currencies.
+func countryOptions(currencies []string) []countryOption {
+	out := make([]countryOption, len(countries))
+	for i, c := range countries {
+		out[i] = countryOption{country: c, StateRequired: c.stateRequired()}
+		if f := postalCodeFormats[c.Code]; f != nil {
+			out[i].ZipPattern, out[i].ZipRequired = f.pattern, true
+		}
+		if c.Currency != "" && stringinSlice(currencies, c.Currency) {
+			out[i].SuggestCurrency = c.Currency
+		}
+	}
+	return out
+}
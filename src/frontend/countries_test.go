@@ -0,0 +1,143 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestCountries(t *testing.T) {
+	if len(countries) != 249 {
+		t.Errorf("%d countries, want the 249 of ISO 3166-1", len(countries))
+	}
+	for code := range postalCodeFormats {
+		if _, ok := countriesByCode[code]; !ok {
+			t.Errorf("postal code format of unknown country %s", code)
+		}
+	}
+	for _, v := range []string{"US", "us", "United States", "united states"} {
+		if c, ok := lookupCountry(v); !ok || c.Code != "US" || c.Currency != "USD" {
+			t.Errorf("lookupCountry(%q) = %+v, %v", v, c, ok)
+		}
+	}
+	if _, ok := lookupCountry("Atlantis"); ok {
+		t.Error("found Atlantis")
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	for _, tc := range []struct {
+		country, state, zip string
+		want                map[string]string
+	}{
+		{"US", "CA", "94043", map[string]string{}},
+		{"US", "CA", "94043-1351", map[string]string{}},
+		{"US", "", "9404", map[string]string{"state": "This field is required.", "zip_code": "Enter a postal code such as 94043."}},
+		{"CA", "ON", "K1A 0B1", map[string]string{}},
+		{"CA", "", "", map[string]string{"state": "This field is required.", "zip_code": "This field is required."}},
+		{"GB", "", "SW1A 1AA", map[string]string{}},
+		{"DE", "", "1011", map[string]string{"zip_code": "Enter a postal code such as 10115."}},
+		{"HK", "", "", map[string]string{}},
+		{"HK", "", "#1", map[string]string{"zip_code": "Enter letters, digits, spaces and dashes only."}},
+		{"United States", "CA", "94043", map[string]string{"country": "Choose a country from the list."}},
+	} {
+		if got := checkAddress(tc.country, tc.state, tc.zip); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("checkAddress(%q, %q, %q) = %v, want %v", tc.country, tc.state, tc.zip, got, tc.want)
+		}
+	}
+}
+
+func TestShippingAddress(t *testing.T) {
+	for _, tc := range []struct {
+		country, city, zip string
+		want               *pb.Address
+	}{
+		{"US", "Mountain View", "94043", &pb.Address{City: "Mountain View", Country: "United States", ZipCode: 94043}},
+		{"JP", "Tokyo", "100-0001", &pb.Address{City: "Tokyo", Country: "Japan", ZipCode: 1000001}},
+		// The zip code of the services is a number.
+		{"CA", "Ottawa", "K1A 0B1", &pb.Address{City: "Ottawa K1A 0B1", Country: "Canada"}},
+		{"US", "Boston", "02134", &pb.Address{City: "Boston 02134", Country: "United States"}},
+		{"HK", "Hong Kong", "", &pb.Address{City: "Hong Kong", Country: "Hong Kong SAR China"}},
+	} {
+		a := checkoutAddress{City: tc.city, Country: tc.country, ZipCode: tc.zip}
+		if got := a.shippingAddress(); got.GetCity() != tc.want.GetCity() || got.GetCountry() != tc.want.GetCountry() || got.GetZipCode() != tc.want.GetZipCode() {
+			t.Errorf("%s %q: shippingAddress = %v, want %v", tc.country, tc.zip, got, tc.want)
+		}
+	}
+}
+
+func TestPlaceOrderChecksAddressPerCountry(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+
+	form := checkoutDefaults(time.Now())
+	form.Set("country", "CA")
+	form.Set("state", "")
+	form.Set("zip_code", "K1A 0B")
+	form.Set("city", "Ottawa")
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(form.Encode())))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"This field is required.", "Enter a postal code such as K1A 0B1.", `value="K1A 0B"`, `value="Ottawa"`, `value="CA" data-currency="CAD" data-state-required`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Errorf("PlaceOrder called %d times for an invalid address", n)
+	}
+
+	form.Set("state", "ON")
+	form.Set("zip_code", "K1A 0B1")
+	w = httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(form.Encode())))
+	if w.Code != http.StatusOK {
+		t.Fatalf("valid Canadian address: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCheckoutSuggestsCountryCurrency(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+
+	for _, tc := range []struct {
+		country, want string
+	}{
+		{"DE", "EUR"},
+		{"US", ""}, // the session's
+		{"CH", ""}, // not supported
+	} {
+		w := httptest.NewRecorder()
+		fe.renderCart(w, newTestRequest(http.MethodGet, "/cart", nil), url.Values{"country": {tc.country}}, nil, http.StatusOK)
+		body := w.Body.String()
+		hidden := strings.Contains(body, `id="currency-suggestion" hidden`)
+		if hidden != (tc.want == "") || tc.want != "" && !strings.Contains(body, `name="currency_code" value="`+tc.want+`"`) {
+			t.Errorf("shipping to %s: suggestion hidden %v, want %q", tc.country, hidden, tc.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+	csrfTokenLen  = 32
+)
+
+type ctxKeyCSRFToken struct{}
+
+// ensureCSRFToken implements double-submit CSRF protection. Every response
+// carries a random token in the shop_csrf-token cookie, which pages embed in
+// their forms. State-changing requests must echo the cookie's value in the
+// csrf_token form field or the X-CSRF-Token header; a cross-origin page can
+// make the browser send the cookie but cannot read it to fill in the field.
+//
+// With disabled set, tokens are still issued but not checked.
+func ensureCSRFToken(disabled bool, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if c, err := r.Cookie(cookieCSRFToken); err == nil && len(c.Value) > 0 {
+			token = c.Value
+		}
+
+		if !disabled && !isSafeMethod(r.Method) {
+			submitted := r.Header.Get(csrfHeader)
+			if submitted == "" {
+				submitted = r.PostFormValue(csrfFormField)
+			}
+			if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) != 1 {
+				log := loggerFromContext(r.Context())
+				log.WithField("csrf.cookie_present", token != "").Warn("rejecting request with missing or mismatched CSRF token")
+				renderErrorPage(log, r, w, "This form has expired or was submitted from another site. Go back, reload the page and try again.", http.StatusForbidden)
+				return
+			}
+		}
+
+		if token == "" {
+			token = randomToken(csrfTokenLen)
+			http.SetCookie(w, newCookie(cookieCSRFToken, token))
+		}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyCSRFToken{}, token))
+		next.ServeHTTP(w, r)
+	}
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func csrfToken(r *http.Request) string {
+	v, _ := r.Context().Value(ctxKeyCSRFToken{}).(string)
+	return v
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestEnsureCSRFToken(t *testing.T) {
+	const token = "known-token"
+	form := func(tok string) string {
+		return url.Values{"currency_code": {"EUR"}, csrfFormField: {tok}}.Encode()
+	}
+
+	tests := []struct {
+		name     string
+		disabled bool
+		method   string
+		cookie   string
+		body     string
+		header   string
+		wantCode int
+	}{
+		{name: "get without cookie", method: http.MethodGet, wantCode: http.StatusOK},
+		{name: "post with matching form token", method: http.MethodPost, cookie: token, body: form(token), wantCode: http.StatusOK},
+		{name: "post with matching header", method: http.MethodPost, cookie: token, header: token, wantCode: http.StatusOK},
+		{name: "post without token", method: http.MethodPost, cookie: token, body: "currency_code=EUR", wantCode: http.StatusForbidden},
+		{name: "post with wrong token", method: http.MethodPost, cookie: token, body: form("guess"), wantCode: http.StatusForbidden},
+		{name: "post with wrong header", method: http.MethodPost, cookie: token, header: "guess", wantCode: http.StatusForbidden},
+		{name: "post without cookie", method: http.MethodPost, body: form(token), wantCode: http.StatusForbidden},
+		{name: "post without cookie or token", method: http.MethodPost, body: "currency_code=EUR", wantCode: http.StatusForbidden},
+		{name: "disabled", disabled: true, method: http.MethodPost, body: "currency_code=EUR", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reached bool
+			h := ensureCSRFToken(tt.disabled, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				if csrfToken(r) == "" {
+					t.Error("no CSRF token in request context")
+				}
+			}))
+			r := newTestRequest(tt.method, "/setCurrency", strings.NewReader(tt.body))
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: cookieCSRFToken, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if reached != (tt.wantCode == http.StatusOK) {
+				t.Errorf("handler reached = %v, want %v", reached, tt.wantCode == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestEnsureCSRFTokenIssuesCookie(t *testing.T) {
+	var seen string
+	h := ensureCSRFToken(false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = csrfToken(r)
+	}))
+
+	w := httptest.NewRecorder()
+	h(w, newTestRequest(http.MethodGet, "/", nil))
+	var issued string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieCSRFToken {
+			issued = c.Value
+		}
+	}
+	if issued == "" || issued != seen {
+		t.Fatalf("issued cookie %q, token in context %q; want equal and non-empty", issued, seen)
+	}
+
+	// A request that already carries the cookie keeps its token.
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookieCSRFToken, Value: issued})
+	w = httptest.NewRecorder()
+	h(w, r)
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("unexpected Set-Cookie %v for a request with a token", w.Result().Header.Values("Set-Cookie"))
+	}
+	if seen != issued {
+		t.Errorf("token in context = %q, want %q", seen, issued)
+	}
+}
+
+func TestCSRFTokenRenderedInForms(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	h := ensureCSRFToken(false, http.HandlerFunc(fe.productHandler))
+
+	r := newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "OLJCESPC7Z"})
+	r.AddCookie(&http.Cookie{Name: cookieCSRFToken, Value: "rendered-token"})
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), `name="csrf_token" value="rendered-token"`) {
+		t.Error("product page form does not embed the CSRF token")
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+const (
+	defaultCurrencyRefreshInterval = 10 * time.Minute
+	currencyRefreshTimeout         = 5 * time.Second
+)
+
+// supportedCurrencies holds the currency codes offered to users: those the
+// currency service supports, optionally narrowed down by CURRENCY_ALLOWLIST.
+type supportedCurrencies struct {
+	allow map[string]bool // nil allows every code
+
+	mu    sync.RWMutex
+	codes []string
+	set   map[string]bool
+}
+
+// parseCurrencyAllowlist parses a comma-separated list of currency codes. It
+// returns nil for an empty list.
+func parseCurrencyAllowlist(s string) map[string]bool {
+	var allow map[string]bool
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			if allow == nil {
+				allow = make(map[string]bool)
+			}
+			allow[c] = true
+		}
+	}
+	return allow
+}
+
+func (s *supportedCurrencies) get() ([]string, map[string]bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.codes, s.set
+}
+
+// refreshCurrencies reloads the supported currencies from the currency service.
+func (fe *frontendServer) refreshCurrencies(ctx context.Context) ([]string, error) {
+	resp, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
+		GetSupportedCurrencies(ctx, &pb.Empty{})
+	if err != nil {
+		return nil, err
+	}
+	var codes []string
+	set := make(map[string]bool)
+	for _, c := range resp.GetCurrencyCodes() {
+		if fe.currencies.allow == nil || fe.currencies.allow[c] {
+			codes = append(codes, c)
+			set[c] = true
+		}
+	}
+	fe.currencies.mu.Lock()
+	fe.currencies.codes, fe.currencies.set = codes, set
+	fe.currencies.mu.Unlock()
+	return codes, nil
+}
+
+// watchCurrencies refreshes the supported currencies every interval until ctx
+// is done.
+func (fe *frontendServer) watchCurrencies(ctx context.Context, log logrus.FieldLogger, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		rctx, cancel := context.WithTimeout(ctx, currencyRefreshTimeout)
+		if _, err := fe.refreshCurrencies(rctx); err != nil {
+			log.WithField("error", err).Warn("could not refresh supported currencies, keeping previous list")
+		}
+		cancel()
+	}
+}
+
+// isSupportedCurrency reports whether code may be selected by users.
+func (fe *frontendServer) isSupportedCurrency(ctx context.Context, code string) (bool, error) {
+	if _, set := fe.currencies.get(); set != nil {
+		return set[code], nil
+	}
+	codes, err := fe.refreshCurrencies(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range codes {
+		if c == code {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type ctxKeyCurrency struct{}
+
+// regionCurrencies maps ISO 3166 country codes to the currency users there
+// most likely want.
+var regionCurrencies = map[string]string{
+	"AT": "EUR", "AU": "AUD", "BE": "EUR", "BG": "BGN", "BR": "BRL", "CA": "CAD",
+	"CH": "CHF", "CN": "CNY", "CY": "EUR", "CZ": "CZK", "DE": "EUR", "DK": "DKK",
+	"EE": "EUR", "ES": "EUR", "FI": "EUR", "FR": "EUR", "GB": "GBP", "GR": "EUR",
+	"HK": "HKD", "HR": "EUR", "HU": "HUF", "ID": "IDR", "IE": "EUR", "IL": "ILS",
+	"IN": "INR", "IS": "ISK", "IT": "EUR", "JP": "JPY", "KR": "KRW", "LT": "EUR",
+	"LU": "EUR", "LV": "EUR", "MT": "EUR", "MX": "MXN", "MY": "MYR", "NL": "EUR",
+	"NO": "NOK", "NZ": "NZD", "PH": "PHP", "PL": "PLN", "PT": "EUR", "RO": "RON",
+	"RU": "RUB", "SE": "SEK", "SG": "SGD", "SI": "EUR", "SK": "EUR", "TH": "THB",
+	"TR": "TRY", "US": "USD", "ZA": "ZAR",
+}
+
+// languageRegions gives the country of Accept-Language tags without a region
+// subtag, for languages mostly spoken in one country.
+var languageRegions = map[string]string{
+	"cs": "CZ", "da": "DK", "de": "DE", "el": "GR", "es": "ES", "fi": "FI",
+	"fr": "FR", "he": "IL", "hu": "HU", "is": "IS", "it": "IT", "ja": "JP",
+	"ko": "KR", "nb": "NO", "nl": "NL", "pl": "PL", "pt": "PT", "ro": "RO",
+	"ru": "RU", "sv": "SE", "th": "TH", "tr": "TR", "zh": "CN",
+}
+
+// currencyCandidates returns the currencies suggested by r for a visitor who
+// has not chosen one, best first: that of the country reported by the edge in
+// CF-IPCountry or X-Country, then those of the languages in Accept-Language.
+func currencyCandidates(r *http.Request) []string {
+	var out []string
+	add := func(region string) {
+		if c, ok := regionCurrencies[strings.ToUpper(region)]; ok {
+			out = append(out, c)
+		}
+	}
+	for _, h := range []string{"CF-IPCountry", "X-Country"} {
+		if v := strings.TrimSpace(r.Header.Get(h)); v != "" {
+			add(v)
+		}
+	}
+	for _, tag := range acceptedLanguages(r) {
+		subtags := strings.FieldsFunc(tag, func(c rune) bool { return c == '-' || c == '_' })
+		region := languageRegions[strings.ToLower(subtags[0])]
+		for _, st := range subtags[1:] {
+			if len(st) == 2 {
+				region = st
+				break
+			}
+		}
+		add(region)
+	}
+	return out
+}
+
+// ensureCurrency picks a currency for visitors without a currency cookie:
+// the first of currencyCandidates that users may select, or else the
+// default currency. A picked currency is stored in the cookie, so later
+// requests, and setCurrencyHandler, work as if the user had chosen it. Until
+// the supported currencies have been loaded no cookie is set, and the
+// default is used. The currency is also put in the request context, where
+// the backend metadata picks it up, if the cookie holds a valid one.
+func (fe *frontendServer) ensureCurrency(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(cookieCurrency); err == nil {
+			if (&validator.SetCurrencyPayload{Currency: c.Value}).Validate() == nil {
+				r = r.WithContext(context.WithValue(r.Context(), ctxKeyCurrency{}, c.Value))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		cur := fe.defaultCurrency
+		if cur == "" {
+			cur = defaultCurrency
+		}
+		if _, set := fe.currencies.get(); set != nil {
+			for _, c := range append(currencyCandidates(r), cur) {
+				if set[c] {
+					cur = c
+					http.SetCookie(w, newCookie(cookieCurrency, c))
+					break
+				}
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyCurrency{}, cur)))
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSetCurrencyHandlerValidatesAgainstLiveCurrencies(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist string
+		currency  string
+		wantCode  int
+	}{
+		{"supported", "", "EUR", http.StatusFound},
+		{"not offered by currency service", "", "CHF", http.StatusBadRequest},
+		{"allowed", "usd, eur", "EUR", http.StatusFound},
+		{"excluded by allowlist", "USD,EUR", "JPY", http.StatusBadRequest},
+		{"invalid code", "", "XYZ", http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := newTestFrontend(t, newFakeBackend())
+			fe.currencies.allow = parseCurrencyAllowlist(tt.allowlist)
+			w := httptest.NewRecorder()
+			fe.setCurrencyHandler(w, newTestRequest(http.MethodPost, "/setCurrency",
+				strings.NewReader(url.Values{"currency_code": {tt.currency}}.Encode())))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			setsCookie := strings.Contains(strings.Join(w.Result().Header.Values("Set-Cookie"), ";"), cookieCurrency+"=")
+			if setsCookie != (tt.wantCode == http.StatusFound) {
+				t.Errorf("currency cookie set = %v, want %v", setsCookie, tt.wantCode == http.StatusFound)
+			}
+		})
+	}
+}
+
+func TestRefreshCurrencies(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	fe.currencies.allow = parseCurrencyAllowlist("EUR,USD,CHF")
+	ctx := context.Background()
+
+	got, err := fe.getCurrencies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"EUR", "USD"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getCurrencies = %v, want %v", got, want)
+	}
+
+	// Once loaded, the list is served without calling the backend.
+	calls := fb.callCount("GetSupportedCurrencies")
+	if _, err := fe.getCurrencies(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := fb.callCount("GetSupportedCurrencies"); n != calls {
+		t.Errorf("getCurrencies called the backend %d more times, want 0", n-calls)
+	}
+
+	// A currency added to the service shows up after a refresh.
+	fb.mu.Lock()
+	fb.currencies = append(fb.currencies, "CHF")
+	fb.mu.Unlock()
+	if _, err := fe.refreshCurrencies(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := fe.isSupportedCurrency(ctx, "CHF"); !ok {
+		t.Error("CHF not supported after refresh")
+	}
+
+	// A failed refresh keeps the previous list.
+	fb.setError("GetSupportedCurrencies", status.Error(codes.Unavailable, "down"))
+	if _, err := fe.refreshCurrencies(ctx); err == nil {
+		t.Fatal("refreshCurrencies succeeded with the backend down")
+	}
+	if got, err := fe.getCurrencies(ctx); err != nil || len(got) != 3 {
+		t.Errorf("getCurrencies = %v, %v; want previous list of 3", got, err)
+	}
+}
+
+func TestEnsureCurrency(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowlist      string
+		defaultCur     string
+		country        string
+		acceptLanguage string
+		want           string
+	}{
+		{"German locale", "", "", "", "de-DE,de;q=0.9,en;q=0.8", "EUR"},
+		{"Japanese without region", "", "", "", "ja", "JPY"},
+		{"country header wins", "", "", "GB", "de-DE", "GBP"},
+		{"unknown country and language", "", "", "XX", "xx-YY", "USD"},
+		{"unknown with DEFAULT_CURRENCY", "", "EUR", "", "", "EUR"},
+		{"country currency not offered", "", "", "CH", "fr-CH, ja;q=0.5", "JPY"},
+		{"excluded by allowlist", "USD,GBP", "", "DE", "de-DE", "USD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := newTestFrontend(t, newFakeBackend())
+			fe.currencies.allow = parseCurrencyAllowlist(tt.allowlist)
+			fe.defaultCurrency = tt.defaultCur
+			if _, err := fe.refreshCurrencies(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			r := newTestRequest(http.MethodGet, "/", nil)
+			r.Header.Set("CF-IPCountry", tt.country)
+			r.Header.Set("Accept-Language", tt.acceptLanguage)
+			var got string
+			w := httptest.NewRecorder()
+			fe.ensureCurrency(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = currentCurrency(r)
+			})).ServeHTTP(w, r)
+
+			if got != tt.want {
+				t.Errorf("currency = %s, want %s", got, tt.want)
+			}
+			if c := w.Result().Cookies(); len(c) != 1 || c[0].Name != cookieCurrency || c[0].Value != tt.want {
+				t.Errorf("cookies = %v, want %s=%s", c, cookieCurrency, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureCurrencyKeepsChoice(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	if _, err := fe.refreshCurrencies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Language", "ja")
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "CAD"})
+	var got string
+	w := httptest.NewRecorder()
+	fe.ensureCurrency(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = currentCurrency(r)
+	})).ServeHTTP(w, r)
+	if got != "CAD" || len(w.Result().Cookies()) != 0 {
+		t.Errorf("currency = %s, cookies %v; want the user's CAD, unchanged", got, w.Result().Cookies())
+	}
+}
+
+func TestEnsureCurrencyBeforeCurrenciesLoad(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.defaultCurrency = "EUR"
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Language", "ja")
+	var got string
+	w := httptest.NewRecorder()
+	fe.ensureCurrency(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = currentCurrency(r)
+	})).ServeHTTP(w, r)
+	if got != "EUR" || len(w.Result().Cookies()) != 0 {
+		t.Errorf("currency = %s, cookies %v; want the default and no cookie", got, w.Result().Cookies())
+	}
+}
+
+func TestSetCurrencyHandlerRedirect(t *testing.T) {
+	defer func(v string) { baseUrl = v }(baseUrl)
+	tests := []struct {
+		name, base, redirectTo, referer, want string
+	}{
+		{"no target", "", "", "", "/"},
+		{"form field", "", "/product/OLJCESPC7Z?x=1", "", "/product/OLJCESPC7Z?x=1"},
+		{"form field wins over referer", "", "/cart", "http://example.com/product/1", "/cart"},
+		{"referer on this host", "", "", "http://example.com/cart#items", "/cart"},
+		{"referer on another host", "", "", "https://evil.example/cart", "/"},
+		{"absolute URL", "", "https://evil.example/", "", "/"},
+		{"protocol-relative URL", "", "//evil.example/cart", "", "/"},
+		{"backslash", "", "/\\evil.example", "", "/"},
+		{"javascript", "", "javascript:alert(1)", "", "/"},
+		{"relative path", "", "cart", "", "/"},
+		{"path traversal", "", "/product/../../admin", "", "/"},
+		{"encoded path traversal", "", "/product/%2e%2e/admin", "", "/"},
+		{"under base path", "/shop", "/shop/cart", "", "/shop/cart"},
+		{"outside base path", "/shop", "/admin", "", "/shop/"},
+		{"base path prefix", "/shop", "/shopping", "", "/shop/"},
+		{"traversal out of base path", "/shop", "/shop/../admin", "", "/shop/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseUrl = tt.base
+			fe := newTestFrontend(t, newFakeBackend())
+			form := url.Values{"currency_code": {"EUR"}}
+			if tt.redirectTo != "" {
+				form.Set("redirect_to", tt.redirectTo)
+			}
+			r := newTestRequest(http.MethodPost, "/setCurrency", strings.NewReader(form.Encode()))
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			w := httptest.NewRecorder()
+			fe.setCurrencyHandler(w, r)
+			if w.Code != http.StatusFound || w.Header().Get("Location") != tt.want {
+				t.Errorf("status %d to %q, want a redirect to %q", w.Code, w.Header().Get("Location"), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/version"
+)
+
+var startTime = time.Now()
+
+// secretEnvMarkers flag environment variables whose values /debug/config
+// must not show.
+var secretEnvMarkers = []string{"SECRET", "TOKEN", "PASSWORD", "PASSWD", "KEY", "CREDENTIAL", "AUTH"}
+
+const redacted = "[redacted]"
+
+type backendDebugStatus struct {
+	State       string            `json:"state"`
+	Target      string            `json:"target,omitempty"`
+	Subchannels map[string]string `json:"subchannels,omitempty"`
+	Breaker     string            `json:"breaker,omitempty"`
+}
+
+type cacheDebugStatus struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+type debugStatus struct {
+	Build         version.Info                  `json:"build"`
+	StartedAt     time.Time                     `json:"started_at"`
+	UptimeSeconds int64                         `json:"uptime_seconds"`
+	Goroutines    int                           `json:"goroutines"`
+	Draining      bool                          `json:"draining"`
+	Backends      map[string]backendDebugStatus `json:"backends"`
+	Caches        map[string]cacheDebugStatus   `json:"caches"`
+}
+
+// debugStatusHandler reports the state of the process and its backend
+// connections. Unlike /_readyz it never probes a backend or nudges an idle
+// connection.
+func (fe *frontendServer) debugStatusHandler(w http.ResponseWriter, r *http.Request) {
+	st := debugStatus{
+		Build:         version.Get(),
+		StartedAt:     startTime,
+		UptimeSeconds: int64(time.Since(startTime) / time.Second),
+		Goroutines:    runtime.NumGoroutine(),
+		Draining:      fe.draining.Load(),
+		Backends:      make(map[string]backendDebugStatus),
+		Caches:        make(map[string]cacheDebugStatus),
+	}
+	for name, conn := range fe.backendConns() {
+		b := backendDebugStatus{State: "NOT_CONNECTED"}
+		if conn != nil {
+			b = backendDebugStatus{
+				State:       conn.GetState().String(),
+				Target:      conn.Target(),
+				Subchannels: subchannelStates.get(conn.CanonicalTarget()),
+			}
+		}
+		if breaker := fe.breakers[name]; breaker != nil {
+			b.Breaker = breaker.current().String()
+		}
+		st.Backends[name] = b
+	}
+	if c := fe.catalog; c != nil {
+		st.Caches["catalog"] = newCacheDebugStatus(c.hits.Load(), c.misses.Load())
+	}
+	if c := fe.currencyRates; c != nil {
+		st.Caches["currency_rates"] = newCacheDebugStatus(c.CacheStats())
+	}
+	writeJSON(loggerFromContext(r.Context()), w, http.StatusOK, st)
+}
+
+func newCacheDebugStatus(hits, misses int64) cacheDebugStatus {
+	c := cacheDebugStatus{Hits: hits, Misses: misses}
+	if total := hits + misses; total > 0 {
+		c.HitRate = float64(hits) / float64(total)
+	}
+	return c
+}
+
+// debugConfigHandler dumps the environment, which is where all of the
+// frontend's configuration comes from. Values of variables that look like
+// secrets, and passwords embedded in URLs, are redacted.
+func debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = redactEnv(k, v)
+	}
+	writeJSON(loggerFromContext(r.Context()), w, http.StatusOK, env)
+}
+
+func redactEnv(key, value string) string {
+	upper := strings.ToUpper(key)
+	for _, m := range secretEnvMarkers {
+		if strings.Contains(upper, m) {
+			return redacted
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the image has no zoneinfo for SHOP_TIMEZONE and TZ
+
+	"github.com/pkg/errors"
+)
+
+// defaultShippingEstimateDays is the transit time of the shop's only
+// shipping option when SHIPPING_ESTIMATE_DAYS is not set.
+const defaultShippingEstimateDays = "standard=5-7"
+
+// shippingTier is a speed of shipping, which takes from min to max business
+// days.
+type shippingTier struct {
+	name     string
+	min, max int
+}
+
+// deliveryEstimator tells when orders should arrive, for each tier of
+// SHIPPING_ESTIMATE_DAYS, counting business days from the day of the order
+// in SHOP_TIMEZONE. A nil estimator estimates nothing.
+type deliveryEstimator struct {
+	tiers []shippingTier
+	loc   *time.Location
+}
+
+// deliveryWindow is the first and last day an order of a tier should arrive
+// on, at midnight in the shop's time zone.
+type deliveryWindow struct {
+	Tier     string
+	From, To time.Time
+}
+
+// deliveryFromEnv reads SHIPPING_ESTIMATE_DAYS, a comma-separated list of
+// tiers such as "standard=5-7,express=1-2", and SHOP_TIMEZONE, an IANA time
+// zone that defaults to that of the process, as set by TZ.
+func deliveryFromEnv(l *envLoader) *deliveryEstimator {
+	d := &deliveryEstimator{loc: time.Local}
+	if name := os.Getenv("SHOP_TIMEZONE"); name != "" {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			l.problem("SHOP_TIMEZONE: unknown time zone %q", name)
+		} else {
+			d.loc = loc
+		}
+	}
+	tiers, err := parseShippingTiers(l.str("SHIPPING_ESTIMATE_DAYS", defaultShippingEstimateDays))
+	if err != nil {
+		l.problem("SHIPPING_ESTIMATE_DAYS: %v", err)
+	}
+	d.tiers = tiers
+	return d
+}
+
+func parseShippingTiers(s string) ([]shippingTier, error) {
+	var tiers []shippingTier
+	for _, text := range strings.Split(s, ",") {
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		name, days, ok := strings.Cut(text, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, errors.Errorf("tier %q is not of the form name=min-max", text)
+		}
+		lo, hi, ranged := strings.Cut(days, "-")
+		if !ranged {
+			hi = lo
+		}
+		min, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		max, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || min < 0 || max < min || max > 90 {
+			return nil, errors.Errorf("tier %q: %q is not a range of business days such as 5-7", name, days)
+		}
+		for _, t := range tiers {
+			if t.name == name {
+				return nil, errors.Errorf("tier %q given twice", name)
+			}
+		}
+		tiers = append(tiers, shippingTier{name: name, min: min, max: max})
+	}
+	return tiers, nil
+}
+
+// windows returns when an order placed at t should arrive, for each tier.
+func (d *deliveryEstimator) windows(t time.Time) []deliveryWindow {
+	if d == nil {
+		return nil
+	}
+	y, m, day := t.In(d.loc).Date()
+	ordered := time.Date(y, m, day, 0, 0, 0, 0, d.loc)
+	out := make([]deliveryWindow, len(d.tiers))
+	for i, tier := range d.tiers {
+		out[i] = deliveryWindow{
+			Tier: tier.name,
+			From: addBusinessDays(ordered, tier.min),
+			To:   addBusinessDays(ordered, tier.max),
+		}
+	}
+	return out
+}
+
+// addBusinessDays returns the day n business days after day, a midnight.
+// Weekends are skipped, so that no day of the result is one, and an order of
+// a Saturday and one of the Monday after arrive on the same day.
+func addBusinessDays(day time.Time, n int) time.Time {
+	next := func(t time.Time) time.Time {
+		// Not t.Add(24 * time.Hour): days around DST changes are not 24 hours.
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+	}
+	for isWeekend(day) {
+		day = next(day)
+	}
+	for ; n > 0; n-- {
+		day = next(day)
+		for isWeekend(day) {
+			day = next(day)
+		}
+	}
+	return day
+}
+
+func isWeekend(t time.Time) bool {
+	return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestDeliveryWindows(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		ordered  time.Time
+		loc      *time.Location
+		min, max int
+		from, to string
+	}{
+		{"Monday", time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC), time.UTC, 5, 7, "2026-10-19 Mon", "2026-10-21 Wed"},
+		{"Friday", time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC), time.UTC, 1, 5, "2026-10-19 Mon", "2026-10-23 Fri"},
+		{"Saturday", time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC), time.UTC, 1, 2, "2026-10-20 Tue", "2026-10-21 Wed"},
+		{"Sunday, same day", time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC), time.UTC, 0, 0, "2026-10-19 Mon", "2026-10-19 Mon"},
+		{"year rollover", time.Date(2026, 12, 30, 9, 0, 0, 0, time.UTC), time.UTC, 5, 7, "2027-01-06 Wed", "2027-01-08 Fri"},
+		{"New Year's Eve", time.Date(2027, 12, 31, 9, 0, 0, 0, time.UTC), time.UTC, 1, 3, "2028-01-03 Mon", "2028-01-05 Wed"},
+		// Late on Friday in UTC is already Saturday in Tokyo.
+		{"Friday night in UTC", time.Date(2026, 10, 16, 23, 30, 0, 0, time.UTC), time.UTC, 1, 1, "2026-10-19 Mon", "2026-10-19 Mon"},
+		{"Saturday morning in Tokyo", time.Date(2026, 10, 16, 23, 30, 0, 0, time.UTC), tokyo, 1, 1, "2026-10-20 Tue", "2026-10-20 Tue"},
+	} {
+		d := &deliveryEstimator{tiers: []shippingTier{{name: "standard", min: tc.min, max: tc.max}}, loc: tc.loc}
+		got := d.windows(tc.ordered)
+		if len(got) != 1 {
+			t.Fatalf("%s: %d windows, want 1", tc.name, len(got))
+		}
+		const layout = "2006-01-02 Mon"
+		if from, to := got[0].From.Format(layout), got[0].To.Format(layout); from != tc.from || to != tc.to {
+			t.Errorf("%s: window %s to %s, want %s to %s", tc.name, from, to, tc.from, tc.to)
+		}
+		if got[0].From.Location() != tc.loc || got[0].From.Hour() != 0 {
+			t.Errorf("%s: window starts at %v, want midnight in %v", tc.name, got[0].From, tc.loc)
+		}
+	}
+
+	if got := (*deliveryEstimator)(nil).windows(time.Now()); got != nil {
+		t.Errorf("nil estimator: windows = %v", got)
+	}
+}
+
+func TestParseShippingTiers(t *testing.T) {
+	got, err := parseShippingTiers(" standard=5-7, express = 1-2 ,overnight=1")
+	want := []shippingTier{{"standard", 5, 7}, {"express", 1, 2}, {"overnight", 1, 1}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("parseShippingTiers = %v, %v, want %v", got, err, want)
+	}
+	for _, s := range []string{"standard", "=5-7", "standard=7-5", "standard=five", "standard=-1", "standard=5-7,standard=1-2"} {
+		if _, err := parseShippingTiers(s); err == nil {
+			t.Errorf("parseShippingTiers(%q) succeeded", s)
+		}
+	}
+}
+
+func TestLoadConfigDelivery(t *testing.T) {
+	cfg := loadTestConfig(t)
+	if want := []shippingTier{{"standard", 5, 7}}; !reflect.DeepEqual(cfg.delivery.tiers, want) || cfg.delivery.loc != time.Local {
+		t.Errorf("default delivery = %+v, want %v in the local time zone", cfg.delivery, want)
+	}
+
+	t.Setenv("SHIPPING_ESTIMATE_DAYS", "standard=3-4,express=1")
+	t.Setenv("SHOP_TIMEZONE", "Europe/Berlin")
+	cfg = loadTestConfig(t)
+	if len(cfg.delivery.tiers) != 2 || cfg.delivery.loc.String() != "Europe/Berlin" {
+		t.Errorf("delivery = %+v", cfg.delivery)
+	}
+
+	t.Setenv("SHIPPING_ESTIMATE_DAYS", "standard=soon")
+	t.Setenv("SHOP_TIMEZONE", "Mars/Olympus_Mons")
+	_, err := loadConfig()
+	for _, want := range []string{"SHIPPING_ESTIMATE_DAYS", "SHOP_TIMEZONE"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want a problem with %s", err, want)
+		}
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	day := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	for lang, want := range map[string]string{
+		"en": "Mon, Oct 19",
+		"de": "Mo., 19. Okt.",
+		"es": "lun, 19 oct",
+		"ja": "10月19日(月)",
+		"fr": "Mon, Oct 19",
+	} {
+		if got := formatDate(lang, day); got != want {
+			t.Errorf("formatDate(%q) = %q, want %q", lang, got, want)
+		}
+	}
+}
+
+func TestPagesShowDeliveryEstimate(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+	fe.delivery = &deliveryEstimator{tiers: []shippingTier{{"standard", 5, 7}, {"express", 1, 1}}, loc: time.UTC}
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, withSavedAddress(fe, newTestRequest(http.MethodGet, "/cart", nil)))
+	body := w.Body.String()
+	for _, want := range []string{"Estimated delivery (standard)", "Estimated delivery (express)", " – "} {
+		if !strings.Contains(body, want) {
+			t.Errorf("cart page does not contain %q", want)
+		}
+	}
+
+	w = placeTestOrder(t, fe)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), "Estimated delivery (express)") {
+		t.Error("order page does not show the delivery estimate")
+	}
+
+	fe.delivery = &deliveryEstimator{tiers: []shippingTier{{"standard", 5, 7}}, loc: time.UTC}
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, withSavedAddress(fe, newTestRequest(http.MethodGet, "/cart", nil)))
+	if body := w.Body.String(); !strings.Contains(body, "Estimated delivery") || strings.Contains(body, "(standard)") {
+		t.Error("a single tier is not shown as the estimated delivery")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/version"
+)
+
+const (
+	cartVersionLen = 8
+
+	// defaultProductPageMaxAge lets browsers reuse a product page only after
+	// revalidating it. A longer PRODUCT_PAGE_MAX_AGE saves the round trip but
+	// may show a cart badge that is out of date for that long.
+	defaultProductPageMaxAge = 0
+)
+
+// bumpCartVersion changes the cart version cookie after the cart has been
+// modified, so that pages showing the old cart no longer match their ETag.
+func bumpCartVersion(w http.ResponseWriter) {
+	http.SetCookie(w, newCookie(cookieCartVersion, randomToken(cartVersionLen)))
+}
+
+func cartVersion(r *http.Request) string {
+	return cookieValue(r, cookieCartVersion)
+}
+
+// cookieValue returns the raw value of cookie name, or "" if r has none.
+func cookieValue(r *http.Request, name string) string {
+	if c, err := r.Cookie(name); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// pageETag returns a weak ETag for a page showing products to the user of r.
+// It changes with the products, the URI, the user's currency, locale,
+// language, session, cart version, recently viewed products and experiment
+// variants, the stock and sales of the products, and the build, whose
+// templates render the page. It does not cover ads, recommendations and the
+// details of recently viewed products, which may be stale on a page
+// revalidated from the browser cache.
+func (fe *frontendServer) pageETag(r *http.Request, products ...*pb.Product) string {
+	h := sha256.New()
+	v := version.Get()
+	for _, s := range []string{
+		v.Version, v.Commit, baseUrl, pageURI(r), currentCurrency(r), userLocale(r).Tag, pageLanguage(r),
+		sessionID(r), csrfToken(r), cartVersion(r), cookieValue(r, cookieRecentlyViewed),
+		cookieValue(r, cookieBannerDismissed), experimentsKey(r),
+	} {
+		fmt.Fprintf(h, "%q\n", s)
+	}
+	opts := proto.MarshalOptions{Deterministic: true}
+	for _, p := range products {
+		b, _ := opts.Marshal(p)
+		fmt.Fprintf(h, "%d\n", len(b))
+		h.Write(b)
+		if n, limited := fe.stock.available(p.GetId()); limited {
+			fmt.Fprintf(h, "stock %d\n", n)
+		}
+		if s, ok := fe.activeSale(p.GetId(), time.Now()); ok {
+			fmt.Fprintf(h, "sale %v\n", s.percent)
+		}
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// setPageCacheHeaders marks a page as cacheable by the browser only, and for
+// maxAge before it must be revalidated with etag.
+func setPageCacheHeaders(w http.ResponseWriter, etag string, maxAge time.Duration) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(maxAge/time.Second)))
+	w.Header().Add("Vary", "Cookie, Accept-Language")
+}
+
+// notModified answers 304 if r carries etag in If-None-Match. The ETag is
+// only sent with 304s and successful pages, never with error pages.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, maxAge time.Duration) bool {
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	setPageCacheHeaders(w, etag, maxAge)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches implements the weak comparison of If-None-Match.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func getProductPage(fe *frontendServer, etag string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	fe.productHandler(w, r)
+	return w
+}
+
+func TestProductPageETag(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	fe.productPageMaxAge = time.Minute
+
+	w := getProductPage(fe, "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("status %d, ETag %q", w.Code, etag)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "private, max-age=60" {
+		t.Errorf("Cache-Control = %q", cc)
+	}
+
+	recommendations := fb.callCount("ListRecommendations")
+	if w := getProductPage(fe, etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+		t.Errorf("revalidation: status %d, ETag %q, %d bytes", w.Code, w.Header().Get("ETag"), w.Body.Len())
+	}
+	if fb.callCount("ListRecommendations") != recommendations {
+		t.Error("page rendered for a 304")
+	}
+
+	eur := &http.Cookie{Name: cookieCurrency, Value: "EUR"}
+	w = getProductPage(fe, etag, eur)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after switching currency: status %d, ETag unchanged: %v", w.Code, w.Header().Get("ETag") == etag)
+	}
+	if w := getProductPage(fe, w.Header().Get("ETag"), eur); w.Code != http.StatusNotModified {
+		t.Errorf("revalidation in EUR: status %d", w.Code)
+	}
+
+	fb.mu.Lock()
+	fb.products[0].Description = "Now polarized."
+	fb.mu.Unlock()
+	if w := getProductPage(fe, etag); w.Code != http.StatusOK {
+		t.Errorf("after a catalog change: status %d", w.Code)
+	}
+}
+
+func TestCartMutationChangesETag(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	etag := getProductPage(fe, "").Header().Get("ETag")
+
+	form := url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}}
+	w := httptest.NewRecorder()
+	fe.addToCartHandler(w, newTestRequest(http.MethodPost, "/cart", strings.NewReader(form.Encode())))
+	var version *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieCartVersion {
+			version = c
+		}
+	}
+	if version == nil {
+		t.Fatal("adding to the cart did not set a cart version")
+	}
+	if w := getProductPage(fe, etag, version); w.Code != http.StatusOK {
+		t.Errorf("page with the old cart revalidated: status %d", w.Code)
+	}
+}
+
+func TestHomePageETag(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Cache-Control") != "private, max-age=0" {
+		t.Fatalf("status %d, ETag %q, Cache-Control %q", w.Code, etag, w.Header().Get("Cache-Control"))
+	}
+
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", `"other", `+etag)
+	w = httptest.NewRecorder()
+	fe.homeHandler(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("revalidation: status %d", w.Code)
+	}
+}
+
+func TestPageETagIgnoresOtherSessions(t *testing.T) {
+	p := &pb.Product{Id: "OLJCESPC7Z"}
+	a := newTestRequest(http.MethodGet, "/", nil)
+	b := a.WithContext(context.WithValue(a.Context(), ctxKeySessionID{}, "other-session"))
+	fe := &frontendServer{}
+	if fe.pageETag(a, p) == fe.pageETag(b, p) {
+		t.Error("two sessions share an ETag")
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`"x", W/"abc"`, true},
+		{`*`, true},
+		{`W/"abcd"`, false},
+	} {
+		if got := etagMatches(tc.header, `W/"abc"`); got != tc.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// experimentsExposedKey is the session state remembering which variants
+// were already logged as exposed.
+const experimentsExposedKey = "experiments.exposed"
+
+var experimentExposures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "experiment_exposures_total",
+	Help: "Number of sessions exposed to each experiment variant.",
+}, []string{"experiment", "variant"})
+
+// experiment is an A/B experiment. Each session gets one of its variants,
+// with a probability proportional to the variant's weight.
+type experiment struct {
+	name     string
+	variants []experimentVariant
+}
+
+type experimentVariant struct {
+	name   string
+	weight int
+}
+
+// parseExperiments parses experiments written as in EXPERIMENTS: experiments
+// are separated by commas, and each is a name=variants pair whose variants
+// are name:weight fields separated by semicolons, e.g.
+// "home_layout=a:50;b:50,checkout_button=blue:9;green:1".
+func parseExperiments(s string) ([]experiment, error) {
+	var out []experiment
+	for _, text := range strings.Split(s, ",") {
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		name, variants, ok := strings.Cut(text, "=")
+		if !ok || !validExperimentName(name) {
+			return nil, errors.Errorf("experiment %q: not of the form name=variant:weight;...", text)
+		}
+		e := experiment{name: name}
+		for _, field := range strings.Split(variants, ";") {
+			v, w, _ := strings.Cut(strings.TrimSpace(field), ":")
+			weight, err := strconv.Atoi(w)
+			if !validExperimentName(v) || err != nil || weight <= 0 {
+				return nil, errors.Errorf("experiment %q: invalid variant %q", text, field)
+			}
+			if e.has(v) {
+				return nil, errors.Errorf("experiment %q: duplicate variant %q", text, v)
+			}
+			e.variants = append(e.variants, experimentVariant{name: v, weight: weight})
+		}
+		if len(e.variants) < 2 {
+			return nil, errors.Errorf("experiment %q: needs at least two variants", text)
+		}
+		for _, o := range out {
+			if o.name == e.name {
+				return nil, errors.Errorf("experiment %q defined twice", e.name)
+			}
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// validExperimentName reports whether s may name an experiment or a variant.
+// The characters used to store assignments in a cookie are excluded.
+func validExperimentName(s string) bool {
+	if s == "" || len(s) > 32 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (e experiment) has(variant string) bool {
+	for _, v := range e.variants {
+		if v.name == variant {
+			return true
+		}
+	}
+	return false
+}
+
+// assign returns the variant of e for session. It depends on the experiment
+// name too, so that the same sessions are not always in the first variant.
+func (e experiment) assign(session string) string {
+	total := 0
+	for _, v := range e.variants {
+		total += v.weight
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.name))
+	h.Write([]byte{0})
+	h.Write([]byte(session))
+	n := int(h.Sum32() % uint32(total))
+	for _, v := range e.variants {
+		if n < v.weight {
+			return v.name
+		}
+		n -= v.weight
+	}
+	return e.variants[len(e.variants)-1].name
+}
+
+type ctxKeyExperiments struct{}
+
+// experimentAssignment holds the variants of the experiments for the session
+// of a request. Templates read them with Variant.
+type experimentAssignment struct {
+	variants map[string]string
+	log      logrus.FieldLogger
+	state    sessionValues
+
+	mu      sync.Mutex
+	exposed map[string]string // loaded from the session state on first use
+}
+
+// Variant returns the variant of the experiment called name, or "" when
+// there is no such experiment. The first time a session is shown a variant,
+// its exposure is logged and counted.
+func (a *experimentAssignment) Variant(name string) string {
+	if a == nil {
+		return ""
+	}
+	v, ok := a.variants[name]
+	if !ok {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.exposed == nil {
+		if a.state.get(experimentsExposedKey, &a.exposed); a.exposed == nil {
+			a.exposed = make(map[string]string)
+		}
+	}
+	if a.exposed[name] != v {
+		a.exposed[name] = v
+		a.state.set(experimentsExposedKey, a.exposed)
+		a.log.WithFields(logrus.Fields{
+			"event":              "exposure",
+			"experiment":         name,
+			"experiment.variant": v,
+		}).Info("experiment exposure")
+		experimentExposures.WithLabelValues(name, v).Inc()
+	}
+	return v
+}
+
+// experimentsFromContext returns the experiment variants of the request,
+// none if ensureExperiments did not assign any.
+func experimentsFromContext(ctx context.Context) *experimentAssignment {
+	a, _ := ctx.Value(ctxKeyExperiments{}).(*experimentAssignment)
+	return a
+}
+
+// experimentsKey is a stable description of the variants of r, for ETags.
+func experimentsKey(r *http.Request) string {
+	if a := experimentsFromContext(r.Context()); a != nil {
+		return encodeExperiments(a.variants)
+	}
+	return ""
+}
+
+// encodeExperiments writes variants as stored in the experiments cookie,
+// e.g. "checkout_button:green|home_layout:b".
+func encodeExperiments(variants map[string]string) string {
+	fields := make([]string, 0, len(variants))
+	for name, v := range variants {
+		fields = append(fields, name+":"+v)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, "|")
+}
+
+func decodeExperiments(s string) map[string]string {
+	out := make(map[string]string)
+	for _, field := range strings.Split(s, "|") {
+		if name, v, ok := strings.Cut(field, ":"); ok {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+// experimentsCookieKey is the name the experiments cookie is signed under.
+// It includes the session so that assignments do not outlive it.
+func experimentsCookieKey(r *http.Request) string {
+	return cookieExperiments + "/" + sessionID(r)
+}
+
+// ensureExperiments assigns the session of each request a variant of every
+// experiment and puts them in the request context. Variants are picked by
+// experiment.assign the first time and then kept in the experiments cookie,
+// so that a session keeps its variants even if the weights change. When
+// overrides are allowed, ?exp=home_layout:b forces a variant, for QA; it is
+// stored too. Crawlers are left out of experiments. It must run after
+// ensureSessionID and withSessionStore.
+func (fe *frontendServer) ensureExperiments(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(fe.experiments) == 0 || isBot(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log := loggerFromContext(r.Context())
+		var raw string
+		if c, err := r.Cookie(cookieExperiments); err == nil {
+			raw, _ = fe.cookieSigner.verify(experimentsCookieKey(r), c.Value)
+		}
+		stored := decodeExperiments(raw)
+		variants := make(map[string]string, len(fe.experiments))
+		for _, e := range fe.experiments {
+			if v := stored[e.name]; e.has(v) {
+				variants[e.name] = v
+			} else {
+				variants[e.name] = e.assign(sessionID(r))
+			}
+		}
+		if fe.experimentOverrides {
+			fe.overrideExperiments(log, variants, r.URL.Query()["exp"])
+		}
+		if value := encodeExperiments(variants); value != raw {
+			http.SetCookie(w, newCookie(cookieExperiments, fe.cookieSigner.sign(experimentsCookieKey(r), value)))
+		}
+
+		a := &experimentAssignment{variants: variants, log: log, state: sessionState(r)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyExperiments{}, a)))
+	}
+}
+
+// overrideExperiments applies the experiment:variant pairs of the exp query
+// parameters to variants. Pairs may also be separated by commas. Unknown
+// experiments and variants are ignored.
+func (fe *frontendServer) overrideExperiments(log logrus.FieldLogger, variants map[string]string, params []string) {
+	for _, param := range params {
+		for _, pair := range strings.Split(param, ",") {
+			name, v, _ := strings.Cut(strings.TrimSpace(pair), ":")
+			known := false
+			for _, e := range fe.experiments {
+				if e.name == name && e.has(v) {
+					known = true
+				}
+			}
+			if !known {
+				log.WithField("experiment.override", pair).Debug("ignoring unknown experiment override")
+				continue
+			}
+			variants[name] = v
+		}
+	}
+}
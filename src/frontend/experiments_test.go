@@ -0,0 +1,210 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestParseExperiments(t *testing.T) {
+	got, err := parseExperiments(" home_layout=a:50;b:50 , checkout_button=blue:9; green:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []experiment{
+		{name: "home_layout", variants: []experimentVariant{{"a", 50}, {"b", 50}}},
+		{name: "checkout_button", variants: []experimentVariant{{"blue", 9}, {"green", 1}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{
+		"home_layout",
+		"home_layout=a:50",
+		"home_layout=a:50;b",
+		"home_layout=a:50;b:0",
+		"home_layout=a:50;a:50",
+		"Home=a:1;b:1",
+		"home=a|b:1;c:1",
+		"home=a:1;b:1,home=a:1;c:1",
+	} {
+		if _, err := parseExperiments(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestExperimentAssign(t *testing.T) {
+	e := experiment{name: "checkout_button", variants: []experimentVariant{{"blue", 3}, {"green", 1}}}
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		v := e.assign(session)
+		if v != e.assign(session) {
+			t.Fatalf("%s: assigned differently twice", session)
+		}
+		counts[v]++
+	}
+	if counts["green"] < 2200 || counts["green"] > 2800 || counts["blue"]+counts["green"] != 10000 {
+		t.Errorf("counts = %v, want about a quarter green", counts)
+	}
+}
+
+// experimentsFrontend returns a frontend running home_layout, and a handler
+// reporting the variant that ensureExperiments assigned.
+func experimentsFrontend(experiments string) (*frontendServer, http.Handler) {
+	fe := &frontendServer{cookieSigner: newCookieSigner("secret")}
+	fe.experiments, _ = parseExperiments(experiments)
+	return fe, fe.ensureExperiments(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a := experimentsFromContext(r.Context()); a != nil {
+			fmt.Fprint(w, a.variants["home_layout"])
+		}
+	}))
+}
+
+func TestEnsureExperimentsIsSticky(t *testing.T) {
+	fe, h := experimentsFrontend("home_layout=a:1;b:1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest(http.MethodGet, "/", nil))
+	first := w.Body.String()
+	c := setCookie(t, w, cookieExperiments)
+
+	// A session keeps its variant when the weights change...
+	fe.experiments, _ = parseExperiments("home_layout=a:1;b:1000000")
+	if first == "a" {
+		fe.experiments, _ = parseExperiments("home_layout=a:1000000;b:1")
+	}
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r.AddCookie(c)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Body.String(); got != first || len(w.Result().Cookies()) != 0 {
+		t.Errorf("second visit: variant %q, want %q and no new cookie", got, first)
+	}
+
+	// ...but not when its variant is gone, or the cookie was not issued for
+	// its session.
+	fe.experiments, _ = parseExperiments("home_layout=c:1;d:1")
+	r = newTestRequest(http.MethodGet, "/", nil)
+	r.AddCookie(c)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Body.String(); got != "c" && got != "d" {
+		t.Errorf("removed variant: got %q", got)
+	}
+	fe.experiments, _ = parseExperiments("home_layout=a:1;b:1")
+	r = newTestRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, "other-session"))
+	r.AddCookie(&http.Cookie{Name: cookieExperiments, Value: "home_layout:x"})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if setCookie(t, w, cookieExperiments).Value == c.Value {
+		t.Error("another session reuses the cookie")
+	}
+}
+
+func TestExperimentOverrides(t *testing.T) {
+	fe, h := experimentsFrontend("home_layout=a:1000000;b:1")
+	for _, tc := range []struct {
+		allowed bool
+		query   string
+		want    string
+	}{
+		{false, "?exp=home_layout:b", "a"},
+		{true, "?exp=home_layout:b", "b"},
+		{true, "?exp=other:b,home_layout:b", "b"},
+		{true, "?exp=home_layout:z", "a"},
+	} {
+		fe.experimentOverrides = tc.allowed
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newTestRequest(http.MethodGet, "/"+tc.query, nil))
+		if got := w.Body.String(); got != tc.want {
+			t.Errorf("overrides allowed %v, %s: got %q, want %q", tc.allowed, tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestEnsureExperimentsSkipsBots(t *testing.T) {
+	_, h := experimentsFrontend("home_layout=a:1;b:1")
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyBot{}, true))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.String() != "" || len(w.Result().Cookies()) != 0 {
+		t.Errorf("crawler assigned %q", w.Body.String())
+	}
+}
+
+func TestExperimentExposureLoggedOnce(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.experiments, _ = parseExperiments("home_layout=a:1;b:1,unused=x:1;y:1")
+	fe.experimentOverrides = true
+	logger, hook := logtest.NewNullLogger()
+	store := newMemorySessionStore(time.Hour, 10)
+	h := withSessionStore(store, fe.ensureExperiments(http.HandlerFunc(fe.homeHandler)))
+
+	exposures := func(query string) []*logrus.Entry {
+		hook.Reset()
+		r := newTestRequest(http.MethodGet, "/"+query, nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(logger)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		var out []*logrus.Entry
+		for _, e := range hook.AllEntries() {
+			if e.Data["event"] == "exposure" {
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+	got := exposures("?exp=home_layout:b")
+	if len(got) != 1 || got[0].Data["experiment"] != "home_layout" || got[0].Data["experiment.variant"] != "b" {
+		t.Fatalf("first render: exposures %v, want home_layout=b only", got)
+	}
+	if got := exposures("?exp=home_layout:b"); len(got) != 0 {
+		t.Errorf("second render: %d exposures, want none", len(got))
+	}
+	if got := exposures("?exp=home_layout:a"); len(got) != 1 || got[0].Data["experiment.variant"] != "a" {
+		t.Errorf("after switching variant: exposures %v, want home_layout=a", got)
+	}
+}
+
+func TestHomeLayoutExperiment(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.experiments, _ = parseExperiments("home_layout=a:1;b:1")
+	fe.experimentOverrides = true
+	h := fe.ensureExperiments(http.HandlerFunc(fe.homeHandler))
+	for variant, want := range map[string]string{"a": "col-md-4 hot-product-card", "b": "col-md-3 hot-product-card"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newTestRequest(http.MethodGet, "/?exp=home_layout:"+variant, nil))
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("variant %s: status %d, page lacks %q", variant, w.Code, want)
+		}
+	}
+}
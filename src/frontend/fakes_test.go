@@ -0,0 +1,330 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/featureflags"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// fakeBackend implements every gRPC service the frontend depends on with
+// canned data. Individual methods can be slowed down or made to fail.
+type fakeBackend struct {
+	pb.UnimplementedProductCatalogServiceServer
+	pb.UnimplementedCurrencyServiceServer
+	pb.UnimplementedCartServiceServer
+	pb.UnimplementedRecommendationServiceServer
+	pb.UnimplementedShippingServiceServer
+	pb.UnimplementedCheckoutServiceServer
+	pb.UnimplementedAdServiceServer
+
+	mu                 sync.Mutex
+	products           []*pb.Product
+	currencies         []string
+	carts              map[string][]*pb.CartItem
+	recommendations    []string
+	recommendationsFor []string // product IDs of the last ListRecommendations call
+	ads                []*pb.Ad
+	adContextKeys      []string    // of the last GetAds call
+	quoteAddress       *pb.Address // of the last GetQuote call
+	latency            map[string]time.Duration
+	errs               map[string]error
+	calls              map[string]int
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		products: []*pb.Product{
+			{Id: "OLJCESPC7Z", Name: "Sunglasses", Picture: "/static/img/products/sunglasses.jpg",
+				PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}, Categories: []string{"accessories"}},
+			{Id: "66VCHSJNUP", Name: "Tank Top", Picture: "/static/img/products/tank-top.jpg",
+				PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 18, Nanos: 990000000}, Categories: []string{"clothing", "tops"}},
+			{Id: "1YMWWN1N4O", Name: "Watch", Picture: "/static/img/products/watch.jpg",
+				PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 109, Nanos: 990000000}, Categories: []string{"accessories"}},
+		},
+		currencies: []string{"EUR", "USD", "JPY", "GBP", "TRY", "CAD"},
+		carts:      make(map[string][]*pb.CartItem),
+		ads:        []*pb.Ad{{RedirectUrl: "/product/1YMWWN1N4O", Text: "Watch for sale"}},
+		latency:    make(map[string]time.Duration),
+		errs:       make(map[string]error),
+		calls:      make(map[string]int),
+	}
+}
+
+// setLatency delays every call to method by d.
+func (f *fakeBackend) setLatency(method string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency[method] = d
+}
+
+// setError makes every call to method fail with err.
+func (f *fakeBackend) setError(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[method] = err
+}
+
+func (f *fakeBackend) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func (f *fakeBackend) enter(ctx context.Context, method string) error {
+	f.mu.Lock()
+	f.calls[method]++
+	d, err := f.latency[method], f.errs[method]
+	f.mu.Unlock()
+	if d > 0 {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(d):
+		}
+	}
+	return err
+}
+
+func (f *fakeBackend) ListProducts(ctx context.Context, _ *pb.Empty) (*pb.ListProductsResponse, error) {
+	if err := f.enter(ctx, "ListProducts"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &pb.ListProductsResponse{Products: f.products}, nil
+}
+
+func (f *fakeBackend) GetProduct(ctx context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
+	if err := f.enter(ctx, "GetProduct"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.products {
+		if p.GetId() == req.GetId() {
+			return p, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "no product with ID %s", req.GetId())
+}
+
+// SearchProducts matches query case-insensitively against product names.
+func (f *fakeBackend) SearchProducts(ctx context.Context, req *pb.SearchProductsRequest) (*pb.SearchProductsResponse, error) {
+	if err := f.enter(ctx, "SearchProducts"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []*pb.Product
+	for _, p := range f.products {
+		if strings.Contains(strings.ToLower(p.GetName()), strings.ToLower(req.GetQuery())) {
+			out = append(out, p)
+		}
+	}
+	return &pb.SearchProductsResponse{Results: out}, nil
+}
+
+func (f *fakeBackend) GetSupportedCurrencies(ctx context.Context, _ *pb.Empty) (*pb.GetSupportedCurrenciesResponse, error) {
+	if err := f.enter(ctx, "GetSupportedCurrencies"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &pb.GetSupportedCurrenciesResponse{CurrencyCodes: f.currencies}, nil
+}
+
+// Convert returns the amount unchanged, relabeled with the target currency.
+func (f *fakeBackend) Convert(ctx context.Context, req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+	if err := f.enter(ctx, "Convert"); err != nil {
+		return nil, err
+	}
+	return &pb.Money{CurrencyCode: req.GetToCode(), Units: req.GetFrom().GetUnits(), Nanos: req.GetFrom().GetNanos()}, nil
+}
+
+func (f *fakeBackend) GetCart(ctx context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	if err := f.enter(ctx, "GetCart"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &pb.Cart{UserId: req.GetUserId(), Items: f.carts[req.GetUserId()]}, nil
+}
+
+func (f *fakeBackend) AddItem(ctx context.Context, req *pb.AddItemRequest) (*pb.Empty, error) {
+	if err := f.enter(ctx, "AddItem"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items := f.carts[req.GetUserId()]
+	for _, it := range items {
+		if it.GetProductId() == req.GetItem().GetProductId() {
+			it.Quantity += req.GetItem().GetQuantity()
+			return &pb.Empty{}, nil
+		}
+	}
+	f.carts[req.GetUserId()] = append(items, &pb.CartItem{
+		ProductId: req.GetItem().GetProductId(),
+		Quantity:  req.GetItem().GetQuantity(),
+	})
+	return &pb.Empty{}, nil
+}
+
+func (f *fakeBackend) EmptyCart(ctx context.Context, req *pb.EmptyCartRequest) (*pb.Empty, error) {
+	if err := f.enter(ctx, "EmptyCart"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.carts, req.GetUserId())
+	return &pb.Empty{}, nil
+}
+
+func (f *fakeBackend) ListRecommendations(ctx context.Context, req *pb.ListRecommendationsRequest) (*pb.ListRecommendationsResponse, error) {
+	if err := f.enter(ctx, "ListRecommendations"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recommendationsFor = req.GetProductIds()
+	return &pb.ListRecommendationsResponse{ProductIds: f.recommendations}, nil
+}
+
+func (f *fakeBackend) GetQuote(ctx context.Context, req *pb.GetQuoteRequest) (*pb.GetQuoteResponse, error) {
+	if err := f.enter(ctx, "GetQuote"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.quoteAddress = req.GetAddress()
+	return &pb.GetQuoteResponse{CostUsd: &pb.Money{CurrencyCode: "USD", Units: 8, Nanos: 990000000}}, nil
+}
+
+func (f *fakeBackend) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
+	if err := f.enter(ctx, "PlaceOrder"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	order := &pb.OrderResult{
+		OrderId:            "order-" + req.GetUserId(),
+		ShippingTrackingId: "tracking-" + req.GetUserId(),
+		ShippingCost:       &pb.Money{CurrencyCode: req.GetUserCurrency(), Units: 8, Nanos: 990000000},
+		ShippingAddress:    req.GetAddress(),
+	}
+	for _, it := range f.carts[req.GetUserId()] {
+		for _, p := range f.products {
+			if p.GetId() == it.GetProductId() {
+				cost := &pb.Money{CurrencyCode: req.GetUserCurrency(), Units: p.GetPriceUsd().GetUnits(), Nanos: p.GetPriceUsd().GetNanos()}
+				order.Items = append(order.Items, &pb.OrderItem{Item: it, Cost: cost})
+			}
+		}
+	}
+	delete(f.carts, req.GetUserId())
+	return &pb.PlaceOrderResponse{Order: order}, nil
+}
+
+func (f *fakeBackend) GetAds(ctx context.Context, req *pb.AdRequest) (*pb.AdResponse, error) {
+	if err := f.enter(ctx, "GetAds"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.adContextKeys = req.GetContextKeys()
+	return &pb.AdResponse{Ads: f.ads}, nil
+}
+
+// newTestFrontend serves fb on a local port and returns a frontendServer whose
+// backend connections all point at it.
+func newTestFrontend(t *testing.T, fb *fakeBackend, opts ...grpc.DialOption) *frontendServer {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterProductCatalogServiceServer(srv, fb)
+	pb.RegisterCurrencyServiceServer(srv, fb)
+	pb.RegisterCartServiceServer(srv, fb)
+	pb.RegisterRecommendationServiceServer(srv, fb)
+	pb.RegisterShippingServiceServer(srv, fb)
+	pb.RegisterCheckoutServiceServer(srv, fb)
+	pb.RegisterAdServiceServer(srv, fb)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	conn, err := grpc.NewClient(lis.Addr().String(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &frontendServer{
+		productCatalogSvcConn: conn,
+		currencySvcConn:       conn,
+		cartSvcConn:           conn,
+		recommendationSvcConn: conn,
+		checkoutSvcConn:       conn,
+		shippingSvcConn:       conn,
+		adSvcConn:             conn,
+		receipts:              newReceiptStore(defaultOrderHistorySize),
+		giftWrapFee:           usd(defaultGiftWrapFee),
+		orderTokens:           newOrderTokens(defaultOrderTokenCacheSize, orderTokenTTL),
+		adSlots:               defaultAdSlots,
+		servedAds:             newServedAds(),
+		flags:                 featureflags.NewStore(defaultFlags),
+		cookieSealer:          newCookieSealer(""),
+	}
+}
+
+// usd parses s as an amount in USD.
+func usd(s string) *pb.Money {
+	m := money.Must(money.Parse(s, "USD"))
+	return &m
+}
+
+var discardLog = &logrus.Logger{Out: io.Discard, Formatter: new(logrus.TextFormatter), Level: logrus.DebugLevel, Hooks: make(logrus.LevelHooks)}
+
+// newTestRequest builds a request carrying the context values that the
+// middleware chain would normally provide.
+func newTestRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	ctx := context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(discardLog))
+	ctx = context.WithValue(ctx, ctxKeySessionID{}, "test-session")
+	ctx, _ = featureflags.NewContext(ctx, featureflags.NewStore(defaultFlags), "test-session")
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,301 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package featureflags turns features on and off at run time, for everyone
+// or for a percentage of users. Flags are read from a JSON or YAML file such
+// as
+//
+//	{"ads": true, "assistant": {"enabled": true, "rollout": 25}}
+//
+// where assistant is on for a quarter of the users. Users are told apart by a
+// subject, such as their session ID, which is hashed so that each keeps the
+// same experience for as long as the rollout stays the same.
+package featureflags
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Flag is the state of a feature.
+type Flag struct {
+	Enabled bool `json:"enabled"`
+	// Rollout, when set, restricts an enabled flag to this percentage of
+	// subjects, from 0 to 100.
+	Rollout *float64 `json:"rollout,omitempty"`
+}
+
+// UnmarshalJSON accepts a bare boolean for a flag without rollout.
+func (f *Flag) UnmarshalJSON(b []byte) error {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] != '{' {
+		return json.Unmarshal(b, &f.Enabled)
+	}
+	type plain Flag
+	var p plain
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return err
+	}
+	if p.Rollout != nil && (*p.Rollout < 0 || *p.Rollout > 100) {
+		return errors.Errorf("rollout %v is not a percentage", *p.Rollout)
+	}
+	*f = Flag(p)
+	return nil
+}
+
+// EnabledFor reports whether the flag called name is on for subject.
+func (f Flag) EnabledFor(name, subject string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if f.Rollout == nil {
+		return true
+	}
+	return float64(bucket(name, subject)) < *f.Rollout*100
+}
+
+// bucket places subject in one of 10000 buckets, independently for each
+// flag so that the same users are not always the first to get features.
+func bucket(name, subject string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(subject))
+	return h.Sum32() % 10000
+}
+
+// Set is a set of flags by name.
+type Set map[string]Flag
+
+// Names returns the names of the flags in s, sorted.
+func (s Set) Names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse reads flags in JSON, or in YAML if name ends in .yaml or .yml.
+func Parse(name string, b []byte) (Set, error) {
+	if ext := strings.ToLower(filepath.Ext(name)); ext == ".yaml" || ext == ".yml" {
+		var v map[string]interface{}
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, errors.Wrapf(err, "invalid feature flags in %s", name)
+		}
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			return nil, errors.Wrapf(err, "invalid feature flags in %s", name)
+		}
+	}
+	var s Set
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrapf(err, "invalid feature flags in %s", name)
+	}
+	return s, nil
+}
+
+// Store holds the current flags: defaults, overridden by those of a file.
+type Store struct {
+	defaults Set
+	cur      atomic.Pointer[Set]
+
+	mu       sync.Mutex
+	path     string
+	modTime  time.Time
+	loadedAt time.Time
+}
+
+// NewStore returns a store with the defaults flags, until a file is loaded.
+func NewStore(defaults Set) *Store {
+	s := &Store{defaults: defaults}
+	flags := s.merge(nil)
+	s.cur.Store(&flags)
+	return s
+}
+
+func (s *Store) merge(file Set) Set {
+	out := make(Set, len(s.defaults)+len(file))
+	for name, f := range s.defaults {
+		out[name] = f
+	}
+	for name, f := range file {
+		out[name] = f
+	}
+	return out
+}
+
+// Flags returns the current flags. The set must not be modified.
+func (s *Store) Flags() Set {
+	return *s.cur.Load()
+}
+
+// Source returns the file the flags were loaded from, if any, and when.
+func (s *Store) Source() (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.path, s.loadedAt
+}
+
+// Load replaces the flags with the defaults overridden by those in the file
+// at path. On error the flags are left as they were.
+func (s *Store) Load(path string) error {
+	f, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s.Apply(f)
+	return nil
+}
+
+// File is a flags file read by ReadFile, to be applied by Store.Apply.
+type File struct {
+	path    string
+	modTime time.Time
+	flags   Set
+}
+
+// ReadFile reads and checks the flags in the file at path, without applying
+// them, so that they can be applied along with other settings or not at all.
+func ReadFile(path string) (*File, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read feature flags")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read feature flags")
+	}
+	flags, err := Parse(path, b)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, modTime: fi.ModTime(), flags: flags}, nil
+}
+
+// Apply replaces the flags with the defaults overridden by those of f.
+func (s *Store) Apply(f *File) {
+	flags := s.merge(f.flags)
+	s.mu.Lock()
+	s.path, s.modTime, s.loadedAt = f.path, f.modTime, time.Now()
+	s.cur.Store(&flags)
+	s.mu.Unlock()
+}
+
+// Watch loads the file at path again whenever its modification time changes,
+// checking every interval until ctx is done. Failed loads are passed to
+// onError and keep the previous flags. Each failure is reported once: a
+// broken or missing file is only tried again once it changes.
+func (s *Store) Watch(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var (
+		failed  time.Time // modification time of the last file that failed
+		missing bool
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			if !missing {
+				onError(errors.Wrap(err, "failed to read feature flags"))
+			}
+			missing = true
+			continue
+		}
+		missing = false
+		s.mu.Lock()
+		changed := !fi.ModTime().Equal(s.modTime)
+		s.mu.Unlock()
+		if changed && !fi.ModTime().Equal(failed) {
+			if err := s.Load(path); err != nil {
+				failed = fi.ModTime()
+				onError(err)
+			}
+		}
+	}
+}
+
+// Evaluation records the flags consulted while serving a request, always
+// with the same flags and subject so that they agree with each other.
+type Evaluation struct {
+	flags   Set
+	subject string
+
+	mu      sync.Mutex
+	results map[string]bool
+}
+
+type ctxKey struct{}
+
+// NewContext returns ctx with an evaluation of the current flags of s for
+// subject, which Enabled consults.
+func NewContext(ctx context.Context, s *Store, subject string) (context.Context, *Evaluation) {
+	e := &Evaluation{flags: s.Flags(), subject: subject, results: make(map[string]bool)}
+	return context.WithValue(ctx, ctxKey{}, e), e
+}
+
+// FromContext returns the evaluation of ctx, or nil.
+func FromContext(ctx context.Context) *Evaluation {
+	e, _ := ctx.Value(ctxKey{}).(*Evaluation)
+	return e
+}
+
+// Enabled reports whether the flag called name is on for the evaluation of
+// ctx. Flags are off outside of an evaluation, and when unknown.
+func Enabled(ctx context.Context, name string) bool {
+	e := FromContext(ctx)
+	if e == nil {
+		return false
+	}
+	return e.Enabled(name)
+}
+
+// Enabled reports whether the flag called name is on, and records it.
+func (e *Evaluation) Enabled(name string) bool {
+	on := e.flags[name].EnabledFor(name, e.subject)
+	e.mu.Lock()
+	e.results[name] = on
+	e.mu.Unlock()
+	return on
+}
+
+// Results returns the flags consulted so far and their values.
+func (e *Evaluation) Results() map[string]bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make(map[string]bool, len(e.results))
+	for name, on := range e.results {
+		out[name] = on
+	}
+	return out
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package featureflags
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func rollout(p float64) *float64 { return &p }
+
+func TestParse(t *testing.T) {
+	want := Set{
+		"ads":       {Enabled: true},
+		"assistant": {Enabled: true, Rollout: rollout(25)},
+		"banner":    {Enabled: false},
+	}
+	for name, src := range map[string]string{
+		"flags.json": `{"ads": true, "assistant": {"enabled": true, "rollout": 25}, "banner": {"enabled": false}}`,
+		"flags.yaml": "ads: true\nassistant:\n  enabled: true\n  rollout: 25\nbanner:\n  enabled: false\n",
+	} {
+		got, err := Parse(name, []byte(src))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+
+	for _, src := range []string{
+		`{"ads": "yes"}`,
+		`{"ads": {"enabled": true, "rollout": 150}}`,
+		`{"ads": {"enabled": true, "rolout": 50}}`,
+		`["ads"]`,
+	} {
+		if _, err := Parse("flags.json", []byte(src)); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+}
+
+func TestRollout(t *testing.T) {
+	f := Flag{Enabled: true, Rollout: rollout(25)}
+	on := 0
+	for i := 0; i < 10000; i++ {
+		subject := fmt.Sprintf("session-%d", i)
+		got := f.EnabledFor("assistant", subject)
+		if got != f.EnabledFor("assistant", subject) {
+			t.Fatalf("%s: value changed between evaluations", subject)
+		}
+		if got {
+			on++
+		}
+	}
+	if on < 2300 || on > 2700 {
+		t.Errorf("on for %d of 10000 subjects, want about 2500", on)
+	}
+
+	// Widening the rollout keeps those who already had the feature.
+	wider := Flag{Enabled: true, Rollout: rollout(50)}
+	for i := 0; i < 1000; i++ {
+		subject := fmt.Sprintf("session-%d", i)
+		if f.EnabledFor("assistant", subject) && !wider.EnabledFor("assistant", subject) {
+			t.Fatalf("%s lost the feature when the rollout grew", subject)
+		}
+	}
+
+	if (Flag{Rollout: rollout(100)}).EnabledFor("assistant", "session-1") {
+		t.Error("disabled flag is on")
+	}
+	if (Flag{Enabled: true, Rollout: rollout(0)}).EnabledFor("assistant", "session-1") {
+		t.Error("flag is on at 0%")
+	}
+}
+
+func TestStoreLoad(t *testing.T) {
+	s := NewStore(Set{"ads": {Enabled: true}, "assistant": {Enabled: true}})
+	path := filepath.Join(t.TempDir(), "flags.json")
+	if err := s.Load(path); err == nil {
+		t.Error("loaded a missing file")
+	}
+	if err := os.WriteFile(path, []byte(`{"assistant": false, "new": true}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	want := Set{"ads": {Enabled: true}, "assistant": {Enabled: false}, "new": {Enabled: true}}
+	if got := s.Flags(); !reflect.DeepEqual(got, want) {
+		t.Errorf("flags = %+v, want %+v", got, want)
+	}
+	if src, at := s.Source(); src != path || at.IsZero() {
+		t.Errorf("source = %q at %v", src, at)
+	}
+
+	if err := os.WriteFile(path, []byte(`{`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(path); err == nil {
+		t.Error("loaded invalid flags")
+	}
+	if got := s.Flags(); !reflect.DeepEqual(got, want) {
+		t.Errorf("flags changed by a failed load: %+v", got)
+	}
+}
+
+func TestStoreWatch(t *testing.T) {
+	s := NewStore(nil)
+	path := filepath.Join(t.TempDir(), "flags.yaml")
+	if err := os.WriteFile(path, []byte("ads: false\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 10)
+	go s.Watch(ctx, path, 10*time.Millisecond, func(err error) { errs <- err })
+
+	if err := os.WriteFile(path, []byte("ads: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time differs on coarse file systems.
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Flags()["ads"].Enabled {
+		if time.Now().After(deadline) {
+			t.Fatal("change not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestStoreWatchReportsFailuresOnce(t *testing.T) {
+	s := NewStore(nil)
+	path := filepath.Join(t.TempDir(), "flags.json")
+	if err := os.WriteFile(path, []byte(`{"ads": false}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 100)
+	go s.Watch(ctx, path, 5*time.Millisecond, func(err error) { errs <- err })
+
+	write := func(content string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{`, time.Now().Add(time.Second))
+	if err := <-errs; err == nil {
+		t.Fatal("no error for a broken file")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(errs); n != 0 {
+		t.Errorf("broken file reported %d more times", n)
+	}
+
+	write(`{"ads": true}`, time.Now().Add(2*time.Second))
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Flags()["ads"].Enabled {
+		if time.Now().After(deadline) {
+			t.Fatal("fixed file not picked up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := len(errs); n != 0 {
+		t.Errorf("%d errors after the file was fixed", n)
+	}
+}
+
+func TestEvaluation(t *testing.T) {
+	if Enabled(context.Background(), "ads") {
+		t.Error("flag on outside of an evaluation")
+	}
+	s := NewStore(Set{"ads": {Enabled: true}, "assistant": {Enabled: false}})
+	ctx, e := NewContext(context.Background(), s, "session-1")
+	if !Enabled(ctx, "ads") || Enabled(ctx, "assistant") || Enabled(ctx, "unknown") {
+		t.Error("wrong flag values")
+	}
+	want := map[string]bool{"ads": true, "assistant": false, "unknown": false}
+	if got := e.Results(); !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %v, want %v", got, want)
+	}
+}
+
+func TestReadFileThenApply(t *testing.T) {
+	s := NewStore(Set{"ads": {Enabled: true}})
+	path := filepath.Join(t.TempDir(), "flags.json")
+	if err := os.WriteFile(path, []byte(`{"ads": false}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Flags()["ads"].Enabled {
+		t.Error("flags changed before Apply")
+	}
+	s.Apply(f)
+	if s.Flags()["ads"].Enabled {
+		t.Error("flags not applied")
+	}
+	if src, _ := s.Source(); src != path {
+		t.Errorf("source = %q", src)
+	}
+}
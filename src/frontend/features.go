@@ -0,0 +1,100 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Optional features, each backed by a service that deployments may not run.
+const (
+	featureAds       = "ads"       // AD_SERVICE_ADDR
+	featureAssistant = "assistant" // SHOPPING_ASSISTANT_SERVICE_ADDR
+)
+
+// featureSet is the set of enabled optional features.
+type featureSet map[string]bool
+
+func (s featureSet) String() string {
+	var names []string
+	for name, on := range s {
+		if on {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// featuresFromEnv decides which optional features are enabled. FEATURES, a
+// comma-separated list such as "ads,assistant", enables exactly those listed,
+// and each must have its service address set. Without FEATURES, ads are
+// enabled when AD_SERVICE_ADDR is set, and the assistant when
+// SHOPPING_ASSISTANT_SERVICE_ADDR is set and ENABLE_ASSISTANT=true.
+func featuresFromEnv(l *envLoader, c *config) featureSet {
+	addrs := map[string]string{
+		featureAds:       c.adSvcAddr,
+		featureAssistant: c.shoppingAssistantSvcAddr,
+	}
+	v := l.str("FEATURES", "")
+	if v == "" {
+		return featureSet{
+			featureAds:       c.adSvcAddr != "",
+			featureAssistant: c.shoppingAssistantSvcAddr != "" && strings.ToLower(l.str("ENABLE_ASSISTANT", "")) == "true",
+		}
+	}
+	s := make(featureSet)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		addr, ok := addrs[name]
+		switch {
+		case !ok:
+			l.problem("FEATURES: unknown feature %q", name)
+		case addr == "":
+			l.problem("FEATURES: %s is enabled but its service address is not set", name)
+		default:
+			s[name] = true
+		}
+	}
+	return s
+}
+
+// adsEnabled reports whether the ad service is in use. Without it pages
+// render without ad slots.
+func (fe *frontendServer) adsEnabled() bool {
+	return fe.adSvcConn != nil
+}
+
+// assistantEnabled reports whether the shopping assistant is in use.
+func (fe *frontendServer) assistantEnabled() bool {
+	return fe.shoppingAssistantSvcAddr != ""
+}
+
+// requireFeature answers 404 with a "feature disabled" page unless enabled
+// reports true.
+func requireFeature(name string, enabled func() bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !enabled() {
+			renderErrorPage(loggerFromContext(r.Context()), r, w, "The "+name+" feature is disabled.", http.StatusNotFound)
+			return
+		}
+		next(w, r)
+	}
+}
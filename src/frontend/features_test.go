@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFeaturesFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		env            map[string]string
+		ads, assistant bool
+		problems       int
+	}{
+		{name: "addresses unset", env: map[string]string{"AD_SERVICE_ADDR": "", "SHOPPING_ASSISTANT_SERVICE_ADDR": ""}},
+		{name: "addresses set", ads: true},
+		{name: "legacy assistant flag", env: map[string]string{"ENABLE_ASSISTANT": "True"}, ads: true, assistant: true},
+		{name: "explicit list", env: map[string]string{"FEATURES": " assistant "}, assistant: true},
+		{name: "unknown feature", env: map[string]string{"FEATURES": "ads,coupons"}, ads: true, problems: 1},
+		{name: "missing address", env: map[string]string{"FEATURES": "ads", "AD_SERVICE_ADDR": ""}, problems: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, k := range backendAddrEnv {
+				t.Setenv(k, "localhost:1")
+			}
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadConfig()
+			problems, _ := err.(configError)
+			if len(problems) != tc.problems {
+				t.Fatalf("problems = %q, want %d", problems, tc.problems)
+			}
+			if cfg.features[featureAds] != tc.ads || cfg.features[featureAssistant] != tc.assistant {
+				t.Errorf("features = %q, want ads %v, assistant %v", cfg.features, tc.ads, tc.assistant)
+			}
+		})
+	}
+}
+
+func TestRequireFeature(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	h := requireFeature(featureAssistant, fe.assistantEnabled, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	w := httptest.NewRecorder()
+	h(w, newTestRequest(http.MethodPost, "/bot", nil))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "assistant feature is disabled") {
+		t.Errorf("disabled: status %d: %.200s", w.Code, w.Body)
+	}
+
+	fe.shoppingAssistantSvcAddr = "localhost:1"
+	w = httptest.NewRecorder()
+	h(w, newTestRequest(http.MethodPost, "/bot", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("enabled: status %d", w.Code)
+	}
+}
+
+func TestPagesWithoutAds(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.adSvcConn = nil
+
+	if ads := fe.chooseAds(context.Background(), nil, discardLog); ads != nil {
+		t.Errorf("chooseAds = %v with ads disabled", ads)
+	}
+	if _, ok := fe.backendConns()["ad"]; ok {
+		t.Error("disabled ad service reported as a backend")
+	}
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `class="ad"`) {
+		t.Errorf("cart page: status %d, has ad slot: %v", w.Code, strings.Contains(w.Body.String(), `class="ad"`))
+	}
+}
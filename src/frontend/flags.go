@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/featureflags"
+)
+
+const defaultFeatureFlagsPollInterval = 5 * time.Second
+
+// defaultFlags apply until FEATURE_FLAGS_FILE says otherwise. The ads and
+// assistant flags narrow down those optional features, see featuresFromEnv:
+// they only matter where the feature is enabled.
+var defaultFlags = featureflags.Set{
+	featureAds:       {Enabled: true},
+	featureAssistant: {Enabled: true},
+}
+
+var featureFlagEvaluations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feature_flag_evaluations_total",
+	Help: "Number of requests that consulted feature flags, by flag and value.",
+}, []string{"flag", "value"})
+
+// withFeatureFlags evaluates the flags of store for the session of each
+// request, so that all of its handlers agree. The flags consulted are
+// labeled on the request's span and counted.
+func withFeatureFlags(store *featureflags.Store, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, e := featureflags.NewContext(r.Context(), store, sessionID(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+		for name, on := range e.Results() {
+			value := strconv.FormatBool(on)
+			labelSpan(ctx, "flag_"+name, value)
+			featureFlagEvaluations.WithLabelValues(name, value).Inc()
+		}
+	}
+}
+
+// requireFlag answers 404 with a "feature disabled" page unless the flag
+// called name is on for the request.
+func requireFlag(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !featureflags.Enabled(r.Context(), name) {
+			renderErrorPage(loggerFromContext(r.Context()), r, w, "The "+name+" feature is disabled.", http.StatusNotFound)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type debugFlags struct {
+	Source   string           `json:"source,omitempty"`
+	LoadedAt *time.Time       `json:"loaded_at,omitempty"`
+	Flags    featureflags.Set `json:"flags"`
+	Session  map[string]bool  `json:"session,omitempty"`
+}
+
+// debugFlagsHandler lists the current flags on the admin port. With
+// ?session=, it also tells which are on for that session.
+func (fe *frontendServer) debugFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	src, at := fe.flags.Source()
+	out := debugFlags{Source: src, Flags: fe.flags.Flags()}
+	if !at.IsZero() {
+		out.LoadedAt = &at
+	}
+	if session := r.URL.Query().Get("session"); session != "" {
+		out.Session = make(map[string]bool)
+		for name, f := range out.Flags {
+			out.Session[name] = f.EnabledFor(name, session)
+		}
+	}
+	writeJSON(loggerFromContext(r.Context()), w, http.StatusOK, out)
+}
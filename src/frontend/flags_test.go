@@ -0,0 +1,97 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/featureflags"
+)
+
+// flagStore returns a store with the defaults overridden by src, in JSON.
+func flagStore(t *testing.T, src string) *featureflags.Store {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "flags.json")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := featureflags.NewStore(defaultFlags)
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAdsFlag(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	off := testutil.ToFloat64(featureFlagEvaluations.WithLabelValues(featureAds, "false"))
+
+	w := httptest.NewRecorder()
+	withFeatureFlags(flagStore(t, `{"ads": false}`), http.HandlerFunc(fe.viewCartHandler)).ServeHTTP(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `class="ad"`) {
+		t.Errorf("status %d, has ad slot: %v", w.Code, strings.Contains(w.Body.String(), `class="ad"`))
+	}
+	if got := testutil.ToFloat64(featureFlagEvaluations.WithLabelValues(featureAds, "false")); got != off+1 {
+		t.Errorf("ads=false evaluations went from %v to %v, want one more", off, got)
+	}
+}
+
+func TestRequireFlag(t *testing.T) {
+	h := requireFlag(featureAssistant, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for src, want := range map[string]int{
+		`{"assistant": false}`:                             http.StatusNotFound,
+		`{"assistant": {"enabled": true, "rollout": 0}}`:   http.StatusNotFound,
+		`{"assistant": {"enabled": true, "rollout": 100}}`: http.StatusTeapot,
+		`{}`: http.StatusTeapot,
+	} {
+		w := httptest.NewRecorder()
+		withFeatureFlags(flagStore(t, src), h).ServeHTTP(w, newTestRequest(http.MethodGet, "/assistant", nil))
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", src, w.Code, want)
+		}
+	}
+}
+
+func TestDebugFlagsHandler(t *testing.T) {
+	fe := &frontendServer{flags: flagStore(t, `{"assistant": {"enabled": true, "rollout": 100}, "new": false}`)}
+	w := httptest.NewRecorder()
+	fe.adminHandler(discardLog, "").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/flags?session=s1", nil))
+	var got struct {
+		Source   string                       `json:"source"`
+		LoadedAt string                       `json:"loaded_at"`
+		Flags    map[string]featureflags.Flag `json:"flags"`
+		Session  map[string]bool              `json:"session"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || !strings.HasSuffix(got.Source, "flags.json") || got.LoadedAt == "" || len(got.Flags) != 3 {
+		t.Errorf("status %d, got %+v", w.Code, got)
+	}
+	if want := map[string]bool{featureAds: true, featureAssistant: true, "new": false}; !reflect.DeepEqual(got.Session, want) {
+		t.Errorf("session flags = %v, want %v", got.Session, want)
+	}
+}
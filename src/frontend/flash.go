@@ -0,0 +1,154 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// The kinds of flash messages, which the page styles differently. Errors are
+// announced to screen readers at once; the others when the reader is idle.
+const (
+	flashSuccess = "success"
+	flashInfo    = "info"
+	flashError   = "error"
+)
+
+const (
+	// maxFlashes bounds the messages waiting for a page; older ones are
+	// dropped first.
+	maxFlashes = 3
+	// flashMaxAge is how long, in seconds, a message waits for the page: it
+	// is meant for the one the browser is redirected to.
+	flashMaxAge = 60
+)
+
+// flashMessage is a one-shot message shown at the top of the next page, such
+// as the confirmation of a form that redirects.
+type flashMessage struct {
+	Kind string `json:"kind"`
+	Text string `json:"text"`
+}
+
+type ctxKeyFlashes struct{}
+
+// flash queues the message of key, in the language of the page, for the next
+// page r's client loads, with args as in translate.
+func (fe *frontendServer) flash(w http.ResponseWriter, r *http.Request, kind, key string, args ...interface{}) {
+	text, err := translate(pageLanguage(r), key, args...)
+	if err != nil {
+		loggerFromContext(r.Context()).WithField("error", err).Warn("failed to render flash message")
+		return
+	}
+	msgs := append(fe.queuedFlashes(r), flashMessage{Kind: kind, Text: text})
+	if len(msgs) > maxFlashes {
+		msgs = msgs[len(msgs)-maxFlashes:]
+	}
+	b, _ := json.Marshal(msgs)
+	c := newCookie(cookieFlash, fe.cookieSigner.sign(flashKey(r), base64.RawURLEncoding.EncodeToString(b)))
+	c.MaxAge = flashMaxAge
+	http.SetCookie(w, c)
+}
+
+// queuedFlashes returns the messages of r's flash cookie. Cookies that do not
+// verify, or were queued for another session, give none.
+func (fe *frontendServer) queuedFlashes(r *http.Request) []flashMessage {
+	c, err := r.Cookie(cookieFlash)
+	if err != nil {
+		return nil
+	}
+	v, ok := fe.cookieSigner.verify(flashKey(r), c.Value)
+	if !ok {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil
+	}
+	var msgs []flashMessage
+	if json.Unmarshal(b, &msgs) != nil || len(msgs) > maxFlashes {
+		return nil
+	}
+	return msgs
+}
+
+// flashKey is the name flash cookies are signed under, which includes the
+// session so that messages cannot be replayed to another.
+func flashKey(r *http.Request) string {
+	return cookieFlash + "/" + sessionID(r)
+}
+
+// withFlashes hands the queued flash messages to the next page the client
+// navigates to, which shows them through the "flashes" template data, and
+// deletes them. Requests of the shop's scripts and for assets do not take
+// them. The page is neither cached nor answered with 304 Not Modified, so
+// that the messages are shown once and only once.
+func (fe *frontendServer) withFlashes(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie(cookieFlash); err != nil || r.Method != http.MethodGet ||
+			!accepts(r, "text/html") || isXHR(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.SetCookie(w, expiredCookie(cookieFlash))
+		msgs := fe.queuedFlashes(r)
+		if len(msgs) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyFlashes{}, msgs))
+		r.Header.Del("If-None-Match")
+		r.Header.Del("If-Modified-Since")
+		next.ServeHTTP(&noStoreWriter{ResponseWriter: w}, r)
+	}
+}
+
+// pageFlashes returns the flash messages withFlashes took for r's page.
+func pageFlashes(r *http.Request) []flashMessage {
+	msgs, _ := r.Context().Value(ctxKeyFlashes{}).([]flashMessage)
+	return msgs
+}
+
+// noStoreWriter keeps browsers from caching a response, whatever its handler
+// says.
+type noStoreWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *noStoreWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		h.Set("Cache-Control", "no-store")
+		h.Del("ETag")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *noStoreWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *noStoreWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
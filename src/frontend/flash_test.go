@@ -0,0 +1,185 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// flashClient plays a browser that keeps the cookies it is sent, across
+// requests of the test session.
+type flashClient struct {
+	t       *testing.T
+	fe      *frontendServer
+	store   sessionStore
+	cookies map[string]string
+}
+
+func newFlashClient(t *testing.T, fe *frontendServer) *flashClient {
+	return &flashClient{t: t, fe: fe, store: newMemorySessionStore(time.Hour, 10), cookies: make(map[string]string)}
+}
+
+// do sends r to h through withFlashes, as a page navigation unless r says
+// otherwise, and keeps the cookies of the response.
+func (c *flashClient) do(h http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	c.t.Helper()
+	if r.Header.Get("Accept") == "" {
+		r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	}
+	for name, value := range c.cookies {
+		r.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	w := httptest.NewRecorder()
+	c.fe.withFlashes(h).ServeHTTP(w, withSessionState(r, c.store))
+	for _, ck := range w.Result().Cookies() {
+		if ck.MaxAge < 0 {
+			delete(c.cookies, ck.Name)
+		} else {
+			c.cookies[ck.Name] = ck.Value
+		}
+	}
+	return w
+}
+
+func (c *flashClient) viewCart() string {
+	c.t.Helper()
+	w := c.do(c.fe.viewCartHandler, newTestRequest(http.MethodGet, "/cart", nil))
+	if w.Code != http.StatusOK {
+		c.t.Fatalf("GET /cart: status %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func postForm(target string, form url.Values) *http.Request {
+	return newTestRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+}
+
+func TestFlashSurvivesOneRedirect(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	c := newFlashClient(t, fe)
+
+	w := c.do(fe.addToCartHandler, postForm("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}}))
+	if w.Code != http.StatusFound {
+		t.Fatalf("POST /cart: status %d", w.Code)
+	}
+	if _, ok := c.cookies[cookieFlash]; !ok {
+		t.Fatal("POST /cart did not queue a flash message")
+	}
+
+	// Requests of scripts and for assets leave the message alone.
+	xhr := newTestRequest(http.MethodGet, "/cart", nil)
+	xhr.Header.Set("X-Requested-With", "XMLHttpRequest")
+	c.do(fe.viewCartHandler, xhr)
+	asset := newTestRequest(http.MethodGet, "/static/styles/styles.css", nil)
+	asset.Header.Set("Accept", "text/css,*/*;q=0.1")
+	c.do(func(w http.ResponseWriter, r *http.Request) {}, asset)
+	if _, ok := c.cookies[cookieFlash]; !ok {
+		t.Fatal("flash message taken by a script or asset request")
+	}
+
+	req := newTestRequest(http.MethodGet, "/cart", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	w = c.do(fe.viewCartHandler, req)
+	body := w.Body.String()
+	if !strings.Contains(body, `aria-live="polite"`) || !strings.Contains(body, "Added 2 × Sunglasses to your cart.") {
+		t.Errorf("page after the redirect lacks the flash message:\n%s", body)
+	}
+	if !strings.Contains(body, `class="flash-message flash-success" role="status"`) {
+		t.Error("flash message is not a status")
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("page with a flash message has Cache-Control %q", cc)
+	}
+	if _, ok := c.cookies[cookieFlash]; ok {
+		t.Error("flash cookie kept after the page showed it")
+	}
+
+	if body := c.viewCart(); strings.Contains(body, "Added 2 × Sunglasses") {
+		t.Error("flash message shown twice")
+	}
+}
+
+func TestFlashFlows(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+	fe.promos, _ = parsePromoCodes("code=SAVE10;percent=10")
+	c := newFlashClient(t, fe)
+
+	for _, tc := range []struct {
+		name string
+		h    http.HandlerFunc
+		r    *http.Request
+		want string
+	}{
+		{"promo", fe.promoHandler, postForm("/cart/promo", url.Values{"promo_code": {"save10"}}), "Promo code SAVE10 applied."},
+		{"promo removed", fe.promoHandler, postForm("/cart/promo", url.Values{"remove": {"1"}}), "Promo code removed."},
+		{"currency", fe.setCurrencyHandler, postForm("/setCurrency", url.Values{"currency_code": {"EUR"}, "redirect_to": {"/cart"}}), "Prices are now shown in EUR."},
+		{"empty cart", fe.emptyCartHandler, postForm("/cart/empty", nil), "Your cart is now empty."},
+	} {
+		if w := c.do(tc.h, tc.r); w.Code != http.StatusFound && w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: status %d", tc.name, w.Code)
+		}
+		if body := c.viewCart(); !strings.Contains(body, tc.want) {
+			t.Errorf("%s: cart page lacks %q", tc.name, tc.want)
+		}
+	}
+
+	// Choosing the currency already shown says nothing.
+	c.do(fe.setCurrencyHandler, postForm("/setCurrency", url.Values{"currency_code": {"EUR"}}))
+	if _, ok := c.cookies[cookieFlash]; ok {
+		t.Error("setting the same currency queued a flash message")
+	}
+}
+
+func TestFlashCookieIsSigned(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.cookieSigner = newCookieSigner("secret")
+	w := httptest.NewRecorder()
+	fe.emptyCartHandler(w, newTestRequest(http.MethodPost, "/cart/empty", nil))
+	var value string
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == cookieFlash {
+			value = ck.Value
+		}
+	}
+	if value == "" {
+		t.Fatal("no flash cookie")
+	}
+
+	for name, tc := range map[string]struct {
+		session, value string
+		want           bool
+	}{
+		"valid":           {"test-session", value, true},
+		"tampered":        {"test-session", "x" + value, false},
+		"another session": {"other-session", value, false},
+	} {
+		r := newTestRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, tc.session))
+		r.AddCookie(&http.Cookie{Name: cookieFlash, Value: tc.value})
+		if got := len(fe.queuedFlashes(r)) == 1; got != tc.want {
+			t.Errorf("%s: message accepted %v, want %v", name, got, tc.want)
+		}
+	}
+}
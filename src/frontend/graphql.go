@@ -0,0 +1,1022 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file holds the GraphQL subset served at /graphql: queries and
+// mutations with aliases, arguments and variables, but no fragments,
+// directives, subscriptions or introspection beyond __typename. The shop's
+// schema and resolvers are in graphql_schema.go.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// gqlMaxDepth is the deepest selection a query may make.
+	gqlMaxDepth = 6
+	// gqlMaxComplexity caps the cost of a query: 1 per field, the fields
+	// below a list counting gqlListFactor times.
+	gqlMaxComplexity = 1000
+	gqlListFactor    = 10
+	// gqlMaxNesting bounds the nesting of selections and values the parser
+	// accepts, before the depth limit applies, so that it cannot be made to
+	// recurse without end.
+	gqlMaxNesting = 32
+)
+
+// gqlError is an error of the GraphQL response.
+type gqlError struct {
+	Message    string                 `json:"message"`
+	Locations  []gqlLocation          `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (e *gqlError) Error() string { return e.Message }
+
+func gqlErrorf(loc gqlLocation, format string, args ...interface{}) *gqlError {
+	return &gqlError{Message: fmt.Sprintf(format, args...), Locations: []gqlLocation{loc}}
+}
+
+// Lexer
+
+type gqlToken struct {
+	kind byte // 'n'ame, 's'tring, 'i'nt, 'f'loat, 'p'unctuator or 'e'nd
+	val  string
+	loc  gqlLocation
+}
+
+type gqlLexer struct {
+	src       string
+	pos       int
+	line, col int
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	l.skipIgnored()
+	if l.pos == len(l.src) {
+		return gqlToken{kind: 'e', loc: l.loc()}, nil
+	}
+	loc, start := l.loc(), l.pos
+	switch c := l.src[l.pos]; {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		return gqlToken{}, gqlErrorf(loc, "fragments are not supported")
+	case strings.IndexByte("!$():=@[]{|}", c) >= 0:
+		l.advance(1)
+		return gqlToken{'p', string(c), loc}, nil
+	case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+		for l.pos < len(l.src) && isGQLNameChar(l.src[l.pos]) {
+			l.advance(1)
+		}
+		return gqlToken{'n', l.src[start:l.pos], loc}, nil
+	case c == '-' || c >= '0' && c <= '9':
+		return l.number(loc)
+	case c == '"':
+		return l.string(loc)
+	default:
+		return gqlToken{}, gqlErrorf(loc, "unexpected character %q", c)
+	}
+}
+
+// skipIgnored skips commas, white space, comments and the BOM, which are
+// insignificant.
+func (l *gqlLexer) skipIgnored() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.pos++
+			l.line, l.col = l.line+1, 1
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			l.advance(1)
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.advance(1)
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\uFEFF"):
+			l.advance(len("\uFEFF"))
+		default:
+			return
+		}
+	}
+}
+
+func (l *gqlLexer) advance(n int) {
+	l.pos += n
+	l.col += n
+}
+
+func (l *gqlLexer) loc() gqlLocation { return gqlLocation{l.line, l.col} }
+
+func isGQLNameChar(c byte) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+func (l *gqlLexer) number(loc gqlLocation) (gqlToken, error) {
+	start, kind := l.pos, byte('i')
+	digits := func() int {
+		n := 0
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.advance(1)
+			n++
+		}
+		return n
+	}
+	if l.src[l.pos] == '-' {
+		l.advance(1)
+	}
+	ok := digits() > 0
+	if ok && l.pos < len(l.src) && l.src[l.pos] == '.' {
+		l.advance(1)
+		kind, ok = 'f', digits() > 0
+	}
+	if ok && l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		l.advance(1)
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.advance(1)
+		}
+		kind, ok = 'f', digits() > 0
+	}
+	if !ok || l.pos < len(l.src) && (isGQLNameChar(l.src[l.pos]) || l.src[l.pos] == '.') {
+		return gqlToken{}, gqlErrorf(loc, "invalid number")
+	}
+	return gqlToken{kind, l.src[start:l.pos], loc}, nil
+}
+
+// string reads a quoted string, whose escapes are those of JSON. Block
+// strings are not supported.
+func (l *gqlLexer) string(loc gqlLocation) (gqlToken, error) {
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		return gqlToken{}, gqlErrorf(loc, "block strings are not supported")
+	}
+	start := l.pos
+	l.advance(1)
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '\\':
+			l.advance(2)
+		case '\n':
+			return gqlToken{}, gqlErrorf(loc, "unterminated string")
+		case '"':
+			l.advance(1)
+			var s string
+			if err := json.Unmarshal([]byte(l.src[start:l.pos]), &s); err != nil {
+				return gqlToken{}, gqlErrorf(loc, "invalid string")
+			}
+			return gqlToken{'s', s, loc}, nil
+		default:
+			l.advance(1)
+		}
+	}
+	return gqlToken{}, gqlErrorf(loc, "unterminated string")
+}
+
+// Parser
+
+type gqlOperation struct {
+	kind       string // query or mutation
+	name       string
+	vars       []gqlVarDef
+	selections []*gqlField
+}
+
+type gqlVarDef struct {
+	name, typ string
+	def       interface{} // the default value, nil without one
+	hasDef    bool
+	loc       gqlLocation
+}
+
+type gqlField struct {
+	alias, name string
+	args        []gqlArg
+	selections  []*gqlField
+	loc         gqlLocation
+
+	// argValues are the coerced arguments, set by validation.
+	argValues map[string]interface{}
+}
+
+func (f *gqlField) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type gqlArg struct {
+	name  string
+	value interface{} // a literal, a gqlVariable, or lists and maps of them
+	loc   gqlLocation
+}
+
+type gqlVariable string
+
+type gqlEnum string
+
+type gqlParser struct {
+	lex     gqlLexer
+	tok     gqlToken
+	nesting int
+}
+
+func parseGQL(src string) ([]*gqlOperation, error) {
+	p := &gqlParser{lex: gqlLexer{src: src, line: 1, col: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var ops []*gqlOperation
+	for p.tok.kind != 'e' {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, gqlErrorf(p.tok.loc, "the document has no operation")
+	}
+	return ops, nil
+}
+
+func (p *gqlParser) advance() (err error) {
+	p.tok, err = p.lex.next()
+	return err
+}
+
+func (p *gqlParser) peek(punct string) bool {
+	return p.tok.kind == 'p' && p.tok.val == punct
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if !p.peek(punct) {
+		return p.unexpected("%q", punct)
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != 'n' {
+		return "", p.unexpected("a name")
+	}
+	name := p.tok.val
+	return name, p.advance()
+}
+
+func (p *gqlParser) unexpected(format string, args ...interface{}) error {
+	got := p.tok.val
+	if p.tok.kind == 'e' {
+		got = "end of document"
+	}
+	return gqlErrorf(p.tok.loc, "expected %s, got %q", fmt.Sprintf(format, args...), got)
+}
+
+func (p *gqlParser) nest() error {
+	if p.nesting++; p.nesting > gqlMaxNesting {
+		return gqlErrorf(p.tok.loc, "the document is nested too deeply")
+	}
+	return nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query"}
+	if p.tok.kind == 'n' {
+		switch p.tok.val {
+		case "query", "mutation":
+			op.kind = p.tok.val
+		case "subscription":
+			return nil, gqlErrorf(p.tok.loc, "subscriptions are not supported")
+		case "fragment":
+			return nil, gqlErrorf(p.tok.loc, "fragments are not supported")
+		default:
+			return nil, p.unexpected("an operation")
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == 'n' {
+			op.name = p.tok.val
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if p.peek("(") {
+			if err := p.varDefs(op); err != nil {
+				return nil, err
+			}
+		}
+		if p.peek("@") {
+			return nil, gqlErrorf(p.tok.loc, "directives are not supported")
+		}
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+func (p *gqlParser) varDefs(op *gqlOperation) error {
+	if err := p.advance(); err != nil {
+		return err
+	}
+	for !p.peek(")") {
+		v := gqlVarDef{loc: p.tok.loc}
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		var err error
+		if v.name, err = p.name(); err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if v.typ, err = p.typeRef(); err != nil {
+			return err
+		}
+		if p.peek("=") {
+			if err := p.advance(); err != nil {
+				return err
+			}
+			if v.def, err = p.value(true); err != nil {
+				return err
+			}
+			v.hasDef = true
+		}
+		op.vars = append(op.vars, v)
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) typeRef() (string, error) {
+	var t string
+	if p.peek("[") {
+		if err := p.nest(); err != nil {
+			return "", err
+		}
+		if err := p.advance(); err != nil {
+			return "", err
+		}
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		p.nesting--
+		t = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		t = name
+	}
+	if p.peek("!") {
+		t += "!"
+		return t, p.advance()
+	}
+	return t, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlField, error) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []*gqlField
+	for !p.peek("}") {
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, gqlErrorf(p.tok.loc, "empty selection")
+	}
+	p.nesting--
+	return fields, p.advance()
+}
+
+func (p *gqlParser) field() (*gqlField, error) {
+	f := &gqlField{loc: p.tok.loc}
+	var err error
+	if f.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.peek(":") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		f.alias = f.name
+		if f.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("(") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		for !p.peek(")") {
+			a := gqlArg{loc: p.tok.loc}
+			if a.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if a.value, err = p.value(false); err != nil {
+				return nil, err
+			}
+			f.args = append(f.args, a)
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("@") {
+		return nil, gqlErrorf(p.tok.loc, "directives are not supported")
+	}
+	if p.peek("{") {
+		if f.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// value parses a value; constant ones, such as defaults, cannot hold
+// variables.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == 'p' && tok.val == "$" && !constant:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case tok.kind == 'p' && tok.val == "[":
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !p.peek("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.nesting--
+		return list, p.advance()
+	case tok.kind == 'p' && tok.val == "{":
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		obj := map[string]interface{}{}
+		for !p.peek("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		p.nesting--
+		return obj, p.advance()
+	case tok.kind == 'i':
+		n, err := strconv.ParseInt(tok.val, 10, 64)
+		if err != nil {
+			return nil, gqlErrorf(tok.loc, "invalid integer %s", tok.val)
+		}
+		return n, p.advance()
+	case tok.kind == 'f':
+		f, err := strconv.ParseFloat(tok.val, 64)
+		if err != nil {
+			return nil, gqlErrorf(tok.loc, "invalid number %s", tok.val)
+		}
+		return f, p.advance()
+	case tok.kind == 's':
+		return tok.val, p.advance()
+	case tok.kind == 'n':
+		var v interface{}
+		switch tok.val {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = gqlEnum(tok.val)
+		}
+		return v, p.advance()
+	}
+	return nil, p.unexpected("a value")
+}
+
+// Schema
+
+// gqlType is an object type of the schema.
+type gqlType struct {
+	name   string
+	fields []*gqlFieldDef
+}
+
+func (t *gqlType) field(name string) *gqlFieldDef {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// gqlFieldDef is a field of an object type. typ is written as in the
+// schema language, such as [Product!]!.
+type gqlFieldDef struct {
+	name    string
+	typ     string
+	args    []gqlArgDef
+	resolve func(e *gqlExec, source interface{}, args map[string]interface{}) (interface{}, error)
+	// batch, if set, is called before the field is resolved for sources,
+	// with the arguments of every selection of the field among them, so
+	// that it can load what all of them need at once.
+	batch func(e *gqlExec, sources []interface{}, args []map[string]interface{})
+}
+
+type gqlArgDef struct {
+	name, typ string
+}
+
+type gqlSchema struct {
+	types    map[string]*gqlType
+	query    string
+	mutation string
+}
+
+// namedType strips the list and non-null markers of typ.
+func namedType(typ string) string {
+	return strings.Trim(typ, "[]!")
+}
+
+// sdl writes the schema in the schema language, the types in the order of
+// names.
+func (s *gqlSchema) sdl(names ...string) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "type %s {\n", name)
+		for _, f := range s.types[name].fields {
+			b.WriteString("  " + f.name)
+			if len(f.args) > 0 {
+				args := make([]string, len(f.args))
+				for i, a := range f.args {
+					args[i] = a.name + ": " + a.typ
+				}
+				b.WriteString("(" + strings.Join(args, ", ") + ")")
+			}
+			b.WriteString(": " + f.typ + "\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// Validation
+
+// prepare picks the operation named name among ops, checks it against the
+// schema and the limits, and coerces its arguments with vars.
+func (s *gqlSchema) prepare(ops []*gqlOperation, name string, vars map[string]interface{}) (*gqlOperation, []*gqlError) {
+	var op *gqlOperation
+	switch {
+	case name != "":
+		for _, o := range ops {
+			if o.name == name {
+				op = o
+			}
+		}
+		if op == nil {
+			return nil, []*gqlError{{Message: fmt.Sprintf("no operation named %q", name)}}
+		}
+	case len(ops) > 1:
+		return nil, []*gqlError{{Message: "the document has several operations: set operationName"}}
+	default:
+		op = ops[0]
+	}
+
+	root := s.query
+	if op.kind == "mutation" {
+		root = s.mutation
+	}
+	v := &gqlValidator{schema: s, values: make(map[string]interface{})}
+	for _, d := range op.vars {
+		val, ok := vars[d.name]
+		switch {
+		case !ok && d.hasDef:
+			val = d.def
+		case (!ok || val == nil) && strings.HasSuffix(d.typ, "!"):
+			v.errs = append(v.errs, gqlErrorf(d.loc, "variable $%s of type %s is required", d.name, d.typ))
+		}
+		v.values[d.name] = val
+	}
+	if cost := v.selections(s.types[root], op.selections, 1); cost > gqlMaxComplexity {
+		v.errs = append(v.errs, &gqlError{Message: fmt.Sprintf("the query is too complex: it costs %d, at most %d is allowed", cost, gqlMaxComplexity)})
+	}
+	if len(v.errs) > 0 {
+		return nil, v.errs
+	}
+	return op, nil
+}
+
+type gqlValidator struct {
+	schema *gqlSchema
+	values map[string]interface{} // of the variables
+	errs   []*gqlError
+}
+
+// selections checks fields of t at depth and returns their cost.
+func (v *gqlValidator) selections(t *gqlType, fields []*gqlField, depth int) int {
+	cost := 0
+	for _, f := range fields {
+		if f.name == "__typename" {
+			if len(f.args) > 0 || len(f.selections) > 0 {
+				v.errs = append(v.errs, gqlErrorf(f.loc, "__typename takes no arguments or selection"))
+			}
+			cost++
+			continue
+		}
+		def := t.field(f.name)
+		if def == nil {
+			v.errs = append(v.errs, gqlErrorf(f.loc, "type %s has no field %q", t.name, f.name))
+			continue
+		}
+		if depth > gqlMaxDepth {
+			v.errs = append(v.errs, gqlErrorf(f.loc, "the query is nested deeper than %d fields", gqlMaxDepth))
+			return cost
+		}
+		v.args(f, def)
+
+		cost++
+		child, isObject := v.schema.types[namedType(def.typ)]
+		switch {
+		case isObject && len(f.selections) == 0:
+			v.errs = append(v.errs, gqlErrorf(f.loc, "field %q of type %s must have a selection", f.key(), def.typ))
+		case !isObject && len(f.selections) > 0:
+			v.errs = append(v.errs, gqlErrorf(f.loc, "field %q of type %s cannot have a selection", f.key(), def.typ))
+		case isObject:
+			n := v.selections(child, f.selections, depth+1)
+			if strings.HasPrefix(def.typ, "[") {
+				n *= gqlListFactor
+			}
+			cost += n
+		}
+	}
+	return cost
+}
+
+// args coerces the arguments of f to the types def declares.
+func (v *gqlValidator) args(f *gqlField, def *gqlFieldDef) {
+	f.argValues = make(map[string]interface{}, len(def.args))
+	for _, a := range f.args {
+		found := false
+		for _, d := range def.args {
+			found = found || d.name == a.name
+		}
+		if !found {
+			v.errs = append(v.errs, gqlErrorf(a.loc, "field %q has no argument %q", f.name, a.name))
+		}
+	}
+	for _, d := range def.args {
+		var (
+			val interface{}
+			loc = f.loc
+		)
+		for _, a := range f.args {
+			if a.name == d.name {
+				val, loc = a.value, a.loc
+			}
+		}
+		if name, ok := val.(gqlVariable); ok {
+			bound, declared := v.values[string(name)]
+			if !declared {
+				v.errs = append(v.errs, gqlErrorf(loc, "variable $%s is not defined", name))
+				continue
+			}
+			val = bound
+		}
+		c, err := coerceGQLInput(d.typ, val)
+		if err != nil {
+			v.errs = append(v.errs, gqlErrorf(loc, "argument %q of %q: %v", d.name, f.name, err))
+			continue
+		}
+		f.argValues[d.name] = c
+	}
+}
+
+// coerceGQLInput converts val, a literal or the JSON value of a variable, to
+// the scalar type typ: string for String and ID, int64 for Int, float64 for
+// Float and bool for Boolean.
+func coerceGQLInput(typ string, val interface{}) (interface{}, error) {
+	nonNull := strings.HasSuffix(typ, "!")
+	if val == nil {
+		if nonNull {
+			return nil, fmt.Errorf("a value of type %s is required", typ)
+		}
+		return nil, nil
+	}
+	switch base := strings.TrimSuffix(typ, "!"); base {
+	case "String", "ID":
+		switch x := val.(type) {
+		case string:
+			return x, nil
+		case int64:
+			if base == "ID" {
+				return strconv.FormatInt(x, 10), nil
+			}
+		}
+	case "Int":
+		switch x := val.(type) {
+		case int64:
+			if x >= math.MinInt32 && x <= math.MaxInt32 {
+				return x, nil
+			}
+		case float64: // from JSON variables
+			if x == math.Trunc(x) && x >= math.MinInt32 && x <= math.MaxInt32 {
+				return int64(x), nil
+			}
+		}
+	case "Float":
+		switch x := val.(type) {
+		case float64:
+			return x, nil
+		case int64:
+			return float64(x), nil
+		}
+	case "Boolean":
+		if b, ok := val.(bool); ok {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%v is not a valid %s", gqlValueString(val), strings.TrimSuffix(typ, "!"))
+}
+
+func gqlValueString(v interface{}) string {
+	if e, ok := v.(gqlEnum); ok {
+		return string(e)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// Execution
+
+// gqlExec runs one operation. Resolvers reach the request through it.
+type gqlExec struct {
+	schema *gqlSchema
+	ctx    *gqlContext
+
+	mu   sync.Mutex
+	errs []*gqlError
+}
+
+// gqlObject is the result of a selection, whose fields are kept in the order
+// they were selected in, as GraphQL requires.
+type gqlObject struct {
+	keys   []string
+	values []interface{}
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		b.Write(key)
+		b.WriteByte(':')
+		val, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(val)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func (e *gqlExec) fail(err *gqlError) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errs = append(e.errs, err)
+}
+
+// run executes op. The fields of a query are resolved concurrently, those of
+// a mutation one after the other.
+func (e *gqlExec) run(op *gqlOperation) *gqlObject {
+	root := e.schema.query
+	if op.kind == "mutation" {
+		root = e.schema.mutation
+	}
+	t := e.schema.types[root]
+	if op.kind == "mutation" {
+		return e.selections(t, op.selections, []interface{}{nil}, [][]interface{}{nil}, false)[0]
+	}
+	return e.selections(t, op.selections, []interface{}{nil}, [][]interface{}{nil}, true)[0]
+}
+
+// selections resolves fields of t for each of sources, at paths, and
+// returns an object for each.
+func (e *gqlExec) selections(t *gqlType, fields []*gqlField, sources []interface{}, paths [][]interface{}, concurrent bool) []*gqlObject {
+	// Batch loads first, for every selection of the field at once.
+	batched := make(map[string][]map[string]interface{})
+	for _, f := range fields {
+		if def := t.field(f.name); def != nil && def.batch != nil {
+			batched[f.name] = append(batched[f.name], f.argValues)
+		}
+	}
+	for name, args := range batched {
+		t.field(name).batch(e, sources, args)
+	}
+
+	values := make([][]interface{}, len(fields))
+	var g errgroup.Group
+	for i, f := range fields {
+		resolve := func() error {
+			values[i] = e.field(t, f, sources, paths)
+			return nil
+		}
+		if concurrent {
+			g.Go(resolve)
+		} else {
+			resolve()
+		}
+	}
+	g.Wait()
+
+	out := make([]*gqlObject, len(sources))
+	for j := range sources {
+		out[j] = &gqlObject{keys: make([]string, len(fields)), values: make([]interface{}, len(fields))}
+		for i, f := range fields {
+			out[j].keys[i], out[j].values[i] = f.key(), values[i][j]
+		}
+	}
+	return out
+}
+
+// field resolves f for each of sources and completes the values. A field
+// that fails is null even if its type is non-null: rather than nulling its
+// parents as the spec has it, which would take the data of the backends that
+// did answer with it, the error tells the client apart from a real null.
+func (e *gqlExec) field(t *gqlType, f *gqlField, sources []interface{}, paths [][]interface{}) []interface{} {
+	values := make([]interface{}, len(sources))
+	if f.name == "__typename" {
+		for i := range values {
+			values[i] = t.name
+		}
+		return values
+	}
+	def := t.field(f.name)
+	fieldPaths := make([][]interface{}, len(sources))
+	failed := make([]bool, len(sources))
+	for i, s := range sources {
+		fieldPaths[i] = append(append([]interface{}(nil), paths[i]...), f.key())
+		v, err := def.resolve(e, s, f.argValues)
+		if err != nil {
+			e.fail(e.ctx.fieldError(err, f.loc, fieldPaths[i]))
+			failed[i] = true
+			continue
+		}
+		values[i] = v
+	}
+	out := e.complete(def.typ, f, values, fieldPaths)
+	for i := range out {
+		if failed[i] {
+			out[i] = nil
+		}
+	}
+	return out
+}
+
+// complete turns the values resolved for a field of type typ into JSON
+// values: lists element by element, and objects by resolving the field's
+// selection for all of them at once.
+func (e *gqlExec) complete(typ string, f *gqlField, values []interface{}, paths [][]interface{}) []interface{} {
+	nonNull := strings.HasSuffix(typ, "!")
+	typ = strings.TrimSuffix(typ, "!")
+	out := make([]interface{}, len(values))
+
+	if strings.HasPrefix(typ, "[") {
+		elemType := typ[1 : len(typ)-1]
+		var (
+			elems     []interface{}
+			elemPaths [][]interface{}
+			owners    []int
+		)
+		for i, v := range values {
+			if isNilValue(v) {
+				if nonNull {
+					out[i] = []interface{}{}
+				}
+				continue
+			}
+			rv := reflect.ValueOf(v)
+			out[i] = make([]interface{}, rv.Len())
+			for j := 0; j < rv.Len(); j++ {
+				elems = append(elems, rv.Index(j).Interface())
+				elemPaths = append(elemPaths, append(append([]interface{}(nil), paths[i]...), j))
+				owners = append(owners, i)
+			}
+		}
+		completed := e.complete(elemType, f, elems, elemPaths)
+		next := make([]int, len(values))
+		for k, v := range completed {
+			i := owners[k]
+			out[i].([]interface{})[next[i]] = v
+			next[i]++
+		}
+		return out
+	}
+
+	t, isObject := e.schema.types[typ]
+	if !isObject {
+		for i, v := range values {
+			if !isNilValue(v) {
+				out[i] = v
+			}
+		}
+		return out
+	}
+	var (
+		sources     []interface{}
+		sourcePaths [][]interface{}
+		index       []int
+	)
+	for i, v := range values {
+		if !isNilValue(v) {
+			sources = append(sources, v)
+			sourcePaths = append(sourcePaths, paths[i])
+			index = append(index, i)
+		}
+	}
+	if len(sources) > 0 {
+		for k, o := range e.selections(t, f.selections, sources, sourcePaths, false) {
+			out[index[k]] = o
+		}
+	}
+	return out
+}
+
+func isNilValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,404 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+// gqlContext is the request a GraphQL operation runs for. Money is in the
+// session's currency and formatted for its locale.
+type gqlContext struct {
+	fe       *frontendServer
+	w        http.ResponseWriter
+	r        *http.Request
+	log      logrus.FieldLogger
+	currency string
+	locale   money.Locale
+	products *productLoader
+}
+
+func (c *gqlContext) ctx() context.Context { return c.r.Context() }
+
+// fieldError describes the failure of the field at path for the client,
+// with the HTTP status the same failure gets from the JSON API and, for
+// refused cart additions, the reason.
+func (c *gqlContext) fieldError(err error, loc gqlLocation, path []interface{}) *gqlError {
+	out := &gqlError{Locations: []gqlLocation{loc}, Path: path}
+	var (
+		refused *cartRefusal
+		invalid *gqlError
+	)
+	switch {
+	case errors.As(err, &refused):
+		out.Message = err.Error()
+		out.Extensions = map[string]interface{}{"status": refused.apiStatus, "reason": refused.reason}
+	case errors.As(err, &invalid):
+		out.Message, out.Extensions = invalid.Message, invalid.Extensions
+	default:
+		code := httpStatusFromGRPC(err)
+		c.log.WithFields(logrus.Fields{
+			"error":         err,
+			"grpc.code":     status.Code(errors.Cause(err)).String(),
+			"graphql.field": path,
+		}).Error("backend request error")
+		out.Message = userErrorMessage(err, code)
+		out.Extensions = map[string]interface{}{"status": code}
+	}
+	return out
+}
+
+// productLoader looks up the products a GraphQL operation needs, those of
+// a batch concurrently and each once.
+type productLoader struct {
+	fe       *frontendServer
+	currency string
+
+	mu    sync.Mutex
+	views map[string]*productView // nil for products the catalog does not have
+}
+
+func (l *productLoader) load(ctx context.Context, ids []string) error {
+	l.mu.Lock()
+	var todo []string
+	for _, id := range ids {
+		if _, ok := l.views[id]; !ok && !stringinSlice(todo, id) {
+			todo = append(todo, id)
+		}
+	}
+	l.mu.Unlock()
+	if len(todo) == 0 {
+		return nil
+	}
+	found, missing, err := l.fe.lookupProducts(ctx, todo, l.currency)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range found {
+		l.views[found[i].Item.GetId()] = &found[i]
+	}
+	for _, id := range missing {
+		l.views[id] = nil
+	}
+	return nil
+}
+
+// prime records products already looked up and priced.
+func (l *productLoader) prime(views []*productView) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, v := range views {
+		l.views[v.Item.GetId()] = v
+	}
+}
+
+// get returns the product id, or nil if the catalog does not have it.
+func (l *productLoader) get(ctx context.Context, id string) (*productView, error) {
+	if err := l.load(ctx, []string{id}); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.views[id], nil
+}
+
+// gqlCart is the source of the Cart type.
+type gqlCart struct {
+	items []*pb.CartItem
+	view  *cartView
+}
+
+func (fe *frontendServer) gqlContext(w http.ResponseWriter, r *http.Request) *gqlContext {
+	currency := currentCurrency(r)
+	return &gqlContext{
+		fe:       fe,
+		w:        w,
+		r:        r,
+		log:      loggerFromContext(r.Context()),
+		currency: currency,
+		locale:   userLocale(r),
+		products: &productLoader{fe: fe, currency: currency, views: make(map[string]*productView)},
+	}
+}
+
+func (c *gqlContext) priced(products []*pb.Product) ([]*productView, error) {
+	ps, err := c.fe.priceProducts(c.ctx(), products, c.currency)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]*productView, len(ps))
+	for i := range ps {
+		views[i] = &ps[i]
+	}
+	c.products.prime(views)
+	return views, nil
+}
+
+func (c *gqlContext) cart() (*gqlCart, error) {
+	items, view, err := c.fe.sessionCartView(c.r)
+	if err != nil {
+		return nil, err
+	}
+	return &gqlCart{items, view}, nil
+}
+
+func gqlString(args map[string]interface{}, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
+
+// field returns a field definition of a scalar or an object without
+// arguments, resolved by get.
+func field[S any](name, typ string, get func(c *gqlContext, s S) (interface{}, error)) *gqlFieldDef {
+	return &gqlFieldDef{name: name, typ: typ, resolve: func(e *gqlExec, source interface{}, _ map[string]interface{}) (interface{}, error) {
+		s, _ := source.(S) // nil for the fields of Query and Mutation
+		return get(e.ctx, s)
+	}}
+}
+
+// shopSchema is the schema of /graphql.
+var shopSchema = &gqlSchema{query: "Query", mutation: "Mutation", types: map[string]*gqlType{
+	"Query": {name: "Query", fields: []*gqlFieldDef{
+		{
+			name: "products", typ: "[Product!]!",
+			args: []gqlArgDef{{"query", "String"}, {"category", "String"}},
+			resolve: func(e *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				var (
+					products []*pb.Product
+					err      error
+				)
+				if q := strings.TrimSpace(gqlString(args, "query")); q != "" {
+					products, err = e.ctx.fe.searchProducts(e.ctx.ctx(), q)
+					err = errors.Wrap(err, "could not search products")
+				} else {
+					products, err = e.ctx.fe.getProducts(e.ctx.ctx())
+					err = errors.Wrap(err, "could not retrieve products")
+				}
+				if err != nil {
+					return nil, err
+				}
+				if category := gqlString(args, "category"); category != "" {
+					var matches []*pb.Product
+					for _, p := range products {
+						if inCategory(p, category) {
+							matches = append(matches, p)
+						}
+					}
+					products = matches
+				}
+				return e.ctx.priced(products)
+			},
+		},
+		{
+			name: "product", typ: "Product",
+			args: []gqlArgDef{{"id", "ID!"}},
+			resolve: func(e *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				return e.ctx.products.get(e.ctx.ctx(), gqlString(args, "id"))
+			},
+			// Every product(id:) of the query is looked up in one batch.
+			batch: func(e *gqlExec, _ []interface{}, args []map[string]interface{}) {
+				ids := make([]string, len(args))
+				for i, a := range args {
+					ids[i] = gqlString(a, "id")
+				}
+				e.ctx.products.load(e.ctx.ctx(), ids) // failures are reported by resolve
+			},
+		},
+		field("cart", "Cart!", func(c *gqlContext, _ interface{}) (interface{}, error) {
+			return c.cart()
+		}),
+		{
+			name: "recommendations", typ: "[Product!]!",
+			args: []gqlArgDef{{"productId", "ID"}},
+			resolve: func(e *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				var ids []string
+				if id := gqlString(args, "productId"); id != "" {
+					ids = append(ids, id)
+				}
+				products, err := e.ctx.fe.getRecommendations(e.ctx.ctx(), sessionID(e.ctx.r), ids)
+				if err != nil {
+					return nil, errors.Wrap(err, "could not retrieve recommendations")
+				}
+				return e.ctx.priced(products)
+			},
+		},
+		field("supportedCurrencies", "[String!]!", func(c *gqlContext, _ interface{}) (interface{}, error) {
+			currencies, err := c.fe.getCurrencies(c.ctx())
+			return currencies, errors.Wrap(err, "could not retrieve currencies")
+		}),
+	}},
+
+	"Mutation": {name: "Mutation", fields: []*gqlFieldDef{
+		{
+			name: "addToCart", typ: "Cart!",
+			args: []gqlArgDef{{"productId", "ID!"}, {"quantity", "Int!"}, {"variant", "String"}},
+			resolve: func(e *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				quantity, _ := args["quantity"].(int64)
+				payload := validator.AddToCartPayload{
+					Quantity:  uint64(max(quantity, 0)),
+					ProductID: gqlString(args, "productId"),
+					Variant:   gqlString(args, "variant"),
+				}
+				if err := payload.Validate(); err != nil {
+					reason := "invalid_product"
+					if _, ok := validator.FieldErrors(err)["quantity"]; ok {
+						reason = "invalid_quantity"
+					}
+					return nil, &gqlError{
+						Message:    strings.TrimSpace(validator.ValidationErrorResponse(err).Error()),
+						Extensions: map[string]interface{}{"status": http.StatusBadRequest, "reason": reason},
+					}
+				}
+				if _, err := e.ctx.fe.addToCart(e.ctx.r, payload); err != nil {
+					return nil, err
+				}
+				bumpCartVersion(e.ctx.w)
+				return e.ctx.cart()
+			},
+		},
+	}},
+
+	"Product": {name: "Product", fields: []*gqlFieldDef{
+		field("id", "ID!", func(_ *gqlContext, p *productView) (interface{}, error) { return p.Item.GetId(), nil }),
+		field("name", "String!", func(_ *gqlContext, p *productView) (interface{}, error) { return p.Item.GetName(), nil }),
+		field("description", "String!", func(_ *gqlContext, p *productView) (interface{}, error) { return p.Item.GetDescription(), nil }),
+		field("picture", "String!", func(_ *gqlContext, p *productView) (interface{}, error) { return p.Item.GetPicture(), nil }),
+		field("categories", "[String!]!", func(_ *gqlContext, p *productView) (interface{}, error) { return p.Item.GetCategories(), nil }),
+		field("price", "Money!", func(_ *gqlContext, p *productView) (interface{}, error) { return p.Price, nil }),
+		field("compareAtPrice", "Money", func(_ *gqlContext, p *productView) (interface{}, error) { return p.CompareAt, nil }),
+		field("variants", "[String!]!", func(c *gqlContext, p *productView) (interface{}, error) { return c.fe.productVariants(p.Item), nil }),
+	}},
+
+	"Money": {name: "Money", fields: []*gqlFieldDef{
+		field("currencyCode", "String!", func(_ *gqlContext, m *pb.Money) (interface{}, error) { return m.GetCurrencyCode(), nil }),
+		field("units", "Int!", func(_ *gqlContext, m *pb.Money) (interface{}, error) { return m.GetUnits(), nil }),
+		field("nanos", "Int!", func(_ *gqlContext, m *pb.Money) (interface{}, error) { return m.GetNanos(), nil }),
+		field("formatted", "String!", func(c *gqlContext, m *pb.Money) (interface{}, error) { return c.locale.Format(*m), nil }),
+	}},
+
+	"Cart": {name: "Cart", fields: []*gqlFieldDef{
+		field("items", "[CartItem!]!", func(_ *gqlContext, c *gqlCart) (interface{}, error) { return c.view.Items, nil }),
+		field("itemCount", "Int!", func(_ *gqlContext, c *gqlCart) (interface{}, error) { return cartSize(c.items), nil }),
+		field("subtotal", "Money!", func(_ *gqlContext, c *gqlCart) (interface{}, error) { return &c.view.Subtotal, nil }),
+		field("promoCode", "String", func(_ *gqlContext, c *gqlCart) (interface{}, error) {
+			if c.view.Promo == "" {
+				return nil, nil
+			}
+			return c.view.Promo, nil
+		}),
+		field("discount", "Money", func(_ *gqlContext, c *gqlCart) (interface{}, error) { return c.view.Discount, nil }),
+		field("estimatedShipping", "Money", func(_ *gqlContext, c *gqlCart) (interface{}, error) { return c.view.EstimatedShipping, nil }),
+		field("total", "Money!", func(_ *gqlContext, c *gqlCart) (interface{}, error) { return &c.view.Total, nil }),
+		field("unavailableProductIds", "[ID!]!", func(_ *gqlContext, c *gqlCart) (interface{}, error) { return c.view.Unavailable, nil }),
+	}},
+
+	"CartItem": {name: "CartItem", fields: []*gqlFieldDef{
+		{
+			name: "product", typ: "Product!",
+			resolve: func(e *gqlExec, source interface{}, _ map[string]interface{}) (interface{}, error) {
+				return e.ctx.products.get(e.ctx.ctx(), source.(cartItemView).Item.GetId())
+			},
+			batch: func(e *gqlExec, sources []interface{}, _ []map[string]interface{}) {
+				ids := make([]string, len(sources))
+				for i, s := range sources {
+					ids[i] = s.(cartItemView).Item.GetId()
+				}
+				e.ctx.products.load(e.ctx.ctx(), ids) // failures are reported by resolve
+			},
+		},
+		field("variant", "String", func(_ *gqlContext, it cartItemView) (interface{}, error) {
+			if it.Variant == "" {
+				return nil, nil
+			}
+			return it.Variant, nil
+		}),
+		field("quantity", "Int!", func(_ *gqlContext, it cartItemView) (interface{}, error) { return it.Quantity, nil }),
+		field("unitPrice", "Money!", func(_ *gqlContext, it cartItemView) (interface{}, error) { return it.UnitPrice, nil }),
+		field("lineTotal", "Money!", func(_ *gqlContext, it cartItemView) (interface{}, error) { return it.Price, nil }),
+	}},
+}}
+
+// shopSchemaSDL is the schema in the schema language, for the explorer.
+var shopSchemaSDL = shopSchema.sdl("Query", "Mutation", "Product", "Money", "Cart", "CartItem")
+
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type gqlResponse struct {
+	Data   *gqlObject  `json:"data,omitempty"`
+	Errors []*gqlError `json:"errors,omitempty"`
+}
+
+// graphqlHandler serves POST /graphql, a single query endpoint over the
+// catalog, the cart, recommendations and currencies for prototypes that
+// would rather not call half a dozen JSON routes. Like every POST, it needs
+// the CSRF token in the X-CSRF-Token header. Documents that cannot be run
+// are answered with 400; errors of fields leave them null in a 200.
+func (fe *frontendServer) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	var req gqlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(log, w, http.StatusBadRequest, gqlResponse{Errors: []*gqlError{{Message: "the body must be a JSON object with a query"}}})
+		return
+	}
+	ops, err := parseGQL(req.Query)
+	if err != nil {
+		var gerr *gqlError
+		if !errors.As(err, &gerr) {
+			gerr = &gqlError{Message: err.Error()}
+		}
+		writeJSON(log, w, http.StatusBadRequest, gqlResponse{Errors: []*gqlError{gerr}})
+		return
+	}
+	op, errs := shopSchema.prepare(ops, req.OperationName, req.Variables)
+	if len(errs) > 0 {
+		log.WithField("errors", len(errs)).Info("rejected graphql document")
+		writeJSON(log, w, http.StatusBadRequest, gqlResponse{Errors: errs})
+		return
+	}
+	log.WithField("graphql.operation", op.kind).WithField("graphql.name", op.name).Debug("running graphql operation")
+
+	e := &gqlExec{schema: shopSchema, ctx: fe.gqlContext(w, r)}
+	data := e.run(op)
+	writeJSON(log, w, http.StatusOK, gqlResponse{Data: data, Errors: e.errs})
+}
+
+// graphiqlHandler serves the explorer of /graphql, for GRAPHIQL_ENABLED.
+func (fe *frontendServer) graphiqlHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	if err := templates.ExecuteTemplate(w, "graphiql", fe.commonTemplateData(r.Context(), r).with(map[string]interface{}{
+		"show_currency": false,
+		"schema":        shopSchemaSDL,
+	})); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+type gqlTestResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Path       []interface{}          `json:"path"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func runGraphQL(t *testing.T, fe *frontendServer, r *http.Request, query string, variables map[string]interface{}) (*httptest.ResponseRecorder, gqlTestResponse) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body))).WithContext(r.Context())
+	req.Header = r.Header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	fe.graphqlHandler(w, req)
+	var got gqlTestResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, w.Body)
+	}
+	return w, got
+}
+
+func TestGraphQLProducts(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	r := newTestRequest(http.MethodPost, "/graphql", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyCurrency{}, "EUR"))
+
+	w, got := runGraphQL(t, fe, r, `
+		query Shop($category: String) {
+			accessories: products(category: $category) { id price { currencyCode units formatted } }
+			currencies: supportedCurrencies
+		}`, map[string]interface{}{"category": "accessories"})
+	if w.Code != http.StatusOK || len(got.Errors) > 0 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var products []struct {
+		ID    string `json:"id"`
+		Price struct {
+			CurrencyCode string `json:"currencyCode"`
+			Units        int64  `json:"units"`
+			Formatted    string `json:"formatted"`
+		} `json:"price"`
+	}
+	if err := json.Unmarshal(got.Data["accessories"], &products); err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || products[0].ID != "OLJCESPC7Z" || products[1].ID != "1YMWWN1N4O" {
+		t.Fatalf("accessories = %+v", products)
+	}
+	if p := products[0].Price; p.CurrencyCode != "EUR" || p.Units != 19 || !strings.Contains(p.Formatted, "19.99") {
+		t.Errorf("price in the session currency = %+v", p)
+	}
+	if _, ok := got.Data["currencies"]; !ok || strings.Contains(w.Body.String(), `"supportedCurrencies"`) {
+		t.Errorf("alias not applied: %s", w.Body)
+	}
+}
+
+func TestGraphQLBatchesProductLookups(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, fb)
+	calls := fb.callCount("GetProduct")
+
+	w, got := runGraphQL(t, fe, newTestRequest(http.MethodPost, "/graphql", nil), `{
+		a: product(id: "OLJCESPC7Z") { name }
+		b: product(id: "66VCHSJNUP") { name }
+		c: product(id: "OLJCESPC7Z") { name }
+		gone: product(id: "NOSUCHPROD") { name }
+	}`, nil)
+	if w.Code != http.StatusOK || len(got.Errors) > 0 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if string(got.Data["gone"]) != "null" || !strings.Contains(string(got.Data["b"]), "Tank Top") {
+		t.Errorf("data = %s", w.Body)
+	}
+	if n := fb.callCount("GetProduct") - calls; n != 3 {
+		t.Errorf("%d product lookups, want one per distinct ID", n)
+	}
+}
+
+func TestGraphQLCartAndAddToCart(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+	r := newTestRequest(http.MethodPost, "/graphql", nil)
+
+	w, got := runGraphQL(t, fe, r, `mutation Add($id: ID!) {
+		addToCart(productId: $id, quantity: 2, variant: "M") {
+			itemCount
+			items { quantity product { id name } lineTotal { formatted } }
+		}
+	}`, map[string]interface{}{"id": "66VCHSJNUP"})
+	if w.Code != http.StatusOK || len(got.Errors) > 0 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var cart struct {
+		ItemCount int `json:"itemCount"`
+		Items     []struct {
+			Quantity int `json:"quantity"`
+			Product  struct {
+				Name string `json:"name"`
+			} `json:"product"`
+			LineTotal struct {
+				Formatted string `json:"formatted"`
+			} `json:"lineTotal"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(got.Data["addToCart"], &cart); err != nil {
+		t.Fatal(err)
+	}
+	if cart.ItemCount != 3 || len(cart.Items) != 2 || cart.Items[1].Product.Name != "Tank Top" || cart.Items[1].LineTotal.Formatted != "$37.98" {
+		t.Errorf("cart after adding = %+v", cart)
+	}
+	if len(w.Result().Cookies()) == 0 {
+		t.Error("cart version cookie not bumped")
+	}
+
+	_, got = runGraphQL(t, fe, r, `mutation { addToCart(productId: "66VCHSJNUP", quantity: 50) { itemCount } }`, nil)
+	if len(got.Errors) != 1 || got.Errors[0].Extensions["reason"] != "invalid_quantity" || string(got.Data["addToCart"]) != "null" {
+		t.Errorf("invalid quantity: %+v", got)
+	}
+}
+
+func TestGraphQLFieldErrors(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("ListRecommendations", status.Error(codes.Unavailable, "connection refused"))
+	fe := newTestFrontend(t, fb)
+
+	w, got := runGraphQL(t, fe, newTestRequest(http.MethodPost, "/graphql", nil),
+		`{ recommendations { id } cart { itemCount } }`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if len(got.Errors) != 1 || got.Errors[0].Message != "could not retrieve recommendations" ||
+		got.Errors[0].Extensions["status"] != float64(http.StatusServiceUnavailable) {
+		t.Errorf("errors = %+v", got.Errors)
+	}
+	if string(got.Data["recommendations"]) != "null" || string(got.Data["cart"]) != `{"itemCount":0}` {
+		t.Errorf("data = %s", w.Body)
+	}
+}
+
+func TestGraphQLRejectsDocuments(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	r := newTestRequest(http.MethodPost, "/graphql", nil)
+	var expensive strings.Builder
+	expensive.WriteString("{")
+	for i := 0; i < 12; i++ {
+		fmt.Fprintf(&expensive, " r%d: recommendations { id name description picture categories variants price { units nanos } }", i)
+	}
+	expensive.WriteString(" }")
+	for name, query := range map[string]string{
+		"syntax":     `{ products { id `,
+		"field":      `{ products { sku } }`,
+		"argument":   `{ product { id } }`,
+		"variable":   `query ($id: ID!) { product(id: $id) { id } }`,
+		"fragments":  `{ ...F } fragment F on Query { cart { itemCount } }`,
+		"selection":  `{ cart }`,
+		"complexity": expensive.String(),
+	} {
+		w, got := runGraphQL(t, fe, r, query, nil)
+		if w.Code != http.StatusBadRequest || len(got.Errors) == 0 || got.Data != nil {
+			t.Errorf("%s: status %d: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestGraphQLDepthLimit(t *testing.T) {
+	node := &gqlType{name: "Node"}
+	node.fields = []*gqlFieldDef{{name: "id", typ: "ID!"}, {name: "child", typ: "Node"}}
+	schema := &gqlSchema{query: "Node", types: map[string]*gqlType{"Node": node}}
+	for depth, ok := range map[int]bool{gqlMaxDepth: true, gqlMaxDepth + 1: false} {
+		query := strings.Repeat("{ child ", depth-1) + "{ id }" + strings.Repeat(" }", depth-1)
+		ops, err := parseGQL(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, errs := schema.prepare(ops, "", nil); (len(errs) == 0) != ok {
+			t.Errorf("depth %d: errors %v", depth, errs)
+		}
+	}
+}
+
+func TestGraphiQLDisabledByDefault(t *testing.T) {
+	t.Setenv("GRAPHIQL_ENABLED", "")
+	if loadTestConfig(t).graphiqlEnabled {
+		t.Error("GraphiQL enabled without GRAPHIQL_ENABLED")
+	}
+	handle := func(_ string, h http.HandlerFunc) http.HandlerFunc { return h }
+	for _, enabled := range []bool{false, true} {
+		fe := newTestFrontend(t, newFakeBackend())
+		fe.graphiqlEnabled = enabled
+		w := httptest.NewRecorder()
+		fe.newRouter("", "", handle).ServeHTTP(w, newTestRequest(http.MethodGet, "/graphql", nil))
+		if got := w.Code == http.StatusOK && strings.Contains(w.Body.String(), "addToCart(productId: ID!"); got != enabled {
+			t.Errorf("GRAPHIQL_ENABLED=%v: GET /graphql status %d", enabled, w.Code)
+		}
+	}
+}
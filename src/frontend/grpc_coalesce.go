@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var grpcClientCoalescedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "grpc_client_coalesced_calls_total",
+	Help: "Number of idempotent unary gRPC calls, by service and result: leader when the call was sent, shared when it got the reply of an identical call in flight.",
+}, []string{"service", "result"})
+
+// callCoalescer lets concurrent identical read-only calls share one RPC, so
+// that a burst of home page requests sends one ListProducts rather than one
+// each. Calls are identical when their method, request and user currency,
+// which goes out as metadata, are. The other metadata, such as the session,
+// is that of the first call.
+type callCoalescer struct {
+	group singleflight.Group
+}
+
+var grpcCoalesce = &callCoalescer{}
+
+// unaryInterceptor coalesces idempotent calls. The shared RPC runs with the
+// first call's deadline but not its cancellation, so that a caller giving up
+// does not fail the others; each caller still stops waiting when its own ctx
+// is done. Every caller gets a deep copy of the reply, never the reply
+// itself, so that callers cannot see each other's changes to it.
+func (c *callCoalescer) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	in, ok := req.(proto.Message)
+	out, ok2 := reply.(proto.Message)
+	if !ok || !ok2 || !idempotentMethods[method] {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(in)
+	if err != nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	currency, _ := ctx.Value(ctxKeyCurrency{}).(string)
+	key := method + "\x00" + currency + "\x00" + string(b)
+
+	var led bool
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		led = true
+		callCtx := context.WithoutCancel(ctx)
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithDeadline(callCtx, deadline)
+			defer cancel()
+		}
+		shared := out.ProtoReflect().New().Interface()
+		err := invoker(callCtx, method, req, shared, cc, opts...)
+		return shared, err
+	})
+	select {
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	case res := <-ch:
+		result := "shared"
+		if led {
+			result = "leader"
+		}
+		grpcClientCoalescedTotal.WithLabelValues(grpcServiceName(method), result).Inc()
+		if res.Err != nil {
+			return res.Err
+		}
+		proto.Reset(out)
+		proto.Merge(out, res.Val.(proto.Message))
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const listProductsMethod = "/hipstershop.ProductCatalogService/ListProducts"
+
+// blockingInvoker answers ListProducts with one product once release is
+// closed, counting the calls.
+type blockingInvoker struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (b *blockingInvoker) invoke(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+	b.calls.Add(1)
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	if resp, ok := reply.(*pb.ListProductsResponse); ok {
+		resp.Products = []*pb.Product{{Id: "OLJCESPC7Z", Name: "Sunglasses"}}
+	}
+	return nil
+}
+
+func withCurrency(ctx context.Context, currency string) context.Context {
+	return context.WithValue(ctx, ctxKeyCurrency{}, currency)
+}
+
+func TestCoalesceIdenticalCalls(t *testing.T) {
+	c := &callCoalescer{}
+	inv := &blockingInvoker{release: make(chan struct{})}
+	shared := testutil.ToFloat64(grpcClientCoalescedTotal.WithLabelValues("hipstershop.ProductCatalogService", "shared"))
+
+	const callers = 20
+	replies := make([]*pb.ListProductsResponse, callers)
+	var wg sync.WaitGroup
+	for i := range replies {
+		replies[i] = &pb.ListProductsResponse{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.unaryInterceptor(withCurrency(context.Background(), "EUR"), listProductsMethod, &pb.Empty{}, replies[i], nil, inv.invoke); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // for every caller to join the call in flight
+	close(inv.release)
+	wg.Wait()
+
+	if n := inv.calls.Load(); n != 1 {
+		t.Errorf("%d calls sent, want 1", n)
+	}
+	if got := testutil.ToFloat64(grpcClientCoalescedTotal.WithLabelValues("hipstershop.ProductCatalogService", "shared")) - shared; got != callers-1 {
+		t.Errorf("%v calls shared, want %d", got, callers-1)
+	}
+	// Each caller has a copy of its own.
+	replies[0].Products[0].Name = "Changed"
+	replies[1].Products = append(replies[1].Products, &pb.Product{Id: "66VCHSJNUP"})
+	for i, r := range replies[2:] {
+		if len(r.GetProducts()) != 1 || r.GetProducts()[0].GetName() != "Sunglasses" {
+			t.Fatalf("reply %d = %v", i+2, r)
+		}
+	}
+}
+
+func TestCoalesceKeepsCallsApart(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		req1     interface{}
+		req2     interface{}
+		currency string
+	}{
+		{"other currency", listProductsMethod, &pb.Empty{}, &pb.Empty{}, "JPY"},
+		{"other request", "/hipstershop.ProductCatalogService/GetProduct", &pb.GetProductRequest{Id: "A"}, &pb.GetProductRequest{Id: "B"}, "EUR"},
+		{"not idempotent", "/hipstershop.CartService/EmptyCart", &pb.EmptyCartRequest{UserId: "a"}, &pb.EmptyCartRequest{UserId: "a"}, "EUR"},
+	} {
+		c := &callCoalescer{}
+		inv := &blockingInvoker{release: make(chan struct{})}
+		var wg sync.WaitGroup
+		for i, req := range []interface{}{tc.req1, tc.req2} {
+			currency := "EUR"
+			if i == 1 {
+				currency = tc.currency
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.unaryInterceptor(withCurrency(context.Background(), currency), tc.method, req, &pb.Empty{}, nil, inv.invoke)
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(inv.release)
+		wg.Wait()
+		if n := inv.calls.Load(); n != 2 {
+			t.Errorf("%s: %d calls sent, want 2", tc.name, n)
+		}
+	}
+}
+
+func TestCoalesceCallerGivingUp(t *testing.T) {
+	c := &callCoalescer{}
+	inv := &blockingInvoker{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(withCurrency(context.Background(), "EUR"))
+	first := make(chan error, 1)
+	go func() {
+		first <- c.unaryInterceptor(ctx, listProductsMethod, &pb.Empty{}, &pb.ListProductsResponse{}, nil, inv.invoke)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	second := make(chan error, 1)
+	reply := &pb.ListProductsResponse{}
+	go func() {
+		second <- c.unaryInterceptor(withCurrency(context.Background(), "EUR"), listProductsMethod, &pb.Empty{}, reply, nil, inv.invoke)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	if err := <-first; status.Code(err) != codes.Canceled {
+		t.Errorf("canceled caller: %v", err)
+	}
+	close(inv.release)
+	if err := <-second; err != nil || len(reply.GetProducts()) != 1 {
+		t.Errorf("other caller: %v, %v", reply, err)
+	}
+	if n := inv.calls.Load(); n != 1 {
+		t.Errorf("%d calls sent, want 1", n)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// gRPC servers reject pings more frequent than every five minutes by
+	// default, so a shorter keepalive time only works where the backends
+	// are configured to allow it.
+	defaultGRPCKeepaliveTime    = 5 * time.Minute
+	defaultGRPCKeepaliveTimeout = 20 * time.Second
+)
+
+// serviceEnvPrefixes maps each backend to the prefix of its environment
+// variables, e.g. CHECKOUT_SERVICE_TIMEOUT for checkoutservice.
+var serviceEnvPrefixes = map[string]string{
+	"currencyservice":       "CURRENCY_SERVICE",
+	"productcatalogservice": "PRODUCT_CATALOG_SERVICE",
+	"cartservice":           "CART_SERVICE",
+	"recommendationservice": "RECOMMENDATION_SERVICE",
+	"shippingservice":       "SHIPPING_SERVICE",
+	"checkoutservice":       "CHECKOUT_SERVICE",
+	"adservice":             "AD_SERVICE",
+	"collector":             "COLLECTOR_SERVICE",
+}
+
+// grpcConnConfig holds the connection settings for one backend. A zero
+// duration or size leaves the gRPC default in place.
+type grpcConnConfig struct {
+	keepaliveTime    time.Duration
+	keepaliveTimeout time.Duration
+	callTimeout      time.Duration
+	maxRecvMsgSize   int
+	maxSendMsgSize   int
+	lbPolicy         string
+	// maxConcurrent caps the calls in flight, see bulkhead; 0 for no cap.
+	maxConcurrent int
+	bulkheadWait  time.Duration
+}
+
+// backendConnConfigs holds the connection settings of each backend, by
+// service; main sets it from the configuration.
+var backendConnConfigs map[string]grpcConnConfig
+
+// grpcConnConfigsFromEnv reads the connection settings of each backend of
+// serviceEnvPrefixes. GRPC_KEEPALIVE_TIME, GRPC_KEEPALIVE_TIMEOUT,
+// GRPC_MAX_RECV_MSG_SIZE, GRPC_MAX_SEND_MSG_SIZE, GRPC_BULKHEAD_WAIT and
+// GRPC_LB_POLICY apply to every backend, <SERVICE>_TIMEOUT and
+// <SERVICE>_MAX_CONCURRENT, e.g. CHECKOUT_SERVICE_MAX_CONCURRENT=32, to one.
+// Setting GRPC_KEEPALIVE_TIME to 0 turns keepalive pings off. GRPC_LB_POLICY
+// is one of lbPolicies; round_robin spreads calls over every address a
+// headless service resolves to.
+func grpcConnConfigsFromEnv(l *envLoader) map[string]grpcConnConfig {
+	base := grpcConnConfig{
+		keepaliveTime:    l.duration("GRPC_KEEPALIVE_TIME", defaultGRPCKeepaliveTime),
+		keepaliveTimeout: l.duration("GRPC_KEEPALIVE_TIMEOUT", defaultGRPCKeepaliveTimeout),
+		maxRecvMsgSize:   l.int("GRPC_MAX_RECV_MSG_SIZE", 0),
+		maxSendMsgSize:   l.int("GRPC_MAX_SEND_MSG_SIZE", 0),
+		lbPolicy:         l.str("GRPC_LB_POLICY", defaultGRPCLBPolicy),
+		bulkheadWait:     l.duration("GRPC_BULKHEAD_WAIT", defaultBulkheadWait),
+	}
+	if !slices.Contains(lbPolicies, base.lbPolicy) {
+		l.problem("GRPC_LB_POLICY: %q must be one of %s", base.lbPolicy, strings.Join(lbPolicies, ", "))
+		base.lbPolicy = defaultGRPCLBPolicy
+	}
+	out := make(map[string]grpcConnConfig, len(serviceEnvPrefixes))
+	for _, service := range slices.Sorted(maps.Keys(serviceEnvPrefixes)) {
+		prefix := serviceEnvPrefixes[service]
+		c := base
+		c.callTimeout = l.duration(prefix+"_TIMEOUT", 0)
+		c.maxConcurrent = l.int(prefix+"_MAX_CONCURRENT", 0)
+		out[service] = c
+	}
+	return out
+}
+
+// dialOptions returns the load balancing, keepalive and message size
+// options. The call timeout is applied by grpcDialOptions instead, since it
+// has to wrap the retry interceptor.
+func (c grpcConnConfig) dialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{grpc.WithDefaultServiceConfig(lbServiceConfig(c.lbPolicy))}
+	if c.keepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    c.keepaliveTime,
+			Timeout: c.keepaliveTimeout,
+		}))
+	}
+	var callOpts []grpc.CallOption
+	if c.maxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(c.maxRecvMsgSize))
+	}
+	if c.maxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(c.maxSendMsgSize))
+	}
+	if len(callOpts) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+	return opts
+}
+
+// logFields describes the effective settings for the startup log.
+func (c grpcConnConfig) logFields() logrus.Fields {
+	return logrus.Fields{
+		"grpc.keepalive_time":     c.keepaliveTime.String(),
+		"grpc.keepalive_timeout":  c.keepaliveTimeout.String(),
+		"grpc.call_timeout":       c.callTimeout.String(),
+		"grpc.max_recv_msg_bytes": c.maxRecvMsgSize,
+		"grpc.max_send_msg_bytes": c.maxSendMsgSize,
+		"grpc.lb_policy":          c.lbPolicy,
+		"grpc.max_concurrent":     c.maxConcurrent,
+	}
+}
+
+// callTimeoutInterceptor bounds each call to timeout. The caller's deadline
+// still wins when it is sooner, so the handler's own deadline is never
+// extended.
+func callTimeoutInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if timeout <= 0 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
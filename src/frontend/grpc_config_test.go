@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestGRPCConnConfigsFromEnv(t *testing.T) {
+	t.Setenv("GRPC_KEEPALIVE_TIME", "1m")
+	t.Setenv("GRPC_MAX_RECV_MSG_SIZE", "8388608")
+	t.Setenv("CHECKOUT_SERVICE_TIMEOUT", "10s")
+	t.Setenv("CHECKOUT_SERVICE_MAX_CONCURRENT", "32")
+
+	want := grpcConnConfig{
+		keepaliveTime:    time.Minute,
+		keepaliveTimeout: defaultGRPCKeepaliveTimeout,
+		callTimeout:      10 * time.Second,
+		maxRecvMsgSize:   8 << 20,
+		lbPolicy:         defaultGRPCLBPolicy,
+		maxConcurrent:    32,
+		bulkheadWait:     defaultBulkheadWait,
+	}
+	var l envLoader
+	got := grpcConnConfigsFromEnv(&l)
+	if l.err() != nil {
+		t.Fatal(l.err())
+	}
+	if got["checkoutservice"] != want {
+		t.Errorf("checkoutservice: got %+v, want %+v", got["checkoutservice"], want)
+	}
+	want.callTimeout, want.maxConcurrent = 0, 0
+	if got["cartservice"] != want {
+		t.Errorf("cartservice: got %+v, want %+v", got["cartservice"], want)
+	}
+
+	// A bare number is not a duration, and must not turn the timeout off.
+	for k, v := range map[string]string{"CHECKOUT_SERVICE_TIMEOUT": "10", "GRPC_MAX_SEND_MSG_SIZE": "lots"} {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv(k, v)
+			var l envLoader
+			if grpcConnConfigsFromEnv(&l); l.err() == nil || !strings.Contains(l.err().Error(), k) {
+				t.Errorf("%s=%q: problems %v", k, v, l.err())
+			}
+		})
+	}
+}
+
+func TestCallTimeoutInterceptor(t *testing.T) {
+	remaining := func(timeout, inherited time.Duration) time.Duration {
+		ctx := context.Background()
+		if inherited > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, inherited)
+			defer cancel()
+		}
+		var got time.Duration
+		invoker := func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+			if deadline, ok := ctx.Deadline(); ok {
+				got = time.Until(deadline)
+			}
+			return nil
+		}
+		callTimeoutInterceptor(timeout)(ctx, "/hipstershop.CheckoutService/PlaceOrder", nil, nil, nil, invoker)
+		return got
+	}
+
+	for _, tc := range []struct {
+		name               string
+		timeout, inherited time.Duration
+		want               time.Duration
+	}{
+		{"configured only", 10 * time.Second, 0, 10 * time.Second},
+		{"configured is sooner", 10 * time.Second, time.Minute, 10 * time.Second},
+		{"inherited is sooner", 10 * time.Second, 2 * time.Second, 2 * time.Second},
+		{"not configured", 0, time.Minute, time.Minute},
+		{"neither", 0, 0, 0},
+	} {
+		got := remaining(tc.timeout, tc.inherited)
+		if got > tc.want || got < tc.want-time.Second {
+			t.Errorf("%s: call deadline in %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
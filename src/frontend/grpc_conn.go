@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+const defaultStartupBackendTimeout = 3 * time.Second
+
+// watchConnState logs every connectivity state change of conn until the
+// connection is closed or ctx is done.
+func watchConnState(ctx context.Context, log logrus.FieldLogger, service string, conn *grpc.ClientConn) {
+	state := conn.GetState()
+	for state != connectivity.Shutdown && conn.WaitForStateChange(ctx, state) {
+		state = conn.GetState()
+		l := log.WithFields(logrus.Fields{
+			"grpc.service": service,
+			"grpc.target":  conn.Target(),
+			"grpc.state":   state.String(),
+		})
+		if state == connectivity.TransientFailure {
+			l.Warn("backend connection failed, reconnecting")
+		} else {
+			l.Info("backend connection state changed")
+		}
+	}
+}
+
+// waitForReady starts connecting conn if it is idle and waits until it is
+// ready or ctx is done.
+func waitForReady(ctx context.Context, conn *grpc.ClientConn) error {
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return errors.Errorf("connection to %s is %s", conn.Target(), state)
+		}
+	}
+}
+
+// requireBackends waits for every backend connection to become ready, for
+// deployments that set STARTUP_REQUIRE_BACKENDS and would rather fail at
+// startup than report unready. It returns an error naming the backends that
+// were not ready within timeout.
+func (fe *frontendServer) requireBackends(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conns := fe.backendConns()
+	errs := make(chan error, len(conns))
+	for name, conn := range conns {
+		go func() {
+			if conn == nil {
+				errs <- errors.Errorf("%s: not connected", name)
+				return
+			}
+			errs <- errors.Wrap(waitForReady(ctx, conn), name)
+		}()
+	}
+	var down []string
+	for range conns {
+		if err := <-errs; err != nil {
+			down = append(down, err.Error())
+		}
+	}
+	if len(down) > 0 {
+		sort.Strings(down)
+		return errors.Errorf("backends not ready after %v: %v", timeout, down)
+	}
+	return nil
+}
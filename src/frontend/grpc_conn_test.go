@@ -0,0 +1,88 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// unreachableConn returns a connection to a port nothing listens on.
+func unreachableConn(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestRequireBackends(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	if err := fe.requireBackends(context.Background(), 5*time.Second); err != nil {
+		t.Errorf("all backends up: %v", err)
+	}
+
+	fe.adSvcConn = unreachableConn(t)
+	err := fe.requireBackends(context.Background(), 200*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "ad:") || strings.Contains(err.Error(), "cart:") {
+		t.Errorf("ad backend down: got %v, want an error naming only ad", err)
+	}
+}
+
+func TestWatchConnStateLogsTransitions(t *testing.T) {
+	logger, hook := logtest.NewNullLogger()
+	conn := unreachableConn(t)
+	done := make(chan struct{})
+	go func() {
+		watchConnState(context.Background(), logger, "adservice", conn)
+		close(done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	waitForReady(ctx, conn)
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop after the connection was closed")
+	}
+
+	var failed bool
+	for _, e := range hook.AllEntries() {
+		if e.Data["grpc.service"] != "adservice" {
+			t.Errorf("entry without the service: %v", e.Data)
+		}
+		failed = failed || e.Data["grpc.state"] == "TRANSIENT_FAILURE"
+	}
+	if !failed {
+		t.Errorf("no TRANSIENT_FAILURE logged, got %d entries", len(hook.AllEntries()))
+	}
+}
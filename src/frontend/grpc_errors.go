@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryAfterSeconds is suggested to clients when a backend is temporarily
+// unavailable.
+const retryAfterSeconds = 5
+
+// httpStatusFromGRPC maps the gRPC status carried by err to the HTTP status
+// the user should see.
+func httpStatusFromGRPC(err error) int {
+	if _, ok := errors.Cause(err).(*bulkheadFullError); ok {
+		// The frontend, not the user, is over its limit.
+		return http.StatusServiceUnavailable
+	}
+	switch status.Code(errors.Cause(err)) {
+	case codes.OK:
+		return http.StatusOK
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return http.StatusServiceUnavailable
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// renderGRPCError renders the error page for a failed backend call. err is
+// expected to wrap the gRPC error with a user-facing description, e.g.
+// errors.Wrap(err, "could not retrieve cart"): only that description is shown
+// to the user, while the full error goes to the log.
+func renderGRPCError(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error) {
+	code := grpcErrorStatus(log, r, w, err)
+	renderErrorPage(log, r, w, userErrorMessage(err, code), code)
+}
+
+// grpcErrorStatus logs a failed backend call and returns the HTTP status to
+// respond with, setting Retry-After where appropriate.
+func grpcErrorStatus(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error) int {
+	code := httpStatusFromGRPC(err)
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		log.WithField("route", routeName(r)).Warn("request deadline exceeded")
+		code = http.StatusGatewayTimeout
+	}
+	log.WithFields(logrus.Fields{
+		"error":     err,
+		"grpc.code": status.Code(errors.Cause(err)).String(),
+	}).Error("backend request error")
+
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	}
+	return code
+}
+
+// userErrorMessage strips the underlying cause from err, leaving only the
+// descriptions added while wrapping it.
+func userErrorMessage(err error, code int) string {
+	cause := errors.Cause(err)
+	if cause == err {
+		return http.StatusText(code)
+	}
+	return strings.TrimSuffix(err.Error(), ": "+cause.Error())
+}
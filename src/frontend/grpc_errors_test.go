@@ -0,0 +1,74 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHTTPStatusFromGRPC(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"not found", status.Error(codes.NotFound, "x"), http.StatusNotFound},
+		{"invalid argument", status.Error(codes.InvalidArgument, "x"), http.StatusBadRequest},
+		{"out of range", status.Error(codes.OutOfRange, "x"), http.StatusBadRequest},
+		{"unavailable", status.Error(codes.Unavailable, "x"), http.StatusServiceUnavailable},
+		{"deadline exceeded", status.Error(codes.DeadlineExceeded, "x"), http.StatusServiceUnavailable},
+		{"resource exhausted", status.Error(codes.ResourceExhausted, "x"), http.StatusTooManyRequests},
+		{"bulkhead full", errors.Wrap(&bulkheadFullError{"checkoutservice", 32}, "failed to complete the order"), http.StatusServiceUnavailable},
+		{"internal", status.Error(codes.Internal, "x"), http.StatusInternalServerError},
+		{"permission denied", status.Error(codes.PermissionDenied, "x"), http.StatusInternalServerError},
+		{"non-grpc error", errors.New("boom"), http.StatusInternalServerError},
+		{"wrapped", errors.Wrap(status.Error(codes.NotFound, "x"), "could not retrieve product"), http.StatusNotFound},
+		{"wrapped twice", errors.Wrap(errors.Wrap(status.Error(codes.Unavailable, "x"), "inner"), "outer"), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := httpStatusFromGRPC(tt.err); got != tt.want {
+				t.Errorf("httpStatusFromGRPC(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderGRPCError(t *testing.T) {
+	err := errors.Wrap(status.Error(codes.Unavailable, "dial tcp 10.0.0.1:7070: connection refused"), "could not retrieve cart")
+	w := httptest.NewRecorder()
+	renderGRPCError(discardLog, newTestRequest(http.MethodGet, "/cart", nil), w, err)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if got := w.Header().Get("Retry-After"); got == "" {
+		t.Error("missing Retry-After header")
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "could not retrieve cart") {
+		t.Error("error page does not contain the user-facing message")
+	}
+	if strings.Contains(body, "10.0.0.1") {
+		t.Error("error page leaks backend error details")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	grpcClientHedgesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_client_hedges_total",
+		Help: "Number of hedged unary gRPC calls, by service: a second attempt was sent after HEDGE_DELAY without a response.",
+	}, []string{"service"})
+	grpcClientHedgeWinsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_client_hedge_wins_total",
+		Help: "Number of hedged unary gRPC calls answered by the hedge rather than the first attempt, by service.",
+	}, []string{"service"})
+)
+
+// hedgedService is the service whose reads are hedged: catalog lookups are
+// many per page, so one slow GetProduct holds up the whole page.
+const hedgedService = "/hipstershop.ProductCatalogService/"
+
+// hedgePolicy sends a second attempt of a catalog read that has not been
+// answered after delay, and takes whichever answers first. A zero delay
+// disables hedging.
+type hedgePolicy struct {
+	delay time.Duration
+}
+
+var grpcHedge hedgePolicy
+
+// unaryInterceptor hedges idempotent catalog calls, at most once per call.
+// It comes after the retry interceptor in the chain, so each retry is a
+// hedged attempt of its own. Both attempts decode into replies of their own,
+// and the winner is copied into reply; the other attempt is canceled.
+func (p hedgePolicy) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	msg, ok := reply.(proto.Message)
+	if p.delay <= 0 || !ok || !idempotentMethods[method] || !strings.HasPrefix(method, hedgedService) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	type result struct {
+		reply proto.Message
+		err   error
+		hedge bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2) // buffered so that the loser need not be waited for
+	attempt := func(hedge bool) {
+		out := msg.ProtoReflect().New().Interface()
+		err := invoker(ctx, method, req, out, cc, opts...)
+		results <- result{out, err, hedge}
+	}
+
+	go attempt(false)
+	timer := time.NewTimer(p.delay)
+	defer timer.Stop()
+	var res result
+	select {
+	case res = <-results:
+	case <-timer.C:
+		service := grpcServiceName(method)
+		grpcClientHedgesTotal.WithLabelValues(service).Inc()
+		loggerFromContext(ctx).WithFields(logrus.Fields{
+			"grpc.target":    cc.Target(),
+			"grpc.method":    method,
+			"hedge.delay_ms": p.delay.Milliseconds(),
+		}).Debug("hedging grpc call")
+		go attempt(true)
+		// A failure of one attempt only counts once the other failed too.
+		if res = <-results; res.err != nil {
+			res = <-results
+		}
+		if res.hedge && res.err == nil {
+			grpcClientHedgeWinsTotal.WithLabelValues(service).Inc()
+		}
+	}
+	if res.err != nil {
+		return res.err
+	}
+	proto.Reset(msg)
+	proto.Merge(msg, res.reply)
+	return nil
+}
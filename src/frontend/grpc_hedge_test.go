@@ -0,0 +1,160 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const getProductMethod = "/hipstershop.ProductCatalogService/GetProduct"
+
+// hedgeTestConn is a connection that is never dialed, for the interceptor's
+// logs.
+func hedgeTestConn(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	cc, err := grpc.NewClient("passthrough:///unused", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+// scriptedInvoker answers the nth call with calls[n], counting the calls.
+type scriptedInvoker struct {
+	mu    sync.Mutex
+	n     int
+	calls []func(ctx context.Context, reply *pb.Product) error
+}
+
+func (s *scriptedInvoker) invoke(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+	s.mu.Lock()
+	call := s.calls[s.n]
+	s.n++
+	s.mu.Unlock()
+	return call(ctx, reply.(*pb.Product))
+}
+
+func (s *scriptedInvoker) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+func TestHedgeWins(t *testing.T) {
+	hedges := testutil.ToFloat64(grpcClientHedgesTotal.WithLabelValues("hipstershop.ProductCatalogService"))
+	wins := testutil.ToFloat64(grpcClientHedgeWinsTotal.WithLabelValues("hipstershop.ProductCatalogService"))
+	canceled := make(chan struct{})
+	inv := &scriptedInvoker{calls: []func(context.Context, *pb.Product) error{
+		func(ctx context.Context, reply *pb.Product) error {
+			<-ctx.Done()
+			close(canceled)
+			return status.FromContextError(ctx.Err()).Err()
+		},
+		func(_ context.Context, reply *pb.Product) error {
+			reply.Name = "Sunglasses"
+			return nil
+		},
+	}}
+
+	var reply pb.Product
+	err := hedgePolicy{delay: 10 * time.Millisecond}.unaryInterceptor(context.Background(), getProductMethod,
+		&pb.GetProductRequest{Id: "OLJCESPC7Z"}, &reply, hedgeTestConn(t), inv.invoke)
+	if err != nil || reply.GetName() != "Sunglasses" {
+		t.Fatalf("got %v, %v; want the hedge's reply", &reply, err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("the slow attempt was not canceled")
+	}
+	if got := testutil.ToFloat64(grpcClientHedgesTotal.WithLabelValues("hipstershop.ProductCatalogService")) - hedges; got != 1 {
+		t.Errorf("%v hedges counted, want 1", got)
+	}
+	if got := testutil.ToFloat64(grpcClientHedgeWinsTotal.WithLabelValues("hipstershop.ProductCatalogService")) - wins; got != 1 {
+		t.Errorf("%v hedge wins counted, want 1", got)
+	}
+}
+
+func TestHedgeNotSent(t *testing.T) {
+	slow := func(ctx context.Context, reply *pb.Product) error {
+		time.Sleep(30 * time.Millisecond)
+		return nil
+	}
+	fast := func(context.Context, *pb.Product) error { return nil }
+	for _, tc := range []struct {
+		name   string
+		policy hedgePolicy
+		method string
+		call   func(context.Context, *pb.Product) error
+	}{
+		{"fast answer", hedgePolicy{delay: 20 * time.Millisecond}, getProductMethod, fast},
+		{"disabled", hedgePolicy{}, getProductMethod, slow},
+		{"other service", hedgePolicy{delay: time.Millisecond}, "/hipstershop.CurrencyService/Convert", slow},
+		{"not idempotent", hedgePolicy{delay: time.Millisecond}, "/hipstershop.CheckoutService/PlaceOrder", slow},
+	} {
+		inv := &scriptedInvoker{calls: []func(context.Context, *pb.Product) error{tc.call, fast}}
+		if err := tc.policy.unaryInterceptor(context.Background(), tc.method, nil, &pb.Product{}, hedgeTestConn(t), inv.invoke); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if n := inv.count(); n != 1 {
+			t.Errorf("%s: %d attempts, want 1", tc.name, n)
+		}
+	}
+}
+
+// TestHedgeWithinRetry checks that a retry after a hedged attempt failed is
+// an attempt of its own, which may be hedged again, rather than a third
+// concurrent call.
+func TestHedgeWithinRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	inv := &scriptedInvoker{calls: []func(context.Context, *pb.Product) error{
+		func(context.Context, *pb.Product) error {
+			time.Sleep(30 * time.Millisecond)
+			return unavailable
+		},
+		func(context.Context, *pb.Product) error { return unavailable },
+		func(_ context.Context, reply *pb.Product) error {
+			reply.Name = "Sunglasses"
+			return nil
+		},
+	}}
+	hedge := hedgePolicy{delay: 10 * time.Millisecond}
+	retry := retryPolicy{maxRetries: 1, baseBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+	cc := hedgeTestConn(t)
+
+	var reply pb.Product
+	err := retry.unaryInterceptor(context.Background(), getProductMethod, nil, &reply, cc,
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			return hedge.unaryInterceptor(ctx, method, req, reply, cc, inv.invoke, opts...)
+		})
+	if err != nil || reply.GetName() != "Sunglasses" {
+		t.Fatalf("got %v, %v; want the retry's reply", &reply, err)
+	}
+	if n := inv.count(); n != 3 {
+		t.Errorf("%d attempts, want the first, its hedge and the retry", n)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+const defaultGRPCLBPolicy = "pick_first"
+
+// lbPolicies are the values accepted for GRPC_LB_POLICY. Each is registered
+// under a frontend_ prefix as a thin wrapper that records subchannel states
+// for /_readyz and logs resolved addresses. Both policies ask the resolver to
+// re-resolve when a subchannel fails, so a headless service whose pods are
+// replaced is picked up again by the DNS resolver.
+var lbPolicies = []string{"pick_first", "round_robin"}
+
+func init() {
+	for _, name := range lbPolicies {
+		balancer.Register(observedBalancerBuilder{child: name})
+	}
+}
+
+// lbServiceConfig is the default service config selecting policy.
+func lbServiceConfig(policy string) string {
+	return fmt.Sprintf(`{"loadBalancingConfig": [{"frontend_%s": {}}]}`, policy)
+}
+
+// subchannelStates is the state of every subchannel, i.e. backend address, by
+// canonical channel target.
+var subchannelStates = &subchannelRegistry{targets: make(map[string]map[string]connectivity.State)}
+
+type subchannelRegistry struct {
+	mu      sync.Mutex
+	targets map[string]map[string]connectivity.State
+}
+
+func (r *subchannelRegistry) set(target, addr string, state connectivity.State) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if state == connectivity.Shutdown {
+		delete(r.targets[target], addr)
+		return
+	}
+	if r.targets[target] == nil {
+		r.targets[target] = make(map[string]connectivity.State)
+	}
+	r.targets[target][addr] = state
+}
+
+func (r *subchannelRegistry) remove(target string) {
+	r.mu.Lock()
+	delete(r.targets, target)
+	r.mu.Unlock()
+}
+
+// get returns the states of target's subchannels by address.
+func (r *subchannelRegistry) get(target string) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.targets[target]) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(r.targets[target]))
+	for addr, state := range r.targets[target] {
+		out[addr] = state.String()
+	}
+	return out
+}
+
+type observedBalancerBuilder struct {
+	child string
+}
+
+func (b observedBalancerBuilder) Name() string { return "frontend_" + b.child }
+
+func (b observedBalancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	target := opts.Target.String()
+	return &observedBalancer{
+		Balancer: balancer.Get(b.child).Build(&observedClientConn{ClientConn: cc, target: target}, opts),
+		target:   target,
+		resolved: -1,
+	}
+}
+
+// ParseConfig hands the policy's config to the wrapped policy, so that
+// e.g. pick_first options still apply.
+func (b observedBalancerBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	if p, ok := balancer.Get(b.child).(balancer.ConfigParser); ok {
+		return p.ParseConfig(js)
+	}
+	return nil, nil
+}
+
+type observedBalancer struct {
+	balancer.Balancer
+	target   string
+	resolved int
+}
+
+func (b *observedBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	n := len(s.ResolverState.Endpoints)
+	if n == 0 {
+		n = len(s.ResolverState.Addresses)
+	}
+	if n != b.resolved {
+		b.resolved = n
+		log.WithFields(logrus.Fields{
+			"grpc.target":    b.target,
+			"grpc.addresses": n,
+		}).Info("resolved backend addresses")
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+func (b *observedBalancer) Close() {
+	b.Balancer.Close()
+	subchannelStates.remove(b.target)
+}
+
+// observedClientConn records the state of each subchannel the wrapped policy
+// creates.
+type observedClientConn struct {
+	balancer.ClientConn
+	target string
+}
+
+func (cc *observedClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	if len(addrs) > 0 && opts.StateListener != nil {
+		addr, listener := addrs[0].Addr, opts.StateListener
+		opts.StateListener = func(s balancer.SubConnState) {
+			subchannelStates.set(cc.target, addr, s.ConnectivityState)
+			listener(s)
+		}
+	}
+	return cc.ClientConn.NewSubConn(addrs, opts)
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// countingCurrency counts the calls one backend pod receives.
+type countingCurrency struct {
+	pb.UnimplementedCurrencyServiceServer
+	calls atomic.Int32
+}
+
+func (c *countingCurrency) GetSupportedCurrencies(context.Context, *pb.Empty) (*pb.GetSupportedCurrenciesResponse, error) {
+	c.calls.Add(1)
+	return &pb.GetSupportedCurrenciesResponse{CurrencyCodes: []string{"USD"}}, nil
+}
+
+// startPods serves n counting currency backends and returns their addresses.
+func startPods(t *testing.T, n int) ([]*countingCurrency, []resolver.Address) {
+	t.Helper()
+	var pods []*countingCurrency
+	var addrs []resolver.Address
+	for range n {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pod := new(countingCurrency)
+		srv := grpc.NewServer()
+		pb.RegisterCurrencyServiceServer(srv, pod)
+		go srv.Serve(lis)
+		t.Cleanup(srv.Stop)
+		pods = append(pods, pod)
+		addrs = append(addrs, resolver.Address{Addr: lis.Addr().String()})
+	}
+	return pods, addrs
+}
+
+func TestLBPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy     string
+		wantSpread bool
+	}{
+		{"round_robin", true},
+		{"pick_first", false},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			pods, addrs := startPods(t, 3)
+			r := manual.NewBuilderWithScheme("headless")
+			r.InitialState(resolver.State{Addresses: addrs})
+			opts := append(grpcConnConfig{lbPolicy: tc.policy}.dialOptions(),
+				grpc.WithResolvers(r), grpc.WithTransportCredentials(insecure.NewCredentials()))
+			conn, err := grpc.NewClient("headless:///currencyservice", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			client := pb.NewCurrencyServiceClient(conn)
+			for range 30 {
+				if _, err := client.GetSupportedCurrencies(ctx, &pb.Empty{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var served int
+			for _, pod := range pods {
+				if pod.calls.Load() > 0 {
+					served++
+				}
+			}
+			if spread := served == len(pods); spread != tc.wantSpread || served == 0 {
+				t.Errorf("%d of %d pods served calls", served, len(pods))
+			}
+
+			st := connStatus(conn)
+			if tc.wantSpread && len(st.Subchannels) != len(pods) {
+				t.Errorf("subchannels = %v, want one per pod", st.Subchannels)
+			}
+			for addr, state := range st.Subchannels {
+				if tc.wantSpread && state != "READY" {
+					t.Errorf("subchannel %s is %s", addr, state)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCConnConfigLBPolicyFromEnv(t *testing.T) {
+	t.Setenv("GRPC_LB_POLICY", "round_robin")
+	var l envLoader
+	if got := grpcConnConfigsFromEnv(&l)["cartservice"].lbPolicy; got != "round_robin" || l.err() != nil {
+		t.Errorf("lbPolicy = %q, %v; want round_robin", got, l.err())
+	}
+	t.Setenv("GRPC_LB_POLICY", "random")
+	l = envLoader{}
+	if got := grpcConnConfigsFromEnv(&l)["cartservice"].lbPolicy; got != defaultGRPCLBPolicy || l.err() == nil {
+		t.Errorf("invalid policy: lbPolicy = %q, %v; want the default and a problem", got, l.err())
+	}
+}
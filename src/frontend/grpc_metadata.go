@@ -0,0 +1,81 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// backendMetadataKeys names the gRPC metadata that carries the user's
+// session, request ID and currency to the backends, so that their logs can
+// be correlated with the frontend's.
+type backendMetadataKeys struct {
+	session   string
+	requestID string
+	currency  string
+}
+
+// backendMetadata applies to every backend connection; main sets it from
+// the configuration.
+var backendMetadata = backendMetadataKeys{
+	session:   "x-session-id",
+	requestID: "x-request-id",
+	currency:  "x-currency",
+}
+
+// metadataKeyPattern matches the metadata keys gRPC accepts for ASCII values.
+// Keys starting with grpc- are reserved.
+var metadataKeyPattern = regexp.MustCompile(`^[0-9a-z_.-]+$`)
+
+// backendMetadataFromEnv reads GRPC_METADATA_SESSION_KEY,
+// GRPC_METADATA_REQUEST_ID_KEY and GRPC_METADATA_CURRENCY_KEY. Keys are
+// case-insensitive, as in HTTP/2 headers.
+func backendMetadataFromEnv(l *envLoader) backendMetadataKeys {
+	key := func(env, def string) string {
+		v := strings.ToLower(l.str(env, def))
+		if !metadataKeyPattern.MatchString(v) || strings.HasPrefix(v, "grpc-") || strings.HasSuffix(v, "-bin") {
+			l.problem("%s: %q is not a gRPC metadata key", env, v)
+		}
+		return v
+	}
+	return backendMetadataKeys{
+		session:   key("GRPC_METADATA_SESSION_KEY", backendMetadata.session),
+		requestID: key("GRPC_METADATA_REQUEST_ID_KEY", backendMetadata.requestID),
+		currency:  key("GRPC_METADATA_CURRENCY_KEY", backendMetadata.currency),
+	}
+}
+
+// unaryInterceptor adds the session, request ID and currency of the request
+// that ctx belongs to as outgoing metadata. Calls made outside of a session,
+// such as readiness probes and background refreshes, are left alone.
+func (k backendMetadataKeys) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if session, ok := ctx.Value(ctxKeySessionID{}).(string); ok && session != "" {
+		kv := []string{k.session, session}
+		if id, ok := ctx.Value(ctxKeyRequestID{}).(string); ok && id != "" {
+			kv = append(kv, k.requestID, id)
+		}
+		if cur, ok := ctx.Value(ctxKeyCurrency{}).(string); ok && cur != "" {
+			kv = append(kv, k.currency, cur)
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, kv...)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
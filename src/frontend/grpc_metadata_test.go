@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// captureMetadata returns a frontend whose backend calls go through keys,
+// and a function returning the outgoing metadata of the last call.
+func captureMetadata(t *testing.T, keys backendMetadataKeys) (*frontendServer, func() metadata.MD) {
+	var md metadata.MD
+	capture := func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	fe := newTestFrontend(t, newFakeBackend(), grpc.WithChainUnaryInterceptor(keys.unaryInterceptor, capture))
+	return fe, func() metadata.MD { return md }
+}
+
+func TestBackendMetadata(t *testing.T) {
+	fe, last := captureMetadata(t, backendMetadata)
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EUR"})
+	ctx := context.WithValue(r.Context(), ctxKeyRequestID{}, "req-1234")
+	fe.ensureCurrency(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if _, err := fe.getCart(r.Context(), sessionID(r)); err != nil {
+			t.Fatal(err)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+	want := metadata.MD{"x-session-id": {"test-session"}, "x-request-id": {"req-1234"}, "x-currency": {"EUR"}}
+	if got := last(); !reflect.DeepEqual(got, want) {
+		t.Errorf("metadata = %v, want %v", got, want)
+	}
+
+	// A forged currency cookie is not passed on.
+	r = newTestRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EURO"})
+	fe.ensureCurrency(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		fe.getCart(r.Context(), sessionID(r))
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if got := last(); !reflect.DeepEqual(got, metadata.MD{"x-session-id": {"test-session"}}) {
+		t.Errorf("invalid currency cookie: metadata = %v", got)
+	}
+
+	if _, err := fe.getCurrencies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := last(); len(got) != 0 {
+		t.Errorf("call without a session: metadata = %v, want none", got)
+	}
+}
+
+func TestBackendMetadataFromEnv(t *testing.T) {
+	t.Setenv("GRPC_METADATA_SESSION_KEY", "X-Shop-Session")
+	var l envLoader
+	keys := backendMetadataFromEnv(&l)
+	if want := (backendMetadataKeys{"x-shop-session", "x-request-id", "x-currency"}); keys != want || l.err() != nil {
+		t.Errorf("keys = %+v, %v; want %+v", keys, l.err(), want)
+	}
+
+	for _, v := range []string{"grpc-session", "x-session-bin", "x session"} {
+		t.Setenv("GRPC_METADATA_REQUEST_ID_KEY", v)
+		var l envLoader
+		backendMetadataFromEnv(&l)
+		if l.err() == nil {
+			t.Errorf("%q accepted as a metadata key", v)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// grpcTransport decides how each backend connection is secured. The zero
+// value dials every backend in plaintext.
+type grpcTransport struct {
+	tls  *tls.Config
+	skip map[string]bool
+}
+
+// backendTransport applies to every backend connection; main sets it from
+// the environment before dialing.
+var backendTransport grpcTransport
+
+// grpcTransportFromEnv reads GRPC_TLS_ENABLED and, when it is "true",
+// GRPC_TLS_CA_FILE (the system roots are used if unset), GRPC_TLS_CERT_FILE
+// and GRPC_TLS_KEY_FILE for a client certificate, and GRPC_TLS_SKIP_SERVICES,
+// a comma-separated list of services that are still dialed in plaintext.
+func grpcTransportFromEnv() (grpcTransport, error) {
+	if os.Getenv("GRPC_TLS_ENABLED") != "true" {
+		return grpcTransport{}, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile := os.Getenv("GRPC_TLS_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return grpcTransport{}, errors.Wrapf(err, "failed to read GRPC_TLS_CA_FILE %s", caFile)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return grpcTransport{}, errors.Errorf("GRPC_TLS_CA_FILE %s contains no PEM certificates", caFile)
+		}
+	}
+
+	certFile, keyFile := os.Getenv("GRPC_TLS_CERT_FILE"), os.Getenv("GRPC_TLS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return grpcTransport{}, errors.New("GRPC_TLS_CERT_FILE and GRPC_TLS_KEY_FILE must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return grpcTransport{}, errors.Wrapf(err, "failed to load client certificate %s with key %s", certFile, keyFile)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	skip := make(map[string]bool)
+	for _, s := range strings.Split(os.Getenv("GRPC_TLS_SKIP_SERVICES"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			skip[s] = true
+		}
+	}
+	return grpcTransport{tls: config, skip: skip}, nil
+}
+
+// credentials returns the transport credentials for the named service.
+func (t grpcTransport) credentials(service string) grpc.DialOption {
+	if t.tls == nil || t.skip[service] {
+		return grpc.WithTransportCredentials(insecure.NewCredentials())
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(t.tls))
+}
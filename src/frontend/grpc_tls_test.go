@@ -0,0 +1,199 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// testPKI is a CA with a server certificate for 127.0.0.1 and a client
+// certificate, written to a temporary directory.
+type testPKI struct {
+	dir    string
+	caPool *x509.CertPool
+	server tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	p := &testPKI{dir: t.TempDir(), caPool: x509.NewCertPool()}
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ = x509.ParseCertificate(caDER)
+	p.caPool.AddCert(ca)
+	p.write(t, "ca.crt", "CERTIFICATE", caDER)
+
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		p.write(t, name+".crt", "CERTIFICATE", der)
+		p.write(t, name+".key", "EC PRIVATE KEY", keyDER)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	p.server = issue("server", 2, x509.ExtKeyUsageServerAuth)
+	issue("client", 3, x509.ExtKeyUsageClientAuth)
+	return p
+}
+
+func (p *testPKI) write(t *testing.T, name, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(p.dir, name), pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *testPKI) path(name string) string { return filepath.Join(p.dir, name) }
+
+// startTLSBackend serves the fake currency service over TLS, requiring a
+// client certificate signed by the test CA.
+func startTLSBackend(t *testing.T, p *testPKI) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{p.server},
+		ClientCAs:    p.caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+	pb.RegisterCurrencyServiceServer(srv, newFakeBackend())
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// callBackend makes one call to addr using tr's credentials for service.
+func callBackend(t *testing.T, tr grpcTransport, service, addr string) error {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, tr.credentials(service))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = pb.NewCurrencyServiceClient(conn).GetSupportedCurrencies(ctx, &pb.Empty{})
+	return err
+}
+
+func TestGRPCTransportMutualTLS(t *testing.T) {
+	p := newTestPKI(t)
+	addr := startTLSBackend(t, p)
+	t.Setenv("GRPC_TLS_ENABLED", "true")
+	t.Setenv("GRPC_TLS_CA_FILE", p.path("ca.crt"))
+	t.Setenv("GRPC_TLS_CERT_FILE", p.path("client.crt"))
+	t.Setenv("GRPC_TLS_KEY_FILE", p.path("client.key"))
+	t.Setenv("GRPC_TLS_SKIP_SERVICES", "adservice, collector")
+
+	tr, err := grpcTransportFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callBackend(t, tr, "currencyservice", addr); err != nil {
+		t.Errorf("call over mTLS failed: %v", err)
+	}
+	if err := callBackend(t, tr, "adservice", addr); err == nil {
+		t.Error("skipped service was dialed with TLS")
+	}
+
+	t.Setenv("GRPC_TLS_CERT_FILE", "")
+	t.Setenv("GRPC_TLS_KEY_FILE", "")
+	tr, err = grpcTransportFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callBackend(t, tr, "currencyservice", addr); err == nil {
+		t.Error("call without a client certificate succeeded")
+	}
+}
+
+func TestGRPCTransportPlaintextByDefault(t *testing.T) {
+	tr, err := grpcTransportFromEnv()
+	if err != nil || tr.tls != nil {
+		t.Fatalf("got %+v, %v; want plaintext", tr, err)
+	}
+	fe := newTestFrontend(t, newFakeBackend())
+	if err := callBackend(t, tr, "currencyservice", fe.currencySvcConn.Target()); err != nil {
+		t.Errorf("plaintext call failed: %v", err)
+	}
+}
+
+func TestGRPCTransportFromEnvErrors(t *testing.T) {
+	p := newTestPKI(t)
+	for _, tc := range []struct {
+		name, wantFile string
+		env            map[string]string
+	}{
+		{"missing CA", "missing.crt", map[string]string{"GRPC_TLS_CA_FILE": p.path("missing.crt")}},
+		{"CA not PEM", "client.key", map[string]string{"GRPC_TLS_CA_FILE": p.path("client.key")}},
+		{"cert without key", "GRPC_TLS_KEY_FILE", map[string]string{"GRPC_TLS_CERT_FILE": p.path("client.crt")}},
+		{"mismatched key", "client.crt", map[string]string{"GRPC_TLS_CERT_FILE": p.path("client.crt"), "GRPC_TLS_KEY_FILE": p.path("server.key")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("GRPC_TLS_ENABLED", "true")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			_, err := grpcTransportFromEnv()
+			if err == nil || !strings.Contains(err.Error(), tc.wantFile) {
+				t.Errorf("got error %v, want one naming %s", err, tc.wantFile)
+			}
+		})
+	}
+}
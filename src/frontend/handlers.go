@@ -16,14 +16,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"html/template"
-	"io"
-	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -31,7 +30,9 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/featureflags"
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
 	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
@@ -43,50 +44,70 @@ type platformDetails struct {
 }
 
 var (
-	frontendMessage  = strings.TrimSpace(os.Getenv("FRONTEND_MESSAGE"))
-	isCymbalBrand    = "true" == strings.ToLower(os.Getenv("CYMBAL_BRANDING"))
-	assistantEnabled = "true" == strings.ToLower(os.Getenv("ENABLE_ASSISTANT"))
-	templates        = template.Must(template.New("").
-				Funcs(template.FuncMap{
-			"renderMoney":        renderMoney,
-			"renderCurrencyLogo": renderCurrencyLogo,
-		}).ParseGlob("templates/*.html"))
-	plat platformDetails
+	frontendMessage = strings.TrimSpace(os.Getenv("FRONTEND_MESSAGE"))
+	isCymbalBrand   = "true" == strings.ToLower(os.Getenv("CYMBAL_BRANDING"))
+	plat            platformDetails
 )
 
+// assistantEnabled shows the assistant link in the header, see
+// featuresFromEnv.
+var assistantEnabled bool
+
 var validEnvs = []string{"local", "gcp", "azure", "aws", "onprem", "alibaba"}
 
 func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	log.WithField("currency", currentCurrency(r)).Info("home")
-	currencies, err := fe.getCurrencies(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+
+	if r.Method == http.MethodHead {
+		products, err := fe.getProducts(r.Context())
+		if err != nil {
+			renderGRPCError(log, r, w, errors.Wrap(err, "could not retrieve products"))
+			return
+		}
+		answerHead(w, r, fe.pageETag(r, products...), 0)
 		return
 	}
-	products, err := fe.getProducts(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve products"), http.StatusInternalServerError)
+
+	// The backend calls below are independent, so issue them concurrently and
+	// pay only for the slowest one. The header and ads are not critical and
+	// never fail the group; a missing ad just leaves the slot empty.
+	var (
+		common   templateData
+		products []*pb.Product
+		ads      []*pb.Ad
+		recent   []productView
+	)
+	g, gctx := errgroup.WithContext(r.Context())
+	g.Go(func() error {
+		common = fe.commonTemplateData(gctx, r)
+		return nil
+	})
+	g.Go(func() (err error) {
+		products, err = fe.getProducts(gctx)
+		return errors.Wrap(err, "could not retrieve products")
+	})
+	g.Go(func() error {
+		ads = fe.chooseAds(gctx, []string{}, log)
+		return nil
+	})
+	g.Go(func() error {
+		recent = fe.recentlyViewedProducts(gctx, log, fe.recentlyViewed(r), "", currentCurrency(r))
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		renderGRPCError(log, r, w, err)
 		return
 	}
-	cart, err := fe.getCart(r.Context(), sessionID(r))
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+	etag := fe.pageETag(r, products...)
+	if notModified(w, r, etag, 0) {
 		return
 	}
 
-	type productView struct {
-		Item  *pb.Product
-		Price *pb.Money
-	}
-	ps := make([]productView, len(products))
-	for i, p := range products {
-		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "failed to do currency conversion for product %s", p.GetId()), http.StatusInternalServerError)
-			return
-		}
-		ps[i] = productView{p, price}
+	ps, err := fe.priceProducts(r.Context(), products, currentCurrency(r))
+	if err != nil {
+		renderGRPCError(log, r, w, err)
+		return
 	}
 
 	// Set ENV_PLATFORM (default to local if not set; use env var if set; otherwise detect GCP, which overrides env)_
@@ -107,18 +128,88 @@ func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 	plat = platformDetails{}
 	plat.setPlatformDetails(strings.ToLower(env))
 
-	if err := templates.ExecuteTemplate(w, "home", injectCommonTemplateData(r, map[string]interface{}{
-		"show_currency": true,
-		"currencies":    currencies,
-		"products":      ps,
-		"cart_size":     cartSize(cart),
-		"banner_color":  os.Getenv("BANNER_COLOR"), // illustrates canary deployments
-		"ad":            fe.chooseAd(r.Context(), []string{}, log),
+	setPageCacheHeaders(w, etag, 0)
+	if err := templates.ExecuteTemplate(w, "home", common.with(map[string]interface{}{
+		"products":        ps,
+		"ads":             ads,
+		"recently_viewed": recent,
 	})); err != nil {
 		log.Error(err)
 	}
 }
 
+// productView is a product with its price in the user's currency.
+type productView struct {
+	Item  *pb.Product
+	Price *pb.Money
+	// CompareAt is the price before the sale the product is on, nil if it
+	// is not on sale.
+	CompareAt *pb.Money
+}
+
+func (fe *frontendServer) priceProducts(ctx context.Context, products []*pb.Product, currency string) ([]productView, error) {
+	ps := make([]productView, len(products))
+	for i, p := range products {
+		price, compareAt, err := fe.productPrice(ctx, p, currency)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to do currency conversion for product %s", p.GetId())
+		}
+		ps[i] = productView{p, price, compareAt}
+	}
+	return ps, nil
+}
+
+func (fe *frontendServer) searchHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	query := strings.TrimSpace(r.FormValue("q"))
+	if query == "" {
+		w.Header().Set("Location", baseUrl+"/")
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	payload := validator.SearchPayload{Query: query}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusBadRequest)
+		return
+	}
+	log.WithField("query", query).Debug("searching products")
+	if r.Method == http.MethodHead {
+		answerHead(w, r, "", 0)
+		return
+	}
+
+	var (
+		common  templateData
+		results []*pb.Product
+	)
+	g, gctx := errgroup.WithContext(r.Context())
+	g.Go(func() error {
+		common = fe.commonTemplateData(gctx, r)
+		return nil
+	})
+	g.Go(func() (err error) {
+		results, err = fe.searchProducts(gctx, query)
+		return errors.Wrap(err, "could not search products")
+	})
+	if err := g.Wait(); err != nil {
+		renderGRPCError(log, r, w, err)
+		return
+	}
+	ps, err := fe.priceProducts(r.Context(), results, currentCurrency(r))
+	if err != nil {
+		renderGRPCError(log, r, w, err)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "search", common.with(map[string]interface{}{
+		"ads":          fe.chooseAds(r.Context(), strings.Fields(query), log),
+		"search_query": query,
+		"products":     ps,
+	})); err != nil {
+		log.Println(err)
+	}
+}
+
 func (plat *platformDetails) setPlatformDetails(env string) {
 	if env == "aws" {
 		plat.provider = "AWS"
@@ -142,7 +233,7 @@ func (plat *platformDetails) setPlatformDetails(env string) {
 }
 
 func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	id := mux.Vars(r)["id"]
 	if id == "" {
 		renderHTTPError(log, r, w, errors.New("product id not specified"), http.StatusBadRequest)
@@ -153,204 +244,629 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 
 	p, err := fe.getProduct(r.Context(), id)
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
+		renderGRPCError(log, r, w, errors.Wrap(err, "could not retrieve product"))
 		return
 	}
-	currencies, err := fe.getCurrencies(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+	if r.Method == http.MethodHead {
+		answerHead(w, r, fe.pageETag(r, p), fe.productPageMaxAge)
 		return
 	}
-
-	cart, err := fe.getCart(r.Context(), sessionID(r))
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+	// The strip shows the products viewed before this one, so the ETag of
+	// the page is computed before it is recorded.
+	etag := fe.pageETag(r, p)
+	recentIDs := fe.recentlyViewed(r)
+	if !isBot(r.Context()) {
+		fe.rememberViewed(w, r, id)
+	}
+	if notModified(w, r, etag, fe.productPageMaxAge) {
+		return
+	}
+	var (
+		common templateData
+		cart   []*pb.CartItem
+	)
+	g, gctx := errgroup.WithContext(r.Context())
+	g.Go(func() error {
+		common = fe.commonTemplateData(gctx, r)
+		return nil
+	})
+	g.Go(func() (err error) {
+		cart, err = fe.getCart(gctx, sessionID(r))
+		return errors.Wrap(err, "could not retrieve cart")
+	})
+	if err := g.Wait(); err != nil {
+		renderGRPCError(log, r, w, err)
 		return
 	}
 
-	price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
+	price, compareAt, err := fe.productPrice(r.Context(), p, currentCurrency(r))
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to convert currency"), http.StatusInternalServerError)
+		renderGRPCError(log, r, w, errors.Wrap(err, "failed to convert currency"))
 		return
 	}
 
 	// ignores the error retrieving recommendations since it is not critical
-	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), []string{id})
+	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), append(cartIDs(cart), id))
 	if err != nil {
 		log.WithField("error", err).Warn("failed to get product recommendations")
 	}
 
-	product := struct {
-		Item  *pb.Product
-		Price *pb.Money
-	}{p, price}
+	product := productView{p, price, compareAt}
 
 	// Fetch packaging info (weight/dimensions) of the product
 	// The packaging service is an optional microservice you can run as part of a Google Cloud demo.
 	var packagingInfo *PackagingInfo = nil
 	if isPackagingServiceConfigured() {
-		packagingInfo, err = httpGetPackagingInfo(id)
+		packagingInfo, err = httpGetPackagingInfo(r.Context(), id)
 		if err != nil {
 			fmt.Println("Failed to obtain product's packaging info:", err)
 		}
 	}
 
-	if err := templates.ExecuteTemplate(w, "product", injectCommonTemplateData(r, map[string]interface{}{
-		"ad":              fe.chooseAd(r.Context(), p.Categories, log),
-		"show_currency":   true,
-		"currencies":      currencies,
+	recent := fe.recentlyViewedProducts(r.Context(), log, recentIDs, id, currentCurrency(r))
+
+	setPageCacheHeaders(w, etag, fe.productPageMaxAge)
+	if err := templates.ExecuteTemplate(w, "product", common.with(map[string]interface{}{
+		"ads":             fe.chooseAds(r.Context(), p.Categories, log),
 		"product":         product,
 		"recommendations": recommendations,
-		"cart_size":       cartSize(cart),
 		"packagingInfo":   packagingInfo,
+		"recently_viewed": recent,
+		"stock":           fe.stock.view(id),
+		"quantities":      fe.stock.quantityChoices(id),
+		"variants":        fe.productVariants(p),
+		"product_meta":    newProductMeta(p, price, fe.origin(r), fe.origin(r)+baseUrl+"/product/"+url.PathEscape(p.GetId())),
 	})); err != nil {
 		log.Println(err)
 	}
 }
 
+// addToCartHandler adds a product to the cart and redirects to it, or, for
+// the shop's scripts (see isXHR), answers with the updated cart in JSON so
+// the page need not be reloaded.
 func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
+	xhr := isXHR(r)
 	quantity, _ := strconv.ParseUint(r.FormValue("quantity"), 10, 32)
 	productID := r.FormValue("product_id")
 	payload := validator.AddToCartPayload{
 		Quantity:  quantity,
 		ProductID: productID,
+		Variant:   r.FormValue("variant"),
 	}
 	if err := payload.Validate(); err != nil {
+		if xhr {
+			reason := "invalid_product"
+			if _, ok := validator.FieldErrors(err)["quantity"]; ok {
+				reason = "invalid_quantity"
+			}
+			renderAPIErrorReason(log, r, w, validator.ValidationErrorResponse(err), http.StatusBadRequest, reason)
+			return
+		}
 		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
 		return
 	}
-	log.WithField("product", payload.ProductID).WithField("quantity", payload.Quantity).Debug("adding to cart")
+	log.WithField("product", payload.ProductID).WithField("variant", payload.Variant).
+		WithField("quantity", payload.Quantity).Debug("adding to cart")
 
-	p, err := fe.getProduct(r.Context(), payload.ProductID)
+	p, err := fe.addToCart(r, payload)
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
+		var refused *cartRefusal
+		switch {
+		case errors.As(err, &refused) && xhr:
+			renderAPIErrorReason(log, r, w, err, refused.apiStatus, refused.reason)
+		case errors.As(err, &refused):
+			renderHTTPError(log, r, w, err, refused.status)
+		case xhr && httpStatusFromGRPC(err) == http.StatusNotFound:
+			renderAPIErrorReason(log, r, w, err, http.StatusBadRequest, "unknown_product")
+		case xhr:
+			renderAPIGRPCError(log, r, w, err)
+		default:
+			renderGRPCError(log, r, w, err)
+		}
 		return
 	}
-
-	if err := fe.insertCart(r.Context(), sessionID(r), p.GetId(), int32(payload.Quantity)); err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to add to cart"), http.StatusInternalServerError)
+	fe.audit.record(r, auditRecord{action: auditAddToCart, items: []auditItem{{ProductID: p.GetId(), Variant: payload.Variant, Quantity: int32(payload.Quantity)}}})
+	bumpCartVersion(w)
+	if xhr {
+		writeJSON(log, w, http.StatusOK, fe.addedToCart(r, p, payload.Variant, int32(payload.Quantity)))
 		return
 	}
-	w.Header().Set("location", baseUrl + "/cart")
+	fe.flash(w, r, flashSuccess, "flash.added_to_cart", "quantity", payload.Quantity, "product", p.GetName())
+	w.Header().Set("location", baseUrl+"/cart")
 	w.WriteHeader(http.StatusFound)
 }
 
+// cartRefusal is an addition to the cart refused for the product or its
+// cart line rather than for a failed backend call, with the status of the
+// page and of the API answer, and the reason of the latter.
+type cartRefusal struct {
+	err       error
+	status    int
+	apiStatus int
+	reason    string
+}
+
+func (e *cartRefusal) Error() string { return e.err.Error() }
+
+// addToCart adds payload, which must have been validated, to the session's cart and returns the
+// product added. The error is a *cartRefusal, or that of a failed backend
+// call wrapped with a message fit for users.
+func (fe *frontendServer) addToCart(r *http.Request, payload validator.AddToCartPayload) (*pb.Product, error) {
+	p, err := fe.getProduct(r.Context(), payload.ProductID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not retrieve product")
+	}
+
+	if variants := fe.productVariants(p); len(variants) > 0 && !fe.hasVariant(p, payload.Variant) ||
+		len(variants) == 0 && payload.Variant != "" {
+		err := errors.Errorf("%q is not a variant of %s, choose one of %q", payload.Variant, p.GetName(), variants)
+		return nil, &cartRefusal{err, http.StatusUnprocessableEntity, http.StatusBadRequest, "invalid_variant"}
+	}
+
+	// The cart line before the addition tells the stock already taken and
+	// the variants still in the cart.
+	var inCart *pb.CartItem
+	if _, limited := fe.stock.available(p.GetId()); limited || payload.Variant != "" {
+		cart, err := fe.getCart(r.Context(), sessionID(r))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not retrieve cart")
+		}
+		for _, it := range cart {
+			if it.GetProductId() == p.GetId() {
+				inCart = it
+			}
+		}
+		if err := fe.stock.check(p.GetId(), int(inCart.GetQuantity())+int(payload.Quantity)); err != nil {
+			err = errors.Wrapf(err, "could not add %s to the cart", p.GetName())
+			return nil, &cartRefusal{err, http.StatusConflict, http.StatusConflict, "out_of_stock"}
+		}
+	}
+
+	if err := fe.insertCart(r.Context(), sessionID(r), p.GetId(), int32(payload.Quantity)); err != nil {
+		return nil, errors.Wrap(err, "failed to add to cart")
+	}
+	if payload.Variant != "" {
+		variants := sessionCartVariants(r)
+		variants.sync(p.GetId(), inCart)
+		current, _ := variants.line(inCart, payload.Variant)
+		variants.set(p.GetId(), payload.Variant, current+int32(payload.Quantity))
+		saveCartVariants(r, variants)
+	}
+	return p, nil
+}
+
 func (fe *frontendServer) emptyCartHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	log.Debug("emptying cart")
 
 	if err := fe.emptyCart(r.Context(), sessionID(r)); err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to empty cart"), http.StatusInternalServerError)
+		renderGRPCError(log, r, w, errors.Wrap(err, "failed to empty cart"))
 		return
 	}
-	w.Header().Set("location", baseUrl + "/")
+	fe.audit.record(r, auditRecord{action: auditEmptyCart})
+	saveCartVariants(r, cartVariants{})
+	bumpCartVersion(w)
+	fe.flash(w, r, flashInfo, "flash.cart_emptied")
+	w.Header().Set("location", baseUrl+"/")
 	w.WriteHeader(http.StatusFound)
 }
 
-func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
-	log.Debug("view user cart")
-	currencies, err := fe.getCurrencies(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+// removeFromCartHandler removes a line of the cart: the product, or only one
+// of its variants.
+func (fe *frontendServer) removeFromCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	payload := validator.RemoveFromCartPayload{ProductID: r.FormValue("product_id"), Variant: r.FormValue("variant")}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
 		return
 	}
+	log.WithField("product", payload.ProductID).WithField("variant", payload.Variant).Debug("removing from cart")
+
 	cart, err := fe.getCart(r.Context(), sessionID(r))
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+		renderGRPCError(log, r, w, errors.Wrap(err, "could not retrieve cart"))
+		return
+	}
+	variants := sessionCartVariants(r)
+	var found bool
+	remaining := make([]*pb.CartItem, 0, len(cart))
+	for _, item := range cart {
+		if item.GetProductId() != payload.ProductID {
+			remaining = append(remaining, item)
+			continue
+		}
+		variants.sync(item.GetProductId(), item)
+		var line int32
+		if line, found = variants.line(item, payload.Variant); found && item.GetQuantity() > line {
+			remaining = append(remaining, &pb.CartItem{ProductId: item.GetProductId(), Quantity: item.GetQuantity() - line})
+		}
+	}
+	if !found {
+		renderHTTPError(log, r, w, errors.Errorf("product %s is not in the cart", cartLineName(payload.ProductID, payload.Variant)), http.StatusBadRequest)
 		return
 	}
 
-	// ignores the error retrieving recommendations since it is not critical
-	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), cartIDs(cart))
+	if err := fe.replaceCart(r.Context(), sessionID(r), remaining); err != nil {
+		renderGRPCError(log, r, w, errors.Wrap(err, "failed to remove from cart"))
+		return
+	}
+	variants.set(payload.ProductID, payload.Variant, 0)
+	saveCartVariants(r, variants)
+	bumpCartVersion(w)
+	w.Header().Set("location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+// cleanUpCartHandler removes the lines of the products the catalog no longer
+// has from the cart, so that the order can be placed.
+func (fe *frontendServer) cleanUpCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	log.Debug("removing unavailable products from cart")
+
+	cart, err := fe.getCart(r.Context(), sessionID(r))
 	if err != nil {
-		log.WithField("error", err).Warn("failed to get product recommendations")
+		renderGRPCError(log, r, w, errors.Wrap(err, "could not retrieve cart"))
+		return
 	}
+	_, missing, err := fe.lookupProducts(r.Context(), cartIDs(cart), currentCurrency(r))
+	if err != nil {
+		renderGRPCError(log, r, w, err)
+		return
+	}
+	if len(missing) > 0 {
+		unavailable := make(map[string]bool, len(missing))
+		for _, id := range missing {
+			unavailable[id] = true
+		}
+		remaining := make([]*pb.CartItem, 0, len(cart))
+		for _, item := range cart {
+			if !unavailable[item.GetProductId()] {
+				remaining = append(remaining, item)
+			}
+		}
+		if err := fe.replaceCart(r.Context(), sessionID(r), remaining); err != nil {
+			renderGRPCError(log, r, w, errors.Wrap(err, "failed to remove from cart"))
+			return
+		}
+		variants := sessionCartVariants(r)
+		for _, id := range missing {
+			variants.sync(id, nil)
+		}
+		saveCartVariants(r, variants)
+		bumpCartVersion(w)
+		log.WithField("products", missing).Info("removed unavailable products from cart")
+	}
+	w.Header().Set("location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
 
-	shippingCost, err := fe.getShippingQuote(r.Context(), cart, currentCurrency(r))
+// updateCartHandler sets the quantity of a line of the cart: the product, or
+// one of its variants.
+func (fe *frontendServer) updateCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	quantity, err := strconv.ParseInt(r.FormValue("quantity"), 10, 32)
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get shipping quote"), http.StatusInternalServerError)
+		renderHTTPError(log, r, w, errors.Errorf("quantity must be a whole number between 0 and %d", cartMaxQuantity), http.StatusUnprocessableEntity)
 		return
 	}
+	payload := validator.UpdateCartPayload{
+		ProductID:   r.FormValue("product_id"),
+		Variant:     r.FormValue("variant"),
+		Quantity:    quantity,
+		MaxQuantity: int64(cartMaxQuantity),
+	}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
+	log.WithField("product", payload.ProductID).WithField("variant", payload.Variant).
+		WithField("quantity", payload.Quantity).Debug("updating cart")
 
-	type cartItemView struct {
-		Item     *pb.Product
-		Quantity int32
-		Price    *pb.Money
+	cart, err := fe.getCart(r.Context(), sessionID(r))
+	if err != nil {
+		renderGRPCError(log, r, w, errors.Wrap(err, "could not retrieve cart"))
+		return
 	}
-	items := make([]cartItemView, len(cart))
-	totalPrice := pb.Money{CurrencyCode: currentCurrency(r)}
-	for i, item := range cart {
-		p, err := fe.getProduct(r.Context(), item.GetProductId())
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId()), http.StatusInternalServerError)
-			return
+	variants := sessionCartVariants(r)
+	var current, total int32 = -1, 0
+	desired := make([]*pb.CartItem, 0, len(cart))
+	for _, item := range cart {
+		if item.GetProductId() != payload.ProductID {
+			desired = append(desired, item)
+			continue
 		}
-		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId()), http.StatusInternalServerError)
+		variants.sync(item.GetProductId(), item)
+		line, ok := variants.line(item, payload.Variant)
+		if !ok {
+			continue
+		}
+		// The other variants of the product keep their quantities.
+		current = item.GetQuantity()
+		total = current - line + int32(payload.Quantity)
+		if total > 0 {
+			desired = append(desired, &pb.CartItem{ProductId: item.GetProductId(), Quantity: total})
+		}
+	}
+	if current < 0 {
+		renderHTTPError(log, r, w, errors.Errorf("product %s is not in the cart", cartLineName(payload.ProductID, payload.Variant)), http.StatusBadRequest)
+		return
+	}
+	if total > current {
+		if err := fe.stock.check(payload.ProductID, int(total)); err != nil {
+			renderHTTPError(log, r, w, errors.Wrap(err, "failed to update cart"), http.StatusConflict)
 			return
 		}
+	}
+
+	// Increases can be applied in place; anything else requires rebuilding
+	// the cart since the cart service cannot shrink a line.
+	switch delta := total - current; {
+	case delta > 0:
+		err = fe.insertCart(r.Context(), sessionID(r), payload.ProductID, delta)
+	case delta < 0:
+		err = fe.replaceCart(r.Context(), sessionID(r), desired)
+	}
+	if err != nil {
+		renderGRPCError(log, r, w, errors.Wrap(err, "failed to update cart"))
+		return
+	}
+	variants.set(payload.ProductID, payload.Variant, int32(payload.Quantity))
+	saveCartVariants(r, variants)
+	bumpCartVersion(w)
+	w.Header().Set("location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request) {
+	loggerFromContext(r.Context()).Debug("view user cart")
+	if r.Method == http.MethodHead {
+		answerHead(w, r, "", 0)
+		return
+	}
+	fe.renderCart(w, r, fe.checkoutValues(r), nil, http.StatusOK)
+}
+
+// checkoutValues fills in the checkout form with the demo details and the
+// address and e-mail saved by the last order, if any.
+func (fe *frontendServer) checkoutValues(r *http.Request) url.Values {
+	checkout := checkoutDefaults(time.Now())
+	if a := fe.savedCheckout(r); a != nil {
+		setAddressValues(checkout, a)
+	}
+	return checkout
+}
 
-		multPrice := money.MultiplySlow(*price, uint32(item.GetQuantity()))
-		items[i] = cartItemView{
-			Item:     p,
-			Quantity: item.GetQuantity(),
-			Price:    &multPrice}
-		totalPrice = money.Must(money.Sum(totalPrice, multPrice))
+// checkoutDefaults pre-fills the checkout form with demo shipping and payment
+// details.
+func checkoutDefaults(now time.Time) url.Values {
+	return url.Values{
+		"email":                        {"someone@example.com"},
+		"street_address":               {"1600 Amphitheatre Parkway"},
+		"zip_code":                     {"94043"},
+		"city":                         {"Mountain View"},
+		"state":                        {"CA"},
+		"country":                      {"US"},
+		"credit_card_number":           {"4432801561520454"},
+		"credit_card_expiration_month": {"1"},
+		"credit_card_expiration_year":  {strconv.Itoa(now.Year() + 1)},
+		"credit_card_cvv":              {"672"},
+	}
+}
+
+type monthOption struct {
+	Value string
+	Name  string
+}
+
+// expirationMonths lists the options of the card expiration month picker.
+var expirationMonths = func() []monthOption {
+	months := make([]monthOption, 12)
+	for i := range months {
+		months[i] = monthOption{strconv.Itoa(i + 1), time.Month(i + 1).String()}
+	}
+	return months
+}()
+
+// giftWrapPrice returns the gift wrapping fee in currency, rounded to its
+// minor units so that the total shown adds up.
+func (fe *frontendServer) giftWrapPrice(ctx context.Context, currency string) (*pb.Money, error) {
+	fee, err := fe.convertCurrency(ctx, fe.giftWrapFee, currency)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not convert the gift wrapping fee")
+	}
+	rounded := money.Round(*fee)
+	return &rounded, nil
+}
+
+// renderCart renders the cart page with the checkout form filled in from
+// checkout and fieldErrors, keyed by form field name, shown next to the
+// offending inputs.
+func (fe *frontendServer) renderCart(w http.ResponseWriter, r *http.Request, checkout url.Values, fieldErrors map[string]string, code int) {
+	log := loggerFromContext(r.Context())
+	var (
+		common templateData
+		cart   []*pb.CartItem
+	)
+	g, gctx := errgroup.WithContext(r.Context())
+	g.Go(func() error {
+		common = fe.commonTemplateData(gctx, r)
+		return nil
+	})
+	g.Go(func() (err error) {
+		cart, err = fe.getCart(gctx, sessionID(r))
+		return errors.Wrap(err, "could not retrieve cart")
+	})
+	if err := g.Wait(); err != nil {
+		renderGRPCError(log, r, w, err)
+		return
+	}
+
+	// ignores the error retrieving recommendations since it is not critical
+	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), cartIDs(cart))
+	if err != nil {
+		log.WithField("error", err).Warn("failed to get product recommendations")
+	}
+
+	var promo *promoCode
+	if p, ok := fe.activePromo(r); ok {
+		promo = &p
+	}
+	view, err := fe.buildCartView(r.Context(), cart, sessionCartVariants(r), fe.savedAddress(r), promo, currentCurrency(r))
+	if err != nil {
+		renderGRPCError(log, r, w, err)
+		return
 	}
-	totalPrice = money.Must(money.Sum(totalPrice, *shippingCost))
 	year := time.Now().Year()
+	var giftWrapFee *pb.Money // shown next to the option when known
+	if fee, err := fe.giftWrapPrice(r.Context(), currentCurrency(r)); err != nil {
+		log.WithField("error", err).Warn("failed to price gift wrapping")
+	} else {
+		giftWrapFee = fee
+	}
 
-	if err := templates.ExecuteTemplate(w, "cart", injectCommonTemplateData(r, map[string]interface{}{
-		"currencies":       currencies,
-		"recommendations":  recommendations,
-		"cart_size":        cartSize(cart),
-		"shipping_cost":    shippingCost,
-		"show_currency":    true,
-		"total_cost":       totalPrice,
-		"items":            items,
-		"expiration_years": []int{year, year + 1, year + 2, year + 3, year + 4},
+	// The country options carry the currency to suggest, so that the form
+	// can offer it as soon as another country is chosen.
+	currencies, _ := common["currencies"].([]string)
+	countries := countryOptions(currencies)
+	var suggestedCurrency string
+	for _, c := range countries {
+		if c.Code == checkout.Get("country") && c.SuggestCurrency != currentCurrency(r) {
+			suggestedCurrency = c.SuggestCurrency
+		}
+	}
+
+	fe.issueOrderToken(w)
+	w.WriteHeader(code)
+	if err := templates.ExecuteTemplate(w, "cart", common.with(map[string]interface{}{
+		"recommendations":    recommendations,
+		"cart_size":          cartSize(cart), // the cart itself, not a cached count
+		"shipping_cost":      view.EstimatedShipping,
+		"delivery":           fe.delivery.windows(time.Now()),
+		"gift_wrap_fee":      giftWrapFee,
+		"promo":              view.Promo,
+		"discount":           view.Discount,
+		"total_cost":         view.Total,
+		"items":              view.Items,
+		"unavailable":        view.Unavailable,
+		"cart_max_qty":       cartMaxQuantity,
+		"ads":                fe.chooseAds(r.Context(), cartCategories(view), log),
+		"checkout":           checkout,
+		"address_saved":      fe.savedCheckout(r) != nil,
+		"countries":          countries,
+		"suggested_currency": suggestedCurrency,
+		"field_errors":       fieldErrors,
+		"expiration_months":  expirationMonths,
+		"expiration_years":   []int{year, year + 1, year + 2, year + 3, year + 4},
 	})); err != nil {
 		log.Println(err)
 	}
 }
 
 func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	log.Debug("placing order")
 
 	var (
-		email         = r.FormValue("email")
-		streetAddress = r.FormValue("street_address")
-		zipCode, _    = strconv.ParseInt(r.FormValue("zip_code"), 10, 32)
-		city          = r.FormValue("city")
-		state         = r.FormValue("state")
-		country       = r.FormValue("country")
-		ccNumber      = r.FormValue("credit_card_number")
-		ccMonth, _    = strconv.ParseInt(r.FormValue("credit_card_expiration_month"), 10, 32)
-		ccYear, _     = strconv.ParseInt(r.FormValue("credit_card_expiration_year"), 10, 32)
-		ccCVV, _      = strconv.ParseInt(r.FormValue("credit_card_cvv"), 10, 32)
+		ccMonth, _ = strconv.ParseInt(r.FormValue("credit_card_expiration_month"), 10, 32)
+		ccYear, _  = strconv.ParseInt(r.FormValue("credit_card_expiration_year"), 10, 32)
 	)
-
 	payload := validator.PlaceOrderPayload{
-		Email:         email,
-		StreetAddress: streetAddress,
-		ZipCode:       zipCode,
-		City:          city,
-		State:         state,
-		Country:       country,
-		CcNumber:      ccNumber,
+		Email:         r.FormValue("email"),
+		StreetAddress: r.FormValue("street_address"),
+		ZipCode:       r.FormValue("zip_code"),
+		City:          r.FormValue("city"),
+		State:         r.FormValue("state"),
+		Country:       r.FormValue("country"),
+		CcNumber:      r.FormValue("credit_card_number"),
 		CcMonth:       ccMonth,
 		CcYear:        ccYear,
-		CcCVV:         ccCVV,
+		CcCVV:         r.FormValue("credit_card_cvv"),
+		GiftWrap:      r.FormValue("gift_wrap") != "",
+		OrderNote:     strings.TrimSpace(r.FormValue("order_note")),
 	}
-	if err := payload.Validate(); err != nil {
-		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+	err := payload.Validate()
+	fieldErrors := validator.FieldErrors(err)
+	if fieldErrors == nil {
+		fieldErrors = make(map[string]string)
+	}
+	// Reports on fields the payload found fault with already take precedence.
+	for field, msg := range checkAddress(payload.Country, payload.State, payload.ZipCode) {
+		if _, ok := fieldErrors[field]; !ok {
+			fieldErrors[field] = msg
+		}
+	}
+	if err != nil || len(fieldErrors) > 0 {
+		log.WithField("error", err).WithField("fields", fieldErrors).Info("invalid checkout form")
+		fe.renderCart(w, r, r.PostForm, fieldErrors, http.StatusUnprocessableEntity)
 		return
 	}
 
+	var giftWrapFee *pb.Money
+	if payload.GiftWrap {
+		if giftWrapFee, err = fe.giftWrapPrice(r.Context(), currentCurrency(r)); err != nil {
+			renderGRPCError(log, r, w, err)
+			return
+		}
+	}
+
+	// The checkout service would fail the whole order on a product the
+	// catalog no longer has; ask for the cart to be cleaned up instead.
+	cart, err := fe.getCart(r.Context(), sessionID(r))
+	if err != nil {
+		renderGRPCError(log, r, w, errors.Wrap(err, "could not retrieve cart"))
+		return
+	}
+	if _, missing, err := fe.lookupProducts(r.Context(), cartIDs(cart), currentCurrency(r)); err != nil {
+		renderGRPCError(log, r, w, err)
+		return
+	} else if len(missing) > 0 {
+		log.WithField("products", missing).Info("checkout refused with unavailable products in cart")
+		fe.renderCart(w, r, r.PostForm, map[string]string{
+			"cart": "Some items in your cart are no longer available. Remove them to place your order.",
+		}, http.StatusConflict)
+		return
+	}
+
+	// A form submitted again with the same order token, e.g. by a double
+	// click, is sent to the order placed by the first submission.
+	var attempt *orderAttempt
+	if token := fe.orderToken(r); token != "" {
+		for {
+			a, claimed := fe.orderTokens.claim(sessionID(r)+"/"+token, time.Now())
+			if claimed {
+				attempt = a
+				break
+			}
+			select {
+			case <-a.done:
+			case <-r.Context().Done():
+				renderHTTPError(log, r, w, errors.Wrap(r.Context().Err(), "failed to complete the order"), http.StatusServiceUnavailable)
+				return
+			}
+			if a.orderID != "" {
+				log.WithField("order", a.orderID).Info("duplicate checkout submission")
+				http.Redirect(w, r, baseUrl+"/order/"+a.orderID, http.StatusSeeOther)
+				return
+			}
+			// The first submission failed: try again.
+		}
+	} else {
+		log.Debug("checkout submitted without an order token")
+	}
+
+	// Validated as a short digit string.
+	ccCVV, _ := strconv.Atoi(payload.CcCVV)
+
+	address := checkoutAddress{
+		Email:         payload.Email,
+		StreetAddress: payload.StreetAddress,
+		City:          payload.City,
+		State:         payload.State,
+		Country:       payload.Country,
+		ZipCode:       payload.ZipCode,
+	}
+	addr := address.shippingAddress()
 	order, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).
 		PlaceOrder(r.Context(), &pb.PlaceOrderRequest{
 			Email: payload.Email,
@@ -358,42 +874,70 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 				CreditCardNumber:          payload.CcNumber,
 				CreditCardExpirationMonth: int32(payload.CcMonth),
 				CreditCardExpirationYear:  int32(payload.CcYear),
-				CreditCardCvv:             int32(payload.CcCVV)},
+				CreditCardCvv:             int32(ccCVV)},
 			UserId:       sessionID(r),
 			UserCurrency: currentCurrency(r),
-			Address: &pb.Address{
-				StreetAddress: payload.StreetAddress,
-				City:          payload.City,
-				State:         payload.State,
-				ZipCode:       int32(payload.ZipCode),
-				Country:       payload.Country},
+			Address:      addr,
 		})
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to complete the order"), http.StatusInternalServerError)
+		fe.orderTokens.finish(attempt, "")
+		renderGRPCError(log, r, w, errors.Wrap(err, "failed to complete the order"))
 		return
 	}
-	log.WithField("order", order.GetOrder().GetOrderId()).Info("order placed")
-
-	order.GetOrder().GetItems()
-	recommendations, _ := fe.getRecommendations(r.Context(), sessionID(r), nil)
+	fe.applySales(r, order.GetOrder())
+	rc := newReceipt(order.GetOrder(), time.Now(), userLocale(r), orderExtras{
+		promo:       fe.orderPromo(r, order.GetOrder()),
+		giftWrapFee: giftWrapFee,
+		note:        payload.OrderNote,
+		variants:    sessionCartVariants(r),
+	})
+	summary := newOrderSummary(rc)
+	logOrderPlaced(log, summary)
+	fe.auditOrder(r, rc)
+	fe.receipts.add(sessionID(r), rc)
+	rememberOrder(r, summary)
+	sessionState(r).set(promoSessionKey, "") // codes apply to one order
+	saveCartVariants(r, cartVariants{})
+	fe.orderTokens.finish(attempt, rc.OrderID)
+	if short := fe.stock.take(order.GetOrder().GetItems()); len(short) > 0 {
+		log.WithField("order", rc.OrderID).WithField("products", short).Warn("order placed with more than in stock")
+	}
+	fe.saveAddress(w, address)
+	bumpCartVersion(w) // the checkout service empties the cart
+	fe.renderOrder(w, r, rc)
+}
 
-	totalPaid := *order.GetOrder().GetShippingCost()
-	for _, v := range order.GetOrder().GetItems() {
-		multPrice := money.MultiplySlow(*v.GetCost(), uint32(v.GetItem().GetQuantity()))
-		totalPaid = money.Must(money.Sum(totalPaid, multPrice))
+// orderHandler shows the confirmation page of an order placed earlier in the
+// session.
+func (fe *frontendServer) orderHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	id := mux.Vars(r)["id"]
+	rc, ok := fe.receipts.get(sessionID(r), id)
+	if !ok {
+		renderHTTPError(log, r, w, errors.Errorf("no order %q", id), http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodHead {
+		answerHead(w, r, "", 0)
+		return
 	}
+	fe.renderOrder(w, r, rc)
+}
+
+func (fe *frontendServer) renderOrder(w http.ResponseWriter, r *http.Request, rc *receipt) {
+	log := loggerFromContext(r.Context())
 
-	currencies, err := fe.getCurrencies(r.Context())
+	// The order has gone through at this point, so failures below must not
+	// keep the receipt from rendering.
+	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), nil)
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
-		return
+		log.WithField("error", err).Warn("failed to get product recommendations")
 	}
 
-	if err := templates.ExecuteTemplate(w, "order", injectCommonTemplateData(r, map[string]interface{}{
+	if err := templates.ExecuteTemplate(w, "order", fe.commonTemplateData(r.Context(), r).with(map[string]interface{}{
 		"show_currency":   false,
-		"currencies":      currencies,
-		"order":           order.GetOrder(),
-		"total_paid":      &totalPaid,
+		"receipt":         rc,
+		"delivery":        fe.delivery.windows(rc.PlacedAt),
 		"recommendations": recommendations,
 	})); err != nil {
 		log.Println(err)
@@ -401,142 +945,103 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 }
 
 func (fe *frontendServer) assistantHandler(w http.ResponseWriter, r *http.Request) {
-	currencies, err := fe.getCurrencies(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
-		return
-	}
-
-	if err := templates.ExecuteTemplate(w, "assistant", injectCommonTemplateData(r, map[string]interface{}{
+	log := loggerFromContext(r.Context())
+	if err := templates.ExecuteTemplate(w, "assistant", fe.commonTemplateData(r.Context(), r).with(map[string]interface{}{
 		"show_currency": false,
-		"currencies":    currencies,
 	})); err != nil {
 		log.Println(err)
 	}
 }
 
 func (fe *frontendServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log := loggerFromContext(r.Context())
 	log.Debug("logging out")
+	sessionState(r).clear()
 	for _, c := range r.Cookies() {
-		c.Expires = time.Now().Add(-time.Hour * 24 * 365)
-		c.MaxAge = -1
-		http.SetCookie(w, c)
+		http.SetCookie(w, expiredCookie(c.Name))
 	}
-	w.Header().Set("Location", baseUrl + "/")
+	w.Header().Set("Location", baseUrl+"/")
 	w.WriteHeader(http.StatusFound)
 }
 
-func (fe *frontendServer) getProductByID(w http.ResponseWriter, r *http.Request) {
-	id := mux.Vars(r)["ids"]
-	if id == "" {
+func (fe *frontendServer) setCurrencyHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	cur := r.FormValue("currency_code")
+	payload := validator.SetCurrencyPayload{Currency: cur}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
 		return
 	}
-
-	p, err := fe.getProduct(r.Context(), id)
+	ok, err := fe.isSupportedCurrency(r.Context(), payload.Currency)
 	if err != nil {
+		renderGRPCError(log, r, w, errors.Wrap(err, "could not retrieve currencies"))
 		return
 	}
-
-	jsonData, err := json.Marshal(p)
-	if err != nil {
-		fmt.Println(err)
+	if !ok {
+		renderHTTPError(log, r, w, errors.Errorf("unsupported currency %q", payload.Currency), http.StatusBadRequest)
 		return
 	}
+	log.WithField("curr.new", payload.Currency).WithField("curr.old", currentCurrency(r)).
+		Debug("setting currency")
 
-	w.Write(jsonData)
-	w.WriteHeader(http.StatusOK)
-}
-
-func (fe *frontendServer) chatBotHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
-	type Response struct {
-		Message string `json:"message"`
+	http.SetCookie(w, newCookie(cookieCurrency, payload.Currency))
+	if payload.Currency != currentCurrency(r) {
+		fe.flash(w, r, flashInfo, "flash.currency_changed", "currency", payload.Currency)
 	}
-
-	type LLMResponse struct {
-		Content string         `json:"content"`
-		Details map[string]any `json:"details"`
+	target, ok := localRedirect(r, r.FormValue("redirect_to"))
+	if !ok {
+		target, _ = localRedirect(r, r.Referer())
 	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusFound)
+}
 
-	var response LLMResponse
-
-	url := "http://" + fe.shoppingAssistantSvcAddr
-	req, err := http.NewRequest(http.MethodPost, url, r.Body)
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to create request"), http.StatusInternalServerError)
-		return
+// localRedirect returns target as a path under baseUrl to redirect to, or the
+// home page and false if it is not one. Absolute URLs, as sent in Referer, are
+// accepted for the host of r only. Paths that would leave baseUrl once "."
+// and ".." are resolved, or that browsers may read as another host, such as
+// "//evil.example" or "/\evil.example", are rejected.
+func localRedirect(r *http.Request, target string) (string, bool) {
+	home := baseUrl + "/"
+	if target == "" || strings.ContainsAny(target, "\\\x00\r\n\t") {
+		return home, false
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	res, err := http.DefaultClient.Do(req)
+	u, err := url.Parse(target)
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to send request"), http.StatusInternalServerError)
-		return
+		return home, false
 	}
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to read response"), http.StatusInternalServerError)
-		return
+	if u.Scheme != "" || u.Host != "" {
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host != r.Host || u.User != nil {
+			return home, false
+		}
 	}
-
-	fmt.Printf("%+v\n", body)
-	fmt.Printf("%+v\n", res)
-
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to unmarshal body"), http.StatusInternalServerError)
-		return
+	p := u.Path
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") {
+		return home, false
 	}
-
-	// respond with the same message
-	json.NewEncoder(w).Encode(Response{Message: response.Content})
-
-	w.WriteHeader(http.StatusOK)
-}
-
-func (fe *frontendServer) setCurrencyHandler(w http.ResponseWriter, r *http.Request) {
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
-	cur := r.FormValue("currency_code")
-	payload := validator.SetCurrencyPayload{Currency: cur}
-	if err := payload.Validate(); err != nil {
-		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
-		return
+	if clean := path.Clean(p); clean != strings.TrimSuffix(p, "/") && clean != p {
+		return home, false
 	}
-	log.WithField("curr.new", payload.Currency).WithField("curr.old", currentCurrency(r)).
-		Debug("setting currency")
-
-	if payload.Currency != "" {
-		http.SetCookie(w, &http.Cookie{
-			Name:   cookieCurrency,
-			Value:  payload.Currency,
-			MaxAge: cookieMaxAge,
-		})
+	if baseUrl != "" && p != baseUrl && !strings.HasPrefix(p, baseUrl+"/") {
+		return home, false
 	}
-	referer := r.Header.Get("referer")
-	if referer == "" {
-		referer = baseUrl + "/"
+	out := u.EscapedPath()
+	if u.RawQuery != "" {
+		out += "?" + u.RawQuery
 	}
-	w.Header().Set("Location", referer)
-	w.WriteHeader(http.StatusFound)
-}
-
-// chooseAd queries for advertisements available and randomly chooses one, if
-// available. It ignores the error retrieving the ad since it is not critical.
-func (fe *frontendServer) chooseAd(ctx context.Context, ctxKeys []string, log logrus.FieldLogger) *pb.Ad {
-	ads, err := fe.getAd(ctx, ctxKeys)
-	if err != nil {
-		log.WithField("error", err).Warn("failed to retrieve ads")
-		return nil
-	}
-	return ads[rand.Intn(len(ads))]
+	return out, true
 }
 
 func renderHTTPError(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error, code int) {
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		log.WithField("route", routeName(r)).Warn("request deadline exceeded")
+		code = http.StatusGatewayTimeout
+	}
 	log.WithField("error", err).Error("request error")
-	errMsg := fmt.Sprintf("%+v", err)
+	renderErrorPage(log, r, w, fmt.Sprintf("%+v", err), code)
+}
 
+func renderErrorPage(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, errMsg string, code int) {
 	w.WriteHeader(code)
 
 	if templateErr := templates.ExecuteTemplate(w, "error", injectCommonTemplateData(r, map[string]interface{}{
@@ -548,21 +1053,70 @@ func renderHTTPError(log logrus.FieldLogger, r *http.Request, w http.ResponseWri
 	}
 }
 
+// unmatchedHandler answers requests that match no route of router: 405,
+// listing the allowed methods in the Allow header, when the path is served
+// for other methods, and 404 otherwise. It backs both the NotFoundHandler and
+// the MethodNotAllowedHandler, because under a base path mux reports a method
+// mismatch as not found.
+func unmatchedHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := loggerFromContext(r.Context())
+		if allowed := allowedMethods(router, r); len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			if wantsJSON(r) {
+				writeJSON(log, w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed", Code: http.StatusMethodNotAllowed})
+				return
+			}
+			renderErrorPage(log, r, w, fmt.Sprintf("%s is not allowed for %s.", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+			return
+		}
+		if wantsJSON(r) {
+			writeJSON(log, w, http.StatusNotFound, apiError{Error: "not found", Code: http.StatusNotFound})
+			return
+		}
+		renderErrorPage(log, r, w, fmt.Sprintf("There is no page at %s.", r.URL.Path), http.StatusNotFound)
+	}
+}
+
+// allowedMethods returns the methods that router serves for the path of r.
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	var allowed []string
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions} {
+		var match mux.RouteMatch
+		req := r.Clone(r.Context())
+		req.Method = method
+		if router.Match(req, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
 func injectCommonTemplateData(r *http.Request, payload map[string]interface{}) map[string]interface{} {
 	data := map[string]interface{}{
 		"session_id":        sessionID(r),
 		"request_id":        r.Context().Value(ctxKeyRequestID{}),
+		"csrf_token":        csrfToken(r),
 		"user_currency":     currentCurrency(r),
 		"platform_css":      plat.css,
 		"platform_name":     plat.provider,
 		"is_cymbal_brand":   isCymbalBrand,
-		"assistant_enabled": assistantEnabled,
+		"assistant_enabled": assistantEnabled && featureflags.Enabled(r.Context(), featureAssistant),
 		"deploymentDetails": deploymentDetailsMap,
 		"frontendMessage":   frontendMessage,
 		"currentYear":       time.Now().Year(),
 		"baseUrl":           baseUrl,
+		"locale":            userLocale(r),
+		"lang":              pageLanguage(r),
+		"request_uri":       pageURI(r),
+		"categories":        getNavCategories(),
+		"experiments":       experimentsFromContext(r.Context()),
+		"flashes":           pageFlashes(r),
 	}
 
+	for k, v := range brandTemplateData(r) {
+		data[k] = v
+	}
 	for k, v := range payload {
 		data[k] = v
 	}
@@ -570,11 +1124,42 @@ func injectCommonTemplateData(r *http.Request, payload map[string]interface{}) m
 	return data
 }
 
+// pageURI returns the URI of the page r renders, to come back to after
+// changing currency. Pages rendered for a form submission cannot be
+// reloaded with GET and have none.
+func pageURI(r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	return r.URL.RequestURI()
+}
+
+// answerHead answers a HEAD request for a page with the headers a GET would
+// get, once the handler has made the cheap checks telling whether the page
+// exists. The template and the calls it takes, such as ads and
+// recommendations, are skipped: uptime checkers only want the status. etag
+// is that of the page, or empty if it has none.
+func answerHead(w http.ResponseWriter, r *http.Request, etag string, maxAge time.Duration) {
+	if etag != "" {
+		if notModified(w, r, etag, maxAge) {
+			return
+		}
+		setPageCacheHeaders(w, etag, maxAge)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+}
+
+// currentCurrency returns the currency chosen by the user, or the one
+// ensureCurrency picked for them.
 func currentCurrency(r *http.Request) string {
 	c, _ := r.Cookie(cookieCurrency)
 	if c != nil {
 		return c.Value
 	}
+	if cur, ok := r.Context().Value(ctxKeyCurrency{}).(string); ok {
+		return cur
+	}
 	return defaultCurrency
 }
 
@@ -603,26 +1188,55 @@ func cartSize(c []*pb.CartItem) int {
 	return cartSize
 }
 
-func renderMoney(money pb.Money) string {
-	currencyLogo := renderCurrencyLogo(money.GetCurrencyCode())
-	return fmt.Sprintf("%s%d.%02d", currencyLogo, money.GetUnits(), money.GetNanos()/10000000)
+// renderMoney formats m for the locale from userLocale, which templates get
+// as $.locale.
+func renderMoney(m pb.Money, l money.Locale) string {
+	return l.Format(m)
 }
 
 func renderCurrencyLogo(currencyCode string) string {
-	logos := map[string]string{
-		"USD": "$",
-		"CAD": "$",
-		"JPY": "¥",
-		"EUR": "€",
-		"TRY": "₺",
-		"GBP": "£",
+	return money.Symbol(currencyCode)
+}
+
+// userLocale picks the preferred language of Accept-Language that prices can
+// be formatted for.
+func userLocale(r *http.Request) money.Locale {
+	for _, tag := range acceptedLanguages(r) {
+		if l, ok := money.LookupLocale(tag); ok {
+			return l
+		}
 	}
+	return money.DefaultLocale
+}
 
-	logo := "$" //default
-	if val, ok := logos[currencyCode]; ok {
-		logo = val
+// acceptedLanguages returns the language tags of Accept-Language, most
+// preferred first, leaving out "*" and those with q=0.
+func acceptedLanguages(r *http.Request) []string {
+	type tag struct {
+		name string
+		q    float64
+	}
+	var tags []tag
+	for _, v := range r.Header.Values("Accept-Language") {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+			if name = strings.TrimSpace(name); name != "" && name != "*" && q > 0 {
+				tags = append(tags, tag{name, q})
+			}
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.name
 	}
-	return logo
+	return names
 }
 
 func stringinSlice(slice []string, val string) bool {
@@ -0,0 +1,420 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func serveHome(t *testing.T, fe *frontendServer) (*httptest.ResponseRecorder, time.Duration) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	start := time.Now()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	return w, time.Since(start)
+}
+
+func TestHomeHandlerCallsBackendsConcurrently(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+
+	// Measure the handler's own overhead first so the assertion below only
+	// concerns the backend latencies.
+	if w, _ := serveHome(t, fe); w.Code != http.StatusOK {
+		t.Fatalf("warm-up: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	_, baseline := serveHome(t, fe)
+
+	const stub = 150 * time.Millisecond
+	for _, m := range []string{"GetSupportedCurrencies", "ListProducts", "GetCart", "GetAds"} {
+		fb.setLatency(m, stub)
+	}
+	w, took := serveHome(t, fe)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	// Serial calls would add 4*stub; concurrent ones roughly stub.
+	if extra := took - baseline; extra > 2*stub {
+		t.Errorf("handler took %v over baseline, want close to %v (the slowest stub)", extra, stub)
+	}
+}
+
+func TestHomeHandlerDegradesWithoutAds(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("GetAds", status.Error(codes.Unavailable, "ads down"))
+	fe := newTestFrontend(t, fb)
+
+	if w, _ := serveHome(t, fe); w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestHomeHandlerFailsWithoutCatalog(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("ListProducts", status.Error(codes.Internal, "catalog broken"))
+	fe := newTestFrontend(t, fb)
+
+	if w, _ := serveHome(t, fe); w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func serveSearch(t *testing.T, fe *frontendServer, h http.HandlerFunc, q string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, newTestRequest(http.MethodGet, "/search?"+url.Values{"q": {q}}.Encode(), nil))
+	return w
+}
+
+func TestSearchHandler(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+
+	w := serveSearch(t, fe, fe.searchHandler, "  sunglasses ")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "/product/OLJCESPC7Z") || strings.Contains(body, "/product/66VCHSJNUP") {
+		t.Error("results page does not list exactly the matching product")
+	}
+	if !strings.Contains(body, "$19.99") {
+		t.Error("results page does not show the converted price")
+	}
+	if got, want := fb.adContextKeys, []string{"sunglasses"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ad context keys = %v, want %v", got, want)
+	}
+}
+
+func TestSearchHandlerEdgeCases(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantBody string
+	}{
+		{"empty query redirects home", "", http.StatusFound, ""},
+		{"blank query redirects home", "   ", http.StatusFound, ""},
+		{"too long", strings.Repeat("a", 101), http.StatusBadRequest, ""},
+		{"no matches", "umbrella", http.StatusOK, "No products match your search"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := newTestFrontend(t, newFakeBackend())
+			w := serveSearch(t, fe, fe.searchHandler, tt.query)
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusFound && w.Header().Get("Location") != "/" {
+				t.Errorf("redirected to %q, want /", w.Header().Get("Location"))
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body does not contain %q", tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAPISearchHandler(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+
+	w := serveSearch(t, fe, fe.apiSearchHandler, "watch")
+	var got apiSearchResults
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(got.Results) != 1 || got.Results[0].ID != "1YMWWN1N4O" || got.Results[0].Price.Formatted != "$109.99" {
+		t.Errorf("got %+v, want the watch at $109.99", got)
+	}
+
+	w = serveSearch(t, fe, fe.apiSearchHandler, "")
+	var apiErr apiError
+	if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil || w.Code != http.StatusBadRequest || apiErr.Code != http.StatusBadRequest {
+		t.Errorf("empty query: got status %d and body %s, want a 400 JSON error", w.Code, w.Body)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			var m map[string]int
+			m["boom"]++ // nil map write
+		}
+		w.Write([]byte("ok"))
+	}))
+	// Attach request IDs the way logHandler does.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(discardLog))
+		ctx = context.WithValue(ctx, ctxKeyRequestID{}, "req-1234")
+		h(w, r.WithContext(ctx))
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/panic")
+	if err != nil {
+		t.Fatalf("panicking request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if !strings.Contains(string(body), "req-1234") {
+		t.Error("error page does not show the request ID")
+	}
+
+	resp, err = http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("server stopped serving after a panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d after the panic, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestPlaceOrderInvalidForm(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+
+	form := checkoutDefaults(time.Now())
+	form.Set("email", "someone@")
+	form.Set("city", "")
+	form.Set("street_address", "42 Unchanged Road")
+	form.Set("credit_card_cvv", "12")
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(form.Encode())))
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`value="42 Unchanged Road"`,
+		`value="someone@"`,
+		"Enter a valid e-mail address.",
+		"This field is required.",
+		"Enter the 3 or 4 digit security code.",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("checkout page does not contain %q", want)
+		}
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Errorf("PlaceOrder called %d times for an invalid form", n)
+	}
+}
+
+func TestRecommendationsExcludeCart(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	// The service suggests products in the cart and the one being viewed.
+	fb.recommendations = []string{"OLJCESPC7Z", "66VCHSJNUP", "OLJCESPC7Z"}
+	fe := newTestFrontend(t, fb)
+
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/66VCHSJNUP", nil), map[string]string{"id": "66VCHSJNUP"})
+	w := httptest.NewRecorder()
+	fe.productHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if want := []string{"OLJCESPC7Z", "66VCHSJNUP"}; !reflect.DeepEqual(fb.recommendationsFor, want) {
+		t.Errorf("recommendations requested for %v, want %v", fb.recommendationsFor, want)
+	}
+
+	got, err := fe.getRecommendations(context.Background(), "test-session", fb.recommendationsFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the watch is left, backfilled from the catalog.
+	if len(got) != 1 || got[0].GetId() != "1YMWWN1N4O" {
+		t.Errorf("recommendations = %v, want only 1YMWWN1N4O", got)
+	}
+}
+
+func TestRecommendationsLimit(t *testing.T) {
+	fb := newFakeBackend()
+	fb.recommendations = []string{"1YMWWN1N4O", "1YMWWN1N4O"}
+	for i := 0; i < 5; i++ {
+		fb.products = append(fb.products, &pb.Product{Id: fmt.Sprintf("EXTRA%d", i), PriceUsd: &pb.Money{CurrencyCode: "USD"}})
+	}
+	fe := newTestFrontend(t, fb)
+
+	got, err := fe.getRecommendations(context.Background(), "test-session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, p := range got {
+		ids = append(ids, p.GetId())
+	}
+	if want := []string{"1YMWWN1N4O", "OLJCESPC7Z", "66VCHSJNUP", "EXTRA0"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("recommendations = %v, want %v", ids, want)
+	}
+}
+
+func TestUserLocale(t *testing.T) {
+	for _, tc := range []struct {
+		header, want string
+	}{
+		{"", "en"},
+		{"de-DE,de;q=0.9,en;q=0.8", "de"},
+		{"xx-YY, pt-BR;q=0.5", "pt-BR"},
+		{"en;q=0.4, fr;q=0.8", "fr"},
+		{"fr;q=0, ja", "ja"},
+		{"*", "en"},
+	} {
+		r := newTestRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Language", tc.header)
+		if got := userLocale(r).Tag; got != tc.want {
+			t.Errorf("userLocale(%q) = %q, want %q", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestHomeHandlerFormatsPricesForLocale(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Language", "de-DE")
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "19,99\u00a0$") {
+		t.Errorf("status %d, body does not show the price as 19,99 $: %.500s", w.Code, w.Body)
+	}
+}
+
+func addToCart(fe *frontendServer, form url.Values, header http.Header) *httptest.ResponseRecorder {
+	r := newTestRequest(http.MethodPost, "/cart", strings.NewReader(form.Encode()))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	fe.addToCartHandler(w, r)
+	return w
+}
+
+func TestAddToCartXHR(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	form := url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}}
+
+	for _, h := range []http.Header{
+		{"Accept": {"application/json"}},
+		{"X-Requested-With": {"XMLHttpRequest"}},
+	} {
+		fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}, {ProductId: "66VCHSJNUP", Quantity: 2}}
+		w := addToCart(fe, form, h)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: status %d, want 200", h, w.Code)
+		}
+		var got apiAddedToCart
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Count != 5 || got.Degraded || got.Item.ProductID != "OLJCESPC7Z" || got.Item.Quantity != 3 ||
+			got.Item.UnitPrice.Formatted != "$19.99" || got.Item.LineTotal.Formatted != "$59.97" {
+			t.Errorf("%v: got %+v", h, got)
+		}
+	}
+
+	if w := addToCart(fe, form, nil); w.Code != http.StatusFound || w.Header().Get("Location") != "/cart" {
+		t.Errorf("form post: status %d to %q, want a redirect to the cart", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestAddToCartXHRErrors(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	xhr := http.Header{"X-Requested-With": {"XMLHttpRequest"}}
+	for _, tc := range []struct {
+		form       url.Values
+		wantReason string
+	}{
+		{url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"0"}}, "invalid_quantity"},
+		{url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"lots"}}, "invalid_quantity"},
+		{url.Values{"quantity": {"1"}}, "invalid_product"},
+		{url.Values{"product_id": {"NOPE"}, "quantity": {"1"}}, "unknown_product"},
+	} {
+		w := addToCart(fe, tc.form, xhr)
+		var got apiError
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("%v: %v", tc.form, err)
+		}
+		if w.Code != http.StatusBadRequest || got.Code != http.StatusBadRequest || got.Reason != tc.wantReason {
+			t.Errorf("%v: status %d, body %+v; want 400 %s", tc.form, w.Code, got, tc.wantReason)
+		}
+
+		if w := addToCart(fe, tc.form, nil); w.Code < 400 || !strings.Contains(w.Body.String(), "<html") {
+			t.Errorf("%v: form post got status %d, want an error page", tc.form, w.Code)
+		}
+	}
+}
+
+func TestHeadRequestsSkipRendering(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	head := func(h http.HandlerFunc, path string, vars map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, mux.SetURLVars(newTestRequest(http.MethodHead, path, nil), vars))
+		return w
+	}
+
+	for _, tc := range []struct {
+		path string
+		h    http.HandlerFunc
+		vars map[string]string
+		etag bool
+	}{
+		{"/", fe.homeHandler, nil, true},
+		{"/product/OLJCESPC7Z", fe.productHandler, map[string]string{"id": "OLJCESPC7Z"}, true},
+		{"/category/accessories", fe.categoryHandler, map[string]string{"name": "accessories"}, false},
+		{"/search?q=sunglasses", fe.searchHandler, nil, false},
+		{"/cart", fe.viewCartHandler, nil, false},
+	} {
+		w := head(tc.h, tc.path, tc.vars)
+		if w.Code != http.StatusOK || w.Body.Len() != 0 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("%s: status %d, %d bytes, Content-Type %q", tc.path, w.Code, w.Body.Len(), w.Header().Get("Content-Type"))
+		}
+		if got := w.Header().Get("ETag") != ""; got != tc.etag {
+			t.Errorf("%s: ETag %q", tc.path, w.Header().Get("ETag"))
+		}
+	}
+	for _, method := range []string{"ListRecommendations", "GetAds", "GetCart", "SearchProducts"} {
+		if n := fb.callCount(method); n != 0 {
+			t.Errorf("%d %s calls for HEAD requests, want none", n, method)
+		}
+	}
+
+	if w := head(fe.productHandler, "/product/NOPE", map[string]string{"id": "NOPE"}); w.Code != http.StatusNotFound {
+		t.Errorf("unknown product: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
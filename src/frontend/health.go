@@ -0,0 +1,209 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const readinessProbeTimeout = 500 * time.Millisecond
+
+// nonCriticalDependencies lists the dependencies, by name, that are reported
+// by /_readyz but never flip readiness. It is read from
+// READINESS_NONCRITICAL, e.g. "ad,shoppingassistant".
+var nonCriticalDependencies = parseNonCritical(os.Getenv("READINESS_NONCRITICAL"))
+
+type dependencyStatus struct {
+	State    string `json:"state"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	// Breaker is the state of the dependency's circuit breaker, if it has
+	// one. An open breaker does not affect readiness.
+	Breaker string `json:"breaker,omitempty"`
+	// Subchannels is the state of each resolved backend address.
+	Subchannels map[string]string `json:"subchannels,omitempty"`
+}
+
+type readinessReport struct {
+	Status       string                      `json:"status"`
+	Down         []string                    `json:"down"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+// healthzHandler is a pure liveness check: it only fails while the server is
+// draining.
+func (fe *frontendServer) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	if fe.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "draining")
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// readyzHandler reports whether the frontend can serve traffic, i.e. whether
+// every critical backend is reachable.
+func (fe *frontendServer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := fe.checkReadiness(r.Context())
+	code := http.StatusOK
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// backendConns returns the backend connections by dependency name.
+// The ad service is left out when ads are disabled.
+func (fe *frontendServer) backendConns() map[string]*grpc.ClientConn {
+	conns := map[string]*grpc.ClientConn{
+		"productcatalog": fe.productCatalogSvcConn,
+		"currency":       fe.currencySvcConn,
+		"cart":           fe.cartSvcConn,
+		"recommendation": fe.recommendationSvcConn,
+		"checkout":       fe.checkoutSvcConn,
+		"shipping":       fe.shippingSvcConn,
+	}
+	if fe.adsEnabled() {
+		conns["ad"] = fe.adSvcConn
+	}
+	return conns
+}
+
+func (fe *frontendServer) checkReadiness(ctx context.Context) readinessReport {
+	conns := fe.backendConns()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		deps = make(map[string]dependencyStatus, len(conns)+1)
+	)
+	record := func(name string, st dependencyStatus) {
+		st.Critical = !nonCriticalDependencies[name]
+		if b := fe.breakers[name]; b != nil {
+			st.Breaker = b.current().String()
+		}
+		mu.Lock()
+		deps[name] = st
+		mu.Unlock()
+	}
+
+	for name, conn := range conns {
+		record(name, connStatus(conn))
+	}
+
+	// The connection state alone does not prove the backend answers RPCs, so
+	// issue one cheap call against the currency service.
+	if deps["currency"].Error == "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, readinessProbeTimeout)
+			defer cancel()
+			st := connStatus(fe.currencySvcConn)
+			if _, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).GetSupportedCurrencies(ctx, &pb.Empty{}); err != nil {
+				st.Error = err.Error()
+			}
+			record("currency", st)
+		}()
+	}
+
+	if fe.shoppingAssistantSvcAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st := dependencyStatus{State: "REACHABLE"}
+			c, err := net.DialTimeout("tcp", fe.shoppingAssistantSvcAddr, readinessProbeTimeout)
+			if err != nil {
+				st = dependencyStatus{State: "UNREACHABLE", Error: err.Error()}
+			} else {
+				c.Close()
+			}
+			record("shoppingassistant", st)
+		}()
+	}
+	if p, ok := fe.sessions.(sessionStorePinger); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, readinessProbeTimeout)
+			defer cancel()
+			st := dependencyStatus{State: "REACHABLE"}
+			if err := p.ping(ctx); err != nil {
+				st = dependencyStatus{State: "UNREACHABLE", Error: err.Error()}
+			}
+			record("sessionstore", st)
+		}()
+	}
+	wg.Wait()
+
+	report := readinessReport{Status: "ok", Down: []string{}, Dependencies: deps}
+	if fe.draining.Load() {
+		report.Status = "draining"
+	}
+	for name, st := range deps {
+		if st.Error == "" {
+			continue
+		}
+		report.Down = append(report.Down, name)
+		if st.Critical && report.Status == "ok" {
+			report.Status = "unavailable"
+		}
+	}
+	sort.Strings(report.Down)
+	return report
+}
+
+func connStatus(conn *grpc.ClientConn) dependencyStatus {
+	if conn == nil {
+		return dependencyStatus{State: "NOT_CONNECTED", Error: "connection not established"}
+	}
+	state := conn.GetState()
+	st := dependencyStatus{State: state.String(), Subchannels: subchannelStates.get(conn.CanonicalTarget())}
+	switch state {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		st.Error = fmt.Sprintf("connection to %s is %s", conn.Target(), state)
+	case connectivity.Idle:
+		// Idle connections are healthy but lazy; nudge them so the next
+		// probe reflects the real state.
+		conn.Connect()
+	}
+	return st
+}
+
+func parseNonCritical(v string) map[string]bool {
+	out := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			out[name] = true
+		}
+	}
+	return out
+}
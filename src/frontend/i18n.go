@@ -0,0 +1,266 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultLanguage is that of the page templates, which every catalog falls
+// back to.
+const defaultLanguage = "en"
+
+//go:embed i18n/*.json
+var embeddedCatalogs embed.FS
+
+// message is the text of a key in one language. Texts counting something
+// have a form per plural category; others have only other.
+type message struct {
+	one, other string
+}
+
+func (m *message) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		m.other = s
+		return nil
+	}
+	var forms struct {
+		One   string `json:"one"`
+		Other string `json:"other"`
+	}
+	if err := json.Unmarshal(b, &forms); err != nil {
+		return err
+	}
+	if forms.Other == "" {
+		return errors.New(`plural forms lack "other"`)
+	}
+	m.one, m.other = forms.One, forms.Other
+	return nil
+}
+
+// catalogs maps languages to their messages by key, see loadCatalogs.
+var catalogs = func() map[string]map[string]message {
+	c, err := loadCatalogs(embeddedCatalogs, "i18n")
+	if err != nil {
+		panic(err)
+	}
+	return c
+}()
+
+// loadCatalogs reads the message catalogs in dir of fsys, one JSON object
+// per language named after it, such as de.json.
+func loadCatalogs(fsys fs.FS, dir string) (map[string]map[string]message, error) {
+	names, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]map[string]message, len(names))
+	for _, name := range names {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		var msgs map[string]message
+		if err := json.Unmarshal(b, &msgs); err != nil {
+			return nil, errors.Wrapf(err, "invalid message catalog %s", name)
+		}
+		out[strings.TrimSuffix(path.Base(name), ".json")] = msgs
+	}
+	if _, ok := out[defaultLanguage]; !ok {
+		return nil, errors.Errorf("no %s message catalog", defaultLanguage)
+	}
+	return out, nil
+}
+
+type ctxKeyLanguage struct{}
+
+// matchLanguage returns the catalog language for a language tag such as
+// "de-AT", if there is one.
+func matchLanguage(tag string) (string, bool) {
+	primary, _, _ := strings.Cut(strings.ToLower(strings.ReplaceAll(tag, "_", "-")), "-")
+	_, ok := catalogs[primary]
+	return primary, ok
+}
+
+// ensureLanguage picks the language of the pages: that given in ?hl=, which
+// is remembered in the shop_language cookie, else the one of the cookie, else
+// the first of Accept-Language there is a catalog for.
+func ensureLanguage(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lang, ok := "", false
+		if hl := r.URL.Query().Get("hl"); hl != "" {
+			if lang, ok = matchLanguage(hl); ok {
+				http.SetCookie(w, newCookie(cookieLanguage, lang))
+			}
+		}
+		if c, err := r.Cookie(cookieLanguage); !ok && err == nil {
+			lang, ok = matchLanguage(c.Value)
+		}
+		for _, tag := range acceptedLanguages(r) {
+			if ok {
+				break
+			}
+			lang, ok = matchLanguage(tag)
+		}
+		if !ok {
+			lang = defaultLanguage
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyLanguage{}, lang)))
+	}
+}
+
+// pageLanguage returns the language ensureLanguage picked for r.
+func pageLanguage(r *http.Request) string {
+	if lang, ok := r.Context().Value(ctxKeyLanguage{}).(string); ok {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// pluralCategory returns the CLDR plural category of n in lang, among those
+// the catalogs use.
+func pluralCategory(lang string, n int64) string {
+	if lang != "ja" && n == 1 {
+		return "one"
+	}
+	return "other"
+}
+
+// missingMessages remembers the keys reported missing, so that each is
+// logged once.
+var missingMessages sync.Map
+
+func lookupMessage(lang, key string) (message, bool) {
+	if m, ok := catalogs[lang][key]; ok {
+		return m, true
+	}
+	if _, seen := missingMessages.LoadOrStore(lang+"/"+key, true); !seen {
+		log.WithField("lang", lang).WithField("key", key).Warn("missing translation")
+	}
+	if lang == defaultLanguage {
+		return message{}, false
+	}
+	return lookupMessage(defaultLanguage, key)
+}
+
+// translate is the T template function: it returns the text of key in lang,
+// falling back to English, with the {name} placeholders replaced by the
+// values of args, given as name, value pairs. The count argument selects the
+// plural form.
+//
+//	{{ T $.lang "cart.title" "count" $.cart_size }}
+func translate(lang, key string, args ...interface{}) (string, error) {
+	if len(args)%2 != 0 {
+		return "", errors.Errorf("T %s: arguments must be name, value pairs", key)
+	}
+	m, ok := lookupMessage(lang, key)
+	if !ok {
+		return key, nil
+	}
+	text := m.other
+	var pairs []string
+	for i := 0; i < len(args); i += 2 {
+		name, ok := args[i].(string)
+		if !ok {
+			return "", errors.Errorf("T %s: argument name %v is not a string", key, args[i])
+		}
+		if name == "count" && m.one != "" {
+			n, ok := toInt64(args[i+1])
+			if !ok {
+				return "", errors.Errorf("T %s: count %v is not an integer", key, args[i+1])
+			}
+			if pluralCategory(lang, n) == "one" {
+				text = m.one
+			}
+		}
+		pairs = append(pairs, "{"+name+"}", fmt.Sprint(args[i+1]))
+	}
+	return strings.NewReplacer(pairs...).Replace(text), nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// dateNames are the weekday and month abbreviations of a language, from
+// Sunday and January, and how formatDate puts them together: {w} is the
+// weekday, {d} the day of the month, {m} the month name and {n} its number.
+type dateNames struct {
+	weekdays [7]string
+	months   [12]string
+	layout   string
+}
+
+var shortDates = map[string]dateNames{
+	"en": {
+		weekdays: [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+		months:   [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		layout:   "{w}, {m} {d}",
+	},
+	"de": {
+		weekdays: [7]string{"So.", "Mo.", "Di.", "Mi.", "Do.", "Fr.", "Sa."},
+		months:   [12]string{"Jan.", "Feb.", "März", "Apr.", "Mai", "Juni", "Juli", "Aug.", "Sept.", "Okt.", "Nov.", "Dez."},
+		layout:   "{w}, {d}. {m}",
+	},
+	"es": {
+		weekdays: [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+		months:   [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		layout:   "{w}, {d} {m}",
+	},
+	"ja": {
+		weekdays: [7]string{"日", "月", "火", "水", "木", "金", "土"},
+		layout:   "{n}月{d}日({w})",
+	},
+}
+
+// formatDate is the formatDate template function: it writes the day of t,
+// in t's time zone, as a short date of lang such as "Mon, Oct 19".
+func formatDate(lang string, t time.Time) string {
+	names, ok := shortDates[lang]
+	if !ok {
+		names = shortDates[defaultLanguage]
+	}
+	return strings.NewReplacer(
+		"{w}", names.weekdays[t.Weekday()],
+		"{d}", strconv.Itoa(t.Day()),
+		"{m}", names.months[t.Month()-1],
+		"{n}", strconv.Itoa(int(t.Month())),
+	).Replace(names.layout)
+}
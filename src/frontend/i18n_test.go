@@ -0,0 +1,177 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestCatalogsTranslateEveryKey(t *testing.T) {
+	for _, lang := range []string{"de", "es", "ja"} {
+		msgs, ok := catalogs[lang]
+		if !ok {
+			t.Errorf("no %s catalog", lang)
+			continue
+		}
+		for key, en := range catalogs[defaultLanguage] {
+			m, ok := msgs[key]
+			if !ok {
+				t.Errorf("%s: %s not translated", lang, key)
+			}
+			if en.one != "" && m.one == "" && pluralCategory(lang, 1) == "one" {
+				t.Errorf("%s: %s lacks the singular form", lang, key)
+			}
+		}
+	}
+}
+
+func TestTemplatesUseKnownKeys(t *testing.T) {
+	keyRE := regexp.MustCompile(`T \$\.lang "([^"]+)"`)
+	names, err := fs.Glob(embeddedTemplates, "templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		b, err := fs.ReadFile(embeddedTemplates, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range keyRE.FindAllStringSubmatch(string(b), -1) {
+			if _, ok := catalogs[defaultLanguage][m[1]]; !ok {
+				t.Errorf("%s: unknown message %s", name, m[1])
+			}
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		lang, key string
+		args      []interface{}
+		want      string
+	}{
+		{"en", "cart.title", []interface{}{"count", 1}, "Cart (1 item)"},
+		{"en", "cart.title", []interface{}{"count", 3}, "Cart (3 items)"},
+		{"en", "cart.title", []interface{}{"count", 0}, "Cart (0 items)"},
+		{"es", "cart.title", []interface{}{"count", 1}, "Carrito (1 artículo)"},
+		{"ja", "cart.title", []interface{}{"count", 1}, "カート（1 点）"},
+		{"de", "category.page", []interface{}{"page", 2, "pages", 5}, "Seite 2 von 5"},
+		{"de", "header.cart", nil, "Warenkorb"},
+	}
+	for _, tt := range tests {
+		got, err := translate(tt.lang, tt.key, tt.args...)
+		if err != nil || got != tt.want {
+			t.Errorf("T %s %s %v = %q, %v; want %q", tt.lang, tt.key, tt.args, got, err, tt.want)
+		}
+	}
+
+	if _, err := translate("en", "cart.title", "count"); err == nil {
+		t.Error("odd arguments accepted")
+	}
+	if _, err := translate("en", "cart.title", "count", "three"); err == nil {
+		t.Error("non-integer count accepted")
+	}
+}
+
+func TestTranslateFallsBackToEnglish(t *testing.T) {
+	catalogs[defaultLanguage]["test.only_en"] = message{other: "English only"}
+	t.Cleanup(func() { delete(catalogs[defaultLanguage], "test.only_en") })
+	missingMessages.Range(func(k, _ interface{}) bool {
+		missingMessages.Delete(k)
+		return true
+	})
+	hooks := log.ReplaceHooks(make(logrus.LevelHooks))
+	t.Cleanup(func() { log.ReplaceHooks(hooks) })
+	hook := logtest.NewLocal(log)
+
+	for i := 0; i < 2; i++ {
+		if got, _ := translate("de", "test.only_en"); got != "English only" {
+			t.Errorf("T de test.only_en = %q, want the English text", got)
+		}
+		if got, _ := translate("de", "test.nowhere"); got != "test.nowhere" {
+			t.Errorf("T de test.nowhere = %q, want the key", got)
+		}
+	}
+	// Once for de/test.only_en, de/test.nowhere and en/test.nowhere.
+	if n := len(hook.AllEntries()); n != 3 {
+		t.Errorf("%d missing translations logged, want 3", n)
+	}
+}
+
+func TestEnsureLanguage(t *testing.T) {
+	tests := []struct {
+		name, target, cookie, acceptLanguage string
+		want                                 string
+		wantCookie                           bool
+	}{
+		{"default", "/", "", "", "en", false},
+		{"Accept-Language", "/", "", "fr-FR,es-MX;q=0.8,en;q=0.5", "es", false},
+		{"unsupported", "/", "", "fr-FR", "en", false},
+		{"cookie over Accept-Language", "/", "ja", "de", "ja", false},
+		{"hl over cookie", "/?hl=de-AT", "ja", "es", "de", true},
+		{"unsupported hl", "/?hl=fr", "", "es", "es", false},
+		{"invalid cookie", "/", "xx", "de", "de", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest(http.MethodGet, tt.target, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: cookieLanguage, Value: tt.cookie})
+			}
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			var got string
+			w := httptest.NewRecorder()
+			ensureLanguage(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = pageLanguage(r)
+			})).ServeHTTP(w, r)
+			if got != tt.want {
+				t.Errorf("language = %q, want %q", got, tt.want)
+			}
+			set := false
+			for _, c := range w.Result().Cookies() {
+				set = set || (c.Name == cookieLanguage && c.Value == tt.want)
+			}
+			if set != tt.wantCookie {
+				t.Errorf("cookie set %v, want %v", set, tt.wantCookie)
+			}
+		})
+	}
+}
+
+func TestPagesRenderInLanguage(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	ensureLanguage(http.HandlerFunc(fe.homeHandler)).ServeHTTP(w, newTestRequest(http.MethodGet, "/?hl=de", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, `<html lang="de">`) || !strings.Contains(body, "Beliebte Produkte") {
+		t.Errorf("home page not in German: %.500s", body)
+	}
+
+	w = httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	if body := w.Body.String(); !strings.Contains(body, `<html lang="en">`) || !strings.Contains(body, "Hot Products") {
+		t.Error("home page not in English by default")
+	}
+}
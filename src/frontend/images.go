@@ -0,0 +1,396 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // decoded as a source format
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+// imageSizes are the sides, in pixels, of the square images /img/{size}/
+// serves. Other sizes are refused, which bounds the variants cached of each
+// image.
+var imageSizes = []int{64, 256, 512}
+
+const (
+	// imageCacheControl lets browsers and CDNs keep resized images for a
+	// month, and revalidate them by ETag after that.
+	imageCacheControl = "public, max-age=2592000"
+
+	// maxSourcePixels bounds the images decoded, which take 4 bytes a pixel
+	// in memory however small they are on disk.
+	maxSourcePixels = 25_000_000
+
+	defaultImageCacheBytes = 64 << 20
+)
+
+var (
+	errNotAnImage    = errors.New("not a JPEG, PNG or GIF image")
+	errNotAcceptable = errors.New("the image can only be served as image/jpeg or image/png")
+)
+
+// imageFormat is an encoding of resized images.
+type imageFormat struct {
+	mediaType string
+	encode    func(*bytes.Buffer, image.Image) error
+}
+
+// The formats resized images are served in. The standard library has no
+// WebP encoder, so browsers that prefer WebP get the better of these that
+// they accept.
+var (
+	jpegFormat = imageFormat{"image/jpeg", func(b *bytes.Buffer, m image.Image) error {
+		return jpeg.Encode(b, m, &jpeg.Options{Quality: 85})
+	}}
+	pngFormat = imageFormat{"image/png", func(b *bytes.Buffer, m image.Image) error {
+		return (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(b, m)
+	}}
+)
+
+// imageProxy resizes the images among the static assets, for /img/{size}/.
+type imageProxy struct {
+	fsys  fs.FS
+	cache resizedImageCache
+	group singleflight.Group
+}
+
+// resizedImageCache keeps encoded resized images. Keys name the source's
+// content, the size and the format, so entries never go stale.
+type resizedImageCache interface {
+	get(key string) ([]byte, bool)
+	put(key string, data []byte)
+}
+
+// newImageProxy resizes the images of fsys, caching the results on disk in
+// dir (IMAGE_CACHE_DIR) when set, or else in memory up to maxBytes
+// (IMAGE_CACHE_BYTES).
+func newImageProxy(fsys fs.FS, dir string, maxBytes int64) (*imageProxy, error) {
+	p := &imageProxy{fsys: fsys}
+	if dir == "" {
+		p.cache = newMemoryImageCache(maxBytes)
+		return p, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create the image cache directory")
+	}
+	p.cache = diskImageCache(dir)
+	return p, nil
+}
+
+// imageHandler serves /img/{size}/{path}: the static asset at path, cropped
+// to a square and scaled down to size, in the format negotiated from the
+// Accept header.
+func (fe *frontendServer) imageHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	if fe.images == nil {
+		http.NotFound(w, r)
+		return
+	}
+	vars := mux.Vars(r)
+	size, err := strconv.Atoi(vars["size"])
+	if err != nil || !slices.Contains(imageSizes, size) {
+		http.Error(w, "size must be 64, 256 or 512", http.StatusBadRequest)
+		return
+	}
+	// The router has cleaned the path already; what is left of .. segments
+	// or absolute paths would climb out of the static assets.
+	name := vars["path"]
+	if !fs.ValidPath(name) || strings.Contains(name, `\`) {
+		http.Error(w, "invalid image path", http.StatusBadRequest)
+		return
+	}
+	source, err := fs.ReadFile(fe.images.fsys, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	format, ok := negotiateImageFormat(r, name)
+	if !ok {
+		http.Error(w, errNotAcceptable.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	data, etag, err := fe.images.resized(source, size, format)
+	if errors.Is(err, errNotAnImage) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.WithField("error", err).WithField("image", name).Error("failed to resize image")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", format.mediaType)
+	h.Set("Cache-Control", imageCacheControl)
+	h.Set("ETag", etag)
+	h.Add("Vary", "Accept")
+	// ServeContent handles If-None-Match against the ETag set above.
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// resized returns source resized to size and encoded in format, from the
+// cache if it is there, and its ETag.
+func (p *imageProxy) resized(source []byte, size int, format imageFormat) ([]byte, string, error) {
+	sum := sha256.Sum256(source)
+	key := hex.EncodeToString(sum[:16]) + "-" + strconv.Itoa(size) + "-" + path.Base(format.mediaType)
+	keySum := sha256.Sum256([]byte(key))
+	etag := `"` + base64.RawURLEncoding.EncodeToString(keySum[:16]) + `"`
+	if data, ok := p.cache.get(key); ok {
+		return data, etag, nil
+	}
+	v, err, _ := p.group.Do(key, func() (interface{}, error) {
+		data, err := resizeImage(source, size, format)
+		if err != nil {
+			return nil, err
+		}
+		p.cache.put(key, data)
+		return data, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return v.([]byte), etag, nil
+}
+
+// resizeImage decodes source, crops it to a centered square and scales that
+// down to size, or leaves it if it is smaller, then encodes it in format.
+func resizeImage(source []byte, size int, format imageFormat) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return nil, errNotAnImage
+	}
+	if cfg.Width*cfg.Height > maxSourcePixels {
+		return nil, errors.Errorf("image of %dx%d pixels is too large to resize", cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, errNotAnImage
+	}
+
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := b.Min.Add(image.Pt((b.Dx()-side)/2, (b.Dy()-side)/2))
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	if format.mediaType == jpegFormat.mediaType {
+		// JPEG has no transparency: show what is transparent as white.
+		draw.Draw(square, square.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	}
+	draw.Draw(square, square.Bounds(), src, crop, draw.Over)
+
+	var buf bytes.Buffer
+	if err := format.encode(&buf, scaleDown(square, size)); err != nil {
+		return nil, errors.Wrapf(err, "failed to encode %s", format.mediaType)
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown scales the square src down to size by averaging the pixels each
+// destination pixel covers. Averaging premultiplied colors keeps transparent
+// pixels from darkening their neighbors.
+func scaleDown(src *image.RGBA, size int) *image.RGBA {
+	side := src.Bounds().Dx()
+	if size >= side {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := y*side/size, (y+1)*side/size
+		for x := 0; x < size; x++ {
+			x0, x1 := x*side/size, (x+1)*side/size
+			var sum [4]uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					for c := range sum {
+						sum[c] += uint64(row[i+c])
+					}
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			out := dst.Pix[y*dst.Stride+x*4:]
+			for c := range sum {
+				out[c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// negotiateImageFormat picks the format of the image at name that the
+// request accepts best, preferring that of the source on a tie: JPEG for
+// photos, PNG for images that may have transparency.
+func negotiateImageFormat(r *http.Request, name string) (imageFormat, bool) {
+	formats := []imageFormat{pngFormat, jpegFormat}
+	if ext := strings.ToLower(path.Ext(name)); ext == ".jpg" || ext == ".jpeg" {
+		formats = []imageFormat{jpegFormat, pngFormat}
+	}
+	var best imageFormat
+	bestQ := 0.0
+	for _, f := range formats {
+		if q := acceptQuality(r, f.mediaType); q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// acceptQuality returns the quality the Accept header of r gives mediaType,
+// from the most specific range that matches it; 1 without the header.
+func acceptQuality(r *http.Request, mediaType string) float64 {
+	values := r.Header.Values("Accept")
+	if len(values) == 0 {
+		return 1
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			mt, params, err := mime.ParseMediaType(part)
+			if err != nil {
+				continue
+			}
+			var s int
+			switch mt {
+			case mediaType:
+				s = 2
+			case typ + "/*":
+				s = 1
+			case "*/*":
+				s = 0
+			default:
+				continue
+			}
+			if s <= specificity {
+				continue
+			}
+			pq := 1.0
+			if v, ok := params["q"]; ok {
+				if pq, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			q, specificity = pq, s
+		}
+	}
+	return q
+}
+
+// memoryImageCache is a resizedImageCache that drops the least recently used
+// images beyond a total size.
+type memoryImageCache struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	lru   *list.List // of *memoryImage, most recently used first
+	byKey map[string]*list.Element
+}
+
+type memoryImage struct {
+	key  string
+	data []byte
+}
+
+func newMemoryImageCache(maxBytes int64) *memoryImageCache {
+	return &memoryImageCache{maxBytes: maxBytes, lru: list.New(), byKey: make(map[string]*list.Element)}
+}
+
+func (c *memoryImageCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*memoryImage).data, true
+}
+
+func (c *memoryImageCache) put(key string, data []byte) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.byKey[key]; ok {
+		return
+	}
+	c.byKey[key] = c.lru.PushFront(&memoryImage{key: key, data: data})
+	c.bytes += int64(len(data))
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops e from the cache. c.mu must be held.
+func (c *memoryImageCache) remove(e *list.Element) {
+	img := c.lru.Remove(e).(*memoryImage)
+	delete(c.byKey, img.key)
+	c.bytes -= int64(len(img.data))
+}
+
+// diskImageCache is a resizedImageCache keeping a file per image in a
+// directory, which it does not bound: there are only so many sizes of the
+// static images.
+type diskImageCache string
+
+func (d diskImageCache) get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(filepath.Join(string(d), key))
+	return data, err == nil
+}
+
+// put writes the image to a temporary file first, so that concurrent
+// readers, of this replica or of others sharing the directory, never see
+// part of it. A failed write only costs resizing the image again.
+func (d diskImageCache) put(key string, data []byte) {
+	f, err := os.CreateTemp(string(d), "."+key+"-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(string(d), key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+// testImageRouter serves the images of fsys at /img/, with the given cache.
+func testImageRouter(t *testing.T, fsys fstest.MapFS, cacheDir string) (http.Handler, *imageProxy) {
+	t.Helper()
+	fe := newTestFrontend(t, newFakeBackend())
+	images, err := newImageProxy(fsys, cacheDir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe.images = images
+	handle := func(_ string, h http.HandlerFunc) http.HandlerFunc { return h }
+	return fe.newRouter("", "", handle), images
+}
+
+func testPNG(t *testing.T, w, h int, c color.Color) []byte {
+	t.Helper()
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageHandler(t *testing.T) {
+	fsys := fstest.MapFS{
+		"img/products/wide.png": {Data: testPNG(t, 1000, 600, color.NRGBA{200, 0, 0, 255})},
+		"img/products/tiny.png": {Data: testPNG(t, 40, 30, color.NRGBA{0, 0, 200, 128})},
+		"img/products/bad.png":  {Data: []byte("not an image")},
+		"styles/styles.css":     {Data: []byte("body {}")},
+	}
+	r, _ := testImageRouter(t, fsys, "")
+
+	for _, tc := range []struct {
+		path, accept string
+		code         int
+		contentType  string
+		side         int
+	}{
+		{"/img/256/img/products/wide.png", "", http.StatusOK, "image/png", 256},
+		{"/img/512/img/products/wide.png", "image/webp,image/*;q=0.8", http.StatusOK, "image/png", 512},
+		{"/img/64/img/products/wide.png", "image/jpeg,image/png;q=0.5", http.StatusOK, "image/jpeg", 64},
+		// Smaller images are cropped, not scaled up.
+		{"/img/64/img/products/tiny.png", "", http.StatusOK, "image/png", 30},
+		{"/img/64/img/products/wide.png", "image/webp", http.StatusNotAcceptable, "", 0},
+		{"/img/100/img/products/wide.png", "", http.StatusBadRequest, "", 0},
+		{"/img/large/img/products/wide.png", "", http.StatusBadRequest, "", 0},
+		{"/img/64/img/products/bad.png", "", http.StatusBadRequest, "", 0},
+		{"/img/64/styles/styles.css", "", http.StatusBadRequest, "", 0},
+		{"/img/64/img/products/missing.png", "", http.StatusNotFound, "", 0},
+	} {
+		req := newTestRequest(http.MethodGet, tc.path, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("%s (Accept %q): got status %d, want %d", tc.path, tc.accept, w.Code, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != tc.contentType {
+			t.Errorf("%s (Accept %q): Content-Type %q, want %q", tc.path, tc.accept, got, tc.contentType)
+		}
+		if w.Header().Get("Cache-Control") != imageCacheControl || w.Header().Get("Vary") != "Accept" || w.Header().Get("ETag") == "" {
+			t.Errorf("%s: headers %v", tc.path, w.Header())
+		}
+		m, _, err := image.Decode(w.Body)
+		if err != nil {
+			t.Errorf("%s: %v", tc.path, err)
+			continue
+		}
+		if b := m.Bounds(); b.Dx() != tc.side || b.Dy() != tc.side {
+			t.Errorf("%s: image is %dx%d, want %dx%[3]d", tc.path, b.Dx(), b.Dy(), tc.side)
+		}
+		if r, g, b, _ := m.At(tc.side/2, tc.side/2).RGBA(); tc.path == "/img/256/img/products/wide.png" && (r>>8 != 200 || g != 0 || b != 0) {
+			t.Errorf("%s: center pixel %v", tc.path, m.At(tc.side/2, tc.side/2))
+		}
+	}
+}
+
+func TestImageHandlerRejectsTraversal(t *testing.T) {
+	r, _ := testImageRouter(t, fstest.MapFS{"img/a.png": {Data: testPNG(t, 8, 8, color.White)}}, "")
+	for _, p := range []string{
+		"/img/64/../../../etc/passwd",
+		"/img/64/img/..%2f..%2f..%2fetc%2fpasswd",
+		"/img/64/%2e%2e/%2e%2e/etc/passwd",
+		"/img/64/%2fetc%2fpasswd",
+		"/img/64/img%5c..%5c..%5cetc%5cpasswd",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, newTestRequest(http.MethodGet, p, nil))
+		if w.Code == http.StatusOK {
+			t.Errorf("%s: got status %d", p, w.Code)
+		}
+	}
+}
+
+func TestImageHandlerCaches(t *testing.T) {
+	source := testPNG(t, 600, 600, color.NRGBA{0, 200, 0, 255})
+	for _, dir := range []string{"", t.TempDir()} {
+		fsys := fstest.MapFS{"img/a.png": {Data: source}}
+		r, images := testImageRouter(t, fsys, dir)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, newTestRequest(http.MethodGet, "/img/256/img/a.png", nil))
+		etag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK {
+			t.Fatalf("dir %q: got status %d", dir, w.Code)
+		}
+		if dir != "" {
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("cache directory holds %d files, want 1", len(entries))
+			}
+		}
+
+		// A cached image is served without decoding the source again.
+		cached := images.cache
+		images.cache = failingImageCache{cached, t}
+		req := newTestRequest(http.MethodGet, "/img/256/img/a.png", nil)
+		req.Header.Set("If-None-Match", etag)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("dir %q: revalidation got status %d, want %d", dir, w.Code, http.StatusNotModified)
+		}
+		images.cache = cached
+
+		// Changed content is a new image.
+		fsys["img/a.png"] = &fstest.MapFile{Data: testPNG(t, 600, 600, color.NRGBA{0, 0, 200, 255})}
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, newTestRequest(http.MethodGet, "/img/256/img/a.png", nil))
+		if w.Header().Get("ETag") == etag {
+			t.Errorf("dir %q: same ETag after the source changed", dir)
+		}
+	}
+}
+
+// failingImageCache fails the test when asked to store an image.
+type failingImageCache struct {
+	resizedImageCache
+	t *testing.T
+}
+
+func (c failingImageCache) put(key string, _ []byte) {
+	c.t.Errorf("resized %s again", key)
+}
+
+func TestMemoryImageCacheEvicts(t *testing.T) {
+	c := newMemoryImageCache(10)
+	c.put("a", make([]byte, 4))
+	c.put("b", make([]byte, 4))
+	c.get("a")
+	c.put("c", make([]byte, 4)) // evicts b, the least recently used
+	c.put("huge", make([]byte, 11))
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "huge": false} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("%s cached: %v, want %v", key, ok, want)
+		}
+	}
+	if c.bytes != 8 {
+		t.Errorf("cache holds %d bytes, want 8", c.bytes)
+	}
+}
+
+func TestResizeImageFlattensForJPEG(t *testing.T) {
+	data, err := resizeImage(testPNG(t, 100, 100, color.NRGBA{0, 0, 0, 0}), 64, jpegFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := m.At(32, 32).RGBA(); r>>8 < 250 {
+		t.Errorf("transparent pixel encoded as %v, want white", m.At(32, 32))
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.elastic.co/apm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// idempotentMethods are the read-only RPCs that are safe to issue more than
+// once. Mutations such as AddItem, EmptyCart and PlaceOrder must never be
+// retried.
+var idempotentMethods = map[string]bool{
+	"/hipstershop.ProductCatalogService/ListProducts":        true,
+	"/hipstershop.ProductCatalogService/GetProduct":          true,
+	"/hipstershop.ProductCatalogService/SearchProducts":      true,
+	"/hipstershop.CartService/GetCart":                       true,
+	"/hipstershop.CurrencyService/GetSupportedCurrencies":    true,
+	"/hipstershop.CurrencyService/Convert":                   true,
+	"/hipstershop.RecommendationService/ListRecommendations": true,
+	"/hipstershop.ShippingService/GetQuote":                  true,
+	"/hipstershop.AdService/GetAds":                          true,
+}
+
+var grpcClientRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "grpc_client_retries_total",
+	Help: "Number of retried unary gRPC calls, by service and the gRPC code that triggered the retry.",
+}, []string{"service", "code"})
+
+// retryPolicy controls how idempotent calls are retried after transient
+// failures.
+type retryPolicy struct {
+	maxRetries  int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+}
+
+var grpcRetry = retryPolicy{
+	maxRetries:  2,
+	baseBackoff: 50 * time.Millisecond,
+	maxBackoff:  time.Second,
+}
+
+// backoff returns the delay before the given retry attempt (starting at 1),
+// using exponential growth with full jitter.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.baseBackoff << uint(attempt-1)
+	if d <= 0 || d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// unaryInterceptor retries idempotent calls that fail with Unavailable, as
+// long as the caller's deadline leaves room for another attempt.
+func (p retryPolicy) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if !idempotentMethods[method] {
+		return err
+	}
+	for attempt := 1; attempt <= p.maxRetries; attempt++ {
+		code := status.Code(err)
+		if code != codes.Unavailable {
+			return err
+		}
+		wait := p.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+			return err
+		}
+
+		grpcClientRetriesTotal.WithLabelValues(grpcServiceName(method), code.String()).Inc()
+		loggerFromContext(ctx).WithFields(logrus.Fields{
+			"grpc.target":   cc.Target(),
+			"grpc.method":   method,
+			"grpc.code":     code.String(),
+			"retry":         attempt,
+			"retry.wait_ms": wait.Milliseconds(),
+		}).Debug("retrying grpc call")
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		err = invoker(ctx, method, req, reply, cc, opts...)
+	}
+	return err
+}
+
+// apmSpanStatusInterceptor labels the APM span started by apmgrpc with the
+// call's gRPC status code. It must come after the apmgrpc interceptor in the
+// chain so that the span is in ctx.
+func apmSpanStatusInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if span := apm.SpanFromContext(ctx); span != nil {
+		span.Context.SetLabel("grpc_status_code", status.Code(err).String())
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.elastic.co/apm/apmtest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCCallsRecordAPMSpans(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("GetProduct", status.Error(codes.NotFound, "no such product"))
+	fe := newTestFrontend(t, fb, grpcDialOptions(0, nil, nil)...)
+
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	_, spans, _ := tracer.WithTransaction(func(ctx context.Context) {
+		if _, err := fe.getCart(ctx, "test-session"); err != nil {
+			t.Error(err)
+		}
+		fe.getProduct(ctx, "OLJCESPC7Z")
+	})
+
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	tests := []struct {
+		name, code string
+	}{
+		{"/hipstershop.CartService/GetCart", "OK"},
+		{"/hipstershop.ProductCatalogService/GetProduct", "NotFound"},
+	}
+	for i, tt := range tests {
+		s := spans[i]
+		if s.Name != tt.name {
+			t.Errorf("span %d name = %q, want %q", i, s.Name, tt.name)
+		}
+		var code interface{}
+		for _, l := range s.Context.Tags {
+			if l.Key == "grpc_status_code" {
+				code = l.Value
+			}
+		}
+		if code != tt.code {
+			t.Errorf("span %q status code label = %v, want %q", s.Name, code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	unixScheme = "unix://"
+
+	defaultSocketMode os.FileMode = 0o660
+)
+
+// listenAddr is an address the shop is served on: a TCP host:port, or the
+// path of a unix socket.
+type listenAddr struct {
+	network string
+	address string
+}
+
+func (a listenAddr) String() string {
+	if a.network == "unix" {
+		return unixScheme + a.address
+	}
+	return a.address
+}
+
+// listenAddrsFromEnv reads LISTEN_ADDR, a comma-separated list of addresses
+// to serve on. Each is a unix socket such as unix:///var/run/frontend.sock,
+// a host:port, or a bare host that gets port. Without LISTEN_ADDR the shop is
+// served on port of every interface.
+func listenAddrsFromEnv(l *envLoader, port string) []listenAddr {
+	v := os.Getenv("LISTEN_ADDR")
+	if strings.TrimSpace(v) == "" {
+		return []listenAddr{{network: "tcp", address: ":" + port}}
+	}
+	var out []listenAddr
+	seen := make(map[listenAddr]bool)
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		var a listenAddr
+		switch {
+		case s == "":
+			// Not every interface: that would defeat a socket-only setup.
+			l.problem("LISTEN_ADDR: %q has an empty address", v)
+			continue
+		case strings.HasPrefix(s, unixScheme):
+			a = listenAddr{network: "unix", address: strings.TrimPrefix(s, unixScheme)}
+			if a.address == "" {
+				l.problem("LISTEN_ADDR: %q has no socket path", s)
+				continue
+			}
+		case strings.Contains(s, "://"):
+			l.problem("LISTEN_ADDR: %q must be a host, a host:port or a unix:// socket", s)
+			continue
+		default:
+			a = listenAddr{network: "tcp", address: s}
+			if _, p, err := net.SplitHostPort(s); err != nil {
+				a.address = net.JoinHostPort(s, port)
+			} else if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+				l.problem("LISTEN_ADDR: invalid port in %q", s)
+				continue
+			}
+		}
+		if seen[a] {
+			l.problem("LISTEN_ADDR: %s listed twice", a)
+			continue
+		}
+		seen[a] = true
+		out = append(out, a)
+	}
+	return out
+}
+
+// socketModeFromEnv reads LISTEN_SOCKET_MODE, the permissions of the unix
+// sockets in octal, such as 0660.
+func socketModeFromEnv(l *envLoader) os.FileMode {
+	v := os.Getenv("LISTEN_SOCKET_MODE")
+	if v == "" {
+		return defaultSocketMode
+	}
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || m > 0o777 {
+		l.problem("LISTEN_SOCKET_MODE: invalid permissions %q", v)
+		return defaultSocketMode
+	}
+	return os.FileMode(m)
+}
+
+// listenHost returns the host the admin and redirect servers listen on: that
+// of the first TCP address in addrs, or every interface if there is none.
+func listenHost(addrs []listenAddr) string {
+	for _, a := range addrs {
+		if a.network == "tcp" {
+			host, _, _ := net.SplitHostPort(a.address)
+			return host
+		}
+	}
+	return ""
+}
+
+// listen opens a listener on a. A unix socket left behind by a process that
+// is gone is removed first, and the new one gets mode; it is removed again
+// when the listener is closed.
+func (a listenAddr) listen(mode os.FileMode) (net.Listener, error) {
+	if a.network != "unix" {
+		return net.Listen(a.network, a.address)
+	}
+	if err := removeStaleSocket(a.address); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", a.address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(a.address, mode); err != nil {
+		ln.Close()
+		return nil, errors.Wrapf(err, "could not set the permissions of %s", a.address)
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the unix socket at path unless a process still
+// accepts connections on it. Files other than sockets are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return errors.Errorf("%s is in use by another process", path)
+	}
+	return errors.Wrap(os.Remove(path), "could not remove stale socket")
+}
+
+// listenAll opens a listener on each of addrs, all or none of them.
+func listenAll(addrs []listenAddr, mode os.FileMode) ([]net.Listener, error) {
+	out := make([]net.Listener, 0, len(addrs))
+	for _, a := range addrs {
+		ln, err := a.listen(mode)
+		if err != nil {
+			for _, ln := range out {
+				ln.Close()
+			}
+			return nil, errors.Wrapf(err, "could not listen on %s", a)
+		}
+		out = append(out, ln)
+	}
+	return out, nil
+}
+
+// fromUnixSocket reports whether r came in on a unix socket, whose peer can
+// only be a local proxy.
+func fromUnixSocket(r *http.Request) bool {
+	_, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return ok
+}
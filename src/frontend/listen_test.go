@@ -0,0 +1,191 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestListenAddrsFromEnv(t *testing.T) {
+	for v, want := range map[string][]listenAddr{
+		"":          {{"tcp", ":8080"}},
+		"127.0.0.1": {{"tcp", "127.0.0.1:8080"}},
+		"::1":       {{"tcp", "[::1]:8080"}},
+		"unix:///var/run/frontend.sock, 127.0.0.1:9000": {
+			{"unix", "/var/run/frontend.sock"},
+			{"tcp", "127.0.0.1:9000"},
+		},
+	} {
+		t.Setenv("LISTEN_ADDR", v)
+		var l envLoader
+		if got := listenAddrsFromEnv(&l, "8080"); !reflect.DeepEqual(got, want) || l.err() != nil {
+			t.Errorf("LISTEN_ADDR=%q: %v, %v; want %v", v, got, l.err(), want)
+		}
+	}
+
+	for _, v := range []string{"unix://", "http://localhost", "localhost:http", "localhost:0", ":8080,:8080",
+		"unix:///run/frontend.sock,", "unix:///run/a.sock,,unix:///run/b.sock", " , "} {
+		t.Setenv("LISTEN_ADDR", v)
+		var l envLoader
+		if listenAddrsFromEnv(&l, "8080"); l.err() == nil {
+			t.Errorf("LISTEN_ADDR=%q accepted", v)
+		}
+	}
+}
+
+func TestSocketModeFromEnv(t *testing.T) {
+	t.Setenv("LISTEN_SOCKET_MODE", "0600")
+	var l envLoader
+	if m := socketModeFromEnv(&l); m != 0o600 || l.err() != nil {
+		t.Errorf("mode %v, %v", m, l.err())
+	}
+	for _, v := range []string{"rw", "0999", "01777"} {
+		t.Setenv("LISTEN_SOCKET_MODE", v)
+		l = envLoader{}
+		if socketModeFromEnv(&l); l.err() == nil {
+			t.Errorf("LISTEN_SOCKET_MODE=%q accepted", v)
+		}
+	}
+}
+
+// unixClient is an HTTP client that connects to the socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestServeOnSeveralListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "frontend.sock")
+	addrs := []listenAddr{{"unix", sock}, {"tcp", "127.0.0.1:0"}}
+	lns, err := listenAll(addrs, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode %v, want 0600", fi.Mode().Perm())
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { io.WriteString(w, "ok") })}
+	done := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() { done <- srv.Serve(ln) }()
+	}
+	for name, c := range map[string]*http.Client{"unix": unixClient(sock), "tcp": http.DefaultClient} {
+		url := "http://frontend/"
+		if name == "tcp" {
+			url = "http://" + lns[1].Addr().String() + "/"
+		}
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d", name, resp.StatusCode)
+		}
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for range lns {
+		if err := <-done; err != http.ErrServerClosed {
+			t.Errorf("Serve returned %v", err)
+		}
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket left behind after shutdown: %v", err)
+	}
+	if _, err := net.Dial("tcp", lns[1].Addr().String()); err == nil {
+		t.Error("TCP listener still open after shutdown")
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "frontend.sock")
+
+	// A socket whose listener went away without removing it.
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenAddr{"unix", sock}.listen(defaultSocketMode)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+
+	// One still in use is not taken over.
+	if _, err := (listenAddr{"unix", sock}).listen(defaultSocketMode); err == nil {
+		t.Error("listened on a socket in use")
+	}
+	ln.Close()
+
+	file := filepath.Join(dir, "not-a-socket")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (listenAddr{"unix", file}).listen(defaultSocketMode); err == nil {
+		t.Error("replaced a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestListenAllClosesOnFailure(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "frontend.sock")
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	if _, err := listenAll([]listenAddr{{"unix", sock}, {"tcp", taken.Addr().String()}}, defaultSocketMode); err == nil {
+		t.Fatal("listened on a port in use")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket left open after a failed listen: %v", err)
+	}
+}
+
+func TestClientIPFromUnixSocket(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "@"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if got := resolveClientIP(r, nil); got != "@" {
+		t.Errorf("without a unix socket: client %q", got)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/var/run/frontend.sock", Net: "unix"}))
+	if got := resolveClientIP(r, nil); got != "203.0.113.7" {
+		t.Errorf("behind a unix socket: client %q, want the forwarded one", got)
+	}
+}
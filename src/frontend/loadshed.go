@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// inflightPerCPU is the default number of requests in flight per
+	// GOMAXPROCS. Requests mostly wait on backends, so each CPU can carry
+	// many of them.
+	inflightPerCPU              = 128
+	defaultInflightQueueTimeout = 250 * time.Millisecond
+	// shedRetryAfter is the Retry-After, in seconds, of shed requests.
+	shedRetryAfter = "1"
+)
+
+var (
+	inflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "http_inflight_requests",
+		Help: "Number of requests being served.",
+	})
+	queuedRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "http_queued_requests",
+		Help: "Number of requests waiting for a slot to be served.",
+	})
+	shedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_shed_requests_total",
+		Help: "Number of requests rejected with 503 under load, by reason: queue_full, or timeout when no slot freed up in time.",
+	}, []string{"reason"})
+)
+
+// defaultMaxInflight returns the default for MAX_INFLIGHT.
+func defaultMaxInflight() int {
+	return inflightPerCPU * runtime.GOMAXPROCS(0)
+}
+
+// loadShedder bounds the number of requests served at once. Requests over
+// the limit wait for a slot in a small queue, for at most timeout; beyond
+// that they are rejected straight away, which keeps latency bounded for the
+// requests that are served instead of letting all of them time out.
+type loadShedder struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+// newLoadShedder returns a shedder serving limit requests at once with up to
+// queue more waiting, or nil if limit is not positive, which disables it.
+func newLoadShedder(limit, queue int, timeout time.Duration) *loadShedder {
+	if limit <= 0 {
+		return nil
+	}
+	return &loadShedder{
+		slots:   make(chan struct{}, limit),
+		queue:   make(chan struct{}, max(queue, 0)),
+		timeout: timeout,
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there is room in it. It
+// returns the reason the request is shed if it got none.
+func (s *loadShedder) acquire(ctx context.Context) (bool, string) {
+	select {
+	case s.slots <- struct{}{}:
+		return true, ""
+	default:
+	}
+	select {
+	case s.queue <- struct{}{}:
+	default:
+		return false, "queue_full"
+	}
+	queuedRequests.Inc()
+	defer func() {
+		<-s.queue
+		queuedRequests.Dec()
+	}()
+	t := time.NewTimer(s.timeout)
+	defer t.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true, ""
+	case <-t.C:
+		return false, "timeout"
+	case <-ctx.Done():
+		return false, "timeout"
+	}
+}
+
+// middleware sheds the requests it gets no slot for with 503 Service
+// Unavailable and a Retry-After header: API clients get a JSON error,
+// browsers an error page. Liveness probes are always served, so that an
+// overloaded frontend is not restarted. A nil shedder lets every request
+// through.
+func (s *loadShedder) middleware(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimPrefix(r.URL.Path, baseUrl) == "/_healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, reason := s.acquire(r.Context())
+		if !ok {
+			shedRequestsTotal.WithLabelValues(reason).Inc()
+			renderOverloaded(w, r)
+			return
+		}
+		inflightRequests.Inc()
+		defer func() {
+			inflightRequests.Dec()
+			<-s.slots
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// renderOverloaded answers a shed request. It runs before logHandler, and
+// logs nothing: under load the counter says enough.
+func renderOverloaded(w http.ResponseWriter, r *http.Request) {
+	const code = http.StatusServiceUnavailable
+	w.Header().Set("Retry-After", shedRetryAfter)
+	log := loggerFromContext(r.Context())
+	if wantsJSON(r) {
+		writeJSON(log, w, code, apiError{Error: "the server is overloaded, retry shortly", Code: code})
+		return
+	}
+	renderErrorPage(log, r, w, "The shop is very busy right now. Please try again in a moment.", code)
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func shed(reason string) float64 {
+	return testutil.ToFloat64(shedRequestsTotal.WithLabelValues(reason))
+}
+
+func TestLoadShedderUnderStress(t *testing.T) {
+	const limit, queue, requests = 4, 4, 100
+	release := make(chan struct{})
+	h := newLoadShedder(limit, queue, time.Minute).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	shedBefore := shed("queue_full")
+	inflightBefore := testutil.ToFloat64(inflightRequests)
+
+	var wg sync.WaitGroup
+	codes := make([]int, requests)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := "/product/OLJCESPC7Z"
+			if i%2 == 0 {
+				target = "/api/products"
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newTestRequest(http.MethodGet, target, nil))
+			codes[i] = w.Code
+			if w.Code == http.StatusServiceUnavailable {
+				if w.Header().Get("Retry-After") == "" {
+					t.Error("shed response without Retry-After")
+				}
+				if json := strings.HasPrefix(w.Header().Get("Content-Type"), "application/json"); json != (i%2 == 0) {
+					t.Errorf("%s: shed response is JSON: %v", target, json)
+				}
+			}
+		}(i)
+	}
+	waitFor(t, "the excess requests to be shed", func() bool { return shed("queue_full")-shedBefore == requests-limit-queue })
+	waitFor(t, "the slots to fill", func() bool { return testutil.ToFloat64(inflightRequests)-inflightBefore == limit })
+	close(release)
+	wg.Wait()
+
+	served := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			served++
+		}
+	}
+	if served != limit+queue {
+		t.Errorf("%d requests served, want %d with the queued ones", served, limit+queue)
+	}
+	if got := testutil.ToFloat64(inflightRequests) - inflightBefore; got != 0 {
+		t.Errorf("%v requests still counted in flight", got)
+	}
+}
+
+func TestLoadShedderQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+	h := newLoadShedder(1, 1, 10*time.Millisecond).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/slow", nil))
+	}()
+	<-started
+
+	before := shed("timeout")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable || shed("timeout")-before != 1 {
+		t.Errorf("status %d, want 503 once the queue wait timed out", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest(http.MethodGet, "/_healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("liveness probe: status %d, want it served under load", w.Code)
+	}
+}
+
+func TestLoadShedderDisabled(t *testing.T) {
+	h := http.NewServeMux()
+	if got := newLoadShedder(0, 10, time.Second).middleware(h); got != http.Handler(h) {
+		t.Error("MAX_INFLIGHT=0 still wraps the handler")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultLogSamplingSlow = time.Second
+
+// logSampling drops a share of the access log entries of successful
+// requests to some routes, along with every other line the requests logged.
+// Failed requests, and those slower than slow, are always logged.
+type logSampling struct {
+	// rates are the shares of requests logged, between 0 and 1, by route
+	// template below BASE_URL, e.g. /product/{id}. Other routes are
+	// always logged.
+	rates map[string]float64
+	slow  time.Duration
+}
+
+// logSamplingFromEnv reads LOG_SAMPLING, a comma-separated list of
+// route=rate pairs such as /=0.1,/product/{id}=0.05, and
+// LOG_SAMPLING_SLOW_THRESHOLD. It returns nil, for no sampling, when
+// LOG_SAMPLING is not set.
+func logSamplingFromEnv(l *envLoader) *logSampling {
+	v := l.str("LOG_SAMPLING", "")
+	slow := l.duration("LOG_SAMPLING_SLOW_THRESHOLD", defaultLogSamplingSlow)
+	if v == "" {
+		return nil
+	}
+	s := &logSampling{rates: make(map[string]float64), slow: slow}
+	for _, pair := range strings.Split(v, ",") {
+		route, rate, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !strings.HasPrefix(route, "/") {
+			l.problem("LOG_SAMPLING: %q must be a route and a rate, like /product/{id}=0.05", pair)
+			continue
+		}
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r < 0 || r > 1 {
+			l.problem("LOG_SAMPLING: rate %q of %s must be between 0 and 1", rate, route)
+			continue
+		}
+		s.rates[route] = r
+	}
+	return s
+}
+
+// keep reports whether the lines of the request with the given ID, served
+// by route (a template with baseUrl) with code after took, are written.
+func (s *logSampling) keep(route, requestID string, code int, took time.Duration) bool {
+	if s == nil || code >= 400 || took >= s.slow {
+		return true
+	}
+	rate, ok := s.rates[strings.TrimPrefix(route, baseUrl)]
+	return !ok || requestSample(requestID) < rate
+}
+
+// requestSample maps a request ID to a number in [0, 1), the same for every
+// frontend that sees the request, so that their decisions agree.
+func requestSample(id string) float64 {
+	sum := sha256.Sum256([]byte(id))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// heldLog holds the lines a request logs until the sampling decision made
+// when it completes: they are then written out, or dropped, together.
+type heldLog struct {
+	logger *logrus.Logger
+	out    io.Writer
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	decided bool
+	keep    bool
+}
+
+// holdLog returns a heldLog for lines that would go to parent, formatted and
+// hooked the same way.
+func holdLog(parent *logrus.Logger) *heldLog {
+	h := &heldLog{out: parent.Out}
+	h.logger = &logrus.Logger{
+		Out:          h,
+		Hooks:        parent.Hooks,
+		Formatter:    parent.Formatter,
+		ReportCaller: parent.ReportCaller,
+		Level:        parent.GetLevel(),
+		ExitFunc:     parent.ExitFunc,
+	}
+	return h
+}
+
+func (h *heldLog) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case !h.decided:
+		return h.buf.Write(p)
+	case h.keep:
+		// Handlers may log from goroutines that outlive the request.
+		return h.out.Write(p)
+	}
+	return len(p), nil
+}
+
+// release writes the held lines if keep is set, and drops them otherwise;
+// so too with later lines.
+func (h *heldLog) release(keep bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.decided, h.keep = true, keep
+	if keep && h.buf.Len() > 0 {
+		h.out.Write(h.buf.Bytes())
+	}
+	h.buf = bytes.Buffer{}
+}
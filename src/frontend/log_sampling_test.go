@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// sampledHandler is a logHandler with sampling, in front of routes that log
+// a debug line each, writing JSON lines to the returned buffer.
+func sampledHandler(t *testing.T, sampling *logSampling) (http.Handler, *bytes.Buffer) {
+	t.Helper()
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Level = logrus.DebugLevel
+	logger.Formatter = &logrus.JSONFormatter{}
+
+	router := mux.NewRouter()
+	debug := func(code int, delay time.Duration) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			loggerFromContext(r.Context()).Debug("handler line")
+			time.Sleep(delay)
+			w.WriteHeader(code)
+		}
+	}
+	router.HandleFunc("/", debug(http.StatusOK, 0))
+	router.HandleFunc("/product/{id}", debug(http.StatusOK, 0))
+	router.HandleFunc("/cart", debug(http.StatusFound, 0))
+	router.HandleFunc("/cart/checkout", debug(http.StatusBadGateway, 0))
+	router.HandleFunc("/slow", debug(http.StatusOK, 20*time.Millisecond))
+	router.Use(recordRouteTemplate)
+	return &logHandler{log: logger, next: instrumentRouter(router, router), sampling: sampling}, &buf
+}
+
+func TestLogSamplingKeepsRequestLinesTogether(t *testing.T) {
+	const rate = 0.3
+	h, buf := sampledHandler(t, &logSampling{rates: map[string]float64{"/product/{id}": rate}, slow: time.Minute})
+
+	var kept int
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("req-%d", i)
+		buf.Reset()
+		r := httptest.NewRequest(http.MethodGet, "/product/OLJCESPC7Z", nil)
+		r.Header.Set(requestIDHeader, id)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		lines := strings.Count(buf.String(), `"http.req.id":"`+id+`"`)
+		want := requestSample(id) < rate
+		if want && lines != 3 || !want && lines != 0 {
+			t.Fatalf("%s (sample %.2f): %d lines logged:\n%s", id, requestSample(id), lines, buf)
+		}
+		if want {
+			kept++
+		}
+	}
+	if kept < 40 || kept > 80 {
+		t.Errorf("kept %d of 200 requests at rate %v", kept, rate)
+	}
+}
+
+func TestLogSamplingAlwaysLogs(t *testing.T) {
+	h, buf := sampledHandler(t, &logSampling{rates: map[string]float64{"/": 0, "/cart/checkout": 0, "/slow": 0, "/cart": 0}, slow: 10 * time.Millisecond})
+	for _, tc := range []struct {
+		path string
+		logs bool
+	}{
+		{"/", false},
+		{"/cart", false},              // redirects count as successful
+		{"/cart/checkout", true},      // a 502
+		{"/nope", true},               // a 404
+		{"/slow", true},               // slower than the threshold
+		{"/product/OLJCESPC7Z", true}, // not sampled
+		{"/static/styles.css", true},  // a 404 of no route
+		{"/cart?page=2&sort=name", false},
+	} {
+		buf.Reset()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if logged := strings.Contains(buf.String(), "request complete"); logged != tc.logs {
+			t.Errorf("%s: logged %v, want %v", tc.path, logged, tc.logs)
+		}
+	}
+}
+
+func TestLogSamplingCountsDroppedRequests(t *testing.T) {
+	h, buf := sampledHandler(t, &logSampling{rates: map[string]float64{"/": 0}, slow: time.Minute})
+	metric := httpRequestsTotal.WithLabelValues("/", http.MethodGet, "200", "false")
+	before := testutil.ToFloat64(metric)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if buf.Len() != 0 {
+		t.Errorf("sampled away request logged:\n%s", buf)
+	}
+	if got := testutil.ToFloat64(metric) - before; got != 1 {
+		t.Errorf("request counter increased by %v, want 1", got)
+	}
+}
+
+func TestLogSamplingUnderBaseURL(t *testing.T) {
+	defer func(v string) { baseUrl = v }(baseUrl)
+	baseUrl = "/shop"
+	s := &logSampling{rates: map[string]float64{"/product/{id}": 0}, slow: time.Minute}
+	if s.keep("/shop/product/{id}", "req-1", http.StatusOK, 0) {
+		t.Error("route under the base path not sampled")
+	}
+}
+
+func TestHeldLogWritesLateLines(t *testing.T) {
+	var out bytes.Buffer
+	h := holdLog(&logrus.Logger{Out: &out, Formatter: new(logrus.TextFormatter), Level: logrus.InfoLevel, Hooks: make(logrus.LevelHooks)})
+	h.logger.Info("during")
+	if out.Len() != 0 {
+		t.Fatal("line written before the decision")
+	}
+	h.release(true)
+	h.logger.Info("after")
+	if s := out.String(); !strings.Contains(s, "during") || !strings.Contains(s, "after") {
+		t.Errorf("output %q", s)
+	}
+
+	out.Reset()
+	h = holdLog(&logrus.Logger{Out: &out, Formatter: new(logrus.TextFormatter), Level: logrus.InfoLevel, Hooks: make(logrus.LevelHooks)})
+	h.logger.Info("during")
+	h.release(false)
+	h.logger.Info("after")
+	if out.Len() != 0 {
+		t.Errorf("dropped request wrote %q", out.String())
+	}
+}
+
+func TestLogSamplingFromEnv(t *testing.T) {
+	t.Setenv("LOG_SAMPLING", "/=0.1, /product/{id}=0.05")
+	t.Setenv("LOG_SAMPLING_SLOW_THRESHOLD", "250ms")
+	var l envLoader
+	s := logSamplingFromEnv(&l)
+	if l.err() != nil || s == nil || s.rates["/"] != 0.1 || s.rates["/product/{id}"] != 0.05 || s.slow != 250*time.Millisecond {
+		t.Errorf("sampling %+v, err %v", s, l.err())
+	}
+
+	t.Setenv("LOG_SAMPLING", "")
+	if s := logSamplingFromEnv(&l); s != nil {
+		t.Errorf("empty LOG_SAMPLING: %+v", s)
+	}
+
+	for _, v := range []string{"/=2", "product=0.1", "/=x", "/"} {
+		t.Setenv("LOG_SAMPLING", v)
+		l = envLoader{}
+		logSamplingFromEnv(&l)
+		if l.err() == nil {
+			t.Errorf("LOG_SAMPLING=%q accepted", v)
+		}
+	}
+}
+
+func TestRequestSampleIsStable(t *testing.T) {
+	a, b := requestSample("abc-123"), requestSample("abc-123")
+	if a != b || a < 0 || a >= 1 {
+		t.Errorf("samples %v and %v", a, b)
+	}
+	if requestSample("abc-124") == a {
+		t.Error("different IDs got the same sample")
+	}
+}
@@ -16,23 +16,34 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"maps"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/profiler"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
-	"go.elastic.co/apm/module/apmhttp"
-	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.elastic.co/apm"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/featureflags"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/version"
 )
 
 const (
@@ -40,22 +51,54 @@ const (
 	defaultCurrency = "USD"
 	cookieMaxAge    = 60 * 60 * 48
 
-	cookiePrefix    = "shop_"
-	cookieSessionID = cookiePrefix + "session-id"
-	cookieCurrency  = cookiePrefix + "currency"
+	defaultShutdownTimeout = 20 * time.Second
+	defaultShutdownDelay   = 5 * time.Second
+	defaultHandlerTimeout  = 5 * time.Second
+
+	defaultCurrencyCacheTTL = 5 * time.Minute
+
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultMaxHeaderBytes    = 64 << 10
+
+	defaultH2MaxConcurrentStreams = 250
+
+	defaultMaxBodyBytes    = 64 << 10
+	defaultMaxBotBodyBytes = 8 << 20 // the assistant accepts uploaded images
+
+	cookiePrefix      = "shop_"
+	cookieSessionID   = cookiePrefix + "session-id"
+	cookieCurrency    = cookiePrefix + "currency"
+	cookieCSRFToken   = cookiePrefix + "csrf-token"
+	cookieOrderToken  = cookiePrefix + "order-token"
+	cookieAddress     = cookiePrefix + "address"
+	cookieCartVersion = cookiePrefix + "cart-version"
+	cookieLanguage    = cookiePrefix + "language"
+
+	cookieBannerDismissed = cookiePrefix + "banner-dismissed"
+	cookieFlash           = cookiePrefix + "flash"
+	cookieExperiments     = cookiePrefix + "experiments"
+
+	cookieRecentlyViewed = cookiePrefix + "recently-viewed"
+	cookieWishlist       = cookiePrefix + "wishlist"
 )
 
 var (
-	whitelistedCurrencies = map[string]bool{
-		"USD": true,
-		"EUR": true,
-		"CAD": true,
-		"JPY": true,
-		"GBP": true,
-		"TRY": true,
-	}
-
 	baseUrl = ""
+
+	// cartMaxQuantity caps the quantity of a single cart line, configurable
+	// via CART_MAX_QTY.
+	cartMaxQuantity = 10
+
+	// routeTimeouts holds per-route handler deadlines that differ from
+	// HANDLER_TIMEOUT_DEFAULT. Each can be overridden with
+	// HANDLER_TIMEOUT_<ROUTE>, e.g. HANDLER_TIMEOUT_CHECKOUT=20s.
+	routeTimeouts = map[string]time.Duration{
+		"checkout": 15 * time.Second,
+		"bot":      2 * time.Minute,
+	}
 )
 
 type ctxKeySessionID struct{}
@@ -86,21 +129,116 @@ type frontendServer struct {
 	collectorConn *grpc.ClientConn
 
 	shoppingAssistantSvcAddr string
+
+	// cookieSigner signs session cookies; nil leaves them unsigned.
+	cookieSigner *cookieSigner
+	// cookieSealer encrypts the saved checkout address.
+	cookieSealer *cookieSealer
+
+	// catalog caches the product catalog; nil disables caching.
+	catalog *catalogCache
+
+	// currencyRates caches exchange rates; nil disables caching and sends
+	// every conversion to the currency service.
+	currencyRates *money.Converter
+
+	// externalURL is where the shop is reached from the outside, such as
+	// https://shop.example.com; empty if unknown.
+	externalURL string
+	// sitemap generates /sitemap.xml; nil without EXTERNAL_URL.
+	sitemap *sitemaps
+	// robotsAllow lets crawlers in, as told by robots.txt along with
+	// robotsExtraRules.
+	robotsAllow      bool
+	robotsExtraRules string
+	// graphiqlEnabled serves the GraphQL explorer at GET /graphql.
+	graphiqlEnabled bool
+	// delivery estimates when orders arrive; nil shows no estimate.
+	delivery *deliveryEstimator
+	// images serves resized static images at /img/; nil serves none.
+	images *imageProxy
+	// audit records cart changes and orders; nil without AUDIT_LOG_PATH.
+	audit *auditLogger
+
+	// cartCounts caches cart item counts for /api/cart/count; nil
+	// disables caching.
+	cartCounts *cartCounts
+
+	// sessions keeps server-side session state; nil disables it, and
+	// handlers reach it through sessionState.
+	sessions sessionStore
+
+	// receipts keeps recent orders so their receipts can be reopened.
+	receipts *receiptStore
+
+	// orderTokens deduplicates resubmitted checkout forms.
+	orderTokens *orderTokens
+
+	// breakers guard the non-critical backends, by dependency name.
+	breakers map[string]*circuitBreaker
+
+	// productPageMaxAge is how long browsers may reuse a product page
+	// without revalidating its ETag.
+	productPageMaxAge time.Duration
+
+	// stock limits the quantities of products that can be ordered; nil
+	// when STOCK_FILE is not set, for unlimited stock.
+	stock *stockLevels
+
+	// variants are the variants of products listed in VARIANTS_FILE; other
+	// products get those of their categories (see productVariants).
+	variants map[string][]string
+
+	// giftWrapFee is added to orders to be gift wrapped, in USD.
+	giftWrapFee *pb.Money
+
+	// adSlots is the number of ads shown per page.
+	adSlots int
+	// servedAds validates ad click targets.
+	servedAds *servedAds
+
+	// currencies lists the currencies users can choose from.
+	currencies supportedCurrencies
+	// defaultCurrency is used for visitors whose country and languages do
+	// not suggest a supported currency, see ensureCurrency.
+	defaultCurrency string
+
+	// flags are the feature flags, see withFeatureFlags.
+	flags *featureflags.Store
+	// experiments are the A/B experiments sessions are assigned to, see
+	// ensureExperiments. experimentOverrides allows forcing a variant.
+	experiments         []experiment
+	experimentOverrides bool
+	// promos are the promo codes users can apply in the cart.
+	promos promoCodes
+
+	// draining is set once a termination signal has been received so that
+	// the health check can steer new traffic away before the listener closes.
+	draining atomic.Bool
 }
 
 func main() {
 	ctx := context.Background()
-	log := logrus.New()
-	log.Level = logrus.DebugLevel
-	log.Formatter = &logrus.JSONFormatter{
-		FieldMap: logrus.FieldMap{
-			logrus.FieldKeyTime:  "timestamp",
-			logrus.FieldKeyLevel: "severity",
-			logrus.FieldKeyMsg:   "message",
-		},
-		TimestampFormat: time.RFC3339Nano,
-	}
-	log.Out = os.Stdout
+	cfg, err := loadConfig()
+	if err != nil {
+		problems, ok := err.(configError)
+		if !ok {
+			log.Fatal(err)
+		}
+		for _, p := range problems {
+			log.WithField("problem", p).Error("invalid configuration")
+		}
+		log.Fatalf("%d configuration problem(s), exiting", len(problems))
+	}
+	log.SetLevel(cfg.logLevel)
+	log.AddHook(redactHook{fields: cfg.redactFields})
+
+	if templates, err = loadTemplates(cfg.templateDevMode); err != nil {
+		log.WithField("error", err).Fatal("failed to load templates")
+	}
+	if cfg.templateDevMode {
+		log.WithField("dir", templateDir).Info("serving templates from disk, reloading on change")
+	}
 
 	svc := new(frontendServer)
 
@@ -108,72 +246,474 @@ func main() {
 		propagation.NewCompositeTextMapPropagator(
 			propagation.TraceContext{}, propagation.Baggage{}))
 
-	baseUrl = os.Getenv("BASE_URL")
+	baseUrl = cfg.baseURL
+	staticAssetPrefix = cfg.staticAssetPrefix
+	assetHashes()
+	cookieAttrs = cookieAttributesFromEnv(log)
+	backendTransport = cfg.grpcTransport
+	backendConnConfigs = cfg.grpcConns
+	backendMetadata = cfg.backendMetadata
+	tracePropagation = cfg.traceFormats
+	telemetry = cfg.telemetry
+	if len(cfg.chaosRules) > 0 || cfg.adminPort != "" {
+		chaos = newChaosInjector(cfg.chaosRules)
+	}
+	if len(cfg.chaosRules) > 0 {
+		log.WithField("chaos.rules", formatChaosRules(cfg.chaosRules)).Warn("injecting faults")
+	}
 
-	if os.Getenv("ENABLE_TRACING") == "1" {
+	svc.cookieSigner = newCookieSigner(cfg.sessionSecret)
+	if svc.cookieSigner == nil {
+		log.Warn("SESSION_SECRET not set, session cookies will not be signed and saved addresses will not survive restarts")
+	}
+	svc.cookieSealer = newCookieSealer(cfg.sessionSecret)
+
+	log.WithField("telemetry", telemetry).Info("telemetry backend")
+	if telemetry != telemetryElastic {
+		// The APM agent starts with the process; stop it from reporting
+		// to a server nobody runs.
+		apm.DefaultTracer.Close()
+	} else {
+		sanitizeAPMFields(apm.DefaultTracer, cfg.redactFields)
+	}
+	if telemetry.exportsOTel(cfg.enableTracing) {
 		log.Info("Tracing enabled.")
+		svc.collectorAddr = cfg.collectorAddr
 		initTracing(log, ctx, svc)
 	} else {
 		log.Info("Tracing disabled.")
 	}
 
-	if os.Getenv("ENABLE_PROFILER") == "1" {
+	if cfg.enableProfiler {
 		log.Info("Profiling enabled.")
-		go initProfiling(log, "frontend", "1.0.0")
+		go initProfiling(log, "frontend", version.Version)
 	} else {
 		log.Info("Profiling disabled.")
 	}
 
-	srvPort := port
-	if os.Getenv("PORT") != "" {
-		srvPort = os.Getenv("PORT")
-	}
-	addr := os.Getenv("LISTEN_ADDR")
-	mustMapEnv(&svc.productCatalogSvcAddr, "PRODUCT_CATALOG_SERVICE_ADDR")
-	mustMapEnv(&svc.currencySvcAddr, "CURRENCY_SERVICE_ADDR")
-	mustMapEnv(&svc.cartSvcAddr, "CART_SERVICE_ADDR")
-	mustMapEnv(&svc.recommendationSvcAddr, "RECOMMENDATION_SERVICE_ADDR")
-	mustMapEnv(&svc.checkoutSvcAddr, "CHECKOUT_SERVICE_ADDR")
-	mustMapEnv(&svc.shippingSvcAddr, "SHIPPING_SERVICE_ADDR")
-	mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
-	mustMapEnv(&svc.shoppingAssistantSvcAddr, "SHOPPING_ASSISTANT_SERVICE_ADDR")
-
-	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
-	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
-	mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
-	mustConnGRPC(ctx, &svc.recommendationSvcConn, svc.recommendationSvcAddr)
-	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
-	mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
-	mustConnGRPC(ctx, &svc.adSvcConn, svc.adSvcAddr)
+	addr := listenHost(cfg.listenAddrs)
+	svc.productCatalogSvcAddr = cfg.productCatalogSvcAddr
+	svc.currencySvcAddr = cfg.currencySvcAddr
+	svc.cartSvcAddr = cfg.cartSvcAddr
+	svc.recommendationSvcAddr = cfg.recommendationSvcAddr
+	svc.checkoutSvcAddr = cfg.checkoutSvcAddr
+	svc.shippingSvcAddr = cfg.shippingSvcAddr
+	if cfg.features[featureAds] {
+		svc.adSvcAddr = cfg.adSvcAddr
+	}
+	if cfg.features[featureAssistant] {
+		svc.shoppingAssistantSvcAddr = cfg.shoppingAssistantSvcAddr
+	}
+	assistantEnabled = svc.assistantEnabled()
+	log.WithField("features", cfg.features.String()).Info("optional features")
+
+	cartMaxQuantity = cfg.cartMaxQuantity
+	grpcRetry.maxRetries = cfg.grpcRetryMax
+	grpcRetry.baseBackoff = cfg.grpcRetryBackoff
+	grpcHedge.delay = cfg.grpcHedgeDelay
+	if grpcHedge.delay > 0 {
+		log.WithField("hedge.delay", grpcHedge.delay).Info("hedging slow catalog reads")
+	}
 
-	r := mux.NewRouter()
-	r.HandleFunc(baseUrl+"/", svc.homeHandler).Methods(http.MethodGet, http.MethodHead)
-	r.HandleFunc(baseUrl+"/product/{id}", svc.productHandler).Methods(http.MethodGet, http.MethodHead)
-	r.HandleFunc(baseUrl+"/cart", svc.viewCartHandler).Methods(http.MethodGet, http.MethodHead)
-	r.HandleFunc(baseUrl+"/cart", svc.addToCartHandler).Methods(http.MethodPost)
-	r.HandleFunc(baseUrl+"/cart/empty", svc.emptyCartHandler).Methods(http.MethodPost)
-	r.HandleFunc(baseUrl+"/setCurrency", svc.setCurrencyHandler).Methods(http.MethodPost)
-	r.HandleFunc(baseUrl+"/logout", svc.logoutHandler).Methods(http.MethodGet)
-	r.HandleFunc(baseUrl+"/cart/checkout", svc.placeOrderHandler).Methods(http.MethodPost)
-	r.HandleFunc(baseUrl+"/assistant", svc.assistantHandler).Methods(http.MethodGet)
-	r.PathPrefix(baseUrl + "/static/").Handler(http.StripPrefix(baseUrl+"/static/", http.FileServer(http.Dir("./static/"))))
-	r.HandleFunc(baseUrl+"/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
-	r.HandleFunc(baseUrl+"/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
-	r.HandleFunc(baseUrl+"/product-meta/{ids}", svc.getProductByID).Methods(http.MethodGet)
-	r.HandleFunc(baseUrl+"/bot", svc.chatBotHandler).Methods(http.MethodPost)
-
-	// Wrap router with Elastic APM middleware
-	var handler http.Handler = apmhttp.Wrap(r)
+	// Pages render without ads and recommendations, so calls to those are
+	// cut short while the backend is failing.
+	svc.breakers = map[string]*circuitBreaker{
+		"ad":             newCircuitBreaker("ad", cfg.breakerThreshold, cfg.breakerCooldown),
+		"recommendation": newCircuitBreaker("recommendation", cfg.breakerThreshold, cfg.breakerCooldown),
+	}
+
+	mustConnGRPC(ctx, &svc.currencySvcConn, "currencyservice", svc.currencySvcAddr, nil)
+	mustConnGRPC(ctx, &svc.productCatalogSvcConn, "productcatalogservice", svc.productCatalogSvcAddr, nil)
+	mustConnGRPC(ctx, &svc.cartSvcConn, "cartservice", svc.cartSvcAddr, nil)
+	mustConnGRPC(ctx, &svc.recommendationSvcConn, "recommendationservice", svc.recommendationSvcAddr, svc.breakers["recommendation"])
+	mustConnGRPC(ctx, &svc.shippingSvcConn, "shippingservice", svc.shippingSvcAddr, nil)
+	mustConnGRPC(ctx, &svc.checkoutSvcConn, "checkoutservice", svc.checkoutSvcAddr, nil)
+	if svc.adSvcAddr != "" {
+		mustConnGRPC(ctx, &svc.adSvcConn, "adservice", svc.adSvcAddr, svc.breakers["ad"])
+	}
+
+	// Backends that are down at startup only make the frontend unready, and
+	// gRPC keeps reconnecting in the background, unless the deployment asks
+	// to fail fast.
+	if cfg.requireBackends {
+		if err := svc.requireBackends(ctx, cfg.startupBackendTimeout); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.catalogCacheTTL > 0 {
+		svc.catalog = newCatalogCache(svc.productCatalogSvcConn, cfg.catalogCacheTTL)
+	}
+	if cfg.currencyCacheTTL > 0 {
+		svc.currencyRates = money.NewConverter(pb.NewCurrencyServiceClient(svc.currencySvcConn), cfg.currencyCacheTTL)
+	}
+
+	svc.externalURL = cfg.externalURL
+	svc.robotsAllow = cfg.robotsAllow
+	svc.robotsExtraRules = cfg.robotsExtraRules
+	svc.graphiqlEnabled = cfg.graphiqlEnabled
+	svc.delivery = cfg.delivery
+	if svc.images, err = newImageProxy(staticFS(cfg.staticDir), cfg.imageCacheDir, int64(cfg.imageCacheBytes)); err != nil {
+		log.Fatal(err)
+	}
+	if svc.audit, err = newAuditLogger(cfg.audit); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.externalURL != "" {
+		svc.sitemap = newSitemaps(cfg.externalURL, cfg.catalogCacheTTL)
+	}
+
+	if svc.sessions, err = newSessionStore(ctx, log, cfg); err != nil {
+		log.Fatal(err)
+	}
+	svc.cartCounts = newCartCounts(cartCountTTL)
+	svc.receipts = newReceiptStore(cfg.orderHistorySize)
+	svc.giftWrapFee = cfg.giftWrapFee
+	svc.orderTokens = newOrderTokens(defaultOrderTokenCacheSize, orderTokenTTL)
+	svc.adSlots = cfg.adSlots
+	svc.productPageMaxAge = cfg.productPageMaxAge
+	svc.servedAds = newServedAds()
+
+	svc.currencies.allow = parseCurrencyAllowlist(cfg.currencyAllowlist)
+	svc.defaultCurrency = cfg.defaultCurrency
+	cctx, cancel := context.WithTimeout(ctx, currencyRefreshTimeout)
+	if _, err := svc.refreshCurrencies(cctx); err != nil {
+		log.WithField("error", err).Warn("could not load supported currencies, will retry on demand")
+	}
+	cancel()
+	go svc.watchCurrencies(ctx, log, cfg.currencyRefreshInterval)
+
+	svc.experiments = cfg.experiments
+	svc.experimentOverrides = cfg.experimentOverrides
+	if cfg.experimentOverrides {
+		log.Warn("experiment overrides allowed with ?exp=")
+	}
+
+	if cfg.stockFile != "" {
+		if svc.stock, err = loadStock(cfg.stockFile); err != nil {
+			log.Fatal(err)
+		}
+		log.WithField("file", cfg.stockFile).Infof("loaded the stock of %d products", len(svc.stock.levels))
+	}
+	if cfg.variantsFile != "" {
+		if svc.variants, err = loadVariants(cfg.variantsFile); err != nil {
+			log.Fatal(err)
+		}
+		log.WithField("file", cfg.variantsFile).Infof("loaded the variants of %d products", len(svc.variants))
+	}
+	live := &liveSettings{brand: cfg.brand, logLevel: cfg.logLevel, logLevelInFile: cfg.logLevelInFile}
+	if cfg.saleConfig != "" {
+		if live.sales, err = loadSales(cfg.saleConfig); err != nil {
+			log.Fatal(err)
+		}
+		log.WithField("file", cfg.saleConfig).Infof("loaded the sales of %d products", len(live.sales))
+	}
+	settings.Store(live)
+
+	svc.promos = cfg.promoCodes
+	if len(cfg.promoCodes) > 0 {
+		log.Infof("loaded %d promo codes", len(cfg.promoCodes))
+	}
+
+	svc.flags = featureflags.NewStore(defaultFlags)
+	if cfg.featureFlagsFile != "" {
+		if err := svc.flags.Load(cfg.featureFlagsFile); err != nil {
+			log.Fatal(err)
+		}
+		log.WithField("file", cfg.featureFlagsFile).Infof("loaded %d feature flags", len(svc.flags.Flags()))
+		go svc.flags.Watch(ctx, cfg.featureFlagsFile, cfg.featureFlagsPollInterval, func(err error) {
+			log.WithField("error", err).Warn("could not reload feature flags, keeping the previous ones")
+		})
+	}
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go svc.reloadOnSignal(log, reloadCh)
+
+	// Each route gets its deadline and, if configured, its rate limit and
+	// chaos rules.
+	handle := func(route string, h http.HandlerFunc) http.HandlerFunc {
+		limiter := newRateLimiter(route, cfg.rateLimits[route])
+		if limiter != nil {
+			go limiter.sweepIdle(ctx, rateLimitSweepInterval)
+		}
+		timeout, ok := cfg.handlerTimeouts[route]
+		if !ok {
+			timeout = cfg.handlerTimeout
+		}
+		return withDeadline(route, timeout, limiter.middleware(chaos.middleware(route, h)))
+	}
+
+	r := svc.newRouter(baseUrl, cfg.staticDir, handle)
+
+	var handler http.Handler = instrumentRouter(r, recoverPanics(r))
+
+	if cfg.csrfDisabled {
+		log.Warn("CSRF protection disabled")
+	}
+	handler = ensureCSRFToken(cfg.csrfDisabled, handler)
+
+	handler = limitBody(int64(cfg.maxBodyBytes), map[string]int64{
+		baseUrl + "/bot": int64(cfg.maxBotBodyBytes),
+	}, handler)
+	handler = svc.withFlashes(handler)
+	handler = svc.ensureCurrency(handler)
+	handler = ensureLanguage(handler)
+	handler = svc.ensureExperiments(handler)
+	handler = cfg.cors.middleware(handler)
 
 	// Add logging and session middleware
-	handler = &logHandler{log: log, next: handler}
-	handler = ensureSessionID(handler)
+	handler = withSessionStore(svc.sessions, handler)
+	handler = withFeatureFlags(svc.flags, handler)
+	handler = &logHandler{log: log, next: handler, skip: logSkipPathsFromEnv(), sampling: cfg.logSampling}
+	handler = ensureSessionID(svc.cookieSigner, handler)
+	if cfg.robotsAllow {
+		handler = detectBots(handler)
+	}
+	// Shed load before sessions and logging spend any work on the
+	// request, but inside the security headers and tracing.
+	handler = newLoadShedder(cfg.maxInflight, cfg.inflightQueue, cfg.inflightQueueTimeout).middleware(handler)
+	trustedProxies := parseTrustedProxies(log, cfg.trustedProxyCIDRs)
+	handler = securityHeadersFromEnv(trustedProxies).middleware(handler)
+	handler = realIP(trustedProxies, handler)
+	handler = labelBuild(handler)
+
+	// Trace outside of logHandler, so that the transaction exists by the
+	// time the request logger is built and log entries can carry its trace
+	// IDs.
+	handler = telemetry.httpMiddleware(handler)
+	if telemetry != telemetryNone {
+		handler = tracePropagation.middleware(handler)
+	}
 
-	// Add OpenTelemetry HTTP middleware for tracing (optional if you want both)
-	handler = otelhttp.NewHandler(handler, "frontend")
+	// Serve metrics outside of the session and logging middleware so that
+	// scrapes neither mint sessions nor flood the logs.
+	root := http.NewServeMux()
+	root.Handle("/metrics", promhttp.Handler())
+	root.HandleFunc("/version", versionHandler)
+	root.Handle("/", handler)
+	handler = root
+
+	var adminSrv *http.Server
+	adminToken := cfg.adminToken
+	if p := cfg.adminPort; p != "" {
+		adminSrv = newHTTPServer(cfg.http, net.JoinHostPort(addr, p), svc.adminHandler(log, adminToken))
+		go func() {
+			log.Infof("starting admin server on " + net.JoinHostPort(addr, p))
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	} else if adminToken != "" {
+		root.Handle("/debug/loglevel", requireAdminToken(adminToken, logLevelHandler(log)))
+	}
 
-	log.Infof("starting server on " + addr + ":" + srvPort)
-	log.Fatal(http.ListenAndServe(addr+":"+srvPort, handler))
+	tlsConf := cfg.tls
+	// srv serves every listener, so that shutting it down closes them all.
+	srv := newHTTPServer(cfg.http, "", handler)
+	var redirectSrv *http.Server
+	if tlsConf != nil {
+		srv.TLSConfig = tlsConf.config
+		if tlsConf.certs != nil {
+			hupCh := make(chan os.Signal, 1)
+			signal.Notify(hupCh, syscall.SIGHUP)
+			go tlsConf.reloadOnSignal(log, hupCh)
+		}
+		if p := cfg.redirectPort; p != "" {
+			redirectSrv = newHTTPServer(cfg.http, net.JoinHostPort(addr, p), tlsConf.redirectHandler(cfg.httpsPublicPort))
+			go func() {
+				log.Infof("redirecting HTTP to HTTPS on " + net.JoinHostPort(addr, p))
+				if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Fatal(err)
+				}
+			}()
+		}
+	}
+	if cfg.http.h2c {
+		if err := enableH2C(srv, cfg.http); err != nil {
+			log.Fatal(err)
+		}
+	}
+	listeners, err := listenAll(cfg.listenAddrs, cfg.socketMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, ln := range listeners {
+		go func(a listenAddr) {
+			var err error
+			if tlsConf != nil {
+				log.WithFields(buildLogFields()).Infof("starting TLS server on %s", a)
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				log.WithFields(buildLogFields()).Infof("starting server on %s", a)
+				err = srv.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(cfg.listenAddrs[i])
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	svc.shutdown(log, sig, cfg.shutdownDelay, cfg.shutdownTimeout, srv, redirectSrv, adminSrv)
+}
+
+// newRouter routes the shop's pages below base, a path such as /shop cleaned
+// by normalizeBaseURL, or "" to serve them from the root. A request for base
+// itself is redirected to base+"/". handle wraps the handlers of named
+// routes with their deadline and rate limit.
+func (fe *frontendServer) newRouter(base, staticDir string, handle func(route string, h http.HandlerFunc) http.HandlerFunc) *mux.Router {
+	r := mux.NewRouter()
+	s := r
+	if base != "" {
+		r.HandleFunc(base, func(w http.ResponseWriter, r *http.Request) {
+			u := *r.URL
+			u.Path = base + "/"
+			http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+		})
+		s = r.PathPrefix(base).Subrouter()
+	}
+	s.HandleFunc("/", handle("home", fe.homeHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/product/{id}", handle("product", fe.productHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/cart", handle("view_cart", fe.viewCartHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/api/cart", handle("api_cart", fe.apiCartHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/api/cart/count", handle("api_cart_count", fe.apiCartCountHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/api/search", handle("api_search", fe.apiSearchHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/api/recently-viewed", handle("api_recently_viewed", fe.apiRecentlyViewedHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/search", handle("search", fe.searchHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/category/{name}", handle("category", fe.categoryHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/cart", handle("add_to_cart", fe.addToCartHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/cart/empty", handle("empty_cart", fe.emptyCartHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/cart/remove", handle("remove_from_cart", fe.removeFromCartHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/cart/update", handle("update_cart", fe.updateCartHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/cart/clean-up", handle("clean_up_cart", fe.cleanUpCartHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/cart/promo", handle("apply_promo", fe.promoHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/setCurrency", handle("set_currency", fe.setCurrencyHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/banner/dismiss", handle("dismiss_banner", dismissBannerHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/logout", handle("logout", fe.logoutHandler)).Methods(http.MethodGet)
+	s.HandleFunc("/cart/checkout", handle("checkout", fe.placeOrderHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/cart/address/clear", handle("clear_address", fe.clearAddressHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/wishlist", handle("view_wishlist", fe.viewWishlistHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/wishlist", handle("add_to_wishlist", fe.addToWishlistHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/wishlist/remove", handle("remove_from_wishlist", fe.removeFromWishlistHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/wishlist/move", handle("move_to_cart", fe.moveToCartHandler)).Methods(http.MethodPost)
+	s.HandleFunc("/api/wishlist", handle("api_wishlist", fe.apiWishlistHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/order/{id}", handle("order", fe.orderHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/orders", handle("orders", fe.ordersHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/orders/{id}", handle("order_summary", fe.orderSummaryHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/order/{id}/receipt.json", handle("order_receipt", fe.orderReceiptHandler)).Methods(http.MethodGet)
+	s.HandleFunc("/order/{id}/email-preview", handle("order_email_preview", fe.emailPreviewHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/ad/click", handle("ad_click", requireFeature(featureAds, fe.adsEnabled, fe.adClickHandler))).Methods(http.MethodGet)
+	s.HandleFunc("/assistant", handle("assistant", requireFeature(featureAssistant, fe.assistantEnabled, requireFlag(featureAssistant, fe.assistantHandler)))).Methods(http.MethodGet)
+	s.HandleFunc("/static/brand.css", brandCSSHandler).Methods(http.MethodGet, http.MethodHead)
+	s.PathPrefix("/static/").Handler(http.StripPrefix(base+"/static/", newStaticHandler(staticDir)))
+	s.HandleFunc("/img/{size}/{path:.+}", handle("image", fe.imageHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/robots.txt", fe.robotsHandler)
+	s.HandleFunc("/sitemap.xml", handle("sitemap", fe.sitemapHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/sitemap-{n:[0-9]+}.xml", handle("sitemap", fe.sitemapHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/_healthz", fe.healthzHandler)
+	s.HandleFunc("/_readyz", fe.readyzHandler)
+	s.HandleFunc("/api/products", handle("api_products", fe.apiProductsHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/api/products/{id}", handle("api_product", fe.apiProductHandler)).Methods(http.MethodGet, http.MethodHead)
+	s.HandleFunc("/product-meta/{ids}", handle("product_meta", fe.apiProductsHandler)).Methods(http.MethodGet)
+	s.HandleFunc("/graphql", handle("graphql", fe.graphqlHandler)).Methods(http.MethodPost)
+	if fe.graphiqlEnabled {
+		s.HandleFunc("/graphql", handle("graphiql", fe.graphiqlHandler)).Methods(http.MethodGet)
+	}
+	s.HandleFunc("/bot", handle("bot", requireFeature(featureAssistant, fe.assistantEnabled, requireFlag(featureAssistant, fe.chatBotHandler)))).Methods(http.MethodPost)
+
+	// Both routers need these: the subrouter does not fall back to r's.
+	for _, router := range []*mux.Router{r, s} {
+		router.NotFoundHandler = unmatchedHandler(r)
+		router.MethodNotAllowedHandler = unmatchedHandler(r)
+	}
+	r.Use(recordRouteTemplate)
+	return r
+}
+
+// newHTTPServer returns a server with timeouts and header limits set, so that
+// slow or oversized requests cannot tie up connections indefinitely. The write
+// timeout must exceed the longest handler deadline.
+func newHTTPServer(c httpServerConfig, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: c.readHeaderTimeout,
+		ReadTimeout:       c.readTimeout,
+		WriteTimeout:      c.writeTimeout,
+		IdleTimeout:       c.idleTimeout,
+		MaxHeaderBytes:    c.maxHeaderBytes,
+	}
+}
+
+// enableH2C lets srv serve HTTP/2 without TLS as well as HTTP/1.1, to
+// clients with prior knowledge or that ask to upgrade. Shutting srv down
+// also drains its HTTP/2 connections.
+func enableH2C(srv *http.Server, c httpServerConfig) error {
+	h2s := &http2.Server{
+		MaxConcurrentStreams: uint32(c.h2MaxConcurrentStreams),
+		IdleTimeout:          c.h2IdleTimeout,
+	}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return errors.Wrap(err, "could not configure HTTP/2")
+	}
+	srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	return nil
+}
+
+// shutdown drains the server after a termination signal. The health check
+// reports 503 for SHUTDOWN_DELAY first so the load balancer stops routing new
+// requests, then in-flight requests get up to SHUTDOWN_TIMEOUT to complete
+// before the backend connections are closed.
+func (fe *frontendServer) shutdown(log logrus.FieldLogger, sig os.Signal, delay, timeout time.Duration, servers ...*http.Server) {
+	log.WithField("signal", sig.String()).Infof("shutting down, draining for %v", delay)
+
+	fe.draining.Store(true)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, srv := range servers {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warnf("warn: server did not shut down cleanly within %v: %+v", timeout, err)
+		}
+	}
+	if err := fe.audit.close(); err != nil {
+		log.Warnf("warn: failed to close the audit log: %+v", err)
+	}
+	fe.closeConns(log)
+	log.Info("shutdown complete")
+}
+
+// closeConns closes every backend gRPC connection that has been established,
+// and the Redis session store if there is one.
+func (fe *frontendServer) closeConns(log logrus.FieldLogger) {
+	for _, conn := range []*grpc.ClientConn{
+		fe.productCatalogSvcConn,
+		fe.currencySvcConn,
+		fe.cartSvcConn,
+		fe.recommendationSvcConn,
+		fe.checkoutSvcConn,
+		fe.shippingSvcConn,
+		fe.adSvcConn,
+		fe.collectorConn,
+	} {
+		if conn == nil {
+			continue
+		}
+		if err := conn.Close(); err != nil {
+			log.Warnf("warn: failed to close grpc connection to %s: %+v", conn.Target(), err)
+		}
+	}
+	if s, ok := fe.sessions.(*redisSessionStore); ok {
+		if err := s.close(); err != nil {
+			log.Warnf("warn: failed to close Redis connection: %+v", err)
+		}
+	}
 }
 
 func initStats(log logrus.FieldLogger) {
@@ -181,8 +721,7 @@ func initStats(log logrus.FieldLogger) {
 }
 
 func initTracing(log logrus.FieldLogger, ctx context.Context, svc *frontendServer) (*sdktrace.TracerProvider, error) {
-	mustMapEnv(&svc.collectorAddr, "COLLECTOR_SERVICE_ADDR")
-	mustConnGRPC(ctx, &svc.collectorConn, svc.collectorAddr)
+	mustConnGRPC(ctx, &svc.collectorConn, "collector", svc.collectorAddr, nil)
 	exporter, err := otlptracegrpc.New(
 		ctx,
 		otlptracegrpc.WithGRPCConn(svc.collectorConn))
@@ -197,8 +736,12 @@ func initTracing(log logrus.FieldLogger, ctx context.Context, svc *frontendServe
 	return tp, err
 }
 
+// initProfiling starts the Cloud Profiler, retrying with a growing delay since
+// the metadata server can be slow to answer while the pod starts. Failures
+// are logged: the frontend runs fine without it.
 func initProfiling(log logrus.FieldLogger, service, version string) {
-	for i := 1; i <= 3; i++ {
+	const attempts = 3
+	for i := 1; i <= attempts; i++ {
 		log = log.WithField("retry", i)
 		if err := profiler.Start(profiler.Config{
 			Service:        service,
@@ -209,6 +752,9 @@ func initProfiling(log logrus.FieldLogger, service, version string) {
 			log.Info("started Stackdriver profiler")
 			return
 		}
+		if i == attempts {
+			break
+		}
 		d := time.Second * 10 * time.Duration(i)
 		log.Debugf("sleeping %v to retry initializing Stackdriver profiler", d)
 		time.Sleep(d)
@@ -216,23 +762,84 @@ func initProfiling(log logrus.FieldLogger, service, version string) {
 	log.Warn("warning: could not initialize Stackdriver profiler after retrying, giving up")
 }
 
+// mustMapEnv sets target to the value of envKey, panicking if it is unset.
+// main reads its configuration through loadConfig instead.
 func mustMapEnv(target *string, envKey string) {
-	v := os.Getenv(envKey)
-	if v == "" {
-		panic(fmt.Sprintf("environment variable %q not set", envKey))
+	var l envLoader
+	*target = l.required(envKey)
+	if len(l.problems) > 0 {
+		panic(l.problems[0])
 	}
-	*target = v
 }
 
-func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
+// handlerTimeoutsFromEnv returns the deadline of each route that does not
+// use HANDLER_TIMEOUT_DEFAULT: the built-in routeTimeouts, overridden or
+// extended by HANDLER_TIMEOUT_<ROUTE>.
+func handlerTimeoutsFromEnv(l *envLoader) map[string]time.Duration {
+	out := maps.Clone(routeTimeouts)
+	for _, key := range envKeysWithPrefix("HANDLER_TIMEOUT_") {
+		if key == "HANDLER_TIMEOUT_DEFAULT" {
+			continue
+		}
+		route := strings.ToLower(strings.TrimPrefix(key, "HANDLER_TIMEOUT_"))
+		out[route] = l.duration(key, out[route])
+	}
+	return out
+}
+
+// mustConnGRPC sets up the connection to the backend service at addr. The
+// service name selects its transport credentials, see GRPC_TLS_SKIP_SERVICES,
+// and its call timeout and load balancing, see grpcConnConfigsFromEnv. addr is
+// a gRPC target such as dns:///cartservice:7070, or a bare host:port, which
+// is resolved through DNS as well. The connection is made lazily on the first
+// call, so this only fails if addr is malformed; state changes are logged
+// until ctx is done.
+func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, service, addr string, breaker *circuitBreaker) {
 	var err error
-	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
-	defer cancel()
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
-		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()))
+	config := backendConnConfigs[service]
+	limit := newBulkhead(service, config.maxConcurrent, config.bulkheadWait)
+	opts := append(grpcDialOptions(config.callTimeout, limit, breaker), config.dialOptions()...)
+	*conn, err = grpc.NewClient(addr, append(opts, backendTransport.credentials(service))...)
 	if err != nil {
-		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
+		panic(errors.Wrapf(err, "grpc: invalid address %s", addr))
+	}
+	go watchConnState(ctx, log, service, *conn)
+	log.WithFields(config.logFields()).WithFields(logrus.Fields{
+		"grpc.service": service,
+		"grpc.target":  addr,
+		"grpc.tls":     backendTransport.tls != nil && !backendTransport.skip[service],
+	}).Info("configured backend connection")
+}
+
+// grpcDialOptions returns the interceptors shared by all backend connections.
+// Each call is traced by the telemetry backend, whose span covers any
+// retries, and carries the trace context in the formats of TRACE_PROPAGATION
+// as well as the backend metadata. A non-zero callTimeout bounds each call
+// including its retries. Identical concurrent reads share one call, see
+// callCoalescer. The optional bulkhead caps the calls in flight, each holding
+// a permit through its retries, and the optional breaker sees the outcome
+// after retries. Hedging sits inside retry: each attempt at a catalog read is
+// hedged on its own after HEDGE_DELAY, and retry only sees the answer that
+// came first. Chaos rules, if enabled, apply innermost.
+func grpcDialOptions(callTimeout time.Duration, limit *bulkhead, breaker *circuitBreaker) []grpc.DialOption {
+	unary := telemetry.unaryInterceptors()
+	if telemetry != telemetryNone {
+		unary = append(unary, tracePropagation.unaryInterceptor)
+	}
+	unary = append(unary,
+		backendMetadata.unaryInterceptor,
+		callTimeoutInterceptor(callTimeout),
+		grpcCoalesce.unaryInterceptor,
+		limit.unaryInterceptor,
+		breaker.unaryInterceptor,
+		grpcRetry.unaryInterceptor,
+		grpcHedge.unaryInterceptor,
+		grpcMetricsInterceptor)
+	if chaos != nil {
+		unary = append(unary, chaos.unaryInterceptor)
+	}
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(unary...),
+		grpc.WithChainStreamInterceptor(telemetry.streamInterceptors()...),
 	}
 }
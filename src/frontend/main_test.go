@@ -0,0 +1,220 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/net/http2"
+)
+
+func TestNewHTTPServer(t *testing.T) {
+	t.Setenv("HTTP_READ_HEADER_TIMEOUT", "2s")
+	t.Setenv("HTTP_WRITE_TIMEOUT", "1m")
+	t.Setenv("HTTP_MAX_HEADER_BYTES", "4096")
+	cfg := loadTestConfig(t)
+	srv := newHTTPServer(cfg.http, ":8080", http.NotFoundHandler())
+	if srv.ReadHeaderTimeout != 2*time.Second || srv.WriteTimeout != time.Minute || srv.MaxHeaderBytes != 4096 {
+		t.Errorf("env overrides not applied: %+v", srv)
+	}
+	if srv.ReadTimeout != defaultReadTimeout || srv.IdleTimeout != defaultIdleTimeout {
+		t.Errorf("server = %+v, want default read and idle timeouts", srv)
+	}
+	if srv.WriteTimeout <= routeTimeouts["checkout"] {
+		t.Errorf("WriteTimeout %v does not leave room for the checkout deadline", srv.WriteTimeout)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	t.Setenv("HTTP2_H2C", "1")
+	t.Setenv("HTTP2_MAX_CONCURRENT_STREAMS", "50")
+	cfg := loadTestConfig(t)
+	srv := newHTTPServer(cfg.http, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	if err := enableH2C(srv, cfg.http); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+
+	// Prior knowledge: HTTP/2 from the first byte, as Envoy speaks it.
+	h2 := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}}
+	url := "http://" + ln.Addr().String() + "/"
+	for client, want := range map[*http.Client]string{h2: "HTTP/2.0", http.DefaultClient: "HTTP/1.1"} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("%s: %v", want, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != want {
+			t.Errorf("status %d, served over %q; want %s", resp.StatusCode, b, want)
+		}
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestH2CConfig(t *testing.T) {
+	cfg := loadTestConfig(t)
+	if cfg.http.h2c || cfg.http.h2MaxConcurrentStreams != defaultH2MaxConcurrentStreams {
+		t.Errorf("HTTP/2 defaults %+v", cfg.http)
+	}
+	t.Setenv("HTTP2_MAX_CONCURRENT_STREAMS", "0")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "HTTP2_MAX_CONCURRENT_STREAMS") {
+		t.Errorf("no streams allowed: err = %v", err)
+	}
+}
+
+func TestHandlerTimeoutsFromEnv(t *testing.T) {
+	t.Setenv("HANDLER_TIMEOUT_DEFAULT", "5s")
+	t.Setenv("HANDLER_TIMEOUT_CHECKOUT", "20s")
+	t.Setenv("HANDLER_TIMEOUT_VIEW_CART", "3s")
+	var l envLoader
+	got := handlerTimeoutsFromEnv(&l)
+	if got["checkout"] != 20*time.Second || got["view_cart"] != 3*time.Second || got["bot"] != routeTimeouts["bot"] || l.err() != nil {
+		t.Errorf("timeouts = %v, %v", got, l.err())
+	}
+	if _, ok := got["default"]; ok {
+		t.Error("HANDLER_TIMEOUT_DEFAULT read as the timeout of a route")
+	}
+
+	t.Setenv("HANDLER_TIMEOUT_CHECKOUT", "20")
+	if got := handlerTimeoutsFromEnv(&l); got["checkout"] != routeTimeouts["checkout"] || l.err() == nil {
+		t.Errorf("HANDLER_TIMEOUT_CHECKOUT=20: timeout %v, problems %v", got["checkout"], l.err())
+	}
+}
+
+func TestRouterBasePath(t *testing.T) {
+	handle := func(route string, _ http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) { io.WriteString(w, route) }
+	}
+	for _, base := range []string{"", "/", "/shop", "/shop/"} {
+		t.Run(base, func(t *testing.T) {
+			prefix, _ := normalizeBaseURL(base)
+			r := new(frontendServer).newRouter(prefix, "", handle)
+			for _, tc := range []struct {
+				method, path, route, template string
+			}{
+				{http.MethodGet, "/", "home", "/"},
+				{http.MethodGet, "/product/OLJCESPC7Z", "product", "/product/{id}"},
+				{http.MethodPost, "/cart", "add_to_cart", "/cart"},
+				{http.MethodGet, "/cart", "view_cart", "/cart"},
+				{http.MethodPost, "/setCurrency", "set_currency", "/setCurrency"},
+				{http.MethodGet, "/logout", "logout", "/logout"},
+			} {
+				req := httptest.NewRequest(tc.method, prefix+tc.path, nil)
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				if w.Code != http.StatusOK || w.Body.String() != tc.route {
+					t.Errorf("%s %s: status %d, route %q; want %s", tc.method, req.URL.Path, w.Code, w.Body, tc.route)
+				}
+				var match mux.RouteMatch
+				if !r.Match(req, &match) {
+					t.Errorf("%s %s: no match", tc.method, req.URL.Path)
+				} else if tpl, _ := match.Route.GetPathTemplate(); tpl != prefix+tc.template {
+					t.Errorf("%s %s: template %q, want %q", tc.method, req.URL.Path, tpl, prefix+tc.template)
+				}
+			}
+		})
+	}
+
+	r := new(frontendServer).newRouter("/shop", "", handle)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/shop?currency=EUR", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/shop/?currency=EUR" {
+		t.Errorf("bare base path: status %d to %q, want a redirect to /shop/", w.Code, w.Header().Get("Location"))
+	}
+	for _, path := range []string{"/cart", "/shopping/cart"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s outside the base path: status %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestRouterNotFoundAndMethodNotAllowed(t *testing.T) {
+	handle := func(route string, _ http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) { io.WriteString(w, route) }
+	}
+	defer func(v string) { baseUrl = v }(baseUrl)
+	for _, base := range []string{"", "/shop"} {
+		baseUrl = base
+		router := new(frontendServer).newRouter(base, "", handle)
+		logger, hook := logtest.NewNullLogger()
+		h := &logHandler{log: logger, next: instrumentRouter(router, router)}
+
+		for _, tc := range []struct {
+			method, path, accept string
+			code                 int
+			allow, body          string
+		}{
+			{http.MethodGet, "/nope", "", http.StatusNotFound, "", "There is no page at " + base + "/nope."},
+			{http.MethodGet, "/api/nope", "", http.StatusNotFound, "", `"code":404`},
+			{http.MethodPost, "/", "", http.StatusMethodNotAllowed, "GET, HEAD", "POST is not allowed"},
+			{http.MethodDelete, "/cart", "application/json", http.StatusMethodNotAllowed, "GET, HEAD, POST", `"code":405`},
+		} {
+			hook.Reset()
+			before := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("not_found", tc.method, strconv.Itoa(tc.code), "false"))
+			r := httptest.NewRequest(tc.method, base+tc.path, nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tc.code || w.Header().Get("Allow") != tc.allow || !strings.Contains(w.Body.String(), tc.body) {
+				t.Errorf("%s %s: status %d, Allow %q, body %.300s", tc.method, r.URL.Path, w.Code, w.Header().Get("Allow"), w.Body)
+			}
+			if id := w.Header().Get(requestIDHeader); tc.accept == "" && !strings.HasPrefix(tc.path, "/api/") && !strings.Contains(w.Body.String(), id) {
+				t.Errorf("%s %s: page does not show request ID %s", tc.method, r.URL.Path, id)
+			}
+			if e := hook.LastEntry(); e == nil || e.Data["http.req.route"] != "not_found" {
+				t.Errorf("%s %s: access log entry %+v, want route not_found", tc.method, r.URL.Path, e)
+			}
+			if got := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("not_found", tc.method, strconv.Itoa(tc.code), "false")) - before; got != 1 {
+				t.Errorf("%s %s: not_found metric increased by %v", tc.method, r.URL.Path, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Number of HTTP requests served, by route template, method, status code and whether they came from a crawler.",
+	}, []string{"route", "method", "status", "bot"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of HTTP requests served, by route template, method, status code and whether they came from a crawler.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status", "bot"})
+
+	grpcClientRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_client_requests_total",
+		Help: "Number of unary gRPC calls made to backends, by service and gRPC code.",
+	}, []string{"service", "code"})
+
+	grpcClientDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_client_duration_seconds",
+		Help:    "Latency of unary gRPC calls made to backends, by service and gRPC code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "code"})
+)
+
+// instrumentRouter records request counts and latencies for every request
+// passed to next, labeled with the route template matched by router so that
+// e.g. all product pages aggregate under /product/{id}.
+func instrumentRouter(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "not_found"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.MatchErr == nil && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		start := time.Now()
+		rr := &responseRecorder{w: w}
+		next.ServeHTTP(rr, r)
+
+		code := rr.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": r.Method,
+			"status": strconv.Itoa(code),
+			"bot":    strconv.FormatBool(isBot(r.Context())),
+		}
+		httpRequestsTotal.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// grpcMetricsInterceptor records the outcome and latency of unary calls made
+// over a backend connection.
+func grpcMetricsInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	labels := prometheus.Labels{"service": grpcServiceName(method), "code": status.Code(err).String()}
+	grpcClientRequestsTotal.With(labels).Inc()
+	grpcClientDuration.With(labels).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// grpcServiceName extracts the service from a full method name such as
+// "/hipstershop.CartService/GetCart".
+func grpcServiceName(fullMethod string) string {
+	s := strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
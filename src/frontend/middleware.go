@@ -15,27 +15,56 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"time"
 	"os"
+	"runtime/debug"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.elastic.co/apm"
+)
+
+const (
+	requestIDHeader = "X-Request-Id"
+	maxRequestIDLen = 128
+
+	// defaultLogSkipPaths are requests made by probes and scrapers, and for
+	// static assets, which would drown out the rest of the access log.
+	defaultLogSkipPaths = "/_healthz,/metrics,/static"
 )
 
 type ctxKeyLog struct{}
 type ctxKeyRequestID struct{}
+type ctxKeyRoute struct{}
+type ctxKeyNewSession struct{}
+type ctxKeyRouteTemplate struct{}
 
 type logHandler struct {
 	log  *logrus.Logger
 	next http.Handler
+	// skip lists path prefixes, below baseUrl, that get no access log entry.
+	skip []string
+	// sampling drops the lines of some successful requests; nil logs all.
+	sampling *logSampling
 }
 
 type responseRecorder struct {
 	b      int
 	status int
 	w      http.ResponseWriter
+	// head is set for HEAD requests, whose body net/http discards even
+	// though it reports writes as successful.
+	head bool
 }
 
 func (r *responseRecorder) Header() http.Header { return r.w.Header() }
@@ -45,7 +74,9 @@ func (r *responseRecorder) Write(p []byte) (int, error) {
 		r.status = http.StatusOK
 	}
 	n, err := r.w.Write(p)
-	r.b += n
+	if !r.head {
+		r.b += n
+	}
 	return n, err
 }
 
@@ -54,39 +85,185 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 	r.w.WriteHeader(statusCode)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, so that
+// streaming handlers can flush through the recorder.
+func (r *responseRecorder) Unwrap() http.ResponseWriter { return r.w }
+
+func (r *responseRecorder) Flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if f, ok := r.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
 func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	requestID, _ := uuid.NewRandom()
-	ctx = context.WithValue(ctx, ctxKeyRequestID{}, requestID.String())
+	requestID := r.Header.Get(requestIDHeader)
+	if !validRequestID(requestID) {
+		u, _ := uuid.NewRandom()
+		requestID = u.String()
+	}
+	ctx = context.WithValue(ctx, ctxKeyRequestID{}, requestID)
+	w.Header().Set(requestIDHeader, requestID)
 
 	start := time.Now()
-	rr := &responseRecorder{w: w}
-	log := lh.log.WithFields(logrus.Fields{
-		"http.req.path":   r.URL.Path,
-		"http.req.method": r.Method,
-		"http.req.id":     requestID.String(),
+	rr := &responseRecorder{w: w, head: r.Method == http.MethodHead}
+	logger := lh.log
+	var held *heldLog
+	if lh.sampling != nil {
+		held = holdLog(lh.log)
+		logger = held.logger
+	}
+	log := logger.WithFields(logrus.Fields{
+		"http.req.path":      r.URL.Path,
+		"http.req.method":    r.Method,
+		"http.req.id":        requestID,
+		"http.req.client_ip": clientIP(r),
 	})
 	if v, ok := r.Context().Value(ctxKeySessionID{}).(string); ok {
 		log = log.WithField("session", v)
 	}
+	if isBot(ctx) {
+		log = log.WithField("bot", true)
+	}
+	if tx := apm.TransactionFromContext(ctx); tx != nil {
+		tc := tx.TraceContext()
+		log = log.WithFields(logrus.Fields{
+			"trace.id":       tc.Trace.String(),
+			"transaction.id": tc.Span.String(),
+		})
+	}
 	log.Debug("request started")
-	defer func() {
-		log.WithFields(logrus.Fields{
-			"http.resp.took_ms": int64(time.Since(start) / time.Millisecond),
-			"http.resp.status":  rr.status,
-			"http.resp.bytes":   rr.b}).Debugf("request complete")
-	}()
 
+	route := new(string)
+	ctx = context.WithValue(ctx, ctxKeyRouteTemplate{}, route)
 	ctx = context.WithValue(ctx, ctxKeyLog{}, log)
 	r = r.WithContext(ctx)
 	lh.next.ServeHTTP(rr, r)
+
+	if lh.skipped(r.URL.Path) {
+		held.release(true)
+		return
+	}
+	code := rr.status
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if *route == "" {
+		*route = "not_found"
+	}
+	took := time.Since(start)
+	entry := log.WithFields(logrus.Fields{
+		"http.req.route":      *route,
+		"http.req.user_agent": r.UserAgent(),
+		"http.resp.took_ms":   int64(took / time.Millisecond),
+		"http.resp.status":    code,
+		"http.resp.bytes":     rr.b,
+	})
+	switch {
+	case code >= 500:
+		entry.Error("request complete")
+	case code >= 400:
+		entry.Warn("request complete")
+	default:
+		entry.Info("request complete")
+	}
+	held.release(lh.sampling.keep(*route, requestID, code, took))
+}
+
+func (lh *logHandler) skipped(path string) bool {
+	path = strings.TrimPrefix(path, baseUrl)
+	for _, p := range lh.skip {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// logSkipPathsFromEnv reads LOG_SKIP_PATHS, a comma-separated list of path
+// prefixes. Setting it to the empty string logs every request.
+func logSkipPathsFromEnv() []string {
+	v, ok := os.LookupEnv("LOG_SKIP_PATHS")
+	if !ok {
+		v = defaultLogSkipPaths
+	}
+	var paths []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
 }
 
-func ensureSessionID(next http.Handler) http.HandlerFunc {
+// recordRouteTemplate is router middleware that hands the matched route's
+// template, e.g. /product/{id}, back to logHandler, which runs before the
+// route is known. The request's span is named after the route as well.
+func recordRouteTemplate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			tpl, _ := route.GetPathTemplate()
+			if p, ok := r.Context().Value(ctxKeyRouteTemplate{}).(*string); ok {
+				*p = tpl
+			}
+			nameSpan(r.Context(), r.Method+" "+tpl)
+			labelSpan(r.Context(), "route", tpl)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID reports whether a client-supplied request ID is safe to
+// adopt: short, and free of characters that could forge log lines or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// loggerFromContext returns the request-scoped logger stored by logHandler,
+// which carries the request and trace IDs, or the process logger for calls
+// made outside of a request.
+func loggerFromContext(ctx context.Context) logrus.FieldLogger {
+	if l, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		return l
+	}
+	return log
+}
+
+// ensureSessionID makes sure every request carries a session ID, issuing a new
+// one when the client sent none or one whose signature does not verify.
+func ensureSessionID(signer *cookieSigner, next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var sessionID string
-		c, err := r.Cookie(cookieSessionID)
-		if err == http.ErrNoCookie {
+		if c, err := r.Cookie(cookieSessionID); err == nil {
+			if id, ok := signer.verify(cookieSessionID, c.Value); ok && id != "" {
+				sessionID = id
+			} else {
+				loggerFromContext(r.Context()).Debug("discarding session cookie with invalid signature")
+			}
+		}
+		if sessionID == "" {
 			if os.Getenv("ENABLE_SINGLE_SHARED_SESSION") == "true" {
 				// Hard coded user id, shared across sessions
 				sessionID = "12345678-1234-1234-1234-123456789123"
@@ -94,18 +271,109 @@ func ensureSessionID(next http.Handler) http.HandlerFunc {
 				u, _ := uuid.NewRandom()
 				sessionID = u.String()
 			}
-			http.SetCookie(w, &http.Cookie{
-				Name:   cookieSessionID,
-				Value:  sessionID,
-				MaxAge: cookieMaxAge,
-			})
-		} else if err != nil {
-			return
-		} else {
-			sessionID = c.Value
+			// Crawlers do not keep cookies: each of their requests
+			// would mint a session nobody comes back to.
+			if !isBot(r.Context()) {
+				http.SetCookie(w, newCookie(cookieSessionID, signer.sign(cookieSessionID, sessionID)))
+			}
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyNewSession{}, true))
 		}
+		labelSpan(r.Context(), "session_id", sessionID)
 		ctx := context.WithValue(r.Context(), ctxKeySessionID{}, sessionID)
 		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
 	}
 }
+
+// withDeadline bounds the request context handed to next by timeout so that a
+// slow backend cannot pin the handler goroutine indefinitely. The route name is
+// recorded in the context for logging when the deadline fires.
+func withDeadline(route string, timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		ctx = context.WithValue(ctx, ctxKeyRoute{}, route)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// isNewSession reports whether the session was issued by this request rather
+// than carried by the client's cookie.
+func isNewSession(r *http.Request) bool {
+	v, _ := r.Context().Value(ctxKeyNewSession{}).(bool)
+	return v
+}
+
+func routeName(r *http.Request) string {
+	if v, ok := r.Context().Value(ctxKeyRoute{}).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// recoverPanics turns a panic in next into a logged error and a 500 page, so
+// the client gets a response carrying the request ID instead of a dropped
+// connection. The panic is also reported to Elastic APM as an error.
+func recoverPanics(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort, which net/http handles quietly.
+				panic(v)
+			}
+
+			log := loggerFromContext(r.Context())
+			log.WithFields(logrus.Fields{
+				"panic": fmt.Sprint(v),
+				"stack": string(debug.Stack()),
+			}).Error("recovered from panic")
+
+			if tx := apm.TransactionFromContext(r.Context()); tx != nil {
+				e := apm.DefaultTracer.Recovered(v)
+				e.SetTransaction(tx)
+				e.Send()
+			}
+
+			renderErrorPage(log, r, w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	}
+}
+
+// limitBody rejects request bodies larger than limit, or than the limit in
+// overrides for the request path, with a 413. The body is buffered up front so
+// that handlers, which mostly read it through r.FormValue, never see a
+// truncated form.
+func limitBody(limit int64, overrides map[string]int64, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		max := limit
+		if l, ok := overrides[r.URL.Path]; ok {
+			max = l
+		}
+		log := loggerFromContext(r.Context())
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, max))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				log.WithFields(logrus.Fields{
+					"http.req.content_length": r.ContentLength,
+					"limit":                   max,
+				}).Warn("request body too large")
+				renderErrorPage(log, r, w, fmt.Sprintf("request body exceeds %d bytes", max), http.StatusRequestEntityTooLarge)
+				return
+			}
+			renderHTTPError(log, r, w, errors.Wrap(err, "failed to read request body"), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"go.elastic.co/apm/apmtest"
+	"go.elastic.co/apm/module/apmhttp"
+)
+
+func TestLogHandlerRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string // empty means a generated ID
+	}{
+		{"generated", "", ""},
+		{"accepted from client", "abc-123_def.4", "abc-123_def.4"},
+		{"rejects control characters", "abc\nforged=1", ""},
+		{"rejects overlong", strings.Repeat("a", maxRequestIDLen+1), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, _ := logtest.NewNullLogger()
+			var inCtx interface{}
+			h := &logHandler{log: logger, next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				inCtx = r.Context().Value(ctxKeyRequestID{})
+			})}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set(requestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			got := w.Header().Get(requestIDHeader)
+			if got == "" || got != inCtx {
+				t.Fatalf("response header %q, context %v; want equal and non-empty", got, inCtx)
+			}
+			if tt.want != "" && got != tt.want {
+				t.Errorf("request ID = %q, want %q", got, tt.want)
+			}
+			if tt.want == "" && got == tt.header {
+				t.Errorf("adopted invalid client request ID %q", got)
+			}
+		})
+	}
+}
+
+func TestLoggerFromContextCarriesIDs(t *testing.T) {
+	logger, hook := logtest.NewNullLogger()
+	logger.Level = logrus.DebugLevel
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+
+	h := apmhttp.Wrap(&logHandler{log: logger, next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loggerFromContext(r.Context()).Error("backend failed")
+	})}, apmhttp.WithTracer(tracer.Tracer))
+	r := httptest.NewRequest(http.MethodGet, "/cart", nil)
+	r.Header.Set(requestIDHeader, "req-42")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "backend failed" {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatal("handler log entry not recorded")
+	}
+	if got := entry.Data["http.req.id"]; got != "req-42" {
+		t.Errorf("http.req.id = %v, want req-42", got)
+	}
+	for _, k := range []string{"trace.id", "transaction.id"} {
+		if v, _ := entry.Data[k].(string); v == "" {
+			t.Errorf("log entry missing %s", k)
+		}
+	}
+}
+
+func TestLogHandlerAccessLog(t *testing.T) {
+	logger, hook := logtest.NewNullLogger()
+	router := mux.NewRouter()
+	router.HandleFunc("/product/{id}", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "product") })
+	router.HandleFunc("/cart/checkout", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) })
+	router.HandleFunc("/_healthz", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	router.PathPrefix("/static/").Handler(http.NotFoundHandler())
+	router.Use(recordRouteTemplate)
+	h := &logHandler{log: logger, next: router, skip: []string{"/_healthz", "/static"}}
+
+	for _, tc := range []struct {
+		path, route string
+		status      int
+		level       logrus.Level
+	}{
+		{"/product/OLJCESPC7Z", "/product/{id}", http.StatusOK, logrus.InfoLevel},
+		{"/nope", "not_found", http.StatusNotFound, logrus.WarnLevel},
+		{"/cart/checkout", "/cart/checkout", http.StatusBadGateway, logrus.ErrorLevel},
+	} {
+		hook.Reset()
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Header.Set("User-Agent", "test-agent")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		entries := hook.AllEntries()
+		if len(entries) != 1 {
+			t.Fatalf("%s: got %d log entries, want 1", tc.path, len(entries))
+		}
+		e := entries[0]
+		if e.Level != tc.level || e.Data["http.req.route"] != tc.route || e.Data["http.resp.status"] != tc.status ||
+			e.Data["http.req.user_agent"] != "test-agent" || e.Data["http.req.method"] != http.MethodGet {
+			t.Errorf("%s: logged %v at %v", tc.path, e.Data, e.Level)
+		}
+	}
+	if n, _ := hook.LastEntry().Data["http.resp.bytes"].(int); n != 0 {
+		t.Errorf("http.resp.bytes = %d for an empty response", n)
+	}
+	hook.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "/product/OLJCESPC7Z", nil))
+	if n, _ := hook.LastEntry().Data["http.resp.bytes"].(int); n != 0 {
+		t.Errorf("http.resp.bytes = %d for a HEAD request", n)
+	}
+
+	for _, path := range []string{"/_healthz", "/static/styles.css"} {
+		hook.Reset()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if len(hook.AllEntries()) != 0 {
+			t.Errorf("%s: logged %v, want it skipped", path, hook.LastEntry().Data)
+		}
+	}
+}
+
+func TestLogSkipPathsFromEnv(t *testing.T) {
+	if got := logSkipPathsFromEnv(); len(got) != 3 {
+		t.Errorf("default skip paths = %q", got)
+	}
+	t.Setenv("LOG_SKIP_PATHS", "")
+	if got := logSkipPathsFromEnv(); len(got) != 0 {
+		t.Errorf("empty LOG_SKIP_PATHS skips %q", got)
+	}
+}
+
+func TestResponseRecorderFlushAndHijack(t *testing.T) {
+	w := httptest.NewRecorder()
+	rr := &responseRecorder{w: w}
+	rr.Flush()
+	if !w.Flushed || rr.status != http.StatusOK {
+		t.Errorf("flushed = %v, status = %d", w.Flushed, rr.status)
+	}
+	if _, _, err := rr.Hijack(); err != http.ErrNotSupported {
+		t.Errorf("Hijack on a recorder: %v, want ErrNotSupported", err)
+	}
+
+	srv := httptest.NewServer(&logHandler{log: discardLog, next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 204 No Content\r\n\r\n")
+		buf.Flush()
+	})})
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d from the hijacked connection", resp.StatusCode)
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		chunked   bool
+		wantCode  int
+		wantBytes int
+	}{
+		{"under limit", "/cart", strings.Repeat("a", 16), false, http.StatusOK, 16},
+		{"at limit", "/cart", strings.Repeat("a", 32), false, http.StatusOK, 32},
+		{"over limit", "/cart", strings.Repeat("a", 33), false, http.StatusRequestEntityTooLarge, 0},
+		{"over limit without content length", "/cart", strings.Repeat("a", 33), true, http.StatusRequestEntityTooLarge, 0},
+		{"path override", "/bot", strings.Repeat("a", 100), false, http.StatusOK, 100},
+		{"over path override", "/bot", strings.Repeat("a", 129), false, http.StatusRequestEntityTooLarge, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int
+			h := limitBody(32, map[string]int64{"/bot": 128}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				got = len(b)
+			}))
+			var body io.Reader = strings.NewReader(tt.body)
+			if tt.chunked {
+				body = io.MultiReader(body) // hides the length from NewRequest
+			}
+			r := newTestRequest(http.MethodPost, tt.path, body)
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got != tt.wantBytes {
+				t.Errorf("handler read %d bytes, want %d", got, tt.wantBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	// rateProbeUnits is the amount converted to derive an exchange rate. The
+	// currency service truncates results to whole nanos, so a large probe
+	// keeps the derived rate accurate to well below a nano per unit.
+	rateProbeUnits = 1000000
+
+	rateFetchTimeout = 2 * time.Second
+)
+
+type cachedRate struct {
+	rate    *big.Rat
+	expires time.Time
+}
+
+// Converter converts amounts with exchange rates derived from the currency
+// service and kept for ttl, so that pages listing many products issue one
+// Convert RPC per currency pair instead of one per price.
+type Converter struct {
+	ttl    time.Duration
+	client pb.CurrencyServiceClient
+	group  singleflight.Group
+
+	mu    sync.RWMutex
+	rates map[string]cachedRate
+
+	hits, misses atomic.Int64
+}
+
+// NewConverter returns a Converter asking client for exchange rates.
+func NewConverter(client pb.CurrencyServiceClient, ttl time.Duration) *Converter {
+	return &Converter{ttl: ttl, client: client, rates: make(map[string]cachedRate)}
+}
+
+// Convert returns m in the currency to, truncated to whole nanos as the
+// currency service does.
+func (c *Converter) Convert(ctx context.Context, m pb.Money, to string) (pb.Money, error) {
+	rate, err := c.Rate(ctx, m.GetCurrencyCode(), to)
+	if err != nil {
+		return pb.Money{}, err
+	}
+	return Convert(m, rate, to), nil
+}
+
+// Rate returns the multiplier converting amounts in from to amounts in to.
+// Concurrent misses for the same pair share a single RPC. The rate is shared
+// and must not be modified.
+func (c *Converter) Rate(ctx context.Context, from, to string) (*big.Rat, error) {
+	key := from + "/" + to
+	c.mu.RLock()
+	e, ok := c.rates[key]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(e.expires) {
+		c.hits.Add(1)
+		return e.rate, nil
+	}
+	c.misses.Add(1)
+
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		// Detach from the caller's cancellation: the result is shared with
+		// every request waiting on this pair.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rateFetchTimeout)
+		defer cancel()
+		out, err := c.client.Convert(ctx, &pb.CurrencyConversionRequest{
+			From:   &pb.Money{CurrencyCode: from, Units: rateProbeUnits},
+			ToCode: to})
+		if err != nil {
+			return nil, err
+		}
+		nanos := new(big.Int).Mul(big.NewInt(out.GetUnits()), big.NewInt(nanosMod))
+		nanos.Add(nanos, big.NewInt(int64(out.GetNanos())))
+		r := new(big.Rat).SetFrac(nanos, big.NewInt(rateProbeUnits*nanosMod))
+
+		c.mu.Lock()
+		c.rates[key] = cachedRate{rate: r, expires: time.Now().Add(c.ttl)}
+		c.mu.Unlock()
+		return r, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch exchange rate %s: %w", key, err)
+	}
+	return v.(*big.Rat), nil
+}
+
+// CacheStats returns the number of rate lookups served from the cache and of
+// those that were not.
+func (c *Converter) CacheStats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
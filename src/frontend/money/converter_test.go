@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// fakeCurrency converts with fixed rates, from USD only, as the currency
+// service would: truncated to whole nanos.
+type fakeCurrency struct {
+	pb.CurrencyServiceClient
+	rates map[string]float64
+	calls atomic.Int32
+}
+
+func (f *fakeCurrency) Convert(_ context.Context, in *pb.CurrencyConversionRequest, _ ...grpc.CallOption) (*pb.Money, error) {
+	f.calls.Add(1)
+	rate, ok := f.rates[in.GetToCode()]
+	if !ok || in.GetFrom().GetCurrencyCode() != "USD" {
+		return nil, errors.New("unsupported currency")
+	}
+	out := Convert(*in.GetFrom(), DecimalRate(rate), in.GetToCode())
+	return &out, nil
+}
+
+func TestConverter(t *testing.T) {
+	client := &fakeCurrency{rates: map[string]float64{"EUR": 0.7, "JPY": 111.81}}
+	c := NewConverter(client, time.Minute)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		in   pb.Money
+		want pb.Money
+	}{
+		// 0.7 is a little less in binary: a float rate made this 6.999999999.
+		{mmc(10, 0, "USD"), mmc(7, 0, "EUR")},
+		{mmc(19, 990000000, "USD"), mmc(13, 993000000, "EUR")},
+		{mmc(19, 990000000, "USD"), mmc(2235, 81900000, "JPY")},
+		{mmc(-1, -500000000, "USD"), mmc(-1, -50000000, "EUR")},
+	} {
+		got, err := c.Convert(ctx, tc.in, tc.want.GetCurrencyCode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !AreEquals(got, tc.want) {
+			t.Errorf("Convert(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+	if n := client.calls.Load(); n != 2 {
+		t.Errorf("%d RPCs, want one per currency pair", n)
+	}
+	if hits, misses := c.CacheStats(); hits != 2 || misses != 2 {
+		t.Errorf("cache hits %d, misses %d", hits, misses)
+	}
+
+	if _, err := c.Convert(ctx, mmc(1, 0, "GBP"), "EUR"); err == nil {
+		t.Error("no error for a failed RPC")
+	}
+}
+
+func TestConverterExpiresRates(t *testing.T) {
+	client := &fakeCurrency{rates: map[string]float64{"EUR": 0.9}}
+	c := NewConverter(client, time.Nanosecond)
+	for range 2 {
+		if _, err := c.Convert(context.Background(), mmc(1, 0, "USD"), "EUR"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := client.calls.Load(); n != 2 {
+		t.Errorf("%d RPCs, want the expired rate fetched again", n)
+	}
+}
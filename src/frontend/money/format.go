@@ -0,0 +1,263 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	nbsp  = "\u00a0" // no-break space
+	nnbsp = "\u202f" // narrow no-break space, the French thousands separator
+)
+
+// Locale describes how amounts are written in a language or region.
+type Locale struct {
+	Tag         string // BCP 47 tag, such as "de" or "pt-BR"
+	Decimal     string // decimal separator
+	Group       string // thousands separator
+	SymbolAfter bool   // "12,50 €" rather than "€12.50"
+	SymbolSpace bool   // a non-breaking space between symbol and number
+}
+
+// DefaultLocale is used when the user's language has no known locale.
+var DefaultLocale = Locale{Tag: "en", Decimal: ".", Group: ","}
+
+var locales = map[string]Locale{
+	"en":    DefaultLocale,
+	"de":    {Tag: "de", Decimal: ",", Group: ".", SymbolAfter: true, SymbolSpace: true},
+	"de-ch": {Tag: "de-CH", Decimal: ".", Group: "’", SymbolSpace: true},
+	"es":    {Tag: "es", Decimal: ",", Group: ".", SymbolAfter: true, SymbolSpace: true},
+	"fr":    {Tag: "fr", Decimal: ",", Group: nnbsp, SymbolAfter: true, SymbolSpace: true},
+	"it":    {Tag: "it", Decimal: ",", Group: ".", SymbolAfter: true, SymbolSpace: true},
+	"ja":    {Tag: "ja", Decimal: ".", Group: ","},
+	"ko":    {Tag: "ko", Decimal: ".", Group: ","},
+	"nl":    {Tag: "nl", Decimal: ",", Group: ".", SymbolSpace: true},
+	"pl":    {Tag: "pl", Decimal: ",", Group: nbsp, SymbolAfter: true, SymbolSpace: true},
+	"pt":    {Tag: "pt", Decimal: ",", Group: nbsp, SymbolAfter: true, SymbolSpace: true},
+	"pt-br": {Tag: "pt-BR", Decimal: ",", Group: ".", SymbolSpace: true},
+	"ru":    {Tag: "ru", Decimal: ",", Group: nbsp, SymbolAfter: true, SymbolSpace: true},
+	"sv":    {Tag: "sv", Decimal: ",", Group: nbsp, SymbolAfter: true, SymbolSpace: true},
+	"tr":    {Tag: "tr", Decimal: ",", Group: "."},
+	"zh":    {Tag: "zh", Decimal: ".", Group: ","},
+}
+
+// LookupLocale returns the locale for a BCP 47 tag, falling back from
+// "pt-BR" to "pt" and from "zh-Hant-TW" to "zh-Hant" and "zh".
+func LookupLocale(tag string) (Locale, bool) {
+	tag = strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+	for tag != "" {
+		if l, ok := locales[tag]; ok {
+			return l, true
+		}
+		i := strings.LastIndex(tag, "-")
+		if i < 0 {
+			break
+		}
+		tag = tag[:i]
+	}
+	return Locale{}, false
+}
+
+var symbols = map[string]string{
+	"AUD": "A$",
+	"BRL": "R$",
+	"CAD": "$",
+	"CNY": "CN¥",
+	"EUR": "€",
+	"GBP": "£",
+	"HKD": "HK$",
+	"ILS": "₪",
+	"INR": "₹",
+	"JPY": "¥",
+	"KRW": "₩",
+	"MXN": "MX$",
+	"NZD": "NZ$",
+	"PHP": "₱",
+	"PLN": "zł",
+	"RUB": "₽",
+	"SGD": "S$",
+	"THB": "฿",
+	"TRY": "₺",
+	"USD": "$",
+	"ZAR": "R",
+}
+
+// Symbol returns the symbol of a currency, or its code if it has none.
+func Symbol(currencyCode string) string {
+	if s, ok := symbols[currencyCode]; ok {
+		return s
+	}
+	return currencyCode
+}
+
+// minorUnits lists the ISO 4217 currencies that do not have two decimals.
+var minorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// MinorUnits returns the number of decimals amounts in a currency are shown
+// with, as per ISO 4217.
+func MinorUnits(currencyCode string) int {
+	if n, ok := minorUnits[currencyCode]; ok {
+		return n
+	}
+	return 2
+}
+
+// Format renders m in locale l, rounded half away from zero to the minor
+// units of its currency.
+func (l Locale) Format(m pb.Money) string {
+	code := m.GetCurrencyCode()
+	units, fraction, negative := round(m, MinorUnits(code))
+
+	var b strings.Builder
+	digits := strconv.FormatUint(units, 10)
+	for i, c := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(l.Group)
+		}
+		b.WriteRune(c)
+	}
+	if fraction != "" {
+		b.WriteString(l.Decimal)
+		b.WriteString(fraction)
+	}
+	number := b.String()
+
+	sym := Symbol(code)
+	sep := ""
+	if l.SymbolSpace || sym == code {
+		sep = nbsp
+	}
+	s := sym + sep + number
+	if l.SymbolAfter {
+		s = number + sep + sym
+	}
+	if negative {
+		s = "-" + s
+	}
+	return s
+}
+
+// Amount renders m as a plain decimal number rounded to the minor units of
+// its currency, such as "1234.50", for machine readers rather than people.
+func Amount(m pb.Money) string {
+	units, fraction, negative := round(m, MinorUnits(m.GetCurrencyCode()))
+	s := strconv.FormatUint(units, 10)
+	if fraction != "" {
+		s += "." + fraction
+	}
+	if negative {
+		s = "-" + s
+	}
+	return s
+}
+
+// Round returns m rounded half away from zero to the minor units of its
+// currency, the amount Format and Amount show, so that sums of rounded
+// amounts match what is displayed.
+func Round(m pb.Money) pb.Money {
+	decimals := MinorUnits(m.GetCurrencyCode())
+	units, fraction, negative := round(m, decimals)
+	var nanos int64
+	if fraction != "" {
+		nanos, _ = strconv.ParseInt(fraction+strings.Repeat("0", 9-decimals), 10, 32)
+	}
+	out := pb.Money{CurrencyCode: m.GetCurrencyCode(), Units: int64(units), Nanos: int32(nanos)}
+	if negative {
+		out = Negate(out)
+	}
+	return out
+}
+
+// Truncate returns m with the fractions of the minor unit of its currency
+// dropped, toward zero.
+func Truncate(m pb.Money) pb.Money {
+	scale := int32(1)
+	for i := MinorUnits(m.GetCurrencyCode()); i < 9; i++ {
+		scale *= 10
+	}
+	return pb.Money{CurrencyCode: m.GetCurrencyCode(), Units: m.GetUnits(), Nanos: m.GetNanos() - m.GetNanos()%scale}
+}
+
+// Parse reads a plain decimal number such as "4.99" or "-0.5", as written
+// by Amount, as an amount of currencyCode. Digits finer than nanos are an
+// error rather than rounded off.
+func Parse(s, currencyCode string) (pb.Money, error) {
+	digits, negative := strings.CutPrefix(s, "-")
+	whole, fraction, hasPoint := strings.Cut(digits, ".")
+	if whole == "" || hasPoint && fraction == "" || len(fraction) > 9 || !isDigits(whole) || !isDigits(fraction) {
+		return pb.Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return pb.Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	nanos, _ := strconv.ParseInt(fraction+strings.Repeat("0", 9-len(fraction)), 10, 32)
+	out := pb.Money{CurrencyCode: currencyCode, Units: units, Nanos: int32(nanos)}
+	if negative {
+		out = Negate(out)
+	}
+	return out, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// round returns the absolute value of m rounded to decimals places, as whole
+// units and the zero-padded digits of the fraction.
+func round(m pb.Money, decimals int) (units uint64, fraction string, negative bool) {
+	u, n := m.GetUnits(), m.GetNanos()
+	negative = u < 0 || n < 0
+	if u < 0 {
+		units = uint64(-(u + 1)) + 1 // does not overflow for math.MinInt64
+	} else {
+		units = uint64(u)
+	}
+	if n < 0 {
+		n = -n
+	}
+
+	scale := int32(1)
+	for i := decimals; i < 9; i++ {
+		scale *= 10
+	}
+	minor := (n + scale/2) / scale
+	if full := nanosMod / scale; minor == full {
+		units++
+		minor = 0
+	}
+	if units == 0 && minor == 0 {
+		negative = false
+	}
+	if decimals > 0 {
+		fraction = strconv.Itoa(int(minor))
+		fraction = strings.Repeat("0", decimals-len(fraction)) + fraction
+	}
+	return units, fraction, negative
+}
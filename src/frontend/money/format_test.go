@@ -0,0 +1,163 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"math"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestFormat(t *testing.T) {
+	en := DefaultLocale
+	de, _ := LookupLocale("de")
+	fr, _ := LookupLocale("fr")
+	tests := []struct {
+		name   string
+		locale Locale
+		in     pb.Money
+		want   string
+	}{
+		{"zero", en, mmc(0, 0, "USD"), "$0.00"},
+		{"cents", en, mmc(19, 990000000, "USD"), "$19.99"},
+		{"grouping", en, mmc(1234567, 500000000, "USD"), "$1,234,567.50"},
+		{"nanos round half up", en, mmc(0, 5000000, "USD"), "$0.01"},
+		{"nanos round down", en, mmc(0, 4999999, "USD"), "$0.00"},
+		{"rounding carries into units", en, mmc(999, 995000000, "USD"), "$1,000.00"},
+		{"negative", en, mmc(-1234, -560000000, "USD"), "-$1,234.56"},
+		{"negative rounds away from zero", en, mmc(0, -5000000, "USD"), "-$0.01"},
+		{"negative rounding to zero has no sign", en, mmc(0, -4000000, "USD"), "$0.00"},
+		{"no minor units", en, mmc(2235, 819000000, "JPY"), "¥2,236"},
+		{"three minor units", en, mmc(12, 345600000, "TND"), "TND\u00a012.346"},
+		{"code without a symbol", en, mmc(5, 0, "CHF"), "CHF\u00a05.00"},
+		{"symbol after", de, mmc(1234, 560000000, "EUR"), "1.234,56\u00a0€"},
+		{"negative symbol after", de, mmc(-3, -500000000, "EUR"), "-3,50\u00a0€"},
+		{"JPY with symbol after", de, mmc(1234, 0, "JPY"), "1.234\u00a0¥"},
+		{"narrow space grouping", fr, mmc(1234, 0, "EUR"), "1\u202f234,00\u00a0€"},
+		{"min int64", en, mmc(math.MinInt64, 0, "JPY"), "-¥9,223,372,036,854,775,808"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.locale.Format(tt.in); got != tt.want {
+				t.Errorf("%s.Format([%v]) = %q, want %q", tt.locale.Tag, tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupLocale(t *testing.T) {
+	tests := []struct {
+		tag, want string
+		ok        bool
+	}{
+		{"de", "de", true},
+		{"de-AT", "de", true},
+		{"DE-ch", "de-CH", true},
+		{"pt_BR", "pt-BR", true},
+		{"zh-Hant-TW", "zh", true},
+		{"xx", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		l, ok := LookupLocale(tt.tag)
+		if ok != tt.ok || l.Tag != tt.want {
+			t.Errorf("LookupLocale(%q) = %q, %v; want %q, %v", tt.tag, l.Tag, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMinorUnits(t *testing.T) {
+	for code, want := range map[string]int{"USD": 2, "EUR": 2, "JPY": 0, "KRW": 0, "TND": 3, "KWD": 3, "XYZ": 2} {
+		if got := MinorUnits(code); got != want {
+			t.Errorf("MinorUnits(%q) = %d, want %d", code, got, want)
+		}
+	}
+}
+
+func TestAmount(t *testing.T) {
+	for _, tc := range []struct {
+		in   pb.Money
+		want string
+	}{
+		{mmc(1234, 500000000, "USD"), "1234.50"},
+		{mmc(19, 990000000, "EUR"), "19.99"},
+		{mmc(0, 995000000, "USD"), "1.00"},
+		{mmc(1500, 400000000, "JPY"), "1500"},
+		{mmc(2, 345600000, "KWD"), "2.346"},
+		{mmc(-3, -250000000, "USD"), "-3.25"},
+	} {
+		if got := Amount(tc.in); got != tc.want {
+			t.Errorf("Amount(%v) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+	for _, tc := range []struct {
+		in, want pb.Money
+	}{
+		{mmc(4, 990000000, "USD"), mmc(4, 990000000, "USD")},
+		{mmc(2, 494999999, "USD"), mmc(2, 490000000, "USD")},
+		{mmc(2, 495000000, "USD"), mmc(2, 500000000, "USD")},
+		{mmc(0, 999000000, "USD"), mmc(1, 0, "USD")},
+		{mmc(4, 990000000, "JPY"), mmc(5, 0, "JPY")},
+		{mmc(1, 234500000, "KWD"), mmc(1, 235000000, "KWD")},
+		{mmc(-2, -495000000, "USD"), mmc(-2, -500000000, "USD")},
+		{mmc(0, -4000000, "USD"), mmc(0, 0, "USD")},
+	} {
+		if got := Round(tc.in); !AreEquals(got, tc.want) {
+			t.Errorf("Round(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		in, want pb.Money
+	}{
+		{mmc(4, 999999999, "USD"), mmc(4, 990000000, "USD")},
+		{mmc(2, 500000000, "JPY"), mmc(2, 0, "JPY")},
+		{mmc(1, 234567890, "KWD"), mmc(1, 234000000, "KWD")},
+		{mmc(-2, -495000000, "USD"), mmc(-2, -490000000, "USD")},
+	} {
+		if got := Truncate(tc.in); !AreEquals(got, tc.want) {
+			t.Errorf("Truncate(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want pb.Money
+	}{
+		{"4.99", mmc(4, 990000000, "USD")},
+		{"5", mmc(5, 0, "USD")},
+		{"0.000000001", mmc(0, 1, "USD")},
+		{"-0.5", mmc(0, -500000000, "USD")},
+		{"1234.50", mmc(1234, 500000000, "USD")},
+	} {
+		got, err := Parse(tc.in, "USD")
+		if err != nil || !AreEquals(got, tc.want) {
+			t.Errorf("Parse(%q) = %v, %v, want %v", tc.in, got, err, tc.want)
+		}
+	}
+	for _, s := range []string{"", "-", ".5", "5.", "+5", "4,99", "1.0000000001", "1e3", "99999999999999999999"} {
+		if got, err := Parse(s, "USD"); err == nil {
+			t.Errorf("Parse(%q) = %v, want an error", s, got)
+		}
+	}
+}
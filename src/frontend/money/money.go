@@ -16,6 +16,8 @@ package money
 
 import (
 	"errors"
+	"math/big"
+	"strconv"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 )
@@ -121,12 +123,42 @@ func Sum(l, r pb.Money) (pb.Money, error) {
 }
 
 // MultiplySlow is a slow multiplication operation done through adding the value
-// to itself n-1 times.
+// to itself n-1 times. Zero times m is zero, in the currency of m.
 func MultiplySlow(m pb.Money, n uint32) pb.Money {
-	out := m
-	for n > 1 {
+	out := pb.Money{CurrencyCode: m.GetCurrencyCode()}
+	for ; n > 0; n-- {
 		out = Must(Sum(out, m))
-		n--
 	}
 	return out
 }
+
+// Convert multiplies m by the exchange rate and labels the result with
+// currencyCode. Like the currency service, fractional nanos are truncated
+// rather than rounded, and the units/nanos of the result always share the
+// same sign. The rate is exact, so that a rate of 0.85 from DecimalRate does
+// not truncate 20.00 to 16.999999999.
+func Convert(m pb.Money, rate *big.Rat, currencyCode string) pb.Money {
+	total := new(big.Int).Mul(big.NewInt(m.GetUnits()), big.NewInt(nanosMod))
+	total.Add(total, big.NewInt(int64(m.GetNanos())))
+
+	total.Mul(total, rate.Num())
+	total.Quo(total, rate.Denom()) // truncates toward zero
+
+	units, nanos := new(big.Int).QuoRem(total, big.NewInt(nanosMod), new(big.Int))
+	return pb.Money{
+		Units:        units.Int64(),
+		Nanos:        int32(nanos.Int64()),
+		CurrencyCode: currencyCode}
+}
+
+// DecimalRate returns the rate f as written in decimal, rather than the
+// binary fraction closest to it: 0.85 is 85/100.
+func DecimalRate(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	return r
+}
+
+// Percent returns the rate for p percent, such as 17/200 for 8.5.
+func Percent(p float64) *big.Rat {
+	return new(big.Rat).Quo(DecimalRate(p), big.NewRat(100, 1))
+}
@@ -16,8 +16,10 @@ package money
 
 import (
 	"fmt"
+	"math/big"
 	"reflect"
 	"testing"
+	"testing/quick"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 )
@@ -243,3 +245,174 @@ func TestSum(t *testing.T) {
 		})
 	}
 }
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name string
+		in   pb.Money
+		rate float64
+		want pb.Money
+	}{
+		{"zero", mmc(0, 0, "USD"), 1.1305, mmc(0, 0, "EUR")},
+		{"identity", mmc(19, 990000000, "USD"), 1, mmc(19, 990000000, "USD")},
+		{"nanos carry into units", mmc(1, 500000000, "USD"), 3, mmc(4, 500000000, "EUR")},
+		{"fraction of a nano truncated", mmc(0, 1, "USD"), 0.5, mmc(0, 0, "EUR")},
+		{"USD to JPY", mmc(19, 990000000, "USD"), 111.81, mmc(2235, 81900000, "JPY")},
+		{"JPY to USD", mmc(2000, 0, "JPY"), 0.0078125, mmc(15, 625000000, "USD")},
+		{"negative keeps signs consistent", mmc(-1, -750000000, "USD"), 1.5, mmc(-2, -625000000, "EUR")},
+		{"negative truncates toward zero", mmc(0, -3, "USD"), 0.5, mmc(0, -1, "EUR")},
+		{"negative to whole units", mmc(-5, -500000000, "USD"), 2, mmc(-11, 0, "EUR")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Convert(tt.in, DecimalRate(tt.rate), tt.want.GetCurrencyCode())
+			if !AreEquals(got, tt.want) {
+				t.Errorf("Convert([%v], %v) = %v, want %v", tt.in, tt.rate, got, tt.want)
+			}
+			if !IsValid(got) {
+				t.Errorf("Convert([%v], %v) = %v, which is not a valid money value", tt.in, tt.rate, got)
+			}
+		})
+	}
+}
+
+func TestMultiplySlow(t *testing.T) {
+	for _, tc := range []struct {
+		in   pb.Money
+		n    uint32
+		want pb.Money
+	}{
+		{mmc(19, 990000000, "USD"), 0, mmc(0, 0, "USD")},
+		{mmc(19, 990000000, "USD"), 1, mmc(19, 990000000, "USD")},
+		{mmc(19, 990000000, "USD"), 3, mmc(59, 970000000, "USD")},
+		{mmc(-1, -500000000, "USD"), 2, mmc(-3, 0, "USD")},
+	} {
+		if got := MultiplySlow(tc.in, tc.n); !AreEquals(got, tc.want) {
+			t.Errorf("MultiplySlow(%v, %d) = %v, want %v", tc.in, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	// In binary, 0.15 and 0.85 are a little less than they are in decimal,
+	// which truncated 20.00 to 2.999999999 and 16.999999999.
+	for _, tc := range []struct {
+		in      pb.Money
+		percent float64
+		want    pb.Money
+	}{
+		{mmc(20, 0, "USD"), 15, mmc(3, 0, "USD")},
+		{mmc(20, 0, "USD"), 85, mmc(17, 0, "USD")},
+		{mmc(1895, 500000000, "JPY"), 85, mmc(1611, 175000000, "JPY")},
+		{mmc(10, 0, "USD"), 8.5, mmc(0, 850000000, "USD")},
+	} {
+		if got := Convert(tc.in, Percent(tc.percent), tc.in.GetCurrencyCode()); !AreEquals(got, tc.want) {
+			t.Errorf("%v%% of %v = %v, want %v", tc.percent, tc.in, got, tc.want)
+		}
+	}
+	if r := DecimalRate(0.85); r.Cmp(big.NewRat(17, 20)) != 0 {
+		t.Errorf("DecimalRate(0.85) = %v", r)
+	}
+}
+
+// The properties below are checked on random valid amounts.
+
+// anyMoney builds a valid amount from random numbers, with units small
+// enough that sums and products of a few of them cannot overflow.
+func anyMoney(units int32, nanos uint32, negative bool) pb.Money {
+	m := mm(int64(units&0x7fffffff), int32(nanos%nanosMod))
+	if negative {
+		m = Negate(m)
+	}
+	return m
+}
+
+// exact returns m as a number of nanos.
+func exact(m pb.Money) *big.Int {
+	n := new(big.Int).Mul(big.NewInt(m.GetUnits()), big.NewInt(nanosMod))
+	return n.Add(n, big.NewInt(int64(m.GetNanos())))
+}
+
+// checkCanonical reports a failure unless m is valid: nanos in range and
+// of the sign of units.
+func checkCanonical(t *testing.T, what string, m pb.Money) bool {
+	t.Helper()
+	if !IsValid(m) {
+		t.Errorf("%s = %v, not a valid amount", what, m)
+		return false
+	}
+	return true
+}
+
+func TestSumProperties(t *testing.T) {
+	f := func(lu int32, ln uint32, lneg bool, ru int32, rn uint32, rneg bool) bool {
+		l, r := anyMoney(lu, ln, lneg), anyMoney(ru, rn, rneg)
+		got, err := Sum(l, r)
+		if err != nil || !checkCanonical(t, fmt.Sprintf("Sum(%v, %v)", l, r), got) {
+			return false
+		}
+		// The carry between nanos and units loses nothing.
+		if want := new(big.Int).Add(exact(l), exact(r)); exact(got).Cmp(want) != 0 {
+			t.Errorf("Sum(%v, %v) = %v, want %v nanos", l, r, got, want)
+			return false
+		}
+		swapped, _ := Sum(r, l)
+		return AreEquals(got, swapped)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNegateProperties(t *testing.T) {
+	f := func(u int32, n uint32, neg bool) bool {
+		m := anyMoney(u, n, neg)
+		if !checkCanonical(t, fmt.Sprintf("Negate(%v)", m), Negate(m)) {
+			return false
+		}
+		zero, err := Sum(m, Negate(m))
+		return err == nil && IsZero(zero) && AreEquals(Negate(Negate(m)), m) &&
+			(IsZero(m) || IsNegative(m) != IsNegative(Negate(m)))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultiplySlowProperties(t *testing.T) {
+	f := func(u int32, n uint32, neg bool, times uint8) bool {
+		m := anyMoney(u, n, neg)
+		k := uint32(times % 32)
+		got := MultiplySlow(m, k)
+		if !checkCanonical(t, fmt.Sprintf("MultiplySlow(%v, %d)", m, k), got) {
+			return false
+		}
+		return exact(got).Cmp(new(big.Int).Mul(exact(m), big.NewInt(int64(k)))) == 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConvertProperties(t *testing.T) {
+	f := func(u int32, n uint32, neg bool, num uint16, den uint16) bool {
+		m := anyMoney(u, n, neg)
+		rate := big.NewRat(int64(num), int64(den)+1)
+		got := Convert(m, rate, "EUR")
+		if !checkCanonical(t, fmt.Sprintf("Convert(%v, %v)", m, rate), got) {
+			return false
+		}
+		// The result is the exact product truncated toward zero: less than
+		// a nano away from it, and never further from zero.
+		product := new(big.Rat).Mul(new(big.Rat).SetInt(exact(m)), rate)
+		diff := new(big.Rat).Sub(product, new(big.Rat).SetInt(exact(got)))
+		if diff.Sign() != 0 && diff.Sign() != product.Sign() || new(big.Rat).Abs(diff).Cmp(big.NewRat(1, 1)) >= 0 {
+			t.Errorf("Convert(%v, %v) = %v, want %v truncated", m, rate, got, product.FloatString(3))
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
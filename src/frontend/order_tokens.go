@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	orderTokenLen = 16
+
+	// defaultOrderTokenCacheSize bounds the number of checkout submissions
+	// remembered; the oldest are forgotten first.
+	defaultOrderTokenCacheSize = 10000
+
+	// orderTokenTTL is how long a resubmitted checkout form is recognized as
+	// a duplicate of an earlier one.
+	orderTokenTTL = 10 * time.Minute
+)
+
+// issueOrderToken sets a fresh one-time order token for the checkout form
+// about to be rendered.
+func (fe *frontendServer) issueOrderToken(w http.ResponseWriter) {
+	token := randomToken(orderTokenLen)
+	http.SetCookie(w, newCookie(cookieOrderToken, fe.cookieSigner.sign(cookieOrderToken, token)))
+}
+
+// orderToken returns the order token of the checkout form being submitted,
+// or "" if there is none or it has been tampered with.
+func (fe *frontendServer) orderToken(r *http.Request) string {
+	c, err := r.Cookie(cookieOrderToken)
+	if err != nil {
+		return ""
+	}
+	token, ok := fe.cookieSigner.verify(cookieOrderToken, c.Value)
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+// orderTokens remembers the outcome of recent checkout submissions by order
+// token so that a form submitted twice, e.g. by a double click, places a
+// single order. It is per replica, like receiptStore.
+type orderTokens struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	lru   *list.List // of *orderAttempt, most recently claimed first
+	byKey map[string]*list.Element
+}
+
+// orderAttempt is a checkout submission, in flight until done is closed.
+type orderAttempt struct {
+	key     string
+	claimed time.Time
+	done    chan struct{}
+	orderID string // empty if the order could not be placed
+}
+
+func newOrderTokens(size int, ttl time.Duration) *orderTokens {
+	return &orderTokens{size: size, ttl: ttl, lru: list.New(), byKey: make(map[string]*list.Element)}
+}
+
+// claim returns the attempt recorded for key, and whether it was just created
+// by this call. The caller that created it must call finish; others wait on
+// its done channel.
+func (t *orderTokens) claim(key string, now time.Time) (*orderAttempt, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.byKey[key]; ok {
+		a := e.Value.(*orderAttempt)
+		if now.Sub(a.claimed) < t.ttl {
+			return a, false
+		}
+		t.remove(e)
+	}
+	a := &orderAttempt{key: key, claimed: now, done: make(chan struct{})}
+	t.byKey[key] = t.lru.PushFront(a)
+	for t.lru.Len() > t.size {
+		t.remove(t.lru.Back())
+	}
+	return a, true
+}
+
+// finish records the order placed by a claimed attempt and releases anyone
+// waiting on it. Failed attempts are forgotten so the order can be retried.
+// A nil attempt is ignored.
+func (t *orderTokens) finish(a *orderAttempt, orderID string) {
+	if a == nil {
+		return
+	}
+	t.mu.Lock()
+	a.orderID = orderID
+	if e, ok := t.byKey[a.key]; ok && e.Value == a && orderID == "" {
+		t.remove(e)
+	}
+	t.mu.Unlock()
+	close(a.done)
+}
+
+// remove drops e from the cache. t.mu must be held.
+func (t *orderTokens) remove(e *list.Element) {
+	t.lru.Remove(e)
+	delete(t.byKey, e.Value.(*orderAttempt).key)
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestOrderTokensClaim(t *testing.T) {
+	tokens := newOrderTokens(2, time.Minute)
+	now := time.Now()
+
+	a, claimed := tokens.claim("a", now)
+	if !claimed {
+		t.Fatal("first claim was not granted")
+	}
+	if dup, claimed := tokens.claim("a", now); claimed || dup != a {
+		t.Fatal("second claim did not return the in-flight attempt")
+	}
+	tokens.finish(a, "order-1")
+	<-a.done
+	if dup, _ := tokens.claim("a", now); dup.orderID != "order-1" {
+		t.Errorf("orderID = %q, want order-1", dup.orderID)
+	}
+
+	if _, claimed := tokens.claim("a", now.Add(time.Minute)); !claimed {
+		t.Error("expired attempt was not replaced")
+	}
+}
+
+func TestOrderTokensForgetsFailures(t *testing.T) {
+	tokens := newOrderTokens(2, time.Minute)
+	a, _ := tokens.claim("a", time.Now())
+	tokens.finish(a, "")
+	if _, claimed := tokens.claim("a", time.Now()); !claimed {
+		t.Error("failed attempt blocks retries")
+	}
+}
+
+func TestOrderTokensEvictsOldest(t *testing.T) {
+	tokens := newOrderTokens(2, time.Minute)
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		a, _ := tokens.claim(key, now)
+		tokens.finish(a, "order-"+key)
+	}
+	if _, claimed := tokens.claim("a", now); !claimed {
+		t.Error("oldest attempt was not evicted")
+	}
+	if _, claimed := tokens.claim("c", now); claimed {
+		t.Error("newest attempt was evicted")
+	}
+	if n := tokens.lru.Len(); n != 2 {
+		t.Errorf("cache holds %d attempts, want 2", n)
+	}
+}
+
+// submitCheckout posts the checkout form with the cookies set by the cart
+// page.
+func submitCheckout(fe *frontendServer, cart []*http.Cookie) *httptest.ResponseRecorder {
+	r := newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm()))
+	for _, c := range cart {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, r)
+	return w
+}
+
+func viewCart(fe *frontendServer) []*http.Cookie {
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	return w.Result().Cookies()
+}
+
+func TestPlaceOrderDeduplicatesResubmits(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+	fe.cookieSigner = newCookieSigner("secret")
+	cart := viewCart(fe)
+
+	if w := submitCheckout(fe, cart); w.Code != http.StatusOK {
+		t.Fatalf("first submit: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	w := submitCheckout(fe, cart)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/order/order-test-session" {
+		t.Errorf("second submit: got status %d to %q, want a redirect to the order", w.Code, w.Header().Get("Location"))
+	}
+	if n := fb.callCount("PlaceOrder"); n != 1 {
+		t.Errorf("PlaceOrder called %d times, want 1", n)
+	}
+
+	if w := submitCheckout(fe, viewCart(fe)); w.Code != http.StatusOK {
+		t.Errorf("submit with a new token: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 2 {
+		t.Errorf("PlaceOrder called %d times after a new checkout, want 2", n)
+	}
+}
+
+func TestPlaceOrderDeduplicatesConcurrentSubmits(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setLatency("PlaceOrder", 100*time.Millisecond)
+	fe := newTestFrontend(t, fb)
+	cart := viewCart(fe)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = submitCheckout(fe, cart).Code
+		}()
+	}
+	wg.Wait()
+
+	if n := fb.callCount("PlaceOrder"); n != 1 {
+		t.Errorf("PlaceOrder called %d times, want 1", n)
+	}
+	if !(codes[0] == http.StatusOK && codes[1] == http.StatusSeeOther || codes[0] == http.StatusSeeOther && codes[1] == http.StatusOK) {
+		t.Errorf("got statuses %v, want one confirmation and one redirect", codes)
+	}
+}
+
+func TestPlaceOrderRetriesFailedSubmit(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("PlaceOrder", status.Error(codes.Unavailable, "down"))
+	fe := newTestFrontend(t, fb)
+	cart := viewCart(fe)
+
+	if w := submitCheckout(fe, cart); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	fb.setError("PlaceOrder", nil)
+	if w := submitCheckout(fe, cart); w.Code != http.StatusOK {
+		t.Errorf("retry: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestPlaceOrderIgnoresForgedToken(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	fe.cookieSigner = newCookieSigner("secret")
+
+	for i := 0; i < 2; i++ {
+		r := newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm()))
+		r.AddCookie(&http.Cookie{Name: cookieOrderToken, Value: "forged.token"})
+		fe.placeOrderHandler(httptest.NewRecorder(), r)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 2 {
+		t.Errorf("PlaceOrder called %d times, want 2", n)
+	}
+}
+
+func TestOrderHandler(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.receipts.add("test-session", &receipt{OrderID: "order-1", ShippingTrackingID: "tracking-1", PlacedAt: time.Now()})
+
+	get := func(id string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(newTestRequest(http.MethodGet, "/order/"+id, nil), map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		fe.orderHandler(w, r)
+		return w
+	}
+	if w := get("order-1"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "tracking-1") {
+		t.Errorf("got status %d, want the confirmation page", w.Code)
+	}
+	if w := get("unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown order: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+const (
+	// maxOrderHistory is the number of orders kept in a session's history.
+	maxOrderHistory = 20
+
+	orderHistoryKey = "orders"
+)
+
+// orderSummary is the compact receipt kept in the session state for the
+// order history. Unlike the receipts of receiptStore, it is shared by all
+// replicas when the session store is.
+type orderSummary struct {
+	OrderID            string    `json:"order_id"`
+	ShippingTrackingID string    `json:"shipping_tracking_id"`
+	Total              apiMoney  `json:"total"`
+	PlacedAt           time.Time `json:"placed_at"`
+	ItemCount          int       `json:"item_count"`
+}
+
+func newOrderSummary(rc *receipt) orderSummary {
+	s := orderSummary{
+		OrderID:            rc.OrderID,
+		ShippingTrackingID: rc.ShippingTrackingID,
+		Total:              rc.Total,
+		PlacedAt:           rc.PlacedAt,
+	}
+	for _, v := range rc.Items {
+		s.ItemCount += int(v.Quantity)
+	}
+	return s
+}
+
+// orderHistory returns the orders placed in the session of r, newest first.
+func orderHistory(r *http.Request) []orderSummary {
+	var orders []orderSummary
+	sessionState(r).get(orderHistoryKey, &orders)
+	return orders
+}
+
+// rememberOrder puts s at the front of the order history of the session of
+// r, forgetting the oldest orders beyond maxOrderHistory.
+func rememberOrder(r *http.Request, s orderSummary) {
+	orders := append([]orderSummary{s}, orderHistory(r)...)
+	if len(orders) > maxOrderHistory {
+		orders = orders[:maxOrderHistory]
+	}
+	sessionState(r).set(orderHistoryKey, orders)
+}
+
+// logOrderPlaced emits the order_placed event that analytics pipelines pick
+// out of the logs. The value is a plain decimal number in the currency.
+func logOrderPlaced(log logrus.FieldLogger, s orderSummary) {
+	log.WithFields(logrus.Fields{
+		"event":          "order_placed",
+		"order":          s.OrderID,
+		"order.value":    money.Amount(pb.Money{CurrencyCode: s.Total.CurrencyCode, Units: s.Total.Units, Nanos: s.Total.Nanos}),
+		"order.currency": s.Total.CurrencyCode,
+		"order.items":    s.ItemCount,
+	}).Info("order placed")
+}
+
+func (fe *frontendServer) ordersHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	if r.Method == http.MethodHead {
+		answerHead(w, r, "", 0)
+		return
+	}
+	if err := templates.ExecuteTemplate(w, "orders", fe.commonTemplateData(r.Context(), r).with(map[string]interface{}{
+		"show_currency": false,
+		"orders":        orderHistory(r),
+	})); err != nil {
+		log.Println(err)
+	}
+}
+
+// orderSummaryHandler shows an order of the session's history. Orders of
+// other sessions are not found.
+func (fe *frontendServer) orderSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	id := mux.Vars(r)["id"]
+	for _, s := range orderHistory(r) {
+		if s.OrderID == id {
+			if r.Method == http.MethodHead {
+				answerHead(w, r, "", 0)
+				return
+			}
+			if err := templates.ExecuteTemplate(w, "order_summary", fe.commonTemplateData(r.Context(), r).with(map[string]interface{}{
+				"show_currency": false,
+				"order":         s,
+			})); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+	}
+	renderHTTPError(log, r, w, errors.Errorf("no order %q", id), http.StatusNotFound)
+}
+
+// emailPreviewHandler renders the confirmation email of an order of the
+// session, for demos. Once the receipt has aged out, orders still in the
+// session's history are gone rather than not found.
+func (fe *frontendServer) emailPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	id := mux.Vars(r)["id"]
+	rc, ok := fe.receipts.get(sessionID(r), id)
+	if !ok {
+		for _, s := range orderHistory(r) {
+			if s.OrderID == id {
+				renderHTTPError(log, r, w, errors.Errorf("the receipt of order %q is no longer available", id), http.StatusGone)
+				return
+			}
+		}
+		renderHTTPError(log, r, w, errors.Errorf("no order %q", id), http.StatusNotFound)
+		return
+	}
+	if err := templates.ExecuteTemplate(w, "email_receipt", injectCommonTemplateData(r, map[string]interface{}{
+		"receipt": rc,
+	})); err != nil {
+		log.Println(err)
+	}
+}
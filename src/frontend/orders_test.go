@@ -0,0 +1,147 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// withSessionState returns r with store as its session store.
+func withSessionState(r *http.Request, store sessionStore) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxKeySessionStore{}, store))
+}
+
+func TestPlaceOrderRecordsHistory(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}, {ProductId: "66VCHSJNUP", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+	store := newMemorySessionStore(time.Hour, 10)
+
+	logger, hook := logtest.NewNullLogger()
+	r := withSessionState(newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm())), store)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(logger)))
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("checkout: status %d", w.Code)
+	}
+	var placed *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Data["event"] == "order_placed" {
+			placed = e
+		}
+	}
+	// Two sunglasses at $19.99, a tank top at $18.99 and $8.99 of shipping.
+	if placed == nil || placed.Data["order"] != "order-test-session" || placed.Data["order.value"] != "67.96" ||
+		placed.Data["order.currency"] != "USD" || placed.Data["order.items"] != 3 {
+		t.Errorf("order_placed event = %+v", placed)
+	}
+
+	w = httptest.NewRecorder()
+	fe.ordersHandler(w, withSessionState(newTestRequest(http.MethodGet, "/orders", nil), store))
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "order-test-session") ||
+		!strings.Contains(body, "3 items") || !strings.Contains(body, "$67.96") {
+		t.Errorf("history: status %d, order not listed: %.500s", w.Code, body)
+	}
+
+	show := func(r *http.Request, id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		fe.orderSummaryHandler(w, mux.SetURLVars(withSessionState(r, store), map[string]string{"id": id}))
+		return w
+	}
+	if w := show(newTestRequest(http.MethodGet, "/orders/order-test-session", nil), "order-test-session"); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "tracking-test-session") {
+		t.Errorf("order: status %d, no tracking ID", w.Code)
+	}
+	if w := show(newTestRequest(http.MethodGet, "/orders/nope", nil), "nope"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown order: status %d, want 404", w.Code)
+	}
+	other := newTestRequest(http.MethodGet, "/orders/order-test-session", nil)
+	other = other.WithContext(context.WithValue(other.Context(), ctxKeySessionID{}, "other-session"))
+	if w := show(other, "order-test-session"); w.Code != http.StatusNotFound {
+		t.Errorf("order of another session: status %d, want 404", w.Code)
+	}
+}
+
+func TestOrderHistoryIsCapped(t *testing.T) {
+	r := withSessionState(newTestRequest(http.MethodGet, "/orders", nil), newMemorySessionStore(time.Hour, 10))
+	for i := 0; i < maxOrderHistory+5; i++ {
+		rememberOrder(r, orderSummary{OrderID: fmt.Sprintf("order-%d", i)})
+	}
+	orders := orderHistory(r)
+	if len(orders) != maxOrderHistory || orders[0].OrderID != "order-24" || orders[len(orders)-1].OrderID != "order-5" {
+		t.Errorf("history has %d orders from %s to %s, want the newest %d first", len(orders),
+			orders[0].OrderID, orders[len(orders)-1].OrderID, maxOrderHistory)
+	}
+}
+
+func TestOrdersPageEmpty(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	fe.ordersHandler(w, newTestRequest(http.MethodGet, "/orders", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "You haven&#39;t placed any orders yet!") {
+		t.Errorf("status %d: %.500s", w.Code, w.Body)
+	}
+}
+
+func TestEmailPreview(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, fb)
+	store := newMemorySessionStore(time.Hour, 10)
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, withSessionState(newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm())), store))
+	if w.Code != http.StatusOK {
+		t.Fatalf("checkout: status %d", w.Code)
+	}
+
+	preview := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		fe.emailPreviewHandler(w, mux.SetURLVars(withSessionState(r, store), map[string]string{"id": "order-test-session"}))
+		return w
+	}
+	w = preview(newTestRequest(http.MethodGet, "/order/order-test-session/email-preview", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "Your Order Confirmation") || !strings.Contains(body, "#tracking-test-session") ||
+		!strings.Contains(body, "#OLJCESPC7Z") || !strings.Contains(body, "$48.97") {
+		t.Errorf("status %d, email lacks the order: %.1000s", w.Code, body)
+	}
+	if strings.Contains(body, "<link") || strings.Contains(body, "/static/") {
+		t.Error("email refers to external resources")
+	}
+
+	other := newTestRequest(http.MethodGet, "/order/order-test-session/email-preview", nil)
+	other = other.WithContext(context.WithValue(other.Context(), ctxKeySessionID{}, "other-session"))
+	if w := preview(other); w.Code != http.StatusNotFound {
+		t.Errorf("order of another session: status %d, want 404", w.Code)
+	}
+
+	fe.receipts = newReceiptStore(defaultOrderHistorySize) // the receipt aged out
+	if w := preview(newTestRequest(http.MethodGet, "/order/order-test-session/email-preview", nil)); w.Code != http.StatusGone {
+		t.Errorf("aged out receipt: status %d, want 410", w.Code)
+	}
+}
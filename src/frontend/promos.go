@@ -0,0 +1,278 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+// promoSessionKey is the session state holding the applied promo code.
+const promoSessionKey = "promo"
+
+// promoCode is a discount users get by entering code in the cart. It takes
+// off either a percentage of the subtotal or a fixed amount in USD, never
+// more than the subtotal. The checkout service knows nothing of promos: the
+// frontend only adjusts the totals it shows and records the code in the
+// receipt.
+type promoCode struct {
+	code    string
+	percent float64   // 0 for a fixed amount
+	amount  *pb.Money // in USD, nil for a percentage
+	expires time.Time // zero if the code never expires
+}
+
+func (p promoCode) expired(now time.Time) bool {
+	return !p.expires.IsZero() && !now.Before(p.expires)
+}
+
+// promoCodes are the codes users can apply, by code.
+type promoCodes map[string]promoCode
+
+// promoFields are the fields of a promo code before validation, as read from
+// PROMO_CODES or PROMO_CODES_FILE. The amount is kept as written so that it
+// is parsed exactly.
+type promoFields struct {
+	Code    string      `json:"code"`
+	Percent float64     `json:"percent"`
+	Amount  json.Number `json:"amount"`
+	Expires string      `json:"expires"`
+}
+
+// parsePromoCodes parses promo codes written as in PROMO_CODES: codes are
+// separated by commas, and each is a list of key=value fields separated by
+// semicolons: code, then either percent or amount (in USD), and optionally
+// expires, a date the code is valid through or an RFC 3339 time, e.g.
+// "code=SAVE10;percent=10;expires=2026-12-31,code=TAKE5;amount=5".
+func parsePromoCodes(s string) (promoCodes, error) {
+	var fields []promoFields
+	for _, text := range strings.Split(s, ",") {
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		var f promoFields
+		for _, field := range strings.Split(text, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+			var err error
+			switch {
+			case !ok:
+				return nil, errors.Errorf("promo code %q: field %q is not of the form key=value", text, field)
+			case k == "code":
+				f.Code = v
+			case k == "percent":
+				f.Percent, err = strconv.ParseFloat(v, 64)
+			case k == "amount":
+				f.Amount = json.Number(v)
+			case k == "expires":
+				f.Expires = v
+			default:
+				return nil, errors.Errorf("promo code %q: unknown field %q", text, k)
+			}
+			if err != nil {
+				return nil, errors.Errorf("promo code %q: invalid %s %q", text, k, v)
+			}
+		}
+		fields = append(fields, f)
+	}
+	return newPromoCodes(fields)
+}
+
+// loadPromoCodes reads promo codes from a JSON file holding an array of
+// objects with the fields of PROMO_CODES, e.g.
+// [{"code": "SAVE10", "percent": 10, "expires": "2026-12-31"}].
+func loadPromoCodes(path string) (promoCodes, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read promo codes")
+	}
+	var fields []promoFields
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, errors.Wrapf(err, "could not parse promo codes in %s", path)
+	}
+	return newPromoCodes(fields)
+}
+
+func newPromoCodes(fields []promoFields) (promoCodes, error) {
+	out := make(promoCodes, len(fields))
+	for _, f := range fields {
+		p := promoCode{code: strings.ToUpper(f.Code), percent: f.Percent}
+		if !validPromoCode(p.code) {
+			return nil, errors.Errorf("promo code %q: codes are 1 to 32 letters and digits", f.Code)
+		}
+		switch {
+		case f.Percent != 0 && f.Amount != "":
+			return nil, errors.Errorf("promo code %s: both a percent and an amount", p.code)
+		case f.Percent != 0:
+			if f.Percent < 0 || f.Percent > 100 {
+				return nil, errors.Errorf("promo code %s: percent %v is not between 0 and 100", p.code, f.Percent)
+			}
+		case f.Amount != "":
+			m, err := money.Parse(f.Amount.String(), "USD")
+			if err != nil || !money.IsPositive(m) {
+				return nil, errors.Errorf("promo code %s: amount %q is not a positive amount in USD", p.code, f.Amount)
+			}
+			p.amount = &m
+		default:
+			return nil, errors.Errorf("promo code %s: needs a positive percent or amount", p.code)
+		}
+		if f.Expires != "" {
+			var err error
+			if p.expires, err = parsePromoExpiry(f.Expires); err != nil {
+				return nil, errors.Errorf("promo code %s: invalid expiry %q", p.code, f.Expires)
+			}
+		}
+		if _, ok := out[p.code]; ok {
+			return nil, errors.Errorf("promo code %s defined twice", p.code)
+		}
+		out[p.code] = p
+	}
+	return out, nil
+}
+
+// parsePromoExpiry returns the time a promo code expires at. A code expiring
+// on a date is valid through the end of that day, in UTC.
+func parsePromoExpiry(s string) (time.Time, error) {
+	if d, err := time.Parse(time.DateOnly, s); err == nil {
+		return d.AddDate(0, 0, 1), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func validPromoCode(s string) bool {
+	if s == "" || len(s) > 32 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// activePromo returns the promo code applied in the session of r, if it is
+// still valid.
+func (fe *frontendServer) activePromo(r *http.Request) (promoCode, bool) {
+	var code string
+	sessionState(r).get(promoSessionKey, &code)
+	p, ok := fe.promos[code]
+	if !ok || p.expired(time.Now()) {
+		return promoCode{}, false
+	}
+	return p, true
+}
+
+// promoDiscount returns the discount p grants on subtotal, in the currency
+// of subtotal. It is truncated to the currency's minor unit so that the
+// amounts shown add up to the total.
+func (fe *frontendServer) promoDiscount(ctx context.Context, p promoCode, subtotal *pb.Money) (*pb.Money, error) {
+	currency := subtotal.GetCurrencyCode()
+	d := p.amount
+	if p.percent != 0 {
+		m := money.Convert(*subtotal, money.Percent(p.percent), currency)
+		d = &m
+	} else {
+		var err error
+		if d, err = fe.convertCurrency(ctx, p.amount, currency); err != nil {
+			return nil, errors.Wrapf(err, "could not convert the discount of promo code %s", p.code)
+		}
+	}
+	t := money.Truncate(*d)
+	if money.IsNegative(money.Must(money.Sum(*subtotal, money.Negate(t)))) {
+		return &pb.Money{CurrencyCode: currency, Units: subtotal.GetUnits(), Nanos: subtotal.GetNanos()}, nil
+	}
+	return &t, nil
+}
+
+// appliedPromo is the promo code of an order and the discount it got.
+type appliedPromo struct {
+	code     string
+	discount *pb.Money
+}
+
+// orderPromo recomputes the discount of the session's promo code on order,
+// from the item costs charged by the checkout service. The order was placed
+// already, so a failure only leaves the discount out of the receipt.
+func (fe *frontendServer) orderPromo(r *http.Request, order *pb.OrderResult) *appliedPromo {
+	p, ok := fe.activePromo(r)
+	if !ok {
+		return nil
+	}
+	log := loggerFromContext(r.Context())
+	subtotal := pb.Money{CurrencyCode: order.GetShippingCost().GetCurrencyCode()}
+	for _, v := range order.GetItems() {
+		subtotal = money.Must(money.Sum(subtotal, money.MultiplySlow(*v.GetCost(), uint32(v.GetItem().GetQuantity()))))
+	}
+	d, err := fe.promoDiscount(r.Context(), p, &subtotal)
+	if err != nil {
+		log.WithField("error", err).Warn("failed to compute the promo discount of the order")
+		return nil
+	}
+	log.WithFields(logrus.Fields{
+		"order":          order.GetOrderId(),
+		"promo.code":     p.code,
+		"promo.discount": money.Amount(*d),
+		"promo.currency": d.GetCurrencyCode(),
+	}).Info("promo code applied to order")
+	return &appliedPromo{code: p.code, discount: d}
+}
+
+// promoHandler applies the promo code entered in the cart to the session,
+// replacing any code applied before, or removes it when remove is set.
+// Unknown and expired codes are shown as errors on the cart page.
+func (fe *frontendServer) promoHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	if r.FormValue("remove") != "" {
+		sessionState(r).set(promoSessionKey, "")
+		fe.flash(w, r, flashInfo, "flash.promo_removed")
+		http.Redirect(w, r, baseUrl+"/cart", http.StatusFound)
+		return
+	}
+
+	payload := validator.PromoCodePayload{Code: strings.ToUpper(strings.TrimSpace(r.FormValue("promo_code")))}
+	checkout := fe.checkoutValues(r)
+	checkout.Set("promo_code", r.FormValue("promo_code"))
+	if err := payload.Validate(); err != nil {
+		fe.renderCart(w, r, checkout, validator.FieldErrors(err), http.StatusUnprocessableEntity)
+		return
+	}
+	var msg string
+	if p, ok := fe.promos[payload.Code]; !ok {
+		msg = "This promo code is not valid."
+	} else if p.expired(time.Now()) {
+		msg = "This promo code has expired."
+	}
+	if msg != "" {
+		log.WithField("promo.code", payload.Code).Info("rejected promo code")
+		fe.renderCart(w, r, checkout, map[string]string{"promo_code": msg}, http.StatusUnprocessableEntity)
+		return
+	}
+	log.WithField("promo.code", payload.Code).Debug("applied promo code")
+	sessionState(r).set(promoSessionKey, payload.Code)
+	fe.flash(w, r, flashSuccess, "flash.promo_applied", "code", payload.Code)
+	http.Redirect(w, r, baseUrl+"/cart", http.StatusFound)
+}
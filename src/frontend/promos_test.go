@@ -0,0 +1,195 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestParsePromoCodes(t *testing.T) {
+	got, err := parsePromoCodes("code=save10;percent=10;expires=2026-12-31, code=TAKE5;amount=5.5;expires=2026-06-01T12:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := promoCodes{
+		"SAVE10": {code: "SAVE10", percent: 10, expires: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"TAKE5": {code: "TAKE5", amount: &pb.Money{CurrencyCode: "USD", Units: 5, Nanos: 500000000},
+			expires: time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, err := parsePromoCodes("code=TAKE5;amount=4.999999999"); err != nil || got["TAKE5"].amount.GetNanos() != 999999999 {
+		t.Errorf("amount=4.999999999: %v, %v", got["TAKE5"].amount, err)
+	}
+
+	for _, s := range []string{
+		"code=SAVE10",
+		"code=SAVE10;percent",
+		"code=SAVE10;percent=10;amount=5",
+		"code=SAVE10;percent=110",
+		"code=SAVE10;amount=-5",
+		"code=SAVE10;amount=0",
+		// Ten decimals made a nanos count of a billion.
+		"code=SAVE10;amount=4.9999999999",
+		"code=SAVE10;amount=1e30",
+		"code=SAVE10;amount=100000000000000000000",
+		"code=SAVE 10;percent=10",
+		"code=SAVE10;percent=10;expires=tomorrow",
+		"code=SAVE10;percent=10;color=red",
+		"code=SAVE10;percent=10,code=save10;amount=5",
+	} {
+		if _, err := parsePromoCodes(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestLoadPromoCodes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "promos.json")
+	if err := os.WriteFile(path, []byte(`[{"code": "SAVE10", "percent": 10}, {"code": "TAKE5", "amount": 5}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadPromoCodes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["SAVE10"].percent != 10 || got["TAKE5"].amount.Units != 5 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestPromoDiscount(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	subtotal := &pb.Money{CurrencyCode: "USD", Units: 39, Nanos: 980000000}
+	for _, tc := range []struct {
+		promo promoCode
+		want  *pb.Money
+	}{
+		{promoCode{code: "SAVE10", percent: 10}, &pb.Money{CurrencyCode: "USD", Units: 3, Nanos: 990000000}},
+		{promoCode{code: "TAKE5", amount: &pb.Money{CurrencyCode: "USD", Units: 5}}, &pb.Money{CurrencyCode: "USD", Units: 5}},
+		{promoCode{code: "TAKE50", amount: &pb.Money{CurrencyCode: "USD", Units: 50}}, subtotal},
+	} {
+		got, err := fe.promoDiscount(context.Background(), tc.promo, subtotal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.GetUnits() != tc.want.GetUnits() || got.GetNanos() != tc.want.GetNanos() {
+			t.Errorf("%s: discount %v, want %v", tc.promo.code, got, tc.want)
+		}
+	}
+
+	// 0.15 is a little less in binary; the discount must not lose a cent.
+	got, err := fe.promoDiscount(context.Background(), promoCode{code: "SAVE15", percent: 15}, &pb.Money{CurrencyCode: "USD", Units: 20})
+	if err != nil || got.GetUnits() != 3 || got.GetNanos() != 0 {
+		t.Errorf("SAVE15 on 20.00: discount %v, %v; want 3.00", got, err)
+	}
+}
+
+func TestPromoCheckout(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, fb)
+	fe.promos, _ = parsePromoCodes("code=SAVE10;percent=10,code=OLD;percent=50;expires=2020-01-01,code=TAKE5;amount=5")
+	store := newMemorySessionStore(time.Hour, 10)
+
+	apply := func(form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		fe.promoHandler(w, withSessionState(newTestRequest(http.MethodPost, "/cart/promo", strings.NewReader(form.Encode())), store))
+		return w
+	}
+	for code, msg := range map[string]string{
+		"NOPE":    "This promo code is not valid.",
+		"old":     "This promo code has expired.",
+		"SAVE-10": "Enter letters and digits only.",
+	} {
+		w := apply(url.Values{"promo_code": {code}})
+		if body := w.Body.String(); w.Code != http.StatusUnprocessableEntity || !strings.Contains(body, msg) {
+			t.Errorf("%s: status %d, page lacks %q", code, w.Code, msg)
+		}
+	}
+
+	// A second code replaces the first.
+	for _, code := range []string{"take5", "save10"} {
+		if w := apply(url.Values{"promo_code": {code}}); w.Code != http.StatusFound {
+			t.Fatalf("%s: status %d", code, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, withSessionState(newTestRequest(http.MethodGet, "/cart", nil), store))
+	if body := w.Body.String(); !strings.Contains(body, "Promo code SAVE10") || !strings.Contains(body, "&minus;$3.99") ||
+		strings.Contains(body, "TAKE5") {
+		t.Errorf("cart lacks the SAVE10 discount: %.2000s", body)
+	}
+
+	logger, hook := logtest.NewNullLogger()
+	r := withSessionState(newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm())), store)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(logger)))
+	w = httptest.NewRecorder()
+	fe.placeOrderHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("checkout: status %d", w.Code)
+	}
+	var applied *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "promo code applied to order" {
+			applied = e
+		}
+	}
+	if applied == nil || applied.Data["promo.code"] != "SAVE10" || applied.Data["promo.discount"] != "3.99" {
+		t.Errorf("promo log entry = %+v", applied)
+	}
+
+	rc, ok := fe.receipts.get("test-session", "order-test-session")
+	if !ok {
+		t.Fatal("no receipt")
+	}
+	b, _ := json.Marshal(rc)
+	// Two sunglasses at $19.99 less 10%, and $8.99 of shipping.
+	if rc.PromoCode != "SAVE10" || rc.Discount == nil || rc.Total.Formatted != "$44.98" {
+		t.Errorf("receipt = %s", b)
+	}
+	if _, ok := fe.activePromo(withSessionState(newTestRequest(http.MethodGet, "/cart", nil), store)); ok {
+		t.Error("promo code still applied after the order")
+	}
+}
+
+func TestRemovePromo(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.promos, _ = parsePromoCodes("code=SAVE10;percent=10")
+	store := newMemorySessionStore(time.Hour, 10)
+	r := withSessionState(newTestRequest(http.MethodGet, "/cart", nil), store)
+	sessionState(r).set(promoSessionKey, "SAVE10")
+	w := httptest.NewRecorder()
+	fe.promoHandler(w, withSessionState(newTestRequest(http.MethodPost, "/cart/promo", strings.NewReader("remove=1")), store))
+	if _, ok := fe.activePromo(r); w.Code != http.StatusFound || ok {
+		t.Errorf("status %d, promo still applied: %v", w.Code, ok)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+// routeRateLimits holds the built-in request limits per route. Each can be
+// overridden with RATE_LIMIT_<ROUTE>, e.g. RATE_LIMIT_CHECKOUT=10/1m, and
+// other routes can be limited the same way; "0" disables a limit.
+var routeRateLimits = map[string]rateLimit{
+	"checkout": {requests: 5, per: time.Minute},
+	"bot":      {requests: 10, per: time.Minute},
+}
+
+var rateLimitRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_rate_limit_rejected_total",
+	Help: "Number of requests rejected with 429 by the rate limiter, by route.",
+}, []string{"route"})
+
+// rateLimit allows bursts of up to requests, refilled evenly over per.
+type rateLimit struct {
+	requests int
+	per      time.Duration
+}
+
+func (l rateLimit) String() string { return fmt.Sprintf("%d/%v", l.requests, l.per) }
+
+// parseRateLimit parses a limit written as "<requests>/<duration>", e.g.
+// "10/1m". "0" is the zero limit, which disables limiting.
+func parseRateLimit(s string) (rateLimit, error) {
+	if s == "0" {
+		return rateLimit{}, nil
+	}
+	n, d, ok := strings.Cut(s, "/")
+	if !ok {
+		return rateLimit{}, errors.Errorf("rate limit %q is not of the form <requests>/<duration>", s)
+	}
+	requests, err := strconv.Atoi(n)
+	if err != nil || requests < 0 {
+		return rateLimit{}, errors.Errorf("invalid request count in rate limit %q", s)
+	}
+	per, err := time.ParseDuration(d)
+	if err != nil || per <= 0 {
+		return rateLimit{}, errors.Errorf("invalid period in rate limit %q", s)
+	}
+	return rateLimit{requests: requests, per: per}, nil
+}
+
+// rateLimitsFromEnv returns the limit of each limited route: the built-in
+// routeRateLimits, overridden or extended by RATE_LIMIT_<ROUTE>.
+func rateLimitsFromEnv(l *envLoader) map[string]rateLimit {
+	out := maps.Clone(routeRateLimits)
+	for _, key := range envKeysWithPrefix("RATE_LIMIT_") {
+		limit, err := parseRateLimit(os.Getenv(key))
+		if err != nil {
+			l.problem("%s: %v", key, err)
+			continue
+		}
+		out[strings.ToLower(strings.TrimPrefix(key, "RATE_LIMIT_"))] = limit
+	}
+	return out
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the requests to one route with a token bucket per
+// client. Clients are told apart by session, or by IP address for requests
+// that did not come with a session cookie, since those get a fresh session
+// each time.
+type rateLimiter struct {
+	route string
+	limit rateLimit
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns a limiter for route, or nil if limit allows no
+// requests, which disables limiting.
+func newRateLimiter(route string, limit rateLimit) *rateLimiter {
+	if limit.requests <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		route:   route,
+		limit:   limit,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *rateLimiter) rate() float64 {
+	return float64(l.limit.requests) / l.limit.per.Seconds()
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it returns
+// false and how long until the next token.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.requests), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.requests), b.tokens+now.Sub(b.last).Seconds()*l.rate())
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate() * float64(time.Second))
+}
+
+// sweep forgets buckets that have refilled completely, which behave the
+// same as new ones.
+func (l *rateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate() >= float64(l.limit.requests) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// sweepIdle calls sweep every interval until ctx is done.
+func (l *rateLimiter) sweepIdle(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			l.sweep()
+		}
+	}
+}
+
+// key identifies the client that sent r.
+func (l *rateLimiter) key(r *http.Request) string {
+	if id := sessionID(r); id != "" && !isNewSession(r) && os.Getenv("ENABLE_SINGLE_SHARED_SESSION") != "true" {
+		return "session:" + id
+	}
+	return "ip:" + clientIP(r)
+}
+
+// middleware rejects requests over the limit with 429 Too Many Requests and a
+// Retry-After header. A nil limiter lets every request through.
+func (l *rateLimiter) middleware(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := l.allow(l.key(r))
+		if ok {
+			next(w, r)
+			return
+		}
+		rateLimitRejectedTotal.WithLabelValues(l.route).Inc()
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		log := loggerFromContext(r.Context())
+		log.WithFields(logrus.Fields{
+			"route":       l.route,
+			"retry_after": retryAfter,
+		}).Warn("request rate limited")
+		renderSlowDown(log, r, w, retryAfter)
+	}
+}
+
+// renderSlowDown answers a rate-limited request: API clients get a JSON
+// error, browsers a page asking them to wait.
+func renderSlowDown(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, retryAfter int) {
+	const code = http.StatusTooManyRequests
+	if wantsJSON(r) {
+		writeJSON(log, w, code, apiError{
+			Error: fmt.Sprintf("too many requests, retry in %d seconds", retryAfter),
+			Code:  code,
+		})
+		return
+	}
+	w.WriteHeader(code)
+	if err := templates.ExecuteTemplate(w, "slow_down", injectCommonTemplateData(r, map[string]interface{}{
+		"retry_after": retryAfter,
+	})); err != nil {
+		log.Println(err)
+	}
+}
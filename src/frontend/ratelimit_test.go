@@ -0,0 +1,163 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    rateLimit
+		wantErr bool
+	}{
+		{"10/1m", rateLimit{10, time.Minute}, false},
+		{"3/30s", rateLimit{3, 30 * time.Second}, false},
+		{"0", rateLimit{}, false},
+		{"10", rateLimit{}, true},
+		{"x/1m", rateLimit{}, true},
+		{"10/0s", rateLimit{}, true},
+		{"-1/1m", rateLimit{}, true},
+	} {
+		got, err := parseRateLimit(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseRateLimit(%q) = %v, %v; want %v, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestRateLimitsFromEnv(t *testing.T) {
+	var l envLoader
+	if got := rateLimitsFromEnv(&l); got["checkout"] != routeRateLimits["checkout"] || l.err() != nil {
+		t.Errorf("default checkout limit = %v, %v", got["checkout"], l.err())
+	}
+	t.Setenv("RATE_LIMIT_CHECKOUT", "2/1s")
+	t.Setenv("RATE_LIMIT_HOME", "100/1m")
+	t.Setenv("RATE_LIMIT_VIEW_CART", "0")
+	got := rateLimitsFromEnv(&l)
+	if got["checkout"] != (rateLimit{2, time.Second}) {
+		t.Errorf("overridden checkout limit = %v", got["checkout"])
+	}
+	if got["home"] != (rateLimit{100, time.Minute}) {
+		t.Errorf("home limit = %v", got["home"])
+	}
+	if got["view_cart"] != (rateLimit{}) || got["search"] != (rateLimit{}) {
+		t.Errorf("view_cart and search limits = %v, %v; want none", got["view_cart"], got["search"])
+	}
+	if l.err() != nil {
+		t.Error(l.err())
+	}
+
+	t.Setenv("RATE_LIMIT_CHECKOUT", "10")
+	if rateLimitsFromEnv(&l); l.err() == nil || !strings.Contains(l.err().Error(), "RATE_LIMIT_CHECKOUT") {
+		t.Errorf("RATE_LIMIT_CHECKOUT=10: problems %v", l.err())
+	}
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	l := newRateLimiter("test", rateLimit{requests: 3, per: 3 * time.Second})
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d of the burst rejected", i+1)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok || wait != time.Second {
+		t.Errorf("over the burst: got %v, retry after %v; want rejected, retry after 1s", ok, wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("another client rejected")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("request rejected after a token was refilled")
+	}
+	if ok, _ := l.allow("a"); ok {
+		t.Error("second request allowed with only one token refilled")
+	}
+
+	now = now.Add(2 * time.Second)
+	l.sweep()
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("sweep kept a refilled bucket")
+	}
+	if _, ok := l.buckets["a"]; !ok {
+		t.Error("sweep removed a bucket that is still draining")
+	}
+}
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	if l := newRateLimiter("test", rateLimit{}); l != nil {
+		t.Errorf("newRateLimiter with no limit = %v, want nil", l)
+	}
+	h := (*rateLimiter)(nil).middleware(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	h(w, newTestRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("nil limiter: got status %d", w.Code)
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	l := newRateLimiter("checkout", rateLimit{requests: 1, per: 10 * time.Second})
+	h := l.middleware(func(w http.ResponseWriter, r *http.Request) {})
+	before := testutil.ToFloat64(rateLimitRejectedTotal.WithLabelValues("checkout"))
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	if w := serve(newTestRequest(http.MethodPost, "/cart/checkout", nil)); w.Code != http.StatusOK {
+		t.Fatalf("first request: got status %d", w.Code)
+	}
+	w := serve(newTestRequest(http.MethodPost, "/cart/checkout", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Fatalf("second request: got status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), "Slow down") {
+		t.Error("rate limited page does not ask the user to slow down")
+	}
+	if got := testutil.ToFloat64(rateLimitRejectedTotal.WithLabelValues("checkout")) - before; got != 1 {
+		t.Errorf("http_rate_limit_rejected_total increased by %v, want 1", got)
+	}
+
+	// Requests without a session cookie are told apart by address.
+	r := newTestRequest(http.MethodPost, "/cart/checkout", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyNewSession{}, true))
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("new session: got status %d", w.Code)
+	}
+
+	r = newTestRequest(http.MethodGet, "/api/cart", nil)
+	w = serve(r)
+	var body apiError
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Code != http.StatusTooManyRequests {
+		t.Errorf("API request: got %q, %v; want a JSON error", w.Body.String(), err)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+type ctxKeyClientIP struct{}
+
+// parseTrustedProxies parses the comma-separated addresses and CIDR ranges
+// in TRUSTED_PROXY_CIDRS, skipping malformed entries.
+func parseTrustedProxies(log logrus.FieldLogger, s string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if a, err := netip.ParseAddr(v); err == nil {
+				a = a.Unmap()
+				out = append(out, netip.PrefixFrom(a, a.BitLen()))
+				continue
+			}
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			log.Warnf("warn: ignoring invalid trusted proxy %q", v)
+			continue
+		}
+		out = append(out, p.Masked())
+	}
+	return out
+}
+
+func isTrustedProxy(a netip.Addr, trusted []netip.Prefix) bool {
+	for _, p := range trusted {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses a single address from a forwarding header.
+func parseIP(s string) (netip.Addr, bool) {
+	a, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.Unmap(), true
+}
+
+// remoteIP returns the address of the peer that sent r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// resolveClientIP returns the address of the client that sent r. Forwarding
+// headers are only believed when the peer is a trusted proxy. X-Forwarded-For
+// is then walked from the right past trusted hops to the first address that
+// is not one; a malformed hop makes the whole header untrustworthy, and
+// X-Real-Ip is used instead if it holds a valid address. Peers on a unix
+// socket are trusted proxies.
+func resolveClientIP(r *http.Request, trusted []netip.Prefix) string {
+	remote := remoteIP(r)
+	if a, ok := parseIP(remote); !fromUnixSocket(r) && (!ok || !isTrustedProxy(a, trusted)) {
+		return remote
+	}
+
+	var client netip.Addr
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			a, ok := parseIP(hops[i])
+			if !ok {
+				client = netip.Addr{}
+				break
+			}
+			client = a
+			if !isTrustedProxy(a, trusted) {
+				break
+			}
+		}
+	}
+	if client.IsValid() {
+		return client.String()
+	}
+	if a, ok := parseIP(r.Header.Get("X-Real-Ip")); ok {
+		return a.String()
+	}
+	return remote
+}
+
+// realIP records the client's address in the request context, for logging,
+// rate limiting and tracing, trusting forwarding headers only from the given
+// proxies.
+func realIP(trusted []netip.Prefix, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r, trusted)
+		labelSpan(r.Context(), "client_ip", ip)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyClientIP{}, ip)))
+	}
+}
+
+// clientIP returns the client address recorded by realIP, or the peer's
+// address for requests that did not go through it.
+func clientIP(r *http.Request) string {
+	if v, ok := r.Context().Value(ctxKeyClientIP{}).(string); ok {
+		return v
+	}
+	return remoteIP(r)
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	got := parseTrustedProxies(discardLog, " 10.0.0.0/8, 192.168.1.1,bogus,10.1.2.3/16, ::ffff:172.16.0.1, fd00::/8,")
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "10.1.0.0/16", "172.16.0.1/32", "fd00::/8"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("entry %d = %v, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	trusted := parseTrustedProxies(discardLog, "10.0.0.0/8, 192.168.1.1, fd00::/8")
+	for _, tc := range []struct {
+		name    string
+		remote  string
+		xff     []string
+		realIP  string
+		trusted bool
+		want    string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "", true, "203.0.113.7"},
+		{"spoofed by untrusted peer", "203.0.113.7:1234", []string{"198.51.100.1"}, "198.51.100.2", true, "203.0.113.7"},
+		{"no proxies configured", "10.1.2.3:1234", []string{"198.51.100.1"}, "", false, "10.1.2.3"},
+		{"one hop", "10.1.2.3:1234", []string{"198.51.100.1"}, "", true, "198.51.100.1"},
+		{"multiple hops", "10.1.2.3:1234", []string{"6.6.6.6, 198.51.100.1, 192.168.1.1"}, "", true, "198.51.100.1"},
+		{"hops over several headers", "10.1.2.3:1234", []string{"6.6.6.6, 198.51.100.1", "10.4.4.4"}, "", true, "198.51.100.1"},
+		{"spoofed hop left of the client", "10.1.2.3:1234", []string{"1.1.1.1, 198.51.100.1"}, "", true, "198.51.100.1"},
+		{"only trusted hops", "10.1.2.3:1234", []string{"10.9.9.9, 10.8.8.8"}, "", true, "10.9.9.9"},
+		{"ipv6", "[fd00::1]:1234", []string{"2001:db8::7"}, "", true, "2001:db8::7"},
+		{"ipv4-mapped hop", "10.1.2.3:1234", []string{"::ffff:198.51.100.1"}, "", true, "198.51.100.1"},
+		{"real ip fallback", "10.1.2.3:1234", nil, "198.51.100.9", true, "198.51.100.9"},
+		{"malformed hop", "10.1.2.3:1234", []string{"198.51.100.1, not-an-ip"}, "", true, "10.1.2.3"},
+		{"malformed hop with real ip", "10.1.2.3:1234", []string{"198.51.100.1, 300.1.1.1"}, "198.51.100.9", true, "198.51.100.9"},
+		{"empty hop", "10.1.2.3:1234", []string{"198.51.100.1,,10.4.4.4"}, "", true, "10.1.2.3"},
+		{"host and port hop", "10.1.2.3:1234", []string{"198.51.100.1:5555"}, "", true, "10.1.2.3"},
+		{"malformed real ip", "10.1.2.3:1234", nil, "198.51.100.9; drop table", true, "10.1.2.3"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		for _, v := range tc.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-Ip", tc.realIP)
+		}
+		p := trusted
+		if !tc.trusted {
+			p = nil
+		}
+		if got := resolveClientIP(r, p); got != tc.want {
+			t.Errorf("%s: resolveClientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRealIPMiddleware(t *testing.T) {
+	var got string
+	h := realIP(parseTrustedProxies(discardLog, "10.0.0.0/8"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIP(r)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	h(httptest.NewRecorder(), r)
+	if got != "198.51.100.1" {
+		t.Errorf("clientIP in handler = %q, want 198.51.100.1", got)
+	}
+
+	if got := clientIP(httptest.NewRequest(http.MethodGet, "/", nil)); got != "192.0.2.1" {
+		t.Errorf("clientIP without the middleware = %q, want the peer address", got)
+	}
+}
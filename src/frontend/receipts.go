@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+const (
+	defaultOrderHistorySize = 5
+
+	// defaultGiftWrapFee is the gift wrapping fee, in USD.
+	defaultGiftWrapFee = "4.99"
+
+	// receiptTTL matches the session cookie lifetime: once the cookie is
+	// gone, nobody can ask for the receipts anymore.
+	receiptTTL = cookieMaxAge * time.Second
+
+	// receiptSweepThreshold is the number of sessions above which expired
+	// receipts are purged on insert.
+	receiptSweepThreshold = 10000
+)
+
+// receipt is the record of a placed order shown on the confirmation page and
+// returned by /order/{id}/receipt.json.
+type receipt struct {
+	OrderID            string        `json:"order_id"`
+	ShippingTrackingID string        `json:"shipping_tracking_id"`
+	Items              []receiptItem `json:"items"`
+	ShippingCost       apiMoney      `json:"shipping_cost"`
+	PromoCode          string        `json:"promo_code,omitempty"`
+	Discount           *apiMoney     `json:"discount,omitempty"`
+	GiftWrapFee        *apiMoney     `json:"gift_wrap_fee,omitempty"`
+	Total              apiMoney      `json:"total"`
+	OrderNote          string        `json:"order_note,omitempty"`
+	PlacedAt           time.Time     `json:"placed_at"`
+}
+
+// orderExtras are what the frontend adds to an order on top of what the
+// checkout service knows of.
+type orderExtras struct {
+	promo *appliedPromo
+	// giftWrapFee is the gift wrapping fee in the order's currency, nil
+	// without gift wrapping.
+	giftWrapFee *pb.Money
+	note        string
+	// variants are those of the products in the cart that was ordered.
+	variants cartVariants
+}
+
+type receiptItem struct {
+	ProductID string   `json:"product_id"`
+	Variant   string   `json:"variant,omitempty"`
+	Quantity  int32    `json:"quantity"`
+	UnitCost  apiMoney `json:"unit_cost"`
+	LineTotal apiMoney `json:"line_total"`
+}
+
+// newReceipt builds a receipt from the checkout service's order result. Item
+// costs are per unit, in the user's currency, and formatted for l. Items are
+// split into the variants of extras, as in the cart. The promo discount and
+// gift wrapping fee of extras adjust the total charged by the checkout
+// service.
+func newReceipt(order *pb.OrderResult, placedAt time.Time, l money.Locale, extras orderExtras) *receipt {
+	total := *order.GetShippingCost()
+	rc := &receipt{
+		OrderID:            order.GetOrderId(),
+		ShippingTrackingID: order.GetShippingTrackingId(),
+		Items:              make([]receiptItem, 0, len(order.GetItems())),
+		ShippingCost:       newAPIMoney(order.GetShippingCost(), l),
+		OrderNote:          extras.note,
+		PlacedAt:           placedAt,
+	}
+	for _, v := range order.GetItems() {
+		for _, cl := range extras.variants.lines(v.GetItem()) {
+			line := money.MultiplySlow(*v.GetCost(), uint32(cl.Quantity))
+			total = money.Must(money.Sum(total, line))
+			rc.Items = append(rc.Items, receiptItem{
+				ProductID: v.GetItem().GetProductId(),
+				Variant:   cl.Variant,
+				Quantity:  cl.Quantity,
+				UnitCost:  newAPIMoney(v.GetCost(), l),
+				LineTotal: newAPIMoney(&line, l),
+			})
+		}
+	}
+	if p := extras.promo; p != nil {
+		total = money.Must(money.Sum(total, money.Negate(*p.discount)))
+		d := newAPIMoney(p.discount, l)
+		rc.PromoCode, rc.Discount = p.code, &d
+	}
+	if fee := extras.giftWrapFee; fee != nil {
+		total = money.Must(money.Sum(total, *fee))
+		f := newAPIMoney(fee, l)
+		rc.GiftWrapFee = &f
+	}
+	rc.Total = newAPIMoney(&total, l)
+	return rc
+}
+
+// receiptStore keeps the last few receipts of each session in memory. It is
+// per replica, so a receipt may not be found after being routed elsewhere.
+type receiptStore struct {
+	size int
+
+	mu        sync.Mutex
+	bySession map[string][]*receipt // newest last
+}
+
+func newReceiptStore(size int) *receiptStore {
+	return &receiptStore{size: size, bySession: make(map[string][]*receipt)}
+}
+
+func (s *receiptStore) add(sessionID string, rc *receipt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.bySession) > receiptSweepThreshold {
+		s.sweep(rc.PlacedAt)
+	}
+	rs := append(s.bySession[sessionID], rc)
+	if len(rs) > s.size {
+		rs = rs[len(rs)-s.size:]
+	}
+	s.bySession[sessionID] = rs
+}
+
+func (s *receiptStore) get(sessionID, orderID string) (*receipt, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rc := range s.bySession[sessionID] {
+		if rc.OrderID == orderID && time.Since(rc.PlacedAt) < receiptTTL {
+			return rc, true
+		}
+	}
+	return nil, false
+}
+
+// sweep drops sessions whose newest receipt has expired. s.mu must be held.
+func (s *receiptStore) sweep(now time.Time) {
+	for id, rs := range s.bySession {
+		if now.Sub(rs[len(rs)-1].PlacedAt) >= receiptTTL {
+			delete(s.bySession, id)
+		}
+	}
+}
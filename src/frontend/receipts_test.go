@@ -0,0 +1,197 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func checkoutForm() string {
+	return checkoutDefaults(time.Now()).Encode()
+}
+
+func placeTestOrder(t *testing.T, fe *frontendServer) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm())))
+	return w
+}
+
+func TestPlaceOrderRendersReceipt(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	// The order is placed; the confirmation page must not depend on this.
+	fb.setError("ListRecommendations", status.Error(codes.Unavailable, "down"))
+	fe := newTestFrontend(t, fb)
+
+	w := placeTestOrder(t, fe)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"order-test-session", "tracking-test-session",
+		"SKU #OLJCESPC7Z", "$19.99 each", "$39.98", // line
+		"$8.99",  // shipping
+		"$48.97", // total
+		"/order/order-test-session/receipt.json",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("confirmation page does not contain %q", want)
+		}
+	}
+}
+
+func TestOrderReceiptHandler(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+	if w := placeTestOrder(t, fe); w.Code != http.StatusOK {
+		t.Fatalf("placing order: got status %d", w.Code)
+	}
+
+	get := func(orderID, session string) *httptest.ResponseRecorder {
+		r := newTestRequest(http.MethodGet, "/order/"+orderID+"/receipt.json", nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, session))
+		r = mux.SetURLVars(r, map[string]string{"id": orderID})
+		w := httptest.NewRecorder()
+		fe.orderReceiptHandler(w, r)
+		return w
+	}
+
+	w := get("order-test-session", "test-session")
+	var rc receipt
+	if err := json.Unmarshal(w.Body.Bytes(), &rc); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got status %d and body %s", w.Code, w.Body)
+	}
+	if rc.ShippingTrackingID != "tracking-test-session" || len(rc.Items) != 1 || rc.Total.Formatted != "$27.98" {
+		t.Errorf("receipt = %+v", rc)
+	}
+
+	if w := get("order-test-session", "another-session"); w.Code != http.StatusNotFound {
+		t.Errorf("other session: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := get("unknown", "test-session"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown order: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// checkoutWith places an order of one pair of sunglasses with the checkout
+// form extended by extra.
+func checkoutWith(fe *frontendServer, currency string, extra url.Values) *httptest.ResponseRecorder {
+	form := checkoutDefaults(time.Now())
+	for k, v := range extra {
+		form[k] = v
+	}
+	r := newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(form.Encode()))
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: currency})
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, r)
+	return w
+}
+
+func TestGiftWrapFee(t *testing.T) {
+	for _, tc := range []struct {
+		fee, currency string
+		wantFee       pb.Money
+		wantTotal     string
+	}{
+		// The fake currency service converts one for one, so the fee is
+		// rounded to the currency's minor units: sunglasses at 19.99,
+		// 8.99 of shipping and the fee.
+		{"4.99", "USD", pb.Money{Units: 4, Nanos: 990000000}, "$33.97"},
+		{"2.495", "USD", pb.Money{Units: 2, Nanos: 500000000}, "$31.48"},
+		{"2.494", "USD", pb.Money{Units: 2, Nanos: 490000000}, "$31.47"},
+		{"4.99", "JPY", pb.Money{Units: 5}, "¥34"},
+	} {
+		fb := newFakeBackend()
+		fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+		fe := newTestFrontend(t, fb)
+		fe.giftWrapFee = usd(tc.fee)
+		if w := checkoutWith(fe, tc.currency, url.Values{"gift_wrap": {"1"}}); w.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d", tc.fee, tc.currency, w.Code)
+		}
+		rc, _ := fe.receipts.get("test-session", "order-test-session")
+		if f := rc.GiftWrapFee; f == nil || f.Units != tc.wantFee.Units || f.Nanos != tc.wantFee.Nanos || rc.Total.Formatted != tc.wantTotal {
+			t.Errorf("%s %s: fee %+v, total %s, want %v and %s", tc.fee, tc.currency, f, rc.Total.Formatted, tc.wantFee.String(), tc.wantTotal)
+		}
+	}
+
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+	checkoutWith(fe, "USD", nil)
+	if rc, _ := fe.receipts.get("test-session", "order-test-session"); rc.GiftWrapFee != nil || rc.Total.Formatted != "$28.98" {
+		t.Errorf("without gift wrap: fee %+v, total %s", rc.GiftWrapFee, rc.Total.Formatted)
+	}
+}
+
+func TestOrderNote(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+
+	long := strings.Repeat("é", 251)
+	w := checkoutWith(fe, "USD", url.Values{"order_note": {long}, "gift_wrap": {"1"}})
+	body := w.Body.String()
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(body, "This value is too long.") ||
+		!strings.Contains(body, long) || !strings.Contains(body, `name="gift_wrap" value="1" checked`) {
+		t.Errorf("note too long: status %d, form not re-rendered with the input: %.3000s", w.Code, body)
+	}
+
+	w = checkoutWith(fe, "USD", url.Values{"order_note": {" <b>Happy birthday!</b> "}})
+	body = w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "&lt;b&gt;Happy birthday!&lt;/b&gt;") || strings.Contains(body, "<b>Happy") {
+		t.Errorf("status %d, note not shown escaped: %.3000s", w.Code, body)
+	}
+	if rc, _ := fe.receipts.get("test-session", "order-test-session"); rc.OrderNote != "<b>Happy birthday!</b>" {
+		t.Errorf("receipt note = %q", rc.OrderNote)
+	}
+}
+
+func TestReceiptStoreKeepsLastN(t *testing.T) {
+	s := newReceiptStore(2)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		s.add("sess", &receipt{OrderID: fmt.Sprint(i), PlacedAt: now})
+	}
+	if _, ok := s.get("sess", "0"); ok {
+		t.Error("oldest receipt was not evicted")
+	}
+	for _, id := range []string{"1", "2"} {
+		if _, ok := s.get("sess", id); !ok {
+			t.Errorf("receipt %s missing", id)
+		}
+	}
+
+	s.add("old", &receipt{OrderID: "x", PlacedAt: now.Add(-receiptTTL)})
+	if _, ok := s.get("old", "x"); ok {
+		t.Error("expired receipt returned")
+	}
+}
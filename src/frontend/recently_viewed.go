@@ -0,0 +1,76 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+const maxRecentlyViewed = 8
+
+// recentlyViewed returns the IDs of the products the user viewed last, most
+// recent first.
+func (fe *frontendServer) recentlyViewed(r *http.Request) []string {
+	return fe.productIDsCookie(r, cookieRecentlyViewed, maxRecentlyViewed)
+}
+
+// rememberViewed puts id at the front of the recently viewed products.
+func (fe *frontendServer) rememberViewed(w http.ResponseWriter, r *http.Request, id string) {
+	ids := []string{id}
+	for _, v := range fe.recentlyViewed(r) {
+		if v != id && len(ids) < maxRecentlyViewed {
+			ids = append(ids, v)
+		}
+	}
+	fe.setProductIDsCookie(w, r, cookieRecentlyViewed, ids)
+}
+
+// recentlyViewedProducts resolves ids, except skip, against the catalog with
+// prices in currency. Products no longer in the catalog are left out. The
+// strip is not critical: on error it is logged and left empty.
+func (fe *frontendServer) recentlyViewedProducts(ctx context.Context, log logrus.FieldLogger, ids []string, skip, currency string) []productView {
+	var want []string
+	for _, id := range ids {
+		if id != skip {
+			want = append(want, id)
+		}
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	found, _, err := fe.lookupProducts(ctx, want, currency)
+	if err != nil {
+		log.WithField("error", err).Warn("failed to get recently viewed products")
+		return nil
+	}
+	return found
+}
+
+func (fe *frontendServer) apiRecentlyViewedHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	found, _, err := fe.lookupProducts(r.Context(), fe.recentlyViewed(r), currentCurrency(r))
+	if err != nil {
+		renderAPIGRPCError(log, r, w, err)
+		return
+	}
+	out := apiProducts{Products: make([]apiProduct, 0, len(found))}
+	for _, p := range found {
+		out.Products = append(out.Products, newAPIProduct(p, userLocale(r)))
+	}
+	writeJSON(log, w, http.StatusOK, out)
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// viewProducts returns the recently viewed cookie after visiting ids in order.
+func viewProducts(fe *frontendServer, ids ...string) *http.Cookie {
+	var c *http.Cookie
+	for _, id := range ids {
+		r := newTestRequest(http.MethodGet, "/product/"+id, nil)
+		if c != nil {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		fe.rememberViewed(w, r, id)
+		c = w.Result().Cookies()[0]
+	}
+	return c
+}
+
+func TestRecentlyViewed(t *testing.T) {
+	fe := &frontendServer{cookieSigner: newCookieSigner("secret")}
+	var ids []string
+	for i := 0; i < 10; i++ {
+		ids = append(ids, fmt.Sprintf("P%d", i))
+	}
+	c := viewProducts(fe, append(ids, "P5")...)
+
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r.AddCookie(c)
+	want := []string{"P5", "P9", "P8", "P7", "P6", "P4", "P3", "P2"}
+	if got := fe.recentlyViewed(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("recentlyViewed = %v, want %v", got, want)
+	}
+
+	other := r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, "other-session"))
+	if got := fe.recentlyViewed(other); got != nil {
+		t.Errorf("another session sees %v, want nil", got)
+	}
+	for _, value := range []string{"", "P1|P2", "P1|P2.forged"} {
+		r := newTestRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: cookieRecentlyViewed, Value: value})
+		if got := fe.recentlyViewed(r); got != nil {
+			t.Errorf("cookie %q: recentlyViewed = %v, want nil", value, got)
+		}
+	}
+}
+
+func TestProductPageShowsRecentlyViewed(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	fe.cookieSigner = newCookieSigner("secret")
+	// GONE is no longer in the catalog and is left out of the strip.
+	c := viewProducts(fe, "GONE", "66VCHSJNUP", "OLJCESPC7Z")
+
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	r.AddCookie(c)
+	w := httptest.NewRecorder()
+	fe.productHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	_, strip, _ := strings.Cut(w.Body.String(), "Recently Viewed")
+	if !strings.Contains(strip, "Tank Top") || !strings.Contains(strip, "$18.99") {
+		t.Errorf("strip does not show the tank top with its price: %.500s", strip)
+	}
+	if strings.Contains(strip, "Sunglasses") {
+		t.Error("strip shows the product of the page")
+	}
+
+	w = httptest.NewRecorder()
+	fe.homeHandler(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Recently Viewed") {
+		t.Errorf("home: status %d, no recently viewed strip", w.Code)
+	}
+}
+
+func TestProductPageRecordsView(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	fe.cookieSigner = newCookieSigner("secret")
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	w := httptest.NewRecorder()
+	fe.productHandler(w, r)
+	if strings.Contains(w.Body.String(), "Recently Viewed") {
+		t.Error("first product page shows a recently viewed strip")
+	}
+
+	r = newTestRequest(http.MethodGet, "/api/recently-viewed", nil)
+	r.AddCookie(setCookie(t, w, cookieRecentlyViewed))
+	w = httptest.NewRecorder()
+	fe.apiRecentlyViewedHandler(w, r)
+	var got apiProducts
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(got.Products) != 1 || got.Products[0].ID != "OLJCESPC7Z" {
+		t.Errorf("status %d, products %+v; want the sunglasses", w.Code, got.Products)
+	}
+}
+
+func setCookie(t *testing.T, w *httptest.ResponseRecorder, name string) *http.Cookie {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie set", name)
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.elastic.co/apm"
+)
+
+// defaultRedactFields are the log fields masked unless REDACT_FIELDS says
+// otherwise: the personal data of the checkout form and credentials.
+const defaultRedactFields = "email,street_address,zip_code,credit_card_*,password,authorization,cookie,set-cookie"
+
+// apmSanitizedFieldNames are the Elastic APM agent's own defaults, which
+// setting the sanitized field names replaces.
+var apmSanitizedFieldNames = []string{
+	"password", "passwd", "pwd", "secret", "*key", "*token*", "*session*",
+	"*credit*", "*card*", "authorization", "set-cookie",
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	// cardPattern matches 13 to 19 digits, which may be grouped by spaces
+	// or dashes; only runs that pass the Luhn check are masked.
+	cardPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+)
+
+// redactFields are the wildcard patterns, as in path.Match, of the field
+// names whose values are masked; matching ignores case.
+type redactFields []string
+
+// redactFieldsFromEnv reads REDACT_FIELDS, a comma-separated list of field
+// name patterns, such as email,credit_card_*. It may be set to none to mask
+// only the values that look like e-mail addresses or card numbers.
+func redactFieldsFromEnv(l *envLoader) redactFields {
+	v := l.str("REDACT_FIELDS", defaultRedactFields)
+	if v == "none" {
+		return nil
+	}
+	var fields redactFields
+	for _, p := range strings.Split(v, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			l.problem("REDACT_FIELDS: bad pattern %q", p)
+			continue
+		}
+		fields = append(fields, p)
+	}
+	return fields
+}
+
+func (f redactFields) match(name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range f {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// redactText masks the e-mail addresses and card numbers in s.
+func redactText(s string) string {
+	if strings.Contains(s, "@") {
+		s = emailPattern.ReplaceAllString(s, redacted)
+	}
+	return cardPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if luhnValid(m) {
+			return redacted
+		}
+		return m
+	})
+}
+
+// luhnValid reports whether the digits of s pass the Luhn checksum of card
+// numbers; other characters are skipped.
+func luhnValid(s string) bool {
+	var sum, n int
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
+
+// redactHook is a logrus hook that masks personal data before entries are
+// written: the values of the fields matching fields, and e-mail addresses
+// and card numbers in the message and in the values of any other field.
+type redactHook struct {
+	fields redactFields
+}
+
+func (h redactHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+// Fire works on the entry's own copy of the fields, which logrus makes for
+// every entry it writes.
+func (h redactHook) Fire(e *logrus.Entry) error {
+	for k, v := range e.Data {
+		if h.fields.match(k) {
+			e.Data[k] = redacted
+			continue
+		}
+		// Values are only replaced, by their masked text, when they hold
+		// something to mask; the others keep their type in the output.
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprint(v)
+		}
+		if r := redactText(s); r != s {
+			e.Data[k] = r
+		}
+	}
+	e.Message = redactText(e.Message)
+	return nil
+}
+
+// sanitizeAPMFields has the Elastic APM agent mask fields, in the request
+// bodies and headers it captures, that match fields as well as its own
+// defaults. ELASTIC_APM_SANITIZE_FIELD_NAMES, set for the agent itself, takes
+// precedence.
+func sanitizeAPMFields(t *apm.Tracer, fields redactFields) {
+	if _, ok := os.LookupEnv("ELASTIC_APM_SANITIZE_FIELD_NAMES"); ok {
+		return
+	}
+	patterns := append(append([]string(nil), apmSanitizedFieldNames...), fields...)
+	t.SetSanitizedFieldNames(patterns...)
+}
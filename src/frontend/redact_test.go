@@ -0,0 +1,164 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// redactingLogger returns a logger that writes JSON entries, masked as in
+// production, to the returned buffer.
+func redactingLogger(t *testing.T, fields redactFields) (*logrus.Logger, *bytes.Buffer) {
+	t.Helper()
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.Out = &buf
+	l.Level = logrus.DebugLevel
+	l.Formatter = &logrus.JSONFormatter{}
+	l.AddHook(redactHook{fields: fields})
+	return l, &buf
+}
+
+func TestRedactText(t *testing.T) {
+	for in, want := range map[string]string{
+		"card 4432801561520454 declined":            "card [redacted] declined",
+		"card 4432-8015-6152-0454 declined":         "card [redacted] declined",
+		"card 4432 8015 6152 0454":                  "card [redacted]",
+		"mail someone@example.com, please":          "mail [redacted], please",
+		"order 4432801561520455 is not luhn":        "order 4432801561520455 is not luhn",
+		"ids 123456789012 and 44328015615204540000": "ids 123456789012 and 44328015615204540000",
+		"product OLJCESPC7Z":                        "product OLJCESPC7Z",
+	} {
+		if got := redactText(in); got != want {
+			t.Errorf("redactText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+	l, buf := redactingLogger(t, redactFields{"email", "credit_card_*"})
+	base := l.WithField("session", "s1")
+	base.WithFields(logrus.Fields{
+		"Email":              "a@b.example",
+		"credit_card_number": 4432801561520454,
+		"error":              errors.New("charge of 4432801561520454 failed"),
+		"quantity":           2,
+		"products":           []string{"OLJCESPC7Z"},
+	}).Error("order for someone@example.com failed")
+	base.Info("next")
+
+	out := buf.String()
+	for _, leak := range []string{"4432801561520454", "a@b.example", "someone@example.com"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("log output contains %q:\n%s", leak, out)
+		}
+	}
+	for _, want := range []string{
+		`"Email":"[redacted]"`,
+		`"credit_card_number":"[redacted]"`,
+		`"error":"charge of [redacted] failed"`,
+		`"msg":"order for [redacted] failed"`,
+		`"quantity":2`,
+		`"products":["OLJCESPC7Z"]`,
+		`"session":"s1"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestPlaceOrderLogsNoCardNumbers(t *testing.T) {
+	form := checkoutDefaults(time.Now())
+	card := form.Get("credit_card_number")
+	grouped := card[:4] + "-" + card[4:8] + "-" + card[8:12] + "-" + card[12:]
+
+	for name, tc := range map[string]struct {
+		setup func(fb *fakeBackend)
+		email string
+	}{
+		"invalid form": {email: "not an e-mail"},
+		"declined": {setup: func(fb *fakeBackend) {
+			fb.setError("PlaceOrder", status.Errorf(codes.InvalidArgument, "card %s of %s was declined", grouped, form.Get("email")))
+		}},
+		"cart unavailable": {setup: func(fb *fakeBackend) {
+			fb.setError("GetCart", status.Errorf(codes.Unavailable, "no cart for card %s", card))
+		}},
+	} {
+		fb := newFakeBackend()
+		fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+		if tc.setup != nil {
+			tc.setup(fb)
+		}
+		fe := newTestFrontend(t, fb)
+		logger, buf := redactingLogger(t, redactFieldsFromEnv(&envLoader{}))
+
+		f := checkoutDefaults(time.Now())
+		if tc.email != "" {
+			f.Set("email", tc.email)
+		}
+		r := newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(f.Encode()))
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(logger.WithField("http.req.path", r.URL.Path))))
+		w := httptest.NewRecorder()
+		fe.placeOrderHandler(w, r)
+		if w.Code == http.StatusOK {
+			t.Fatalf("%s: order placed", name)
+		}
+
+		out := buf.String()
+		if out == "" {
+			t.Errorf("%s: nothing logged", name)
+		}
+		for _, leak := range []string{card, grouped, form.Get("email")} {
+			if strings.Contains(out, leak) {
+				t.Errorf("%s: log output contains %q:\n%s", name, leak, out)
+			}
+		}
+	}
+}
+
+func TestRedactFieldsFromEnv(t *testing.T) {
+	t.Setenv("REDACT_FIELDS", "Email, card_*,")
+	var l envLoader
+	f := redactFieldsFromEnv(&l)
+	if l.err() != nil || !f.match("EMAIL") || !f.match("card_cvv") || f.match("street_address") {
+		t.Errorf("fields %v, err %v", f, l.err())
+	}
+
+	t.Setenv("REDACT_FIELDS", "none")
+	if f := redactFieldsFromEnv(&l); f != nil {
+		t.Errorf("none: fields %v", f)
+	}
+
+	t.Setenv("REDACT_FIELDS", "email,[bad")
+	l = envLoader{}
+	redactFieldsFromEnv(&l)
+	if l.err() == nil {
+		t.Error("bad pattern accepted")
+	}
+}
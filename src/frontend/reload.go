@@ -0,0 +1,215 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/featureflags"
+)
+
+// reloadableVars are the variables SETTINGS_FILE may set. The environment of
+// a running process cannot change, so reloads read them from the file.
+var reloadableVars = []string{"BANNER_MESSAGE", "BRAND_NAME", "BRAND_LOGO_URL", "BRAND_PRIMARY_COLOR", "LOG_LEVEL"}
+
+// liveSettings are the settings that can change without a restart, on
+// SIGHUP or POST /debug/reload. They are replaced as a whole, never in part,
+// and read through currentBrand and currentSales.
+type liveSettings struct {
+	brand    brandSettings
+	sales    sales
+	logLevel logrus.Level
+	// logLevelInFile is set when SETTINGS_FILE has LOG_LEVEL; otherwise
+	// reloads leave the level alone.
+	logLevelInFile bool
+}
+
+// settingsFile holds the variables of SETTINGS_FILE, which override those of
+// the environment.
+type settingsFile map[string]string
+
+// readSettingsFile reads SETTINGS_FILE, a YAML or JSON object of reloadable
+// variables such as {"BANNER_MESSAGE": "Winter sale!", "LOG_LEVEL": "debug"}.
+// Without a path it returns nil, leaving every variable to the environment.
+func readSettingsFile(path string) (settingsFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read settings")
+	}
+	var f settingsFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, errors.Wrapf(err, "could not parse settings in %s", path)
+	}
+	for k := range f {
+		if !slices.Contains(reloadableVars, k) {
+			return nil, errors.Errorf("settings in %s: %s cannot be set, only %s", path, k, strings.Join(reloadableVars, ", "))
+		}
+	}
+	return f, nil
+}
+
+// getenv returns the variable key of f, or of the environment if f does not
+// set it.
+func (f settingsFile) getenv(key string) string {
+	if v, ok := f[key]; ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// settings holds the current liveSettings; main sets the first from the
+// startup configuration.
+var settings atomic.Pointer[liveSettings]
+
+// reloadMu serializes reloads, so that the flags and the settings applied
+// last come from the same one.
+var reloadMu sync.Mutex
+
+func currentSettings() *liveSettings {
+	if s := settings.Load(); s != nil {
+		return s
+	}
+	return &liveSettings{logLevel: defaultLogLevel}
+}
+
+// currentBrand returns the branding of the shop.
+func currentBrand() brandSettings { return currentSettings().brand }
+
+// currentSales returns the sales of products.
+func currentSales() sales { return currentSettings().sales }
+
+// logLevelFromEnv reads LOG_LEVEL, a logrus level such as debug, with getenv.
+func logLevelFromEnv(l *envLoader, getenv func(string) string) logrus.Level {
+	v := getenv("LOG_LEVEL")
+	if v == "" {
+		return defaultLogLevel
+	}
+	level, err := logrus.ParseLevel(v)
+	if err != nil {
+		l.problem("LOG_LEVEL: invalid log level %q", v)
+		return defaultLogLevel
+	}
+	return level
+}
+
+// loadLiveSettings reads the live settings from their files: SETTINGS_FILE
+// for the banner, the other BRAND_* variables and LOG_LEVEL, SALE_CONFIG,
+// and FEATURE_FLAGS_FILE, whose flags are returned apart (nil without a
+// file) as the flag store keeps them. The error is a configError listing
+// every problem.
+func loadLiveSettings() (*liveSettings, *featureflags.File, error) {
+	var l envLoader
+	file, err := readSettingsFile(os.Getenv("SETTINGS_FILE"))
+	l.check(err)
+	_, inFile := file["LOG_LEVEL"]
+	s := &liveSettings{
+		brand:          brandFromEnv(&l, file.getenv),
+		logLevel:       logLevelFromEnv(&l, file.getenv),
+		logLevelInFile: inFile,
+	}
+	if path := os.Getenv("SALE_CONFIG"); path != "" {
+		s.sales, err = loadSales(path)
+		l.check(err)
+	}
+	var flags *featureflags.File
+	if path := os.Getenv("FEATURE_FLAGS_FILE"); path != "" {
+		flags, err = featureflags.ReadFile(path)
+		l.check(err)
+	}
+	if err := l.err(); err != nil {
+		return nil, nil, err
+	}
+	return s, flags, nil
+}
+
+// reloadSettings reads the live settings again and, if every one of them is
+// valid, applies them along with the feature flags and log level of log.
+// Otherwise nothing changes and the error lists the problems. The level is
+// only set when SETTINGS_FILE changed it, so that reloads keep one set with
+// PUT /debug/loglevel.
+func (fe *frontendServer) reloadSettings(log *logrus.Logger) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	s, flags, err := loadLiveSettings()
+	if err != nil {
+		return err
+	}
+	prev := currentSettings()
+	settings.Store(s)
+	if flags != nil {
+		fe.flags.Apply(flags)
+	}
+	if s.logLevelInFile && (!prev.logLevelInFile || s.logLevel != prev.logLevel) {
+		if level := log.GetLevel(); level != prev.logLevel && level != s.logLevel {
+			log.WithFields(logrus.Fields{"log.level": level.String(), "log.level.new": s.logLevel.String()}).
+				Warn("reloaded settings override the log level set at runtime")
+		}
+		log.SetLevel(s.logLevel)
+	}
+	return nil
+}
+
+// reloadOnSignal reloads the live settings on every signal received on ch.
+func (fe *frontendServer) reloadOnSignal(log *logrus.Logger, ch <-chan os.Signal) {
+	for range ch {
+		fe.reload(log)
+	}
+}
+
+// reload reloads the live settings and logs the outcome.
+func (fe *frontendServer) reload(log *logrus.Logger) error {
+	if err := fe.reloadSettings(log); err != nil {
+		log.WithField("error", err).Error("failed to reload settings, keeping the current ones")
+		return err
+	}
+	s := currentSettings()
+	log.WithFields(logrus.Fields{
+		"sales":     len(s.sales),
+		"flags":     len(fe.flags.Flags()),
+		"log.level": log.GetLevel().String(),
+	}).Info("reloaded settings")
+	return nil
+}
+
+// reloadHandler serves POST /debug/reload on the admin port, as SIGHUP does.
+// Invalid settings are answered with 422 Unprocessable Entity, listing the
+// problems.
+func (fe *frontendServer) reloadHandler(log *logrus.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(log, w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed", Code: http.StatusMethodNotAllowed})
+			return
+		}
+		log.WithField("client_ip", clientIP(r)).Warn("settings reload requested")
+		if err := fe.reload(log); err != nil {
+			writeJSON(log, w, http.StatusUnprocessableEntity, apiError{Error: err.Error(), Code: http.StatusUnprocessableEntity})
+			return
+		}
+		writeJSON(log, w, http.StatusOK, map[string]string{"status": "reloaded"})
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// withSettings changes a copy of the live settings with set, for the
+// duration of the test.
+func withSettings(t *testing.T, set func(*liveSettings)) {
+	t.Helper()
+	old := settings.Load()
+	s := *currentSettings()
+	set(&s)
+	settings.Store(&s)
+	t.Cleanup(func() { settings.Store(old) })
+}
+
+// reloadFiles writes the settings, sale config and flags files of a reload
+// to the files SETTINGS_FILE, SALE_CONFIG and FEATURE_FLAGS_FILE name, the
+// same ones for the whole test, as mounted files would be.
+type reloadFiles struct {
+	t   *testing.T
+	dir string
+}
+
+func newReloadFiles(t *testing.T) reloadFiles {
+	f := reloadFiles{t: t, dir: t.TempDir()}
+	t.Setenv("SETTINGS_FILE", filepath.Join(f.dir, "settings.yaml"))
+	t.Setenv("SALE_CONFIG", filepath.Join(f.dir, "sales.json"))
+	t.Setenv("FEATURE_FLAGS_FILE", filepath.Join(f.dir, "flags.json"))
+	return f
+}
+
+func (f reloadFiles) write(settings, sales, flags string) {
+	f.t.Helper()
+	for name, src := range map[string]string{"settings.yaml": settings, "sales.json": sales, "flags.json": flags} {
+		if err := os.WriteFile(filepath.Join(f.dir, name), []byte(src), 0o644); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+func TestReloadSettings(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	withSettings(t, func(s *liveSettings) {
+		*s = liveSettings{brand: brandSettings{bannerMessage: "Old news"}, logLevel: logrus.InfoLevel}
+	})
+	log, _ := logtest.NewNullLogger()
+	log.SetLevel(logrus.InfoLevel)
+	files := newReloadFiles(t)
+
+	files.write("BANNER_MESSAGE: Winter sale!\nLOG_LEVEL: debug\n", `{"OLJCESPC7Z": {"percent": 20}}`, `{"ads": false}`)
+	if err := fe.reloadSettings(log); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentBrand().bannerMessage; got != "Winter sale!" {
+		t.Errorf("banner %q after reload", got)
+	}
+	if _, ok := fe.activeSale("OLJCESPC7Z", time.Now()); !ok {
+		t.Error("sale not loaded")
+	}
+	if fe.flags.Flags()[featureAds].Enabled {
+		t.Error("ads flag not reloaded")
+	}
+	if log.GetLevel() != logrus.DebugLevel {
+		t.Errorf("log level %v after reload", log.GetLevel())
+	}
+
+	// A reload with any invalid setting changes nothing, not even the valid
+	// ones.
+	for name, setup := range map[string]func(){
+		"sale config": func() {
+			files.write("BANNER_MESSAGE: Spring sale!\nLOG_LEVEL: warn\n", `{"OLJCESPC7Z": {"percent": 120}}`, `{"ads": true}`)
+		},
+		"flags": func() { files.write("BANNER_MESSAGE: Spring sale!\nLOG_LEVEL: warn\n", `{}`, `{"ads": "yes"}`) },
+		"log level": func() {
+			files.write("BANNER_MESSAGE: Spring sale!\nLOG_LEVEL: loud\n", `{}`, `{"ads": true}`)
+		},
+		"settings": func() { files.write("BANNER_MESSAGE: Spring sale!\nPORT: 9090\n", `{}`, `{"ads": true}`) },
+	} {
+		setup()
+		if err := fe.reloadSettings(log); err == nil {
+			t.Errorf("%s: invalid settings reloaded", name)
+		}
+		if got := currentBrand().bannerMessage; got != "Winter sale!" {
+			t.Errorf("%s: banner %q after a failed reload", name, got)
+		}
+		if _, ok := fe.activeSale("OLJCESPC7Z", time.Now()); !ok {
+			t.Errorf("%s: sale dropped by a failed reload", name)
+		}
+		if fe.flags.Flags()[featureAds].Enabled {
+			t.Errorf("%s: flags changed by a failed reload", name)
+		}
+		if log.GetLevel() != logrus.DebugLevel {
+			t.Errorf("%s: log level %v after a failed reload", name, log.GetLevel())
+		}
+	}
+}
+
+func TestReloadKeepsRuntimeLogLevel(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	withSettings(t, func(s *liveSettings) { *s = liveSettings{logLevel: logrus.InfoLevel} })
+	log, hook := logtest.NewNullLogger()
+	log.SetLevel(logrus.InfoLevel)
+	files := newReloadFiles(t)
+
+	// Without LOG_LEVEL in the file, the level set at runtime stays.
+	files.write("BANNER_MESSAGE: Winter sale!\n", `{}`, `{}`)
+	log.SetLevel(logrus.DebugLevel)
+	if err := fe.reloadSettings(log); err != nil {
+		t.Fatal(err)
+	}
+	if log.GetLevel() != logrus.DebugLevel {
+		t.Errorf("log level %v, want the runtime one kept", log.GetLevel())
+	}
+
+	// Nor does a reload of an unchanged LOG_LEVEL undo it.
+	files.write("LOG_LEVEL: warn\n", `{}`, `{}`)
+	if err := fe.reloadSettings(log); err != nil {
+		t.Fatal(err)
+	}
+	log.SetLevel(logrus.DebugLevel)
+	hook.Reset()
+	if err := fe.reloadSettings(log); err != nil {
+		t.Fatal(err)
+	}
+	if log.GetLevel() != logrus.DebugLevel {
+		t.Errorf("log level %v, want the runtime one kept", log.GetLevel())
+	}
+
+	// A new level in the file wins, and says so.
+	files.write("LOG_LEVEL: error\n", `{}`, `{}`)
+	if err := fe.reloadSettings(log); err != nil {
+		t.Fatal(err)
+	}
+	if log.GetLevel() != logrus.ErrorLevel {
+		t.Errorf("log level %v, want the one of the file", log.GetLevel())
+	}
+	if e := hook.LastEntry(); e == nil || !strings.Contains(e.Message, "override the log level") {
+		t.Errorf("override not logged: %v", hook.AllEntries())
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	withSettings(t, func(s *liveSettings) {})
+	log, _ := logtest.NewNullLogger()
+	h := fe.reloadHandler(log)
+	files := newReloadFiles(t)
+
+	files.write(`{"BANNER_MESSAGE": "Reloaded"}`, `{}`, `{}`)
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/debug/reload", nil))
+	if w.Code != http.StatusOK || currentBrand().bannerMessage != "Reloaded" {
+		t.Errorf("POST: status %d, banner %q", w.Code, currentBrand().bannerMessage)
+	}
+
+	files.write(`{"BANNER_MESSAGE": "Reloaded"}`, `not json`, `{}`)
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/debug/reload", nil))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "sales.json") {
+		t.Errorf("invalid settings: status %d, body %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/debug/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestSettingsFileAtStartup(t *testing.T) {
+	files := newReloadFiles(t)
+	files.write("BANNER_MESSAGE: From the file\nLOG_LEVEL: warn\n", `{}`, `{}`)
+	t.Setenv("BANNER_MESSAGE", "From the environment")
+	t.Setenv("BRAND_NAME", "Acme")
+	cfg := loadTestConfig(t)
+	if cfg.brand.bannerMessage != "From the file" || cfg.brand.name != "Acme" || cfg.logLevel != logrus.WarnLevel || !cfg.logLevelInFile {
+		t.Errorf("brand %+v, log level %v (in file %v)", cfg.brand, cfg.logLevel, cfg.logLevelInFile)
+	}
+}
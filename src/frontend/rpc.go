@@ -27,28 +27,47 @@ const (
 	avoidNoopCurrencyConversionRPC = false
 )
 
+// getCurrencies returns the currencies users can choose from. The list is
+// refreshed in the background; it is only fetched on demand until the first
+// successful load.
 func (fe *frontendServer) getCurrencies(ctx context.Context) ([]string, error) {
-	currs, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
-		GetSupportedCurrencies(ctx, &pb.Empty{})
-	if err != nil {
-		return nil, err
+	if codes, set := fe.currencies.get(); set != nil {
+		return codes, nil
 	}
-	var out []string
-	for _, c := range currs.CurrencyCodes {
-		if _, ok := whitelistedCurrencies[c]; ok {
-			out = append(out, c)
-		}
-	}
-	return out, nil
+	return fe.refreshCurrencies(ctx)
 }
 
-func (fe *frontendServer) getProducts(ctx context.Context) ([]*pb.Product, error) {
+func (fe *frontendServer) searchProducts(ctx context.Context, query string) ([]*pb.Product, error) {
 	resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
-		ListProducts(ctx, &pb.Empty{})
-	return resp.GetProducts(), err
+		SearchProducts(ctx, &pb.SearchProductsRequest{Query: query})
+	return resp.GetResults(), err
+}
+
+// getProducts lists the catalog, and refreshes the categories of the
+// navigation with what it finds.
+func (fe *frontendServer) getProducts(ctx context.Context) ([]*pb.Product, error) {
+	var (
+		products []*pb.Product
+		err      error
+	)
+	if fe.catalog != nil {
+		products, err = fe.catalog.listProducts(ctx)
+	} else {
+		var resp *pb.ListProductsResponse
+		resp, err = pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
+			ListProducts(ctx, &pb.Empty{})
+		products = resp.GetProducts()
+	}
+	if err == nil {
+		setNavCategories(products)
+	}
+	return products, err
 }
 
 func (fe *frontendServer) getProduct(ctx context.Context, id string) (*pb.Product, error) {
+	if fe.catalog != nil {
+		return fe.catalog.product(ctx, id)
+	}
 	resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
 		GetProduct(ctx, &pb.GetProductRequest{Id: id})
 	return resp, err
@@ -74,20 +93,41 @@ func (fe *frontendServer) insertCart(ctx context.Context, userID, productID stri
 	return err
 }
 
-func (fe *frontendServer) convertCurrency(ctx context.Context, money *pb.Money, currency string) (*pb.Money, error) {
-	if avoidNoopCurrencyConversionRPC && money.GetCurrencyCode() == currency {
-		return money, nil
+// replaceCart overwrites the user's cart with items. The cart service cannot
+// remove or update a single line, so the cart is emptied and rebuilt.
+func (fe *frontendServer) replaceCart(ctx context.Context, userID string, items []*pb.CartItem) error {
+	if err := fe.emptyCart(ctx, userID); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := fe.insertCart(ctx, userID, item.GetProductId(), item.GetQuantity()); err != nil {
+			return errors.Wrapf(err, "failed to restore cart item %s", item.GetProductId())
+		}
+	}
+	return nil
+}
+
+func (fe *frontendServer) convertCurrency(ctx context.Context, amount *pb.Money, currency string) (*pb.Money, error) {
+	if avoidNoopCurrencyConversionRPC && amount.GetCurrencyCode() == currency {
+		return amount, nil
+	}
+	if fe.currencyRates != nil {
+		converted, err := fe.currencyRates.Convert(ctx, *amount, currency)
+		if err != nil {
+			return nil, err
+		}
+		return &converted, nil
 	}
 	return pb.NewCurrencyServiceClient(fe.currencySvcConn).
 		Convert(ctx, &pb.CurrencyConversionRequest{
-			From:   money,
+			From:   amount,
 			ToCode: currency})
 }
 
-func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.CartItem, currency string) (*pb.Money, error) {
+func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.CartItem, addr *pb.Address, currency string) (*pb.Money, error) {
 	quote, err := pb.NewShippingServiceClient(fe.shippingSvcConn).GetQuote(ctx,
 		&pb.GetQuoteRequest{
-			Address: nil,
+			Address: addr,
 			Items:   items})
 	if err != nil {
 		return nil, err
@@ -96,27 +136,68 @@ func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.Cart
 	return localized, errors.Wrap(err, "failed to convert currency for shipping cost")
 }
 
+// maxRecommendations is the number of recommended products that fit the UI.
+const maxRecommendations = 4
+
+// getRecommendations returns products to suggest alongside productIDs, which
+// are never suggested themselves: callers pass the products on the page and
+// those already in the cart. If the recommendation service comes up short,
+// the list is topped up from the catalog. Crawlers get no recommendations.
 func (fe *frontendServer) getRecommendations(ctx context.Context, userID string, productIDs []string) ([]*pb.Product, error) {
+	if isBot(ctx) {
+		return nil, nil
+	}
 	resp, err := pb.NewRecommendationServiceClient(fe.recommendationSvcConn).ListRecommendations(ctx,
 		&pb.ListRecommendationsRequest{UserId: userID, ProductIds: productIDs})
 	if err != nil {
 		return nil, err
 	}
-	out := make([]*pb.Product, len(resp.GetProductIds()))
-	for i, v := range resp.GetProductIds() {
+
+	// The service is asked to leave these out, but does not always do so.
+	skip := make(map[string]bool, len(productIDs)+maxRecommendations)
+	for _, id := range productIDs {
+		skip[id] = true
+	}
+	var out []*pb.Product
+	for _, v := range resp.GetProductIds() {
+		if len(out) == maxRecommendations {
+			break
+		}
+		if skip[v] {
+			continue
+		}
 		p, err := fe.getProduct(ctx, v)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to get recommended product info (#%s)", v)
 		}
-		out[i] = p
+		skip[v] = true
+		out = append(out, p)
 	}
-	if len(out) > 4 {
-		out = out[:4] // take only first four to fit the UI
+	if len(out) == maxRecommendations {
+		return out, nil
 	}
-	return out, err
+
+	catalog, err := fe.getProducts(ctx)
+	if err != nil {
+		loggerFromContext(ctx).WithField("error", err).Warn("failed to backfill recommendations from the catalog")
+		return out, nil
+	}
+	for _, p := range catalog {
+		if len(out) == maxRecommendations {
+			break
+		}
+		if !skip[p.GetId()] {
+			skip[p.GetId()] = true
+			out = append(out, p)
+		}
+	}
+	return out, nil
 }
 
 func (fe *frontendServer) getAd(ctx context.Context, ctxKeys []string) ([]*pb.Ad, error) {
+	if !fe.adsEnabled() {
+		return nil, nil
+	}
 	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
 	defer cancel()
 
@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// sale takes percent off the price of a product from starts until ends. The
+// catalog knows nothing of sales: the frontend shows the sale price, with the
+// catalog price struck through, and charges it in the totals it shows.
+type sale struct {
+	percent float64
+	starts  time.Time // zero if the sale has started already
+	ends    time.Time // zero if the sale runs until removed
+}
+
+func (s sale) activeAt(now time.Time) bool {
+	return !now.Before(s.starts) && (s.ends.IsZero() || now.Before(s.ends))
+}
+
+// price returns m with the sale off, rounded to the currency's minor unit.
+func (s sale) price(m pb.Money) pb.Money {
+	return money.Round(money.Convert(m, money.Percent(100-s.percent), m.GetCurrencyCode()))
+}
+
+// sales are the sales of products, by product ID. They are parsed at startup
+// and on reloads; whether each is on is decided as prices are shown, so sales
+// start and end without a restart.
+type sales map[string]sale
+
+// loadSales reads sales from SALE_CONFIG, a JSON file mapping product IDs
+// to the percent off and, optionally, the dates the sale runs from and
+// through, or RFC 3339 times, e.g.
+// {"OLJCESPC7Z": {"percent": 20, "starts": "2026-11-27", "ends": "2026-11-30"}}.
+func loadSales(path string) (sales, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read sales")
+	}
+	var fields map[string]struct {
+		Percent float64 `json:"percent"`
+		Starts  string  `json:"starts"`
+		Ends    string  `json:"ends"`
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, errors.Wrapf(err, "could not parse sales in %s", path)
+	}
+	out := make(sales, len(fields))
+	for id, f := range fields {
+		s := sale{percent: f.Percent}
+		if f.Percent <= 0 || f.Percent >= 100 {
+			return nil, errors.Errorf("sale of product %s: percent %v is not between 0 and 100", id, f.Percent)
+		}
+		if f.Starts != "" {
+			if s.starts, err = parseSaleStart(f.Starts); err != nil {
+				return nil, errors.Errorf("sale of product %s: invalid start %q", id, f.Starts)
+			}
+		}
+		if f.Ends != "" {
+			if s.ends, err = parsePromoExpiry(f.Ends); err != nil {
+				return nil, errors.Errorf("sale of product %s: invalid end %q", id, f.Ends)
+			}
+			if !s.ends.After(s.starts) {
+				return nil, errors.Errorf("sale of product %s ends before it starts", id)
+			}
+		}
+		out[id] = s
+	}
+	return out, nil
+}
+
+// parseSaleStart returns the time a sale starts at: the start of the day, in
+// UTC, for a date.
+func parseSaleStart(s string) (time.Time, error) {
+	if d, err := time.Parse(time.DateOnly, s); err == nil {
+		return d, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// activeSale returns the sale product id is on at now, if any.
+func (fe *frontendServer) activeSale(id string, now time.Time) (sale, bool) {
+	s, ok := currentSales()[id]
+	if !ok || !s.activeAt(now) {
+		return sale{}, false
+	}
+	return s, true
+}
+
+// productPrice returns the price of p in currency, with any sale off. When p
+// is on sale, compareAt is its price before the sale; it is nil otherwise.
+func (fe *frontendServer) productPrice(ctx context.Context, p *pb.Product, currency string) (price, compareAt *pb.Money, err error) {
+	price, err = fe.convertCurrency(ctx, p.GetPriceUsd(), currency)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s, ok := fe.activeSale(p.GetId(), time.Now()); ok {
+		sp := s.price(*price)
+		return &sp, price, nil
+	}
+	return price, nil, nil
+}
+
+// applySales replaces the costs the checkout service charged for the items
+// of order with their sale prices, so that the receipt matches the cart.
+func (fe *frontendServer) applySales(r *http.Request, order *pb.OrderResult) {
+	now := time.Now()
+	for _, it := range order.GetItems() {
+		s, ok := fe.activeSale(it.GetItem().GetProductId(), now)
+		if !ok {
+			continue
+		}
+		cost := s.price(*it.GetCost())
+		loggerFromContext(r.Context()).WithField("order", order.GetOrderId()).
+			WithField("product", it.GetItem().GetProductId()).WithField("sale.percent", s.percent).
+			Debug("sale price applied to order")
+		it.Cost = &cost
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// salesFrom writes src to a sale config file and loads it.
+func salesFrom(t *testing.T, src string) (sales, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sales.json")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return loadSales(path)
+}
+
+func TestSaleDates(t *testing.T) {
+	s, err := salesFrom(t, `{"OLJCESPC7Z": {"percent": 20, "starts": "2026-11-27", "ends": "2026-11-30"},
+		"66VCHSJNUP": {"percent": 10, "ends": "2026-06-01T12:00:00Z"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		id   string
+		at   string
+		want bool
+	}{
+		{"OLJCESPC7Z", "2026-11-26T23:59:59Z", false},
+		{"OLJCESPC7Z", "2026-11-27T00:00:00Z", true},
+		{"OLJCESPC7Z", "2026-11-30T23:59:59Z", true},
+		{"OLJCESPC7Z", "2026-12-01T00:00:00Z", false},
+		{"66VCHSJNUP", "2020-01-01T00:00:00Z", true},
+		{"66VCHSJNUP", "2026-06-01T11:59:59Z", true},
+		{"66VCHSJNUP", "2026-06-01T12:00:00Z", false},
+	} {
+		at, _ := time.Parse(time.RFC3339, tc.at)
+		if got := s[tc.id].activeAt(at); got != tc.want {
+			t.Errorf("%s at %s: on sale %v, want %v", tc.id, tc.at, got, tc.want)
+		}
+	}
+
+	for _, src := range []string{
+		`{"OLJCESPC7Z": {"percent": 0}}`,
+		`{"OLJCESPC7Z": {"percent": 100}}`,
+		`{"OLJCESPC7Z": {"percent": 20, "starts": "soon"}}`,
+		`{"OLJCESPC7Z": {"percent": 20, "starts": "2026-11-27", "ends": "2026-11-26"}}`,
+		`["OLJCESPC7Z"]`,
+	} {
+		if _, err := salesFrom(t, src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+}
+
+func TestSalePrice(t *testing.T) {
+	for _, tc := range []struct {
+		percent float64
+		price   pb.Money
+		want    pb.Money
+	}{
+		{20, pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}, pb.Money{CurrencyCode: "USD", Units: 15, Nanos: 990000000}},
+		{15, pb.Money{CurrencyCode: "JPY", Units: 2230}, pb.Money{CurrencyCode: "JPY", Units: 1896}},
+		{25, pb.Money{CurrencyCode: "JPY", Units: 1999}, pb.Money{CurrencyCode: "JPY", Units: 1499}},
+	} {
+		got := sale{percent: tc.percent}.price(tc.price)
+		if got.GetCurrencyCode() != tc.want.GetCurrencyCode() || got.GetUnits() != tc.want.GetUnits() || got.GetNanos() != tc.want.GetNanos() {
+			t.Errorf("%v%% off %v = %v, want %v", tc.percent, tc.price, got, tc.want)
+		}
+	}
+}
+
+func TestSaleShownAndCharged(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}, {ProductId: "66VCHSJNUP", Quantity: 1}}
+	fe := newTestFrontend(t, fb)
+	withSettings(t, func(s *liveSettings) {
+		s.sales = sales{
+			"OLJCESPC7Z": {percent: 20, starts: time.Now().Add(-time.Hour), ends: time.Now().Add(time.Hour)},
+			"66VCHSJNUP": {percent: 50, ends: time.Now().Add(-time.Second)},
+		}
+	})
+
+	w := httptest.NewRecorder()
+	fe.productHandler(w, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"}))
+	if body := w.Body.String(); !strings.Contains(body, "$15.99") || !strings.Contains(body, "Was $19.99") {
+		t.Errorf("product page lacks the sale price: status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	fe.apiProductsHandler(w, newTestRequest(http.MethodGet, "/api/products", nil))
+	var got apiProducts
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range got.Products {
+		switch p.ID {
+		case "OLJCESPC7Z":
+			if p.Price.Formatted != "$15.99" || p.CompareAtPrice == nil || p.CompareAtPrice.Formatted != "$19.99" {
+				t.Errorf("sunglasses = %+v", p)
+			}
+		case "66VCHSJNUP":
+			if p.Price.Formatted != "$18.99" || p.CompareAtPrice != nil {
+				t.Errorf("tank top after its sale = %+v", p)
+			}
+		}
+	}
+
+	w = httptest.NewRecorder()
+	fe.apiCartHandler(w, newTestRequest(http.MethodGet, "/api/cart", nil))
+	var cart apiCart
+	if err := json.Unmarshal(w.Body.Bytes(), &cart); err != nil || cart.Subtotal.Formatted != "$50.97" {
+		t.Errorf("cart subtotal = %+v, %v, want $50.97", cart.Subtotal, err)
+	}
+
+	// Two sunglasses at $15.99, a tank top at $18.99 and $8.99 of shipping.
+	if w := placeTestOrder(t, fe); w.Code != http.StatusOK {
+		t.Fatalf("checkout: status %d", w.Code)
+	}
+	rc, ok := fe.receipts.get("test-session", "order-test-session")
+	if !ok {
+		t.Fatal("no receipt")
+	}
+	if rc.Items[0].UnitCost.Formatted != "$15.99" || rc.Total.Formatted != "$59.96" {
+		t.Errorf("receipt = %+v", rc)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// defaultContentSecurityPolicy allows what the templates load: our own static
+// assets and product images, Bootstrap from its CDN and Google Fonts. The
+// templates use inline scripts and event handlers, hence 'unsafe-inline';
+// images uploaded to the assistant are previewed from data: URLs.
+const defaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://stackpath.bootstrapcdn.com; " +
+	"style-src 'self' 'unsafe-inline' https://stackpath.bootstrapcdn.com https://fonts.googleapis.com; " +
+	"font-src 'self' https://fonts.gstatic.com; " +
+	"img-src 'self' data:; " +
+	"connect-src 'self'; " +
+	"object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+
+// securityHeader is a response header set on every page, read from
+// SECURITY_HEADER_<NAME> with "off" disabling it.
+type securityHeader struct {
+	name, env, value string
+}
+
+var defaultSecurityHeaders = []securityHeader{
+	{"Content-Security-Policy", "SECURITY_HEADER_CSP", defaultContentSecurityPolicy},
+	{"X-Content-Type-Options", "SECURITY_HEADER_CONTENT_TYPE_OPTIONS", "nosniff"},
+	{"X-Frame-Options", "SECURITY_HEADER_FRAME_OPTIONS", "DENY"},
+	{"Referrer-Policy", "SECURITY_HEADER_REFERRER_POLICY", "strict-origin-when-cross-origin"},
+}
+
+const defaultHSTS = "max-age=31536000"
+
+// securityHeaders holds the configured headers. HSTS is only sent over
+// HTTPS, since browsers ignore it on plain HTTP anyway.
+type securityHeaders struct {
+	headers    [][2]string
+	hsts       string
+	tlsEnabled bool
+	trusted    []netip.Prefix
+}
+
+// securityHeadersFromEnv reads the SECURITY_HEADER_* overrides, and
+// TLS_ENABLED, which marks every request as HTTPS because TLS is terminated
+// in front of the frontend. Otherwise a request is HTTPS if a trusted proxy
+// says so in X-Forwarded-Proto.
+func securityHeadersFromEnv(trusted []netip.Prefix) securityHeaders {
+	s := securityHeaders{tlsEnabled: os.Getenv("TLS_ENABLED") == "true", trusted: trusted}
+	for _, h := range defaultSecurityHeaders {
+		def := h.value
+		if h.name == "Content-Security-Policy" {
+			def = allowAssetOrigin(def, assetOrigin(staticAssetPrefix))
+		}
+		if v := headerFromEnv(h.env, def); v != "" {
+			s.headers = append(s.headers, [2]string{h.name, v})
+		}
+	}
+	s.hsts = headerFromEnv("SECURITY_HEADER_HSTS", defaultHSTS)
+	return s
+}
+
+// assetDirectives are the directives of the Content-Security-Policy that
+// cover what the pages load from STATIC_ASSET_PREFIX.
+var assetDirectives = []string{"script-src", "style-src", "font-src", "img-src"}
+
+// allowAssetOrigin adds origin, where the static assets are served from, to
+// the sources of the asset directives of policy. An empty origin, for assets
+// served by the shop itself, leaves policy as it is.
+func allowAssetOrigin(policy, origin string) string {
+	if origin == "" {
+		return policy
+	}
+	directives := strings.Split(policy, "; ")
+	for i, d := range directives {
+		name, sources, _ := strings.Cut(d, " ")
+		if slices.Contains(assetDirectives, name) {
+			directives[i] = name + " " + origin + " " + sources
+		}
+	}
+	return strings.Join(directives, "; ")
+}
+
+// headerFromEnv returns the value of envKey, def if it is unset, or "" if it
+// is "off".
+func headerFromEnv(envKey, def string) string {
+	switch v := os.Getenv(envKey); {
+	case v == "":
+		return def
+	case strings.EqualFold(v, "off"):
+		return ""
+	default:
+		return v
+	}
+}
+
+// isHTTPS reports whether the client reached us over HTTPS.
+func (s securityHeaders) isHTTPS(r *http.Request) bool {
+	if s.tlsEnabled || r.TLS != nil {
+		return true
+	}
+	a, ok := parseIP(remoteIP(r))
+	if !ok || !isTrustedProxy(a, s.trusted) {
+		return false
+	}
+	// The proxy nearest to us appends last.
+	protos := strings.Split(strings.Join(r.Header.Values("X-Forwarded-Proto"), ","), ",")
+	return strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+}
+
+// middleware sets the security headers on responses, except those of the
+// health checks, which only load balancers read.
+func (s securityHeaders) middleware(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != baseUrl+"/_healthz" && r.URL.Path != baseUrl+"/_readyz" {
+			h := w.Header()
+			for _, kv := range s.headers {
+				h.Set(kv[0], kv[1])
+			}
+			if s.hsts != "" && s.isHTTPS(r) {
+				h.Set("Strict-Transport-Security", s.hsts)
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
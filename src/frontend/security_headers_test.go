@@ -0,0 +1,99 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveSecurityHeaders(s securityHeaders, r *http.Request) http.Header {
+	w := httptest.NewRecorder()
+	s.middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(w, r)
+	return w.Header()
+}
+
+func TestSecurityHeadersDefaults(t *testing.T) {
+	h := serveSecurityHeaders(securityHeadersFromEnv(nil), httptest.NewRequest(http.MethodGet, "/", nil))
+	for name, want := range map[string]string{
+		"Content-Security-Policy": defaultContentSecurityPolicy,
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         "strict-origin-when-cross-origin",
+	} {
+		if got := h.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if got := h.Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("HSTS sent over plain HTTP: %q", got)
+	}
+
+	h = serveSecurityHeaders(securityHeadersFromEnv(nil), httptest.NewRequest(http.MethodGet, "/_healthz", nil))
+	if len(h) != 0 {
+		t.Errorf("health check got headers %v", h)
+	}
+}
+
+func TestSecurityHeadersOverrides(t *testing.T) {
+	t.Setenv("SECURITY_HEADER_CSP", "default-src 'none'")
+	t.Setenv("SECURITY_HEADER_FRAME_OPTIONS", "off")
+	h := serveSecurityHeaders(securityHeadersFromEnv(nil), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := h.Get("Content-Security-Policy"); got != "default-src 'none'" {
+		t.Errorf("Content-Security-Policy = %q", got)
+	}
+	if _, ok := h["X-Frame-Options"]; ok {
+		t.Error("disabled X-Frame-Options still sent")
+	}
+	if got := h.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q", got)
+	}
+}
+
+func TestSecurityHeadersHSTS(t *testing.T) {
+	trusted := parseTrustedProxies(discardLog, "10.0.0.0/8")
+	request := func(remote, proto string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote
+		if proto != "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+		return r
+	}
+	s := securityHeadersFromEnv(trusted)
+	for _, tc := range []struct {
+		name, remote, proto string
+		want                bool
+	}{
+		{"trusted proxy over https", "10.1.2.3:1234", "https", true},
+		{"proxy chain", "10.1.2.3:1234", "http, https", true},
+		{"trusted proxy over http", "10.1.2.3:1234", "http", false},
+		{"spoofed proto", "203.0.113.7:1234", "https", false},
+	} {
+		if got := serveSecurityHeaders(s, request(tc.remote, tc.proto)).Get("Strict-Transport-Security") != ""; got != tc.want {
+			t.Errorf("%s: HSTS sent = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	t.Setenv("TLS_ENABLED", "true")
+	if got := serveSecurityHeaders(securityHeadersFromEnv(nil), request("203.0.113.7:1234", "")).Get("Strict-Transport-Security"); got != defaultHSTS {
+		t.Errorf("TLS_ENABLED: Strict-Transport-Security = %q, want %q", got, defaultHSTS)
+	}
+	t.Setenv("SECURITY_HEADER_HSTS", "off")
+	if got := serveSecurityHeaders(securityHeadersFromEnv(nil), request("203.0.113.7:1234", "")).Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("disabled HSTS still sent: %q", got)
+	}
+}
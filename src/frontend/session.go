@@ -0,0 +1,164 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// cookieSigner authenticates cookie values with HMAC-SHA256 so that clients
+// cannot forge them, e.g. to pick another user's session ID. The first key
+// signs; all keys verify, which allows secrets to be rotated without logging
+// everybody out.
+type cookieSigner struct {
+	keys [][]byte
+}
+
+// newCookieSigner builds a signer from a comma-separated list of secrets, as
+// found in SESSION_SECRET. It returns nil when no secret is configured, in
+// which case cookies are neither signed nor verified.
+func newCookieSigner(secrets string) *cookieSigner {
+	keys := sessionSecrets(secrets)
+	if len(keys) == 0 {
+		return nil
+	}
+	return &cookieSigner{keys: keys}
+}
+
+// sessionSecrets splits the comma-separated secrets of SESSION_SECRET.
+func sessionSecrets(secrets string) [][]byte {
+	var keys [][]byte
+	for _, s := range strings.Split(secrets, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			keys = append(keys, []byte(s))
+		}
+	}
+	return keys
+}
+
+// sign returns value with a signature appended as "<value>.<sig>". The cookie
+// name is part of the signed message so a value cannot be replayed under a
+// different cookie.
+func (s *cookieSigner) sign(name, value string) string {
+	if s == nil {
+		return value
+	}
+	return value + "." + s.mac(s.keys[0], name, value)
+}
+
+// verify checks raw as produced by sign and returns the original value.
+func (s *cookieSigner) verify(name, raw string) (string, bool) {
+	if s == nil {
+		return raw, true
+	}
+	i := strings.LastIndexByte(raw, '.')
+	if i < 0 {
+		return "", false
+	}
+	value, sig := raw[:i], raw[i+1:]
+	for _, k := range s.keys {
+		if hmac.Equal([]byte(sig), []byte(s.mac(k, name, value))) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func (s *cookieSigner) mac(key []byte, name, value string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(name))
+	h.Write([]byte{'='})
+	h.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// cookieSealer encrypts cookie values with AES-256-GCM, for cookies that,
+// unlike a session ID, hold details the client's browser should not expose to
+// whoever reads its cookies. As with cookieSigner, the first key seals and all
+// keys open.
+type cookieSealer struct {
+	aeads []cipher.AEAD
+}
+
+// newCookieSealer builds a sealer from the secrets of SESSION_SECRET, deriving
+// keys distinct from those signing cookies. Without a secret, it uses a random
+// key, so that sealed cookies only last as long as the process.
+func newCookieSealer(secrets string) *cookieSealer {
+	keys := sessionSecrets(secrets)
+	if len(keys) == 0 {
+		keys = [][]byte{[]byte(randomToken(32))}
+	}
+	s := &cookieSealer{}
+	for _, k := range keys {
+		h := hmac.New(sha256.New, k)
+		h.Write([]byte("cookie encryption"))
+		block, err := aes.NewCipher(h.Sum(nil))
+		if err != nil {
+			panic(err) // the key is 32 bytes
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			panic(err)
+		}
+		s.aeads = append(s.aeads, aead)
+	}
+	return s
+}
+
+// seal encrypts plaintext for the cookie name, which is authenticated along
+// with it so that a value cannot be replayed under a different cookie.
+func (s *cookieSealer) seal(name string, plaintext []byte) string {
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(name)))
+}
+
+// open decrypts raw as produced by seal. It fails for values sealed with a
+// key no longer configured, as well as for tampered ones.
+func (s *cookieSealer) open(name, raw string) ([]byte, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, false
+	}
+	for _, aead := range s.aeads {
+		n := aead.NonceSize()
+		if len(b) < n {
+			return nil, false
+		}
+		if plaintext, err := aead.Open(nil, b[:n], b[n:], []byte(name)); err == nil {
+			return plaintext, true
+		}
+	}
+	return nil, false
+}
+
+// randomToken returns n random bytes, base64 encoded for use in cookies and
+// form fields.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,303 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSessionStoreTTL        = 30 * time.Minute
+	defaultSessionStoreMaxEntries = 10000
+
+	sessionStoreShards        = 16
+	sessionStoreSweepInterval = time.Minute
+)
+
+var (
+	sessionStoreEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "session_store_entries",
+		Help: "Number of sessions with server-side state.",
+	})
+	sessionStoreEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "session_store_evictions_total",
+		Help: "Number of sessions whose server-side state was dropped, by reason: expired, or capacity when the store was full.",
+	}, []string{"reason"})
+)
+
+type ctxKeySessionStore struct{}
+
+// sessionStore keeps server-side state for sessions, for what does not fit
+// in cookies. A session holds values under keys chosen by each feature,
+// encoded as JSON so that every implementation stores the same thing.
+// Features must cope with finding nothing: state expires, and the in-memory
+// store is per replica.
+type sessionStore interface {
+	// get decodes the value stored under key for session id into v, and
+	// reports whether there was one.
+	get(ctx context.Context, id, key string, v interface{}) (bool, error)
+	// set stores v under key for session id.
+	set(ctx context.Context, id, key string, v interface{}) error
+	// delete forgets session id.
+	delete(ctx context.Context, id string) error
+}
+
+// sessionStorePinger is implemented by stores that live in another process,
+// so that /_readyz can check them.
+type sessionStorePinger interface {
+	ping(ctx context.Context) error
+}
+
+// memorySessionStore is a sessionStore in memory. A session expires ttl after
+// it was last used, and when there are more than max sessions the least
+// recently used are evicted. Sessions are spread over shards so that
+// concurrent requests rarely wait on the same lock.
+type memorySessionStore struct {
+	ttl    time.Duration
+	shards [sessionStoreShards]sessionShard
+}
+
+type sessionShard struct {
+	max int
+
+	mu   sync.Mutex
+	lru  *list.List // of *sessionEntry, most recently used first
+	byID map[string]*list.Element
+}
+
+type sessionEntry struct {
+	id     string
+	used   time.Time
+	values map[string][]byte
+}
+
+func newMemorySessionStore(ttl time.Duration, max int) *memorySessionStore {
+	s := &memorySessionStore{ttl: ttl}
+	perShard := max / sessionStoreShards
+	if perShard < 1 {
+		perShard = 1
+	}
+	for i := range s.shards {
+		s.shards[i] = sessionShard{max: perShard, lru: list.New(), byID: make(map[string]*list.Element)}
+	}
+	return s
+}
+
+func (s *memorySessionStore) shard(id string) *sessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &s.shards[h.Sum32()%sessionStoreShards]
+}
+
+func (s *memorySessionStore) get(_ context.Context, id, key string, v interface{}) (bool, error) {
+	sh := s.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e, ok := sh.byID[id]
+	if !ok {
+		return false, nil
+	}
+	entry := e.Value.(*sessionEntry)
+	now := time.Now()
+	if now.Sub(entry.used) >= s.ttl {
+		sh.remove(e, "expired")
+		return false, nil
+	}
+	entry.used = now
+	sh.lru.MoveToFront(e)
+	raw, ok := entry.values[key]
+	if !ok {
+		return false, nil
+	}
+	return true, errors.Wrapf(json.Unmarshal(raw, v), "failed to decode session value %s", key)
+}
+
+func (s *memorySessionStore) set(_ context.Context, id, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode session value %s", key)
+	}
+	sh := s.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	now := time.Now()
+	if e, ok := sh.byID[id]; ok {
+		entry := e.Value.(*sessionEntry)
+		if now.Sub(entry.used) < s.ttl {
+			entry.used = now
+			entry.values[key] = raw
+			sh.lru.MoveToFront(e)
+			return nil
+		}
+		sh.remove(e, "expired")
+	}
+	entry := &sessionEntry{id: id, used: now, values: map[string][]byte{key: raw}}
+	sh.byID[id] = sh.lru.PushFront(entry)
+	sessionStoreEntries.Inc()
+	for sh.lru.Len() > sh.max {
+		sh.remove(sh.lru.Back(), "capacity")
+	}
+	return nil
+}
+
+func (s *memorySessionStore) delete(_ context.Context, id string) error {
+	sh := s.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if e, ok := sh.byID[id]; ok {
+		sh.remove(e, "")
+	}
+	return nil
+}
+
+// sweep drops the sessions that have expired.
+func (s *memorySessionStore) sweep(now time.Time) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		// The least recently used come last, so the expired ones are at
+		// the back.
+		for e := sh.lru.Back(); e != nil && now.Sub(e.Value.(*sessionEntry).used) >= s.ttl; e = sh.lru.Back() {
+			sh.remove(e, "expired")
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// janitor calls sweep every interval until ctx is done.
+func (s *memorySessionStore) janitor(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.sweep(now)
+		}
+	}
+}
+
+// remove drops e, counting it as an eviction for reason unless that is
+// empty. sh.mu must be held.
+func (sh *sessionShard) remove(e *list.Element, reason string) {
+	sh.lru.Remove(e)
+	delete(sh.byID, e.Value.(*sessionEntry).id)
+	sessionStoreEntries.Dec()
+	if reason != "" {
+		sessionStoreEvictions.WithLabelValues(reason).Inc()
+	}
+}
+
+// newSessionStore opens the session store the configuration asks for, or
+// returns nil if it is disabled. An unreachable Redis falls back to the
+// in-memory store unless SESSION_STORE_STRICT is set.
+func newSessionStore(ctx context.Context, log logrus.FieldLogger, cfg *config) (sessionStore, error) {
+	if cfg.sessionStoreTTL <= 0 {
+		return nil, nil
+	}
+	if cfg.sessionStoreKind == "redis" {
+		store := newRedisSessionStore(cfg.redis, cfg.sessionStoreTTL)
+		pingCtx, cancel := context.WithTimeout(ctx, redisStartupTimeout)
+		err := store.ping(pingCtx)
+		cancel()
+		if err == nil {
+			log.WithField("addr", cfg.redis.addr).Info("session store: Redis")
+			return store, nil
+		}
+		store.close()
+		if cfg.sessionStoreStrict {
+			return nil, errors.Wrapf(err, "session store: Redis at %s unreachable", cfg.redis.addr)
+		}
+		log.WithField("error", err).Warnf("session store: Redis at %s unreachable, falling back to memory", cfg.redis.addr)
+	}
+	if cfg.sessionStoreMaxEntries <= 0 {
+		return nil, nil
+	}
+	store := newMemorySessionStore(cfg.sessionStoreTTL, cfg.sessionStoreMaxEntries)
+	go store.janitor(ctx, sessionStoreSweepInterval)
+	return store, nil
+}
+
+// withSessionStore makes store available to handlers through sessionState.
+// It must run after ensureSessionID.
+func withSessionStore(store sessionStore, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store != nil {
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionStore{}, store))
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// sessionValues is the server-side state of one session. Without a store it
+// holds nothing and forgets what it is given. Store errors are logged and
+// otherwise treated as if nothing was stored, as features must cope with
+// that anyway.
+type sessionValues struct {
+	ctx   context.Context
+	store sessionStore
+	id    string
+}
+
+// sessionState returns the server-side state of the session of r.
+func sessionState(r *http.Request) sessionValues {
+	store, _ := r.Context().Value(ctxKeySessionStore{}).(sessionStore)
+	return sessionValues{ctx: r.Context(), store: store, id: sessionID(r)}
+}
+
+// get decodes the value stored under key into v, and reports whether there
+// was one.
+func (s sessionValues) get(key string, v interface{}) bool {
+	if s.store == nil || s.id == "" {
+		return false
+	}
+	ok, err := s.store.get(s.ctx, s.id, key, v)
+	if err != nil {
+		loggerFromContext(s.ctx).WithField("error", err).WithField("session.key", key).Warn("failed to read session state")
+		return false
+	}
+	return ok
+}
+
+func (s sessionValues) set(key string, v interface{}) {
+	if s.store == nil || s.id == "" {
+		return
+	}
+	if err := s.store.set(s.ctx, s.id, key, v); err != nil {
+		loggerFromContext(s.ctx).WithField("error", err).WithField("session.key", key).Warn("failed to write session state")
+	}
+}
+
+// clear forgets the whole session, e.g. on logout.
+func (s sessionValues) clear() {
+	if s.store == nil || s.id == "" {
+		return
+	}
+	if err := s.store.delete(s.ctx, s.id); err != nil {
+		loggerFromContext(s.ctx).WithField("error", err).Warn("failed to clear session state")
+	}
+}
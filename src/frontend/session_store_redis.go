@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisSessionKeyPrefix = "frontend:session:"
+
+	// redisStartupTimeout bounds the check that Redis is reachable at
+	// startup.
+	redisStartupTimeout = 3 * time.Second
+)
+
+// redisSessionStore is a sessionStore in Redis, shared by every replica. Each
+// session is a hash of its JSON-encoded values, expiring ttl after it was
+// last used. Redis bounds the number of sessions through its maxmemory
+// policy rather than the store.
+type redisSessionStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// redisConfig holds the REDIS_* settings.
+type redisConfig struct {
+	addr     string
+	password string
+	tls      bool
+	poolSize int // 0 for the go-redis default
+}
+
+func newRedisSessionStore(cfg redisConfig, ttl time.Duration) *redisSessionStore {
+	opts := &redis.Options{Addr: cfg.addr, Password: cfg.password, PoolSize: cfg.poolSize}
+	if cfg.tls {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return &redisSessionStore{client: redis.NewClient(opts), ttl: ttl}
+}
+
+func redisSessionKey(id string) string {
+	return redisSessionKeyPrefix + id
+}
+
+func (s *redisSessionStore) get(ctx context.Context, id, key string, v interface{}) (bool, error) {
+	k := redisSessionKey(id)
+	pipe := s.client.TxPipeline()
+	value := pipe.HGet(ctx, k, key)
+	pipe.Expire(ctx, k, s.ttl)
+	if _, err := pipe.Exec(ctx); errors.Is(err, redis.Nil) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "failed to read session from Redis")
+	}
+	raw, err := value.Bytes()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read session from Redis")
+	}
+	return true, errors.Wrapf(json.Unmarshal(raw, v), "failed to decode session value %s", key)
+}
+
+func (s *redisSessionStore) set(ctx context.Context, id, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode session value %s", key)
+	}
+	k := redisSessionKey(id)
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, k, key, raw)
+	pipe.Expire(ctx, k, s.ttl)
+	_, err = pipe.Exec(ctx)
+	return errors.Wrap(err, "failed to write session to Redis")
+}
+
+func (s *redisSessionStore) delete(ctx context.Context, id string) error {
+	return errors.Wrap(s.client.Del(ctx, redisSessionKey(id)).Err(), "failed to delete session from Redis")
+}
+
+func (s *redisSessionStore) ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *redisSessionStore) close() error {
+	return s.client.Close()
+}
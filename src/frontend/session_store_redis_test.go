@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestRedisStore(t *testing.T) (*redisSessionStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	s := newRedisSessionStore(redisConfig{addr: mr.Addr()}, time.Minute)
+	t.Cleanup(func() { s.close() })
+	return s, mr
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	testSessionStore(t, s)
+	if got := mr.TTL(redisSessionKey("b")); got != time.Minute {
+		t.Errorf("session TTL = %v, want %v", got, time.Minute)
+	}
+}
+
+func TestRedisSessionStoreExpires(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	s.set(context.Background(), "a", "k", 1)
+	mr.FastForward(45 * time.Second)
+	if !has(t, s, "a", "k") {
+		t.Fatal("session expired before its TTL")
+	}
+	// Reading the session extended it.
+	mr.FastForward(45 * time.Second)
+	if !has(t, s, "a", "k") {
+		t.Fatal("session expired although it was used")
+	}
+	mr.FastForward(2 * time.Minute)
+	if has(t, s, "a", "k") {
+		t.Error("session outlived its TTL")
+	}
+}
+
+func TestNewSessionStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := logrus.New()
+	mr := miniredis.RunT(t)
+	cfg := &config{sessionStoreTTL: time.Minute, sessionStoreMaxEntries: 100, sessionStoreKind: "redis", redis: redisConfig{addr: mr.Addr()}}
+
+	store, err := newSessionStore(ctx, log, cfg)
+	if _, ok := store.(*redisSessionStore); !ok || err != nil {
+		t.Fatalf("newSessionStore = %T, %v; want Redis", store, err)
+	}
+	store.(*redisSessionStore).close()
+
+	mr.Close()
+	store, err = newSessionStore(ctx, log, cfg)
+	if _, ok := store.(*memorySessionStore); !ok || err != nil {
+		t.Errorf("Redis down: newSessionStore = %T, %v; want the memory fallback", store, err)
+	}
+	cfg.sessionStoreStrict = true
+	if store, err = newSessionStore(ctx, log, cfg); err == nil {
+		t.Errorf("Redis down and strict: newSessionStore = %T, want an error", store)
+	}
+
+	cfg.sessionStoreTTL = 0
+	if store, err := newSessionStore(ctx, log, cfg); store != nil || err != nil {
+		t.Errorf("disabled: newSessionStore = %T, %v; want nil", store, err)
+	}
+}
+
+func TestReadinessChecksSessionStore(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	s, mr := newTestRedisStore(t)
+	fe.sessions = s
+	if st := fe.checkReadiness(context.Background()).Dependencies["sessionstore"]; st.State != "REACHABLE" || st.Error != "" {
+		t.Errorf("sessionstore = %+v, want reachable", st)
+	}
+	mr.Close()
+	report := fe.checkReadiness(context.Background())
+	if st := report.Dependencies["sessionstore"]; st.Error == "" || report.Status != "unavailable" {
+		t.Errorf("Redis down: status %s, sessionstore = %+v", report.Status, st)
+	}
+
+	fe.sessions = newMemorySessionStore(time.Minute, 100)
+	if _, ok := fe.checkReadiness(context.Background()).Dependencies["sessionstore"]; ok {
+		t.Error("in-memory store reported as a dependency")
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// has reports whether store holds key for session id.
+func has(t *testing.T, store sessionStore, id, key string) bool {
+	t.Helper()
+	var v interface{}
+	ok, err := store.get(context.Background(), id, key, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+// testSessionStore checks the behavior every sessionStore shares.
+func testSessionStore(t *testing.T, s sessionStore) {
+	ctx := context.Background()
+	var n int
+	if ok, err := s.get(ctx, "a", "k", &n); ok || err != nil {
+		t.Errorf("empty store: get = %v, %v", ok, err)
+	}
+	for _, set := range []struct {
+		id, key string
+		v       interface{}
+	}{{"a", "k", 1}, {"a", "other", "x"}, {"b", "k", 2}} {
+		if err := s.set(ctx, set.id, set.key, set.v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := s.get(ctx, "a", "k", &n); !ok || err != nil || n != 1 {
+		t.Errorf("get(a, k) = %v, %v, %v; want 1", n, ok, err)
+	}
+	var str string
+	if _, err := s.get(ctx, "a", "other", &str); err != nil || str != "x" {
+		t.Errorf("get(a, other) = %q, %v; want x", str, err)
+	}
+	if _, err := s.get(ctx, "b", "k", &n); err != nil || n != 2 {
+		t.Errorf("get(b, k) = %v, %v; want 2", n, err)
+	}
+	if err := s.set(ctx, "a", "bad", func() {}); err == nil {
+		t.Error("set stored a value that does not encode")
+	}
+	if err := s.delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if has(t, s, "a", "other") {
+		t.Error("deleted session still has values")
+	}
+	if !has(t, s, "b", "k") {
+		t.Error("deleting a session dropped another")
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, newMemorySessionStore(time.Minute, 100))
+}
+
+func TestMemorySessionStoreExpires(t *testing.T) {
+	s := newMemorySessionStore(time.Minute, 100)
+	s.set(context.Background(), "a", "k", 1)
+	before := testutil.ToFloat64(sessionStoreEvictions.WithLabelValues("expired"))
+	s.sweep(time.Now().Add(30 * time.Second))
+	if !has(t, s, "a", "k") {
+		t.Fatal("session expired before its TTL")
+	}
+	s.sweep(time.Now().Add(2 * time.Minute))
+	if has(t, s, "a", "k") {
+		t.Error("session outlived its TTL")
+	}
+	if got := testutil.ToFloat64(sessionStoreEvictions.WithLabelValues("expired")) - before; got != 1 {
+		t.Errorf("%v expired evictions counted, want 1", got)
+	}
+}
+
+func TestMemorySessionStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	s := newMemorySessionStore(time.Minute, 2*sessionStoreShards) // two sessions per shard
+	// Find three sessions of the same shard.
+	var ids []string
+	for i := 0; len(ids) < 3; i++ {
+		id := fmt.Sprintf("s%d", i)
+		if s.shard(id) == s.shard("s0") {
+			ids = append(ids, id)
+		}
+	}
+
+	ctx := context.Background()
+	s.set(ctx, ids[0], "k", 0)
+	s.set(ctx, ids[1], "k", 1)
+	has(t, s, ids[0], "k") // ids[1] is now the least recently used
+	s.set(ctx, ids[2], "k", 2)
+	if has(t, s, ids[1], "k") {
+		t.Error("least recently used session kept")
+	}
+	for _, id := range []string{ids[0], ids[2]} {
+		if !has(t, s, id, "k") {
+			t.Errorf("session %s evicted", id)
+		}
+	}
+}
+
+func TestMemorySessionStoreConcurrent(t *testing.T) {
+	s := newMemorySessionStore(time.Minute, 64)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				id := fmt.Sprintf("s%d", (i*j)%100)
+				var v int
+				s.set(context.Background(), id, "k", j)
+				s.get(context.Background(), id, "k", &v)
+			}
+		}(i)
+	}
+	wg.Wait()
+	n := 0
+	for i := range s.shards {
+		n += s.shards[i].lru.Len()
+	}
+	if n > 64 {
+		t.Errorf("%d sessions kept, want at most 64", n)
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	store := newMemorySessionStore(time.Minute, 100)
+	var got int
+	h := withSessionStore(store, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		s := sessionState(r)
+		got = 0
+		s.get("visits", &got)
+		s.set("visits", got+1)
+	}))
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/", nil))
+	}
+	if got != 1 {
+		t.Errorf("second request saw %v visits, want 1", got)
+	}
+	var v int
+	if store.get(context.Background(), "test-session", "visits", &v); v != 2 {
+		t.Errorf("store holds %v visits, want 2", v)
+	}
+
+	// Without a store, the state is empty and writes are dropped.
+	s := sessionState(newTestRequest(http.MethodGet, "/", nil))
+	s.set("visits", 1)
+	if s.get("visits", &v) {
+		t.Error("state without a store kept a value")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testSessionID = "6a3f1c2e-9d8b-4c7a-8e5f-0b1d2c3e4f5a"
+
+func TestCookieSignerVerify(t *testing.T) {
+	s := newCookieSigner("current")
+	signed := s.sign(cookieSessionID, testSessionID)
+	other := newCookieSigner("other").sign(cookieSessionID, testSessionID)
+
+	tests := []struct {
+		name   string
+		raw    string
+		wantOK bool
+	}{
+		{"valid", signed, true},
+		{"tampered value", "7a3f1c2e-9d8b-4c7a-8e5f-0b1d2c3e4f5a" + signed[len(testSessionID):], false},
+		{"tampered signature", signed[:len(signed)-1] + "A", false},
+		{"truncated signature", signed[:len(signed)-4], false},
+		{"empty signature", testSessionID + ".", false},
+		{"legacy unsigned", testSessionID, false},
+		{"signed with unknown key", other, false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := s.verify(cookieSessionID, tt.raw)
+			if ok != tt.wantOK {
+				t.Fatalf("verify(%q) ok = %v, want %v", tt.raw, ok, tt.wantOK)
+			}
+			if ok && got != testSessionID {
+				t.Errorf("verify(%q) = %q, want %q", tt.raw, got, testSessionID)
+			}
+		})
+	}
+}
+
+func TestCookieSignerBindsName(t *testing.T) {
+	s := newCookieSigner("current")
+	if _, ok := s.verify(cookieCurrency, s.sign(cookieSessionID, testSessionID)); ok {
+		t.Error("value signed for one cookie verified under another name")
+	}
+}
+
+func TestCookieSignerRotation(t *testing.T) {
+	old := newCookieSigner("old")
+	rotated := newCookieSigner("new, old")
+
+	if got, ok := rotated.verify(cookieSessionID, old.sign(cookieSessionID, testSessionID)); !ok || got != testSessionID {
+		t.Errorf("cookie signed with retired key: got (%q, %v), want (%q, true)", got, ok, testSessionID)
+	}
+	if _, ok := old.verify(cookieSessionID, rotated.sign(cookieSessionID, testSessionID)); ok {
+		t.Error("rotated signer still signs with the old key")
+	}
+}
+
+func TestCookieSignerDisabled(t *testing.T) {
+	for _, secrets := range []string{"", " , "} {
+		if s := newCookieSigner(secrets); s != nil {
+			t.Errorf("newCookieSigner(%q) = %v, want nil", secrets, s)
+		}
+	}
+	var s *cookieSigner
+	if got := s.sign(cookieSessionID, testSessionID); got != testSessionID {
+		t.Errorf("nil signer sign = %q, want value unchanged", got)
+	}
+	if got, ok := s.verify(cookieSessionID, testSessionID); !ok || got != testSessionID {
+		t.Errorf("nil signer verify = (%q, %v), want value unchanged", got, ok)
+	}
+}
+
+func TestEnsureSessionIDSigned(t *testing.T) {
+	signer := newCookieSigner("current")
+	signed := signer.sign(cookieSessionID, testSessionID)
+
+	tests := []struct {
+		name      string
+		cookie    string
+		wantReuse bool
+	}{
+		{"no cookie", "", false},
+		{"valid", signed, true},
+		{"tampered", "00000000-0000-0000-0000-000000000000" + signed[len(testSessionID):], false},
+		{"truncated", signed[:len(testSessionID)+5], false},
+		{"legacy unsigned", testSessionID, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotID string
+			h := ensureSessionID(signer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotID = sessionID(r)
+			}))
+			r := newTestRequest(http.MethodGet, "/", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			var issued *http.Cookie
+			for _, c := range w.Result().Cookies() {
+				if c.Name == cookieSessionID {
+					issued = c
+				}
+			}
+			if tt.wantReuse {
+				if gotID != testSessionID {
+					t.Errorf("session ID = %q, want %q", gotID, testSessionID)
+				}
+				if issued != nil {
+					t.Errorf("unexpected Set-Cookie %q for a valid session", issued.Value)
+				}
+				return
+			}
+			if gotID == "" || gotID == testSessionID || gotID == "00000000-0000-0000-0000-000000000000" {
+				t.Errorf("session ID = %q, want a freshly generated one", gotID)
+			}
+			if issued == nil {
+				t.Fatal("no session cookie issued")
+			}
+			if id, ok := signer.verify(cookieSessionID, issued.Value); !ok || id != gotID {
+				t.Errorf("issued cookie %q does not verify to %q", issued.Value, gotID)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	sitemapXMLNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+	// maxSitemapURLs is the most URLs a single sitemap may list, per
+	// sitemaps.org.
+	maxSitemapURLs = 50000
+)
+
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name       `xml:"urlset"`
+	XMLNS   string         `xml:"xmlns,attr"`
+	URLs    []sitemapEntry `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name       `xml:"sitemapindex"`
+	XMLNS    string         `xml:"xmlns,attr"`
+	Sitemaps []sitemapEntry `xml:"sitemap"`
+}
+
+// sitemapDoc is a generated sitemap file, kept both plain and gzipped.
+type sitemapDoc struct {
+	plain, gzipped []byte
+}
+
+// sitemaps generates the sitemap of the shop from the catalog and keeps it
+// for ttl, the catalog cache TTL, rather than rebuilding it for every
+// crawler. When the shop has more than maxURLs pages, /sitemap.xml is an
+// index of /sitemap-1.xml, /sitemap-2.xml and so on.
+type sitemaps struct {
+	origin  string // EXTERNAL_URL, such as https://shop.example.com
+	ttl     time.Duration
+	maxURLs int
+
+	mu       sync.Mutex
+	built    time.Time
+	modified time.Time
+	docs     []sitemapDoc // docs[0] is /sitemap.xml, docs[n] /sitemap-n.xml
+}
+
+func newSitemaps(origin string, ttl time.Duration) *sitemaps {
+	return &sitemaps{origin: origin, ttl: ttl, maxURLs: maxSitemapURLs}
+}
+
+// get returns the sitemap files and when their content last changed,
+// regenerating them from pages once they are older than ttl. If regenerating
+// fails, the previous files are served.
+func (s *sitemaps) get(ctx context.Context, pages func(context.Context) ([]string, time.Time, error)) ([]sitemapDoc, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.docs != nil && time.Since(s.built) < s.ttl {
+		return s.docs, s.modified, nil
+	}
+	paths, modified, err := pages(ctx)
+	if err == nil {
+		var docs []sitemapDoc
+		if docs, err = s.build(paths, modified); err == nil {
+			s.docs, s.modified, s.built = docs, modified, time.Now()
+			return docs, modified, nil
+		}
+	}
+	if s.docs != nil {
+		log.WithField("error", err).Warn("failed to regenerate sitemap, serving the previous one")
+		return s.docs, s.modified, nil
+	}
+	return nil, time.Time{}, err
+}
+
+// build renders the sitemap files listing paths, all last modified at
+// modified.
+func (s *sitemaps) build(paths []string, modified time.Time) ([]sitemapDoc, error) {
+	lastmod := modified.UTC().Format(time.RFC3339)
+	entries := make([]sitemapEntry, len(paths))
+	for i, p := range paths {
+		entries[i] = sitemapEntry{Loc: s.origin + p, LastMod: lastmod}
+	}
+	if len(entries) <= s.maxURLs {
+		doc, err := newSitemapDoc(sitemapURLSet{XMLNS: sitemapXMLNS, URLs: entries})
+		return []sitemapDoc{doc}, err
+	}
+
+	docs := []sitemapDoc{{}}
+	index := sitemapIndex{XMLNS: sitemapXMLNS}
+	for start := 0; start < len(entries); start += s.maxURLs {
+		doc, err := newSitemapDoc(sitemapURLSet{XMLNS: sitemapXMLNS, URLs: entries[start:min(start+s.maxURLs, len(entries))]})
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+		index.Sitemaps = append(index.Sitemaps, sitemapEntry{
+			Loc:     fmt.Sprintf("%s%s/sitemap-%d.xml", s.origin, baseUrl, len(docs)-1),
+			LastMod: lastmod,
+		})
+	}
+	var err error
+	docs[0], err = newSitemapDoc(index)
+	return docs, err
+}
+
+func newSitemapDoc(v interface{}) (sitemapDoc, error) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return sitemapDoc{}, errors.Wrap(err, "failed to encode sitemap")
+	}
+	plain := append([]byte(xml.Header), out...)
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(plain)
+	if err := zw.Close(); err != nil {
+		return sitemapDoc{}, errors.Wrap(err, "failed to compress sitemap")
+	}
+	return sitemapDoc{plain: plain, gzipped: buf.Bytes()}, nil
+}
+
+// sitemapPages lists the paths of the home page, every product page and
+// every category page, with when the catalog they come from was fetched.
+func (fe *frontendServer) sitemapPages(ctx context.Context) ([]string, time.Time, error) {
+	products, err := fe.getProducts(ctx)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "could not retrieve products")
+	}
+	modified := time.Now()
+	if fe.catalog != nil {
+		if t := fe.catalog.listFetched(); !t.IsZero() {
+			modified = t
+		}
+	}
+	paths := []string{baseUrl + "/"}
+	for _, p := range products {
+		paths = append(paths, baseUrl+"/product/"+url.PathEscape(p.GetId()))
+	}
+	for _, c := range productCategories(products...) {
+		paths = append(paths, baseUrl+"/category/"+url.PathEscape(c))
+	}
+	return paths, modified, nil
+}
+
+// sitemapHandler serves /sitemap.xml and, for large catalogs, the
+// /sitemap-{n}.xml files it indexes. URLs in a sitemap must be absolute, so
+// there is none unless EXTERNAL_URL is set.
+func (fe *frontendServer) sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	if fe.sitemap == nil {
+		renderHTTPError(log, r, w, errors.New("there is no sitemap: EXTERNAL_URL is not set"), http.StatusNotFound)
+		return
+	}
+	n := 0
+	if v, ok := mux.Vars(r)["n"]; ok {
+		if n, _ = strconv.Atoi(v); n < 1 {
+			renderHTTPError(log, r, w, errors.Errorf("there is no sitemap %s", v), http.StatusNotFound)
+			return
+		}
+	}
+	docs, modified, err := fe.sitemap.get(r.Context(), fe.sitemapPages)
+	if err != nil {
+		renderGRPCError(log, r, w, errors.Wrap(err, "could not generate sitemap"))
+		return
+	}
+	if n >= len(docs) {
+		renderHTTPError(log, r, w, errors.Errorf("there is no sitemap %d", n), http.StatusNotFound)
+		return
+	}
+
+	body := docs[n].plain
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		body = docs[n].gzipped
+	}
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+}
+
+// acceptsGzip reports whether the Accept-Encoding of r allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				f, err := strconv.ParseFloat(q, 64)
+				return err == nil && f > 0
+			}
+			return true
+		}
+	}
+	return false
+}
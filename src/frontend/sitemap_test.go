@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func newSitemapFrontend(t *testing.T, fb *fakeBackend) *frontendServer {
+	fe := newTestFrontend(t, fb)
+	fe.sitemap = newSitemaps("https://shop.example.com", time.Minute)
+	return fe
+}
+
+func getSitemap(fe *frontendServer, target string, vars map[string]string) *httptest.ResponseRecorder {
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, target, nil), vars)
+	w := httptest.NewRecorder()
+	fe.sitemapHandler(w, r)
+	return w
+}
+
+func TestSitemap(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newSitemapFrontend(t, fb)
+	w := getSitemap(fe, "/sitemap.xml", nil)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/xml") {
+		t.Fatalf("status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var got sitemapURLSet
+	if err := xml.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	var locs []string
+	for _, u := range got.URLs {
+		locs = append(locs, u.Loc)
+		if _, err := time.Parse(time.RFC3339, u.LastMod); err != nil {
+			t.Errorf("%s: lastmod %q: %v", u.Loc, u.LastMod, err)
+		}
+	}
+	for _, want := range []string{
+		"https://shop.example.com/",
+		"https://shop.example.com/product/OLJCESPC7Z",
+		"https://shop.example.com/category/tops",
+	} {
+		if !stringinSlice(locs, want) {
+			t.Errorf("sitemap does not list %s: %v", want, locs)
+		}
+	}
+
+	getSitemap(fe, "/sitemap.xml", nil)
+	if n := fb.callCount("ListProducts"); n != 1 {
+		t.Errorf("ListProducts called %d times, want the sitemap reused", n)
+	}
+}
+
+func TestSitemapGzip(t *testing.T) {
+	fe := newSitemapFrontend(t, newFakeBackend())
+	r := newTestRequest(http.MethodGet, "/sitemap.xml", nil)
+	r.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+	w := httptest.NewRecorder()
+	fe.sitemapHandler(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil || !strings.Contains(string(body), "<urlset") {
+		t.Errorf("gunzipped body %.200q, err %v", body, err)
+	}
+
+	r.Header.Set("Accept-Encoding", "gzip;q=0")
+	w = httptest.NewRecorder()
+	fe.sitemapHandler(w, r)
+	if w.Header().Get("Content-Encoding") != "" || !strings.Contains(w.Body.String(), "<urlset") {
+		t.Error("gzip;q=0 still got a gzipped sitemap")
+	}
+}
+
+func TestSitemapIndex(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newSitemapFrontend(t, fb)
+	fe.sitemap.maxURLs = 3 // home, 3 products and 3 categories: 3 files
+	var index sitemapIndex
+	if err := xml.Unmarshal(getSitemap(fe, "/sitemap.xml", nil).Body.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Sitemaps) != 3 || index.Sitemaps[2].Loc != "https://shop.example.com/sitemap-3.xml" {
+		t.Fatalf("index = %+v", index.Sitemaps)
+	}
+
+	var last sitemapURLSet
+	if err := xml.Unmarshal(getSitemap(fe, "/sitemap-3.xml", map[string]string{"n": "3"}).Body.Bytes(), &last); err != nil {
+		t.Fatal(err)
+	}
+	if len(last.URLs) != 1 {
+		t.Errorf("last sitemap lists %+v, want one URL", last.URLs)
+	}
+	for _, n := range []string{"0", "4"} {
+		if w := getSitemap(fe, "/sitemap-"+n+".xml", map[string]string{"n": n}); w.Code != http.StatusNotFound {
+			t.Errorf("sitemap-%s.xml: status %d, want 404", n, w.Code)
+		}
+	}
+}
+
+func TestSitemapEscapesURLs(t *testing.T) {
+	fb := newFakeBackend()
+	fb.products = append(fb.products, &pb.Product{Id: "A&B", Name: "Odd", Categories: []string{"home & garden"},
+		PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 1}})
+	fe := newSitemapFrontend(t, fb)
+	body := getSitemap(fe, "/sitemap.xml", nil).Body.String()
+	for _, want := range []string{"/product/A&amp;B<", "/category/home%20&amp;%20garden<"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("sitemap does not contain %s: %s", want, body)
+		}
+	}
+}
+
+func TestSitemapWithoutExternalURL(t *testing.T) {
+	fe := newTestFrontend(t, newFakeBackend())
+	if w := getSitemap(fe, "/sitemap.xml", nil); w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", w.Code)
+	}
+	w := httptest.NewRecorder()
+	fe.robotsHandler(w, newTestRequest(http.MethodGet, "/robots.txt", nil))
+	if strings.Contains(w.Body.String(), "Sitemap") {
+		t.Errorf("robots.txt = %q, advertises no sitemap", w.Body.String())
+	}
+
+	fe.sitemap = newSitemaps("https://shop.example.com", time.Minute)
+	w = httptest.NewRecorder()
+	fe.robotsHandler(w, newTestRequest(http.MethodGet, "/robots.txt", nil))
+	if !strings.Contains(w.Body.String(), "\nSitemap: https://shop.example.com/sitemap.xml") {
+		t.Errorf("robots.txt = %q", w.Body.String())
+	}
+}
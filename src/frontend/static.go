@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed static
+var embeddedStatic embed.FS
+
+const (
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	staticCacheControl    = "public, max-age=300"
+)
+
+// fingerprintedAsset matches file names carrying a content hash, such as
+// styles.3f2a9c1d.css. Their content never changes under the same name.
+var fingerprintedAsset = regexp.MustCompile(`\.[0-9a-f]{8,}\.[A-Za-z0-9]+$`)
+
+// staticHandler serves static assets with caching headers and content-hash
+// ETags, answering conditional requests with 304 Not Modified.
+type staticHandler struct {
+	fsys fs.FS
+	// live is set when serving from disk: files may change at any time, so
+	// ETags are recomputed on every request and browsers must revalidate.
+	live bool
+
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+// newStaticHandler serves the assets embedded in the binary, or those in dir
+// when it is set (STATIC_DIR), which allows editing them without a rebuild.
+func newStaticHandler(dir string) http.Handler {
+	if dir != "" {
+		return &staticHandler{fsys: staticFS(dir), live: true}
+	}
+	return &staticHandler{fsys: staticFS(""), etags: make(map[string]string)}
+}
+
+// staticFS returns the static assets: those in dir, or the embedded ones.
+func staticFS(dir string) fs.FS {
+	if dir != "" {
+		return os.DirFS(dir)
+	}
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if !fs.ValidPath(name) {
+		http.NotFound(w, r)
+		return
+	}
+	if info, err := fs.Stat(h.fsys, name); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := fs.ReadFile(h.fsys, name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case fingerprintedAsset.MatchString(name):
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	case !h.live && isAssetURL(r, name):
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	case h.live:
+		w.Header().Set("Cache-Control", "no-cache")
+	default:
+		w.Header().Set("Cache-Control", staticCacheControl)
+	}
+	w.Header().Set("ETag", h.etag(name, data))
+	// ServeContent handles If-None-Match against the ETag set above.
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// isAssetURL reports whether r is for the URL assetURL gives the embedded
+// file name, which changes with its content.
+func isAssetURL(r *http.Request, name string) bool {
+	h, ok := assetHashes()[name]
+	return ok && r.URL.Query().Get("v") == h
+}
+
+func (h *staticHandler) etag(name string, data []byte) string {
+	if h.live {
+		return contentETag(data)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if tag, ok := h.etags[name]; ok {
+		return tag
+	}
+	tag := contentETag(data)
+	h.etags[name] = tag
+	return tag
+}
+
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func serveStatic(h http.Handler, path, etag string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestStaticHandlerEmbedded(t *testing.T) {
+	h := newStaticHandler("")
+
+	w := serveStatic(h, "/styles/styles.css", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/css; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != staticCacheControl {
+		t.Errorf("Cache-Control = %q, want %q", cc, staticCacheControl)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	w = serveStatic(h, "/styles/styles.css", etag)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("conditional GET: got status %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if w.Body.Len() != 0 {
+		t.Error("304 response has a body")
+	}
+
+	for _, p := range []string{"/missing.css", "/styles", "/../main.go"} {
+		if w := serveStatic(h, p, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", p, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestStaticHandlerDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("app.js", "one")
+	write("app.0123abcd.js", "fingerprinted")
+	h := newStaticHandler(dir)
+
+	w := serveStatic(h, "/app.js", "")
+	if cc := w.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", cc)
+	}
+	etag := w.Header().Get("ETag")
+
+	// Edits show up immediately, with a new ETag.
+	write("app.js", "two")
+	w = serveStatic(h, "/app.js", etag)
+	if w.Code != http.StatusOK || w.Body.String() != "two" {
+		t.Errorf("after edit: got status %d and body %q, want 200 and the new content", w.Code, w.Body)
+	}
+
+	w = serveStatic(h, "/app.0123abcd.js", "")
+	if cc := w.Header().Get("Cache-Control"); cc != immutableCacheControl {
+		t.Errorf("fingerprinted asset Cache-Control = %q, want %q", cc, immutableCacheControl)
+	}
+}
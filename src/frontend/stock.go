@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// lowStockThreshold is the stock level at and below which product pages
+// tell how many are left.
+const lowStockThreshold = 5
+
+// errOutOfStock is returned when a cart would hold more of a product than
+// is in stock.
+var errOutOfStock = errors.New("not enough in stock")
+
+// stockLevels is the number of each product left, for demos: the backends
+// know nothing of stock, so it is kept by each replica in memory, loaded
+// from STOCK_FILE at startup and decremented as orders are placed. Products
+// it does not list are unlimited, as are all products of a nil stockLevels.
+type stockLevels struct {
+	mu     sync.Mutex
+	levels map[string]int // by product ID
+}
+
+// loadStock reads stock levels from a JSON file mapping product IDs to the
+// number in stock, e.g. {"OLJCESPC7Z": 3, "66VCHSJNUP": 0}.
+func loadStock(path string) (*stockLevels, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read stock levels")
+	}
+	var levels map[string]int
+	if err := json.Unmarshal(b, &levels); err != nil {
+		return nil, errors.Wrapf(err, "could not parse stock levels in %s", path)
+	}
+	for id, n := range levels {
+		if n < 0 {
+			return nil, errors.Errorf("stock of product %s: %d is negative", id, n)
+		}
+	}
+	return &stockLevels{levels: levels}, nil
+}
+
+// available returns the number of product id left, and whether it is
+// limited at all.
+func (s *stockLevels) available(id string) (n int, limited bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, limited = s.levels[id]
+	return n, limited
+}
+
+// check returns errOutOfStock if quantity of product id is more than is
+// left. It only advises: the stock is taken when orders are placed.
+func (s *stockLevels) check(id string, quantity int) error {
+	if n, limited := s.available(id); limited && quantity > n {
+		return errors.Wrapf(errOutOfStock, "only %d of product %s left, %d wanted", n, id, quantity)
+	}
+	return nil
+}
+
+// take removes the items of a placed order from the stock. The order has
+// gone through already, so levels stop at zero rather than being refused,
+// and the products that ran short are returned.
+func (s *stockLevels) take(items []*pb.OrderItem) (short []string) {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, it := range items {
+		id := it.GetItem().GetProductId()
+		n, limited := s.levels[id]
+		if !limited {
+			continue
+		}
+		n -= int(it.GetItem().GetQuantity())
+		if n < 0 {
+			short = append(short, id)
+			n = 0
+		}
+		s.levels[id] = n
+	}
+	return short
+}
+
+// stockView is the stock of a product as shown on its page.
+type stockView struct {
+	Left       int
+	Low        bool // only a few left
+	OutOfStock bool
+}
+
+func (s *stockLevels) view(id string) stockView {
+	n, limited := s.available(id)
+	if !limited {
+		return stockView{}
+	}
+	return stockView{Left: n, Low: n > 0 && n <= lowStockThreshold, OutOfStock: n == 0}
+}
+
+// quantityOptions are the quantities the product page offers to add.
+var quantityOptions = []int{1, 2, 3, 4, 5, 10}
+
+// quantityChoices returns the quantityOptions there are enough of product id
+// for.
+func (s *stockLevels) quantityChoices(id string) []int {
+	n, limited := s.available(id)
+	if !limited {
+		return quantityOptions
+	}
+	var out []int
+	for _, q := range quantityOptions {
+		if q <= n {
+			out = append(out, q)
+		}
+	}
+	return out
+}
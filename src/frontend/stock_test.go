@@ -0,0 +1,155 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// stockFrom writes src to a stock file and loads it.
+func stockFrom(t *testing.T, src string) *stockLevels {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stock.json")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadStock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLoadStock(t *testing.T) {
+	s := stockFrom(t, `{"OLJCESPC7Z": 3, "66VCHSJNUP": 0}`)
+	if n, limited := s.available("OLJCESPC7Z"); n != 3 || !limited {
+		t.Errorf("sunglasses: %d, limited %v", n, limited)
+	}
+	if _, limited := s.available("1YMWWN1N4O"); limited {
+		t.Error("unlisted product is limited")
+	}
+	if _, limited := (*stockLevels)(nil).available("OLJCESPC7Z"); limited {
+		t.Error("nil stock is limited")
+	}
+
+	path := filepath.Join(t.TempDir(), "stock.json")
+	os.WriteFile(path, []byte(`{"OLJCESPC7Z": -1}`), 0o644)
+	if _, err := loadStock(path); err == nil {
+		t.Error("negative stock: no error")
+	}
+}
+
+func TestStockView(t *testing.T) {
+	s := stockFrom(t, `{"A": 3, "B": 0, "C": 50}`)
+	for id, want := range map[string]stockView{
+		"A": {Left: 3, Low: true},
+		"B": {OutOfStock: true},
+		"C": {Left: 50},
+		"D": {},
+	} {
+		if got := s.view(id); got != want {
+			t.Errorf("%s: %+v, want %+v", id, got, want)
+		}
+	}
+	if got := s.quantityChoices("A"); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("quantities of A = %v", got)
+	}
+}
+
+func TestStockTakeConcurrently(t *testing.T) {
+	s := stockFrom(t, `{"OLJCESPC7Z": 100}`)
+	order := []*pb.OrderItem{{Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 2}}, {Item: &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 1}}}
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		shortOrder int
+	)
+	for i := 0; i < 60; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if short := s.take(order); len(short) > 0 {
+				mu.Lock()
+				shortOrder++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if n, _ := s.available("OLJCESPC7Z"); n != 0 || shortOrder != 10 {
+		t.Errorf("%d left and %d orders short, want 0 and 10", n, shortOrder)
+	}
+	if _, limited := s.available("66VCHSJNUP"); limited {
+		t.Error("unlimited product became limited")
+	}
+}
+
+func TestAddToCartOutOfStock(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, fb)
+	fe.stock = stockFrom(t, `{"OLJCESPC7Z": 3}`)
+
+	add := func(quantity string, xhr bool) *httptest.ResponseRecorder {
+		r := newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity="+quantity))
+		if xhr {
+			r.Header.Set("X-Requested-With", "XMLHttpRequest")
+			r.Header.Set("Accept", "application/json")
+		}
+		w := httptest.NewRecorder()
+		fe.addToCartHandler(w, r)
+		return w
+	}
+	if w := add("2", false); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "only 3 of product OLJCESPC7Z left") {
+		t.Errorf("two more: status %d: %.500s", w.Code, w.Body)
+	}
+	if w := add("2", true); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "out_of_stock") {
+		t.Errorf("two more by script: status %d: %s", w.Code, w.Body)
+	}
+	if w := add("1", false); w.Code != http.StatusFound {
+		t.Errorf("one more: status %d", w.Code)
+	}
+}
+
+func TestOrderTakesStock(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, fb)
+	fe.stock = stockFrom(t, `{"OLJCESPC7Z": 2}`)
+
+	if w := placeTestOrder(t, fe); w.Code != http.StatusOK {
+		t.Fatalf("checkout: status %d", w.Code)
+	}
+	if err := fe.stock.check("OLJCESPC7Z", 1); !errors.Is(err, errOutOfStock) {
+		t.Errorf("after the order: %v, want out of stock", err)
+	}
+	w := httptest.NewRecorder()
+	fe.productHandler(w, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"}))
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "Out of stock") {
+		t.Errorf("product page: status %d, not out of stock", w.Code)
+	}
+}
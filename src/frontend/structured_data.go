@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// productMeta describes a product page to link previews and search engines:
+// Open Graph tags and a schema.org Product in JSON-LD. The header template
+// renders it in the <head> of the page; html/template marshals JSONLD with
+// its JavaScript escaping, so product text cannot close the script element.
+type productMeta struct {
+	OpenGraph openGraph
+	JSONLD    ldProduct
+}
+
+// openGraph holds the og: properties of a product page. Image and the price
+// are empty when the product has none.
+type openGraph struct {
+	Title         string
+	Description   string
+	URL           string
+	Image         string
+	PriceAmount   string
+	PriceCurrency string
+}
+
+// ldProduct is a https://schema.org/Product.
+type ldProduct struct {
+	Context     string   `json:"@context"`
+	Type        string   `json:"@type"`
+	SKU         string   `json:"sku"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Image       []string `json:"image,omitempty"`
+	Category    string   `json:"category,omitempty"`
+	URL         string   `json:"url"`
+	Offers      *ldOffer `json:"offers,omitempty"`
+}
+
+// ldOffer is a https://schema.org/Offer.
+type ldOffer struct {
+	Type          string `json:"@type"`
+	Price         string `json:"price"`
+	PriceCurrency string `json:"priceCurrency"`
+	Availability  string `json:"availability"`
+	URL           string `json:"url"`
+}
+
+// newProductMeta describes p, sold at price, at pageURL. Open Graph and
+// JSON-LD want absolute URLs, so picture paths are resolved against origin.
+// A product without a picture gets no image, and one without a price, or
+// priced at zero, gets no offer rather than being advertised as free.
+func newProductMeta(p *pb.Product, price *pb.Money, origin, pageURL string) productMeta {
+	var image string
+	if pic := p.GetPicture(); pic != "" {
+		if u, err := url.Parse(pic); err == nil && u.IsAbs() {
+			image = pic
+		} else {
+			image = origin + baseUrl + pic
+		}
+	}
+	meta := productMeta{
+		OpenGraph: openGraph{
+			Title:       p.GetName(),
+			Description: p.GetDescription(),
+			URL:         pageURL,
+			Image:       image,
+		},
+		JSONLD: ldProduct{
+			Context:     "https://schema.org",
+			Type:        "Product",
+			SKU:         p.GetId(),
+			Name:        p.GetName(),
+			Description: p.GetDescription(),
+			Category:    strings.Join(p.GetCategories(), ", "),
+			URL:         pageURL,
+		},
+	}
+	if image != "" {
+		meta.JSONLD.Image = []string{image}
+	}
+	if price != nil && !money.IsZero(*price) && price.GetCurrencyCode() != "" {
+		amount := money.Amount(*price)
+		meta.OpenGraph.PriceAmount = amount
+		meta.OpenGraph.PriceCurrency = price.GetCurrencyCode()
+		meta.JSONLD.Offers = &ldOffer{
+			Type:          "Offer",
+			Price:         amount,
+			PriceCurrency: price.GetCurrencyCode(),
+			// The catalog does not track stock: everything it lists is
+			// for sale.
+			Availability: "https://schema.org/InStock",
+			URL:          pageURL,
+		}
+	}
+	return meta
+}
+
+// origin returns the scheme and host the shop is reached at: EXTERNAL_URL
+// if set, or else as told by r.
+func (fe *frontendServer) origin(r *http.Request) string {
+	if fe.externalURL != "" {
+		return fe.externalURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// jsonLD returns the JSON-LD block of a page, decoded.
+func jsonLD(t *testing.T, body string) map[string]interface{} {
+	t.Helper()
+	_, rest, ok := strings.Cut(body, `<script type="application/ld+json">`)
+	block, _, _ := strings.Cut(rest, "</script>")
+	if !ok {
+		t.Fatal("page has no JSON-LD")
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(block), &v); err != nil {
+		t.Fatalf("JSON-LD %q does not parse: %v", block, err)
+	}
+	return v
+}
+
+func TestNewProductMeta(t *testing.T) {
+	p := &pb.Product{Id: "OLJCESPC7Z", Name: "Sunglasses", Description: "Add a modern touch.",
+		Picture: "/static/img/products/sunglasses.jpg", Categories: []string{"accessories"}}
+	price := &pb.Money{CurrencyCode: "EUR", Units: 17, Nanos: 500000000}
+	meta := newProductMeta(p, price, "https://shop.example.com", "https://shop.example.com/product/OLJCESPC7Z")
+
+	og := meta.OpenGraph
+	if og.Image != "https://shop.example.com/static/img/products/sunglasses.jpg" || og.PriceAmount != "17.50" || og.PriceCurrency != "EUR" {
+		t.Errorf("Open Graph = %+v", og)
+	}
+	b, err := json.Marshal(meta.JSONLD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ld map[string]interface{}
+	if err := json.Unmarshal(b, &ld); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"@context": "https://schema.org", "@type": "Product", "sku": "OLJCESPC7Z", "name": "Sunglasses", "category": "accessories"} {
+		if ld[k] != want {
+			t.Errorf("%s = %v, want %q", k, ld[k], want)
+		}
+	}
+	offer, _ := ld["offers"].(map[string]interface{})
+	for k, want := range map[string]string{"@type": "Offer", "price": "17.50", "priceCurrency": "EUR", "availability": "https://schema.org/InStock"} {
+		if offer[k] != want {
+			t.Errorf("offers.%s = %v, want %q", k, offer[k], want)
+		}
+	}
+}
+
+func TestNewProductMetaWithoutPictureOrPrice(t *testing.T) {
+	p := &pb.Product{Id: "FREE", Name: "Sticker"}
+	for _, price := range []*pb.Money{nil, {CurrencyCode: "USD"}} {
+		meta := newProductMeta(p, price, "https://shop.example.com", "https://shop.example.com/product/FREE")
+		if meta.OpenGraph.Image != "" || meta.OpenGraph.PriceAmount != "" || meta.JSONLD.Image != nil || meta.JSONLD.Offers != nil {
+			t.Errorf("price %v: meta = %+v, want no image and no offer", price, meta)
+		}
+	}
+
+	p.Picture = "https://cdn.example.com/sticker.png"
+	if got := newProductMeta(p, nil, "https://shop.example.com", "").OpenGraph.Image; got != p.Picture {
+		t.Errorf("image = %q, want the absolute picture URL kept", got)
+	}
+}
+
+func TestProductPageMetadata(t *testing.T) {
+	fb := newFakeBackend()
+	fb.products[0].Name = `Sunglasses </script><script>alert(1)</script>`
+	fe := newTestFrontend(t, fb)
+	fe.externalURL = "https://shop.example.com"
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	w := httptest.NewRecorder()
+	fe.productHandler(w, r)
+	body := w.Body.String()
+	for _, want := range []string{
+		`<meta property="og:url" content="https://shop.example.com/product/OLJCESPC7Z">`,
+		`<meta property="og:price:amount" content="19.99">`,
+		`<meta property="og:price:currency" content="USD">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page does not contain %s", want)
+		}
+	}
+	if strings.Contains(body, "<script>alert(1)") {
+		t.Error("product name breaks out of the JSON-LD script")
+	}
+	ld := jsonLD(t, body)
+	if ld["name"] != fb.products[0].Name || ld["@type"] != "Product" {
+		t.Errorf("JSON-LD = %v", ld)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmgrpc"
+	"go.elastic.co/apm/module/apmhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// telemetryBackend selects how requests and backend calls are traced.
+type telemetryBackend string
+
+const (
+	// telemetryElastic traces with Elastic APM, and with OpenTelemetry as
+	// well, exporting its spans only if ENABLE_TRACING=1.
+	telemetryElastic telemetryBackend = "elastic"
+	// telemetryOTel traces with OpenTelemetry only, exporting to
+	// COLLECTOR_SERVICE_ADDR.
+	telemetryOTel telemetryBackend = "otel"
+	// telemetryNone installs no tracing middleware or interceptors at all.
+	telemetryNone telemetryBackend = "none"
+)
+
+// telemetry applies to every request and backend connection; main sets it
+// from TELEMETRY_BACKEND.
+var telemetry = telemetryElastic
+
+func parseTelemetryBackend(v string) (telemetryBackend, bool) {
+	switch b := telemetryBackend(v); b {
+	case telemetryElastic, telemetryOTel, telemetryNone:
+		return b, true
+	}
+	return "", false
+}
+
+// exportsOTel reports whether OpenTelemetry spans are sent to the collector.
+func (b telemetryBackend) exportsOTel(enableTracing bool) bool {
+	return b == telemetryOTel || b == telemetryElastic && enableTracing
+}
+
+// httpMiddleware wraps the handler chain with the tracing middleware of b.
+// It must wrap logHandler, so that log entries can carry the trace IDs.
+func (b telemetryBackend) httpMiddleware(next http.Handler) http.Handler {
+	switch b {
+	case telemetryElastic:
+		return otelhttp.NewHandler(apmhttp.Wrap(next), "frontend")
+	case telemetryOTel:
+		return otelhttp.NewHandler(next, "frontend")
+	}
+	return next
+}
+
+// unaryInterceptors returns the tracing interceptors of b for unary calls,
+// which start the span of each call.
+func (b telemetryBackend) unaryInterceptors() []grpc.UnaryClientInterceptor {
+	switch b {
+	case telemetryElastic:
+		return []grpc.UnaryClientInterceptor{
+			otelgrpc.UnaryClientInterceptor(),
+			apmgrpc.NewUnaryClientInterceptor(),
+			apmSpanStatusInterceptor,
+		}
+	case telemetryOTel:
+		return []grpc.UnaryClientInterceptor{otelgrpc.UnaryClientInterceptor()}
+	}
+	return nil
+}
+
+func (b telemetryBackend) streamInterceptors() []grpc.StreamClientInterceptor {
+	switch b {
+	case telemetryElastic:
+		return []grpc.StreamClientInterceptor{
+			otelgrpc.StreamClientInterceptor(),
+			apmgrpc.NewStreamClientInterceptor(),
+		}
+	case telemetryOTel:
+		return []grpc.StreamClientInterceptor{otelgrpc.StreamClientInterceptor()}
+	}
+	return nil
+}
+
+// labelSpan sets an attribute on the request's APM transaction and on its
+// OpenTelemetry span, whichever are being recorded, so that both backends
+// carry the same attributes.
+func labelSpan(ctx context.Context, key, value string) {
+	if tx := apm.TransactionFromContext(ctx); tx != nil {
+		tx.Context.SetLabel(key, value)
+	}
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.SetAttributes(attribute.String(key, value))
+	}
+}
+
+// nameSpan names the request's APM transaction and OpenTelemetry span, e.g.
+// after the matched route.
+func nameSpan(ctx context.Context, name string) {
+	if tx := apm.TransactionFromContext(ctx); tx != nil {
+		tx.Name = name
+	}
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.SetName(name)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.elastic.co/apm/apmtest"
+	"go.elastic.co/apm/module/apmhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// tracedChain is the part of the handler chain that labels spans.
+func tracedChain() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/product/{id}", func(http.ResponseWriter, *http.Request) {})
+	r.Use(recordRouteTemplate)
+	return ensureSessionID(nil, r)
+}
+
+func productRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/product/OLJCESPC7Z", nil)
+	r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: "s-1"})
+	return r
+}
+
+func TestSpansCarrySameAttributes(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	apmhttp.Wrap(tracedChain(), apmhttp.WithTracer(tracer.Tracer)).ServeHTTP(httptest.NewRecorder(), productRequest())
+	tracer.Flush(nil)
+	txs := tracer.Payloads().Transactions
+	if len(txs) != 1 {
+		t.Fatalf("got %d transactions, want 1", len(txs))
+	}
+	elastic := map[string]string{"name": txs[0].Name}
+	for _, l := range txs[0].Context.Tags {
+		elastic[l.Key], _ = l.Value.(string)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otelhttp.NewHandler(tracedChain(), "frontend", otelhttp.WithTracerProvider(tp)).ServeHTTP(httptest.NewRecorder(), productRequest())
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	otel := map[string]string{"name": spans[0].Name()}
+	for _, a := range spans[0].Attributes() {
+		otel[string(a.Key)] = a.Value.Emit()
+	}
+
+	for key, want := range map[string]string{
+		"name":       "GET /product/{id}",
+		"route":      "/product/{id}",
+		"session_id": "s-1",
+	} {
+		if elastic[key] != want || otel[key] != want {
+			t.Errorf("%s: elastic %q, otel %q; want %q", key, elastic[key], otel[key], want)
+		}
+	}
+}
+
+func TestTelemetryNoneAddsNothing(t *testing.T) {
+	h := http.NewServeMux()
+	if got := telemetryNone.httpMiddleware(h); got != http.Handler(h) {
+		t.Error("none wraps the handler")
+	}
+	if n := len(telemetryNone.unaryInterceptors()) + len(telemetryNone.streamInterceptors()); n != 0 {
+		t.Errorf("none installs %d interceptors", n)
+	}
+	if len(telemetryOTel.unaryInterceptors()) != 1 || len(telemetryElastic.unaryInterceptors()) != 3 {
+		t.Error("otel should trace calls with otelgrpc only, elastic with otelgrpc and apmgrpc")
+	}
+}
+
+func TestParseTelemetryBackend(t *testing.T) {
+	for v, want := range map[string]bool{"elastic": true, "otel": true, "none": true, "jaeger": false, "": false} {
+		if _, ok := parseTelemetryBackend(v); ok != want {
+			t.Errorf("parseTelemetryBackend(%q) ok = %v, want %v", v, ok, want)
+		}
+	}
+	if !telemetryOTel.exportsOTel(false) || telemetryElastic.exportsOTel(false) || !telemetryElastic.exportsOTel(true) || telemetryNone.exportsOTel(true) {
+		t.Error("exportsOTel: want otel always, elastic only with ENABLE_TRACING")
+	}
+}
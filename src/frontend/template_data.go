@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// commonTemplateDataTimeout bounds each backend call made for the header, so
+// that a slow currency or cart service delays pages by at most this much.
+const commonTemplateDataTimeout = time.Second
+
+// bannerColor illustrates canary deployments.
+var bannerColor = os.Getenv("BANNER_COLOR")
+
+// templateData is the data a page template is executed with.
+type templateData map[string]interface{}
+
+// with layers the fields of a page over d, and returns d.
+func (d templateData) with(page map[string]interface{}) templateData {
+	for k, v := range page {
+		d[k] = v
+	}
+	return d
+}
+
+// commonTemplateData returns the data the layout of every shop page needs:
+// that of injectCommonTemplateData, plus the currency picker, the cart badge
+// and the banner. Pages hide the picker by setting show_currency to false.
+//
+// The currencies and the cart are fetched concurrently, each within
+// commonTemplateDataTimeout. Neither is worth failing a page for: on error,
+// the picker offers only the current currency and the badge is left out.
+// Backend-free pages, such as errors, use injectCommonTemplateData alone.
+func (fe *frontendServer) commonTemplateData(ctx context.Context, r *http.Request) templateData {
+	log := loggerFromContext(r.Context())
+	var (
+		wg         sync.WaitGroup
+		currencies []string
+		count      int
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(ctx, commonTemplateDataTimeout)
+		defer cancel()
+		var err error
+		if currencies, err = fe.getCurrencies(ctx); err != nil {
+			log.WithField("error", err).Warn("failed to retrieve currencies for the header")
+			currencies = []string{currentCurrency(r)}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(ctx, commonTemplateDataTimeout)
+		defer cancel()
+		var err error
+		if count, err = fe.cartCount(ctx, r); err != nil {
+			log.WithField("error", err).Warn("failed to retrieve cart for its item count")
+		}
+	}()
+	wg.Wait()
+
+	return injectCommonTemplateData(r, map[string]interface{}{
+		"show_currency": true,
+		"currencies":    currencies,
+		"cart_size":     count,
+		"banner_color":  bannerColor,
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestPagesIncludeCommonTemplateData(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}, {ProductId: "66VCHSJNUP", Quantity: 2}}
+	fe := newTestFrontend(t, fb)
+	fe.cookieSigner = newCookieSigner("secret")
+	fe.receipts.add("test-session", &receipt{OrderID: "order-1", ShippingTrackingID: "tracking-1", PlacedAt: time.Now()})
+
+	pages := []struct {
+		name     string
+		handler  http.HandlerFunc
+		r        *http.Request
+		currency bool
+	}{
+		{"home", fe.homeHandler, newTestRequest(http.MethodGet, "/", nil), true},
+		{"search", fe.searchHandler, newTestRequest(http.MethodGet, "/search?q=tank", nil), true},
+		{"product", fe.productHandler, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"}), true},
+		{"category", fe.categoryHandler, categoryRequest("accessories", ""), true},
+		{"cart", fe.viewCartHandler, newTestRequest(http.MethodGet, "/cart", nil), true},
+		{"wishlist", fe.viewWishlistHandler, newTestRequest(http.MethodGet, "/wishlist", nil), true},
+		{"order", fe.orderHandler, mux.SetURLVars(newTestRequest(http.MethodGet, "/order/order-1", nil), map[string]string{"id": "order-1"}), false},
+		{"assistant", fe.assistantHandler, newTestRequest(http.MethodGet, "/assistant", nil), false},
+	}
+	for _, p := range pages {
+		t.Run(p.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p.handler(w, p.r)
+			body := w.Body.String()
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %.500s", w.Code, body)
+			}
+			if !strings.Contains(body, `<span class="cart-size-circle">3</span>`) {
+				t.Error("no cart badge counting 3 items")
+			}
+			if got := strings.Contains(body, `<option value="JPY"`); got != p.currency {
+				t.Errorf("currency picker shown %v, want %v", got, p.currency)
+			}
+		})
+	}
+}
+
+func TestCommonTemplateDataFailsSoft(t *testing.T) {
+	fb := newFakeBackend()
+	fb.carts["test-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fb.setError("GetSupportedCurrencies", status.Error(codes.Unavailable, "down"))
+	fb.setError("GetCart", status.Error(codes.Unavailable, "down"))
+	fe := newTestFrontend(t, fb)
+
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want the page rendered without the header data", w.Code)
+	}
+	if strings.Contains(body, "cart-size-circle") {
+		t.Error("cart badge shown with the cart service down")
+	}
+	if !strings.Contains(body, `<option value="USD"`) || strings.Contains(body, `<option value="JPY"`) {
+		t.Error("currency picker should offer only the current currency")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// templateDir is where TEMPLATE_DEV_MODE reads the templates from, relative
+// to the working directory.
+const templateDir = "templates"
+
+var templateRenderDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "template_render_duration_seconds",
+	Help:    "Time taken to execute page templates, by template name.",
+	Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+}, []string{"template"})
+
+// templates renders the pages; main sets it up before serving.
+var templates *templateSet
+
+// templateSet holds the parsed page templates. They are parsed once from the
+// copy embedded in the binary, or, in development, from templateDir, where
+// they are checked for changes and parsed again before each render so that
+// edits show without a restart.
+type templateSet struct {
+	fsys fs.FS
+	live bool
+
+	mu    sync.Mutex
+	tmpl  *template.Template
+	stamp string // of the files tmpl was parsed from, see templateStamp
+}
+
+// loadTemplates parses the embedded templates, or those in templateDir if dev
+// is set. Errors name the file and line at fault.
+func loadTemplates(dev bool) (*templateSet, error) {
+	if dev {
+		return newTemplateSet(os.DirFS(templateDir), true)
+	}
+	sub, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	return newTemplateSet(sub, false)
+}
+
+// newTemplateSet parses the templates in fsys. If live is set, they are
+// checked for changes before each render.
+func newTemplateSet(fsys fs.FS, live bool) (*templateSet, error) {
+	s := &templateSet{fsys: fsys, live: live}
+	if _, err := s.current(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseTemplates(fsys fs.FS) (*template.Template, error) {
+	t, err := template.New("").Funcs(template.FuncMap{
+		"renderMoney":        renderMoney,
+		"renderCurrencyLogo": renderCurrencyLogo,
+		"T":                  translate,
+		"formatDate":         formatDate,
+		"assetURL":           assetURL,
+	}).ParseFS(fsys, "*.html")
+	return t, errors.Wrap(err, "failed to parse templates")
+}
+
+// templateStamp identifies the version of the templates in fsys by their
+// names, sizes and modification times.
+func templateStamp(fsys fs.FS) (string, error) {
+	names, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, name := range names {
+		fi, err := fs.Stat(fsys, name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", name, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// current returns the templates to render with, parsing them again first if
+// they are live and changed on disk. A template that fails to parse is
+// reported on every render until it is fixed.
+func (s *templateSet) current() (*template.Template, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tmpl != nil && !s.live {
+		return s.tmpl, nil
+	}
+	stamp, err := templateStamp(s.fsys)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list templates")
+	}
+	if s.tmpl != nil && stamp == s.stamp {
+		return s.tmpl, nil
+	}
+	t, err := parseTemplates(s.fsys)
+	if err != nil {
+		return nil, err
+	}
+	s.tmpl, s.stamp = t, stamp
+	return t, nil
+}
+
+// ExecuteTemplate renders the template called name with data to w.
+func (s *templateSet) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	t, err := s.current()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = t.ExecuteTemplate(w, name, data)
+	templateRenderDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if templates, err = loadTemplates(false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// writeTemplate writes a page template to dir, dated at, so that changes are
+// seen whatever the resolution of the file system clock.
+func writeTemplate(t *testing.T, dir, name, text string, at time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func render(t *testing.T, s *templateSet, name string) (string, error) {
+	t.Helper()
+	var b strings.Builder
+	err := s.ExecuteTemplate(&b, name, nil)
+	return b.String(), err
+}
+
+func TestTemplateSetReloadsWhenLive(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeTemplate(t, dir, "page.html", `{{ define "page" }}v1{{ end }}`, now)
+
+	live, err := newTemplateSet(os.DirFS(dir), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed, err := newTemplateSet(os.DirFS(dir), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTemplate(t, dir, "page.html", `{{ define "page" }}v2{{ end }}`, now.Add(time.Second))
+	if got, err := render(t, live, "page"); err != nil || got != "v2" {
+		t.Errorf("live = %q, %v; want the edit", got, err)
+	}
+	if got, err := render(t, fixed, "page"); err != nil || got != "v1" {
+		t.Errorf("not live = %q, %v; want the templates parsed at start", got, err)
+	}
+
+	writeTemplate(t, dir, "page.html", "{{ define \"page\" }}\n{{ .Broken }\n{{ end }}", now.Add(2*time.Second))
+	if _, err := render(t, live, "page"); err == nil || !strings.Contains(err.Error(), "page.html:2") {
+		t.Errorf("broken template: err = %v, want its file and line", err)
+	}
+	writeTemplate(t, dir, "page.html", `{{ define "page" }}v3{{ end }}`, now.Add(3*time.Second))
+	if got, err := render(t, live, "page"); err != nil || got != "v3" {
+		t.Errorf("after the fix = %q, %v", got, err)
+	}
+}
+
+func TestNewTemplateSetFailsOnParseError(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "ok.html", `{{ define "ok" }}ok{{ end }}`, time.Now())
+	writeTemplate(t, dir, "bad.html", "\n\n{{ if }}", time.Now())
+	_, err := newTemplateSet(os.DirFS(dir), false)
+	if err == nil || !strings.Contains(err.Error(), "bad.html:3") {
+		t.Errorf("err = %v, want the file and line at fault", err)
+	}
+}
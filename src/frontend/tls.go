@@ -0,0 +1,175 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultACMECacheDir = "/var/cache/frontend/autocert"
+
+// newTLSConfig returns the settings shared by both certificate sources: TLS
+// 1.2 or later, and for 1.2 only forward-secret AEAD cipher suites. TLS 1.3
+// suites are not configurable and are all fine.
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// tlsSetup is how the server gets its certificates: from files, which can be
+// reloaded, or from an ACME CA such as Let's Encrypt.
+type tlsSetup struct {
+	config *tls.Config
+	certs  *certReloader     // set for TLS_CERT_FILE/TLS_KEY_FILE
+	acme   *autocert.Manager // set for ACME_DOMAINS
+}
+
+// tlsSetupFromEnv reads TLS_CERT_FILE and TLS_KEY_FILE, or ACME_DOMAINS (a
+// comma-separated list) and ACME_CACHE_DIR. It returns nil when none is set,
+// in which case the server speaks plain HTTP.
+func tlsSetupFromEnv() (*tlsSetup, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	var domains []string
+	for _, d := range strings.Split(os.Getenv("ACME_DOMAINS"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		if len(domains) > 0 {
+			return nil, errors.New("ACME_DOMAINS cannot be combined with TLS_CERT_FILE")
+		}
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config := newTLSConfig()
+		config.GetCertificate = certs.getCertificate
+		return &tlsSetup{config: config, certs: certs}, nil
+	case len(domains) > 0:
+		cacheDir := os.Getenv("ACME_CACHE_DIR")
+		if cacheDir == "" {
+			cacheDir = defaultACMECacheDir
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      os.Getenv("ACME_EMAIL"),
+		}
+		config := newTLSConfig()
+		config.GetCertificate = m.GetCertificate
+		config.NextProtos = m.TLSConfig().NextProtos // includes the ACME TLS-ALPN-01 protocol
+		return &tlsSetup{config: config, acme: m}, nil
+	}
+	return nil, nil
+}
+
+// certReloader serves a certificate loaded from files, which reload replaces
+// without restarting the server, e.g. after a renewal.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the key pair again. On error the previous certificate stays
+// in use.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load TLS certificate")
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// httpsRedirectHandler redirects every request to the same URL over HTTPS.
+// The target port is HTTPS_PUBLIC_PORT, or the default 443 if unset, since
+// the port the server listens on is rarely the one clients connect to.
+func httpsRedirectHandler(publicPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if publicPort != "" && publicPort != "443" {
+			host = net.JoinHostPort(host, publicPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
+
+// redirectHandler is what the plain HTTP listener serves besides the
+// redirect: ACME HTTP-01 challenges, when certificates come from ACME.
+func (t *tlsSetup) redirectHandler(publicPort string) http.Handler {
+	h := httpsRedirectHandler(publicPort)
+	if t.acme != nil {
+		return t.acme.HTTPHandler(h)
+	}
+	return h
+}
+
+// reloadOnSignal reloads file certificates each time a signal arrives on ch.
+func (t *tlsSetup) reloadOnSignal(log logrus.FieldLogger, ch <-chan os.Signal) {
+	for range ch {
+		if err := t.certs.reload(); err != nil {
+			log.WithField("error", err).Error("failed to reload TLS certificate, keeping the current one")
+			continue
+		}
+		log.Info("reloaded TLS certificate")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for commonName and its key
+// to dir, returning their paths.
+func writeTestCert(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// servedCommonName connects to srv and returns the common name of the
+// certificate it presents. The client sends SNI, without which the server
+// would use httptest's own certificate instead of calling GetCertificate.
+func servedCommonName(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{ServerName: "shop.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSSetupFromEnvDefault(t *testing.T) {
+	if s, err := tlsSetupFromEnv(); s != nil || err != nil {
+		t.Errorf("got %+v, %v with nothing configured, want plain HTTP", s, err)
+	}
+}
+
+func TestTLSSetupFromEnvInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _ := writeTestCert(t, dir, "shop")
+	for name, env := range map[string]map[string]string{
+		"cert without key": {"TLS_CERT_FILE": certFile},
+		"missing files":    {"TLS_CERT_FILE": filepath.Join(dir, "nope.crt"), "TLS_KEY_FILE": filepath.Join(dir, "nope.key")},
+		"files and acme":   {"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": certFile, "ACME_DOMAINS": "shop.example.com"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, err := tlsSetupFromEnv(); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	s, err := tlsSetupFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x, want TLS 1.2", s.config.MinVersion)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.TLS = s.config
+	srv.StartTLS()
+	defer srv.Close()
+	if got := servedCommonName(t, srv); got != "first" {
+		t.Fatalf("served %q, want the first certificate", got)
+	}
+
+	writeTestCert(t, dir, "second")
+	ch := make(chan os.Signal, 1)
+	ch <- os.Interrupt
+	close(ch)
+	s.reloadOnSignal(discardLog, ch)
+	if got := servedCommonName(t, srv); got != "second" {
+		t.Errorf("served %q after reloading, want the second certificate", got)
+	}
+
+	os.WriteFile(certFile, []byte("garbage"), 0o600)
+	if err := s.certs.reload(); err == nil {
+		t.Error("reloading a broken certificate succeeded")
+	}
+	if got := servedCommonName(t, srv); got != "second" {
+		t.Errorf("served %q after a failed reload, want the previous certificate", got)
+	}
+}
+
+func TestTLSSetupFromEnvACME(t *testing.T) {
+	t.Setenv("ACME_DOMAINS", "shop.example.com, www.shop.example.com")
+	t.Setenv("ACME_CACHE_DIR", t.TempDir())
+	s, err := tlsSetupFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.acme == nil || s.config.GetCertificate == nil || !slices.Contains(s.config.NextProtos, "acme-tls/1") {
+		t.Errorf("ACME setup = %+v", s)
+	}
+	if err := s.acme.HostPolicy(context.Background(), "evil.example.com"); err == nil {
+		t.Error("host policy allows a domain that is not configured")
+	}
+
+	// The redirect listener answers HTTP-01 challenges itself.
+	w := httptest.NewRecorder()
+	s.redirectHandler("").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://shop.example.com/.well-known/acme-challenge/x", nil))
+	if w.Code == http.StatusMovedPermanently {
+		t.Error("ACME challenge redirected to HTTPS")
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	for _, tc := range []struct {
+		port, target, want string
+	}{
+		{"", "http://shop.example.com:8081/cart?x=1", "https://shop.example.com/cart?x=1"},
+		{"443", "http://shop.example.com/", "https://shop.example.com/"},
+		{"8443", "http://shop.example.com/product/1", "https://shop.example.com:8443/product/1"},
+	} {
+		w := httptest.NewRecorder()
+		httpsRedirectHandler(tc.port)(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tc.want {
+			t.Errorf("port %q, %s: got %d to %q, want a redirect to %q", tc.port, tc.target, w.Code, w.Header().Get("Location"), tc.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// gRPC metadata keys are lower case.
+var (
+	w3cTraceparentMetadata     = strings.ToLower(apmhttp.W3CTraceparentHeader)
+	tracestateMetadata         = strings.ToLower(apmhttp.TracestateHeader)
+	elasticTraceparentMetadata = strings.ToLower(apmhttp.ElasticTraceparentHeader)
+)
+
+// traceFormats selects the trace context headers exchanged with clients and
+// backends: the W3C traceparent and tracestate, understood by OpenTelemetry,
+// and Elastic's legacy Elastic-Apm-Traceparent.
+type traceFormats struct {
+	w3c     bool
+	elastic bool
+}
+
+// tracePropagation applies to every request and backend connection; main
+// sets it from the configuration.
+var tracePropagation = traceFormats{w3c: true, elastic: true}
+
+// tracePropagationFromEnv reads TRACE_PROPAGATION, a comma-separated list of
+// w3c and elastic. It may be set to none to propagate no trace context.
+func tracePropagationFromEnv(l *envLoader) traceFormats {
+	v := l.str("TRACE_PROPAGATION", "w3c,elastic")
+	if v == "none" {
+		return traceFormats{}
+	}
+	var f traceFormats
+	for _, name := range strings.Split(v, ",") {
+		switch strings.TrimSpace(name) {
+		case "w3c":
+			f.w3c = true
+		case "elastic":
+			f.elastic = true
+		default:
+			l.problem("TRACE_PROPAGATION: unknown format %q, want w3c, elastic or none", name)
+		}
+	}
+	return f
+}
+
+// middleware drops the inbound trace headers of disabled formats, so that
+// neither apmhttp nor otelhttp continue traces from them. It must wrap both.
+func (f traceFormats) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.w3c || !f.elastic {
+			r = r.Clone(r.Context())
+			if !f.w3c {
+				r.Header.Del(apmhttp.W3CTraceparentHeader)
+				r.Header.Del(apmhttp.TracestateHeader)
+			}
+			if !f.elastic {
+				r.Header.Del(apmhttp.ElasticTraceparentHeader)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unaryInterceptor sets the outgoing trace headers of the enabled formats
+// from the current Elastic APM span, or its transaction, and removes those of
+// the disabled ones. The otelgrpc and apmgrpc interceptors each set
+// traceparent from their own trace, so this one must come after both for
+// backends to see the span of the call. Without an APM transaction, the
+// OpenTelemetry traceparent, if any, is left as it is.
+func (f traceFormats) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	if tc, ok := apmTraceContext(ctx); ok {
+		traceparent := apmhttp.FormatTraceparentHeader(tc)
+		if f.w3c {
+			md.Set(w3cTraceparentMetadata, traceparent)
+			if state := tc.State.String(); state != "" {
+				md.Set(tracestateMetadata, state)
+			}
+		}
+		if f.elastic {
+			md.Set(elasticTraceparentMetadata, traceparent)
+		}
+	}
+	if !f.w3c {
+		md.Delete(w3cTraceparentMetadata)
+		md.Delete(tracestateMetadata)
+	}
+	if !f.elastic {
+		md.Delete(elasticTraceparentMetadata)
+	}
+	return invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+}
+
+// apmTraceContext returns the trace context of the APM span in ctx, or else
+// of its transaction.
+func apmTraceContext(ctx context.Context) (apm.TraceContext, bool) {
+	if span := apm.SpanFromContext(ctx); span != nil {
+		return span.TraceContext(), true
+	}
+	if tx := apm.TransactionFromContext(ctx); tx != nil {
+		return tx.TraceContext(), true
+	}
+	return apm.TraceContext{}, false
+}
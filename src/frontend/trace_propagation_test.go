@@ -0,0 +1,173 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.elastic.co/apm/apmtest"
+	"go.elastic.co/apm/module/apmhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// tracedCartCall makes a GetCart call through the backend interceptors for
+// formats, inside an APM transaction if traced, and returns the metadata the
+// cart service received and the ID of the call's span.
+func tracedCartCall(t *testing.T, formats traceFormats, traced bool) (metadata.MD, string) {
+	defer func(v traceFormats) { tracePropagation = v }(tracePropagation)
+	tracePropagation = formats
+
+	var got metadata.MD
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		got, _ = metadata.FromIncomingContext(ctx)
+		return handler(ctx, req)
+	}))
+	pb.RegisterCartServiceServer(srv, newFakeBackend())
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis)
+	defer srv.Stop()
+	conn, err := grpc.NewClient(lis.Addr().String(),
+		append(grpcDialOptions(0, nil, nil), grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	call := func(ctx context.Context) {
+		if _, err := pb.NewCartServiceClient(conn).GetCart(ctx, &pb.GetCartRequest{UserId: "u"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !traced {
+		call(context.Background())
+		return got, ""
+	}
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	_, spans, _ := tracer.WithTransaction(call)
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	return got, fmt.Sprintf("00-%x-%x-01", spans[0].TraceID[:], spans[0].ID[:])
+}
+
+func TestTracePropagationGRPC(t *testing.T) {
+	tests := []struct {
+		name         string
+		formats      traceFormats
+		w3c, elastic bool
+	}{
+		{"both", traceFormats{w3c: true, elastic: true}, true, true},
+		{"w3c", traceFormats{w3c: true}, true, false},
+		{"elastic", traceFormats{elastic: true}, false, true},
+		{"none", traceFormats{}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, want := tracedCartCall(t, tt.formats, true)
+			check := func(key string, on bool) {
+				got := md.Get(key)
+				if on && (len(got) != 1 || got[0] != want) {
+					t.Errorf("%s = %q, want %s", key, got, want)
+				}
+				if !on && len(got) != 0 {
+					t.Errorf("%s = %q, want none", key, got)
+				}
+			}
+			check("traceparent", tt.w3c)
+			check("elastic-apm-traceparent", tt.elastic)
+			if got := md.Get("tracestate"); tt.w3c != (len(got) == 1) {
+				t.Errorf("tracestate = %q", got)
+			}
+		})
+	}
+
+	md, _ := tracedCartCall(t, traceFormats{w3c: true, elastic: true}, false)
+	for _, key := range []string{"traceparent", "tracestate", "elastic-apm-traceparent"} {
+		if got := md.Get(key); len(got) != 0 {
+			t.Errorf("untraced call: %s = %q, want none", key, got)
+		}
+	}
+}
+
+func TestTracePropagationHTTP(t *testing.T) {
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	for _, tt := range []struct {
+		formats      traceFormats
+		w3c, elastic bool
+	}{
+		{traceFormats{w3c: true, elastic: true}, true, true},
+		{traceFormats{w3c: true}, true, false},
+		{traceFormats{}, false, false},
+	} {
+		var got http.Header
+		h := tt.formats.middleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			got = r.Header
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(apmhttp.W3CTraceparentHeader, traceparent)
+		r.Header.Set(apmhttp.TracestateHeader, "es=s:1")
+		r.Header.Set(apmhttp.ElasticTraceparentHeader, traceparent)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if (got.Get("Traceparent") != "") != tt.w3c || (got.Get("Tracestate") != "") != tt.w3c ||
+			(got.Get("Elastic-Apm-Traceparent") != "") != tt.elastic {
+			t.Errorf("%+v: headers = %v", tt.formats, got)
+		}
+	}
+
+	// With W3C on, apmhttp continues the upstream trace.
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	h := tracePropagation.middleware(apmhttp.Wrap(http.NotFoundHandler(), apmhttp.WithTracer(tracer.Tracer)))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(apmhttp.W3CTraceparentHeader, traceparent)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	tracer.Flush(nil)
+	if txs := tracer.Payloads().Transactions; len(txs) != 1 || fmt.Sprintf("%x", txs[0].TraceID[:]) != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("transactions = %+v, want one in the upstream trace", txs)
+	}
+}
+
+func TestTracePropagationFromEnv(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		want    traceFormats
+		problem bool
+	}{
+		{"", traceFormats{w3c: true, elastic: true}, false},
+		{"w3c", traceFormats{w3c: true}, false},
+		{"elastic, w3c", traceFormats{w3c: true, elastic: true}, false},
+		{"none", traceFormats{}, false},
+		{"b3", traceFormats{}, true},
+	} {
+		t.Setenv("TRACE_PROPAGATION", tt.value)
+		var l envLoader
+		if got := tracePropagationFromEnv(&l); got != tt.want || (l.err() != nil) != tt.problem {
+			t.Errorf("TRACE_PROPAGATION=%q: %+v, %v", tt.value, got, l.err())
+		}
+	}
+}
@@ -17,6 +17,8 @@ package validator
 import (
 	"errors"
 	"fmt"
+	"reflect"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -28,39 +30,104 @@ var validate *validator.Validate
 // benefit of caching struct info and validations.
 func init() {
 	validate = validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterTagNameFunc(func(f reflect.StructField) string {
+		return f.Tag.Get("form")
+	})
+	validate.RegisterStructValidation(validateCardExpiry, PlaceOrderPayload{})
+}
+
+// now is replaced in tests.
+var now = time.Now
+
+// validateCardExpiry rejects cards whose expiry month has passed. A card is
+// valid through the end of its expiry month.
+func validateCardExpiry(sl validator.StructLevel) {
+	po := sl.Current().Interface().(PlaceOrderPayload)
+	if po.CcMonth < 1 || po.CcMonth > 12 || po.CcYear == 0 {
+		return // reported by the field validations
+	}
+	y, m, _ := now().Date()
+	if po.CcYear < int64(y) || po.CcYear == int64(y) && po.CcMonth < int64(m) {
+		sl.ReportError(po.CcYear, "credit_card_expiration_year", "CcYear", "expired", "")
+	}
 }
 
 type Payload interface {
 	Validate() error
 }
 
+// AddToCartPayload is the add-to-cart form. The form tags name the fields in
+// the errors returned by FieldErrors.
 type AddToCartPayload struct {
-	Quantity  uint64 `validate:"required,gte=1,lte=10"`
+	Quantity  uint64 `form:"quantity" validate:"required,gte=1,lte=10"`
+	ProductID string `form:"product_id" validate:"required"`
+	Variant   string `form:"variant" validate:"max=32"`
+}
+
+type RemoveFromCartPayload struct {
 	ProductID string `validate:"required"`
+	Variant   string `validate:"max=32"`
 }
 
+type WishlistPayload struct {
+	ProductID string `validate:"required"`
+}
+
+type UpdateCartPayload struct {
+	ProductID   string `validate:"required"`
+	Variant     string `validate:"max=32"`
+	Quantity    int64  `validate:"gte=0,ltefield=MaxQuantity"`
+	MaxQuantity int64  `validate:"gte=1"`
+}
+
+// PlaceOrderPayload is the checkout form. The form tags name the fields in
+// the errors returned by FieldErrors. Whether the state and zip code are
+// required, and the zip code's format, depend on the country, which the
+// caller checks.
 type PlaceOrderPayload struct {
-	Email         string `validate:"required,email"`
-	StreetAddress string `validate:"required,max=512"`
-	ZipCode       int64  `validate:"required"`
-	City          string `validate:"required,max=128"`
-	State         string `validate:"required,max=128"`
-	Country       string `validate:"required,max=128"`
-	CcNumber      string `validate:"required,credit_card"`
-	CcMonth       int64  `validate:"required,gte=1,lte=12"`
-	CcYear        int64  `validate:"required"`
-	CcCVV         int64  `validate:"required"`
+	Email         string `form:"email" validate:"required,email"`
+	StreetAddress string `form:"street_address" validate:"required,max=512"`
+	ZipCode       string `form:"zip_code" validate:"max=10"`
+	City          string `form:"city" validate:"required,max=128"`
+	State         string `form:"state" validate:"max=128"`
+	Country       string `form:"country" validate:"required,max=128"`
+	CcNumber      string `form:"credit_card_number" validate:"required,credit_card"`
+	CcMonth       int64  `form:"credit_card_expiration_month" validate:"required,gte=1,lte=12"`
+	CcYear        int64  `form:"credit_card_expiration_year" validate:"required"`
+	CcCVV         string `form:"credit_card_cvv" validate:"required,number,min=3,max=4"`
+	GiftWrap      bool   `form:"gift_wrap"`
+	OrderNote     string `form:"order_note" validate:"max=250"`
 }
 
 type SetCurrencyPayload struct {
 	Currency string `validate:"required,iso4217"`
 }
 
+type SearchPayload struct {
+	Query string `validate:"required,max=100"`
+}
+
+type PromoCodePayload struct {
+	Code string `form:"promo_code" validate:"required,alphanum,max=32"`
+}
+
 // Implementations of the 'Payload' interface.
 func (ad *AddToCartPayload) Validate() error {
 	return validate.Struct(ad)
 }
 
+func (rc *RemoveFromCartPayload) Validate() error {
+	return validate.Struct(rc)
+}
+
+func (wp *WishlistPayload) Validate() error {
+	return validate.Struct(wp)
+}
+
+func (uc *UpdateCartPayload) Validate() error {
+	return validate.Struct(uc)
+}
+
 func (po *PlaceOrderPayload) Validate() error {
 	return validate.Struct(po)
 }
@@ -69,6 +136,14 @@ func (sc *SetCurrencyPayload) Validate() error {
 	return validate.Struct(sc)
 }
 
+func (sp *SearchPayload) Validate() error {
+	return validate.Struct(sp)
+}
+
+func (pc *PromoCodePayload) Validate() error {
+	return validate.Struct(pc)
+}
+
 // Reusable error response function.
 func ValidationErrorResponse(err error) error {
 	validationErrs, ok := err.(validator.ValidationErrors)
@@ -81,3 +156,46 @@ func ValidationErrorResponse(err error) error {
 	}
 	return fmt.Errorf(msg)
 }
+
+// FieldErrors describes each failed field of a validation error, keyed by the
+// field's form name, in words fit to show next to the form input.
+func FieldErrors(err error) map[string]string {
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return nil
+	}
+	out := make(map[string]string, len(validationErrs))
+	for _, fe := range validationErrs {
+		out[fe.Field()] = fieldErrorMessage(fe)
+	}
+	return out
+}
+
+func fieldErrorMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "This field is required."
+	case "email":
+		return "Enter a valid e-mail address."
+	case "credit_card":
+		return "Enter a valid credit card number."
+	case "number":
+		return "Enter digits only."
+	case "alphanum":
+		return "Enter letters and digits only."
+	case "expired":
+		return "This card has expired."
+	case "gte", "lte":
+		return "This value is out of range."
+	case "min", "max":
+		if fe.Field() == "credit_card_cvv" {
+			return "Enter the 3 or 4 digit security code."
+		}
+		if fe.Tag() == "min" {
+			return "This value is too short."
+		}
+		return "This value is too long."
+	default:
+		return "This value is invalid."
+	}
+}
@@ -17,23 +17,25 @@ package validator
 import (
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestPlaceOrderPassesValidation(t *testing.T) {
+	nextYear := int64(time.Now().Year() + 1)
 	tests := []struct {
 		name          string
 		email         string
 		streetAddress string
-		zipCode       int64
+		zipCode       string
 		city          string
 		state         string
 		country       string
 		ccNumber      string
 		ccMonth       int64
 		ccYear        int64
-		ccCVV         int64
+		ccCVV         string
 	}{
-		{"valid", "test@example.com", "12345 example street", 10004, "New York", "New York", "United States", "5272940000751666", 4, 2024, 584},
+		{"valid", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 4, nextYear, "584"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -57,30 +59,35 @@ func TestPlaceOrderPassesValidation(t *testing.T) {
 }
 
 func TestPlaceOrderFailsValidation(t *testing.T) {
+	nextYear := int64(time.Now().Year() + 1)
 	tests := []struct {
 		name          string
 		email         string
 		streetAddress string
-		zipCode       int64
+		zipCode       string
 		city          string
 		state         string
 		country       string
 		ccNumber      string
 		ccMonth       int64
 		ccYear        int64
-		ccCVV         int64
+		ccCVV         string
 	}{
-		{"invalid email", "test@example", "12345 example street", 10004, "New York", "New York", "United States", "5272940000751666", 4, 2024, 584},
-		{"invalid address (too long)", "test@example.com", strings.Repeat("12345 example street", 513), 10004, "New York", "New York", "United States", "5272940000751666", 4, 2024, 584},
-		{"invalid zip code", "test@example.com", "12345 example street", 0, "New York", "New York", "United States", "5272940000751666", 4, 2024, 584},
-		{"invalid city", "test@example.com", "12345 example street", 10004, "", "New York", "United States", "5272940000751666", 4, 2024, 584},
-		{"invalid state", "test@example.com", "12345 example street", 10004, "New York", "", "United States", "5272940000751666", 4, 2024, 584},
-		{"invalid country", "test@example.com", "12345 example street", 10004, "New York", "New York", "", "5272940000751666", 4, 2024, 584},
-		{"invalid ccNumber", "test@example.com", "12345 example street", 10004, "New York", "New York", "United States", "5272940000", 4, 2024, 584},
-		{"invalid ccMonth (month < 1)", "test@example.com", "12345 example street", 10004, "New York", "New York", "United States", "5272940000751666", 0, 2024, 584},
-		{"invalid ccMonth (month > 12)", "test@example.com", "12345 example street", 10004, "New York", "New York", "United States", "5272940000751666", 13, 2024, 584},
-		{"invalid ccYear (not provided)", "test@example.com", "12345 example street", 10004, "New York", "New York", "United States", "5272940000751666", 12, 0, 584},
-		{"invalid ccCVV (not provided)", "test@example.com", "12345 example street", 10004, "New York", "New York", "United States", "5272940000751666", 12, 2024, 0},
+		{"invalid email", "test@example", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 4, nextYear, "584"},
+		{"invalid address (too long)", "test@example.com", strings.Repeat("12345 example street", 513), "10004", "New York", "New York", "United States", "5272940000751666", 4, nextYear, "584"},
+		{"invalid zip code (too long)", "test@example.com", "12345 example street", "10004-12345", "New York", "New York", "United States", "5272940000751666", 4, nextYear, "584"},
+		{"invalid city", "test@example.com", "12345 example street", "10004", "", "New York", "United States", "5272940000751666", 4, nextYear, "584"},
+		{"invalid country", "test@example.com", "12345 example street", "10004", "New York", "New York", "", "5272940000751666", 4, nextYear, "584"},
+		{"invalid ccNumber", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000", 4, nextYear, "584"},
+		{"invalid ccMonth (month < 1)", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 0, nextYear, "584"},
+		{"invalid ccMonth (month > 12)", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 13, nextYear, "584"},
+		{"invalid ccYear (not provided)", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 12, 0, "584"},
+		{"invalid ccCVV (not provided)", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 12, nextYear, ""},
+		{"invalid ccNumber (fails Luhn check)", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751667", 4, nextYear, "584"},
+		{"invalid ccYear (expired)", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 12, 2020, "584"},
+		{"invalid ccCVV (too short)", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 4, nextYear, "58"},
+		{"invalid ccCVV (too long)", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 4, nextYear, "58412"},
+		{"invalid ccCVV (not a number)", "test@example.com", "12345 example street", "10004", "New York", "New York", "United States", "5272940000751666", 4, nextYear, "5a4"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -103,6 +110,56 @@ func TestPlaceOrderFailsValidation(t *testing.T) {
 	}
 }
 
+func TestCardExpiry(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2030, time.June, 15, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name    string
+		month   int64
+		year    int64
+		wantErr bool
+	}{
+		{"current month", 6, 2030, false},
+		{"later this year", 12, 2030, false},
+		{"next year", 1, 2031, false},
+		{"last month", 5, 2030, true},
+		{"last year", 12, 2029, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := PlaceOrderPayload{
+				Email: "test@example.com", StreetAddress: "12345 example street", ZipCode: "10004",
+				City: "New York", State: "New York", Country: "United States",
+				CcNumber: "5272940000751666", CcMonth: tt.month, CcYear: tt.year, CcCVV: "584",
+			}
+			if err := payload.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("expiry %d/%d: got %v, want error=%v", tt.month, tt.year, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	payload := PlaceOrderPayload{
+		Email: "test@example", StreetAddress: "12345 example street", ZipCode: "10004",
+		City: "", State: "New York", Country: "United States",
+		CcNumber: "5272940000751666", CcMonth: 4, CcYear: 2020, CcCVV: "58",
+	}
+	got := FieldErrors(payload.Validate())
+	for _, field := range []string{"email", "city", "credit_card_expiration_year", "credit_card_cvv"} {
+		if got[field] == "" {
+			t.Errorf("no error for %s in %v", field, got)
+		}
+	}
+	if len(got) != 4 {
+		t.Errorf("got errors for %d fields, want 4: %v", len(got), got)
+	}
+	if FieldErrors(nil) != nil {
+		t.Error("FieldErrors(nil) != nil")
+	}
+}
+
 func TestAddToCartPassesValidation(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -143,6 +200,30 @@ func TestAddToCartFailsValidation(t *testing.T) {
 	}
 }
 
+func TestUpdateCartValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		quantity int64
+		max      int64
+		wantErr  bool
+	}{
+		{"zero removes the line", 0, 10, false},
+		{"within max", 3, 10, false},
+		{"at max", 10, 10, false},
+		{"over max", 11, 10, true},
+		{"negative", -1, 10, true},
+		{"custom max", 25, 50, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := UpdateCartPayload{ProductID: "OLJCESPC7Z", Quantity: tt.quantity, MaxQuantity: tt.max}
+			if err := payload.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validation of %v: got %v, want error=%v", payload, err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestSetCurrencyPassesValidation(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -183,3 +264,43 @@ func TestSetCurrencyFailsValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestSearchValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{"single term", "sunglasses", false},
+		{"at limit", strings.Repeat("a", 100), false},
+		{"multibyte at limit", strings.Repeat("é", 100), false},
+		{"over limit", strings.Repeat("a", 101), true},
+		{"empty", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := SearchPayload{Query: tt.query}
+			if err := payload.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validation of %q: got %v, want error=%v", tt.query, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPromoCodeValidation(t *testing.T) {
+	tests := []struct {
+		code    string
+		wantErr string
+	}{
+		{"SAVE10", ""},
+		{"", "This field is required."},
+		{"SAVE 10", "Enter letters and digits only."},
+		{strings.Repeat("A", 33), "This value is too long."},
+	}
+	for _, tt := range tests {
+		payload := PromoCodePayload{Code: tt.code}
+		if got := FieldErrors(payload.Validate())["promo_code"]; got != tt.wantErr {
+			t.Errorf("%q: error %q, want %q", tt.code, got, tt.wantErr)
+		}
+	}
+}
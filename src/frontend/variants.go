@@ -0,0 +1,185 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// cartVariantsKey is the session state holding the variants in the cart.
+const cartVariantsKey = "cart.variants"
+
+// categoryVariants are the variants of the products of a category, unless
+// VARIANTS_FILE lists the product.
+var categoryVariants = map[string][]string{
+	"clothing": {"S", "M", "L", "XL"},
+	"footwear": {"39", "40", "41", "42", "43", "44"},
+}
+
+// loadVariants reads the variants of products from a JSON file mapping
+// product IDs to their variants, e.g. {"66VCHSJNUP": ["S", "M", "L"]}. An
+// empty list gives a product no variants despite its categories.
+func loadVariants(path string) (map[string][]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read product variants")
+	}
+	var variants map[string][]string
+	if err := json.Unmarshal(b, &variants); err != nil {
+		return nil, errors.Wrapf(err, "could not parse product variants in %s", path)
+	}
+	for id, vs := range variants {
+		seen := make(map[string]bool, len(vs))
+		for _, v := range vs {
+			if v == "" || len(v) > 32 || seen[v] {
+				return nil, errors.Errorf("product %s: invalid or duplicate variant %q", id, v)
+			}
+			seen[v] = true
+		}
+	}
+	return variants, nil
+}
+
+// productVariants returns the variants p is sold in, none if it comes in one
+// kind only.
+func (fe *frontendServer) productVariants(p *pb.Product) []string {
+	if vs, ok := fe.variants[p.GetId()]; ok {
+		return vs
+	}
+	for _, c := range p.GetCategories() {
+		if vs, ok := categoryVariants[c]; ok {
+			return vs
+		}
+	}
+	return nil
+}
+
+func (fe *frontendServer) hasVariant(p *pb.Product, variant string) bool {
+	for _, v := range fe.productVariants(p) {
+		if v == variant {
+			return true
+		}
+	}
+	return false
+}
+
+// cartVariants records the variants of the products in the cart: the
+// quantity of each variant, by product ID then variant. The cart service
+// only knows of one line per product, whose quantity is that of all its
+// variants, so the variants are kept alongside in the session state.
+type cartVariants map[string]map[string]int32
+
+// cartLine is a line of the cart as the user sees it: a product, or one of
+// its variants.
+type cartLine struct {
+	Variant  string // "" for the product without a variant
+	Quantity int32
+}
+
+func sessionCartVariants(r *http.Request) cartVariants {
+	var v cartVariants
+	if sessionState(r).get(cartVariantsKey, &v); v == nil {
+		v = make(cartVariants)
+	}
+	return v
+}
+
+func saveCartVariants(r *http.Request, v cartVariants) {
+	sessionState(r).set(cartVariantsKey, v)
+}
+
+// lines splits item into a line per variant, by variant name, after the
+// line of what has no variant, if any. The cart service has the last word:
+// variant quantities beyond the quantity of item are left out.
+func (v cartVariants) lines(item *pb.CartItem) []cartLine {
+	byVariant := v[item.GetProductId()]
+	names := make([]string, 0, len(byVariant))
+	for name := range byVariant {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	left := item.GetQuantity()
+	var named []cartLine
+	for _, name := range names {
+		q := min(byVariant[name], left)
+		if q > 0 {
+			named = append(named, cartLine{Variant: name, Quantity: q})
+			left -= q
+		}
+	}
+	if left > 0 {
+		return append([]cartLine{{Quantity: left}}, named...)
+	}
+	return named
+}
+
+// line returns the quantity of variant of item in the cart.
+func (v cartVariants) line(item *pb.CartItem, variant string) (int32, bool) {
+	for _, l := range v.lines(item) {
+		if l.Variant == variant {
+			return l.Quantity, true
+		}
+	}
+	return 0, false
+}
+
+// set records quantity of variant of product id, forgetting it for 0. The
+// quantity without a variant is what remains of the cart line, so it is
+// not recorded.
+func (v cartVariants) set(id, variant string, quantity int32) {
+	if variant == "" {
+		return
+	}
+	if quantity <= 0 {
+		delete(v[id], variant)
+		if len(v[id]) == 0 {
+			delete(v, id)
+		}
+		return
+	}
+	if v[id] == nil {
+		v[id] = make(map[string]int32)
+	}
+	v[id][variant] = quantity
+}
+
+// sync forgets the variant quantities of product id that its cart line item
+// no longer holds; item is nil if the product is not in the cart.
+func (v cartVariants) sync(id string, item *pb.CartItem) {
+	var lines []cartLine
+	if item != nil {
+		lines = v.lines(item)
+	}
+	delete(v, id)
+	for _, l := range lines {
+		v.set(id, l.Variant, l.Quantity)
+	}
+}
+
+// cartLineName names a line of the cart in errors and logs.
+func cartLineName(id, variant string) string {
+	if variant == "" {
+		return id
+	}
+	return id + " (" + variant + ")"
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestLoadVariants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "variants.json")
+	if err := os.WriteFile(path, []byte(`{"66VCHSJNUP": [], "OLJCESPC7Z": ["Black", "Tortoise"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fe := newTestFrontend(t, newFakeBackend())
+	var err error
+	if fe.variants, err = loadVariants(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		p    *pb.Product
+		want []string
+	}{
+		{&pb.Product{Id: "OLJCESPC7Z", Categories: []string{"accessories"}}, []string{"Black", "Tortoise"}},
+		{&pb.Product{Id: "66VCHSJNUP", Categories: []string{"clothing"}}, []string{}},
+		{&pb.Product{Id: "L9ECAV7KIM", Categories: []string{"footwear"}}, categoryVariants["footwear"]},
+		{&pb.Product{Id: "9SIQT8TOJO", Categories: []string{"kitchen"}}, nil},
+	} {
+		if got := fe.productVariants(tc.p); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %q, want %q", tc.p.GetId(), got, tc.want)
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"OLJCESPC7Z": ["Black", "Black"]}`), 0o644)
+	if _, err := loadVariants(path); err == nil {
+		t.Error("duplicate variant: no error")
+	}
+}
+
+func TestCartVariantLines(t *testing.T) {
+	v := cartVariants{"66VCHSJNUP": {"M": 1, "S": 2}}
+	item := &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 4}
+	want := []cartLine{{Quantity: 1}, {Variant: "M", Quantity: 1}, {Variant: "S", Quantity: 2}}
+	if got := v.lines(item); !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %+v, want %+v", got, want)
+	}
+
+	// The cart service emptied part of the line behind the frontend's back.
+	item.Quantity = 2
+	v.sync("66VCHSJNUP", item)
+	if want := (cartVariants{"66VCHSJNUP": {"M": 1, "S": 1}}); !reflect.DeepEqual(v, want) {
+		t.Errorf("after sync: %v, want %v", v, want)
+	}
+	v.sync("66VCHSJNUP", nil)
+	if len(v) != 0 {
+		t.Errorf("product not in the cart: %v", v)
+	}
+}
+
+func TestCartVariantsAreSeparateLines(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newTestFrontend(t, fb)
+	store := newMemorySessionStore(time.Hour, 10)
+	post := func(h http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, withSessionState(newTestRequest(http.MethodPost, path, strings.NewReader(form.Encode())), store))
+		return w
+	}
+	tankTop := func(variant, quantity string) url.Values {
+		return url.Values{"product_id": {"66VCHSJNUP"}, "variant": {variant}, "quantity": {quantity}}
+	}
+
+	w := httptest.NewRecorder()
+	fe.productHandler(w, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/66VCHSJNUP", nil), map[string]string{"id": "66VCHSJNUP"}))
+	if body := w.Body.String(); !strings.Contains(body, `name="variant"`) || !strings.Contains(body, "<option>XL</option>") {
+		t.Errorf("product page lacks the size choice: status %d", w.Code)
+	}
+
+	for _, variant := range []string{"", "XXL"} {
+		if w := post(fe.addToCartHandler, "/cart", tankTop(variant, "1")); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("variant %q: status %d", variant, w.Code)
+		}
+	}
+	if w := post(fe.addToCartHandler, "/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "variant": {"M"}, "quantity": {"1"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("variant of a product without variants: status %d", w.Code)
+	}
+	for _, form := range []url.Values{tankTop("S", "2"), tankTop("M", "1"), tankTop("S", "1")} {
+		if w := post(fe.addToCartHandler, "/cart", form); w.Code != http.StatusFound {
+			t.Fatalf("add %v: status %d: %.500s", form, w.Code, w.Body)
+		}
+	}
+
+	lines := func() []cartLine {
+		t.Helper()
+		cart := fb.carts["test-session"]
+		if len(cart) != 1 {
+			t.Fatalf("cart = %v", cart)
+		}
+		return sessionCartVariants(withSessionState(newTestRequest(http.MethodGet, "/cart", nil), store)).lines(cart[0])
+	}
+	if got, want := lines(), []cartLine{{Variant: "M", Quantity: 1}, {Variant: "S", Quantity: 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after adding: %+v, want %+v", got, want)
+	}
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, withSessionState(newTestRequest(http.MethodGet, "/cart", nil), store))
+	if body := w.Body.String(); !strings.Contains(body, "Size: M") || !strings.Contains(body, "Size: S") {
+		t.Errorf("cart page lacks the sizes: %.2000s", body)
+	}
+
+	post(fe.updateCartHandler, "/cart/update", url.Values{"product_id": {"66VCHSJNUP"}, "variant": {"S"}, "quantity": {"2"}})
+	if got, want := lines(), []cartLine{{Variant: "M", Quantity: 1}, {Variant: "S", Quantity: 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after updating S: %+v, want %+v", got, want)
+	}
+	post(fe.removeFromCartHandler, "/cart/remove", url.Values{"product_id": {"66VCHSJNUP"}, "variant": {"M"}})
+	if got, want := lines(), []cartLine{{Variant: "S", Quantity: 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after removing M: %+v, want %+v", got, want)
+	}
+	if w := post(fe.removeFromCartHandler, "/cart/remove", url.Values{"product_id": {"66VCHSJNUP"}, "variant": {"M"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("removing M again: status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	fe.placeOrderHandler(w, withSessionState(newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm())), store))
+	if w.Code != http.StatusOK {
+		t.Fatalf("checkout: status %d", w.Code)
+	}
+	rc, ok := fe.receipts.get("test-session", "order-test-session")
+	if !ok {
+		t.Fatal("no receipt")
+	}
+	if len(rc.Items) != 1 || rc.Items[0].Variant != "S" || rc.Items[0].Quantity != 2 {
+		t.Errorf("receipt items = %+v", rc.Items)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+const maxWishlistItems = 50
+
+// wishlist returns the IDs of the products the user saved for later, most
+// recently added first. It is kept in the signed shop_wishlist cookie.
+func (fe *frontendServer) wishlist(r *http.Request) []string {
+	return fe.productIDsCookie(r, cookieWishlist, maxWishlistItems)
+}
+
+func (fe *frontendServer) setWishlist(w http.ResponseWriter, r *http.Request, ids []string) {
+	fe.setProductIDsCookie(w, r, cookieWishlist, ids)
+}
+
+// wishlistWithout returns ids without id, and whether id was in it.
+func wishlistWithout(ids []string, id string) ([]string, bool) {
+	out := make([]string, 0, len(ids))
+	for _, v := range ids {
+		if v != id {
+			out = append(out, v)
+		}
+	}
+	return out, len(out) != len(ids)
+}
+
+// wishlistProduct validates the product_id of a wishlist form.
+func wishlistProduct(log logrus.FieldLogger, w http.ResponseWriter, r *http.Request) (string, bool) {
+	payload := validator.WishlistPayload{ProductID: r.FormValue("product_id")}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return "", false
+	}
+	return payload.ProductID, true
+}
+
+func (fe *frontendServer) viewWishlistHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	ids := fe.wishlist(r)
+	if r.Method == http.MethodHead {
+		answerHead(w, r, "", 0)
+		return
+	}
+
+	var (
+		common  templateData
+		items   []productView
+		missing []string
+	)
+	g, gctx := errgroup.WithContext(r.Context())
+	g.Go(func() error {
+		common = fe.commonTemplateData(gctx, r)
+		return nil
+	})
+	g.Go(func() (err error) {
+		items, missing, err = fe.lookupProducts(gctx, ids, currentCurrency(r))
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		renderGRPCError(log, r, w, err)
+		return
+	}
+	// Products dropped from the catalog are forgotten.
+	if len(missing) > 0 {
+		for _, id := range missing {
+			ids, _ = wishlistWithout(ids, id)
+		}
+		fe.setWishlist(w, r, ids)
+	}
+
+	if err := templates.ExecuteTemplate(w, "wishlist", common.with(map[string]interface{}{
+		"items": items,
+	})); err != nil {
+		log.Println(err)
+	}
+}
+
+func (fe *frontendServer) addToWishlistHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	id, ok := wishlistProduct(log, w, r)
+	if !ok {
+		return
+	}
+	log.WithField("product", id).Debug("adding to wishlist")
+
+	ids := fe.wishlist(r)
+	if !stringinSlice(ids, id) {
+		if len(ids) >= maxWishlistItems {
+			renderHTTPError(log, r, w, errors.Errorf("the wishlist is full: it holds at most %d products", maxWishlistItems), http.StatusConflict)
+			return
+		}
+		p, err := fe.getProduct(r.Context(), id)
+		if err != nil {
+			renderGRPCError(log, r, w, errors.Wrap(err, "could not retrieve product"))
+			return
+		}
+		fe.setWishlist(w, r, append([]string{p.GetId()}, ids...))
+	}
+	w.Header().Set("location", baseUrl+"/wishlist")
+	w.WriteHeader(http.StatusFound)
+}
+
+func (fe *frontendServer) removeFromWishlistHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	id, ok := wishlistProduct(log, w, r)
+	if !ok {
+		return
+	}
+	log.WithField("product", id).Debug("removing from wishlist")
+
+	ids, found := wishlistWithout(fe.wishlist(r), id)
+	if !found {
+		renderHTTPError(log, r, w, errors.Errorf("product %s is not in the wishlist", id), http.StatusBadRequest)
+		return
+	}
+	fe.setWishlist(w, r, ids)
+	w.Header().Set("location", baseUrl+"/wishlist")
+	w.WriteHeader(http.StatusFound)
+}
+
+// moveToCartHandler adds one of a wishlist product to the cart. The product
+// leaves the wishlist only once it is in the cart, so a failure leaves both
+// as they were. Products sold in variants cannot be added without choosing
+// one, so users are sent to the product page instead.
+func (fe *frontendServer) moveToCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	id, ok := wishlistProduct(log, w, r)
+	if !ok {
+		return
+	}
+	log.WithField("product", id).Debug("moving from wishlist to cart")
+
+	ids, found := wishlistWithout(fe.wishlist(r), id)
+	if !found {
+		renderHTTPError(log, r, w, errors.Errorf("product %s is not in the wishlist", id), http.StatusBadRequest)
+		return
+	}
+	p, err := fe.getProduct(r.Context(), id)
+	if err != nil {
+		renderGRPCError(log, r, w, errors.Wrap(err, "could not retrieve product"))
+		return
+	}
+	if len(fe.productVariants(p)) > 0 {
+		http.Redirect(w, r, baseUrl+"/product/"+url.PathEscape(p.GetId()), http.StatusFound)
+		return
+	}
+	if err := fe.insertCart(r.Context(), sessionID(r), p.GetId(), 1); err != nil {
+		renderGRPCError(log, r, w, errors.Wrap(err, "failed to add to cart"))
+		return
+	}
+	fe.setWishlist(w, r, ids)
+	bumpCartVersion(w)
+	w.Header().Set("location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+func (fe *frontendServer) apiWishlistHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	found, _, err := fe.lookupProducts(r.Context(), fe.wishlist(r), currentCurrency(r))
+	if err != nil {
+		renderAPIGRPCError(log, r, w, err)
+		return
+	}
+	out := apiProducts{Products: make([]apiProduct, 0, len(found))}
+	for _, p := range found {
+		out.Products = append(out.Products, newAPIProduct(p, userLocale(r)))
+	}
+	writeJSON(log, w, http.StatusOK, out)
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newWishlistFrontend(t *testing.T, fb *fakeBackend) *frontendServer {
+	fe := newTestFrontend(t, fb)
+	fe.cookieSigner = newCookieSigner("secret")
+	return fe
+}
+
+// wishlistRequest is a request carrying a wishlist of ids.
+func wishlistRequest(fe *frontendServer, method, target string, form url.Values, ids ...string) *http.Request {
+	var r *http.Request
+	if form != nil {
+		r = newTestRequest(method, target, strings.NewReader(form.Encode()))
+	} else {
+		r = newTestRequest(method, target, nil)
+	}
+	if ids != nil {
+		w := httptest.NewRecorder()
+		fe.setWishlist(w, r, ids)
+		r.AddCookie(w.Result().Cookies()[0])
+	}
+	return r
+}
+
+// wishlistAfter returns the wishlist stored by the response in w, and whether
+// w sets it at all.
+func wishlistAfter(fe *frontendServer, w *httptest.ResponseRecorder) ([]string, bool) {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieWishlist {
+			r := newTestRequest(http.MethodGet, "/wishlist", nil)
+			r.AddCookie(c)
+			return fe.wishlist(r), true
+		}
+	}
+	return nil, false
+}
+
+func TestAddToWishlist(t *testing.T) {
+	full := make([]string, maxWishlistItems)
+	for i := range full {
+		full[i] = fmt.Sprintf("P%d", i)
+	}
+	tests := []struct {
+		name     string
+		product  string
+		before   []string
+		wantCode int
+		want     []string
+	}{
+		{"first", "OLJCESPC7Z", nil, http.StatusFound, []string{"OLJCESPC7Z"}},
+		{"most recent first", "66VCHSJNUP", []string{"OLJCESPC7Z"}, http.StatusFound, []string{"66VCHSJNUP", "OLJCESPC7Z"}},
+		{"already saved", "OLJCESPC7Z", []string{"OLJCESPC7Z"}, http.StatusFound, nil},
+		{"unknown product", "NOPE", nil, http.StatusNotFound, nil},
+		{"missing product", "", nil, http.StatusUnprocessableEntity, nil},
+		{"full", "OLJCESPC7Z", full, http.StatusConflict, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := newWishlistFrontend(t, newFakeBackend())
+			w := httptest.NewRecorder()
+			fe.addToWishlistHandler(w, wishlistRequest(fe, http.MethodPost, "/wishlist",
+				url.Values{"product_id": {tt.product}}, tt.before...))
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			got, set := wishlistAfter(fe, w)
+			if set != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wishlist set %v to %v, want %v", set, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveFromWishlist(t *testing.T) {
+	fe := newWishlistFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	fe.removeFromWishlistHandler(w, wishlistRequest(fe, http.MethodPost, "/wishlist/remove",
+		url.Values{"product_id": {"OLJCESPC7Z"}}, "66VCHSJNUP", "OLJCESPC7Z"))
+	if got, _ := wishlistAfter(fe, w); w.Code != http.StatusFound || !reflect.DeepEqual(got, []string{"66VCHSJNUP"}) {
+		t.Errorf("status %d, wishlist %v; want only 66VCHSJNUP left", w.Code, got)
+	}
+
+	w = httptest.NewRecorder()
+	fe.removeFromWishlistHandler(w, wishlistRequest(fe, http.MethodPost, "/wishlist/remove",
+		url.Values{"product_id": {"1YMWWN1N4O"}}, "66VCHSJNUP"))
+	if _, set := wishlistAfter(fe, w); w.Code != http.StatusBadRequest || set {
+		t.Errorf("removing a product not in the wishlist: status %d, wishlist set %v", w.Code, set)
+	}
+}
+
+func TestMoveToCart(t *testing.T) {
+	fb := newFakeBackend()
+	fe := newWishlistFrontend(t, fb)
+	w := httptest.NewRecorder()
+	fe.moveToCartHandler(w, wishlistRequest(fe, http.MethodPost, "/wishlist/move",
+		url.Values{"product_id": {"OLJCESPC7Z"}}, "66VCHSJNUP", "OLJCESPC7Z"))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/cart" {
+		t.Errorf("status %d to %q, want a redirect to the cart", w.Code, w.Header().Get("Location"))
+	}
+	if got, _ := wishlistAfter(fe, w); !reflect.DeepEqual(got, []string{"66VCHSJNUP"}) {
+		t.Errorf("wishlist = %v, want only 66VCHSJNUP left", got)
+	}
+	if cart := fb.carts["test-session"]; len(cart) != 1 || cart[0].GetProductId() != "OLJCESPC7Z" || cart[0].GetQuantity() != 1 {
+		t.Errorf("cart = %v, want one OLJCESPC7Z", cart)
+	}
+}
+
+func TestMoveToCartFailureKeepsWishlist(t *testing.T) {
+	fb := newFakeBackend()
+	fb.setError("AddItem", status.Error(codes.Unavailable, "down"))
+	fe := newWishlistFrontend(t, fb)
+	w := httptest.NewRecorder()
+	fe.moveToCartHandler(w, wishlistRequest(fe, http.MethodPost, "/wishlist/move",
+		url.Values{"product_id": {"OLJCESPC7Z"}}, "OLJCESPC7Z"))
+	if _, set := wishlistAfter(fe, w); w.Code == http.StatusFound || set {
+		t.Errorf("status %d, wishlist set %v; want an error and the wishlist unchanged", w.Code, set)
+	}
+}
+
+func TestViewWishlist(t *testing.T) {
+	fe := newWishlistFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	fe.viewWishlistHandler(w, wishlistRequest(fe, http.MethodGet, "/wishlist", nil, "GONE", "66VCHSJNUP"))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "Tank Top") || !strings.Contains(body, "$18.99") {
+		t.Errorf("status %d, page does not list the tank top: %.500s", w.Code, body)
+	}
+	if !strings.Contains(body, "/wishlist/move") || strings.Contains(body, "/cart/checkout") {
+		t.Error("page should offer to move items to the cart, and no checkout")
+	}
+	if got, _ := wishlistAfter(fe, w); !reflect.DeepEqual(got, []string{"66VCHSJNUP"}) {
+		t.Errorf("wishlist = %v, want the product no longer in the catalog dropped", got)
+	}
+
+	w = httptest.NewRecorder()
+	fe.viewWishlistHandler(w, wishlistRequest(fe, http.MethodGet, "/wishlist", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Your wishlist is empty") {
+		t.Errorf("empty wishlist: status %d", w.Code)
+	}
+}
+
+func TestAPIWishlist(t *testing.T) {
+	fe := newWishlistFrontend(t, newFakeBackend())
+	w := httptest.NewRecorder()
+	fe.apiWishlistHandler(w, wishlistRequest(fe, http.MethodGet, "/api/wishlist", nil, "1YMWWN1N4O", "GONE", "OLJCESPC7Z"))
+	var got apiProducts
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, p := range got.Products {
+		ids = append(ids, p.ID)
+	}
+	if w.Code != http.StatusOK || !reflect.DeepEqual(ids, []string{"1YMWWN1N4O", "OLJCESPC7Z"}) {
+		t.Errorf("status %d, products %v", w.Code, ids)
+	}
+}
@@ -31,12 +31,17 @@ products = [
     'LS4PSXUNUM',
     'OLJCESPC7Z']
 
+def post(l, path, data=None):
+    # The frontend rejects posts that do not echo its CSRF cookie.
+    token = next((c.value for c in l.client.cookiejar if c.name == 'shop_csrf-token'), '')
+    return l.client.post(path, data, headers={'X-CSRF-Token': token})
+
 def index(l):
     l.client.get("/")
 
 def setCurrency(l):
     currencies = ['EUR', 'USD', 'JPY', 'CAD', 'GBP', 'TRY']
-    l.client.post("/setCurrency",
+    post(l, "/setCurrency",
         {'currency_code': random.choice(currencies)})
 
 def browseProduct(l):
@@ -48,17 +53,17 @@ def viewCart(l):
 def addToCart(l):
     product = random.choice(products)
     l.client.get("/product/" + product)
-    l.client.post("/cart", {
+    post(l, "/cart", {
         'product_id': product,
         'quantity': random.randint(1,10)})
     
 def empty_cart(l):
-    l.client.post('/cart/empty')
+    post(l, '/cart/empty')
 
 def checkout(l):
     addToCart(l)
     current_year = datetime.datetime.now().year+1
-    l.client.post("/cart/checkout", {
+    post(l, "/cart/checkout", {
         'email': fake.email(),
         'street_address': fake.street_address(),
         'zip_code': fake.zipcode(),
@@ -14,13 +14,15 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 # 
+import json
 import os
+import traceback
 
 from google.cloud import secretmanager_v1
 from urllib.parse import unquote
 from langchain_core.messages import HumanMessage
 from langchain_google_genai import ChatGoogleGenerativeAI, GoogleGenerativeAIEmbeddings
-from flask import Flask, request
+from flask import Flask, Response, request, stream_with_context
 
 from langchain_google_alloydb_pg import AlloyDBEngine, AlloyDBVectorStore
 
@@ -105,6 +107,20 @@ def create_app():
             f"{description_response} Here are a list of products that are relevant to it: {relevant_docs} Specifically, this is what the customer has asked for, see if you can accommodate it: {prompt} Start by repeating a brief description of the room's design to the customer, then provide your recommendations. Do your best to pick the most relevant item out of the list of products provided, but if none of them seem relevant, then say that instead of inventing a new product. At the end of the response, add a list of the IDs of the relevant products in the following format for the top 3 results: [<first product ID>], [<second product ID>], [<third product ID>] ")
         print("Final design prompt: ")
         print(design_prompt)
+        if 'text/event-stream' in request.headers.get('Accept', ''):
+            # Stream the answer as Server-Sent Events while it is generated
+            def generate():
+                try:
+                    for chunk in llm.stream(design_prompt):
+                        yield f"data: {json.dumps({'content': chunk.content})}\n\n"
+                except Exception:
+                    # The details stay in the log: they may come from the
+                    # model or other upstream services.
+                    print("Streaming failed:")
+                    traceback.print_exc()
+                    yield f"event: error\ndata: {json.dumps('The assistant could not finish its answer.')}\n\n"
+            return Response(stream_with_context(generate()), mimetype='text/event-stream')
+
         design_response = llm.invoke(
             design_prompt
         )